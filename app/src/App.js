@@ -22,6 +22,7 @@ class App extends React.Component {
             <Route path="/action/:id" exact component={AdminAction}></Route>
             <Route path="/dashboard" exact component={Dashboard}></Route>
             <Route path="/login" exact component={Login}></Route>
+            <Route path="/resubmit/:id" exact component={Application}></Route>
             <Route path="/">
               <Application></Application>
             </Route>
@@ -11,18 +11,34 @@ import {
   Input
 } from "reactstrap";
 import moment from "moment";
-import RequestsService from "../service/RequestsService";
+import RequestsService, { retryAfterMinutes } from "../service/RequestsService";
 import i18next from "i18next";
 import "./AdminAction.css";
 
+// linkError tells expired and used action links apart from invalid ones
+const linkError = error => {
+  if (!error.response) {
+    return "";
+  }
+  if (error.response.status === 410) {
+    return "expired";
+  } else if (error.response.status === 409) {
+    return "used";
+  }
+  return "";
+};
+
 class AdminAction extends React.Component {
   constructor(props) {
     super();
     this.state = {
       currentRequest: {},
       invalid: false,
+      // Set to expired or used for authentic links that are no longer valid
+      linkError: "",
       adminToken: "",
-      note: ""
+      note: "",
+      reason: ""
     };
   }
   componentDidMount() {
@@ -46,7 +62,8 @@ class AdminAction extends React.Component {
     } = this.props;
     RequestsService.verifyAdminToken(params.id, adminToken).catch(error => {
       this.setState({
-        invalid: true
+        invalid: true,
+        linkError: linkError(error)
       });
       return;
     });
@@ -61,7 +78,8 @@ class AdminAction extends React.Component {
       })
       .catch(error => {
         this.setState({
-          invalid: true
+          invalid: true,
+          retryAfter: retryAfterMinutes(error)
         });
         return;
       });
@@ -80,21 +98,55 @@ class AdminAction extends React.Component {
       match: { params }
     } = this.props;
     let note = this.state.note;
+    let reason = this.state.reason;
     let promise;
     if (newStatus === "Denied") {
       promise = RequestsService.denyRequest(
         params.id,
         this.state.adminToken,
-        note
+        note,
+        reason
       );
     } else {
       promise = RequestsService.approveRequest(
         params.id,
         this.state.adminToken,
-        note
+        note,
+        reason
       );
     }
     promise
+      .then(res => {
+        if (res.status === 200) {
+          alert(i18next.t("Action.CompletedMsg"));
+          window.location.reload();
+        } else if (res.status === 202) {
+          // The decision needs the votes of more ops
+          alert(i18next.t("Action.VoteRecordedMsg"));
+          window.location.reload();
+        }
+      })
+      .catch(error => {
+        if (error.response) {
+          if (error.response.status === 400) {
+            alert(i18next.t("Action.InvalidTokenErrMsg"));
+          } else if (error.response.status === 410) {
+            alert(i18next.t("Action.ExpiredLinkMsg"));
+          } else if (error.response.status === 409) {
+            alert(i18next.t("Action.VotedMsg"));
+          } else {
+            alert(i18next.t("Action.InternalErrMsg"));
+          }
+        }
+      });
+  };
+
+  onReview = (event, outcome) => {
+    event.preventDefault();
+    const {
+      match: { params }
+    } = this.props;
+    RequestsService.reviewRequest(params.id, this.state.adminToken, outcome)
       .then(res => {
         if (res.status === 200) {
           alert(i18next.t("Action.CompletedMsg"));
@@ -105,6 +157,10 @@ class AdminAction extends React.Component {
         if (error.response) {
           if (error.response.status === 400) {
             alert(i18next.t("Action.InvalidTokenErrMsg"));
+          } else if (error.response.status === 410) {
+            alert(i18next.t("Action.ExpiredLinkMsg"));
+          } else if (error.response.status === 409) {
+            alert(i18next.t("Action.ReviewedMsg"));
           } else {
             alert(i18next.t("Action.InternalErrMsg"));
           }
@@ -157,6 +213,16 @@ class AdminAction extends React.Component {
                 onChange={this.handleInputChange}
               />
             </FormGroup>
+            <FormGroup>
+              <Input
+                type="textarea"
+                name="reason"
+                maxLength={1000}
+                placeholder={i18next.t("Action.ReasonPlaceHolder")}
+                value={this.state.reason}
+                onChange={this.handleInputChange}
+              />
+            </FormGroup>
           </Form>
           <Button
             className="actionButton"
@@ -187,6 +253,62 @@ class AdminAction extends React.Component {
           </Jumbotron>
         </Container>
       );
+    } else if (
+      !this.state.invalid &&
+      currentRequest &&
+      currentRequest.status === "Approved" &&
+      currentRequest.provisional
+    ) {
+      display = (
+        <Container>
+          <ListGroup>
+            <ListGroupItem active action>
+              {i18next.t("Action.ReviewTitle")}
+            </ListGroupItem>
+            <ListGroupItem action>
+              <strong>{i18next.t("Action.Username")}</strong>{" "}
+              {currentRequest.username}
+            </ListGroupItem>
+            <ListGroupItem disabled action>
+              {i18next.t("Action.Approved")}{" "}
+              {moment
+                .parseZone(currentRequest.processedTimestamp)
+                .local()
+                .fromNow()}
+            </ListGroupItem>
+          </ListGroup>
+          <Button
+            className="actionButton"
+            onClick={e => this.onReview(e, "confirm")}
+            color="success"
+            outline
+            size="lg"
+            type="button"
+          >
+            {i18next.t("Action.Confirm")}
+          </Button>
+          <Button
+            className="actionButton"
+            onClick={e => this.onReview(e, "extend")}
+            color="info"
+            outline
+            size="lg"
+            type="button"
+          >
+            {i18next.t("Action.Extend")}
+          </Button>
+          <Button
+            className="actionButton"
+            onClick={e => this.onReview(e, "deactivate")}
+            color="danger"
+            outline
+            size="lg"
+            type="button"
+          >
+            {i18next.t("Action.Deactivate")}
+          </Button>
+        </Container>
+      );
     } else if (
       currentRequest &&
       (currentRequest.status === "Approved" ||
@@ -197,6 +319,38 @@ class AdminAction extends React.Component {
           <Alert color="info">{i18next.t("Action.FulfilledMsg")}</Alert>
         </div>
       );
+    } else if (currentRequest && currentRequest.status === "Disputed") {
+      display = (
+        <div>
+          <Alert color="warning">{i18next.t("Action.DisputedMsg")}</Alert>
+        </div>
+      );
+    } else if (currentRequest && currentRequest.status === "Cancelled") {
+      display = (
+        <div>
+          <Alert color="info">{i18next.t("Action.WithdrawnMsg")}</Alert>
+        </div>
+      );
+    } else if (this.state.linkError === "expired") {
+      display = (
+        <div>
+          <Alert color="warning">{i18next.t("Action.ExpiredLinkMsg")}</Alert>
+        </div>
+      );
+    } else if (this.state.linkError === "used") {
+      display = (
+        <div>
+          <Alert color="info">{i18next.t("Action.UsedLinkMsg")}</Alert>
+        </div>
+      );
+    } else if (this.state.retryAfter) {
+      display = (
+        <p>
+          {i18next.t("Status.TooManyAttempts", {
+            minutes: this.state.retryAfter
+          })}
+        </p>
+      );
     } else if (this.state.invalid) {
       display = <p>Invalid route</p>;
     }
@@ -59,6 +59,48 @@ class Application extends React.Component {
 
     // Request submission related error messages
     this.ERR_INTERNAL = i18next.t("Splash.SubmissionInternalErrMsg");
+    this.ERR_ALREADY_RESUBMITTED = i18next.t("Splash.AlreadyResubmittedErrMsg");
+    this.ERR_RESUBMIT_NOT_ALLOWED = i18next.t("Splash.ResubmitNotAllowedErrMsg");
+  }
+
+  // resubmitToken is the status token of the denied request being resubmitted, if any
+  resubmitToken() {
+    const { match } = this.props;
+    return match && match.params.id;
+  }
+
+  componentDidMount() {
+    const token = this.resubmitToken();
+    if (!token) {
+      return;
+    }
+    // Start from the denied request so the applicant only fixes what was wrong
+    RequestsService.getRequestByEncodedID(token)
+      .then(res => {
+        if (res.status === 200) {
+          const request = res.data.request;
+          this.setState({
+            email: request.email,
+            username: request.username,
+            gender: request.gender,
+            age: request.age ? String(request.age) : "",
+            applicationText: request.info ? request.info.applicationText : ""
+          });
+        }
+      })
+      .catch(error => {
+        this.setState({
+          errorMsg: this.ERR_RESUBMIT_NOT_ALLOWED
+        });
+      });
+  }
+
+  submitRequest(data) {
+    const token = this.resubmitToken();
+    if (token) {
+      return RequestsService.resubmitRequest(token, data);
+    }
+    return RequestsService.createRequest(data);
   }
 
   onToggle = () => {
@@ -70,11 +112,13 @@ class Application extends React.Component {
   onResolved() {
     RecaptchaService.verify(this.recaptcha.getResponse()).then(res => {
       if (res.status === 200 && res.data.success) {
-        RequestsService.createRequest({
+        this.submitRequest({
           email: this.state.email,
           username: this.state.username,
           gender: this.state.gender,
           age: parseInt(this.state.age),
+          // Emails to the applicant are sent in the language of the form
+          locale: i18next.language,
           info: {
             applicationText: this.state.applicationText
           }
@@ -92,7 +136,17 @@ class Application extends React.Component {
               // 422 Unprocessable Entity means there is pending request with that username in the system
               // (duplicate request)
               let statusCode = error.response.status;
-              if (statusCode === 422) {
+              if (this.resubmitToken() && statusCode === 409) {
+                // The denied request has already been resubmitted
+                this.setState({
+                  errorMsg: this.ERR_ALREADY_RESUBMITTED
+                });
+              } else if (this.resubmitToken() && statusCode === 403) {
+                // Banned or out of resubmissions
+                this.setState({
+                  errorMsg: this.ERR_RESUBMIT_NOT_ALLOWED
+                });
+              } else if (statusCode === 422) {
                 this.setState({
                   errorMsg: this.ERR_REPEAT_REQUEST
                 });
@@ -274,7 +328,11 @@ class Application extends React.Component {
           <div>
             <Jumbotron className="application-jumbotron">
               <h1 className="display-4">Hey,</h1>
-              <p className="lead">{i18next.t("Splash.Welcome")}</p>
+              <p className="lead">
+                {this.resubmitToken()
+                  ? i18next.t("Splash.ResubmitWelcome")
+                  : i18next.t("Splash.Welcome")}
+              </p>
             </Jumbotron>
           </div>
           {messageBlock}
@@ -286,6 +344,7 @@ class Application extends React.Component {
                 name="email"
                 required
                 placeholder="example@gmail.com"
+                disabled={!!this.resubmitToken()}
                 value={this.state.email}
                 onChange={this.handleInputChange}
               />
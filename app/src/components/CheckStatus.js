@@ -1,7 +1,7 @@
 import React from "react";
 import { ListGroup, ListGroupItem, Container, Button } from "reactstrap";
 import moment from "moment";
-import RequestsService from "../service/RequestsService";
+import RequestsService, { retryAfterMinutes } from "../service/RequestsService";
 import i18next from "i18next";
 import "./CheckStatus.css";
 
@@ -27,17 +27,68 @@ class CheckStatus extends React.Component {
       })
       .catch(error => {
         this.setState({
-          invalid: true
+          invalid: true,
+          retryAfter: retryAfterMinutes(error)
         });
       });
   }
 
+  toggleDirectoryOptOut = () => {
+    const {
+      match: { params }
+    } = this.props;
+    const optOut = !this.state.currentRequest.directoryOptOut;
+    RequestsService.setDirectoryOptOut(params.id, optOut)
+      .then(res => {
+        if (res.status === 200) {
+          this.setState({
+            currentRequest: {
+              ...this.state.currentRequest,
+              directoryOptOut: optOut
+            }
+          });
+        }
+      })
+      .catch(error => {
+        alert(i18next.t("Status.DirectoryError"));
+      });
+  };
+
+  cancelRequest = () => {
+    if (!window.confirm(i18next.t("Status.CancelConfirm"))) {
+      return;
+    }
+    const {
+      match: { params }
+    } = this.props;
+    RequestsService.cancelRequest(params.id)
+      .then(res => {
+        if (res.status === 200) {
+          this.setState({
+            currentRequest: {
+              ...this.state.currentRequest,
+              status: "Cancelled"
+            }
+          });
+        }
+      })
+      .catch(error => {
+        if (error.response && error.response.status === 409) {
+          alert(i18next.t("Status.CancelConflict"));
+        } else {
+          alert(i18next.t("Status.CancelError"));
+        }
+      });
+  };
+
   getButtonColor(status) {
     switch (status) {
       case "Approved":
         return "success";
       case "Denied":
         return "danger";
+      case "Cancelled":
+        return "secondary";
       default:
         return "info";
     }
@@ -50,6 +101,8 @@ class CheckStatus extends React.Component {
       return i18next.t("Status.Approved");
     } else if (status === "Denied") {
       return i18next.t("Status.Denied");
+    } else if (status === "Cancelled") {
+      return i18next.t("Status.Cancelled");
     }
   };
 
@@ -80,6 +133,45 @@ class CheckStatus extends React.Component {
                 {this.getApplicationStatusText(currentRequest.status)}
               </Button>
             </ListGroupItem>
+            {currentRequest.status === "Pending" && (
+              <ListGroupItem tag="a" action>
+                <Button
+                  outline
+                  color="danger"
+                  type="button"
+                  onClick={this.cancelRequest}
+                >
+                  {i18next.t("Status.Cancel")}
+                </Button>
+              </ListGroupItem>
+            )}
+            {currentRequest.status === "Denied" && (
+              <ListGroupItem tag="a" action>
+                <Button
+                  outline
+                  color="primary"
+                  type="button"
+                  href={`/resubmit/${this.props.match.params.id}`}
+                >
+                  {i18next.t("Status.Resubmit")}
+                </Button>
+              </ListGroupItem>
+            )}
+            {currentRequest.status === "Approved" && (
+              <ListGroupItem tag="a" action>
+                <strong>{i18next.t("Status.Directory")} </strong>
+                <Button
+                  outline
+                  color="secondary"
+                  type="button"
+                  onClick={this.toggleDirectoryOptOut}
+                >
+                  {currentRequest.directoryOptOut
+                    ? i18next.t("Status.DirectoryOptIn")
+                    : i18next.t("Status.DirectoryOptOut")}
+                </Button>
+              </ListGroupItem>
+            )}
             <ListGroupItem tag="a" action>
               <strong>{i18next.t("Status.ReferenceID")} </strong>{" "}
               {currentRequest._id}
@@ -97,6 +189,14 @@ class CheckStatus extends React.Component {
           </ListGroup>
         </Container>
       );
+    } else if (this.state.retryAfter) {
+      display = (
+        <h4>
+          {i18next.t("Status.TooManyAttempts", {
+            minutes: this.state.retryAfter
+          })}
+        </h4>
+      );
     } else {
       display = <h1>Invalid</h1>;
     }
@@ -97,6 +97,8 @@ class Table extends React.Component {
       return "You are about to ban the player permanately on your server. Are you sure about this?";
     } else if (attemptedNewStatus === "Deactivated") {
       return "By deactivating, the player will be unwhitelisted from your server and unable to play. However the user will be able to submit new application again in the future.";
+    } else if (attemptedNewStatus === "Unbanned") {
+      return "By unbanning, the player will be pardoned on your server but not whitelisted. The user will be able to submit new application again.";
     }
   };
 
@@ -247,14 +249,18 @@ class Table extends React.Component {
               tooltip: i18next.t("Dashboard.Table.ApproveTooltip"),
               onClick: (event, rowData) =>
                 this.onStatusChange(rowData, "Approved"),
-              hidden: rowData.status !== "Pending"
+              // The owner decides on requests ops voted differently on
+              hidden:
+                rowData.status !== "Pending" && rowData.status !== "Disputed"
             }),
             rowData => ({
               icon: "close",
               tooltip: i18next.t("Dashboard.Table.DenyTooltip"),
               onClick: (event, rowData) =>
                 this.onStatusChange(rowData, "Denied"),
-              hidden: rowData.status !== "Pending"
+              // The owner decides on requests ops voted differently on
+              hidden:
+                rowData.status !== "Pending" && rowData.status !== "Disputed"
             }),
             rowData => ({
               icon: "cancel",
@@ -269,6 +275,13 @@ class Table extends React.Component {
               onClick: (event, rowData) =>
                 this.onAttemptAction(rowData, "Banned"),
               hidden: rowData.status !== "Approved"
+            }),
+            rowData => ({
+              icon: "undo",
+              tooltip: "Unban the user",
+              onClick: (event, rowData) =>
+                this.onAttemptAction(rowData, "Unbanned"),
+              hidden: rowData.status !== "Banned"
             })
           ]}
           options={{
@@ -46,6 +46,14 @@ const StatusGraph = props => {
     {
       name: "Banned",
       count: props.banned
+    },
+    {
+      name: "Expired",
+      count: props.expired
+    },
+    {
+      name: "Cancelled",
+      count: props.cancelled
     }
   ];
 
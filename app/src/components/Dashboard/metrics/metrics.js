@@ -162,6 +162,8 @@ class Metrics extends React.Component {
               denied={this.state.stats.denied}
               banned={this.state.stats.banned}
               deactivated={this.state.stats.deactivated}
+              expired={this.state.stats.expired}
+              cancelled={this.state.stats.cancelled}
             ></StatusGraph>
           </div>
         </Grid>
@@ -4,6 +4,15 @@ const API_HOST = process.env.REACT_APP_API_HOST
   ? process.env.REACT_APP_API_HOST
   : "";
 
+// Minutes to wait before trying again if a link was rejected for too many invalid attempts
+export function retryAfterMinutes(error) {
+  if (error.response && error.response.status === 429) {
+    const seconds = parseInt(error.response.headers["retry-after"]) || 60;
+    return Math.ceil(seconds / 60);
+  }
+  return null;
+}
+
 class RequestsService {
   // config: axios config containing auth bearer header
   getAllRequests(config) {
@@ -33,22 +42,52 @@ class RequestsService {
     return axios.get(`${API_HOST}/api/v1/requests/${encodedID}`);
   }
 
-  approveRequest(requestID, admToken, note) {
+  setDirectoryOptOut(encodedID, optOut) {
+    return axios.patch(`${API_HOST}/api/v1/requests/${encodedID}/directory`, {
+      optOut: optOut
+    });
+  }
+
+  resubmitRequest(encodedID, data) {
+    return axios.post(
+      `${API_HOST}/api/v1/requests/${encodedID}/resubmit`,
+      data
+    );
+  }
+
+  cancelRequest(encodedID) {
+    return axios.post(`${API_HOST}/api/v1/requests/${encodedID}/cancel`);
+  }
+
+  // note: only seen by ops, reason: told to the applicant in the decision email
+  approveRequest(requestID, admToken, note, reason) {
     return axios.patch(
       `${API_HOST}/api/v1/requests/${requestID}?adm=${admToken}`,
       {
         status: "Approved",
-        note: note
+        note: note,
+        decisionReason: reason
       }
     );
   }
 
-  denyRequest(requestID, admToken, note) {
+  denyRequest(requestID, admToken, note, reason) {
     return axios.patch(
       `${API_HOST}/api/v1/requests/${requestID}?adm=${admToken}`,
       {
         status: "Denied",
-        note: note
+        note: note,
+        decisionReason: reason
+      }
+    );
+  }
+
+  // outcome: one of confirm, extend, deactivate
+  reviewRequest(requestID, admToken, outcome) {
+    return axios.post(
+      `${API_HOST}/api/v1/requests/${requestID}/review?adm=${admToken}`,
+      {
+        outcome: outcome
       }
     );
   }
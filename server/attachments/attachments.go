@@ -0,0 +1,214 @@
+// Package attachments stores the proof images applicants attach to their request, e.g a screenshot showing
+// they own the account. Files are stored in a local directory or an S3-compatible bucket under a random key,
+// which is all the request keeps of them. They are only served through signed, expiring links
+package attachments
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// Storage backends of attachmentsStorage
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// Limits of attachments if attachmentMaxBytes or attachmentsMaxCount are not set
+const (
+	defaultMaxBytes = 5 << 20
+	defaultMaxCount = 3
+)
+
+// Validity of the links to attachments in emails to ops if attachmentLinkTTLHours is not set. Links shown in
+// the dashboard are signed on every view and expire sooner
+const (
+	defaultEmailLinkTTL = 7 * 24 * time.Hour
+	ViewLinkTTL         = time.Hour
+)
+
+var (
+	// ErrNotFound is returned for keys without a stored file, e.g erased
+	ErrNotFound = errors.New("Attachment not found")
+	// ErrType is returned for files that are not an image of an accepted type
+	ErrType = errors.New("Only PNG, JPEG, GIF and WebP images can be attached")
+)
+
+// Accepted types of files by the extension of their keys. The type is sniffed from the content, the one
+// claimed by the upload is ignored
+var extensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+var keyPattern = regexp.MustCompile(`^[0-9a-f]{32}\.(png|jpg|gif|webp)$`)
+
+// Store stores the files of attachments by key
+type Store interface {
+	Put(key, contentType string, data []byte) error
+	// Get returns ErrNotFound if nothing is stored under the key
+	Get(key string) (io.ReadCloser, error)
+	// Delete succeeds if nothing is stored under the key
+	Delete(key string) error
+}
+
+// Enabled tells if applicants may attach files, i.e attachmentsStorage is set
+func Enabled() bool {
+	return viper.GetString("attachmentsStorage") != ""
+}
+
+// FromConfig returns the store of attachmentsStorage. Nil if attachments are disabled
+func FromConfig() (Store, error) {
+	switch storage := viper.GetString("attachmentsStorage"); storage {
+	case "":
+		return nil, nil
+	case StorageLocal:
+		return NewLocalStore(viper.GetString("attachmentsDir"))
+	case StorageS3:
+		return NewS3Store(S3Config{
+			Endpoint:  viper.GetString("attachmentsS3Endpoint"),
+			Bucket:    viper.GetString("attachmentsS3Bucket"),
+			Region:    viper.GetString("attachmentsS3Region"),
+			AccessKey: viper.GetString("attachmentsS3AccessKey"),
+			SecretKey: viper.GetString("attachmentsS3SecretKey"),
+		}, nil)
+	default:
+		return nil, fmt.Errorf("attachmentsStorage %q is not supported, expected %s or %s", storage, StorageLocal, StorageS3)
+	}
+}
+
+// Validate checks the store of attachments can be set up and links to them can be built, so a misconfiguration
+// is reported on startup
+func Validate() error {
+	if !Enabled() {
+		return nil
+	}
+	_, err := FromConfig()
+	if err != nil {
+		return err
+	}
+	_, err = Links([]string{strings.Repeat("0", 32) + ".png"}, time.Minute)
+	return err
+}
+
+// Link is the signed download link of an attachment
+type Link struct {
+	Key       string    `json:"key"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Links returns the download links of the keys through the API at apiURL, valid for ttl
+func Links(keys []string, ttl time.Duration) ([]Link, error) {
+	links := make([]Link, 0, len(keys))
+	expiresAt := time.Now().Add(ttl)
+	for _, key := range keys {
+		link, err := utils.AttachmentURL(viper.GetString("apiURL"), key, ttl)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, Link{Key: key, URL: link, ExpiresAt: expiresAt})
+	}
+	return links, nil
+}
+
+// EmailLinkTTL is the validity of the links to attachments in emails to ops, attachmentLinkTTLHours
+func EmailLinkTTL() time.Duration {
+	if hours := viper.GetInt("attachmentLinkTTLHours"); hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return defaultEmailLinkTTL
+}
+
+// MaxBytes is the largest file accepted, attachmentMaxBytes
+func MaxBytes() int64 {
+	if size := viper.GetInt64("attachmentMaxBytes"); size > 0 {
+		return size
+	}
+	return defaultMaxBytes
+}
+
+// MaxCount is the number of files a request may have attached, attachmentsMaxCount
+func MaxCount() int {
+	if count := viper.GetInt("attachmentsMaxCount"); count > 0 {
+		return count
+	}
+	return defaultMaxCount
+}
+
+// Check returns the type of the file if it is an accepted image within the size limit
+func Check(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", errors.New("The attachment is empty")
+	}
+	if int64(len(data)) > MaxBytes() {
+		return "", fmt.Errorf("The attachment is larger than %d KB", MaxBytes()>>10)
+	}
+	contentType := http.DetectContentType(data)
+	if _, ok := extensions[contentType]; !ok {
+		return "", ErrType
+	}
+	return contentType, nil
+}
+
+// NewKey returns a random key for a file of the type. Keys can not be guessed, so a request can only reference
+// files uploaded by its applicant
+func NewKey(contentType string) (string, error) {
+	extension, ok := extensions[contentType]
+	if !ok {
+		return "", ErrType
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b) + extension, nil
+}
+
+// ValidKey tells if the key is one NewKey returns, so it is safe to use in paths
+func ValidKey(key string) bool {
+	return keyPattern.MatchString(key)
+}
+
+// ContentType returns the type of the file of the key
+func ContentType(key string) string {
+	extension := path.Ext(key)
+	for contentType, ext := range extensions {
+		if ext == extension {
+			return contentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// DeleteAll deletes the files of the keys, e.g of an erased request. Returns the first error, after trying
+// every key
+func DeleteAll(store Store, keys []string) error {
+	var failed []string
+	var first error
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			failed = append(failed, key)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if first != nil {
+		return fmt.Errorf("Unable to delete attachments %s: %s", strings.Join(failed, ", "), first.Error())
+	}
+	return nil
+}
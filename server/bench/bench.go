@@ -0,0 +1,433 @@
+// Package bench measures the capacity of the pipeline by sending synthetic requests through the
+// message queue and the worker. Emails are recorded instead of sent and no game server is needed
+package bench
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Synthetic requests are submitted with emails of this domain. The .invalid top level domain is reserved
+	emailDomain = "bench.invalid"
+	// Prefix of the usernames of synthetic requests
+	usernamePrefix = "bench_"
+)
+
+// Pipeline submits synthetic requests and approves them like an op once they are dispatched
+type Pipeline interface {
+	// Submit creates the request and publishes it as a new request
+	Submit(request types.WhitelistRequest) (primitive.ObjectID, error)
+	// Approve approves the pending request and publishes the approval
+	Approve(id primitive.ObjectID) error
+	// QueueDepth returns the number of messages waiting to be processed
+	QueueDepth() (int, error)
+}
+
+// Config of a benchmark run
+type Config struct {
+	// RunID marks the synthetic requests of the run
+	RunID    string
+	Requests int
+	// Submissions per second
+	Rate float64
+	// Time to wait for requests to complete after the last submission
+	Timeout time.Duration
+	// Interval the queue depth is sampled at
+	SampleInterval time.Duration
+}
+
+// Latency percentiles in seconds
+type Latency struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	Max float64 `json:"max"`
+}
+
+// QueueSample is the queue depth at a time of the run
+type QueueSample struct {
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+	Depth          int     `json:"depth"`
+}
+
+// Report of a benchmark run
+type Report struct {
+	RunID     string `json:"runId"`
+	Requests  int    `json:"requests"`
+	Submitted int    `json:"submitted"`
+	Completed int    `json:"completed"`
+	// Requests whose submission or approval failed
+	Failed int `json:"failed"`
+	// Requests not completed before the timeout
+	TimedOut         int              `json:"timedOut"`
+	TargetRate       float64          `json:"targetRatePerSecond"`
+	SubmissionRate   float64          `json:"submissionRatePerSecond"`
+	Throughput       float64          `json:"throughputPerSecond"`
+	DurationSeconds  float64          `json:"durationSeconds"`
+	DispatchLatency  Latency          `json:"dispatchLatency"`
+	EndToEndLatency  Latency          `json:"endToEndLatency"`
+	QueueDepth       []QueueSample    `json:"queueDepth"`
+	MaxQueueDepth    int              `json:"maxQueueDepth"`
+	EmailsRecorded   int              `json:"emailsRecorded"`
+	CommandsRecorded int              `json:"commandsRecorded"`
+	MongoOperations  map[string]int64 `json:"mongoOperations"`
+	RedisOperations  map[string]int64 `json:"redisOperations"`
+}
+
+// Bench submits synthetic requests at the configured rate and tracks them through the pipeline.
+// Submission to dispatch is measured by the action emails to ops, submission to end by the whitelist
+// command on the game server. Both are recorded by the bench in place of the mailer and the RCON client
+type Bench struct {
+	config   Config
+	pipeline Pipeline
+
+	mu         sync.Mutex
+	submitted  map[string]time.Time
+	dispatched map[string]time.Time
+	completed  map[string]time.Time
+	failed     map[string]bool
+	// IDs of the requests by username
+	ids       map[string]string
+	emails    int
+	commands  int
+	samples   []QueueSample
+	finished  int
+	done      chan struct{}
+	closeDone sync.Once
+}
+
+// New creates a bench sending requests through the pipeline
+func New(config Config, pipeline Pipeline) *Bench {
+	if config.SampleInterval <= 0 {
+		config.SampleInterval = time.Second
+	}
+	return &Bench{
+		config:     config,
+		pipeline:   pipeline,
+		submitted:  make(map[string]time.Time),
+		dispatched: make(map[string]time.Time),
+		completed:  make(map[string]time.Time),
+		failed:     make(map[string]bool),
+		ids:        make(map[string]string),
+		done:       make(chan struct{}),
+	}
+}
+
+// NewRunID returns an ID for a run, short enough to keep usernames readable
+func NewRunID() string {
+	return strconv.FormatInt(time.Now().Unix(), 36)
+}
+
+// SyntheticRequest returns the i-th synthetic request of the run
+func SyntheticRequest(runID string, i int) types.WhitelistRequest {
+	username := fmt.Sprintf("%s%s_%d", usernamePrefix, runID, i)
+	return types.WhitelistRequest{
+		Username: username,
+		Email:    username + "@" + emailDomain,
+		Age:      20,
+		Gender:   "other",
+		Bench:    runID,
+	}
+}
+
+// Run submits the requests, waits for them to complete or the timeout and returns the report
+func (b *Bench) Run() Report {
+	start := time.Now()
+	stopSampling := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		b.sampleQueueDepth(start, stopSampling)
+		close(sampled)
+	}()
+	b.submitAll()
+	submitDuration := time.Since(start)
+	select {
+	case <-b.done:
+	case <-time.After(b.config.Timeout):
+	}
+	close(stopSampling)
+	<-sampled
+	return b.report(start, submitDuration)
+}
+
+// submitAll submits the requests paced at the configured rate. Submissions slower than the rate
+// are not caught up on, the achieved rate is reported instead
+func (b *Bench) submitAll() {
+	if b.config.Requests <= 0 {
+		b.closeDone.Do(func() { close(b.done) })
+		return
+	}
+	interval := time.Duration(float64(time.Second) / b.config.Rate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 0; i < b.config.Requests; i++ {
+		if i > 0 {
+			<-ticker.C
+		}
+		b.submit(SyntheticRequest(b.config.RunID, i))
+	}
+}
+
+func (b *Bench) submit(request types.WhitelistRequest) {
+	submittedAt := time.Now()
+	id, err := b.pipeline.Submit(request)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.failed[request.Username] = true
+		b.finish()
+		return
+	}
+	b.submitted[id.Hex()] = submittedAt
+	b.ids[request.Username] = id.Hex()
+	// The worker may have processed the request before Submit returned. Whitelisting
+	// is recorded by username until then
+	if t, ok := b.completed[request.Username]; ok {
+		delete(b.completed, request.Username)
+		b.completed[id.Hex()] = t
+		b.finish()
+	} else if b.failed[id.Hex()] {
+		b.finish()
+	}
+}
+
+// finish counts a request that completed or failed. Must be called with the lock held
+func (b *Bench) finish() {
+	b.finished++
+	if b.finished >= b.config.Requests {
+		b.closeDone.Do(func() { close(b.done) })
+	}
+}
+
+func (b *Bench) sampleQueueDepth(start time.Time, stop chan struct{}) {
+	ticker := time.NewTicker(b.config.SampleInterval)
+	defer ticker.Stop()
+	for {
+		depth, err := b.pipeline.QueueDepth()
+		if err == nil {
+			b.mu.Lock()
+			b.samples = append(b.samples, QueueSample{ElapsedSeconds: time.Since(start).Seconds(), Depth: depth})
+			b.mu.Unlock()
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SendMail records an email of the worker instead of sending it. The first action email of a
+// request marks it as dispatched and approves it like an op following the link would
+func (b *Bench) SendMail(templateName string, templateData interface{}, subject string, recipent string) error {
+	b.mu.Lock()
+	b.emails++
+	b.mu.Unlock()
+	data, ok := templateData.(map[string]string)
+	if !ok {
+		return nil
+	}
+	id, ok := requestIDFromLink(data["link"])
+	if !ok {
+		return nil
+	}
+	b.mu.Lock()
+	if _, dispatched := b.dispatched[id]; dispatched {
+		b.mu.Unlock()
+		return nil
+	}
+	// The request may be dispatched before Submit returned so it is not required to be known yet
+	b.dispatched[id] = time.Now()
+	b.mu.Unlock()
+	// Approve in the background as the worker is still dispatching the request
+	go func() {
+		objectID, _ := primitive.ObjectIDFromHex(id)
+		if err := b.pipeline.Approve(objectID); err != nil {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if _, ok := b.completed[id]; !ok && !b.failed[id] {
+				b.failed[id] = true
+				// Requests not known yet are counted once Submit returns
+				if _, known := b.submitted[id]; known {
+					b.finish()
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// SendCommand records a command of the worker instead of running it on a game server. The first
+// command mentioning a synthetic request, e.g whitelisting the player, completes it
+func (b *Bench) SendCommand(command string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.commands++
+	if strings.HasPrefix(command, "whitelist list") {
+		// e.g the reconciliation listing the whitelist
+		return "There are no whitelisted players", nil
+	}
+	username := ""
+	for _, field := range strings.Fields(command) {
+		if strings.HasPrefix(field, usernamePrefix+b.config.RunID+"_") {
+			username = field
+			break
+		}
+	}
+	if username == "" {
+		return "", nil
+	}
+	// The request may be whitelisted before Submit returned, keep it by username until then
+	key := username
+	if id, ok := b.ids[username]; ok {
+		key = id
+	}
+	if _, ok := b.completed[key]; !ok && !b.failed[key] {
+		b.completed[key] = time.Now()
+		if key != username {
+			b.finish()
+		}
+	}
+	return "Added " + username + " to the whitelist", nil
+}
+
+// requestIDFromLink returns the request ID of the action link of an email to ops,
+// e.g https://example.com/action/<request ID token>?adm=<op token>
+func requestIDFromLink(link string) (string, bool) {
+	i := strings.Index(link, "action/")
+	if i < 0 {
+		return "", false
+	}
+	token := link[i+len("action/"):]
+	if j := strings.Index(token, "?"); j >= 0 {
+		token = token[:j]
+	}
+	id, err := utils.VerifyToken(token, utils.PurposeAction)
+	if err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+func (b *Bench) report(start time.Time, submitDuration time.Duration) Report {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	report := Report{
+		RunID:            b.config.RunID,
+		Requests:         b.config.Requests,
+		Submitted:        len(b.submitted),
+		TargetRate:       b.config.Rate,
+		QueueDepth:       b.samples,
+		EmailsRecorded:   b.emails,
+		CommandsRecorded: b.commands,
+		MongoOperations:  map[string]int64{},
+		RedisOperations:  map[string]int64{},
+	}
+	if report.QueueDepth == nil {
+		report.QueueDepth = []QueueSample{}
+	}
+	for _, sample := range b.samples {
+		if sample.Depth > report.MaxQueueDepth {
+			report.MaxQueueDepth = sample.Depth
+		}
+	}
+	if submitDuration > 0 {
+		report.SubmissionRate = float64(report.Submitted) / submitDuration.Seconds()
+	}
+	dispatchLatencies := make([]float64, 0, len(b.dispatched))
+	endToEndLatencies := make([]float64, 0, len(b.completed))
+	end := start
+	for id, submittedAt := range b.submitted {
+		if t, ok := b.dispatched[id]; ok {
+			dispatchLatencies = append(dispatchLatencies, t.Sub(submittedAt).Seconds())
+		}
+		if t, ok := b.completed[id]; ok {
+			endToEndLatencies = append(endToEndLatencies, t.Sub(submittedAt).Seconds())
+			if t.After(end) {
+				end = t
+			}
+		}
+	}
+	report.Completed = len(endToEndLatencies)
+	// Approvals of requests of others, e.g a worker of another deployment sharing the broker, are not counted
+	for key := range b.failed {
+		if _, known := b.submitted[key]; known || strings.HasPrefix(key, usernamePrefix) {
+			report.Failed++
+		}
+	}
+	report.TimedOut = b.config.Requests - report.Completed - report.Failed
+	report.DispatchLatency = latency(dispatchLatencies)
+	report.EndToEndLatency = latency(endToEndLatencies)
+	report.DurationSeconds = end.Sub(start).Seconds()
+	if report.DurationSeconds > 0 {
+		report.Throughput = float64(report.Completed) / report.DurationSeconds
+	}
+	return report
+}
+
+func latency(seconds []float64) Latency {
+	if len(seconds) == 0 {
+		return Latency{}
+	}
+	sort.Float64s(seconds)
+	return Latency{
+		P50: percentile(seconds, 50),
+		P95: percentile(seconds, 95),
+		Max: seconds[len(seconds)-1],
+	}
+}
+
+// percentile returns the nearest-rank percentile of the sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// ParseCommandStats parses the commandstats section of the INFO of a redis server into
+// the number of calls per command, e.g "cmdstat_get:calls=21,usec=175,usec_per_call=8.33"
+func ParseCommandStats(info string) map[string]int64 {
+	counts := make(map[string]int64)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "cmdstat_") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		command := strings.TrimPrefix(line[:i], "cmdstat_")
+		for _, field := range strings.Split(line[i+1:], ",") {
+			if strings.HasPrefix(field, "calls=") {
+				calls, err := strconv.ParseInt(strings.TrimPrefix(field, "calls="), 10, 64)
+				if err == nil {
+					counts[command] = calls
+				}
+			}
+		}
+	}
+	return counts
+}
+
+// CountsSince returns the increase of every count since the earlier counts. Counts that did not increase are left out
+func CountsSince(before, after map[string]int64) map[string]int64 {
+	increase := make(map[string]int64)
+	for key, count := range after {
+		if delta := count - before[key]; delta > 0 {
+			increase[key] = delta
+		}
+	}
+	return increase
+}
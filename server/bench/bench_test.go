@@ -0,0 +1,207 @@
+package bench
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fakePipeline processes requests like the worker would, emailing the action link to two ops
+// on submission and whitelisting the player on approval, through the recording bench
+type fakePipeline struct {
+	bench *Bench
+	delay time.Duration
+	// Requests whose submission or approval fails
+	failSubmit  map[int]bool
+	failApprove map[int]bool
+
+	// pending tracks the requests dispatched in the background. Tests wait for them before returning, so their
+	// action links are not verified against the config while the next test changes it
+	pending sync.WaitGroup
+
+	mu        sync.Mutex
+	submitted int
+	usernames map[primitive.ObjectID]string
+	indexes   map[primitive.ObjectID]int
+}
+
+func (p *fakePipeline) Submit(request types.WhitelistRequest) (primitive.ObjectID, error) {
+	p.mu.Lock()
+	i := p.submitted
+	p.submitted++
+	p.mu.Unlock()
+	if p.failSubmit[i] {
+		return primitive.ObjectID{}, errors.New("unable to publish")
+	}
+	id := primitive.NewObjectID()
+	p.mu.Lock()
+	p.usernames[id] = request.Username
+	p.indexes[id] = i
+	p.mu.Unlock()
+	token, _ := utils.SignToken(id.Hex(), utils.PurposeAction, time.Hour)
+	dispatch := func() {
+		p.bench.SendMail("confirmation.html", map[string]string{"username": request.Username}, "Confirmation", request.Email)
+		for _, op := range []string{"op1", "op2"} {
+			p.bench.SendMail("ops.html", map[string]string{"link": "https://example.com/action/" + token + "?adm=" + op}, "Action", op)
+		}
+	}
+	// Every other request is dispatched before Submit returns
+	if i%2 == 0 {
+		dispatch()
+	} else {
+		p.pending.Add(1)
+		go func() {
+			defer p.pending.Done()
+			time.Sleep(p.delay)
+			dispatch()
+		}()
+	}
+	return id, nil
+}
+
+func (p *fakePipeline) Approve(id primitive.ObjectID) error {
+	p.mu.Lock()
+	username := p.usernames[id]
+	fail := p.failApprove[p.indexes[id]]
+	p.mu.Unlock()
+	if fail {
+		return errors.New("request changed concurrently")
+	}
+	// The bench approves in the background already
+	time.Sleep(p.delay)
+	p.bench.SendCommand("whitelist add " + username)
+	return nil
+}
+
+func (p *fakePipeline) QueueDepth() (int, error) {
+	return 0, nil
+}
+
+func newFakeBench(config Config) (*Bench, *fakePipeline) {
+	pipeline := &fakePipeline{
+		delay:       5 * time.Millisecond,
+		failSubmit:  map[int]bool{},
+		failApprove: map[int]bool{},
+		usernames:   make(map[primitive.ObjectID]string),
+		indexes:     make(map[primitive.ObjectID]int),
+	}
+	b := New(config, pipeline)
+	pipeline.bench = b
+	return b, pipeline
+}
+
+// Smoke variant of the benchmark sized for CI
+func TestBenchSmoke(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	b, pipeline := newFakeBench(Config{RunID: "smoke", Requests: 20, Rate: 200, Timeout: 5 * time.Second, SampleInterval: 10 * time.Millisecond})
+	defer pipeline.pending.Wait()
+	report := b.Run()
+	if report.Submitted != 20 || report.Completed != 20 || report.Failed != 0 || report.TimedOut != 0 {
+		t.Fatalf("Expected all requests to complete, got %+v", report)
+	}
+	// One confirmation and two action emails per request
+	if report.EmailsRecorded != 60 || report.CommandsRecorded != 20 {
+		t.Errorf("Expected 60 emails and 20 commands recorded, got %d and %d", report.EmailsRecorded, report.CommandsRecorded)
+	}
+	if report.EndToEndLatency.P50 <= 0 || report.EndToEndLatency.P95 < report.EndToEndLatency.P50 ||
+		report.EndToEndLatency.Max < report.EndToEndLatency.P95 || report.DispatchLatency.P95 > report.EndToEndLatency.Max {
+		t.Errorf("Unexpected latencies %+v %+v", report.DispatchLatency, report.EndToEndLatency)
+	}
+	if report.Throughput <= 0 || report.SubmissionRate <= 0 || len(report.QueueDepth) == 0 {
+		t.Errorf("Expected throughput, submission rate and queue depth samples, got %+v", report)
+	}
+}
+
+func TestBenchFailuresAndTimeout(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	b, pipeline := newFakeBench(Config{RunID: "failures", Requests: 6, Rate: 500, Timeout: 200 * time.Millisecond})
+	pipeline.failSubmit[1] = true
+	pipeline.failApprove[2] = true
+	pipeline.failApprove[3] = true
+	start := time.Now()
+	report := b.Run()
+	if report.Submitted != 5 || report.Completed != 3 || report.Failed != 3 || report.TimedOut != 0 {
+		t.Errorf("Expected 3 completed and 3 failed requests, got %+v", report)
+	}
+	// The run ends once every request completed or failed, without waiting for the timeout
+	if time.Since(start) >= 200*time.Millisecond {
+		t.Errorf("Expected the run to end before the timeout, took %s", time.Since(start))
+	}
+	pipeline.pending.Wait()
+
+	// Requests never whitelisted time out
+	// A bench of its own, the approvals of the first one may still be running
+	slow, slowPipeline := newFakeBench(Config{RunID: "timeout", Requests: 2, Rate: 500, Timeout: 50 * time.Millisecond})
+	slowPipeline.delay = time.Second
+	defer slowPipeline.pending.Wait()
+	report = slow.Run()
+	if report.Completed != 0 || report.TimedOut != 2 {
+		t.Errorf("Expected 2 timed out requests, got %+v", report)
+	}
+}
+
+func TestSubmissionRate(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	b, pipeline := newFakeBench(Config{RunID: "rate", Requests: 5, Rate: 50, Timeout: time.Second})
+	defer pipeline.pending.Wait()
+	start := time.Now()
+	b.Run()
+	// 4 intervals of 20ms between 5 submissions
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("Expected submissions to be paced at the rate, took %s", elapsed)
+	}
+}
+
+func TestCommandsOfOtherRequestsAreIgnored(t *testing.T) {
+	b, _ := newFakeBench(Config{RunID: "run", Requests: 1})
+	_, err := b.SendCommand("whitelist add Steve")
+	if err != nil || len(b.completed) != 0 {
+		t.Errorf("Expected whitelisting other players to be acknowledged only, got %v %v", err, b.completed)
+	}
+	b.SendCommand("lp user bench_run_0 parent add member")
+	if _, ok := b.completed["bench_run_0"]; !ok {
+		t.Errorf("Expected any command mentioning the synthetic request to complete it, got %v", b.completed)
+	}
+	if response, _ := b.SendCommand("whitelist list"); response != "There are no whitelisted players" {
+		t.Errorf("Unexpected response %q", response)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if l := latency(values); l.P50 != 5 || l.P95 != 10 || l.Max != 10 {
+		t.Errorf("Unexpected latency %+v", l)
+	}
+	if l := latency([]float64{3}); l.P50 != 3 || l.P95 != 3 {
+		t.Errorf("Unexpected latency of a single value %+v", l)
+	}
+	if l := latency(nil); l != (Latency{}) {
+		t.Errorf("Expected no latency without values, got %+v", l)
+	}
+}
+
+func TestParseCommandStats(t *testing.T) {
+	info := "# Commandstats\r\ncmdstat_get:calls=21,usec=175,usec_per_call=8.33\r\ncmdstat_hmset:calls=3,usec=30,usec_per_call=10.00\r\n"
+	before := ParseCommandStats(info)
+	if before["get"] != 21 || before["hmset"] != 3 || len(before) != 2 {
+		t.Fatalf("Unexpected command stats %v", before)
+	}
+	after := ParseCommandStats("cmdstat_get:calls=25,usec=200\ncmdstat_hmset:calls=3,usec=30\ncmdstat_incr:calls=2,usec=4")
+	increase := CountsSince(before, after)
+	if increase["get"] != 4 || increase["incr"] != 2 || len(increase) != 2 {
+		t.Errorf("Unexpected increase %v", increase)
+	}
+}
+
+func TestSyntheticRequest(t *testing.T) {
+	request := SyntheticRequest("abc", 7)
+	if request.Username != "bench_abc_7" || request.Email != "bench_abc_7@bench.invalid" || request.Bench != "abc" {
+		t.Errorf("Expected a clearly marked synthetic request, got %+v", request)
+	}
+}
@@ -11,7 +11,10 @@ import (
 
 	"github.com/spf13/viper"
 	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/topology"
 	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
 	try "gopkg.in/matryer/try.v1"
 )
 
@@ -21,6 +24,7 @@ type Service struct {
 	channel          *amqp.Channel
 	log              *logrus.Logger
 	rabbitCloseError chan *amqp.Error
+	names            topology.Names
 }
 
 func (s *Service) GetConn() *amqp.Connection {
@@ -49,6 +53,7 @@ func (s *Service) WatchForReconnect() {
 					"err": err.Error(),
 				}).Fatal("Unable to set up broker")
 			}
+			metrics.Reconnects.WithLabelValues("broker").Inc()
 		}
 	}
 }
@@ -105,92 +110,139 @@ func (s *Service) setup() error {
 	if err != nil {
 		return errors.New("Failed to open a channel")
 	}
+	names := topology.FromConfig()
+	err = topology.Declare(ch, names)
+	if err != nil {
+		return err
+	}
+	s.log.WithFields(logrus.Fields(names.Fields())).Info("Message queue topology declared")
+	s.channel = ch
+	s.names = names
+	return nil
+}
+
+// Topology returns the names of the exchanges and queues declared by the broker
+func (s *Service) Topology() topology.Names {
+	return s.names
+}
 
-	args := make(amqp.Table)
-	// Dead letter exchange name
-	args["x-dead-letter-exchange"] = "dead.letter.ex"
-	// Default message ttl 24 hours
-	args["x-message-ttl"] = int32(8.64e+7)
-
-	// Declare the dead letter exchange
-	err = ch.ExchangeDeclare(
-		"dead.letter.ex", // name
-		"fanout",         // type
-		true,             // durable
-		false,            // auto-deleted
-		false,            // internal
-		false,            // no-wait
-		nil,              // arguments
-	)
+// Publish a whitelistRequest message for the queue to consume. Bans and deactivations go to the high priority queue
+func (s *Service) Publish(message types.WhitelistRequest) error {
+	encodedMessage, err := types.EncodeRequestMessage(message)
 	if err != nil {
 		return err
 	}
-	// Declare the dead letter queue
-	_, err = ch.QueueDeclare(
-		"dead.letter.queue", // name
-		true,                // durable
-		false,               // delete when unused
-		false,               // exclusive
-		false,               // no-wait
-		nil,                 // arguments
-	)
+	var headers amqp.Table
+	if types.HighPriority(message.Status) {
+		headers = amqp.Table{types.PriorityHeader: types.PriorityHigh}
+	}
+	return s.publish(encodedMessage, headers)
+}
+
+// PublishDecisionEmail publish a decision task of which only the decision email is left to send, e.g to resend
+// a failed notification. The decision is not carried out on the game server again
+func (s *Service) PublishDecisionEmail(message types.WhitelistRequest) error {
+	encodedMessage, err := types.EncodeRequestMessage(message)
 	if err != nil {
 		return err
 	}
-	// Bind dead letter exchange to dead letter queue
-	err = ch.QueueBind(
-		"dead.letter.queue", // queue name
-		"",                  // routing key
-		"dead.letter.ex",    // exchange
-		false,
-		nil,
-	)
+	return s.publish(encodedMessage, amqp.Table{types.PhaseHeader: types.PhaseEmail})
+}
+
+// PublishConsoleTask publish a console task for the worker to run on the game server
+func (s *Service) PublishConsoleTask(task types.ConsoleTask) error {
+	encodedMessage, err := serialize(task)
 	if err != nil {
 		return err
 	}
+	return s.publish(encodedMessage, amqp.Table{types.TaskTypeHeader: types.ConsoleTaskType})
+}
 
-	_, err = ch.QueueDeclare(
-		viper.GetString("taskQueueName"), // name
-		true,                             // durable
-		false,                            // delete when unused
-		false,                            // exclusive
-		false,                            // no-wait
-		args,                             // arguments
-	)
+// PublishResendTask publish a task for the worker to send an email of a request again
+func (s *Service) PublishResendTask(task types.ResendTask) error {
+	encodedMessage, err := serialize(task)
 	if err != nil {
-		return errors.New("Failed to declare the queue")
+		return err
 	}
-	s.channel = ch
-	return nil
+	return s.publish(encodedMessage, amqp.Table{types.TaskTypeHeader: types.ResendTaskType})
 }
 
-// Publish a whitelistRequest message for the queue to consume
-func (s *Service) Publish(message types.WhitelistRequest) error {
-	encodedMessage, err := serialize(message)
+// PublishCommentTask publish a task for the worker to tell the ops assigned to a request about a new comment
+func (s *Service) PublishCommentTask(task types.CommentTask) error {
+	encodedMessage, err := serialize(task)
 	if err != nil {
 		return err
 	}
+	return s.publish(encodedMessage, amqp.Table{types.TaskTypeHeader: types.CommentTaskType})
+}
+
+// PublishRetry publish a message parked in the retry queue again, for the worker to retry it right away. The
+// headers of the parked message are kept, so the attempt counts as the same retry and keeps its priority
+func (s *Service) PublishRetry(encodedMessage []byte, headers amqp.Table) error {
+	return s.publish(encodedMessage, headers)
+}
 
+func (s *Service) publish(encodedMessage []byte, headers amqp.Table) error {
+	if headers == nil {
+		headers = make(amqp.Table)
+	}
+	// Retried messages keep the time they were first published at
+	if _, ok := headers[types.PublishedAtHeader]; !ok {
+		headers[types.PublishedAtHeader] = time.Now().Unix()
+	}
+	// Republished messages, e.g forced retries, are signed anew so their message ID is not seen as a replay
+	err := types.SignMessage(headers, encodedMessage, time.Now(), utils.PassphraseSecrets().Primary)
+	if err != nil {
+		return err
+	}
 	err = try.Do(func(attempt int) (bool, error) {
 		if attempt > 1 {
 			s.log.Infof("Trying to publish message to broker [%d/3]\n", attempt)
 		}
 		e := s.channel.Publish(
-			"",                               // exchange
-			viper.GetString("taskQueueName"), // routing key
-			false,                            // mandatory
+			"",                           // exchange
+			s.names.TaskQueueOf(headers), // routing key
+			false,                        // mandatory
 			false,
 			amqp.Publishing{
+				Headers:      headers,
 				DeliveryMode: amqp.Persistent,
 				ContentType:  "application/json",
-				Body:         []byte(encodedMessage),
+				Body:         encodedMessage,
 			})
 		return attempt < 3, e
 	})
 	return err
 }
 
-func serialize(msg types.WhitelistRequest) ([]byte, error) {
+// Peek fetch up to limit ready messages of the queue without consuming them and report the number
+// of ready messages. Messages are fetched unacknowledged on a dedicated channel and requeued in place
+// once it is closed, so they are only marked as redelivered. Messages held by consumers are not seen
+func (s *Service) Peek(queue string, limit int) (int, []amqp.Delivery, error) {
+	ch, err := s.conn.Channel()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer ch.Close()
+	q, err := ch.QueueInspect(queue)
+	if err != nil {
+		return 0, nil, err
+	}
+	messages := make([]amqp.Delivery, 0)
+	for len(messages) < limit && len(messages) < q.Messages {
+		d, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return q.Messages, messages, err
+		}
+		if !ok {
+			break
+		}
+		messages = append(messages, d)
+	}
+	return q.Messages, messages, nil
+}
+
+func serialize(msg interface{}) ([]byte, error) {
 	var b bytes.Buffer
 	encoder := json.NewEncoder(&b)
 	err := encoder.Encode(msg)
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const actionNoncePrefix = "ActionNonce:"
+
+const (
+	// NonceUnused is the state of the nonce of an action link that has not been used yet
+	NonceUnused = "unused"
+	// NonceConsumed is the state of the nonce of an action link an op has made a decision with
+	NonceConsumed = "consumed"
+)
+
+// Marks the nonce consumed if it is unused, keeping its expiry
+var consumeNonceScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) ~= "unused" then
+	return 0
+end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl > 0 then
+	redis.call("SET", KEYS[1], "consumed", "PX", ttl)
+else
+	redis.call("SET", KEYS[1], "consumed")
+end
+return 1
+`)
+
+// StoreActionNonce registers the nonce of a new action link as unused until the link expires
+func (svc *Service) StoreActionNonce(nonce string, ttl time.Duration) error {
+	conn := svc.conn()
+	defer conn.Close()
+	_, err := conn.Do("SET", actionNoncePrefix+nonce, NonceUnused, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+// ActionNonceState returns NonceUnused or NonceConsumed, or an empty string for nonces that are
+// unknown or expired
+func (svc *Service) ActionNonceState(nonce string) (string, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	state, err := redis.String(conn.Do("GET", actionNoncePrefix+nonce))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return state, err
+}
+
+// ConsumeActionNonce marks the nonce consumed. Returns false if it was not unused, e.g the link has
+// been used concurrently
+func (svc *Service) ConsumeActionNonce(nonce string) (bool, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	return redis.Bool(consumeNonceScript.Do(conn, actionNoncePrefix+nonce))
+}
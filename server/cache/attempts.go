@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const attemptsPrefix = "Attempts:"
+
+// SubmissionEmailKey is the key the applications of the email are counted by, ignoring case
+func SubmissionEmailKey(email string) string {
+	return "submit:email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// SubmissionLimitedKey is the key counting the applications of the email rejected by the submission limit.
+// It ends with the window of the limit
+func SubmissionLimitedKey(email string) string {
+	return "submit:limited:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// CountAttempt increments the counter of the key for a fixed window starting with the first
+// attempt, and returns the number of attempts in the window and the time left until it ends
+func (svc *Service) CountAttempt(key string, window time.Duration) (int64, time.Duration, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	conn.Send("MULTI")
+	// Only start the window if there is none yet so attempts do not extend it
+	conn.Send("SET", attemptsPrefix+key, 0, "PX", int64(window/time.Millisecond), "NX")
+	conn.Send("INCR", attemptsPrefix+key)
+	conn.Send("PTTL", attemptsPrefix+key)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, 0, err
+	}
+	count, err := redis.Int64(replies[1], nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	ttl, err := redis.Int64(replies[2], nil)
+	return count, time.Duration(ttl) * time.Millisecond, err
+}
+
+// GetAttempts returns the number of attempts of the key in the current window and the time left
+// until it ends. No attempts are returned once the window ended
+func (svc *Service) GetAttempts(key string) (int64, time.Duration, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("GET", attemptsPrefix+key)
+	conn.Send("PTTL", attemptsPrefix+key)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, 0, err
+	}
+	count, err := redis.Int64(replies[0], nil)
+	if err == redis.ErrNil {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	ttl, err := redis.Int64(replies[1], nil)
+	return count, time.Duration(ttl) * time.Millisecond, err
+}
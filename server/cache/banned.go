@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Set of the lowercased usernames of banned requests of each tenant, so new requests are checked without
+// querying the db. A player banned by one tenant may still apply to the others
+const bannedUsernamesKey = "BannedUsernames"
+
+// AddBannedUsername adds the username to the banned usernames of the tenant, ignoring case
+func (svc *Service) AddBannedUsername(serverID, username string) error {
+	conn := svc.conn()
+	defer conn.Close()
+	_, err := conn.Do("SADD", tenantKey(bannedUsernamesKey, serverID), strings.ToLower(username))
+	return err
+}
+
+// RemoveBannedUsername removes the username from the banned usernames of the tenant, e.g once the player is unbanned
+func (svc *Service) RemoveBannedUsername(serverID, username string) error {
+	conn := svc.conn()
+	defer conn.Close()
+	_, err := conn.Do("SREM", tenantKey(bannedUsernamesKey, serverID), strings.ToLower(username))
+	return err
+}
+
+// IsUsernameBanned checks whether a request of the tenant with the username has been banned, ignoring case
+func (svc *Service) IsUsernameBanned(serverID, username string) (bool, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	return redis.Bool(conn.Do("SISMEMBER", tenantKey(bannedUsernamesKey, serverID), strings.ToLower(username)))
+}
+
+// RebuildBannedUsernames replaces the banned usernames of every tenant with the usernames of its banned
+// requests in db
+func (svc *Service) RebuildBannedUsernames() error {
+	conn := svc.conn()
+	defer conn.Close()
+	for _, cfg := range tenant.All() {
+		banned, err := svc.dbService.GetRequests(-1, db.InTenant(bson.M{"status": types.StatusBanned}, cfg.ID))
+		if err != nil {
+			return err
+		}
+		key := tenantKey(bannedUsernamesKey, cfg.ID)
+		conn.Send("MULTI")
+		conn.Send("DEL", key)
+		if len(banned) > 0 {
+			args := redis.Args{}.Add(key)
+			for _, request := range banned {
+				args = args.Add(strings.ToLower(request.Username))
+			}
+			conn.Send("SADD", args...)
+		}
+		_, err = conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,9 +1,14 @@
 package cache
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spf13/viper"
@@ -12,17 +17,27 @@ import (
 	"github.com/gomodule/redigo/redis"
 	"github.com/sirupsen/logrus"
 	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/form"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
 	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
 const (
-	allRequestKey        = "AllRequests"
 	statsKey             = "Stats"
+	dispatchCursorKey    = "DispatchCursor"
+	queueLoadKey         = "QueueLoad"
+	directoryKey         = "Directory"
+	processedTaskPrefix  = "ProcessedTask:"
+	sentEmailPrefix      = "SentEmail:"
+	seenMessagePrefix    = "SeenMessage:"
 	aggregateStatusField = "AggregateStats"
 	maxRetry             = 5
 	layoutISO            = "01/02 2016"
 	ageGroupStep         = 15
+	// Only decisions made within this window count towards the median decision time
+	recentDecisionWindow = 7 * 24 * time.Hour
 )
 
 // Service represents a redis cache that is used to cache API results
@@ -31,39 +46,22 @@ type Service struct {
 	dbService *db.Service
 	pool      *redis.Pool
 	sseServer *sse.Broker
+	*sharedState
+	// Deadline and cancellation of the operations, see WithContext
+	ctx context.Context
 }
 
-// Stats is composed of both thre real-time stats that got updated in real-time after each
-// application status change AND aggregate stats that are analyzed and updated at a regular interval
-type Stats struct {
-	Pending                      int64          `redis:"pending" json:"pending"`
-	Denied                       int64          `redis:"denied" json:"denied"`
-	Approved                     int64          `redis:"approved" json:"approved"`
-	Banned                       int64          `redis:"banned" json:"banned"`
-	Deactivated                  int64          `redis:"deactivated" json:"deactivated"`
-	AverageResponseTimeInMinutes float64        `redis:"averageResponseTimeInMinutes" json:"averageResponseTimeInMinutes"`
-	TotalResponseTimeInMinutes   float64        `redis:"totalResponseTimeInMinutes" json:"totalResponseTimeInMinutes"`
-	MaleCount                    int64          `redis:"maleCount" json:"maleCount"`
-	FemaleCount                  int64          `redis:"femaleCount" json:"femaleCount"`
-	OtherGenderCount             int64          `redis:"otherGenderCount" json:"otherGenderCount"`
-	AgeGroup1Count               int64          `redis:"ageGroup1Count" json:"ageGroup1Count"`
-	AgeGroup2Count               int64          `redis:"ageGroup2Count" json:"ageGroup2Count"`
-	AgeGroup3Count               int64          `redis:"ageGroup3Count" json:"ageGroup3Count"`
-	AgeGroup4Count               int64          `redis:"ageGroup4Count" json:"ageGroup4Count"`
-	AggregateStats               AggregateStats `redis:"-" json:"aggregateStats"`
-}
-
-// AggregateStats are records of some time-consuming results and got updated at regular intervals
-type AggregateStats struct {
-	OvertimeCount    int                     `json:"overtimeCount"`
-	AdminPerformance map[string]*Performance `json:"adminPerformance"`
-}
-
-// Performance contains stats information about each ops
-type Performance struct {
-	TotalHandled                 int     `json:"totalHandled"`
-	AverageResponseTimeInMinutes float64 `json:"averageResponseTimeInMinutes"`
-	totalResponseTimeInMinutes   float64
+// sharedState is the state of the service shared with its copies bound to a context
+type sharedState struct {
+	// Set while the aggregate stats are recomputed, so slow recomputations do not overlap
+	aggregating int32
+	// Set while the time-windowed stats are recounted
+	countingTimeSeries int32
+	// Set while the cache is unreachable or being rebuilt after an outage
+	unavailable int32
+	// End of the lease of the leader lock held by this instance, see IsLeader
+	leaderMu   sync.Mutex
+	leaseUntil time.Time
 }
 
 var log = logrus.New()
@@ -90,18 +88,92 @@ func NewService(db *db.Service, sseServer *sse.Broker) *Service {
 	log.Info("Redis cache connection established. Please wait a few moments for initilization...")
 
 	return &Service{
-		dbService: db,
-		pool:      pool,
-		sseServer: sseServer,
+		dbService:   db,
+		pool:        pool,
+		sseServer:   sseServer,
+		sharedState: &sharedState{},
+	}
+}
+
+// WithContext returns the service with its operations bound to the context, e.g to the deadline of a worker
+// task. Operations of the returned service, including the db operations it makes, fail once the context is done
+func (svc *Service) WithContext(ctx context.Context) *Service {
+	bound := *svc
+	bound.ctx = ctx
+	if svc.dbService != nil {
+		bound.dbService = svc.dbService.WithContext(ctx)
+	}
+	return &bound
+}
+
+// conn gets a connection of the pool. Commands of connections of a service bound to a context fail once the
+// context is done
+func (svc *Service) conn() redis.Conn {
+	if svc.ctx == nil {
+		return svc.pool.Get()
+	}
+	conn, _ := svc.pool.GetContext(svc.ctx)
+	return contextConn{Conn: conn, ctx: svc.ctx}
+}
+
+// contextConn is a connection running commands until the deadline of the context
+type contextConn struct {
+	redis.Conn
+	ctx context.Context
+}
+
+func (c contextConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
 	}
+	if deadline, ok := c.ctx.Deadline(); ok {
+		return redis.DoWithTimeout(c.Conn, time.Until(deadline), commandName, args...)
+	}
+	return c.Conn.Do(commandName, args...)
+}
+
+// Info returns the section of the INFO of the redis server, e.g commandstats
+func (svc *Service) Info(section string) (string, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	return redis.String(conn.Do("INFO", section))
+}
+
+// Ping checks for cache connection
+func (svc *Service) Ping() error {
+	conn := svc.conn()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
 }
 
-// UpdateAggregateStats will be called at certain time intervals to start calculate and analyze all records
-// and update the aggregateStats field in the Stats cache
+// tenantKey namespaces the cache key by the tenant with the server ID, so the stats of tenants do not blend
+func tenantKey(key, serverID string) string {
+	return tenant.Config{ID: serverID}.Key(key)
+}
+
+// UpdateAggregateStats recomputes the aggregate stats of every tenant from all records and updates the
+// aggregateStats field in the Stats cache of the tenant. Decisions update them as they are made, so this only
+// reconciles them on startup and at a long interval. Skipped if a recomputation is already running
 func (svc *Service) UpdateAggregateStats() error {
+	if !atomic.CompareAndSwapInt32(&svc.aggregating, 0, 1) {
+		log.Warn("Aggregate stats are already being updated. Skipping")
+		return nil
+	}
+	defer atomic.StoreInt32(&svc.aggregating, 0)
+	for _, cfg := range tenant.All() {
+		err := svc.updateAggregateStats(cfg.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svc *Service) updateAggregateStats(serverID string) error {
 	overtimeCount := 0
 
-	pendingRequests, err := svc.dbService.GetRequests(-1, bson.M{"status": "Pending"})
+	pendingRequests, err := svc.dbService.GetRequests(-1, db.InTenant(bson.M{"status": types.StatusPending}, serverID))
 	if err != nil {
 		return err
 	}
@@ -112,43 +184,94 @@ func (svc *Service) UpdateAggregateStats() error {
 			overtimeCount++
 		}
 	}
-	fulfilledRequests, err := svc.dbService.GetRequests(-1, bson.M{
-		"status": bson.M{"$in": []string{"Denied", "Approved", "Banned", "Deactivated"}},
-	})
+	fulfilledRequests, err := svc.dbService.GetRequests(-1, db.InTenant(bson.M{
+		"status": bson.M{"$in": []string{types.StatusDenied, types.StatusApproved, types.StatusBanned, types.StatusDeactivated}},
+	}, serverID))
 	if err != nil {
 		return err
 	}
-	adminPerformance := make(map[string]*Performance)
+	adminPerformance := make(map[string]*types.Performance)
+	var approvedCount, decisions int64
+	var totalDecisionTime float64
+	recentDecisionTimes := make([]float64, 0)
 	for _, request := range fulfilledRequests {
+		if request.Status == types.StatusApproved {
+			approvedCount++
+		}
+		// Imported requests were never decided by an op
+		if request.ImportedAt != nil {
+			continue
+		}
+		if (request.Status == types.StatusApproved || request.Status == types.StatusDenied) &&
+			currentTime.Sub(request.ProcessedTimestamp) <= recentDecisionWindow {
+			recentDecisionTimes = append(recentDecisionTimes, request.ProcessedTimestamp.Sub(request.Timestamp).Minutes())
+		}
 		processingTime := request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
+		decisions++
+		totalDecisionTime += processingTime
 		if p, ok := adminPerformance[request.Admin]; ok {
-			p.totalResponseTimeInMinutes += processingTime
-			p.AverageResponseTimeInMinutes = p.totalResponseTimeInMinutes / (float64(p.TotalHandled) + 1)
+			p.TotalResponseTimeInMinutes += processingTime
+			p.AverageResponseTimeInMinutes = p.TotalResponseTimeInMinutes / (float64(p.TotalHandled) + 1)
 			p.TotalHandled++
 		} else {
-			p := new(Performance)
+			p := new(types.Performance)
 			p.TotalHandled = 1
-			p.totalResponseTimeInMinutes = processingTime
+			p.TotalResponseTimeInMinutes = processingTime
 			p.AverageResponseTimeInMinutes = processingTime
 			adminPerformance[request.Admin] = p
 		}
 	}
-	var aggreagateStats = AggregateStats{
+	resubmissions, err := svc.dbService.GetRequests(-1, db.InTenant(bson.M{"previousRequestId": bson.M{"$exists": true}}, serverID))
+	if err != nil {
+		return err
+	}
+	opResponse, err := CountOpResponses(svc.dbService, serverID)
+	if err != nil {
+		return err
+	}
+	referrers, err := svc.dbService.CountReferrals(serverID)
+	if err != nil {
+		return err
+	}
+	var aggreagateStats = types.AggregateStats{
 		OvertimeCount:    overtimeCount,
 		AdminPerformance: adminPerformance,
+		ResubmissionRate: resubmissionRate(fulfilledRequests, resubmissions),
+		Latency:          latencyStats(fulfilledRequests, currentTime),
+		OpResponse:       opResponse,
+		Referrers:        referrers,
+	}
+	field, ok, err := form.BreakdownField(tenant.Config{ID: serverID})
+	if err != nil {
+		return err
+	}
+	if ok {
+		aggreagateStats.ApprovalBreakdown = approvalBreakdown(field, fulfilledRequests)
 	}
 	// serialize objects to JSON
 	json, err := json.Marshal(aggreagateStats)
 	if err != nil {
 		return err
 	}
-	conn := svc.pool.Get()
+	conn := svc.conn()
 	defer conn.Close()
-	_, err = conn.Do("HMSET", statsKey, aggregateStatusField, json)
+	_, err = conn.Do("HMSET", tenantKey(statsKey, serverID), aggregateStatusField, json,
+		"decisions", decisions,
+		"totalDecisionTimeInMinutes", totalDecisionTime,
+		"averageDecisionTimeInMinutes", averageOf(totalDecisionTime, decisions))
 	if err != nil {
 		return err
 	}
-	err = svc.BroadcastStats()
+	err = svc.setQueueLoad(serverID, types.QueueLoad{
+		Pending:                     int64(len(pendingRequests)),
+		Approved:                    approvedCount,
+		MedianDecisionTimeInMinutes: median(recentDecisionTimes),
+		UpdatedTimestamp:            currentTime,
+	})
+	if err != nil {
+		return err
+	}
+	err = svc.BroadcastStats(serverID)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err": err.Error(),
@@ -157,175 +280,375 @@ func (svc *Service) UpdateAggregateStats() error {
 	return nil
 }
 
-// GetAllRequests get the cached value of all requets in db if exists
-func (svc *Service) GetAllRequests() ([]types.WhitelistRequest, error) {
-	conn := svc.pool.Get()
-	defer conn.Close()
-	// Check if the key exists
-	exists, err := redis.Int(conn.Do("EXISTS", allRequestKey))
+func (svc *Service) setQueueLoad(serverID string, load types.QueueLoad) error {
+	json, err := json.Marshal(load)
 	if err != nil {
-		return nil, err
-	} else if exists == 0 {
-		return nil, errors.New("Key does not exist")
+		return err
 	}
+	conn := svc.conn()
+	defer conn.Close()
+	_, err = conn.Do("SET", tenantKey(queueLoadKey, serverID), json)
+	return err
+}
 
-	// If exists, get cached value
-	s, err := redis.String(conn.Do("GET", allRequestKey))
+// GetQueueLoad get the cached snapshot of the current review queue of the tenant
+func (svc *Service) GetQueueLoad(serverID string) (types.QueueLoad, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	s, err := redis.String(conn.Do("GET", tenantKey(queueLoadKey, serverID)))
 	if err != nil {
-		return nil, err
+		return types.QueueLoad{}, err
 	}
-	var requests []types.WhitelistRequest
-	if err := json.Unmarshal([]byte(s), &requests); err != nil {
-		return nil, err
+	var load types.QueueLoad
+	if err := json.Unmarshal([]byte(s), &load); err != nil {
+		return types.QueueLoad{}, err
 	}
-	return requests, nil
+	return load, nil
 }
 
-// UpdateAllRequests updates the cached value of all requests by fetching from db once
-func (svc *Service) UpdateAllRequests() error {
-	requests, err := svc.dbService.GetRequests(-1, bson.D{{}})
-	if err != nil {
-		return err
-	}
-	// serialize objects to JSON
-	json, err := json.Marshal(requests)
-	if err != nil {
-		return err
-	}
-	conn := svc.pool.Get()
-	_, err = conn.Do("SET", allRequestKey, json)
-	if err != nil {
-		return err
-	}
-	return nil
+// SetDirectory store the generated member directory published to the community website
+func (svc *Service) SetDirectory(blob []byte) error {
+	conn := svc.conn()
+	defer conn.Close()
+	_, err := conn.Do("SET", directoryKey, blob)
+	return err
+}
+
+// GetDirectory get the last generated member directory
+func (svc *Service) GetDirectory() ([]byte, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	return redis.Bytes(conn.Do("GET", directoryKey))
+}
+
+// IncrDispatchCursor advances the round robin dispatching cursor of the tenant by n and returns the new value
+// The cursor lives in the cache so the rotation survives worker restarts
+func (svc *Service) IncrDispatchCursor(serverID string, n int) (int64, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	return redis.Int64(conn.Do("INCRBY", tenantKey(dispatchCursorKey, serverID), n))
 }
 
-// getStats get both real-time and aggregate stats from cache and unmarshal into struct
-func (svc *Service) getStats() (Stats, error) {
-	conn := svc.pool.Get()
+// GetStats get both real-time and aggregate stats of the tenant from cache and unmarshal into struct
+func (svc *Service) GetStats(serverID string) (types.Stats, error) {
+	conn := svc.conn()
 	defer conn.Close()
-	values, err := redis.Values(conn.Do("HGETALL", statsKey))
+	key := tenantKey(statsKey, serverID)
+	values, err := redis.Values(conn.Do("HGETALL", key))
 	if err != nil {
-		return Stats{}, err
+		return types.Stats{}, err
 	}
 
-	var stats Stats
+	var stats types.Stats
 	err = redis.ScanStruct(values, &stats)
 	if err != nil {
-		return Stats{}, err
+		return types.Stats{}, err
 	}
 	// Need to manually unmarshal AggregateStats as it is a nested struct
-	value, err := redis.Values(conn.Do("HMGET", statsKey, aggregateStatusField))
+	value, err := redis.Values(conn.Do("HMGET", key, aggregateStatusField))
 	// redis.Values returns []interface{}
 	aggregateStatsStr := fmt.Sprintf("%s", value[0])
 	if err != nil {
-		return Stats{}, err
+		return types.Stats{}, err
 	}
-	var aggregateStats AggregateStats
+	var aggregateStats types.AggregateStats
 	err = json.Unmarshal([]byte(aggregateStatsStr), &aggregateStats)
 	if err != nil {
-		return Stats{}, err
+		return types.Stats{}, err
 	}
 	stats.AggregateStats = aggregateStats
+	stats.ServerID = serverID
 	return stats, nil
 }
 
-// UpdateRealTimeStats makes proper change to the real-time portion of the stats in the cache
-// depending on changes on the system
+// UpdateRealTimeStats makes proper change to the real-time portion of the stats of the request's tenant in
+// the cache depending on changes on the system, see ApplyStatsDelta
 func (svc *Service) UpdateRealTimeStats(request types.WhitelistRequest) error {
+	return svc.ApplyStatsDelta(request.ServerID, StatsDeltaOf(request))
+}
+
+// refreshQueueLoad updates the counts of the queue load snapshot. The median decision time is only
+// recomputed with the aggregate stats
+func (svc *Service) refreshQueueLoad(serverID string, pending, approved int64) error {
+	load, err := svc.GetQueueLoad(serverID)
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	load.Pending = pending
+	load.Approved = approved
+	load.UpdatedTimestamp = time.Now()
+	return svc.setQueueLoad(serverID, load)
+}
+
+// RecordDecisionLatency adds the time from the submission of the decided request to its decision to the
+// decision stats and the performance of the op who made it
+func (svc *Service) RecordDecisionLatency(request types.WhitelistRequest) error {
+	if request.Canary || request.ImportedAt != nil {
+		return nil
+	}
+	key := tenantKey(statsKey, request.ServerID)
 	for n := 1; n <= maxRetry; n++ {
-		conn := svc.pool.Get()
+		conn := svc.conn()
 		defer conn.Close()
-		stats, err := svc.getStats()
+		_, err := conn.Do("WATCH", key)
 		if err != nil {
 			return err
 		}
-		// Instruct Redis to watch the stats hash for any changes
-		_, err = conn.Do("WATCH", statsKey)
+		stats, err := svc.GetStats(request.ServerID)
+		if err != nil {
+			return err
+		}
+		stats = recordDecision(stats, request)
+		json, err := json.Marshal(stats.AggregateStats)
 		if err != nil {
 			return err
 		}
-		newApprovedCount := stats.Approved
-		newDeniedCount := stats.Denied
-		newPendingCount := stats.Pending
-		newBannedCount := stats.Banned
-		newDeactivatedCount := stats.Deactivated
-		newTotalResponseTimeInMinutes := stats.TotalResponseTimeInMinutes
-		var newAverageResponseTimeInMinutes float64
-		var args = make([]interface{}, 0)
-		args = append(args, statsKey)
-		// Update the values for stats on the cache according to different type of actions being
-		// made for the request
-		switch request.Status {
-		case "Approved":
-			args = append(args, updateAgeGenderStats(request, stats, 1)...)
-			newApprovedCount++
-			newPendingCount--
-			newTotalResponseTimeInMinutes += request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
-			args = append(args, []interface{}{"pending", newPendingCount, "approved", newApprovedCount, "totalResponseTimeInMinutes", newTotalResponseTimeInMinutes}...)
-		case "Denied":
-			newDeniedCount++
-			newPendingCount--
-			newTotalResponseTimeInMinutes += request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
-			args = append(args, []interface{}{"pending", newPendingCount, "denied", newDeniedCount, "totalResponseTimeInMinutes", newTotalResponseTimeInMinutes}...)
-		case "Pending":
-			newPendingCount++
-			args = append(args, []interface{}{"pending", newPendingCount}...)
-		case "Banned":
-			newBannedCount++
-			newApprovedCount--
-			args = append(args, []interface{}{"approved", newApprovedCount, "banned", newBannedCount}...)
-			args = append(args, updateAgeGenderStats(request, stats, -1)...)
-		case "Deactivated":
-			newApprovedCount--
-			newDeactivatedCount++
-			args = append(args, []interface{}{"approved", newApprovedCount, "deactivated", newDeactivatedCount}...)
-			args = append(args, updateAgeGenderStats(request, stats, -1)...)
-		}
-		// Only update the average reponse time stats if the request is being fulfilled
-		if newTotalResponseTimeInMinutes != 0 {
-			newAverageResponseTimeInMinutes = newTotalResponseTimeInMinutes / float64(newApprovedCount+newDeniedCount+newBannedCount+newDeactivatedCount)
-			args = append(args, []interface{}{"averageResponseTimeInMinutes", newAverageResponseTimeInMinutes}...)
-		}
-		// Use the MULTI command to inform Redis that we are starting
-		// a new transaction.
 		err = conn.Send("MULTI")
 		if err != nil {
 			return err
 		}
-		err = conn.Send("HMSET", args...)
+		err = conn.Send("HMSET", key, aggregateStatusField, json,
+			"decisions", stats.Decisions,
+			"totalDecisionTimeInMinutes", stats.TotalDecisionTimeInMinutes,
+			"averageDecisionTimeInMinutes", stats.AverageDecisionTimeInMinutes)
 		if err != nil {
 			return err
 		}
-		// Execute the transaction. Importantly, use the redis.ErrNil
-		// type to check whether the reply from EXEC was nil or not. If
-		// it is nil it means that another client changed the WATCHed
-		// field, so we use the continue command to re-run
-		// the loop.
 		_, err = redis.Values(conn.Do("EXEC"))
 		if err == redis.ErrNil {
-			log.Debugf("Race condition detected during stats update. Retring %d/%d \n", n, maxRetry)
+			log.Debugf("Race condition detected during decision stats update. Retring %d/%d \n", n, maxRetry)
 			time.Sleep(time.Second * 2)
 			continue
 		} else if err != nil {
 			return err
 		}
-		// After a successful update, broadcast the new stats to clients
-		// who are listening for the stats update via ServerSideEvent http server
-		err = svc.BroadcastStats()
+		err = svc.BroadcastStats(request.ServerID)
 		if err != nil {
 			log.WithFields(logrus.Fields{
 				"err": err.Error(),
-			}).Error("Unable to broadcast event for stats update")
+			}).Error("Unable to broadcast event for decision stats update")
 		}
 		return nil
 	}
-	return errors.New("Unable to update stats. Give up")
+	return errors.New("Unable to update decision stats. Give up")
+}
+
+// recordDecision returns the stats with the decision of the request added
+func recordDecision(stats types.Stats, request types.WhitelistRequest) types.Stats {
+	latency := request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
+	stats.Decisions++
+	stats.TotalDecisionTimeInMinutes += latency
+	stats.AverageDecisionTimeInMinutes = averageOf(stats.TotalDecisionTimeInMinutes, stats.Decisions)
+
+	performance := make(map[string]*types.Performance, len(stats.AggregateStats.AdminPerformance)+1)
+	for admin, p := range stats.AggregateStats.AdminPerformance {
+		copied := *p
+		performance[admin] = &copied
+	}
+	p, ok := performance[request.Admin]
+	if !ok {
+		p = new(types.Performance)
+		performance[request.Admin] = p
+	}
+	// The total of ops is not stored with the aggregate stats
+	p.TotalResponseTimeInMinutes = p.AverageResponseTimeInMinutes*float64(p.TotalHandled) + latency
+	p.TotalHandled++
+	p.AverageResponseTimeInMinutes = p.TotalResponseTimeInMinutes / float64(p.TotalHandled)
+	stats.AggregateStats.AdminPerformance = performance
+	return stats
+}
+
+// OpResponseCounter counts the response times of the ops of a tenant. Implemented by *db.Service
+type OpResponseCounter interface {
+	CountOpResponses(serverID string) ([]types.OpResponseStats, error)
+}
+
+// CountOpResponses counts how quickly each op of the tenant responds to the requests sent to them in db, most
+// requests assigned first
+func CountOpResponses(counter OpResponseCounter, serverID string) ([]types.OpResponseStats, error) {
+	counts, err := counter.CountOpResponses(serverID)
+	if err != nil {
+		return nil, err
+	}
+	return opResponseStats(counts), nil
+}
+
+// opResponseStats computes the median response time of each op from the response times counted in db
+func opResponseStats(counts []types.OpResponseStats) []types.OpResponseStats {
+	for i := range counts {
+		responseTimes := make([]float64, 0, len(counts[i].ResponseTimes))
+		for _, responseTime := range counts[i].ResponseTimes {
+			if responseTime != nil {
+				responseTimes = append(responseTimes, *responseTime)
+			}
+		}
+		counts[i].MedianResponseTimeInMinutes = median(responseTimes)
+		counts[i].ResponseTimes = nil
+	}
+	sort.SliceStable(counts, func(i, j int) bool {
+		if counts[i].Assigned != counts[j].Assigned {
+			return counts[i].Assigned > counts[j].Assigned
+		}
+		return counts[i].Op < counts[j].Op
+	})
+	return counts
+}
+
+// resubmissionRate is the share of the denied requests among the fulfilled requests that have been resubmitted
+func resubmissionRate(fulfilledRequests, resubmissions []types.WhitelistRequest) float64 {
+	resubmitted := make(map[string]bool, len(resubmissions))
+	for _, request := range resubmissions {
+		resubmitted[request.PreviousRequestID] = true
+	}
+	var denied, deniedResubmitted int
+	for _, request := range fulfilledRequests {
+		if request.Status != types.StatusDenied {
+			continue
+		}
+		denied++
+		if resubmitted[request.ID.Hex()] {
+			deniedResubmitted++
+		}
+	}
+	if denied == 0 {
+		return 0
+	}
+	return float64(deniedResubmitted) / float64(denied)
 }
 
-// BroadcastStats will push the current state of stats in cache to clients listening for SSE
-func (svc *Service) BroadcastStats() error {
-	stats, err := svc.getStats()
+// approvalBreakdown computes the approval rate of the requests decided by ops by their answer to the field. Answers
+// are listed in the order of the options of the field, answers no longer offered after them, and requests which did
+// not answer the field last. Banned requests may not have been decided, imported requests never were
+func approvalBreakdown(field form.Field, requests []types.WhitelistRequest) *types.ApprovalBreakdown {
+	byAnswer := make(map[string]*types.AnswerApproval)
+	for _, request := range requests {
+		approved := request.Status == types.StatusApproved || request.Status == types.StatusDeactivated
+		if (!approved && request.Status != types.StatusDenied) || request.ImportedAt != nil || request.Canary {
+			continue
+		}
+		answer := form.AnswerTo(request, field.Key)
+		a, ok := byAnswer[answer]
+		if !ok {
+			a = &types.AnswerApproval{Answer: answer}
+			byAnswer[answer] = a
+		}
+		a.Decided++
+		if approved {
+			a.Approved++
+		}
+	}
+	answers := make([]string, 0, len(byAnswer))
+	for answer := range byAnswer {
+		answers = append(answers, answer)
+	}
+	rank := func(answer string) int {
+		for i, option := range field.Options {
+			if option == answer {
+				return i
+			}
+		}
+		if answer == "" {
+			return len(field.Options) + 1
+		}
+		return len(field.Options)
+	}
+	sort.Slice(answers, func(i, j int) bool {
+		if rank(answers[i]) != rank(answers[j]) {
+			return rank(answers[i]) < rank(answers[j])
+		}
+		return answers[i] < answers[j]
+	})
+	breakdown := &types.ApprovalBreakdown{Field: field.Key, Answers: make([]types.AnswerApproval, 0, len(answers))}
+	for _, answer := range answers {
+		a := byAnswer[answer]
+		a.ApprovalRate = float64(a.Approved) / float64(a.Decided)
+		breakdown.Answers = append(breakdown.Answers, *a)
+	}
+	return breakdown
+}
+
+// Periods the latency percentiles are computed over, in days
+var latencyWindows = []int{7, 30}
+
+// latencyStats computes the percentiles of the time to decision and the time to whitelist of the requests
+// decided, respectively whitelisted, within each window. Imported requests were never decided by an op and
+// requests are only counted once decided, so neither skews the percentiles
+func latencyStats(requests []types.WhitelistRequest, now time.Time) []types.LatencyStats {
+	stats := make([]types.LatencyStats, 0, len(latencyWindows))
+	for _, days := range latencyWindows {
+		since := now.AddDate(0, 0, -days)
+		decisionTimes := make([]float64, 0)
+		whitelistTimes := make([]float64, 0)
+		for _, request := range requests {
+			if request.ImportedAt != nil || request.Canary {
+				continue
+			}
+			submitted := submittedAt(request)
+			if decided, ok := decidedAt(request); ok && !decided.Before(since) && !decided.Before(submitted) {
+				decisionTimes = append(decisionTimes, decided.Sub(submitted).Minutes())
+			}
+			// Whitelisted players may have been deactivated since
+			whitelisted := request.Status == types.StatusApproved || request.Status == types.StatusDeactivated
+			if processed := request.ProcessedAt; whitelisted && processed != nil && !processed.Before(since) && !processed.Before(submitted) {
+				whitelistTimes = append(whitelistTimes, processed.Sub(submitted).Minutes())
+			}
+		}
+		stats = append(stats, types.LatencyStats{
+			Days:                  days,
+			Decisions:             len(decisionTimes),
+			DecisionP50InMinutes:  percentile(decisionTimes, 50),
+			DecisionP95InMinutes:  percentile(decisionTimes, 95),
+			Whitelisted:           len(whitelistTimes),
+			WhitelistP50InMinutes: percentile(whitelistTimes, 50),
+			WhitelistP95InMinutes: percentile(whitelistTimes, 95),
+		})
+	}
+	return stats
+}
+
+// submittedAt is when the request was submitted. Requests stored before SubmittedAt was introduced only
+// have their creation timestamp
+func submittedAt(request types.WhitelistRequest) time.Time {
+	if request.SubmittedAt != nil {
+		return *request.SubmittedAt
+	}
+	return request.Timestamp
+}
+
+// decidedAt is when the request was first decided, or false if it was never decided. Requests stored
+// before DecidedAt was introduced fall back to the time of their last decision
+func decidedAt(request types.WhitelistRequest) (time.Time, bool) {
+	if request.DecidedAt != nil {
+		return *request.DecidedAt, true
+	}
+	return request.ProcessedTimestamp, !request.ProcessedTimestamp.IsZero()
+}
+
+// percentile returns the nearest-rank percentile p of the values, or 0 if there are none
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func averageOf(total float64, count int64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return total / float64(count)
+}
+
+// BroadcastStats will push the current state of stats of the tenant in cache to clients listening for SSE.
+// Clients tell the stats of tenants apart by their serverId
+func (svc *Service) BroadcastStats(serverID string) error {
+	stats, err := svc.GetStats(serverID)
 	if err != nil {
 		return err
 	}
@@ -333,14 +656,42 @@ func (svc *Service) BroadcastStats() error {
 	if err != nil {
 		return err
 	}
+	// No clients are listening outside of the server, e.g when stats are synced from the command line
+	if svc.sseServer == nil {
+		return nil
+	}
 	svc.sseServer.Notifier <- jsonBytes
 	return nil
 }
 
+// BroadcastAllStats pushes the stats of every tenant to clients listening for SSE, e.g when a client joins.
+// The SSE server only buffers one event, so the stats of several tenants are pushed in the background
+func (svc *Service) BroadcastAllStats() error {
+	if len(tenant.IDs()) == 0 {
+		return svc.BroadcastStats("")
+	}
+	go func() {
+		for _, cfg := range tenant.All() {
+			err := svc.BroadcastStats(cfg.ID)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"serverId": cfg.ID,
+					"err":      err.Error(),
+				}).Error("Unable to broadcast stats of tenant")
+			}
+		}
+	}()
+	return nil
+}
+
 // SyncStats will run once during startup to synchronize/ initilize everything stats related
 func (svc *Service) SyncStats() error {
-	// Sync all requets from db to cache
-	err := svc.UpdateAllRequests()
+	// Sync all requets from db to cache. This also migrates the cache layout of earlier versions
+	err := svc.RebuildRequests()
+	if err != nil {
+		return err
+	}
+	err = svc.RebuildBannedUsernames()
 	if err != nil {
 		return err
 	}
@@ -350,88 +701,68 @@ func (svc *Service) SyncStats() error {
 		return err
 	}
 	// Sync real-time stats
-	for n := 1; n <= maxRetry; n++ {
-		conn := svc.pool.Get()
-		defer conn.Close()
-		requests, err := svc.GetAllRequests()
+	requests, err := svc.GetAllRequests()
+	if err != nil {
+		return err
+	}
+	for _, cfg := range tenant.All() {
+		err = svc.syncRealTimeStats(cfg.ID, TenantRequests(requests, cfg.ID))
 		if err != nil {
 			return err
 		}
-		_, err = conn.Do("WATCH", statsKey)
+	}
+	log.Info("Initial cache sync completed")
+	return nil
+}
+
+// TenantRequests returns the requests of the tenant with the server ID
+func TenantRequests(requests []types.WhitelistRequest, serverID string) []types.WhitelistRequest {
+	filtered := make([]types.WhitelistRequest, 0, len(requests))
+	for _, request := range requests {
+		if request.ServerID == serverID {
+			filtered = append(filtered, request)
+		}
+	}
+	return filtered
+}
+
+// syncRealTimeStats recalculates the real-time stats of the tenant from its requests
+func (svc *Service) syncRealTimeStats(serverID string, requests []types.WhitelistRequest) error {
+	key := tenantKey(statsKey, serverID)
+	for n := 1; n <= maxRetry; n++ {
+		conn := svc.conn()
+		defer conn.Close()
+		_, err := conn.Do("WATCH", key)
 		if err != nil {
 			return err
 		}
 		// Recalculate the stats for all requests at the moment
 		// And update the stats value in cache
-		var approved, denied, pending, banned, deactivated int64
-		var totalResponseTimeInMinutes float64
-		var maleCount, femaleCount, otherGenderCount int64
-		var ageGroup1Count, ageGroup2Count, ageGroup3Count, ageGroup4Count int64
-		for _, request := range requests {
-			switch request.Status {
-			case "Approved":
-				approved++
-				// Gather gender metric
-				switch request.Gender {
-				case "male":
-					maleCount++
-				case "female":
-					femaleCount++
-				default:
-					otherGenderCount++
-				}
-				// Gather age group metric
-				age := request.Age
-				// temp value
-				var step int64 = ageGroupStep
-				if 0 <= age && age < step {
-					ageGroup1Count++
-				} else if step <= age && age < step*2 {
-					ageGroup2Count++
-				} else if step*2 <= age && age < step*3 {
-					ageGroup3Count++
-				} else {
-					ageGroup4Count++
-				}
-				totalResponseTimeInMinutes += request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
-			case "Denied":
-				denied++
-				totalResponseTimeInMinutes += request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
-			case "Pending":
-				pending++
-			case "Banned":
-				banned++
-				totalResponseTimeInMinutes += request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
-			case "Deactivated":
-				deactivated++
-				totalResponseTimeInMinutes += request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
-			}
-		}
-		var averageResponseTimeInMinutes float64
-		// Only update the averageResponseTime if there are fulfilled requests
-		if totalResponseTimeInMinutes != 0 {
-			averageResponseTimeInMinutes = totalResponseTimeInMinutes / float64(approved+denied+banned+deactivated)
-		}
+		stats := StatsFromRequests(requests)
 
 		err = conn.Send("MULTI")
 		if err != nil {
 			return err
 		}
 		err = conn.Send(
-			"HMSET", statsKey,
-			"pending", pending, "denied", denied,
-			"approved", approved,
-			"banned", banned,
-			"Deactivated", deactivated,
-			"averageResponseTimeInMinutes", averageResponseTimeInMinutes,
-			"totalResponseTimeInMinutes", totalResponseTimeInMinutes,
-			"maleCount", maleCount,
-			"femaleCount", femaleCount,
-			"otherGenderCount", otherGenderCount,
-			"ageGroup1Count", ageGroup1Count,
-			"ageGroup2Count", ageGroup2Count,
-			"ageGroup3Count", ageGroup3Count,
-			"ageGroup4Count", ageGroup4Count)
+			"HMSET", key,
+			"pending", stats.Pending, "denied", stats.Denied,
+			"approved", stats.Approved,
+			"banned", stats.Banned,
+			"Deactivated", stats.Deactivated,
+			"expired", stats.Expired,
+			"cancelled", stats.Cancelled,
+			"averageResponseTimeInMinutes", stats.AverageResponseTimeInMinutes,
+			"totalResponseTimeInMinutes", stats.TotalResponseTimeInMinutes,
+			"maleCount", stats.MaleCount,
+			"femaleCount", stats.FemaleCount,
+			"otherGenderCount", stats.OtherGenderCount,
+			"ageGroup1Count", stats.AgeGroup1Count,
+			"ageGroup2Count", stats.AgeGroup2Count,
+			"ageGroup3Count", stats.AgeGroup3Count,
+			"ageGroup4Count", stats.AgeGroup4Count,
+			"javaCount", stats.JavaCount,
+			"bedrockCount", stats.BedrockCount)
 		if err != nil {
 			return err
 		}
@@ -443,44 +774,129 @@ func (svc *Service) SyncStats() error {
 		} else if err != nil {
 			return err
 		}
-		log.Info("Initial cache sync completed")
 		return nil
 	}
 	return errors.New("Unable to sync cache. Give up")
 }
 
-// updateAgeGenderStats takes in a reuqest and make appropriate change to the stats
-func updateAgeGenderStats(request types.WhitelistRequest, stats Stats, delta int64) []interface{} {
-	args := make([]interface{}, 0)
-	var newMaleCount = stats.MaleCount
-	var newFemaleCount = stats.FemaleCount
-	var newOtherGenderCount = stats.OtherGenderCount
-	var newAgeGroup1Count = stats.AgeGroup1Count
-	var newAgeGroup2Count = stats.AgeGroup2Count
-	var newAgeGroup3Count = stats.AgeGroup3Count
-	var newAgeGroup4Count = stats.AgeGroup4Count
-	switch request.Gender {
-	case "male":
-		newMaleCount += delta
-	case "female":
-		newFemaleCount += delta
-	default:
-		newOtherGenderCount += delta
-	}
-	args = append(args, []interface{}{"maleCount", newMaleCount, "femaleCount", newFemaleCount, "otherGenderCount", newOtherGenderCount}...)
-
-	// Update age group metric
-	age := request.Age
-	var step int64 = ageGroupStep
-	if 0 <= age && age < step {
-		newAgeGroup1Count += delta
-	} else if step <= age && age < step*2 {
-		newAgeGroup2Count += delta
-	} else if step*2 <= age && age < step*3 {
-		newAgeGroup3Count += delta
-	} else {
-		newAgeGroup4Count += delta
-	}
-	args = append(args, []interface{}{"ageGroup1Count", newAgeGroup1Count, "ageGroup2Count", newAgeGroup2Count, "ageGroup3Count", newAgeGroup3Count, "ageGroup4Count", newAgeGroup4Count}...)
-	return args
+// StatsFromRequests calculates the real-time portion of the stats from all requests, e.g to serve
+// them from db while the cache is unavailable
+func StatsFromRequests(requests []types.WhitelistRequest) types.Stats {
+	var stats types.Stats
+	for _, request := range requests {
+		switch request.Status {
+		case types.StatusApproved:
+			stats.Approved++
+			// Gather gender metric
+			switch request.Gender {
+			case "male":
+				stats.MaleCount++
+			case "female":
+				stats.FemaleCount++
+			default:
+				stats.OtherGenderCount++
+			}
+			// Gather age group metric
+			age := request.Age
+			// temp value
+			var step int64 = ageGroupStep
+			if 0 <= age && age < step {
+				stats.AgeGroup1Count++
+			} else if step <= age && age < step*2 {
+				stats.AgeGroup2Count++
+			} else if step*2 <= age && age < step*3 {
+				stats.AgeGroup3Count++
+			} else {
+				stats.AgeGroup4Count++
+			}
+			if request.Platform == utils.PlatformBedrock {
+				stats.BedrockCount++
+			} else {
+				stats.JavaCount++
+			}
+			stats.TotalResponseTimeInMinutes += request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
+		case types.StatusDenied:
+			stats.Denied++
+			stats.TotalResponseTimeInMinutes += request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
+		case types.StatusPending, types.StatusDisputed, types.StatusWaitlisted:
+			// Disputed requests still await a decision, waitlisted ones a free slot on the game server
+			stats.Pending++
+		case types.StatusBanned:
+			stats.Banned++
+			stats.TotalResponseTimeInMinutes += request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
+		case types.StatusDeactivated:
+			stats.Deactivated++
+			stats.TotalResponseTimeInMinutes += request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
+		case types.StatusExpired:
+			stats.Expired++
+		case types.StatusCancelled:
+			stats.Cancelled++
+		}
+	}
+	// Only update the averageResponseTime if there are fulfilled requests
+	if stats.TotalResponseTimeInMinutes != 0 {
+		stats.AverageResponseTimeInMinutes = stats.TotalResponseTimeInMinutes / float64(stats.Approved+stats.Denied+stats.Banned+stats.Deactivated)
+	}
+	return stats
+}
+
+// median returns the median of the values, or 0 if there are none
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// IsTaskProcessed checks whether the worker has completed the task with the given key
+func (svc *Service) IsTaskProcessed(key string) (bool, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	return redis.Bool(conn.Do("EXISTS", processedTaskPrefix+key))
+}
+
+// MarkTaskProcessed records the task with the given key as completed by the worker for ttl
+func (svc *Service) MarkTaskProcessed(key string, ttl time.Duration) error {
+	conn := svc.conn()
+	defer conn.Close()
+	_, err := conn.Do("SET", processedTaskPrefix+key, 1, "EX", int64(ttl/time.Second))
+	return err
+}
+
+// ClaimEmail atomically records the email with the given key as sent for ttl. Returns false if it already is,
+// so concurrent or redelivered tasks send it once
+func (svc *Service) ClaimEmail(key string, ttl time.Duration) (bool, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	_, err := redis.String(conn.Do("SET", sentEmailPrefix+key, 1, "EX", int64(ttl/time.Second), "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseEmail forgets the email with the given key, e.g after it failed to send, so it can be sent again
+func (svc *Service) ReleaseEmail(key string) error {
+	conn := svc.conn()
+	defer conn.Close()
+	_, err := conn.Do("DEL", sentEmailPrefix+key)
+	return err
+}
+
+// ClaimMessageID atomically records the queue message with the ID as seen for ttl. Returns false if it already
+// is, so a message published again with the same ID is told apart from the original
+func (svc *Service) ClaimMessageID(id string, ttl time.Duration) (bool, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	_, err := redis.String(conn.Do("SET", seenMessagePrefix+id, 1, "PX", int64(ttl/time.Millisecond), "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
 }
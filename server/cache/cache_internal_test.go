@@ -0,0 +1,726 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/form"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var testCache *Service
+
+func TestMain(m *testing.M) {
+	// Mock the main application using the test configuration file
+	viper.SetConfigName("config_test")
+	viper.AddConfigPath("../")
+	viper.AutomaticEnv()
+	viper.SetConfigType("yml")
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Fatal("Error reading config file")
+	}
+	// Requests are written to the cache directly so no db is needed
+	testCache = NewService(nil, nil)
+	os.Exit(m.Run())
+}
+
+// newTestRequests returns requests updated one minute apart, the last one most recently
+func newTestRequests(n int) []types.WhitelistRequest {
+	statuses := []string{types.StatusPending, types.StatusApproved, types.StatusDenied}
+	start := time.Now().Add(-time.Duration(n) * time.Minute)
+	requests := make([]types.WhitelistRequest, n)
+	for i := range requests {
+		requests[i] = types.WhitelistRequest{
+			ID:                   primitive.NewObjectID(),
+			Username:             fmt.Sprintf("player%d", i),
+			Email:                fmt.Sprintf("player%d@gmail.com", i),
+			Status:               statuses[i%len(statuses)],
+			Timestamp:            start,
+			LastUpdatedTimestamp: start.Add(time.Duration(i) * time.Minute),
+			Info:                 map[string]interface{}{"applicationText": "I would like to join the server"},
+		}
+	}
+	return requests
+}
+
+func usernames(requests []types.WhitelistRequest) []string {
+	names := make([]string, 0, len(requests))
+	for _, request := range requests {
+		names = append(names, request.Username)
+	}
+	return names
+}
+
+func TestRequestsPaging(t *testing.T) {
+	requests := newTestRequests(7)
+	err := testCache.storeRequests(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Most recently updated first
+	page, total, err := testCache.GetRequestsPage("", 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(usernames(page)) != "[player4 player3 player2]" || total != 7 {
+		t.Errorf("Unexpected page %v of %d", usernames(page), total)
+	}
+	page, total, err = testCache.GetRequestsPage(types.StatusPending, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(usernames(page)) != "[player6 player3 player0]" || total != 3 {
+		t.Errorf("Unexpected pending requests %v of %d", usernames(page), total)
+	}
+	// Pages past the end are empty
+	page, total, err = testCache.GetRequestsPage(types.StatusDenied, 5, 5)
+	if err != nil || len(page) != 0 || total != 2 {
+		t.Errorf("Expected empty page of 2 denied requests, got %v of %d %v", usernames(page), total, err)
+	}
+
+	// A status change moves the request between the status indexes and to the front
+	updated := requests[0]
+	updated.Status = types.StatusApproved
+	updated.LastUpdatedTimestamp = time.Now()
+	err = testCache.UpsertRequest(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, total, err = testCache.GetRequestsPage(types.StatusPending, 0, -1)
+	if err != nil || fmt.Sprint(usernames(page)) != "[player6 player3]" || total != 2 {
+		t.Errorf("Expected request to leave the pending index, got %v of %d %v", usernames(page), total, err)
+	}
+	page, total, err = testCache.GetRequestsPage(types.StatusApproved, 0, 1)
+	if err != nil || len(page) != 1 || page[0].Status != types.StatusApproved || page[0].Username != "player0" || total != 3 {
+		t.Errorf("Expected updated request first among approved requests, got %+v of %d %v", page, total, err)
+	}
+
+	err = testCache.RemoveRequest(updated.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := testCache.GetAllRequests()
+	if err != nil || len(all) != 6 {
+		t.Errorf("Expected 6 requests left, got %d %v", len(all), err)
+	}
+}
+
+func TestRebuildRemovesLegacyKey(t *testing.T) {
+	conn := testCache.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SET", legacyAllRequestsKey, "[]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testCache.storeRequests(newTestRequests(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := redis.Bool(conn.Do("EXISTS", legacyAllRequestsKey))
+	if err != nil || exists {
+		t.Errorf("Expected the monolithic key to be removed, got %v %v", exists, err)
+	}
+	// Entries of an earlier layout do not survive a rebuild
+	all, err := testCache.GetAllRequests()
+	if err != nil || len(all) != 2 {
+		t.Errorf("Expected 2 requests, got %d %v", len(all), err)
+	}
+}
+
+func TestCanariesAreNotCached(t *testing.T) {
+	err := testCache.storeRequests(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canary := newTestRequests(1)[0]
+	canary.Canary = true
+	err = testCache.UpsertRequest(canary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := testCache.GetAllRequests()
+	if err != nil || len(all) != 0 {
+		t.Errorf("Expected canary not to be cached, got %d %v", len(all), err)
+	}
+}
+
+func TestRequestByIDFilledOnMiss(t *testing.T) {
+	request := newTestRequests(1)[0]
+	loads := 0
+	load := func(id primitive.ObjectID) ([]types.WhitelistRequest, error) {
+		loads++
+		if id != request.ID {
+			return nil, nil
+		}
+		return []types.WhitelistRequest{request}, nil
+	}
+	for i := 0; i < 2; i++ {
+		got, err := testCache.getRequestByID(request.ID, load)
+		if err != nil || got.Username != request.Username || got.Status != request.Status {
+			t.Fatalf("Expected request %s, got %+v %v", request.Username, got, err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("Expected the request to be read from db once, got %d", loads)
+	}
+	// Written through on changes
+	request.Status = types.StatusApproved
+	err := testCache.SetRequestByID(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := testCache.getRequestByID(request.ID, load); err != nil || got.Status != types.StatusApproved || loads != 1 {
+		t.Errorf("Expected the changed request from cache, got %q %v after %d loads", got.Status, err, loads)
+	}
+}
+
+func TestRequestByIDNotFoundIsCached(t *testing.T) {
+	loads := 0
+	load := func(id primitive.ObjectID) ([]types.WhitelistRequest, error) {
+		loads++
+		return nil, nil
+	}
+	id := primitive.NewObjectID()
+	for i := 0; i < 2; i++ {
+		if _, err := testCache.getRequestByID(id, load); err != ErrRequestNotFound {
+			t.Fatalf("Expected request not found, got %v", err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("Expected the missing request to be read from db once, got %d", loads)
+	}
+	conn := testCache.pool.Get()
+	defer conn.Close()
+	if ttl, err := redis.Int64(conn.Do("TTL", requestByIDKey(id))); err != nil || ttl <= 0 || ttl > int64(notFoundTTL.Seconds()) {
+		t.Errorf("Expected the missing request to expire within %v, got %d %v", notFoundTTL, ttl, err)
+	}
+	// A failed load is not cached
+	failing := func(id primitive.ObjectID) ([]types.WhitelistRequest, error) {
+		return nil, errors.New("db unavailable")
+	}
+	other := primitive.NewObjectID()
+	if _, err := testCache.getRequestByID(other, failing); err == nil || err == ErrRequestNotFound {
+		t.Errorf("Expected the db error, got %v", err)
+	}
+	if exists, _ := redis.Bool(conn.Do("EXISTS", requestByIDKey(other))); exists {
+		t.Error("Expected a failed load not to be cached")
+	}
+}
+
+func TestCountAttempt(t *testing.T) {
+	key := "test:" + primitive.NewObjectID().Hex()
+	count, _, err := testCache.GetAttempts(key)
+	if err != nil || count != 0 {
+		t.Fatalf("Expected no attempts, got %d %v", count, err)
+	}
+	for i := 1; i <= 3; i++ {
+		count, ttl, err := testCache.CountAttempt(key, time.Minute)
+		if err != nil || count != int64(i) || ttl <= 0 || ttl > time.Minute {
+			t.Fatalf("Unexpected attempt %d in window %v %v", count, ttl, err)
+		}
+	}
+	// The window is not extended by later attempts
+	count, ttl, err := testCache.CountAttempt(key, time.Hour)
+	if err != nil || count != 4 || ttl > time.Minute {
+		t.Errorf("Expected the window of the first attempt, got %d %v %v", count, ttl, err)
+	}
+	count, _, err = testCache.GetAttempts(key)
+	if err != nil || count != 4 {
+		t.Errorf("Expected 4 attempts, got %d %v", count, err)
+	}
+}
+
+func TestConsumeActionNonce(t *testing.T) {
+	nonce := primitive.NewObjectID().Hex()
+	if state, err := testCache.ActionNonceState(nonce); err != nil || state != "" {
+		t.Fatalf("Expected unknown nonce, got %q %v", state, err)
+	}
+	err := testCache.StoreActionNonce(nonce, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, err := testCache.ActionNonceState(nonce); err != nil || state != NonceUnused {
+		t.Fatalf("Expected unused nonce, got %q %v", state, err)
+	}
+	if consumed, err := testCache.ConsumeActionNonce(nonce); err != nil || !consumed {
+		t.Fatalf("Expected the nonce to be consumed, got %v %v", consumed, err)
+	}
+	// Only the first use consumes the nonce
+	if consumed, err := testCache.ConsumeActionNonce(nonce); err != nil || consumed {
+		t.Errorf("Expected the nonce to be consumed once, got %v %v", consumed, err)
+	}
+	if state, err := testCache.ActionNonceState(nonce); err != nil || state != NonceConsumed {
+		t.Errorf("Expected consumed nonce, got %q %v", state, err)
+	}
+	conn := testCache.pool.Get()
+	defer conn.Close()
+	if ttl, err := redis.Int64(conn.Do("PTTL", actionNoncePrefix+nonce)); err != nil || ttl <= 0 {
+		t.Errorf("Expected the consumed nonce to keep its expiry, got %d %v", ttl, err)
+	}
+}
+
+func TestClaimEmail(t *testing.T) {
+	key := primitive.NewObjectID().Hex() + ":approved:approve"
+	if claimed, err := testCache.ClaimEmail(key, time.Minute); err != nil || !claimed {
+		t.Fatalf("Expected the email to be claimed, got %v %v", claimed, err)
+	}
+	// Only the first claim sends the email
+	if claimed, err := testCache.ClaimEmail(key, time.Minute); err != nil || claimed {
+		t.Errorf("Expected the email to be claimed once, got %v %v", claimed, err)
+	}
+	// A released email is sent by the retry
+	if err := testCache.ReleaseEmail(key); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := testCache.ClaimEmail(key, time.Minute); err != nil || !claimed {
+		t.Errorf("Expected the released email to be claimed again, got %v %v", claimed, err)
+	}
+}
+
+func TestBannedUsernames(t *testing.T) {
+	username := "Griefer_" + primitive.NewObjectID().Hex()[18:]
+	defer testCache.RemoveBannedUsername("", username)
+	if err := testCache.AddBannedUsername("", username); err != nil {
+		t.Fatal(err)
+	}
+	// Usernames are matched ignoring case
+	banned, err := testCache.IsUsernameBanned("", strings.ToUpper(username))
+	if err != nil || !banned {
+		t.Fatalf("Expected username to be banned, got %v %v", banned, err)
+	}
+	// Bans are per tenant
+	banned, err = testCache.IsUsernameBanned("creative", username)
+	if err != nil || banned {
+		t.Fatalf("Expected username not to be banned by another tenant, got %v %v", banned, err)
+	}
+	if err = testCache.RemoveBannedUsername("", username); err != nil {
+		t.Fatal(err)
+	}
+	banned, err = testCache.IsUsernameBanned("", username)
+	if err != nil || banned {
+		t.Errorf("Expected unbanned username not to be banned, got %v %v", banned, err)
+	}
+}
+
+func TestRecordDecisionLatency(t *testing.T) {
+	conn := testCache.pool.Get()
+	defer conn.Close()
+	aggregate, _ := json.Marshal(types.AggregateStats{
+		AdminPerformance: map[string]*types.Performance{
+			"admin1": {TotalHandled: 2, AverageResponseTimeInMinutes: 30},
+		},
+	})
+	_, err := conn.Do("HMSET", statsKey, aggregateStatusField, aggregate,
+		"decisions", 2, "totalDecisionTimeInMinutes", 60, "averageDecisionTimeInMinutes", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitted := time.Now().Add(-2 * time.Hour)
+	decisions := []types.WhitelistRequest{
+		{Admin: "admin1", Status: types.StatusApproved, Timestamp: submitted, ProcessedTimestamp: submitted.Add(90 * time.Minute)},
+		{Admin: "admin2", Status: types.StatusDenied, Timestamp: submitted, ProcessedTimestamp: submitted.Add(60 * time.Minute)},
+		// Not counted
+		{Admin: "admin2", Status: types.StatusApproved, Canary: true, Timestamp: submitted, ProcessedTimestamp: submitted.Add(time.Minute)},
+	}
+	for _, request := range decisions {
+		if err = testCache.RecordDecisionLatency(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := testCache.GetStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Decisions != 4 || stats.TotalDecisionTimeInMinutes != 210 || stats.AverageDecisionTimeInMinutes != 52.5 {
+		t.Errorf("Expected 4 decisions taking 52.5 minutes on average, got %d %v %v",
+			stats.Decisions, stats.TotalDecisionTimeInMinutes, stats.AverageDecisionTimeInMinutes)
+	}
+	admin1 := stats.AggregateStats.AdminPerformance["admin1"]
+	if admin1 == nil || admin1.TotalHandled != 3 || admin1.AverageResponseTimeInMinutes != 50 {
+		t.Errorf("Expected admin1 to have handled 3 requests in 50 minutes on average, got %+v", admin1)
+	}
+	admin2 := stats.AggregateStats.AdminPerformance["admin2"]
+	if admin2 == nil || admin2.TotalHandled != 1 || admin2.AverageResponseTimeInMinutes != 60 {
+		t.Errorf("Expected admin2 to have handled 1 request in 60 minutes, got %+v", admin2)
+	}
+}
+
+func TestApplyStatsDelta(t *testing.T) {
+	conn := testCache.pool.Get()
+	defer conn.Close()
+	aggregate, _ := json.Marshal(types.AggregateStats{})
+	_, err := conn.Do("HMSET", statsKey, aggregateStatusField, aggregate, "pending", 3, "approved", 1,
+		"totalResponseTimeInMinutes", 30, "maleCount", 1, "ageGroup2Count", 1, "javaCount", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitted := time.Now().Add(-2 * time.Hour)
+	changes := []types.WhitelistRequest{
+		{Status: types.StatusApproved, Gender: "female", Age: 16, Platform: utils.PlatformBedrock, Timestamp: submitted,
+			ProcessedTimestamp: submitted.Add(60 * time.Minute)},
+		{Status: types.StatusDenied, Timestamp: submitted, ProcessedTimestamp: submitted.Add(30 * time.Minute)},
+		{Status: types.StatusPending},
+		{Status: types.StatusBanned, Gender: "male", Age: 20},
+		// Not counted
+		{Status: types.StatusApproved, Canary: true, Timestamp: submitted, ProcessedTimestamp: submitted.Add(time.Minute)},
+	}
+	// Changes added up are applied like one by one
+	var delta StatsDelta
+	for _, request := range changes {
+		delta.Add(StatsDeltaOf(request))
+	}
+	if delta.Changes != 4 {
+		t.Errorf("Expected the canary not to be counted, got %d changes", delta.Changes)
+	}
+	if err = testCache.ApplyStatsDelta("", delta); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := testCache.GetStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Pending != 2 || stats.Approved != 1 || stats.Denied != 1 || stats.Banned != 1 {
+		t.Errorf("Expected 2 pending, 1 approved, 1 denied and 1 banned requests, got %+v", stats)
+	}
+	if stats.TotalResponseTimeInMinutes != 120 || stats.AverageResponseTimeInMinutes != 40 {
+		t.Errorf("Expected 120 minutes of response time, 40 on average, got %v %v",
+			stats.TotalResponseTimeInMinutes, stats.AverageResponseTimeInMinutes)
+	}
+	if stats.MaleCount != 0 || stats.FemaleCount != 1 || stats.AgeGroup2Count != 1 {
+		t.Errorf("Expected the banned applicant to be replaced by the approved one, got %+v", stats)
+	}
+	if stats.JavaCount != 0 || stats.BedrockCount != 1 {
+		t.Errorf("Expected the banned Java player to be replaced by the approved Bedrock player, got %+v", stats)
+	}
+	conn.Do("DEL", statsKey)
+	if err = testCache.ApplyStatsDelta("", delta); err == nil {
+		t.Error("Expected stats not synced yet not to be updated")
+	}
+}
+
+func TestResubmissionRate(t *testing.T) {
+	denied := []types.WhitelistRequest{
+		{ID: primitive.NewObjectID(), Status: types.StatusDenied},
+		{ID: primitive.NewObjectID(), Status: types.StatusDenied},
+		{ID: primitive.NewObjectID(), Status: types.StatusDenied},
+		{ID: primitive.NewObjectID(), Status: types.StatusDenied},
+		{ID: primitive.NewObjectID(), Status: types.StatusApproved},
+	}
+	resubmissions := []types.WhitelistRequest{
+		{ID: primitive.NewObjectID(), PreviousRequestID: denied[0].ID.Hex()},
+		// Denied requests are counted once
+		{ID: primitive.NewObjectID(), PreviousRequestID: denied[1].ID.Hex()},
+		{ID: primitive.NewObjectID(), PreviousRequestID: denied[1].ID.Hex()},
+	}
+	if rate := resubmissionRate(denied, resubmissions); rate != 0.5 {
+		t.Errorf("Expected half of the denied requests to be resubmitted, got %v", rate)
+	}
+	if rate := resubmissionRate(nil, nil); rate != 0 {
+		t.Errorf("Expected no resubmission rate without denied requests, got %v", rate)
+	}
+}
+
+func TestApprovalBreakdown(t *testing.T) {
+	field := form.Field{Key: "referral", Options: []string{"Friend", "Reddit"}}
+	answered := func(status, referral string) types.WhitelistRequest {
+		return types.WhitelistRequest{Status: status, Answers: []types.Answer{{Key: "referral", Value: referral}}}
+	}
+	breakdown := approvalBreakdown(field, []types.WhitelistRequest{
+		answered(types.StatusApproved, "Reddit"),
+		answered(types.StatusDenied, "Reddit"),
+		answered(types.StatusDeactivated, "Friend"),
+		answered(types.StatusApproved, "Forum"),
+		{Status: types.StatusDenied},
+		// Not decided by an op
+		answered(types.StatusBanned, "Friend"),
+		{Status: types.StatusApproved, ImportedAt: &time.Time{}},
+	})
+	expected := []types.AnswerApproval{
+		{Answer: "Friend", Decided: 1, Approved: 1, ApprovalRate: 1},
+		{Answer: "Reddit", Decided: 2, Approved: 1, ApprovalRate: 0.5},
+		{Answer: "Forum", Decided: 1, Approved: 1, ApprovalRate: 1},
+		{Answer: "", Decided: 1, Approved: 0, ApprovalRate: 0},
+	}
+	if breakdown.Field != "referral" || !reflect.DeepEqual(breakdown.Answers, expected) {
+		t.Errorf("Expected the approval rate by referral, got %+v", breakdown)
+	}
+}
+
+func TestTimeSeriesFromCounts(t *testing.T) {
+	now := time.Date(2019, 11, 7, 13, 0, 0, 0, time.UTC)
+	series := TimeSeriesFromCounts(types.TimeSeriesCounts{
+		Submissions: []types.SubmissionCount{
+			{Day: "2019-11-07", Hour: 9, Count: 2},
+			{Day: "2019-11-05", Hour: 9, Count: 1},
+			{Day: "2019-11-05", Hour: 21, Count: 3},
+			// Before the range
+			{Day: "2019-11-04", Hour: 9, Count: 5},
+		},
+		Decisions: []types.DecisionCount{
+			{Day: "2019-11-05", Status: types.StatusApproved, Count: 2},
+			{Day: "2019-11-05", Status: types.StatusDenied, Count: 1},
+			{Day: "2019-11-01", Status: types.StatusApproved, Count: 4},
+		},
+	}, 3, now)
+	if series.From != "2019-11-05" || series.To != "2019-11-07" || len(series.Days) != 3 {
+		t.Fatalf("Expected the 3 days up to today, got %+v", series)
+	}
+	expected := []types.DayStats{
+		{Date: "2019-11-05", Submitted: 4, Decided: map[string]int64{types.StatusApproved: 2, types.StatusDenied: 1}},
+		{Date: "2019-11-06", Submitted: 0, Decided: map[string]int64{}},
+		{Date: "2019-11-07", Submitted: 2, Decided: map[string]int64{}},
+	}
+	if !reflect.DeepEqual(series.Days, expected) {
+		t.Errorf("Expected days %+v, got %+v", expected, series.Days)
+	}
+	if len(series.SubmissionsByHour) != 24 || series.SubmissionsByHour[9] != 3 || series.SubmissionsByHour[21] != 3 {
+		t.Errorf("Unexpected submissions by hour %v", series.SubmissionsByHour)
+	}
+}
+
+func TestOpLeaderboardFromCounts(t *testing.T) {
+	now := time.Date(2019, 11, 7, 13, 0, 0, 0, time.UTC)
+	leaderboard := OpLeaderboardFromCounts(types.OpDecisionCounts{
+		Decisions: []types.OpDecisionCount{
+			{Day: "2019-11-07", Op: "bob", Status: types.StatusApproved, Count: 1},
+			{Day: "2019-11-06", Op: "alice", Status: types.StatusApproved, Count: 3},
+			{Day: "2019-11-07", Op: "alice", Status: types.StatusDenied, Count: 1},
+			{Day: "2019-11-07", Op: "carol", Status: types.StatusDenied, Count: 1},
+			// Before the range
+			{Day: "2019-10-01", Op: "bob", Status: types.StatusApproved, Count: 9},
+		},
+	}, 7, now)
+	expected := []types.OpStats{
+		{Op: "alice", Decisions: 4, Approved: 3, Denied: 1, ApprovalRate: 0.75},
+		{Op: "bob", Decisions: 1, Approved: 1, ApprovalRate: 1},
+		{Op: "carol", Decisions: 1, Denied: 1, ApprovalRate: 0},
+	}
+	if !reflect.DeepEqual(leaderboard.Ops, expected) {
+		t.Errorf("Expected ops %+v, got %+v", expected, leaderboard.Ops)
+	}
+
+	// Empty ranges encode without NaN
+	empty := OpLeaderboardFromCounts(types.OpDecisionCounts{}, 1, now)
+	if _, err := json.Marshal(empty); err != nil || empty.Ops == nil || len(empty.Ops) != 0 {
+		t.Errorf("Expected an empty leaderboard, got %+v %v", empty, err)
+	}
+}
+
+func TestOpResponseStats(t *testing.T) {
+	minutes := func(m float64) *float64 { return &m }
+	stats := opResponseStats([]types.OpResponseStats{
+		{Op: "bob", Assigned: 2, Decided: 1, ResponseTimes: []*float64{minutes(30), nil}},
+		{Op: "carol", Assigned: 3, Decided: 2, EscalatedPast: 1, ResponseTimes: []*float64{minutes(90), nil, minutes(10)}},
+		// Assigned requests decided by others only
+		{Op: "alice", Assigned: 2, ResponseTimes: []*float64{nil, nil}},
+	})
+	expected := []types.OpResponseStats{
+		{Op: "carol", Assigned: 3, Decided: 2, EscalatedPast: 1, MedianResponseTimeInMinutes: 50},
+		{Op: "alice", Assigned: 2},
+		{Op: "bob", Assigned: 2, Decided: 1, MedianResponseTimeInMinutes: 30},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Expected response stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestCacheRebuiltAfterOutage(t *testing.T) {
+	svc := &Service{sharedState: &sharedState{}}
+	rebuilds := 0
+	rebuild := func() error {
+		rebuilds++
+		if rebuilds == 1 {
+			return errors.New("rebuild interrupted")
+		}
+		return nil
+	}
+	up := func() error { return nil }
+	down := func() error { return errors.New("connection refused") }
+
+	svc.checkConnection(up, rebuild)
+	if !svc.Available() || rebuilds != 0 {
+		t.Fatalf("Expected a reachable cache not to be rebuilt, got %v %d", svc.Available(), rebuilds)
+	}
+	svc.checkConnection(down, rebuild)
+	if svc.Available() {
+		t.Fatal("Expected an unreachable cache to be unavailable")
+	}
+	// Stays unavailable until a rebuild succeeds
+	svc.checkConnection(up, rebuild)
+	if svc.Available() || rebuilds != 1 {
+		t.Fatalf("Expected the cache to stay unavailable after a failed rebuild, got %v %d", svc.Available(), rebuilds)
+	}
+	svc.checkConnection(up, rebuild)
+	if !svc.Available() || rebuilds != 2 {
+		t.Fatalf("Expected the cache to be available once rebuilt, got %v %d", svc.Available(), rebuilds)
+	}
+	svc.checkConnection(up, rebuild)
+	if rebuilds != 2 {
+		t.Errorf("Expected no rebuild while the cache stays reachable, got %d", rebuilds)
+	}
+}
+
+// Write amplification of a single request change with the monolithic value of all requests
+// used by earlier versions. Every change rewrote the whole listing
+func BenchmarkMonolithicRequestsWrite(b *testing.B) {
+	requests := newTestRequests(10000)
+	conn := testCache.pool.Get()
+	defer conn.Close()
+	defer conn.Do("DEL", legacyAllRequestsKey)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		requests[i%len(requests)].LastUpdatedTimestamp = time.Now()
+		encoded, err := json.Marshal(requests)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(encoded)))
+		_, err = conn.Do("SET", legacyAllRequestsKey, encoded)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Cost of storing every request again after a single request change, as tasks did before they
+// only updated the entry of their request. The reads from db are not included
+func BenchmarkRebuildAllRequests(b *testing.B) {
+	requests := newTestRequests(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		requests[i%len(requests)].LastUpdatedTimestamp = time.Now()
+		err := testCache.storeRequests(requests)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Write amplification of a single request change with the chunked layout
+func BenchmarkUpsertRequest(b *testing.B) {
+	requests := newTestRequests(10000)
+	err := testCache.storeRequests(requests)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request := requests[i%len(requests)]
+		request.LastUpdatedTimestamp = time.Now()
+		encoded, err := json.Marshal(request)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(encoded)))
+		err = testCache.UpsertRequest(request)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetRequestsPage(b *testing.B) {
+	err := testCache.storeRequests(newTestRequests(10000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := testCache.GetRequestsPage(types.StatusPending, 100, 50)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	requests := []types.WhitelistRequest{}
+	// Decided within the last 7 days in 10 to 100 minutes
+	for i := 1; i <= 10; i++ {
+		submitted := at(-48 * time.Hour)
+		requests = append(requests, types.WhitelistRequest{
+			Status:      types.StatusApproved,
+			SubmittedAt: submitted,
+			DecidedAt:   at(-48*time.Hour + time.Duration(i*10)*time.Minute),
+			ProcessedAt: at(-48*time.Hour + time.Duration(i*10+5)*time.Minute),
+		})
+	}
+	requests = append(requests,
+		// Decided 20 days ago, before DecidedAt was introduced
+		types.WhitelistRequest{Status: types.StatusDenied, Timestamp: now.Add(-20*24*time.Hour - 1000*time.Minute),
+			ProcessedTimestamp: now.Add(-20 * 24 * time.Hour)},
+		// Never decided by an op
+		types.WhitelistRequest{Status: types.StatusApproved, ImportedAt: at(-time.Hour), Timestamp: now.Add(-time.Hour),
+			ProcessedTimestamp: now.Add(-time.Hour)},
+		types.WhitelistRequest{Status: types.StatusDeactivated, SubmittedAt: at(-100 * 24 * time.Hour)},
+	)
+	stats := latencyStats(requests, now)
+	if len(stats) != 2 || stats[0].Days != 7 || stats[1].Days != 30 {
+		t.Fatalf("Expected stats over 7 and 30 days, got %+v", stats)
+	}
+	week := stats[0]
+	if week.Decisions != 10 || week.DecisionP50InMinutes != 50 || week.DecisionP95InMinutes != 100 {
+		t.Errorf("Unexpected time to decision over 7 days %+v", week)
+	}
+	if week.Whitelisted != 10 || week.WhitelistP50InMinutes != 55 || week.WhitelistP95InMinutes != 105 {
+		t.Errorf("Unexpected time to whitelist over 7 days %+v", week)
+	}
+	month := stats[1]
+	if month.Decisions != 11 || month.DecisionP95InMinutes != 1000 || month.Whitelisted != 10 {
+		t.Errorf("Unexpected latency over 30 days %+v", month)
+	}
+	if stats := latencyStats(nil, now); stats[0].Decisions != 0 || stats[0].DecisionP50InMinutes != 0 {
+		t.Errorf("Expected empty stats without decisions, got %+v", stats)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	first := &Service{pool: testCache.pool, sharedState: &sharedState{}}
+	second := &Service{pool: testCache.pool, sharedState: &sharedState{}}
+	conn := testCache.pool.Get()
+	conn.Do("DEL", leaderKey)
+	conn.Close()
+	ttl := 300 * time.Millisecond
+
+	first.campaign("first", ttl)
+	second.campaign("second", ttl)
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatalf("Expected the first instance to lead, got %v %v", first.IsLeader(), second.IsLeader())
+	}
+	// The leader renews its lock
+	first.campaign("first", ttl)
+	second.campaign("second", ttl)
+	if leader, _ := first.GetLeader(); leader != "first" || second.IsLeader() {
+		t.Fatalf("Expected the first instance to keep leading, got %q", leader)
+	}
+
+	// The leader stops renewing, e.g it crashed. Its lease ends with the lock and the other instance takes over
+	time.Sleep(ttl + 50*time.Millisecond)
+	if first.IsLeader() {
+		t.Error("Expected the lease of the leader to end with its lock")
+	}
+	second.campaign("second", ttl)
+	first.campaign("first", ttl)
+	if !second.IsLeader() || first.IsLeader() {
+		t.Errorf("Expected the second instance to take over, got %v %v", first.IsLeader(), second.IsLeader())
+	}
+}
@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+)
+
+// ErrUnavailable tells that a read was not attempted because the cache is unreachable or being rebuilt
+var ErrUnavailable = errors.New("Cache is unavailable")
+
+// Available reports whether the cache is reachable and holds what was written while it was. Reads
+// should fall back to the db otherwise
+func (svc *Service) Available() bool {
+	return atomic.LoadInt32(&svc.unavailable) == 0
+}
+
+// MonitorConnection pings the cache at the interval. Updates made while the cache is unreachable are
+// lost, so everything cached is rebuilt from db once it is reachable again
+func (svc *Service) MonitorConnection(interval time.Duration) {
+	for range time.Tick(interval) {
+		svc.checkConnection(svc.Ping, svc.SyncStats)
+	}
+}
+
+// checkConnection marks the cache unavailable if the ping fails, and available again once it succeeds
+// and the cache has been rebuilt. A failed rebuild is retried on the next check
+func (svc *Service) checkConnection(ping, rebuild func() error) {
+	err := ping()
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&svc.unavailable, 0, 1) {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Lost connection to redis cache. Reads fall back to db")
+		}
+		return
+	}
+	if svc.Available() {
+		return
+	}
+	log.Info("Redis cache is reachable again. Rebuilding it from db")
+	err = rebuild()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to rebuild cache. Retrying on the next check")
+		return
+	}
+	atomic.StoreInt32(&svc.unavailable, 0)
+	metrics.CacheRebuilds.Inc()
+	log.Info("Redis cache rebuilt")
+}
@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+)
+
+const leaderKey = "Leader"
+
+// renewLeaderScript extends the leader lock only if the instance still holds it
+var renewLeaderScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// AcquireLeadership takes the leader lock for the instance if no instance holds it, or renews it if the
+// instance already does. Returns true if the instance holds the lock for the ttl
+func (svc *Service) AcquireLeadership(instance string, ttl time.Duration) (bool, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	ms := int64(ttl / time.Millisecond)
+	renewed, err := redis.Int(renewLeaderScript.Do(conn, leaderKey, instance, ms))
+	if err != nil {
+		return false, err
+	}
+	if renewed == 1 {
+		return true, nil
+	}
+	_, err = redis.String(conn.Do("SET", leaderKey, instance, "NX", "PX", ms))
+	if err == redis.ErrNil {
+		// Held by another instance
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetLeader returns the instance holding the leader lock, empty if none does
+func (svc *Service) GetLeader() (string, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	leader, err := redis.String(conn.Do("GET", leaderKey))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return leader, err
+}
+
+// IsLeader reports whether this instance leads and runs the periodic background jobs. Leadership ends with the
+// lease of the lock if it could not be renewed, e.g while the cache is unreachable, so two instances never
+// lead at once
+func (svc *Service) IsLeader() bool {
+	svc.leaderMu.Lock()
+	defer svc.leaderMu.Unlock()
+	return time.Now().Before(svc.leaseUntil)
+}
+
+// StartLeaderElection campaigns for the leadership of the instance and keeps renewing it every third of the
+// ttl. The first campaign is over when it returns, so jobs started afterwards know whether they lead
+func (svc *Service) StartLeaderElection(instance string, ttl time.Duration) {
+	svc.campaign(instance, ttl)
+	if !svc.IsLeader() {
+		leader, _ := svc.GetLeader()
+		log.WithFields(logrus.Fields{
+			"instance": instance,
+			"leader":   leader,
+		}).Info("Following the leader. Periodic background jobs are left to it")
+	}
+	go func() {
+		for range time.Tick(ttl / 3) {
+			svc.campaign(instance, ttl)
+		}
+	}()
+}
+
+// campaign acquires or renews the leader lock and logs changes of leadership
+func (svc *Service) campaign(instance string, ttl time.Duration) {
+	start := time.Now()
+	held, err := svc.AcquireLeadership(instance, ttl)
+	wasLeader := svc.IsLeader()
+	if err != nil {
+		// The lease runs out on its own if the lock can not be renewed
+		log.WithFields(logrus.Fields{
+			"err":      err.Error(),
+			"instance": instance,
+		}).Warning("Unable to renew leadership")
+	} else {
+		svc.leaderMu.Lock()
+		svc.leaseUntil = time.Time{}
+		if held {
+			// Counted from before the lock was taken, so the lease never outlives the lock
+			svc.leaseUntil = start.Add(ttl)
+		}
+		svc.leaderMu.Unlock()
+	}
+	isLeader := svc.IsLeader()
+	if isLeader {
+		metrics.Leader.Set(1)
+	} else {
+		metrics.Leader.Set(0)
+	}
+	if isLeader == wasLeader {
+		return
+	}
+	if isLeader {
+		log.WithFields(logrus.Fields{
+			"instance": instance,
+		}).Info("Leadership acquired. Running the periodic background jobs")
+		return
+	}
+	leader, _ := svc.GetLeader()
+	log.WithFields(logrus.Fields{
+		"instance": instance,
+		"leader":   leader,
+	}).Warning("Leadership lost. Periodic background jobs are left to the leader")
+}
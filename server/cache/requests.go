@@ -0,0 +1,249 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Requests are cached as individual entries of a hash keyed by request ID. Sorted sets index them
+// by last update, one for all requests and one per status, so pages are read without loading
+// every request and a change only rewrites the entry of the request and its index positions
+const (
+	requestsKey = "Requests"
+	// Sorted set of all request IDs scored by last update
+	requestsIndexKey = "RequestsByUpdate"
+	// Prefix of the sorted sets of request IDs of a status scored by last update
+	requestsStatusIndexPrefix = "RequestsByUpdate:"
+	// Set once the cache holds every request, until then reads fall back to the db
+	requestsReadyKey = "RequestsReady"
+	// Monolithic value of all requests used by earlier versions, removed by RebuildRequests
+	legacyAllRequestsKey = "AllRequests"
+)
+
+// ErrRequestsNotCached is returned by reads of requests before the cache holds every request
+var ErrRequestsNotCached = errors.New("Requests are not cached")
+
+var requestStatuses = []string{
+	types.StatusPending,
+	types.StatusApproved,
+	types.StatusDenied,
+	types.StatusBanned,
+	types.StatusDeactivated,
+	types.StatusUnbanned,
+	types.StatusExpired,
+	types.StatusDisputed,
+	types.StatusCancelled,
+	types.StatusWaitlisted,
+}
+
+func statusIndexKey(status string) string {
+	return requestsStatusIndexPrefix + status
+}
+
+// lastUpdated is the time requests are ordered by. Requests never updated fall back to their submission time
+func lastUpdated(request types.WhitelistRequest) int64 {
+	if request.LastUpdatedTimestamp.IsZero() {
+		return request.Timestamp.UnixNano() / 1e6
+	}
+	return request.LastUpdatedTimestamp.UnixNano() / 1e6
+}
+
+// SortByLastUpdated sorts requests the way cached pages are ordered, most recently updated first
+func SortByLastUpdated(requests []types.WhitelistRequest) {
+	sort.SliceStable(requests, func(i, j int) bool {
+		return lastUpdated(requests[i]) > lastUpdated(requests[j])
+	})
+}
+
+// sendUpsert queues the commands writing the request entry and moving it to the index of its status
+func sendUpsert(conn redis.Conn, request types.WhitelistRequest) error {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	id := request.ID.Hex()
+	for _, status := range requestStatuses {
+		if status != request.Status {
+			conn.Send("ZREM", statusIndexKey(status), id)
+		}
+	}
+	conn.Send("HSET", requestsKey, id, encoded)
+	conn.Send("ZADD", requestsIndexKey, lastUpdated(request), id)
+	return conn.Send("ZADD", statusIndexKey(request.Status), lastUpdated(request), id)
+}
+
+func sendRemove(conn redis.Conn, id string) {
+	conn.Send("HDEL", requestsKey, id)
+	conn.Send("ZREM", requestsIndexKey, id)
+	for _, status := range requestStatuses {
+		conn.Send("ZREM", statusIndexKey(status), id)
+	}
+}
+
+// UpsertRequest writes the cached entry of the request and updates its index positions atomically
+func (svc *Service) UpsertRequest(request types.WhitelistRequest) error {
+	conn := svc.conn()
+	defer conn.Close()
+	conn.Send("MULTI")
+	if request.Canary {
+		sendRemove(conn, request.ID.Hex())
+	} else {
+		err := sendUpsert(conn, request)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// RemoveRequest removes the cached entry of a request deleted from db
+func (svc *Service) RemoveRequest(id primitive.ObjectID) error {
+	conn := svc.conn()
+	defer conn.Close()
+	conn.Send("MULTI")
+	sendRemove(conn, id.Hex())
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// RefreshRequests updates the cached entries of the given requests from db, and the requests cached for the
+// status page. Requests no longer found in db are removed from the cache
+func (svc *Service) RefreshRequests(ids ...primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	requests, err := svc.dbService.GetRequests(-1, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	found := make(map[primitive.ObjectID]bool)
+	conn := svc.conn()
+	defer conn.Close()
+	conn.Send("MULTI")
+	for _, request := range requests {
+		found[request.ID] = true
+		err = sendUpsert(conn, request)
+		if err == nil {
+			err = sendSetRequestByID(conn, request)
+		}
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+	for _, id := range ids {
+		if !found[id] {
+			sendRemove(conn, id.Hex())
+			conn.Send("DEL", requestByIDKey(id))
+		}
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// RebuildRequests rebuilds the cached requests from db. It also migrates the cache from the
+// monolithic value of all requests used by earlier versions by removing it
+func (svc *Service) RebuildRequests() error {
+	requests, err := svc.dbService.GetRequests(-1, bson.D{{}})
+	if err != nil {
+		return err
+	}
+	return svc.storeRequests(requests)
+}
+
+func (svc *Service) storeRequests(requests []types.WhitelistRequest) error {
+	conn := svc.conn()
+	defer conn.Close()
+	keys := []interface{}{requestsKey, requestsIndexKey, legacyAllRequestsKey}
+	for _, status := range requestStatuses {
+		keys = append(keys, statusIndexKey(status))
+	}
+	conn.Send("MULTI")
+	conn.Send("DEL", keys...)
+	for _, request := range requests {
+		err := sendUpsert(conn, request)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+	conn.Send("SET", requestsReadyKey, 1)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// GetAllRequests get the cached value of all requests, most recently updated first
+func (svc *Service) GetAllRequests() ([]types.WhitelistRequest, error) {
+	requests, _, err := svc.GetRequestsPage("", 0, -1)
+	return requests, err
+}
+
+// GetRequestsPage get up to limit cached requests of the status starting at offset, most recently
+// updated first, and the total number of cached requests of the status. An empty status matches
+// all requests and a negative limit returns every request from offset
+func (svc *Service) GetRequestsPage(status string, offset, limit int64) ([]types.WhitelistRequest, int64, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	ready, err := redis.Bool(conn.Do("EXISTS", requestsReadyKey))
+	if err != nil {
+		return nil, 0, err
+	} else if !ready {
+		return nil, 0, ErrRequestsNotCached
+	}
+	index := requestsIndexKey
+	if status != "" {
+		index = statusIndexKey(status)
+	}
+	if limit == 0 {
+		total, err := redis.Int64(conn.Do("ZCARD", index))
+		return make([]types.WhitelistRequest, 0), total, err
+	}
+	stop := int64(-1)
+	if limit > 0 {
+		stop = offset + limit - 1
+	}
+	conn.Send("MULTI")
+	conn.Send("ZCARD", index)
+	conn.Send("ZREVRANGE", index, offset, stop)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := redis.Int64(replies[0], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	ids, err := redis.Values(replies[1], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	requests := make([]types.WhitelistRequest, 0, len(ids))
+	if len(ids) == 0 {
+		return requests, total, nil
+	}
+	entries, err := redis.ByteSlices(conn.Do("HMGET", append([]interface{}{requestsKey}, ids...)...))
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, entry := range entries {
+		// Skip entries removed since the index was read
+		if entry == nil {
+			continue
+		}
+		var request types.WhitelistRequest
+		err = json.Unmarshal(entry, &request)
+		if err != nil {
+			return nil, 0, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, total, nil
+}
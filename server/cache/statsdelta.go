@@ -0,0 +1,202 @@
+package cache
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// StatsDelta is the change of the real-time stats of a tenant made by requests changing status. Deltas add up,
+// so the changes of many requests are applied in one atomic update without losing any, see ApplyStatsDelta
+type StatsDelta struct {
+	Pending, Denied, Approved, Banned, Deactivated, Expired, Cancelled int64
+	TotalResponseTimeInMinutes                                         float64
+	MaleCount, FemaleCount, OtherGenderCount                           int64
+	AgeGroup1Count, AgeGroup2Count, AgeGroup3Count, AgeGroup4Count     int64
+	JavaCount, BedrockCount                                            int64
+	// Changes is the number of request changes added up
+	Changes int
+}
+
+// StatsDeltaOf returns the change of the stats made by the request changing to its current status. Canary
+// requests are synthetic and never counted
+func StatsDeltaOf(request types.WhitelistRequest) StatsDelta {
+	var d StatsDelta
+	if request.Canary {
+		return d
+	}
+	d.Changes = 1
+	responseTime := request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
+	switch request.Status {
+	case types.StatusApproved:
+		d.addAgeGender(request, 1)
+		d.Approved++
+		d.Pending--
+		d.TotalResponseTimeInMinutes += responseTime
+	case types.StatusDenied:
+		d.Denied++
+		d.Pending--
+		d.TotalResponseTimeInMinutes += responseTime
+	case types.StatusPending:
+		d.Pending++
+	case types.StatusBanned:
+		d.Banned++
+		d.Approved--
+		d.addAgeGender(request, -1)
+	case types.StatusDeactivated:
+		d.Approved--
+		d.Deactivated++
+		d.addAgeGender(request, -1)
+	case types.StatusUnbanned:
+		// Unbanned requests are no longer counted, like on a full sync
+		d.Banned--
+		d.TotalResponseTimeInMinutes -= responseTime
+	case types.StatusExpired:
+		// Expired requests were never handled by an op so they do not count towards response time
+		d.Expired++
+		d.Pending--
+	case types.StatusCancelled:
+		// Withdrawn by the applicant before an op handled them
+		d.Cancelled++
+		d.Pending--
+	case types.StatusWaitlisted:
+		// Counted as pending until promoted and approved again
+		d.Changes = 0
+	}
+	return d
+}
+
+// addAgeGender counts the applicant of the request in or out of the gender and age group stats
+func (d *StatsDelta) addAgeGender(request types.WhitelistRequest, delta int64) {
+	switch request.Gender {
+	case "male":
+		d.MaleCount += delta
+	case "female":
+		d.FemaleCount += delta
+	default:
+		d.OtherGenderCount += delta
+	}
+	var step int64 = ageGroupStep
+	switch age := request.Age; {
+	case 0 <= age && age < step:
+		d.AgeGroup1Count += delta
+	case step <= age && age < step*2:
+		d.AgeGroup2Count += delta
+	case step*2 <= age && age < step*3:
+		d.AgeGroup3Count += delta
+	default:
+		d.AgeGroup4Count += delta
+	}
+	if request.Platform == utils.PlatformBedrock {
+		d.BedrockCount += delta
+	} else {
+		d.JavaCount += delta
+	}
+}
+
+// Add adds the changes of other
+func (d *StatsDelta) Add(other StatsDelta) {
+	d.Pending += other.Pending
+	d.Denied += other.Denied
+	d.Approved += other.Approved
+	d.Banned += other.Banned
+	d.Deactivated += other.Deactivated
+	d.Expired += other.Expired
+	d.Cancelled += other.Cancelled
+	d.TotalResponseTimeInMinutes += other.TotalResponseTimeInMinutes
+	d.MaleCount += other.MaleCount
+	d.FemaleCount += other.FemaleCount
+	d.OtherGenderCount += other.OtherGenderCount
+	d.AgeGroup1Count += other.AgeGroup1Count
+	d.AgeGroup2Count += other.AgeGroup2Count
+	d.AgeGroup3Count += other.AgeGroup3Count
+	d.AgeGroup4Count += other.AgeGroup4Count
+	d.JavaCount += other.JavaCount
+	d.BedrockCount += other.BedrockCount
+	d.Changes += other.Changes
+}
+
+// increments lists the stats fields the delta changes and by how much
+func (d StatsDelta) increments() []interface{} {
+	args := make([]interface{}, 0)
+	for _, field := range []struct {
+		name  string
+		value int64
+	}{
+		{"pending", d.Pending}, {"denied", d.Denied}, {"approved", d.Approved}, {"banned", d.Banned},
+		{"deactivated", d.Deactivated}, {"expired", d.Expired}, {"cancelled", d.Cancelled},
+		{"maleCount", d.MaleCount}, {"femaleCount", d.FemaleCount}, {"otherGenderCount", d.OtherGenderCount},
+		{"ageGroup1Count", d.AgeGroup1Count}, {"ageGroup2Count", d.AgeGroup2Count},
+		{"ageGroup3Count", d.AgeGroup3Count}, {"ageGroup4Count", d.AgeGroup4Count},
+		{"javaCount", d.JavaCount}, {"bedrockCount", d.BedrockCount},
+	} {
+		if field.value != 0 {
+			args = append(args, field.name, field.value)
+		}
+	}
+	if d.TotalResponseTimeInMinutes != 0 {
+		args = append(args, "totalResponseTimeInMinutes", d.TotalResponseTimeInMinutes)
+	}
+	return args
+}
+
+// Increments the real-time stats and recomputes the average response time. Fails if the stats have not been
+// synced yet, the sync counts the changes then. Returns the pending and approved counts before and after
+var applyStatsDeltaScript = redis.NewScript(1, `
+if redis.call("HEXISTS", KEYS[1], "AggregateStats") == 0 then
+	return redis.error_reply("Stats are not cached yet")
+end
+local before = redis.call("HMGET", KEYS[1], "pending", "approved")
+for i = 1, #ARGV, 2 do
+	if ARGV[i] == "totalResponseTimeInMinutes" then
+		redis.call("HINCRBYFLOAT", KEYS[1], ARGV[i], ARGV[i + 1])
+	else
+		redis.call("HINCRBY", KEYS[1], ARGV[i], ARGV[i + 1])
+	end
+end
+local total = tonumber(redis.call("HGET", KEYS[1], "totalResponseTimeInMinutes") or "0")
+local decided = 0
+for _, field in ipairs({"approved", "denied", "banned", "deactivated"}) do
+	decided = decided + tonumber(redis.call("HGET", KEYS[1], field) or "0")
+end
+-- Only update the average response time if requests are being fulfilled
+if total ~= 0 and decided ~= 0 then
+	redis.call("HSET", KEYS[1], "averageResponseTimeInMinutes", tostring(total / decided))
+end
+local after = redis.call("HMGET", KEYS[1], "pending", "approved")
+return {before[1] or "0", before[2] or "0", after[1] or "0", after[2] or "0"}
+`)
+
+// ApplyStatsDelta applies the changes of the delta to the real-time stats of the tenant in one atomic update, and
+// broadcasts the new stats to clients listening for SSE
+func (svc *Service) ApplyStatsDelta(serverID string, delta StatsDelta) error {
+	args := delta.increments()
+	if len(args) == 0 {
+		return nil
+	}
+	conn := svc.conn()
+	defer conn.Close()
+	counts, err := redis.Int64s(applyStatsDeltaScript.Do(conn, append([]interface{}{tenantKey(statsKey, serverID)}, args...)...))
+	if err != nil {
+		return err
+	}
+	// Keep the queue load shown to applicants fresh between reconciliations
+	if counts[0] != counts[2] || counts[1] != counts[3] {
+		err = svc.refreshQueueLoad(serverID, counts[2], counts[3])
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warn("Unable to refresh queue load")
+		}
+	}
+	// After a successful update, broadcast the new stats to clients
+	// who are listening for the stats update via ServerSideEvent http server
+	err = svc.BroadcastStats(serverID)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to broadcast event for stats update")
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Requests read by the public status page are also cached under a key of their own, so a failed refresh of the
+// cached requests never makes every status page stale at once. The keys expire, so a missed update is only
+// shown until requestByIDTTL passes
+const (
+	requestByIDPrefix = "Request:"
+	requestByIDTTL    = 10 * time.Minute
+	// IDs no request has are cached as notFoundMarker for notFoundTTL, so bots probing random tokens do not
+	// hit the db on every attempt
+	notFoundMarker = "-"
+	notFoundTTL    = time.Minute
+)
+
+// ErrRequestNotFound is returned by GetRequestByID if no request has the ID
+var ErrRequestNotFound = errors.New("Request not found")
+
+func requestByIDKey(id primitive.ObjectID) string {
+	return requestByIDPrefix + id.Hex()
+}
+
+// GetRequestByID returns the request with the ID for the status page. Read from db and cached on a miss, and
+// from db only while the cache can not be read. Fields never sent to clients are left out of cached requests
+func (svc *Service) GetRequestByID(id primitive.ObjectID) (types.WhitelistRequest, error) {
+	return svc.getRequestByID(id, func(id primitive.ObjectID) ([]types.WhitelistRequest, error) {
+		return svc.dbService.GetRequests(1, bson.M{"_id": id})
+	})
+}
+
+func (svc *Service) getRequestByID(id primitive.ObjectID, load func(id primitive.ObjectID) ([]types.WhitelistRequest, error)) (types.WhitelistRequest, error) {
+	conn := svc.conn()
+	defer conn.Close()
+	cached, err := redis.Bytes(conn.Do("GET", requestByIDKey(id)))
+	if err == nil && string(cached) == notFoundMarker {
+		metrics.StatusCacheReads.WithLabelValues("negative_hit").Inc()
+		return types.WhitelistRequest{}, ErrRequestNotFound
+	} else if err == nil {
+		var request types.WhitelistRequest
+		if json.Unmarshal(cached, &request) == nil {
+			metrics.StatusCacheReads.WithLabelValues("hit").Inc()
+			return request, nil
+		}
+	}
+	result := "miss"
+	if err != nil && err != redis.ErrNil {
+		result = "fallback"
+	}
+	metrics.StatusCacheReads.WithLabelValues(result).Inc()
+	requests, err := load(id)
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	if len(requests) == 0 {
+		if result == "miss" {
+			conn.Do("SET", requestByIDKey(id), notFoundMarker, "EX", int(notFoundTTL.Seconds()))
+		}
+		return types.WhitelistRequest{}, ErrRequestNotFound
+	}
+	if result == "miss" && sendSetRequestByID(conn, requests[0]) == nil {
+		conn.Do("")
+	}
+	return requests[0], nil
+}
+
+// SetRequestByID caches the request for the status page, e.g right after a change of the request is stored
+func (svc *Service) SetRequestByID(request types.WhitelistRequest) error {
+	conn := svc.conn()
+	defer conn.Close()
+	err := sendSetRequestByID(conn, request)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("")
+	return err
+}
+
+func sendSetRequestByID(conn redis.Conn, request types.WhitelistRequest) error {
+	// Only set by publishers of a change
+	request.PreviousStatus = ""
+	request.BulkID = ""
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return conn.Send("SET", requestByIDKey(request.ID), encoded, "EX", int(requestByIDTTL.Seconds()))
+}
@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+const (
+	timeSeriesKey  = "TimeSeries"
+	opDecisionsKey = "OpDecisions"
+	dayLayout      = "2006-01-02"
+	// TimeSeriesDays is how many days back the time-windowed stats go, today included
+	TimeSeriesDays = 90
+)
+
+// firstDay returns the start of the first UTC day of the range of days ending today
+func firstDay(now time.Time, days int) time.Time {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return today.AddDate(0, 0, -(days - 1))
+}
+
+// CountTimeSeries counts the submissions and decisions of the tenant of the last TimeSeriesDays days in db
+func CountTimeSeries(dbService *db.Service, serverID string, now time.Time) (types.TimeSeriesCounts, error) {
+	since := firstDay(now, TimeSeriesDays)
+	submissions, err := dbService.CountSubmissions(serverID, since)
+	if err != nil {
+		return types.TimeSeriesCounts{}, err
+	}
+	decisions, err := dbService.CountDecisions(serverID, since)
+	if err != nil {
+		return types.TimeSeriesCounts{}, err
+	}
+	return types.TimeSeriesCounts{Submissions: submissions, Decisions: decisions, UpdatedTimestamp: now}, nil
+}
+
+// CountOpDecisions counts the decisions of the ops of the tenant of the last TimeSeriesDays days in db
+func CountOpDecisions(dbService *db.Service, serverID string, now time.Time) (types.OpDecisionCounts, error) {
+	decisions, err := dbService.CountOpDecisions(serverID, firstDay(now, TimeSeriesDays))
+	if err != nil {
+		return types.OpDecisionCounts{}, err
+	}
+	return types.OpDecisionCounts{Decisions: decisions, UpdatedTimestamp: now}, nil
+}
+
+// UpdateTimeSeriesStats recounts the time-windowed stats of every tenant in db. They are not updated on
+// decisions, so they lag behind by up to the refresh interval. Skipped if a recount is already running
+func (svc *Service) UpdateTimeSeriesStats() error {
+	if !atomic.CompareAndSwapInt32(&svc.countingTimeSeries, 0, 1) {
+		log.Warn("Time series stats are already being updated. Skipping")
+		return nil
+	}
+	defer atomic.StoreInt32(&svc.countingTimeSeries, 0)
+	now := time.Now()
+	for _, cfg := range tenant.All() {
+		counts, err := CountTimeSeries(svc.dbService, cfg.ID, now)
+		if err != nil {
+			return err
+		}
+		err = svc.setJSON(tenantKey(timeSeriesKey, cfg.ID), counts)
+		if err != nil {
+			return err
+		}
+		opCounts, err := CountOpDecisions(svc.dbService, cfg.ID, now)
+		if err != nil {
+			return err
+		}
+		err = svc.setJSON(tenantKey(opDecisionsKey, cfg.ID), opCounts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svc *Service) setJSON(key string, value interface{}) error {
+	blob, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	conn := svc.conn()
+	defer conn.Close()
+	_, err = conn.Do("SET", key, blob)
+	return err
+}
+
+func (svc *Service) getJSON(key string, value interface{}) error {
+	conn := svc.conn()
+	defer conn.Close()
+	blob, err := redis.Bytes(conn.Do("GET", key))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(blob, value)
+}
+
+// GetTimeSeriesCounts get the cached daily counts of the time series of the tenant
+func (svc *Service) GetTimeSeriesCounts(serverID string) (types.TimeSeriesCounts, error) {
+	var counts types.TimeSeriesCounts
+	err := svc.getJSON(tenantKey(timeSeriesKey, serverID), &counts)
+	return counts, err
+}
+
+// GetOpDecisionCounts get the cached daily counts of the decisions of the ops of the tenant
+func (svc *Service) GetOpDecisionCounts(serverID string) (types.OpDecisionCounts, error) {
+	var counts types.OpDecisionCounts
+	err := svc.getJSON(tenantKey(opDecisionsKey, serverID), &counts)
+	return counts, err
+}
+
+// TimeSeriesFromCounts sums the counts of the last days days, today included, into the time series. Every
+// day of the range is listed, with zero counts if nothing happened on it
+func TimeSeriesFromCounts(counts types.TimeSeriesCounts, days int, now time.Time) types.TimeSeries {
+	from := firstDay(now, days)
+	series := types.TimeSeries{
+		From:              from.Format(dayLayout),
+		To:                from.AddDate(0, 0, days-1).Format(dayLayout),
+		Days:              make([]types.DayStats, days),
+		SubmissionsByHour: make([]int64, 24),
+		UpdatedTimestamp:  counts.UpdatedTimestamp,
+	}
+	index := make(map[string]int, days)
+	for i := range series.Days {
+		date := from.AddDate(0, 0, i).Format(dayLayout)
+		series.Days[i] = types.DayStats{Date: date, Decided: map[string]int64{}}
+		index[date] = i
+	}
+	for _, count := range counts.Submissions {
+		i, ok := index[count.Day]
+		if !ok || count.Hour < 0 || count.Hour > 23 {
+			continue
+		}
+		series.Days[i].Submitted += count.Count
+		series.SubmissionsByHour[count.Hour] += count.Count
+	}
+	for _, count := range counts.Decisions {
+		if i, ok := index[count.Day]; ok {
+			series.Days[i].Decided[count.Status] += count.Count
+		}
+	}
+	return series
+}
+
+// OpLeaderboardFromCounts sums the decisions of each op of the last days days, today included. Ops with most
+// decisions come first
+func OpLeaderboardFromCounts(counts types.OpDecisionCounts, days int, now time.Time) types.OpLeaderboard {
+	from := firstDay(now, days)
+	to := from.AddDate(0, 0, days-1).Format(dayLayout)
+	leaderboard := types.OpLeaderboard{
+		From:             from.Format(dayLayout),
+		To:               to,
+		Ops:              []types.OpStats{},
+		UpdatedTimestamp: counts.UpdatedTimestamp,
+	}
+	byOp := make(map[string]*types.OpStats)
+	for _, count := range counts.Decisions {
+		// Days are zero padded so they compare as strings
+		if count.Day < leaderboard.From || count.Day > to {
+			continue
+		}
+		op, ok := byOp[count.Op]
+		if !ok {
+			op = &types.OpStats{Op: count.Op}
+			byOp[count.Op] = op
+		}
+		switch count.Status {
+		case types.StatusApproved:
+			op.Approved += count.Count
+		case types.StatusDenied:
+			op.Denied += count.Count
+		default:
+			continue
+		}
+		op.Decisions += count.Count
+	}
+	for _, op := range byOp {
+		op.ApprovalRate = averageOf(float64(op.Approved), op.Decisions)
+		leaderboard.Ops = append(leaderboard.Ops, *op)
+	}
+	sort.Slice(leaderboard.Ops, func(i, j int) bool {
+		if leaderboard.Ops[i].Decisions != leaderboard.Ops[j].Decisions {
+			return leaderboard.Ops[i].Decisions > leaderboard.Ops[j].Decisions
+		}
+		return leaderboard.Ops[i].Op < leaderboard.Ops[j].Op
+	})
+	return leaderboard
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultRetryWait  = time.Second
+)
+
+// Client provides typed access to the gatekeeper HTTP API
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	apiKey     string
+	token      string
+	maxRetries int
+	retryWait  time.Duration
+}
+
+// Option configures the client
+type Option func(*Client)
+
+// WithAPIKey authenticates admin endpoints using a static API key
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// WithToken authenticates admin endpoints using an already obtained jwt auth token
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithHTTPClient replaces the default http client
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetries sets how many times a request is retried when the server responds
+// with 429 or 503 and the initial wait between retries
+func WithRetries(maxRetries int, wait time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.retryWait = wait
+	}
+}
+
+// APIError is returned when the server responds with an unexpected status code
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("status code: %d %s", e.StatusCode, e.Message)
+}
+
+// IncompatibleVersionError is returned when the server API major version differs from the client
+type IncompatibleVersionError struct {
+	ServerVersion string
+}
+
+func (e *IncompatibleVersionError) Error() string {
+	return fmt.Sprintf("server API version %s is not compatible with client version %s", e.ServerVersion, types.APIVersion)
+}
+
+// New creates a client for the gatekeeper API served at baseURL. e.g https://gatekeeper.example.com
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("baseURL must be an absolute url")
+	}
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+		maxRetries: defaultMaxRetries,
+		retryWait:  defaultRetryWait,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// CheckVersion negotiates the API version with the server. Returns IncompatibleVersionError
+// if the server major version differs from the one this client is built against
+func (c *Client) CheckVersion(ctx context.Context) error {
+	var resp struct {
+		APIVersion string `json:"apiVersion"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/schema", nil, false, &resp)
+	if err != nil {
+		return err
+	}
+	if majorVersion(resp.APIVersion) != majorVersion(types.APIVersion) {
+		return &IncompatibleVersionError{ServerVersion: resp.APIVersion}
+	}
+	return nil
+}
+
+// Login signs in as admin user and uses the obtained jwt auth token for subsequent admin calls
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	var resp struct {
+		Token struct {
+			Value   string    `json:"value"`
+			Expires time.Time `json:"expires"`
+		} `json:"token"`
+	}
+	body := map[string]string{"username": username, "password": password}
+	err := c.do(ctx, http.MethodPost, "/api/v1/auth/", body, false, &resp)
+	if err != nil {
+		return err
+	}
+	c.token = resp.Token.Value
+	return nil
+}
+
+// SubmitRequest creates a new whitelist request and returns its ID
+func (c *Client) SubmitRequest(ctx context.Context, request types.WhitelistRequest) (string, error) {
+	var resp struct {
+		Created string `json:"created"`
+	}
+	body := map[string]interface{}{
+		"username": request.Username,
+		"email":    request.Email,
+		"age":      request.Age,
+		"gender":   request.Gender,
+		"info":     request.Info,
+		"answers":  request.Answers,
+	}
+	err := c.do(ctx, http.MethodPost, "/api/v1/requests/", body, false, &resp)
+	return resp.Created, err
+}
+
+// GetRequestStatus gets the applicant facing view of a request by its encrypted status token
+func (c *Client) GetRequestStatus(ctx context.Context, token string) (types.WhitelistRequest, error) {
+	var resp struct {
+		Request types.WhitelistRequest `json:"request"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/requests/"+url.PathEscape(token), nil, false, &resp)
+	return resp.Request, err
+}
+
+// ListRequests gets all requests. Requires admin authentication
+func (c *Client) ListRequests(ctx context.Context) ([]types.WhitelistRequest, error) {
+	var resp struct {
+		Requests []types.WhitelistRequest `json:"requests"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/internal/requests/", nil, true, &resp)
+	return resp.Requests, err
+}
+
+// DecideRequest changes the status of a request. e.g Approved / Denied. Requires admin authentication
+func (c *Client) DecideRequest(ctx context.Context, requestID, status string) (types.WhitelistRequest, error) {
+	var resp struct {
+		Updated types.WhitelistRequest `json:"updated"`
+	}
+	body := map[string]string{"status": status}
+	err := c.do(ctx, http.MethodPatch, "/api/v1/internal/requests/"+url.PathEscape(requestID), body, true, &resp)
+	return resp.Updated, err
+}
+
+// GetStats gets the current stats. Requires admin authentication
+func (c *Client) GetStats(ctx context.Context) (types.Stats, error) {
+	var resp struct {
+		Stats types.Stats `json:"stats"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/internal/stats", nil, true, &resp)
+	return resp.Stats, err
+}
+
+// Resync re-synchronizes the cached requests and stats from the database. Requires admin authentication
+func (c *Client) Resync(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/internal/resync", nil, true, nil)
+}
+
+// do sends the request with retries on 429 and 503 and decodes the json response into out
+func (c *Client) do(ctx context.Context, method, path string, body interface{}, auth bool, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, c.baseURL.String()+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		if auth {
+			if c.apiKey != "" {
+				req.Header.Set("X-API-Key", c.apiKey)
+			} else if c.token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) && attempt < c.maxRetries {
+			wait := retryAfter(resp, c.retryWait*time.Duration(1<<uint(attempt)))
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			message, _ := ioutil.ReadAll(resp.Body)
+			return &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+		}
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+}
+
+// Use the Retry-After header in seconds if provided by the server
+func retryAfter(resp *http.Response, fallback time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return fallback
+}
+
+func majorVersion(version string) string {
+	return strings.SplitN(strings.TrimPrefix(version, "v"), ".", 2)[0]
+}
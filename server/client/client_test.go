@@ -0,0 +1,229 @@
+package client_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/client"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/server"
+	"github.com/tywin1104/mc-gatekeeper/server/sse"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var log = logrus.New()
+var testServer *httptest.Server
+var dbClient *mongo.Client
+
+func TestMain(m *testing.M) {
+	// Run the client against the real server handler stack using the test configuration file
+	viper.SetConfigName("config_test")
+	viper.AddConfigPath("../")
+	viper.AutomaticEnv()
+	viper.SetConfigType("yml")
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Fatal("Error reading config file")
+	}
+	viper.Set("apiKeys", []string{"testapikey"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(viper.GetString("mongodbConn")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	dbClient = client
+	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
+	dbSvc := db.NewService(client)
+	broker := broker.NewService(log, make(chan *amqp.Error))
+	defer broker.Close()
+	serverLogger := log.WithField("origin", "server")
+	sseServer := sse.NewServer(serverLogger)
+	cacheService := cache.NewService(dbSvc, sseServer)
+	err = cacheService.SyncStats()
+	if err != nil {
+		log.Fatal("Unable to sync cache values: " + err.Error())
+	}
+	svc := server.NewService(dbSvc, broker, cacheService, sseServer, serverLogger)
+	testServer = httptest.NewServer(svc.Handler())
+	defer testServer.Close()
+	m.Run()
+}
+
+func TestCheckVersion(t *testing.T) {
+	c, err := client.New(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CheckVersion(context.Background()); err != nil {
+		t.Errorf("Expect server version to be compatible, got %v", err)
+	}
+}
+
+func TestSubmitAndGetStatus(t *testing.T) {
+	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
+	c, err := client.New(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := c.SubmitRequest(context.Background(), types.WhitelistRequest{
+		Username: "clientuser",
+		Email:    "clientuser@gmail.com",
+		Age:      20,
+		Gender:   "male",
+		Info:     map[string]interface{}{"applicationText": "I'd like to join the server"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := utils.SignToken(id, utils.PurposeStatus, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := c.GetRequestStatus(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Username != "clientuser" || request.Status != "Pending" || request.ID.Hex() != id {
+		t.Errorf("Got unexpected request %+v", request)
+	}
+
+	// Submitting again with the same username is rejected by the server
+	_, err = c.SubmitRequest(context.Background(), types.WhitelistRequest{Username: "clientuser", Email: "clientuser@gmail.com"})
+	if apiErr, ok := err.(*client.APIError); !ok || apiErr.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expect duplicate submission to fail with 422, got %v", err)
+	}
+}
+
+func TestAdminFlowWithJWT(t *testing.T) {
+	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
+	c, err := client.New(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := c.SubmitRequest(context.Background(), types.WhitelistRequest{Username: "jwtuser", Email: "jwtuser@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Admin endpoints are rejected before logging in
+	_, err = c.ListRequests(context.Background())
+	if apiErr, ok := err.(*client.APIError); !ok || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expect unauthenticated call to fail with 401, got %v", err)
+	}
+	err = c.Login(context.Background(), "testadmin", "testadminpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Resync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, err := c.ListRequests(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].Username != "jwtuser" {
+		t.Errorf("Expect to list the submitted request, got %v", requests)
+	}
+	updated, err := c.DecideRequest(context.Background(), id, "Denied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Status != "Denied" {
+		t.Errorf("Expect request to be denied, got %s", updated.Status)
+	}
+	_, err = c.GetStats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	c, err := client.New(testServer.URL, client.WithAPIKey("testapikey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ListRequests(context.Background())
+	if err != nil {
+		t.Errorf("Expect API key to be accepted, got %v", err)
+	}
+
+	c, err = client.New(testServer.URL, client.WithAPIKey("wrongkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ListRequests(context.Background())
+	if apiErr, ok := err.(*client.APIError); !ok || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expect wrong API key to fail with 401, got %v", err)
+	}
+}
+
+func TestRetryOnUnavailable(t *testing.T) {
+	attempts := 0
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"apiVersion": "1.2.0"}`))
+	}))
+	defer stub.Close()
+	c, err := client.New(stub.URL, client.WithRetries(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CheckVersion(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expect 3 attempts, got %d", attempts)
+	}
+}
+
+func TestRetryRespectsContext(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer stub.Close()
+	c, err := client.New(stub.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.CheckVersion(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expect context deadline to stop retries, got %v", err)
+	}
+}
+
+func TestIncompatibleVersion(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"apiVersion": "2.0.0"}`))
+	}))
+	defer stub.Close()
+	c, err := client.New(stub.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.CheckVersion(context.Background()).(*client.IncompatibleVersionError); !ok {
+		t.Error("Expect incompatible version error")
+	}
+}
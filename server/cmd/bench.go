@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/bench"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/worker"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Admin recorded on the synthetic requests approved by the benchmark
+const benchActor = "bench"
+
+// benchPipeline submits synthetic requests the way the API does and approves them the way ops do,
+// through the same publisher the server uses
+type benchPipeline struct {
+	runID     string
+	dbService *db.Service
+	broker    *broker.Service
+	worker    *worker.Worker
+}
+
+func (p benchPipeline) Submit(request types.WhitelistRequest) (primitive.ObjectID, error) {
+	id, err := p.dbService.CreateRequest(request)
+	if err != nil {
+		return id, err
+	}
+	request.ID = id
+	request.Status = types.StatusPending
+	return id, p.broker.Publish(request)
+}
+
+func (p benchPipeline) Approve(id primitive.ObjectID) error {
+	now := time.Now()
+	// Only synthetic requests of this run are approved
+	approvedRequest, err := p.dbService.ConditionalUpdateRequest(bson.M{
+		"_id":    id,
+		"status": types.StatusPending,
+		"bench":  p.runID,
+	}, db.WithNextSequence(bson.M{
+		"$set": bson.M{
+			"status":               types.StatusApproved,
+			"admin":                benchActor,
+			"processedTimestamp":   now,
+			"lastUpdatedTimestamp": now,
+		},
+	}))
+	if err != nil {
+		return err
+	}
+	return p.broker.Publish(approvedRequest)
+}
+
+func (p benchPipeline) QueueDepth() (int, error) {
+	return p.worker.QueueDepth()
+}
+
+// commandCounter counts the commands sent to mongodb by name
+type commandCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (c *commandCounter) started(ctx context.Context, e *event.CommandStartedEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[e.CommandName]++
+}
+
+func (c *commandCounter) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int64, len(c.counts))
+	for name, count := range c.counts {
+		counts[name] = count
+	}
+	return counts
+}
+
+// runBench runs the load benchmark, or removes the synthetic requests of earlier runs with --purge.
+// Only runs against a test environment as it submits requests to the configured database and message queue
+func runBench(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	requests := flags.Int("requests", 100, "number of synthetic requests to submit")
+	rate := flags.Float64("rate", 10, "submissions per second")
+	timeout := flags.Duration("timeout", 2*time.Minute, "time to wait for requests to complete after the last submission")
+	reportPath := flags.String("report", "bench-report.json", "file the JSON report is written to")
+	purge := flags.Bool("purge", false, "remove the synthetic requests of all runs and exit")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *requests <= 0 || *rate <= 0 {
+		fmt.Fprintln(os.Stderr, "--requests and --rate must be positive")
+		return 2
+	}
+	if viper.GetString("environment") != "test" {
+		fmt.Fprintln(os.Stderr, "The benchmark only runs with a dedicated test configuration (environment: test)")
+		return 2
+	}
+	// Keep the standard output for the summary
+	log.SetOutput(os.Stderr)
+	log.SetLevel(logrus.WarnLevel)
+	counter := &commandCounter{counts: make(map[string]int64)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(viper.GetString("mongodbConn")).
+		SetMonitor(&event.CommandMonitor{Started: counter.started}))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to connect to mongodb: "+err.Error())
+		return 1
+	}
+	defer client.Disconnect(context.Background())
+	dbService := db.NewService(client)
+	cacheService := cache.NewService(dbService, nil)
+
+	if *purge {
+		return purgeBench(dbService, cacheService)
+	}
+
+	if worker.NoOpsConfigured(tenant.Default) {
+		fmt.Fprintln(os.Stderr, "Configure at least one op, requests are not dispatched without ops")
+		return 2
+	}
+	brokerService := broker.NewService(log, make(chan *amqp.Error))
+	defer brokerService.Close()
+	// The commands are recorded by the benchmark, see SetExecutor below
+	w, err := worker.NewWorker(dbService, cacheService, log.WithField("origin", "bench"), make(chan *amqp.Error), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to create the worker: "+err.Error())
+		return 1
+	}
+	runID := bench.NewRunID()
+	b := bench.New(bench.Config{
+		RunID:    runID,
+		Requests: *requests,
+		Rate:     *rate,
+		Timeout:  *timeout,
+	}, benchPipeline{runID: runID, dbService: dbService, broker: brokerService, worker: w})
+	w.SetMailer(b.SendMail)
+	w.SetExecutor(b)
+	err = w.Start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to start the worker: "+err.Error())
+		return 1
+	}
+	defer w.Close()
+
+	redisBefore := redisCommandStats(cacheService)
+	mongoBefore := counter.snapshot()
+	report := b.Run()
+	report.MongoOperations = bench.CountsSince(mongoBefore, counter.snapshot())
+	report.RedisOperations = bench.CountsSince(redisBefore, redisCommandStats(cacheService))
+
+	blob, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(*reportPath, blob, 0644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to write the report: "+err.Error())
+		return 1
+	}
+	printBenchReport(os.Stdout, report, *reportPath)
+	if report.Completed < report.Requests {
+		return 1
+	}
+	return 0
+}
+
+// redisCommandStats returns the calls per command of the redis server. They include the calls of all
+// clients, so nothing else should use the redis server of the test configuration during the benchmark
+func redisCommandStats(cacheService *cache.Service) map[string]int64 {
+	info, err := cacheService.Info("commandstats")
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to get redis command stats")
+		return map[string]int64{}
+	}
+	return bench.ParseCommandStats(info)
+}
+
+func purgeBench(dbService *db.Service, cacheService *cache.Service) int {
+	deleted, err := dbService.DeleteRequests(bson.M{"bench": bson.M{"$exists": true}})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to remove the synthetic requests: "+err.Error())
+		return 1
+	}
+	// Leave the synthetic requests out of the cached requests and stats again
+	err = cacheService.SyncStats()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to sync the stats, they are synced again on the next start: "+err.Error())
+	}
+	fmt.Printf("Removed %d synthetic requests\n", deleted)
+	return 0
+}
+
+func printBenchReport(out io.Writer, report bench.Report, reportPath string) {
+	fmt.Fprintf(out, "Run %s: %d/%d requests completed, %d failed, %d timed out\n",
+		report.RunID, report.Completed, report.Requests, report.Failed, report.TimedOut)
+	fmt.Fprintf(out, "Submission rate: %.1f/s (target %.1f/s)\n", report.SubmissionRate, report.TargetRate)
+	fmt.Fprintf(out, "Throughput: %.1f requests/s over %.1fs\n", report.Throughput, report.DurationSeconds)
+	fmt.Fprintf(out, "Dispatch latency: p50 %.2fs, p95 %.2fs, max %.2fs\n",
+		report.DispatchLatency.P50, report.DispatchLatency.P95, report.DispatchLatency.Max)
+	fmt.Fprintf(out, "End-to-end latency: p50 %.2fs, p95 %.2fs, max %.2fs\n",
+		report.EndToEndLatency.P50, report.EndToEndLatency.P95, report.EndToEndLatency.Max)
+	fmt.Fprintf(out, "Max queue depth: %d\n", report.MaxQueueDepth)
+	fmt.Fprintf(out, "Report written to %s. Remove the synthetic requests with: main bench --purge\n", reportPath)
+}
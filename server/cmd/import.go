@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// runImport creates approved requests for the players of an existing whitelist.json so they are
+// counted in the stats and can be deactivated. Nothing is sent to the players or the game server
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the summary as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: main import [--json] <path to whitelist.json>")
+		return 2
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to open the whitelist: "+err.Error())
+		return 1
+	}
+	defer file.Close()
+	entries, err := parseWhitelistFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to parse the whitelist: "+err.Error())
+		return 1
+	}
+	// Keep the standard output for the summary
+	log.SetOutput(os.Stderr)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(viper.GetString("mongodbConn")))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to connect to mongodb: "+err.Error())
+		return 1
+	}
+	defer client.Disconnect(context.Background())
+	dbService := db.NewService(client)
+	summary := dbService.ImportWhitelist(entries)
+	if len(summary.Created) > 0 {
+		// Refresh the cached requests and stats so the imported players show up right away
+		err = cache.NewService(dbService, nil).SyncStats()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to sync the stats, they are synced again on the next start: "+err.Error())
+		}
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(summary)
+	} else {
+		printImportSummary(os.Stdout, summary)
+	}
+	if err != nil || len(summary.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// parseWhitelistFile parses the whitelist.json file of a vanilla game server
+func parseWhitelistFile(r io.Reader) ([]types.WhitelistEntry, error) {
+	var entries []types.WhitelistEntry
+	err := json.NewDecoder(r).Decode(&entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func printImportSummary(out io.Writer, summary db.ImportSummary) {
+	fmt.Fprintf(out, "Created (%d): %s\n", len(summary.Created), strings.Join(summary.Created, ", "))
+	fmt.Fprintf(out, "Skipped, request exists (%d): %s\n", len(summary.Skipped), strings.Join(summary.Skipped, ", "))
+	if len(summary.Failed) > 0 {
+		fmt.Fprintf(out, "Failed (%d): %s\n", len(summary.Failed), strings.Join(summary.Failed, ", "))
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseWhitelistFile(t *testing.T) {
+	entries, err := parseWhitelistFile(strings.NewReader(`[
+  {"uuid": "069a79f4-44e9-4726-a5be-fca90e38aaf5", "name": "Notch"},
+  {"uuid": "853c80ef-3c37-49fd-aa49-938b674adae6", "name": "jeb_"}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "Notch" || entries[1].UUID != "853c80ef-3c37-49fd-aa49-938b674adae6" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+	_, err = parseWhitelistFile(strings.NewReader(`{"name": "Notch"}`))
+	if err == nil {
+		t.Error("expected an error for a file that is not a whitelist")
+	}
+}
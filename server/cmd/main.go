@@ -2,20 +2,33 @@ package main
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"net/http"
 	"os"
 	"sync"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/attachments"
 	"github.com/tywin1104/mc-gatekeeper/broker"
 	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/config"
 	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/form"
+	"github.com/tywin1104/mc-gatekeeper/links"
+	"github.com/tywin1104/mc-gatekeeper/mailer"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/rcon"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
 	"github.com/tywin1104/mc-gatekeeper/server"
 	"github.com/tywin1104/mc-gatekeeper/server/sse"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/topology"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"github.com/tywin1104/mc-gatekeeper/webhook"
 	"github.com/tywin1104/mc-gatekeeper/worker"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -32,6 +45,8 @@ func main() {
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
 	viper.AutomaticEnv()
+	// Deployments set the address of the frontend in the environment
+	viper.BindEnv("frontendURL", "FRONTEND_DEPLOYED_URL")
 	viper.SetConfigType("yml")
 
 	if err := viper.ReadInConfig(); err != nil {
@@ -40,14 +55,59 @@ func main() {
 		}).Fatal("Error reading config file")
 	}
 
+	// Declare the message queue topology and exit, e.g before the first deployment on a new broker
+	if len(os.Args) > 1 && os.Args[1] == "topology" {
+		names, err := topology.DeclareFromConfig()
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Fatal("Unable to declare message queue topology")
+		}
+		log.WithFields(logrus.Fields{
+			"queues": names.Queues(),
+		}).Info("Message queue topology declared")
+		return
+	}
+	// Inspect and change requests from the command line, e.g while the frontend is down
+	if len(os.Args) > 1 && os.Args[1] == "requests" {
+		os.Exit(runRequests(os.Args[2:]))
+	}
+	// Compare the whitelist of the game server with the approved requests once
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(runReconcile(os.Args[2:]))
+	}
+	// Create approved requests for the players of an existing whitelist.json
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(os.Args[2:]))
+	}
+	// Measure the capacity of the pipeline with synthetic requests against a test configuration
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+
 	err := validateConfig()
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err": err.Error(),
 		}).Fatal("Invalid configuration")
 	}
-	// Watch for configuration changes
-	go watchConfig(log)
+	// Templates referencing data not allowed for their audience would leak it or render empty
+	err = mailer.ValidateTemplates(mailer.TemplatesDir)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Fatal("Invalid email templates")
+	}
+	// Older producers may still send deprecated field names
+	types.LegacyAliasUsed = func(alias, canonical string) {
+		metrics.LegacyFieldAliases.WithLabelValues(alias).Inc()
+		log.WithFields(logrus.Fields{
+			"alias":     alias,
+			"canonical": canonical,
+		}).Warning("Whitelist request uses a deprecated field name")
+	}
+	// Reload the settings that are safe to change while running
+	config.Watch(log, validateConfig)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -60,6 +120,31 @@ func main() {
 
 	// Setup database service
 	dbSvc := db.NewService(client)
+	err = dbSvc.EnsureIndexes()
+	if err != nil {
+		// Duplicate requests are still rejected by the API and the worker, queries only get slower
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to create indexes")
+	}
+	// Hash the addresses stored before the hash mode was enabled
+	_, err = server.MigrateSubmissionIPs(dbSvc, log.WithField("origin", "migration"))
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to hash the stored submission addresses. They are hashed again on the next start")
+	}
+	// Players imported before their state on the game server was recorded, so they are not whitelisted again
+	backfilled, err := dbSvc.BackfillImportedOnserverStatus()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to record imported players as whitelisted. They are recorded on the next start")
+	} else if backfilled > 0 {
+		log.WithFields(logrus.Fields{
+			"backfilled": backfilled,
+		}).Info("Recorded imported players as whitelisted")
+	}
 
 	// Initilize server side event server for pushing out stats
 	serverLogger := log.WithField("origin", "server")
@@ -70,11 +155,23 @@ func main() {
 	if err != nil {
 		log.Fatal("Unable to sync cache values: " + err.Error())
 	}
-	// Start background job to collect aggregate stats at a interval
+	// Rebuild the cache once it is reachable again after an outage
+	healthCheckInterval := time.Duration(viper.GetInt("cacheHealthCheckSeconds")) * time.Second
+	if healthCheckInterval <= 0 {
+		healthCheckInterval = 10 * time.Second
+	}
+	go cache.MonitorConnection(healthCheckInterval)
+	// Only the leading instance runs the periodic background jobs if several instances are deployed
+	cache.StartLeaderElection(instanceID(), leaderLockTTL())
+	// Start background job to reconcile aggregate stats at a interval
 	go aggregatingStats(cache)
+	// Start background job to recount the time-windowed stats at their own interval
+	go countingTimeSeries(cache)
+	// Start background job to rebuild the cached requests in case a change was missed
+	go rebuildingRequests(cache)
 
 	// Set it running - listening and broadcasting events
-	go sseServer.Listen(cache.BroadcastStats)
+	go sseServer.Listen(cache.BroadcastAllStats)
 
 	broker := broker.NewService(log, make(chan *amqp.Error))
 	// Watch for unexpected connection loss to rabbitMQ and re-establish connection
@@ -82,62 +179,349 @@ func main() {
 	defer broker.Close()
 
 	wg := sync.WaitGroup{}
-	wg.Add(2)
+	wg.Add(1)
 	// Start the worker
 	workerLogger := log.WithField("origin", "worker")
-	worker1, err := worker.NewWorker(dbSvc, cache, workerLogger, make(chan *amqp.Error))
+	executor, err := worker.NewRCONExecutor(workerLogger)
+	if err != nil {
+		log.Fatal("Unable to connect to the game server: " + err.Error())
+	}
+	worker1, err := worker.NewWorker(dbSvc, cache, workerLogger, make(chan *amqp.Error), executor)
+	if err != nil {
+		log.Fatal("Unable to start worker: " + err.Error())
+	}
+	err = worker1.Start()
 	if err != nil {
 		log.Fatal("Unable to start worker: " + err.Error())
 	}
-	go worker1.Start(&wg)
 	defer worker1.Close()
+	// Serve prometheus metrics on a dedicated port if configured
+	// Otherwise they are served by the API server
+	if metricsPort := viper.GetString("metricsPort"); metricsPort != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			if err := http.ListenAndServe(metricsPort, mux); err != nil {
+				log.Fatal("Unable to serve metrics: " + err.Error())
+			}
+		}()
+	}
+	// Serve liveness and readiness probes of the worker if configured
+	if healthPort := viper.GetString("healthPort"); healthPort != "" {
+		go func() {
+			if err := http.ListenAndServe(healthPort, worker1.HealthService().Handler()); err != nil {
+				log.Fatal("Unable to serve health checks: " + err.Error())
+			}
+		}()
+	}
 	// Setup and start the http REST API server
 	httpServer := server.NewService(dbSvc, broker, cache, sseServer, serverLogger)
 	go httpServer.Listen(viper.GetString("port"), &wg)
+	// Start background job to regenerate the public member directory
+	go regeneratingDirectory(httpServer, cache)
 	wg.Wait()
 	log.Info("Everything is up.")
 	<-make(chan int)
 }
 
+// validateConfig reports every problem of the configuration at once, see config.Validate
 func validateConfig() error {
-	// TODO: add more constraints to fail fast
-	strategy := viper.GetString("dispatchingStrategy")
-	if strategy != "Broadcast" && strategy != "Random" {
-		return errors.New("Invalid configuration. Allowed values for dispatchingStrategy: [Broadcast, Random]")
+	return config.Validate(
+		validateOps,
+		func() error {
+			if locale := viper.GetString("opsLocale"); locale != "" && mailer.NormalizeLocale(locale) == "" {
+				return fmt.Errorf("opsLocale %q is not supported. Allowed values: %v", locale, mailer.SupportedLocales)
+			}
+			return nil
+		},
+		func() error {
+			err := mailer.ValidateIdentities()
+			if err != nil {
+				return fmt.Errorf("Invalid email sender identity. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			err := worker.ValidateBedrockPrefixes()
+			if err != nil {
+				return fmt.Errorf("Invalid Bedrock settings. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			err := worker.ValidateCommandTemplates()
+			if err != nil {
+				return fmt.Errorf("Invalid command templates. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			err := rcon.ValidateAllowlist(viper.GetStringSlice("consoleAllowlist"))
+			if err != nil {
+				return fmt.Errorf("Invalid consoleAllowlist. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			err := worker.ValidateServerBackends()
+			if err != nil {
+				return fmt.Errorf("Invalid game server backend. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			err := form.Validate()
+			if err != nil {
+				return fmt.Errorf("Invalid application form. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			err := worker.ValidateMaintenanceWindows()
+			if err != nil {
+				return fmt.Errorf("Invalid maintenance windows. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			err := worker.ValidateApplicationWindows()
+			if err != nil {
+				return fmt.Errorf("Invalid application windows. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			err := links.Validate()
+			if err != nil {
+				return fmt.Errorf("Invalid frontendURL. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			err := server.ValidatePublicStatsFields()
+			if err != nil {
+				return fmt.Errorf("Invalid publicStatsFields. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			if viper.GetBool("telegramBanAlerts") && (viper.GetString("telegramBotToken") == "" || viper.GetString("telegramChatID") == "") {
+				return fmt.Errorf("telegramBanAlerts requires telegramBotToken and telegramChatID")
+			}
+			return nil
+		},
+		func() error {
+			err := topology.Validate()
+			if err != nil {
+				return fmt.Errorf("Invalid message queue topology. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			err := attachments.Validate()
+			if err != nil {
+				return fmt.Errorf("Invalid attachments configuration. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			_, err := webhook.ParseEndpoints()
+			if err != nil {
+				return fmt.Errorf("Invalid webhooks configuration. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			_, err := utils.LinkSigningKeys()
+			if err != nil {
+				return fmt.Errorf("Invalid linkSigningKeys configuration. %s", err.Error())
+			}
+			return nil
+		},
+		func() error {
+			switch viper.GetString("ipStorageMode") {
+			case "", server.IPStorageHash, server.IPStorageRaw:
+				return nil
+			}
+			return fmt.Errorf("Unknown ipStorageMode %q. Allowed values: [%s, %s]", viper.GetString("ipStorageMode"), server.IPStorageHash, server.IPStorageRaw)
+		},
+		func() error {
+			_, err := schedule.Location()
+			if err != nil {
+				return fmt.Errorf("Invalid timezone. %s", err.Error())
+			}
+			for _, job := range periodicJobs {
+				if _, err := job.runs(); err != nil {
+					return fmt.Errorf("Invalid schedule. %s", err.Error())
+				}
+			}
+			return nil
+		},
+		validateTenants,
+	)
+}
+
+func validateOps() error {
+	ops, err := worker.ParseOps()
+	if err != nil {
+		return fmt.Errorf("Invalid ops configuration. %s", err.Error())
 	}
-	if strategy == "Random" && viper.GetInt("randomDispatchingThreshold") > len(viper.GetStringSlice("ops")) {
-		return errors.New("Invalid configuration. Threshold value for random dispatching can not exceed total number of ops")
+	if len(ops) == 0 {
+		log.Warning("No ops configured. New requests will await ops configuration and are dispatched once ops are configured")
 	}
 	return nil
 }
 
-func watchConfig(log *logrus.Logger) {
-	viper.WatchConfig()
-	viper.OnConfigChange(func(e fsnotify.Event) {
-		// Re-validate config each time it changes
-		err := validateConfig()
+// validateTenants checks the settings the tenants override
+func validateTenants() error {
+	err := tenant.Validate()
+	if err != nil {
+		return fmt.Errorf("Invalid tenants configuration. %s", err.Error())
+	}
+	for _, id := range tenant.IDs() {
+		cfg := tenant.Config{ID: id}
+		_, err := worker.ParseTenantOps(cfg)
 		if err != nil {
-			log.WithFields(logrus.Fields{
-				"err": err.Error(),
-			}).Error("Invalid configuration. The application will not not work properly.")
+			return fmt.Errorf("Invalid ops configuration of tenant %s. %s", id, err.Error())
 		}
+		strategy := cfg.GetString("dispatchingStrategy")
+		known := false
+		for _, s := range config.DispatchingStrategies {
+			known = known || s == strategy
+		}
+		if !known {
+			return fmt.Errorf("Unknown dispatchingStrategy %q of tenant %s", strategy, id)
+		}
+	}
+	return nil
+}
+
+// instanceID tells the instances of a deployment apart in the leader election, instanceId if configured
+func instanceID() string {
+	if id := viper.GetString("instanceId"); id != "" {
+		return id
+	}
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// leaderLockTTL is how long the leader lock outlives the leading instance if it stops renewing it, e.g after a
+// crash. Another instance takes over the periodic background jobs after that long
+func leaderLockTTL() time.Duration {
+	ttl := time.Duration(viper.GetInt("leaderLockSeconds")) * time.Second
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	return ttl
+}
+
+// periodicJob is a background job of the leader. It runs on the schedule set under scheduleKey, an interval or
+// an expression evaluated in the timezone, e.g "daily at 03:00". Otherwise every minutesKey minutes, by default
+// every fallback
+type periodicJob struct {
+	scheduleKey, minutesKey string
+	fallback                time.Duration
+}
+
+var (
+	statsReconcileJob   = periodicJob{"statsReconcileSchedule", "statsReconcileMinutes", time.Hour}
+	timeSeriesStatsJob  = periodicJob{"timeSeriesStatsSchedule", "timeSeriesStatsMinutes", 15 * time.Minute}
+	requestsRebuildJob  = periodicJob{"requestsRebuildSchedule", "requestsRebuildMinutes", 6 * time.Hour}
+	directoryRefreshJob = periodicJob{"directoryRefreshSchedule", "directoryRefreshMinutes", time.Hour}
+	periodicJobs        = []periodicJob{statsReconcileJob, timeSeriesStatsJob, requestsRebuildJob, directoryRefreshJob}
+)
+
+func (job periodicJob) runs() (schedule.Schedule, error) {
+	interval := time.Duration(viper.GetInt(job.minutesKey)) * time.Minute
+	if interval <= 0 {
+		interval = job.fallback
+	}
+	return schedule.FromConfig(job.scheduleKey, schedule.Every(interval))
+}
+
+// tick delivers the current time each time the job is due. Schedules are checked on startup, an invalid one
+// only set since then runs at the fallback interval
+func (job periodicJob) tick() <-chan time.Time {
+	runs, err := job.runs()
+	if err != nil {
 		log.WithFields(logrus.Fields{
-			"file": e.Name,
-		}).Info("Config file changed:")
-	})
+			"err": err.Error(),
+		}).Error("Invalid schedule, running at the default interval")
+		runs = schedule.Every(job.fallback)
+	}
+	return schedule.Tick(runs)
 }
 
+// Decisions update the stats as they are made. The aggregate stats are still recomputed at a long interval
+// to reconcile missed updates and refresh the overtime count
 func aggregatingStats(cache *cache.Service) {
-	for range time.Tick(60 * time.Second) {
-		go func() {
-			err := cache.UpdateAggregateStats()
+	for range statsReconcileJob.tick() {
+		if !cache.IsLeader() {
+			continue
+		}
+		err := cache.UpdateAggregateStats()
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to aggregate stats")
+		} else {
+			log.Info("Aggregate stats data completed")
+		}
+	}
+}
+
+// The time-windowed stats are not updated on decisions, they are recounted in db at a shorter interval than
+// the aggregate stats are reconciled. Counted once on startup so they are available right away
+func countingTimeSeries(cache *cache.Service) {
+	ticks := timeSeriesStatsJob.tick()
+	for {
+		if cache.IsLeader() {
+			err := cache.UpdateTimeSeriesStats()
 			if err != nil {
 				log.WithFields(logrus.Fields{
 					"err": err.Error(),
-				}).Error("Unable to aggregate stats")
-			} else {
-				log.Info("Aggregate stats data completed")
+				}).Error("Unable to count time series stats")
 			}
-		}()
+		}
+		<-ticks
+	}
+}
+
+// Tasks only update the cached entries of their request. The whole cache is rebuilt from db at a long
+// interval so entries missed, e.g while the cache was unavailable, do not stay stale
+func rebuildingRequests(cache *cache.Service) {
+	for range requestsRebuildJob.tick() {
+		if !cache.IsLeader() {
+			continue
+		}
+		err := cache.RebuildRequests()
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to rebuild cached requests")
+		} else {
+			log.Info("Cached requests rebuilt")
+		}
+	}
+}
+
+func regeneratingDirectory(httpServer *server.Service, cache *cache.Service) {
+	regenerateDirectory(httpServer, cache)
+	for range directoryRefreshJob.tick() {
+		regenerateDirectory(httpServer, cache)
+	}
+}
+
+func regenerateDirectory(httpServer *server.Service, cache *cache.Service) {
+	// The directory is only published if the owner enabled it. It is shared through the cache, so the leader
+	// regenerates it for every instance
+	if viper.GetString("directoryPublicToken") == "" || !cache.IsLeader() {
+		return
+	}
+	err := httpServer.RegenerateDirectory()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to regenerate member directory")
 	}
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/worker"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// runReconcile compares the whitelist of the game server with the approved requests once
+// and fixes the discrepancies unless it is a dry run
+func runReconcile(args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", worker.ReconcileDryRun(), "only report discrepancies. Defaults to reconcileDryRun")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	// Keep the standard output for the report
+	log.SetOutput(os.Stderr)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(viper.GetString("mongodbConn")))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to connect to mongodb: "+err.Error())
+		return 1
+	}
+	defer client.Disconnect(context.Background())
+	// Only the database and the game server are needed, the worker does not consume messages
+	executor, err := worker.NewRCONExecutor(log.WithField("origin", "reconcile"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to connect to the game server: "+err.Error())
+		return 1
+	}
+	w, err := worker.NewWorker(db.NewService(client), nil, log.WithField("origin", "reconcile"), nil, executor)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to create the worker: "+err.Error())
+		return 1
+	}
+	report, err := w.Reconcile(*dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to reconcile the whitelist: "+err.Error())
+		return 1
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	} else {
+		printReconcileReport(os.Stdout, report)
+	}
+	if err != nil || len(report.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printReconcileReport(out io.Writer, report worker.ReconcileReport) {
+	fmt.Fprintf(out, "Whitelisted without approved request (%d): %s\n", len(report.NotApproved), strings.Join(report.NotApproved, ", "))
+	fmt.Fprintf(out, "Approved but not whitelisted (%d): %s\n", len(report.Missing), strings.Join(report.Missing, ", "))
+	if report.DryRun {
+		fmt.Fprintln(out, "Dry run, nothing was changed")
+		return
+	}
+	fmt.Fprintf(out, "Fixed (%d): %s\n", len(report.Fixed), strings.Join(report.Fixed, ", "))
+	if len(report.Failed) > 0 {
+		fmt.Fprintf(out, "Failed (%d): %s\n", len(report.Failed), strings.Join(report.Failed, ", "))
+	}
+}
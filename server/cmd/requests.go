@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/server"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const requestsUsage = `Usage: main requests <command> [flags]
+
+Commands:
+  list [--status STATUS] [--limit N]   List requests, most recently submitted first
+  show ID                              Show a request
+  approve ID [--reason R] [--note N]   Approve a request
+  deny ID [--reason R] [--note N]      Deny a request
+  ban ID [--reason R] [--note N]       Ban the player of a request
+  deactivate ID [--note N]             Deactivate the player of a request
+  unban ID [--note N]                  Pardon the player of a banned request, who may apply again
+  requeue ID                           Publish the task of the request's current status again,
+                                       e.g once the game server is reachable again
+  resend ID --email EMAIL [--op OP]    Send an email of a request again: confirmation, decision or
+                                       ops-action. The action email is resent to every assigned op
+                                       unless --op is given
+  erase ID|EMAIL [--delete]            Erase the personal data of a request, or of every request of an
+                                       email. Requests that never got approved are deleted with --delete
+
+Every command accepts --json to print JSON instead of a table. Changes are made the same way
+as through the API, published to the worker and recorded in the audit log with --actor as actor
+`
+
+// requestsBackend is what the requests commands need from the database and the message queue
+type requestsBackend interface {
+	GetRequests(limit int64, filter interface{}) ([]types.WhitelistRequest, error)
+	UpdateRequest(requestID string, change map[string]interface{}, actor string) (types.WhitelistRequest, error)
+	RequeueRequest(requestID string, actor string) (types.WhitelistRequest, error)
+	ResendEmail(requestID string, body server.ResendBody, actor string) (types.ResendTask, error)
+	EraseRequests(body server.ErasureBody, actor string) (server.ErasureResult, error)
+}
+
+// cliRequestsBackend reads requests from the database and changes them through the server service.
+// The message queue is only connected to once a request is changed
+type cliRequestsBackend struct {
+	dbService *db.Service
+	broker    *broker.Service
+	server    *server.Service
+}
+
+func (b *cliRequestsBackend) GetRequests(limit int64, filter interface{}) ([]types.WhitelistRequest, error) {
+	return b.dbService.GetRequests(limit, filter)
+}
+
+func (b *cliRequestsBackend) UpdateRequest(requestID string, change map[string]interface{}, actor string) (types.WhitelistRequest, error) {
+	return b.serverService().UpdateRequest(requestID, change, actor)
+}
+
+func (b *cliRequestsBackend) RequeueRequest(requestID string, actor string) (types.WhitelistRequest, error) {
+	return b.serverService().RequeueRequest(requestID, actor)
+}
+
+func (b *cliRequestsBackend) ResendEmail(requestID string, body server.ResendBody, actor string) (types.ResendTask, error) {
+	return b.serverService().ResendEmail(requestID, body, actor)
+}
+
+// EraseRequests needs no message queue but the cache, which keeps the erased values until it is refreshed
+func (b *cliRequestsBackend) EraseRequests(body server.ErasureBody, actor string) (server.ErasureResult, error) {
+	svc := server.NewService(b.dbService, nil, cache.NewService(b.dbService, nil), nil, log.WithField("origin", "cli"))
+	return svc.EraseRequests(body, actor)
+}
+
+func (b *cliRequestsBackend) serverService() *server.Service {
+	if b.server == nil {
+		b.broker = broker.NewService(log, make(chan *amqp.Error))
+		b.server = server.NewService(b.dbService, b.broker, nil, nil, log.WithField("origin", "cli"))
+	}
+	return b.server
+}
+
+func (b *cliRequestsBackend) close() {
+	if b.broker != nil {
+		b.broker.Close()
+	}
+}
+
+// Statuses each decision command moves a request to
+var requestTransitions = map[string]string{
+	"approve":    types.StatusApproved,
+	"deny":       types.StatusDenied,
+	"ban":        types.StatusBanned,
+	"deactivate": types.StatusDeactivated,
+	"unban":      types.StatusUnbanned,
+}
+
+// runRequests connects to the database and runs the requests subcommand of the admin CLI
+func runRequests(args []string) int {
+	// Keep the standard output for the results
+	log.SetOutput(os.Stderr)
+	log.SetLevel(logrus.WarnLevel)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(viper.GetString("mongodbConn")))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to connect to mongodb: "+err.Error())
+		return 1
+	}
+	defer client.Disconnect(context.Background())
+	backend := &cliRequestsBackend{dbService: db.NewService(client)}
+	defer backend.close()
+	return runRequestsCommand(args, backend, os.Stdout, os.Stderr)
+}
+
+// runRequestsCommand runs the requests subcommand of the admin CLI and returns the exit code
+func runRequestsCommand(args []string, backend requestsBackend, out, errOut io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(errOut, requestsUsage)
+		return 2
+	}
+	command := args[0]
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	asJSON := flags.Bool("json", false, "print JSON")
+	status := flags.String("status", "", "only list requests of this status")
+	limit := flags.Int64("limit", 50, "maximum number of requests listed, 0 for all")
+	reason := flags.String("reason", "", "decision reason told to the applicant")
+	note := flags.String("note", "", "note for other ops")
+	actor := flags.String("actor", defaultActor(), "actor recorded in the audit log")
+	email := flags.String("email", "", "email to resend: confirmation, decision or ops-action")
+	op := flags.String("op", "", "op the action email is resent to")
+	deleteUnapproved := flags.Bool("delete", false, "delete erased requests that never got approved")
+	id, err := parseRequestsArgs(flags, args[1:])
+	if err != nil {
+		return 2
+	}
+	if command != "list" && id == "" {
+		fmt.Fprintf(errOut, "%s needs the ID of a request\n", command)
+		return 2
+	}
+
+	var requests []types.WhitelistRequest
+	switch command {
+	case "list":
+		filter := bson.M{}
+		if *status != "" {
+			filter["status"] = *status
+		}
+		requests, err = backend.GetRequests(-1, filter)
+		if *limit > 0 && int64(len(requests)) > *limit {
+			requests = requests[:*limit]
+		}
+	case "show":
+		var request types.WhitelistRequest
+		request, err = showRequest(backend, id)
+		requests = []types.WhitelistRequest{request}
+	case "approve", "deny", "ban", "deactivate", "unban":
+		change := map[string]interface{}{"status": requestTransitions[command]}
+		if *note != "" {
+			change["note"] = *note
+		}
+		if *reason != "" {
+			change["decisionReason"] = *reason
+		}
+		var request types.WhitelistRequest
+		request, err = backend.UpdateRequest(id, change, *actor)
+		requests = []types.WhitelistRequest{request}
+	case "requeue":
+		var request types.WhitelistRequest
+		request, err = backend.RequeueRequest(id, *actor)
+		requests = []types.WhitelistRequest{request}
+	case "resend":
+		var task types.ResendTask
+		task, err = backend.ResendEmail(id, server.ResendBody{Email: *email, Op: *op}, *actor)
+		requests = []types.WhitelistRequest{task.Request}
+	case "erase":
+		body := server.ErasureBody{RequestID: id, Delete: *deleteUnapproved}
+		if strings.Contains(id, "@") {
+			body = server.ErasureBody{Email: id, Delete: *deleteUnapproved}
+		}
+		var result server.ErasureResult
+		result, err = backend.EraseRequests(body, *actor)
+		if err == nil {
+			return printErasure(out, errOut, result, *asJSON)
+		}
+	default:
+		fmt.Fprintf(errOut, "Unknown command %q\n\n%s", command, requestsUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(errOut, "Unable to %s request: %s\n", command, err.Error())
+		return 1
+	}
+	if *asJSON {
+		err = printRequestsJSON(out, requests, command == "list")
+	} else {
+		err = printRequestsTable(out, requests)
+	}
+	if err != nil {
+		fmt.Fprintln(errOut, err.Error())
+		return 1
+	}
+	return 0
+}
+
+func printErasure(out, errOut io.Writer, result server.ErasureResult, asJSON bool) int {
+	if asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			fmt.Fprintln(errOut, err.Error())
+			return 1
+		}
+		return 0
+	}
+	for _, id := range result.Erased {
+		fmt.Fprintln(out, "Erased "+id)
+	}
+	for _, id := range result.Deleted {
+		fmt.Fprintln(out, "Deleted "+id)
+	}
+	return 0
+}
+
+// parseRequestsArgs parses the flags and the optional request ID, which may come before or after the flags
+func parseRequestsArgs(flags *flag.FlagSet, args []string) (string, error) {
+	err := flags.Parse(args)
+	if err != nil {
+		return "", err
+	}
+	if flags.NArg() == 0 {
+		return "", nil
+	}
+	id := flags.Arg(0)
+	err = flags.Parse(flags.Args()[1:])
+	if err != nil {
+		return "", err
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(flags.Output(), "Unexpected arguments %v\n", flags.Args())
+		return "", errors.New("Unexpected arguments")
+	}
+	return id, nil
+}
+
+func showRequest(backend requestsBackend, id string) (types.WhitelistRequest, error) {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return types.WhitelistRequest{}, errors.New("Invalid request ID")
+	}
+	requests, err := backend.GetRequests(1, bson.M{"_id": _id})
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	if len(requests) == 0 {
+		return types.WhitelistRequest{}, errors.New("Resource not found")
+	}
+	return requests[0], nil
+}
+
+// defaultActor identifies the operator running the CLI in the audit log
+func defaultActor() string {
+	if user := os.Getenv("USER"); user != "" {
+		return "cli:" + user
+	}
+	return "cli"
+}
+
+func printRequestsJSON(out io.Writer, requests []types.WhitelistRequest, list bool) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if list {
+		return encoder.Encode(requests)
+	}
+	return encoder.Encode(requests[0])
+}
+
+func printRequestsTable(out io.Writer, requests []types.WhitelistRequest) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tEMAIL\tSTATUS\tSUBMITTED\tADMIN\tASSIGNEES")
+	for _, request := range requests {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			request.ID.Hex(),
+			request.Username,
+			request.Email,
+			request.Status,
+			request.Timestamp.Local().Format(time.RFC3339),
+			request.Admin,
+			strings.Join(request.Assignees, ","),
+		)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/server"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type fakeRequestsBackend struct {
+	requests []types.WhitelistRequest
+	changes  []map[string]interface{}
+	actors   []string
+	requeued []string
+	resent   []server.ResendBody
+	erasures []server.ErasureBody
+}
+
+func (b *fakeRequestsBackend) GetRequests(limit int64, filter interface{}) ([]types.WhitelistRequest, error) {
+	f := filter.(bson.M)
+	matched := make([]types.WhitelistRequest, 0)
+	for _, request := range b.requests {
+		if status, ok := f["status"]; ok && status != request.Status {
+			continue
+		}
+		if id, ok := f["_id"]; ok && id != request.ID {
+			continue
+		}
+		matched = append(matched, request)
+	}
+	return matched, nil
+}
+
+func (b *fakeRequestsBackend) UpdateRequest(requestID string, change map[string]interface{}, actor string) (types.WhitelistRequest, error) {
+	b.changes = append(b.changes, change)
+	b.actors = append(b.actors, actor)
+	request := b.requests[0]
+	request.Status = change["status"].(string)
+	return request, nil
+}
+
+func (b *fakeRequestsBackend) RequeueRequest(requestID string, actor string) (types.WhitelistRequest, error) {
+	b.requeued = append(b.requeued, requestID)
+	b.actors = append(b.actors, actor)
+	return b.requests[0], nil
+}
+
+func (b *fakeRequestsBackend) ResendEmail(requestID string, body server.ResendBody, actor string) (types.ResendTask, error) {
+	b.resent = append(b.resent, body)
+	b.actors = append(b.actors, actor)
+	return types.ResendTask{Request: b.requests[0], Email: body.Email}, nil
+}
+
+func (b *fakeRequestsBackend) EraseRequests(body server.ErasureBody, actor string) (server.ErasureResult, error) {
+	b.erasures = append(b.erasures, body)
+	b.actors = append(b.actors, actor)
+	return server.ErasureResult{Erased: []string{b.requests[0].ID.Hex()}, Deleted: []string{}}, nil
+}
+
+func newFakeRequestsBackend() *fakeRequestsBackend {
+	now := time.Now()
+	return &fakeRequestsBackend{requests: []types.WhitelistRequest{
+		{ID: primitive.NewObjectID(), Username: "steve", Email: "steve@gmail.com", Status: types.StatusPending, Timestamp: now},
+		{ID: primitive.NewObjectID(), Username: "alex", Email: "alex@gmail.com", Status: types.StatusApproved, Timestamp: now},
+		{ID: primitive.NewObjectID(), Username: "herobrine", Email: "herobrine@gmail.com", Status: types.StatusPending, Timestamp: now},
+	}}
+}
+
+func runTestCommand(backend requestsBackend, args ...string) (int, string, string) {
+	var out, errOut bytes.Buffer
+	code := runRequestsCommand(args, backend, &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+func TestRequestsList(t *testing.T) {
+	backend := newFakeRequestsBackend()
+	code, out, _ := runTestCommand(backend, "list", "--status", types.StatusPending, "--limit", "1")
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "ID") || !strings.Contains(lines[1], "steve") {
+		t.Errorf("Expected header and the first pending request, got %q", out)
+	}
+
+	code, out, _ = runTestCommand(backend, "list", "--json")
+	var requests []types.WhitelistRequest
+	if code != 0 || json.Unmarshal([]byte(out), &requests) != nil || len(requests) != 3 {
+		t.Errorf("Expected every request as JSON, got %d %q", code, out)
+	}
+}
+
+func TestRequestsShow(t *testing.T) {
+	backend := newFakeRequestsBackend()
+	id := backend.requests[1].ID.Hex()
+	code, out, _ := runTestCommand(backend, "show", id, "--json")
+	var request types.WhitelistRequest
+	if code != 0 || json.Unmarshal([]byte(out), &request) != nil || request.Username != "alex" {
+		t.Errorf("Expected the request as JSON, got %d %q", code, out)
+	}
+	code, _, errOut := runTestCommand(backend, "show", primitive.NewObjectID().Hex())
+	if code != 1 || !strings.Contains(errOut, "not found") {
+		t.Errorf("Expected missing request to fail, got %d %q", code, errOut)
+	}
+	code, _, _ = runTestCommand(backend, "show", "not-an-id")
+	if code != 1 {
+		t.Errorf("Expected invalid ID to fail, got %d", code)
+	}
+}
+
+func TestRequestsTransitions(t *testing.T) {
+	backend := newFakeRequestsBackend()
+	id := backend.requests[0].ID.Hex()
+	// Flags may come before or after the ID
+	code, _, _ := runTestCommand(backend, "deny", "--actor", "cli:alice", id, "--reason", "Incomplete application")
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	code, _, _ = runTestCommand(backend, "ban", id, "--note", "Griefed")
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	if backend.changes[0]["status"] != types.StatusDenied || backend.changes[0]["decisionReason"] != "Incomplete application" {
+		t.Errorf("Unexpected deny change %v", backend.changes[0])
+	}
+	if backend.changes[1]["status"] != types.StatusBanned || backend.changes[1]["note"] != "Griefed" {
+		t.Errorf("Unexpected ban change %v", backend.changes[1])
+	}
+	if _, ok := backend.changes[1]["decisionReason"]; ok {
+		t.Errorf("Expected no decision reason without --reason, got %v", backend.changes[1])
+	}
+	// Changes are attributed to the actor in the audit log
+	if backend.actors[0] != "cli:alice" || !strings.HasPrefix(backend.actors[1], "cli") {
+		t.Errorf("Unexpected actors %v", backend.actors)
+	}
+	code, _, _ = runTestCommand(backend, "unban", id)
+	if code != 0 || backend.changes[2]["status"] != types.StatusUnbanned {
+		t.Errorf("Expected request to be unbanned, got %d %v", code, backend.changes[2])
+	}
+
+	code, _, _ = runTestCommand(backend, "requeue", id)
+	if code != 0 || len(backend.requeued) != 1 || backend.requeued[0] != id {
+		t.Errorf("Expected request to be requeued, got %d %v", code, backend.requeued)
+	}
+
+	code, _, _ = runTestCommand(backend, "resend", id, "--email", types.EmailOpsAction, "--op", "op1@gmail.com")
+	if code != 0 || len(backend.resent) != 1 || backend.resent[0] != (server.ResendBody{Email: types.EmailOpsAction, Op: "op1@gmail.com"}) {
+		t.Errorf("Expected the action email to be resent to the op, got %d %v", code, backend.resent)
+	}
+}
+
+func TestRequestsErase(t *testing.T) {
+	backend := newFakeRequestsBackend()
+	id := backend.requests[0].ID.Hex()
+	code, out, _ := runTestCommand(backend, "erase", id)
+	if code != 0 || out != "Erased "+id+"\n" || backend.erasures[0] != (server.ErasureBody{RequestID: id}) {
+		t.Errorf("Expected the request to be erased, got %d %q %v", code, out, backend.erasures)
+	}
+	code, out, _ = runTestCommand(backend, "erase", "steve@gmail.com", "--delete", "--json")
+	var result server.ErasureResult
+	if code != 0 || json.Unmarshal([]byte(out), &result) != nil || len(result.Erased) != 1 {
+		t.Errorf("Expected the erasure as JSON, got %d %q", code, out)
+	}
+	if backend.erasures[1] != (server.ErasureBody{Email: "steve@gmail.com", Delete: true}) {
+		t.Errorf("Expected the requests of the email to be erased, got %v", backend.erasures[1])
+	}
+}
+
+func TestRequestsUsage(t *testing.T) {
+	backend := newFakeRequestsBackend()
+	for _, args := range [][]string{
+		{},
+		{"promote", "id"},
+		{"approve"},
+		{"approve", "id", "extra"},
+		{"list", "--unknown"},
+	} {
+		if code, _, _ := runTestCommand(backend, args...); code != 2 {
+			t.Errorf("Expected usage error for %v, got %d", args, code)
+		}
+	}
+	if len(backend.changes) != 0 {
+		t.Errorf("Expected no change on usage errors, got %v", backend.changes)
+	}
+}
@@ -0,0 +1,136 @@
+// Package config validates the configuration on startup and reloads the settings that are safe to change
+// while running, e.g the ops and the email subjects, when the config file changes
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+)
+
+// The passphrase keys the encryption of tokens. The Helm chart generates one of this length
+const minPassphraseLength = 16
+
+// DispatchingStrategies are the allowed values of dispatchingStrategy
+var DispatchingStrategies = []string{"Broadcast", "Random", "RoundRobin", "LeastAssigned"}
+
+// EmailEventsProviders are the allowed values of emailEventsProvider
+var EmailEventsProviders = []string{"sendgrid", "ses"}
+
+// CommentNotifications are the allowed values of commentNotification
+var CommentNotifications = []string{"email", "webhook"}
+
+// Problems lists every problem found in the configuration
+type Problems []string
+
+func (p Problems) Error() string {
+	return strings.Join(p, "; ")
+}
+
+// Check validates a part of the configuration owned by another package, e.g the command templates of the worker
+type Check func() error
+
+// DryRun reports whether the side effects of tasks are simulated, so no game server nor SMTP server is needed.
+// The test environment always runs dry
+func DryRun() bool {
+	return viper.GetBool("dryRun") || viper.GetString("environment") == "test"
+}
+
+// Validate checks the required settings and runs the checks, reporting every problem at once instead of
+// crashing deep into runtime. Returns Problems, or nil if the configuration is valid
+func Validate(checks ...Check) error {
+	v := Settings()
+	var problems Problems
+	required := func(keys ...string) {
+		for _, key := range keys {
+			if strings.TrimSpace(v.GetString(key)) == "" {
+				problems = append(problems, key+" is required")
+			}
+		}
+	}
+	port := func(key string) {
+		if p := v.GetInt(key); p <= 0 || p > 65535 {
+			problems = append(problems, fmt.Sprintf("%s %q is not a valid port", key, v.GetString(key)))
+		}
+	}
+	// Optional settings are either unset or one of the allowed values
+	oneOf := func(key string, allowed []string) {
+		value := v.GetString(key)
+		if value == "" {
+			return
+		}
+		for _, a := range allowed {
+			if a == value {
+				return
+			}
+		}
+		problems = append(problems, fmt.Sprintf("Unknown %s %q. Allowed values: %v", key, value, allowed))
+	}
+
+	required("mongodbConn", "rabbitMQConn", "redisConn", "jwtTokenSecret")
+	if conn := v.GetString("mongodbConn"); conn != "" && !strings.HasPrefix(conn, "mongodb://") && !strings.HasPrefix(conn, "mongodb+srv://") {
+		problems = append(problems, "mongodbConn must start with mongodb:// or mongodb+srv://")
+	}
+	if conn := v.GetString("rabbitMQConn"); conn != "" {
+		if _, err := amqp.ParseURI(conn); err != nil {
+			problems = append(problems, "Invalid rabbitMQConn. "+err.Error())
+		}
+	}
+	if len(v.GetString("passphrase")) < minPassphraseLength {
+		problems = append(problems, fmt.Sprintf("passphrase must be at least %d characters long", minPassphraseLength))
+	}
+	for _, previous := range v.GetStringSlice("previousPassphrases") {
+		if previous == "" || previous == v.GetString("passphrase") {
+			problems = append(problems, "previousPassphrases must not be empty nor the passphrase")
+			break
+		}
+	}
+	oneOf("emailEventsProvider", EmailEventsProviders)
+	oneOf("commentNotification", CommentNotifications)
+	if !DryRun() {
+		required("SMTPServer", "SMTPEmail", "SMTPPassword")
+		port("SMTPPort")
+		// Proxies managed through their plugin may have no RCON
+		if v.GetString("serverBackend") != "http" {
+			required("RCONServer", "RCONPassword")
+			port("RCONPort")
+		}
+	}
+	problems = append(problems, dispatchingProblems(v)...)
+	for _, check := range checks {
+		if err := check(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// dispatchingProblems checks that the strategy is known and its threshold can be met by the ops. Without ops
+// requests await ops configuration, so no ops is not a problem
+func dispatchingProblems(v *viper.Viper) Problems {
+	strategy := v.GetString("dispatchingStrategy")
+	known := false
+	for _, s := range DispatchingStrategies {
+		known = known || s == strategy
+	}
+	if !known {
+		return Problems{fmt.Sprintf("Unknown dispatchingStrategy %q. Allowed values: %v", strategy, DispatchingStrategies)}
+	}
+	ops := 0
+	switch entries := v.Get("ops").(type) {
+	case []interface{}:
+		ops = len(entries)
+	case []string:
+		ops = len(entries)
+	}
+	threshold := v.GetInt("randomDispatchingThreshold")
+	if strategy != "Broadcast" && ops > 0 && threshold > ops {
+		return Problems{fmt.Sprintf("randomDispatchingThreshold %d exceeds the number of ops (%d)", threshold, ops)}
+	}
+	return nil
+}
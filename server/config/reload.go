@@ -0,0 +1,172 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Settings re-read while running. Tenants may override them as well
+var reloadableKeys = map[string]bool{
+	"ops":                        true,
+	"dispatchingstrategy":        true,
+	"randomdispatchingthreshold": true,
+	"slahours":                   true,
+	"maxretries":                 true,
+	"retrydelayseconds":          true,
+}
+
+var (
+	mu sync.RWMutex
+	// Settings read by the last reload. nil until the config file changed
+	settings *viper.Viper
+)
+
+// Reloadable tells if the setting is re-read when the config file changes: the ops, the dispatching strategy,
+// the email subjects, the SLA and the retry policy. Settings of tenants are named by their last segment
+func Reloadable(key string) bool {
+	key = strings.ToLower(key[strings.LastIndex(key, ".")+1:])
+	return reloadableKeys[key] || strings.HasSuffix(key, "emailtitle")
+}
+
+// Settings returns the settings read by the last reload of the config file, or the settings read on startup.
+// Settings returned are never changed, a reload replaces them
+func Settings() *viper.Viper {
+	mu.RLock()
+	defer mu.RUnlock()
+	if settings == nil {
+		return viper.GetViper()
+	}
+	return settings
+}
+
+func source(key string) *viper.Viper {
+	if Reloadable(key) {
+		return Settings()
+	}
+	return viper.GetViper()
+}
+
+// Get returns the setting. Reloadable settings are read from the last reload, the others from startup
+func Get(key string) interface{} {
+	return source(key).Get(key)
+}
+
+// IsSet tells if the setting is set, see Get
+func IsSet(key string) bool {
+	return source(key).IsSet(key)
+}
+
+// GetString returns the setting as a string, see Get
+func GetString(key string) string {
+	return source(key).GetString(key)
+}
+
+// GetInt returns the setting as an int, see Get
+func GetInt(key string) int {
+	return source(key).GetInt(key)
+}
+
+// GetBool returns the setting as a bool, see Get
+func GetBool(key string) bool {
+	return source(key).GetBool(key)
+}
+
+// GetStringSlice returns the setting as a string slice, see Get
+func GetStringSlice(key string) []string {
+	return source(key).GetStringSlice(key)
+}
+
+// UnmarshalKey decodes the setting into rawVal, see Get
+func UnmarshalKey(key string, rawVal interface{}) error {
+	return source(key).UnmarshalKey(key, rawVal)
+}
+
+// Watch reloads the settings when the config file changes. The reloaded settings are only kept if validate
+// accepts them. Changes of the other settings, e.g the connection strings, are logged as requiring a restart
+func Watch(logger *logrus.Logger, validate func() error) {
+	// Only tells about changes. The settings in use are read again so they are never changed while read
+	watcher := viper.New()
+	watcher.SetConfigFile(viper.ConfigFileUsed())
+	err := watcher.ReadInConfig()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to watch the config file. Settings are not reloaded")
+		return
+	}
+	watcher.OnConfigChange(func(e fsnotify.Event) {
+		logger.WithFields(logrus.Fields{
+			"file": e.Name,
+		}).Info("Config file changed")
+		reload(logger, validate)
+	})
+	watcher.WatchConfig()
+}
+
+func reload(logger *logrus.Logger, validate func() error) {
+	next := viper.New()
+	next.SetConfigFile(viper.ConfigFileUsed())
+	next.AutomaticEnv()
+	err := next.ReadInConfig()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to read the changed config file. Keeping the previous settings")
+		return
+	}
+	mu.Lock()
+	previous := settings
+	settings = next
+	mu.Unlock()
+	err = validate()
+	if err != nil {
+		mu.Lock()
+		settings = previous
+		mu.Unlock()
+		logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Invalid configuration. Keeping the previous settings")
+		return
+	}
+	if changed := restartRequired(viper.GetViper(), next); len(changed) > 0 {
+		logger.WithFields(logrus.Fields{
+			"settings": changed,
+		}).Warning("Settings changed that only apply after a restart. Restart required")
+	}
+	logger.Info("Settings reloaded")
+}
+
+// restartRequired lists the settings that are not reloadable and differ from the settings in use, including
+// added and removed tenants
+func restartRequired(current, next *viper.Viper) []string {
+	keys := make(map[string]bool)
+	for _, key := range append(current.AllKeys(), next.AllKeys()...) {
+		keys[key] = true
+	}
+	changed := []string{}
+	for key := range keys {
+		if !Reloadable(key) && !reflect.DeepEqual(current.Get(key), next.Get(key)) {
+			changed = append(changed, key)
+		}
+	}
+	if !reflect.DeepEqual(tenantIDs(current), tenantIDs(next)) {
+		changed = append(changed, "tenants")
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func tenantIDs(v *viper.Viper) []string {
+	ids := []string{}
+	for id := range v.GetStringMap("tenants") {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SetOpAway records the op as away until the given time, replacing the previous record of the op
+func (s *Service) SetOpAway(away types.OpAway) error {
+	collection := s.db.Database("mc-whitelist").Collection("opAvailability")
+	away.Op = strings.ToLower(away.Op)
+	_, err := collection.ReplaceOne(s.baseContext(), bson.M{"_id": away.Op}, away, options.Replace().SetUpsert(true))
+	return err
+}
+
+// RemoveOpAway marks the op back. Returns mongo.ErrNoDocuments if the op was not recorded as away
+func (s *Service) RemoveOpAway(op string) error {
+	collection := s.db.Database("mc-whitelist").Collection("opAvailability")
+	result, err := collection.DeleteOne(s.baseContext(), bson.M{"_id": strings.ToLower(op)})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// GetAwayOps query for the ops away at the given time, the first back first
+func (s *Service) GetAwayOps(now time.Time) ([]types.OpAway, error) {
+	collection := s.db.Database("mc-whitelist").Collection("opAvailability")
+	opts := options.Find().SetSort(bson.D{{Key: "awayUntil", Value: 1}})
+	cur, err := collection.Find(s.baseContext(), bson.M{"awayUntil": bson.M{"$gt": now}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(s.baseContext())
+	away := make([]types.OpAway, 0)
+	err = cur.All(s.baseContext(), &away)
+	return away, err
+}
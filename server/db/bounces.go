@@ -0,0 +1,67 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Number of Message-IDs of the last emails to the applicant kept on a request
+const maxMessageIDs = 20
+
+// RecordMessageID adds the Message-ID of an email sent to the applicant to the request, keeping the last ones
+func (s *Service) RecordMessageID(id primitive.ObjectID, messageID string) error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	_, err := collection.UpdateOne(s.baseContext(), bson.M{"_id": id}, bson.M{
+		"$push": bson.M{"messageIds": bson.M{"$each": []string{messageID}, "$slice": -maxMessageIDs}},
+	})
+	return err
+}
+
+// MarkEmailUndeliverable flags the request an email with the Message-ID was sent for, and returns it.
+// Returns mongo.ErrNoDocuments if no request has the Message-ID
+func (s *Service) MarkEmailUndeliverable(messageID, reason string) (types.WhitelistRequest, error) {
+	return s.ConditionalUpdateRequest(bson.M{"messageIds": messageID}, bson.M{
+		"$set": bson.M{"emailUndeliverable": true, "emailBounceReason": reason},
+	})
+}
+
+// MarkRequestEmailUndeliverable flags the request, e.g once the mail server of the applicant rejected the address
+func (s *Service) MarkRequestEmailUndeliverable(id primitive.ObjectID, reason string) error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	_, err := collection.UpdateOne(s.baseContext(), bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"emailUndeliverable": true, "emailBounceReason": reason},
+	})
+	return err
+}
+
+// SuppressEmail records the address as one emails are no longer sent to, replacing the previous record of it
+func (s *Service) SuppressEmail(suppression types.EmailSuppression) error {
+	collection := s.db.Database("mc-whitelist").Collection("emailSuppressions")
+	suppression.Email = strings.ToLower(suppression.Email)
+	_, err := collection.ReplaceOne(s.baseContext(), bson.M{"_id": suppression.Email}, suppression, options.Replace().SetUpsert(true))
+	return err
+}
+
+// EmailSuppressed tells whether emails are no longer sent to the address
+func (s *Service) EmailSuppressed(email string) (bool, error) {
+	collection := s.db.Database("mc-whitelist").Collection("emailSuppressions")
+	err := collection.FindOne(s.baseContext(), bson.M{"_id": strings.ToLower(email)}).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// EnsureBounceIndexes creates the index used to find the request of a bounced email
+func (s *Service) EnsureBounceIndexes() error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	_, err := collection.Indexes().CreateMany(s.baseContext(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "messageIds", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	return err
+}
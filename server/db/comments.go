@@ -0,0 +1,56 @@
+package db
+
+import (
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CommentsPage is a page of the comments on a request, oldest first
+type CommentsPage struct {
+	Comments []types.Comment `json:"comments"`
+	// Number of comments on the request
+	Total int64 `json:"total"`
+	// Page following this one, 0 on the last page
+	NextPage int64 `json:"nextPage,omitempty"`
+}
+
+// AddComment atomically appends the comment to the request and returns the updated request. Returns
+// mongo.ErrNoDocuments if the request does not exist
+func (s *Service) AddComment(id primitive.ObjectID, comment types.Comment) (types.WhitelistRequest, error) {
+	return s.ConditionalUpdateRequest(bson.M{"_id": id}, bson.M{
+		"$push": bson.M{"comments": comment},
+	})
+}
+
+// GetComments query for a page of the comments on the request, starting from page 1. Only the comments of the
+// page are read from db. Returns mongo.ErrNoDocuments if the request does not exist
+func (s *Service) GetComments(id primitive.ObjectID, page, pageSize int64) (CommentsPage, error) {
+	comments := bson.M{"$ifNull": []interface{}{"$comments", bson.A{}}}
+	var results []struct {
+		Comments []types.Comment `bson:"comments"`
+		Total    int64           `bson:"total"`
+	}
+	err := s.aggregate("requests", []bson.M{
+		{"$match": bson.M{"_id": id}},
+		{"$project": bson.M{
+			"total":    bson.M{"$size": comments},
+			"comments": bson.M{"$slice": []interface{}{comments, (page - 1) * pageSize, pageSize}},
+		}},
+	}, &results)
+	if err != nil {
+		return CommentsPage{}, err
+	}
+	if len(results) == 0 {
+		return CommentsPage{}, mongo.ErrNoDocuments
+	}
+	result := CommentsPage{Comments: results[0].Comments, Total: results[0].Total}
+	if result.Comments == nil {
+		result.Comments = make([]types.Comment, 0)
+	}
+	if page*pageSize < result.Total {
+		result.NextPage = page + 1
+	}
+	return result, nil
+}
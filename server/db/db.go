@@ -2,7 +2,7 @@ package db
 
 import (
 	"context"
-	"fmt"
+	"regexp"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -15,9 +15,20 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// Error code returned by mongodb when a write violates a unique index
+const duplicateKeyErrorCode = 11000
+
+// Error codes returned by mongodb when dropping an index that does not exist or of a collection that does not exist
+const (
+	namespaceNotFoundErrorCode = 26
+	indexNotFoundErrorCode     = 27
+)
+
 // Service represents struct that deals with database level operations
 type Service struct {
 	db *mongo.Client
+	// Deadline and cancellation of the operations, see WithContext
+	ctx context.Context
 }
 
 // NewService create new mongoDb service that handles database level operations
@@ -27,40 +38,57 @@ func NewService(db *mongo.Client) *Service {
 	}
 }
 
-// Ping checks for db connection
-func (s *Service) Ping() {
-	err := s.db.Ping(context.TODO(), readpref.Primary())
-	if err != nil {
-		fmt.Println("Unable to ping the db")
-	} else {
-		fmt.Println("Pong")
+// WithContext returns the service with its operations bound to the context, e.g to the deadline of a worker
+// task. Operations of the returned service fail once the context is done
+func (s *Service) WithContext(ctx context.Context) *Service {
+	return &Service{db: s.db, ctx: ctx}
+}
+
+// baseContext is the parent of the contexts of the operations
+func (s *Service) baseContext() context.Context {
+	if s.ctx == nil {
+		return context.Background()
 	}
+	return s.ctx
+}
+
+// Ping checks for db connection, giving up after the timeout
+func (s *Service) Ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(s.baseContext(), timeout)
+	defer cancel()
+	return s.db.Ping(ctx, readpref.Primary())
 }
 
 // CreateRequest create new whitelistRequest
 func (s *Service) CreateRequest(newRequest types.WhitelistRequest) (primitive.ObjectID, error) {
+	return s.createRequest(s.baseContext(), newRequest)
+}
+
+func (s *Service) createRequest(ctx context.Context, newRequest types.WhitelistRequest) (primitive.ObjectID, error) {
 	collection := s.db.Database("mc-whitelist").Collection("requests")
 	newRequest.ID = primitive.NewObjectID()
 	// Set initial request status and attach timestamp
 	newRequest.Timestamp = time.Now()
-	newRequest.Status = "Pending"
-	_, err := collection.InsertOne(context.TODO(), newRequest)
+	newRequest.SubmittedAt = &newRequest.Timestamp
+	newRequest.Status = types.StatusPending
+	_, err := collection.InsertOne(ctx, newRequest)
 	if err != nil {
 		return primitive.ObjectID{}, err
 	}
 	return newRequest.ID, nil
 }
 
-// GetRequests query for whitelistRequests in db
+// GetRequests query for whitelistRequests in db. Canary requests are never returned so they are
+// left out of stats, listings and exports. Use GetCanaryRequest to get them
 func (s *Service) GetRequests(limit int64, filter interface{}) ([]types.WhitelistRequest, error) {
 	collection := s.db.Database("mc-whitelist").Collection("requests")
-	cur, err := collection.Find(context.TODO(), filter, options.Find().SetSort(map[string]int{"timestamp": -1}))
+	cur, err := collection.Find(s.baseContext(), ExcludeCanaries(filter), options.Find().SetSort(map[string]int{"timestamp": -1}))
 	if err != nil {
 		return nil, err
 	}
 
 	requests := make([]types.WhitelistRequest, 0)
-	for cur.Next(context.TODO()) {
+	for cur.Next(s.baseContext()) {
 		var request types.WhitelistRequest
 		err := cur.Decode(&request)
 		if err != nil {
@@ -72,8 +100,83 @@ func (s *Service) GetRequests(limit int64, filter interface{}) ([]types.Whitelis
 	return requests, nil
 }
 
+// GetCanaryRequest get the canary request with the given ID
+func (s *Service) GetCanaryRequest(id primitive.ObjectID) (types.WhitelistRequest, error) {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	var request types.WhitelistRequest
+	err := collection.FindOne(s.baseContext(), bson.M{"_id": id, "canary": true}).Decode(&request)
+	return request, err
+}
+
+// ExcludeCanaries restricts the filter to requests that are not canaries
+func ExcludeCanaries(filter interface{}) bson.M {
+	return bson.M{"$and": []interface{}{filter, bson.M{"canary": bson.M{"$ne": true}}}}
+}
+
+// InTenant restricts the filter to the requests of the tenant with the server ID. Requests of the
+// default tenant have no server ID
+func InTenant(filter interface{}, serverID string) bson.M {
+	tenantFilter := bson.M{"serverId": serverID}
+	if serverID == "" {
+		tenantFilter = bson.M{"serverId": bson.M{"$in": []interface{}{nil, ""}}}
+	}
+	return bson.M{"$and": []interface{}{filter, tenantFilter}}
+}
+
+// FindDuplicateRequests query for requests of the tenant in one of the given statuses with the same username
+// or email, ignoring case. Most recent first
+func (s *Service) FindDuplicateRequests(serverID, username, email string, statuses []string, exclude bson.M) ([]types.WhitelistRequest, error) {
+	filter := bson.M{
+		"$or": []bson.M{
+			{"username": caseInsensitive(username)},
+			{"email": caseInsensitive(email)},
+		},
+		"status": bson.M{"$in": statuses},
+	}
+	for k, v := range exclude {
+		filter[k] = v
+	}
+	return s.GetRequests(-1, InTenant(filter, serverID))
+}
+
+func caseInsensitive(value string) primitive.Regex {
+	return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(value) + "$", Options: "i"}
+}
+
+// RequestsOfUsername matches the requests of the player, ignoring case, e.g to find the standing of a referrer
+func RequestsOfUsername(username string) bson.M {
+	return bson.M{"username": caseInsensitive(username)}
+}
+
+// MentionsWord matches values containing the given word, ignoring case. Used to find console
+// commands and audit entries about a player, e.g "whitelist add <username>"
+func MentionsWord(word string) primitive.Regex {
+	return primitive.Regex{Pattern: `(^|\s)` + regexp.QuoteMeta(word) + `(\s|$)`, Options: "i"}
+}
+
+// DeleteRequest delete the specified whitelistRequest
+func (s *Service) DeleteRequest(id primitive.ObjectID) error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	_, err := collection.DeleteOne(s.baseContext(), bson.M{"_id": id})
+	return err
+}
+
+// DeleteRequests delete all requests matching the filter and returns the number of requests deleted
+func (s *Service) DeleteRequests(filter interface{}) (int64, error) {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	result, err := collection.DeleteMany(s.baseContext(), filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
 // UpdateRequest perform partial update to the specified whitelistRequest in db
 func (s *Service) UpdateRequest(filter, update interface{}) (bson.M, error) {
+	return s.updateRequest(s.baseContext(), filter, update)
+}
+
+func (s *Service) updateRequest(ctx context.Context, filter, update interface{}) (bson.M, error) {
 	collection := s.db.Database("mc-whitelist").Collection("requests")
 	upsert := true
 	after := options.After
@@ -82,7 +185,7 @@ func (s *Service) UpdateRequest(filter, update interface{}) (bson.M, error) {
 		Upsert:         &upsert,
 	}
 
-	result := collection.FindOneAndUpdate(context.TODO(), filter, update, &opt)
+	result := collection.FindOneAndUpdate(ctx, filter, update, &opt)
 	if result.Err() != nil {
 		return nil, result.Err()
 	}
@@ -90,3 +193,277 @@ func (s *Service) UpdateRequest(filter, update interface{}) (bson.M, error) {
 	decodeErr := result.Decode(&updatedRequest)
 	return updatedRequest, decodeErr
 }
+
+// ConditionalUpdateRequest atomically updates the request matching the filter without upserting.
+// Returns mongo.ErrNoDocuments if no request matches, e.g the request has been changed concurrently
+func (s *Service) ConditionalUpdateRequest(filter, update interface{}) (types.WhitelistRequest, error) {
+	return s.conditionalUpdateRequest(s.baseContext(), filter, update)
+}
+
+func (s *Service) conditionalUpdateRequest(ctx context.Context, filter, update interface{}) (types.WhitelistRequest, error) {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	after := options.After
+	opt := options.FindOneAndUpdateOptions{
+		ReturnDocument: &after,
+	}
+	var updatedRequest types.WhitelistRequest
+	err := collection.FindOneAndUpdate(ctx, filter, update, &opt).Decode(&updatedRequest)
+	return updatedRequest, err
+}
+
+// UpdateRequests perform the same update to all requests matching the filter
+// Returns the number of requests modified
+func (s *Service) UpdateRequests(filter, update interface{}) (int64, error) {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	result, err := collection.UpdateMany(s.baseContext(), filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// CreateTask create new console task
+func (s *Service) CreateTask(newTask types.ConsoleTask) (primitive.ObjectID, error) {
+	collection := s.db.Database("mc-whitelist").Collection("tasks")
+	newTask.ID = primitive.NewObjectID()
+	newTask.Timestamp = time.Now()
+	newTask.Status = "Queued"
+	_, err := collection.InsertOne(s.baseContext(), newTask)
+	if err != nil {
+		return primitive.ObjectID{}, err
+	}
+	return newTask.ID, nil
+}
+
+// GetTask query for one console task by ID
+func (s *Service) GetTask(id primitive.ObjectID) (types.ConsoleTask, error) {
+	collection := s.db.Database("mc-whitelist").Collection("tasks")
+	var task types.ConsoleTask
+	err := collection.FindOne(s.baseContext(), bson.M{"_id": id}).Decode(&task)
+	return task, err
+}
+
+// GetTasks query for console tasks, most recent first
+func (s *Service) GetTasks(limit int64, filter interface{}) ([]types.ConsoleTask, error) {
+	collection := s.db.Database("mc-whitelist").Collection("tasks")
+	opts := options.Find().SetSort(map[string]int{"timestamp": -1})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cur, err := collection.Find(s.baseContext(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]types.ConsoleTask, 0)
+	for cur.Next(s.baseContext()) {
+		var task types.ConsoleTask
+		err := cur.Decode(&task)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// UpdateTask perform partial update to the specified console task in db
+func (s *Service) UpdateTask(id primitive.ObjectID, update interface{}) error {
+	collection := s.db.Database("mc-whitelist").Collection("tasks")
+	_, err := collection.UpdateOne(s.baseContext(), bson.M{"_id": id}, update)
+	return err
+}
+
+// CompleteConsoleTask records the response of the game server to the console task, and the failure if the
+// command failed
+func (s *Service) CompleteConsoleTask(ctx context.Context, id primitive.ObjectID, response, failure string, at time.Time) error {
+	changes := bson.M{
+		"status":             "Completed",
+		"response":           response,
+		"completedTimestamp": at,
+	}
+	if failure != "" {
+		changes["status"] = "Failed"
+		changes["error"] = failure
+	}
+	return s.WithContext(ctx).UpdateTask(id, bson.M{"$set": changes})
+}
+
+// CreateAuditEntry appends a new entry to the audit log
+func (s *Service) CreateAuditEntry(entry types.AuditEntry) error {
+	collection := s.db.Database("mc-whitelist").Collection("audit")
+	entry.ID = primitive.NewObjectID()
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	_, err := collection.InsertOne(s.baseContext(), entry)
+	return err
+}
+
+// GetAuditEntries query for audit log entries, most recent first
+func (s *Service) GetAuditEntries(limit int64, filter interface{}) ([]types.AuditEntry, error) {
+	collection := s.db.Database("mc-whitelist").Collection("audit")
+	opts := options.Find().SetSort(map[string]int{"timestamp": -1})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cur, err := collection.Find(s.baseContext(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]types.AuditEntry, 0)
+	for cur.Next(s.baseContext()) {
+		var entry types.AuditEntry
+		err := cur.Decode(&entry)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// CreateBatch create new active event batch
+func (s *Service) CreateBatch(newBatch types.Batch) (types.Batch, error) {
+	collection := s.db.Database("mc-whitelist").Collection("batches")
+	newBatch.ID = primitive.NewObjectID()
+	newBatch.Timestamp = time.Now()
+	newBatch.Status = types.BatchStatusActive
+	_, err := collection.InsertOne(s.baseContext(), newBatch)
+	if err != nil {
+		return types.Batch{}, err
+	}
+	return newBatch, nil
+}
+
+// GetBatches query for event batches with specified filter, sorted by end time
+func (s *Service) GetBatches(filter interface{}) ([]types.Batch, error) {
+	collection := s.db.Database("mc-whitelist").Collection("batches")
+	opts := options.Find().SetSort(map[string]int{"endTime": 1})
+	cur, err := collection.Find(s.baseContext(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	batches := make([]types.Batch, 0)
+	for cur.Next(s.baseContext()) {
+		var batch types.Batch
+		err := cur.Decode(&batch)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+// ConditionalUpdateBatch atomically updates the batch matching the filter.
+// Returns mongo.ErrNoDocuments if no batch matches
+func (s *Service) ConditionalUpdateBatch(filter, update interface{}) (types.Batch, error) {
+	collection := s.db.Database("mc-whitelist").Collection("batches")
+	after := options.After
+	opt := options.FindOneAndUpdateOptions{
+		ReturnDocument: &after,
+	}
+	var updatedBatch types.Batch
+	err := collection.FindOneAndUpdate(s.baseContext(), filter, update, &opt).Decode(&updatedBatch)
+	return updatedBatch, err
+}
+
+// GetExpiredBatches query for the active event batches whose end time has passed, sorted by end time
+func (s *Service) GetExpiredBatches(now time.Time) ([]types.Batch, error) {
+	return s.GetBatches(bson.M{
+		"status":  types.BatchStatusActive,
+		"endTime": bson.M{"$lte": now},
+	})
+}
+
+// EndBatch atomically ends the active event batch. Returns false if it has been ended already
+func (s *Service) EndBatch(id primitive.ObjectID, now time.Time) (types.Batch, bool, error) {
+	endedBatch, err := s.ConditionalUpdateBatch(bson.M{
+		"_id":    id,
+		"status": types.BatchStatusActive,
+	}, bson.M{
+		"$set": bson.M{"status": types.BatchStatusEnded, "endedTimestamp": now},
+	})
+	if err == mongo.ErrNoDocuments {
+		return types.Batch{}, false, nil
+	}
+	return endedBatch, err == nil, err
+}
+
+// DeleteBatch delete the specified event batch.
+// Returns mongo.ErrNoDocuments if the batch does not exist
+func (s *Service) DeleteBatch(id primitive.ObjectID) error {
+	collection := s.db.Database("mc-whitelist").Collection("batches")
+	result, err := collection.DeleteOne(s.baseContext(), bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// EnsureRequestIndexes creates the indexes enforcing that there is at most one pending request
+// per username and per email of each tenant, ignoring case
+func (s *Service) EnsureRequestIndexes() error {
+	// The indexes of earlier versions did not allow a player to apply to several tenants at once
+	for _, legacyIndex := range []string{"username_1_status_1", "email_1_status_1"} {
+		err := s.dropIndex("requests", legacyIndex)
+		if err != nil {
+			return err
+		}
+	}
+	pending := bson.M{"status": types.StatusPending}
+	err := s.EnsureUniqueIndex("requests", []string{"serverId", "username", "status"}, pending)
+	if err != nil {
+		return err
+	}
+	return s.EnsureUniqueIndex("requests", []string{"serverId", "email", "status"}, pending)
+}
+
+// dropIndex drops the index of the collection if it exists
+func (s *Service) dropIndex(collection, name string) error {
+	_, err := s.db.Database("mc-whitelist").Collection(collection).Indexes().DropOne(s.baseContext(), name)
+	if commandErr, ok := err.(mongo.CommandError); ok &&
+		(commandErr.Code == indexNotFoundErrorCode || commandErr.Code == namespaceNotFoundErrorCode) {
+		return nil
+	}
+	return err
+}
+
+// EnsureUniqueIndex creates a case insensitive unique compound index on the given keys of the collection
+// if it does not exist yet. Only documents matching partialFilter are indexed if it is not nil
+func (s *Service) EnsureUniqueIndex(collection string, keys []string, partialFilter interface{}) error {
+	indexKeys := bson.D{}
+	for _, key := range keys {
+		indexKeys = append(indexKeys, bson.E{Key: key, Value: 1})
+	}
+	opts := options.Index().
+		SetUnique(true).
+		SetCollation(&options.Collation{Locale: "en", Strength: 2})
+	if partialFilter != nil {
+		opts.SetPartialFilterExpression(partialFilter)
+	}
+	_, err := s.db.Database("mc-whitelist").Collection(collection).Indexes().CreateOne(s.baseContext(), mongo.IndexModel{
+		Keys:    indexKeys,
+		Options: opts,
+	})
+	return err
+}
+
+// IsDuplicateKeyError tells if the write failed because it violates a unique index
+func IsDuplicateKeyError(err error) bool {
+	// Returned by updates through FindOneAndUpdate
+	if commandError, ok := err.(mongo.CommandError); ok {
+		return commandError.Code == duplicateKeyErrorCode
+	}
+	if writeException, ok := err.(mongo.WriteException); ok {
+		for _, writeError := range writeException.WriteErrors {
+			if writeError.Code == duplicateKeyErrorCode {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,529 @@
+package db_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestExcludeCanaries(t *testing.T) {
+	filter := bson.M{"status": "Approved"}
+	excluding := db.ExcludeCanaries(filter)
+	clauses, ok := excluding["$and"].([]interface{})
+	if !ok || len(clauses) != 2 {
+		t.Fatalf("expected the filter and the canary exclusion to be combined, got %v", excluding)
+	}
+	if clauses[0].(bson.M)["status"] != "Approved" {
+		t.Errorf("expected the original filter to be kept, got %v", clauses[0])
+	}
+	canary := clauses[1].(bson.M)["canary"]
+	if ne, ok := canary.(bson.M)["$ne"]; !ok || ne != true {
+		t.Errorf("expected canary requests to be excluded, got %v", canary)
+	}
+}
+
+func TestInTenant(t *testing.T) {
+	clauses := db.InTenant(bson.M{"status": "Approved"}, "survival")["$and"].([]interface{})
+	if clauses[0].(bson.M)["status"] != "Approved" || clauses[1].(bson.M)["serverId"] != "survival" {
+		t.Errorf("expected the filter to be restricted to the tenant, got %v", clauses)
+	}
+	// Requests of the default tenant have no server ID
+	clauses = db.InTenant(bson.M{}, "")["$and"].([]interface{})
+	in, _ := clauses[1].(bson.M)["serverId"].(bson.M)["$in"].([]interface{})
+	if len(in) != 2 || in[0] != nil || in[1] != "" {
+		t.Errorf("expected requests without server ID to match the default tenant, got %v", clauses[1])
+	}
+}
+
+func TestImportedRequest(t *testing.T) {
+	importedAt := time.Now()
+	request := db.ImportedRequest(types.WhitelistEntry{UUID: "069a79f4-44e9-4726-a5be-fca90e38aaf5", Name: " Notch "}, importedAt)
+	if request.Username != "Notch" || request.Status != types.StatusApproved {
+		t.Errorf("expected an approved request of Notch, got %+v", request)
+	}
+	if request.Email != "notch@"+types.ImportedEmailDomain {
+		t.Errorf("expected a placeholder email, got %s", request.Email)
+	}
+	if request.UUID != "069a79f444e94726a5befca90e38aaf5" {
+		t.Errorf("expected the UUID in the format of the Mojang API, got %s", request.UUID)
+	}
+	if request.ImportedAt == nil || !request.ImportedAt.Equal(importedAt) || !request.ProcessedTimestamp.Equal(importedAt) {
+		t.Errorf("expected the import time to be recorded, got %+v", request)
+	}
+	if request.ID.IsZero() {
+		t.Error("expected the request to have an ID")
+	}
+	if request.OnserverStatus != types.OnserverWhitelisted {
+		t.Errorf("expected the imported player to be recorded as whitelisted, got %q", request.OnserverStatus)
+	}
+}
+
+// testService connects to the MongoDB of the test configuration. Skips the test if it is not running
+func testService(t *testing.T) (*db.Service, func()) {
+	viper.SetConfigName("config_test")
+	viper.AddConfigPath("../")
+	if err := viper.ReadInConfig(); err != nil {
+		t.Skip("No test configuration: " + err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(viper.GetString("mongodbConn")))
+	if err != nil {
+		t.Skip("MongoDB is not available: " + err.Error())
+	}
+	disconnect := func() { client.Disconnect(context.Background()) }
+	service := db.NewService(client)
+	if err := service.Ping(2 * time.Second); err != nil {
+		disconnect()
+		t.Skip("MongoDB is not available: " + err.Error())
+	}
+	return service, disconnect
+}
+
+// Imported players are already whitelisted, the recovery pass must not republish their approval. Players of
+// the whitelist with a request are skipped and keep their state, e.g approved players not whitelisted yet
+func TestImportOnserverStatus(t *testing.T) {
+	service, disconnect := testService(t)
+	defer disconnect()
+	suffix := primitive.NewObjectID().Hex()[18:]
+	imported, approved := "imp_"+suffix, "app_"+suffix
+	defer service.DeleteRequests(bson.M{"username": bson.M{"$in": []string{imported, approved}}})
+	id, err := service.CreateRequest(types.WhitelistRequest{Username: approved, Email: approved + "@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	_, err = service.ConditionalUpdateRequest(bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"status": types.StatusApproved, "lastUpdatedTimestamp": now},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := service.ImportWhitelist([]types.WhitelistEntry{
+		{UUID: "069a79f4-44e9-4726-a5be-fca90e38aaf5", Name: imported},
+		{UUID: "853c80ef-3c37-49fd-aa49-938b674adae6", Name: approved},
+	})
+	if len(summary.Created) != 1 || summary.Created[0] != imported || len(summary.Skipped) != 1 {
+		t.Fatalf("expected only the player without request to be imported, got %+v", summary)
+	}
+	onserverStatus := func(username string) string {
+		requests, err := service.GetRequests(-1, bson.M{"username": username})
+		if err != nil || len(requests) != 1 {
+			t.Fatalf("expected a request of %s, got %+v %v", username, requests, err)
+		}
+		return requests[0].OnserverStatus
+	}
+	if status := onserverStatus(imported); status != types.OnserverWhitelisted {
+		t.Errorf("expected the imported player to be recorded as whitelisted, got %q", status)
+	}
+	if status := onserverStatus(approved); status != "" {
+		t.Errorf("expected the skipped player to keep their state, got %q", status)
+	}
+	stuck, err := service.GetRequests(-1, bson.M{"$and": []interface{}{
+		db.StuckRequestsFilter(now.Add(-time.Hour), now.Add(time.Hour)),
+		bson.M{"username": bson.M{"$in": []string{imported, approved}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stuck) != 1 || stuck[0].Username != approved {
+		t.Errorf("expected only the approved player not whitelisted yet to be recovered, got %+v", stuck)
+	}
+
+	// Imported before the state was recorded on import
+	_, err = service.ConditionalUpdateRequest(bson.M{"username": imported}, bson.M{"$unset": bson.M{"onserverStatus": ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backfilled, err := service.BackfillImportedOnserverStatus(); err != nil || backfilled < 1 {
+		t.Fatalf("expected the imported player to be backfilled, got %d %v", backfilled, err)
+	}
+	if status := onserverStatus(imported); status != types.OnserverWhitelisted {
+		t.Errorf("expected the imported player to be backfilled as whitelisted, got %q", status)
+	}
+	if status := onserverStatus(approved); status != "" {
+		t.Errorf("expected players not imported to be left out of the backfill, got %q", status)
+	}
+}
+
+// The bounces of an erased address are erased with it, its suppression once no request has the address anymore
+func TestEraseRequestReleasesSuppression(t *testing.T) {
+	service, disconnect := testService(t)
+	defer disconnect()
+	suffix := primitive.NewObjectID().Hex()[18:]
+	email := "Bounced_" + suffix + "@gmail.com"
+	defer service.DeleteRequests(bson.M{"username": bson.M{"$in": []string{"first_" + suffix, "second_" + suffix}}})
+	var ids []primitive.ObjectID
+	for _, username := range []string{"first_" + suffix, "second_" + suffix} {
+		id, err := service.CreateRequest(types.WhitelistRequest{Username: username, Email: email})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := service.RecordMessageID(ids[0], "<"+suffix+"@mail.example.com>"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.MarkEmailUndeliverable("<"+suffix+"@mail.example.com>", "mailbox full"); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.SuppressEmail(types.EmailSuppression{Email: email, Reason: "mailbox full", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	suppressed := func() bool {
+		suppressed, err := service.EmailSuppressed(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return suppressed
+	}
+
+	erased, err := service.EraseRequest(ids[0], time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(erased.MessageIDs) != 0 || erased.EmailBounceReason != "" {
+		t.Errorf("expected the bounces of the address to be erased, got %v %q", erased.MessageIDs, erased.EmailBounceReason)
+	}
+	if !suppressed() {
+		t.Error("expected the address to stay suppressed while another request has it")
+	}
+	if _, err := service.EraseRequest(ids[1], time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if suppressed() {
+		t.Error("expected the suppression to be erased with the last request of the address")
+	}
+}
+
+// Erasing a decided request leaves no personal data of the applicant in the requests, the failed notifications
+// or the audit log. What was decided and by whom is kept
+func TestEraseDecidedRequest(t *testing.T) {
+	service, disconnect := testService(t)
+	defer disconnect()
+	suffix := primitive.NewObjectID().Hex()[18:]
+	username := "erased_" + suffix
+	defer service.DeleteRequests(bson.M{"username": username})
+	personal := []string{
+		"erased_" + suffix + "@gmail.com",
+		"griefed the spawn of " + suffix,
+		"friend of " + suffix,
+		"discord_" + suffix,
+		"203.0.113.7",
+		"comment about " + suffix,
+	}
+	id, err := service.CreateRequest(types.WhitelistRequest{
+		Username:          username,
+		Email:             "Erased_" + suffix + "@gmail.com",
+		Age:               17,
+		Gender:            "female",
+		Info:              map[string]interface{}{"discord": personal[3]},
+		SubmissionIP:      personal[4],
+		SubmissionCountry: "GB",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.ConditionalUpdateRequest(bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"status":             types.StatusDenied,
+		"processedTimestamp": time.Now(),
+		"admin":              "op1@gmail.com",
+		"decisionReason":     personal[1],
+		"note":               personal[2],
+		"comments":           []types.Comment{{Author: "op1@gmail.com", Text: personal[5], Timestamp: time.Now()}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.RecordFailedNotification(types.FailedNotification{
+		RequestID: id,
+		Username:  username,
+		Email:     "Erased_" + suffix + "@gmail.com",
+		Status:    types.StatusDenied,
+		Error:     "connection refused",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, details := range []map[string]interface{}{
+		{"decisionReason": personal[1]},
+		{"comment": personal[5]},
+		{"email": personal[0]},
+	} {
+		details["requestId"] = id.Hex()
+		details["username"] = username
+		details["status"] = types.StatusDenied
+		err = service.CreateAuditEntry(types.AuditEntry{Action: "request.update", Actor: "op1@gmail.com", Details: details})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := service.EraseRequest(id, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	requests, err := service.GetRequests(-1, bson.M{"_id": id})
+	if err != nil || len(requests) != 1 {
+		t.Fatalf("expected the erased request to be kept, got %+v %v", requests, err)
+	}
+	notifications, err := service.GetFailedNotifications(-1, bson.M{"requestId": id})
+	if err != nil || len(notifications) != 1 {
+		t.Fatalf("expected the failed notification to be kept, got %+v %v", notifications, err)
+	}
+	entries, err := service.GetAuditEntries(-1, bson.M{"details.requestId": id.Hex()})
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("expected the audit entries to be kept, got %+v %v", entries, err)
+	}
+	for name, document := range map[string]interface{}{"request": requests[0], "failed notification": notifications[0], "audit log": entries} {
+		stored, err := bson.MarshalExtJSON(bson.M{"document": document}, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range personal {
+			if strings.Contains(strings.ToLower(string(stored)), value) {
+				t.Errorf("expected %q to be erased from the %s, got %s", value, name, stored)
+			}
+		}
+	}
+	for _, entry := range entries {
+		if entry.Details["username"] != username || entry.Details["status"] != types.StatusDenied || entry.Actor != "op1@gmail.com" {
+			t.Errorf("expected what was decided and by whom to be kept, got %+v", entry)
+		}
+	}
+	if requests[0].Username != username || requests[0].Status != types.StatusDenied {
+		t.Errorf("expected the username and status to be kept, got %+v", requests[0])
+	}
+}
+
+func TestRequestExporterCSV(t *testing.T) {
+	var out bytes.Buffer
+	exporter, err := db.NewRequestExporter(&out, db.ExportOptions{
+		Format:  db.ExportFormatCSV,
+		Columns: []string{"username", "email", "status", "timestamp", "assignees"},
+		Redact:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitted := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	exporter.Write(types.WhitelistRequest{Username: "steve", Email: "steve@example.com", Status: types.StatusApproved,
+		Timestamp: submitted, Assignees: []string{"op1@example.com", "op2@example.com"}})
+	exporter.Write(types.WhitelistRequest{Username: "alex", Email: "alex@example.com", Status: types.StatusPending})
+	if err := exporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "username,email,status,timestamp,assignees\n" +
+		"steve,s***@example.com,Approved,2019-10-01T12:00:00Z,op1@example.com;op2@example.com\n" +
+		"alex,a***@example.com,Pending,,\n"
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestRequestExporterJSONLines(t *testing.T) {
+	var out bytes.Buffer
+	exporter, err := db.NewRequestExporter(&out, db.ExportOptions{Format: db.ExportFormatJSONLines})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"steve", "alex"} {
+		exporter.Write(types.WhitelistRequest{Username: username, Email: username + "@example.com"})
+	}
+	exporter.Flush()
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one line per request, got %q", out.String())
+	}
+	var row map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &row); err != nil {
+		t.Fatal(err)
+	}
+	if len(row) != len(db.DefaultExportColumns) || row["username"] != "alex" || row["email"] != "alex@example.com" {
+		t.Errorf("expected the default columns unredacted, got %v", row)
+	}
+}
+
+func TestCommentsExported(t *testing.T) {
+	var out bytes.Buffer
+	exporter, err := db.NewRequestExporter(&out, db.ExportOptions{
+		Format:  db.ExportFormatCSV,
+		Columns: []string{"username", "comments"},
+		Redact:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commented := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	exporter.Write(types.WhitelistRequest{Username: "steve", Comments: []types.Comment{
+		{Author: "op1@example.com", Text: "My cousin; I vouch", Timestamp: commented},
+		{Author: "op2@example.com", Text: "Fine by me", Timestamp: commented.Add(time.Hour)},
+	}})
+	exporter.Write(types.WhitelistRequest{Username: "alex"})
+	if err := exporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "username,comments\n" +
+		"steve,\"2019-10-01T12:00:00Z o***@example.com: My cousin; I vouch\n2019-10-01T13:00:00Z o***@example.com: Fine by me\"\n" +
+		"alex,\n"
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestExportOptionsValidate(t *testing.T) {
+	for _, opts := range []db.ExportOptions{
+		{Format: "xml"},
+		{Format: db.ExportFormatCSV, Columns: []string{"username", "password"}},
+	} {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", opts)
+		}
+	}
+	var out bytes.Buffer
+	exporter, _ := db.NewRequestExporter(&out, db.ExportOptions{Format: db.ExportFormatCSV, Columns: []string{"username"}})
+	exporter.Flush()
+	if out.String() != "username\n" {
+		t.Errorf("expected the header of an empty export, got %q", out.String())
+	}
+}
+
+func TestMaskEmail(t *testing.T) {
+	for email, expected := range map[string]string{
+		"steve@example.com": "s***@example.com",
+		"élise@example.com": "é***@example.com",
+		"invalid":           "***",
+	} {
+		if masked := db.MaskEmail(email); masked != expected {
+			t.Errorf("%s: expected %s, got %s", email, expected, masked)
+		}
+	}
+}
+
+func TestWithNextSequence(t *testing.T) {
+	update := db.WithNextSequence(bson.M{
+		"$set": bson.M{"status": "Approved"},
+		"$inc": bson.M{"reminders": 1},
+	})
+	inc := update["$inc"].(bson.M)
+	if inc["sequence"] != 1 || inc["reminders"] != 1 {
+		t.Fatalf("expected the sequence increment to be merged with the other increments, got %v", update)
+	}
+	if update["$set"].(bson.M)["status"] != "Approved" {
+		t.Fatalf("expected the update to be kept, got %v", update)
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	for email, expected := range map[string]string{
+		" steve@gmail.com ":                  "steve@gmail.com",
+		"Steve@Gmail.com":                    "Steve@Gmail.com",
+		"steve@gmail":                        "steve@gmail",
+		"steve.gmail.com":                    "",
+		"Steve <steve@gmail.com>":            "",
+		"steve@gmail.com, alex@a.b":          "",
+		"":                                   "",
+		"steve@" + types.ImportedEmailDomain: "",
+	} {
+		validated, err := db.ValidateEmail(email)
+		if validated != expected || (err == nil) != (expected != "") {
+			t.Errorf("Expected %q to be validated as %q, got %q %v", email, expected, validated, err)
+		}
+	}
+}
+
+func TestRequestQueryFilter(t *testing.T) {
+	if filter := (db.RequestQuery{}).Filter(); len(filter) != 0 {
+		t.Errorf("expected an empty query to match every request, got %v", filter)
+	}
+	onServer := true
+	from := time.Date(2019, 11, 1, 0, 0, 0, 0, time.UTC)
+	filter := db.RequestQuery{
+		Status:   types.StatusApproved,
+		OnServer: &onServer,
+		Username: "st.e",
+		Email:    "Steve@gmail.com",
+		Assignee: "op1@gmail.com",
+		From:     from,
+	}.Filter()
+	if filter["status"] != types.StatusApproved || filter["processedAt"].(bson.M)["$exists"] != true {
+		t.Errorf("unexpected status filter %v", filter)
+	}
+	if username := filter["username"].(primitive.Regex); username.Pattern != `st\.e` || username.Options != "i" {
+		t.Errorf("expected usernames containing the search ignoring case, got %v", username)
+	}
+	if email := filter["email"].(primitive.Regex); email.Pattern != `^Steve@gmail\.com$` {
+		t.Errorf("expected the exact email ignoring case, got %v", email)
+	}
+	if timestamp := filter["timestamp"].(bson.M); timestamp["$gte"] != from || timestamp["$lt"] != nil {
+		t.Errorf("expected requests submitted from the date, got %v", timestamp)
+	}
+}
+
+func TestParseRequestSort(t *testing.T) {
+	sort, err := db.ParseRequestSort("")
+	if err != nil || sort[0].Key != "timestamp" || sort[0].Value != -1 || sort[1].Key != "_id" {
+		t.Errorf("expected the most recent requests first by default, got %v %v", sort, err)
+	}
+	sort, err = db.ParseRequestSort("username")
+	if err != nil || sort[0].Key != "username" || sort[0].Value != 1 {
+		t.Errorf("expected requests sorted by username, got %v %v", sort, err)
+	}
+	if _, err := db.ParseRequestSort("-email"); err == nil {
+		t.Error("expected an error for an unknown sort field")
+	}
+}
+
+func TestErasure(t *testing.T) {
+	id := primitive.NewObjectID()
+	now := time.Now()
+	update := db.Erasure(id, now)
+	set := update["$set"].(bson.M)
+	if set["email"] != db.ErasedEmail(id) || !types.PlaceholderEmail(set["email"].(string)) || set["erasedAt"] != now {
+		t.Errorf("expected the email to be replaced by a placeholder, got %v", set)
+	}
+	for _, field := range []string{"username", "status", "timestamp", "processedTimestamp"} {
+		if _, ok := set[field]; ok {
+			t.Errorf("expected %s to be kept, got %v", field, set)
+		}
+	}
+	unset := update["$unset"].(bson.M)
+	for _, field := range []string{"info", "answers", "submissionIp", "submissionIpPrefix", "attachments", "comments",
+		"submissionCountry", "networkSignals", "messageIds", "emailBounceReason"} {
+		if _, ok := unset[field]; !ok {
+			t.Errorf("expected %s to be erased, got %v", field, unset)
+		}
+	}
+	if db.ErasedEmail(id) == db.ErasedEmail(primitive.NewObjectID()) {
+		t.Error("expected the placeholder to be unique to the request")
+	}
+	if _, err := db.ValidateEmail(db.ErasedEmail(id)); err != db.ErrInvalidEmail {
+		t.Errorf("expected the placeholder not to be a valid email, got %v", err)
+	}
+}
+
+func TestDeletable(t *testing.T) {
+	for status, deletable := range map[string]bool{
+		types.StatusDenied:      true,
+		types.StatusExpired:     true,
+		types.StatusCancelled:   true,
+		types.StatusPending:     false,
+		types.StatusApproved:    false,
+		types.StatusDeactivated: false,
+		types.StatusBanned:      false,
+	} {
+		if db.Deletable(types.WhitelistRequest{Status: status}) != deletable {
+			t.Errorf("expected %s requests to be deletable: %v", status, deletable)
+		}
+	}
+}
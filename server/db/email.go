@@ -0,0 +1,76 @@
+package db
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	// ErrInvalidEmail is returned for addresses emails can not be sent to
+	ErrInvalidEmail = errors.New("Invalid email address")
+	// ErrEmailInUse is returned if another active request of the tenant has the address, which would make the
+	// requests duplicates of each other
+	ErrEmailInUse = errors.New("Another active request uses this email address")
+)
+
+// Statuses of requests that count as duplicates of new requests with the same username or email
+var activeStatuses = []string{types.StatusPending, types.StatusDisputed, types.StatusApproved, types.StatusWaitlisted, types.StatusBanned}
+
+// ValidateEmail returns the address trimmed, or ErrInvalidEmail unless it is a plain email address. The
+// placeholder addresses of imported and erased requests are not valid
+func ValidateEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || types.PlaceholderEmail(email) {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+// CorrectRequestEmail replaces the email of a pending or decided request, e.g an address the applicant
+// typo'd, and returns the corrected request. Returns ErrInvalidEmail for invalid addresses, ErrEmailInUse if the
+// request is active and another active request of its tenant has the address, and mongo.ErrNoDocuments if the
+// request is neither pending nor decided
+func (s *Service) CorrectRequestEmail(request types.WhitelistRequest, email string) (types.WhitelistRequest, error) {
+	email, err := ValidateEmail(email)
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	active := false
+	for _, status := range activeStatuses {
+		active = active || request.Status == status
+	}
+	if active {
+		duplicates, err := s.GetRequests(1, InTenant(bson.M{
+			"_id":    bson.M{"$ne": request.ID},
+			"email":  caseInsensitive(email),
+			"status": bson.M{"$in": activeStatuses},
+		}, request.ServerID))
+		if err != nil {
+			return types.WhitelistRequest{}, err
+		}
+		if len(duplicates) > 0 {
+			return types.WhitelistRequest{}, ErrEmailInUse
+		}
+	}
+	correctedRequest, err := s.ConditionalUpdateRequest(bson.M{
+		"_id": request.ID,
+		"status": bson.M{"$in": []string{
+			types.StatusPending, types.StatusDisputed, types.StatusApproved, types.StatusWaitlisted, types.StatusDenied,
+			types.StatusBanned,
+		}},
+	}, bson.M{
+		"$set": bson.M{"email": email},
+		// The corrected address is emailed again
+		"$unset": bson.M{"emailUndeliverable": "", "emailBounceReason": ""},
+	})
+	if IsDuplicateKeyError(err) {
+		// Another pending request with the address got created concurrently
+		return types.WhitelistRequest{}, ErrEmailInUse
+	}
+	return correctedRequest, err
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Statuses of requests that never got approved. They may be deleted instead of anonymized
+var unapprovedStatuses = []string{types.StatusDenied, types.StatusExpired, types.StatusCancelled}
+
+// Details of the audit entries of requests holding personal data, e.g the reason told to the applicant or the
+// addresses emails were sent to
+var personalAuditDetails = []string{"decisionReason", "comment", "email", "oldEmail", "newEmail", "resent", "reason"}
+
+// ErasedEmail returns the placeholder replacing the email of an erased request. It is unique to the request so
+// erased requests never count as duplicates of each other
+func ErasedEmail(id primitive.ObjectID) string {
+	return id.Hex() + "@" + types.ErasedEmailDomain
+}
+
+// Deletable tells if the request never got approved, so it may be deleted instead of anonymized
+func Deletable(request types.WhitelistRequest) bool {
+	for _, status := range unapprovedStatuses {
+		if request.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Erasure returns the update anonymizing the personal data of the request: its email, the answers of the
+// application form, the notes, reasons and comments of ops, the submission address with the country and network
+// signals derived from it, the Message-IDs and bounce reason of the emails sent to it and the keys of its
+// attachments, whose files are deleted by the caller. The username, the status and the timestamps are kept for
+// the whitelist and the stats
+func Erasure(id primitive.ObjectID, now time.Time) bson.M {
+	return bson.M{
+		"$set": bson.M{
+			"email":    ErasedEmail(id),
+			"age":      0,
+			"gender":   "",
+			"note":     "",
+			"erasedAt": now,
+		},
+		"$unset": bson.M{
+			"info":               "",
+			"answers":            "",
+			"decisionReason":     "",
+			"submissionIp":       "",
+			"submissionIpPrefix": "",
+			"submissionIpHashed": "",
+			"submissionCountry":  "",
+			"networkSignals":     "",
+			"attachments":        "",
+			"comments":           "",
+			"messageIds":         "",
+			"emailBounceReason":  "",
+		},
+	}
+}
+
+// FindRequestsOfEmail query for the requests of every tenant with the email, ignoring case
+func (s *Service) FindRequestsOfEmail(email string) ([]types.WhitelistRequest, error) {
+	return s.GetRequests(-1, bson.M{"email": caseInsensitive(email)})
+}
+
+// EraseRequest anonymizes the personal data of the request, see Erasure, the address kept by its failed
+// notifications and the personal data recorded in the details of its audit entries. The address is no longer
+// suppressed once no request has it, see releaseSuppression. Returns mongo.ErrNoDocuments if the request does
+// not exist
+func (s *Service) EraseRequest(id primitive.ObjectID, now time.Time) (types.WhitelistRequest, error) {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	var request types.WhitelistRequest
+	err := collection.FindOne(s.baseContext(), bson.M{"_id": id}).Decode(&request)
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	erasedRequest, err := s.ConditionalUpdateRequest(bson.M{"_id": id}, Erasure(id, now))
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	notifications := s.db.Database("mc-whitelist").Collection("failedNotifications")
+	_, err = notifications.UpdateMany(s.baseContext(), bson.M{"requestId": id}, bson.M{
+		"$set": bson.M{"email": erasedRequest.Email},
+	})
+	if err != nil {
+		return erasedRequest, err
+	}
+	err = s.redactAuditEntries(id)
+	if err != nil {
+		return erasedRequest, err
+	}
+	return erasedRequest, s.releaseSuppression(request.Email)
+}
+
+// redactAuditEntries removes the personal data from the details of the audit entries of the request. What was
+// done to the request and by whom is kept. Signed entries are left as they are, they do not record personal data
+func (s *Service) redactAuditEntries(id primitive.ObjectID) error {
+	unset := bson.M{}
+	for _, field := range personalAuditDetails {
+		unset["details."+field] = ""
+	}
+	collection := s.db.Database("mc-whitelist").Collection("audit")
+	_, err := collection.UpdateMany(s.baseContext(), bson.M{
+		"details.requestId": id.Hex(),
+		"signature":         bson.M{"$exists": false},
+	}, bson.M{"$unset": unset})
+	return err
+}
+
+// releaseSuppression deletes the suppression of the address of an erased request, so the address is not kept
+// once no request has it anymore. The suppression still applies to the other requests of the address otherwise
+func (s *Service) releaseSuppression(email string) error {
+	if email == "" || types.PlaceholderEmail(email) {
+		return nil
+	}
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	count, err := collection.CountDocuments(s.baseContext(), bson.M{"email": caseInsensitive(email)})
+	if err != nil || count > 0 {
+		return err
+	}
+	suppressions := s.db.Database("mc-whitelist").Collection("emailSuppressions")
+	_, err = suppressions.DeleteOne(s.baseContext(), bson.M{"_id": strings.ToLower(email)})
+	return err
+}
+
+// DeleteUnapprovedRequest deletes the request with its failed notifications if it never got approved, and
+// erases the details of its audit entries and the suppression of its address like EraseRequest. Returns mongo.ErrNoDocuments if the request does not exist or
+// got approved
+func (s *Service) DeleteUnapprovedRequest(id primitive.ObjectID) error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	var request types.WhitelistRequest
+	err := collection.FindOneAndDelete(s.baseContext(), bson.M{
+		"_id":    id,
+		"status": bson.M{"$in": unapprovedStatuses},
+	}).Decode(&request)
+	if err != nil {
+		return err
+	}
+	notifications := s.db.Database("mc-whitelist").Collection("failedNotifications")
+	_, err = notifications.DeleteMany(s.baseContext(), bson.M{"requestId": id})
+	if err != nil {
+		return err
+	}
+	err = s.redactAuditEntries(id)
+	if err != nil {
+		return err
+	}
+	return s.releaseSuppression(request.Email)
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Formats requests can be exported in
+const (
+	ExportFormatCSV       = "csv"
+	ExportFormatJSONLines = "jsonl"
+)
+
+// Requests are fetched from the cursor in batches of this size so exports never hold all requests in memory
+const exportBatchSize = 500
+
+// ExportColumns are the columns requests can be exported with
+var ExportColumns = []string{
+	"id", "username", "email", "status", "age", "gender", "locale", "timestamp", "processedTimestamp",
+	"lastUpdatedTimestamp", "admin", "assignees", "decisionReason", "expiresAt", "importedAt",
+	"comments",
+}
+
+// DefaultExportColumns are exported if no columns are selected
+var DefaultExportColumns = []string{"id", "username", "email", "status", "timestamp", "processedTimestamp", "admin", "assignees"}
+
+// ExportOptions select how requests are exported
+type ExportOptions struct {
+	Format  string
+	Columns []string
+	// Redact masks the email addresses, e.g to share the export outside the admin team
+	Redact bool
+}
+
+// Validate checks the format and the columns, and selects the default columns if none are selected
+func (o *ExportOptions) Validate() error {
+	if o.Format != ExportFormatCSV && o.Format != ExportFormatJSONLines {
+		return fmt.Errorf("Unknown export format %q. Allowed values: [%s, %s]", o.Format, ExportFormatCSV, ExportFormatJSONLines)
+	}
+	if len(o.Columns) == 0 {
+		o.Columns = DefaultExportColumns
+	}
+	for _, column := range o.Columns {
+		if !isExportColumn(column) {
+			return fmt.Errorf("Unknown export column %q. Allowed values: %v", column, ExportColumns)
+		}
+	}
+	return nil
+}
+
+func isExportColumn(column string) bool {
+	for _, c := range ExportColumns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportRequests streams the requests matching the filter to w, oldest first, and returns the number of
+// requests exported. Canary requests are never exported
+func (s *Service) ExportRequests(w io.Writer, filter interface{}, opts ExportOptions) (int64, error) {
+	exporter, err := NewRequestExporter(w, opts)
+	if err != nil {
+		return 0, err
+	}
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	findOptions := options.Find().SetSort(map[string]int{"timestamp": 1}).SetBatchSize(exportBatchSize)
+	cur, err := collection.Find(s.baseContext(), ExcludeCanaries(filter), findOptions)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(s.baseContext())
+	var count int64
+	for cur.Next(s.baseContext()) {
+		var request types.WhitelistRequest
+		err = cur.Decode(&request)
+		if err != nil {
+			return count, err
+		}
+		err = exporter.Write(request)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err = cur.Err(); err != nil {
+		return count, err
+	}
+	return count, exporter.Flush()
+}
+
+// RequestExporter writes requests one at a time in the format and with the columns of the export options
+type RequestExporter struct {
+	opts       ExportOptions
+	csvWriter  *csv.Writer
+	jsonWriter *json.Encoder
+	started    bool
+}
+
+// NewRequestExporter creates an exporter writing to w. The options are validated first
+func NewRequestExporter(w io.Writer, opts ExportOptions) (*RequestExporter, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+	exporter := &RequestExporter{opts: opts}
+	if opts.Format == ExportFormatCSV {
+		exporter.csvWriter = csv.NewWriter(w)
+	} else {
+		exporter.jsonWriter = json.NewEncoder(w)
+	}
+	return exporter, nil
+}
+
+// Write writes the request, preceded by the header if it is the first request of a CSV export
+func (e *RequestExporter) Write(request types.WhitelistRequest) error {
+	if e.csvWriter == nil {
+		row := make(map[string]interface{}, len(e.opts.Columns))
+		for _, column := range e.opts.Columns {
+			row[column] = exportValue(request, column, e.opts.Redact)
+		}
+		return e.jsonWriter.Encode(row)
+	}
+	if !e.started {
+		e.started = true
+		err := e.csvWriter.Write(e.opts.Columns)
+		if err != nil {
+			return err
+		}
+	}
+	record := make([]string, len(e.opts.Columns))
+	for i, column := range e.opts.Columns {
+		record[i] = csvValue(exportValue(request, column, e.opts.Redact))
+	}
+	return e.csvWriter.Write(record)
+}
+
+// Flush writes any buffered data. The header is written for CSV exports without requests
+func (e *RequestExporter) Flush() error {
+	if e.csvWriter == nil {
+		return nil
+	}
+	if !e.started {
+		e.started = true
+		e.csvWriter.Write(e.opts.Columns)
+	}
+	e.csvWriter.Flush()
+	return e.csvWriter.Error()
+}
+
+func exportValue(request types.WhitelistRequest, column string, redact bool) interface{} {
+	switch column {
+	case "id":
+		return request.ID.Hex()
+	case "username":
+		return request.Username
+	case "email":
+		if redact {
+			return MaskEmail(request.Email)
+		}
+		return request.Email
+	case "status":
+		return request.Status
+	case "age":
+		return request.Age
+	case "gender":
+		return request.Gender
+	case "locale":
+		return request.Locale
+	case "timestamp":
+		return exportTime(request.Timestamp)
+	case "processedTimestamp":
+		return exportTime(request.ProcessedTimestamp)
+	case "lastUpdatedTimestamp":
+		return exportTime(request.LastUpdatedTimestamp)
+	case "admin":
+		return request.Admin
+	case "assignees":
+		if request.Assignees == nil {
+			return []string{}
+		}
+		return request.Assignees
+	case "decisionReason":
+		return request.DecisionReason
+	case "expiresAt":
+		if request.ExpiresAt == nil {
+			return ""
+		}
+		return exportTime(*request.ExpiresAt)
+	case "importedAt":
+		if request.ImportedAt == nil {
+			return ""
+		}
+		return exportTime(*request.ImportedAt)
+	case "comments":
+		comments := make([]types.Comment, 0, len(request.Comments))
+		for _, comment := range request.Comments {
+			if redact {
+				comment.Author = MaskEmail(comment.Author)
+			}
+			comments = append(comments, comment)
+		}
+		return comments
+	}
+	return nil
+}
+
+// Unset times are exported empty
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case []string:
+		return strings.Join(v, ";")
+	case []types.Comment:
+		// One comment per line, as comments may contain the separator of lists
+		lines := make([]string, len(v))
+		for i, comment := range v {
+			lines[i] = exportTime(comment.Timestamp) + " " + comment.Author + ": " + comment.Text
+		}
+		return strings.Join(lines, "\n")
+	}
+	return fmt.Sprint(value)
+}
+
+// MaskEmail keeps the first character of the local part and the domain of the email, e.g s***@example.com
+func MaskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return "***"
+	}
+	return string([]rune(email)[0]) + "***" + email[at:]
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Actor of imported requests, recorded as their admin
+const importActor = "import"
+
+// ImportSummary lists the names of the entries of a whitelist import by outcome
+type ImportSummary struct {
+	Created []string `json:"created"`
+	Skipped []string `json:"skipped"`
+	Failed  []string `json:"failed"`
+}
+
+// ImportWhitelist creates an approved request for every entry of an existing whitelist whose name has
+// no request yet, ignoring case. Nothing is published so the players are neither emailed nor whitelisted
+// again. The cache is not updated, sync the stats once the import is done
+func (s *Service) ImportWhitelist(entries []types.WhitelistEntry) ImportSummary {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	summary := ImportSummary{Created: []string{}, Skipped: []string{}, Failed: []string{}}
+	seen := make(map[string]bool)
+	importedAt := time.Now()
+	for _, entry := range entries {
+		name := strings.TrimSpace(entry.Name)
+		if name == "" {
+			summary.Failed = append(summary.Failed, entry.UUID)
+			continue
+		}
+		if seen[strings.ToLower(name)] {
+			summary.Skipped = append(summary.Skipped, name)
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		existing, err := s.GetRequests(-1, bson.M{"username": caseInsensitive(name)})
+		if err != nil {
+			summary.Failed = append(summary.Failed, name)
+			continue
+		}
+		if len(existing) > 0 {
+			summary.Skipped = append(summary.Skipped, name)
+			continue
+		}
+		_, err = collection.InsertOne(s.baseContext(), ImportedRequest(entry, importedAt))
+		if err != nil {
+			summary.Failed = append(summary.Failed, name)
+			continue
+		}
+		summary.Created = append(summary.Created, name)
+	}
+	return summary
+}
+
+// ImportedRequest returns the approved request of a player imported from an existing whitelist
+func ImportedRequest(entry types.WhitelistEntry, importedAt time.Time) types.WhitelistRequest {
+	name := strings.TrimSpace(entry.Name)
+	return types.WhitelistRequest{
+		ID:                   primitive.NewObjectID(),
+		Username:             name,
+		Email:                strings.ToLower(name) + "@" + types.ImportedEmailDomain,
+		Status:               types.StatusApproved,
+		Timestamp:            importedAt,
+		ProcessedTimestamp:   importedAt,
+		LastUpdatedTimestamp: importedAt,
+		Admin:                importActor,
+		// Already on the whitelist of the game server, so the recovery pass does not whitelist them again
+		OnserverStatus: types.OnserverWhitelisted,
+		UUID:           strings.Replace(entry.UUID, "-", "", -1),
+		ImportedAt:     &importedAt,
+	}
+}
+
+// BackfillImportedOnserverStatus records the requests imported before their state on the game server was recorded
+// on import as whitelisted, and returns their number. Only approved requests are backfilled, later decisions
+// record their own state
+func (s *Service) BackfillImportedOnserverStatus() (int64, error) {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	result, err := collection.UpdateMany(s.baseContext(), bson.M{
+		"importedAt":     bson.M{"$exists": true},
+		"status":         types.StatusApproved,
+		"onserverStatus": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"onserverStatus": types.OnserverWhitelisted}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WithDecidedAt adds the time of the decision to the update. Only the first decision is kept, so deciding
+// again, e.g approving a deactivated player, does not skew the decision latency
+func WithDecidedAt(update bson.M, decidedAt time.Time) bson.M {
+	min, ok := update["$min"].(bson.M)
+	if !ok {
+		min = bson.M{}
+	}
+	min["decidedAt"] = decidedAt
+	update["$min"] = min
+	return update
+}
+
+// MarkRequestProcessed records when the worker carried out the decision on the request. Only the first
+// time is kept, like the decision time
+func (s *Service) MarkRequestProcessed(id primitive.ObjectID, processedAt time.Time) error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	_, err := collection.UpdateOne(s.baseContext(), bson.M{"_id": id}, bson.M{
+		"$min": bson.M{"processedAt": processedAt},
+	})
+	return err
+}
+
+// RecordResponseTime records the op who decided the request and their response time. Only the first decision
+// is kept, like the decision time
+func (s *Service) RecordResponseTime(id primitive.ObjectID, op string, minutes float64) error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	_, err := collection.UpdateOne(s.baseContext(), bson.M{
+		"_id":                   id,
+		"responseTimeInMinutes": bson.M{"$exists": false},
+	}, bson.M{
+		"$set": bson.M{"respondedBy": op, "responseTimeInMinutes": minutes},
+	})
+	return err
+}
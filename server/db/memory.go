@@ -0,0 +1,465 @@
+package db
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore is a Store keeping the requests in memory, e.g to test handlers and the worker without MongoDB
+type MemoryStore struct {
+	mu       sync.Mutex
+	requests map[primitive.ObjectID]types.WhitelistRequest
+	outbox   []types.OutboxEntry
+}
+
+// NewMemoryStore returns an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{requests: make(map[primitive.ObjectID]types.WhitelistRequest)}
+}
+
+func (s *MemoryStore) CreateRequest(request types.WhitelistRequest) (primitive.ObjectID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request.ID = primitive.NewObjectID()
+	request.Timestamp = time.Now()
+	request.SubmittedAt = &request.Timestamp
+	request.Status = types.StatusPending
+	s.requests[request.ID] = request
+	return request.ID, nil
+}
+
+func (s *MemoryStore) GetRequest(id primitive.ObjectID) (types.WhitelistRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request, ok := s.requests[id]
+	if !ok {
+		return types.WhitelistRequest{}, ErrNotFound
+	}
+	return request, nil
+}
+
+func (s *MemoryStore) QueryRequests(filter RequestFilter) ([]types.WhitelistRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := make([]types.WhitelistRequest, 0)
+	for _, request := range s.requests {
+		if !request.Canary && filter.matches(request) {
+			requests = append(requests, request)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Timestamp.After(requests[j].Timestamp)
+	})
+	if filter.Limit > 0 && int64(len(requests)) > filter.Limit {
+		requests = requests[:filter.Limit]
+	}
+	return requests, nil
+}
+
+func (s *MemoryStore) CountAssignments(filter RequestFilter) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assignments := make(map[string]int)
+	for _, request := range s.requests {
+		if request.Canary || !filter.matches(request) {
+			continue
+		}
+		for _, op := range request.Assignees {
+			assignments[op]++
+		}
+	}
+	return assignments, nil
+}
+
+// matches tells if the request is selected by the filter, like the MongoDB filter of bson
+func (f RequestFilter) matches(request types.WhitelistRequest) bool {
+	if len(f.Statuses) > 0 && !contains(f.Statuses, request.Status) {
+		return false
+	}
+	if len(f.Tenants) > 0 && !contains(f.Tenants, request.ServerID) {
+		return false
+	}
+	username := f.Username != "" && strings.EqualFold(request.Username, f.Username)
+	email := f.Email != "" && strings.EqualFold(request.Email, f.Email)
+	if (f.Username != "" || f.Email != "") && !username && !email {
+		return false
+	}
+	if !f.SubmittedBefore.IsZero() && request.Timestamp.After(f.SubmittedBefore) {
+		return false
+	}
+	if !f.DecidedAfter.IsZero() && !request.ProcessedTimestamp.After(f.DecidedAfter) {
+		return false
+	}
+	if !f.DecidedBefore.IsZero() && request.ProcessedTimestamp.After(f.DecidedBefore) {
+		return false
+	}
+	if !f.BeforeID.IsZero() && request.ID.Hex() >= f.BeforeID.Hex() {
+		return false
+	}
+	if (f.ExcludeAwaitingOps && request.AwaitingOps) || (f.OnlyAwaitingOps && !request.AwaitingOps) {
+		return false
+	}
+	if f.Assigned && len(request.Assignees) == 0 {
+		return false
+	}
+	if !f.ExpiresBefore.IsZero() && (request.ExpiresAt == nil || request.ExpiresAt.After(f.ExpiresBefore)) {
+		return false
+	}
+	if f.BatchID != "" && request.BatchID != f.BatchID {
+		return false
+	}
+	if f.NotEscalated && request.Escalated {
+		return false
+	}
+	if !f.DigestedBefore.IsZero() && (request.DigestedAt == nil || request.DigestedAt.After(f.DigestedBefore)) {
+		return false
+	}
+	if !f.NotDigestedSince.IsZero() && digestedSince(request, f.NotDigestedSince) {
+		return false
+	}
+	if !f.SLANotifiedBefore.IsZero() && request.SLANotifiedAt != nil && request.SLANotifiedAt.After(f.SLANotifiedBefore) {
+		return false
+	}
+	if !f.ReviewDueBefore.IsZero() && (!request.Provisional || request.ReviewAt == nil || request.ReviewAt.After(f.ReviewDueBefore)) {
+		return false
+	}
+	if f.FollowUp && (request.FollowUp == nil || request.FollowUp.DismissedAt != nil) {
+		return false
+	}
+	if f.SubmissionIPPrefix != "" && request.SubmissionIPPrefix != f.SubmissionIPPrefix {
+		return false
+	}
+	if !f.ExcludeID.IsZero() && request.ID == f.ExcludeID {
+		return false
+	}
+	if f.NotBench && request.Bench != "" {
+		return false
+	}
+	return !f.NotReviewReminded || !request.ReviewReminded
+}
+
+func digestedSince(request types.WhitelistRequest, since time.Time) bool {
+	return request.LastDigestedAt != nil && !request.LastDigestedAt.Before(since)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) DeleteRequest(id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.requests, id)
+	return nil
+}
+
+func (s *MemoryStore) AddAssignees(id primitive.ObjectID, ops []string, dispatchedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request, ok := s.requests[id]
+	if !ok {
+		return ErrNotFound
+	}
+	// Copied, so requests returned earlier are not changed
+	assignees := append([]string{}, request.Assignees...)
+	dispatches := append([]types.Dispatch{}, request.Dispatches...)
+	for _, op := range ops {
+		if !contains(assignees, op) {
+			assignees = append(assignees, op)
+		}
+		dispatches = append(dispatches, types.Dispatch{Op: op, Timestamp: dispatchedAt})
+	}
+	request.Assignees, request.Dispatches = assignees, dispatches
+	s.requests[id] = request
+	return nil
+}
+
+func (s *MemoryStore) SetOnserverStatus(id primitive.ObjectID, status string, sequence int64, onserverStatus string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request, ok := s.requests[id]
+	if !ok || request.Status != status || (sequence > 0 && request.Sequence > sequence) {
+		return nil
+	}
+	request.OnserverStatus = onserverStatus
+	s.requests[id] = request
+	return nil
+}
+
+func (s *MemoryStore) TransitionStatus(id primitive.ObjectID, change StatusChange) (types.WhitelistRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.transitionStatus(id, change)
+}
+
+func (s *MemoryStore) TransitionStatusWithTask(id primitive.ObjectID, change StatusChange) (types.WhitelistRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request, err := s.transitionStatus(id, change)
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	request.PreviousStatus = change.From
+	body, err := types.EncodeRequestMessage(request)
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	s.outbox = append(s.outbox, types.OutboxEntry{
+		ID:        primitive.NewObjectID(),
+		RequestID: request.ID,
+		Sequence:  request.Sequence,
+		Body:      body,
+		CreatedAt: time.Now(),
+	})
+	return request, nil
+}
+
+// Outbox returns the tasks written to the outbox with their changes, oldest first
+func (s *MemoryStore) Outbox() []types.OutboxEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]types.OutboxEntry(nil), s.outbox...)
+}
+
+// transitionStatus applies the change to the request while the store is locked
+func (s *MemoryStore) transitionStatus(id primitive.ObjectID, change StatusChange) (types.WhitelistRequest, error) {
+	request, ok := s.requests[id]
+	if !ok || request.Status != change.From {
+		return types.WhitelistRequest{}, ErrConflict
+	}
+	request.Status = change.To
+	request.LastUpdatedTimestamp = change.At
+	request.Sequence++
+	if change.decision() {
+		request.Admin = change.Admin
+		request.ProcessedTimestamp = change.At
+		if change.Reason != "" {
+			request.DecisionReason = change.Reason
+		}
+		if request.DecidedAt == nil || change.At.Before(*request.DecidedAt) {
+			decidedAt := change.At
+			request.DecidedAt = &decidedAt
+		}
+	}
+	s.requests[id] = request
+	return request, nil
+}
+
+func (s *MemoryStore) SetAwaitingOps(id primitive.ObjectID, awaiting bool) (types.WhitelistRequest, error) {
+	return s.claim(id, func(request *types.WhitelistRequest) bool {
+		if request.Status != types.StatusPending || request.AwaitingOps == awaiting {
+			return false
+		}
+		request.AwaitingOps = awaiting
+		return true
+	})
+}
+
+func (s *MemoryStore) ReplaceAssignees(id primitive.ObjectID, assignees, replacement []string) error {
+	_, err := s.claim(id, func(request *types.WhitelistRequest) bool {
+		if request.Status != types.StatusPending || !equalStrings(request.Assignees, assignees) {
+			return false
+		}
+		request.Assignees = append([]string{}, replacement...)
+		return true
+	})
+	return err
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *MemoryStore) ClaimEscalation(id primitive.ObjectID, at time.Time) error {
+	_, err := s.claim(id, func(request *types.WhitelistRequest) bool {
+		if request.Status != types.StatusPending || request.Escalated {
+			return false
+		}
+		request.Escalated = true
+		request.EscalatedTimestamp = at
+		return true
+	})
+	return err
+}
+
+func (s *MemoryStore) ClaimDigest(id primitive.ObjectID, since, at time.Time) error {
+	_, err := s.claim(id, func(request *types.WhitelistRequest) bool {
+		if request.Status != types.StatusPending || digestedSince(*request, since) {
+			return false
+		}
+		lastDigestedAt := at
+		request.LastDigestedAt = &lastDigestedAt
+		if request.DigestedAt == nil || at.Before(*request.DigestedAt) {
+			digestedAt := at
+			request.DigestedAt = &digestedAt
+		}
+		return true
+	})
+	return err
+}
+
+func (s *MemoryStore) ClaimSLANotification(id primitive.ObjectID, notifiedBefore, at time.Time) error {
+	_, err := s.claim(id, func(request *types.WhitelistRequest) bool {
+		if request.Status != types.StatusPending || (request.SLANotifiedAt != nil && request.SLANotifiedAt.After(notifiedBefore)) {
+			return false
+		}
+		notifiedAt := at
+		request.SLANotifiedAt = &notifiedAt
+		return true
+	})
+	return err
+}
+
+func (s *MemoryStore) SetReviewReminded(id primitive.ObjectID, reminded bool) error {
+	_, err := s.claim(id, func(request *types.WhitelistRequest) bool {
+		if request.Status != types.StatusApproved || !request.Provisional || request.ReviewReminded == reminded {
+			return false
+		}
+		request.ReviewReminded = reminded
+		return true
+	})
+	return err
+}
+
+func (s *MemoryStore) RecordFirstJoins(serverID string, usernames []string, at time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var recorded int64
+	for id, request := range s.requests {
+		if request.Status != types.StatusApproved || request.ServerID != serverID || request.FirstJoinedAt != nil {
+			continue
+		}
+		for _, username := range usernames {
+			if strings.EqualFold(request.Username, username) {
+				joinedAt := at
+				request.FirstJoinedAt = &joinedAt
+				s.requests[id] = request
+				recorded++
+				break
+			}
+		}
+	}
+	return recorded, nil
+}
+
+func (s *MemoryStore) SetFollowUp(id primitive.ObjectID, followUp *types.FollowUp) error {
+	_, err := s.claim(id, func(request *types.WhitelistRequest) bool {
+		if request.Status != types.StatusApproved {
+			return false
+		}
+		request.FollowUp = nil
+		if followUp != nil {
+			copied := *followUp
+			request.FollowUp = &copied
+		}
+		return true
+	})
+	return err
+}
+
+func (s *MemoryStore) StuckRequests(since, before time.Time) ([]types.WhitelistRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := make([]types.WhitelistRequest, 0)
+	for _, request := range s.requests {
+		if !request.Canary && stuck(request, since, before) {
+			requests = append(requests, request)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Timestamp.After(requests[j].Timestamp)
+	})
+	return requests, nil
+}
+
+// stuck tells if the request is matched by StuckRequestsFilter
+func stuck(request types.WhitelistRequest, since, before time.Time) bool {
+	if request.LastUpdatedTimestamp.Before(since) || !request.LastUpdatedTimestamp.Before(before) ||
+		request.Bench != "" || request.ImportedAt != nil {
+		return false
+	}
+	switch request.Status {
+	case types.StatusApproved:
+		return request.OnserverStatus != types.OnserverWhitelisted
+	case types.StatusBanned:
+		return request.OnserverStatus != types.OnserverBanned
+	case types.StatusDeactivated:
+		return request.OnserverStatus == types.OnserverWhitelisted
+	}
+	return false
+}
+
+func (s *MemoryStore) SetNetworkSignals(id primitive.ObjectID, signals types.NetworkSignals) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request, ok := s.requests[id]
+	if !ok {
+		return ErrNotFound
+	}
+	request.NetworkSignals = &signals
+	s.requests[id] = request
+	return nil
+}
+
+func (s *MemoryStore) SetReferral(id primitive.ObjectID, referral types.Referral) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request, ok := s.requests[id]
+	if !ok {
+		return ErrNotFound
+	}
+	request.Referral = &referral
+	if !referral.Verified() && !contains(request.Tags, types.TagUnverifiedReferrer) {
+		// Copied, so requests returned earlier are not changed
+		request.Tags = append(append([]string{}, request.Tags...), types.TagUnverifiedReferrer)
+	}
+	s.requests[id] = request
+	return nil
+}
+
+func (s *MemoryStore) CompleteCanary(id primitive.ObjectID, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request, ok := s.requests[id]
+	if !ok || !request.Canary {
+		return ErrNotFound
+	}
+	request.CanaryCompletedTimestamp = &at
+	s.requests[id] = request
+	return nil
+}
+
+func (s *MemoryStore) Ping(timeout time.Duration) error {
+	return nil
+}
+
+// claim applies the update to a copy of the request and stores it if the update applies. Returns ErrConflict
+// otherwise
+func (s *MemoryStore) claim(id primitive.ObjectID, update func(request *types.WhitelistRequest) bool) (types.WhitelistRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	request, ok := s.requests[id]
+	if !ok || !update(&request) {
+		return types.WhitelistRequest{}, ErrConflict
+	}
+	s.requests[id] = request
+	return request, nil
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RecordFailedNotification records a decision email the worker gave up sending, so an admin can resend it
+func (s *Service) RecordFailedNotification(notification types.FailedNotification) error {
+	collection := s.db.Database("mc-whitelist").Collection("failedNotifications")
+	notification.ID = primitive.NewObjectID()
+	if notification.Timestamp.IsZero() {
+		notification.Timestamp = time.Now()
+	}
+	_, err := collection.InsertOne(s.baseContext(), notification)
+	return err
+}
+
+// GetFailedNotification query for one failed notification by ID
+func (s *Service) GetFailedNotification(id primitive.ObjectID) (types.FailedNotification, error) {
+	collection := s.db.Database("mc-whitelist").Collection("failedNotifications")
+	var notification types.FailedNotification
+	err := collection.FindOne(s.baseContext(), bson.M{"_id": id}).Decode(&notification)
+	return notification, err
+}
+
+// GetFailedNotifications query for failed notifications, most recent first
+func (s *Service) GetFailedNotifications(limit int64, filter interface{}) ([]types.FailedNotification, error) {
+	collection := s.db.Database("mc-whitelist").Collection("failedNotifications")
+	opts := options.Find().SetSort(map[string]int{"timestamp": -1})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cur, err := collection.Find(s.baseContext(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	notifications := make([]types.FailedNotification, 0)
+	for cur.Next(s.baseContext()) {
+		var notification types.FailedNotification
+		err := cur.Decode(&notification)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications, nil
+}
+
+// MarkNotificationResent records when an admin resent the notification. A resend failing again is recorded
+// as a new failed notification
+func (s *Service) MarkNotificationResent(id primitive.ObjectID, resentAt time.Time) error {
+	collection := s.db.Database("mc-whitelist").Collection("failedNotifications")
+	_, err := collection.UpdateOne(s.baseContext(), bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"resentAt": resentAt},
+	})
+	return err
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GetOpProfiles query for the profiles of every op, ordered by email
+func (s *Service) GetOpProfiles() ([]types.OpProfile, error) {
+	collection := s.db.Database("mc-whitelist").Collection("opProfiles")
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cur, err := collection.Find(s.baseContext(), bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(s.baseContext())
+	profiles := make([]types.OpProfile, 0)
+	err = cur.All(s.baseContext(), &profiles)
+	return profiles, err
+}
+
+// GetOpProfile returns mongo.ErrNoDocuments if the op has no profile
+func (s *Service) GetOpProfile(email string) (types.OpProfile, error) {
+	collection := s.db.Database("mc-whitelist").Collection("opProfiles")
+	var profile types.OpProfile
+	err := collection.FindOne(s.baseContext(), bson.M{"_id": strings.ToLower(email)}).Decode(&profile)
+	return profile, err
+}
+
+// SetOpProfile stores the profile of the op, replacing the previous one
+func (s *Service) SetOpProfile(profile types.OpProfile) error {
+	collection := s.db.Database("mc-whitelist").Collection("opProfiles")
+	profile.Email = strings.ToLower(profile.Email)
+	_, err := collection.ReplaceOne(s.baseContext(), bson.M{"_id": profile.Email}, profile, options.Replace().SetUpsert(true))
+	return err
+}
+
+// RemoveOpProfile removes the op. Returns mongo.ErrNoDocuments if the op has no profile
+func (s *Service) RemoveOpProfile(email string) error {
+	collection := s.db.Database("mc-whitelist").Collection("opProfiles")
+	result, err := collection.DeleteOne(s.baseContext(), bson.M{"_id": strings.ToLower(email)})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// SeedOpProfiles stores the profiles if no profile is stored yet, so the ops config is migrated once and ops
+// removed by admins are not added back. Profiles stored concurrently by another instance are kept. Returns
+// whether the profiles were seeded
+func (s *Service) SeedOpProfiles(profiles []types.OpProfile) (bool, error) {
+	collection := s.db.Database("mc-whitelist").Collection("opProfiles")
+	count, err := collection.CountDocuments(s.baseContext(), bson.M{})
+	if err != nil || count > 0 {
+		return false, err
+	}
+	for _, profile := range profiles {
+		fields, err := bson.Marshal(profile)
+		if err != nil {
+			return false, err
+		}
+		var insert bson.M
+		if err := bson.Unmarshal(fields, &insert); err != nil {
+			return false, err
+		}
+		// The ID is taken from the filter on insert
+		delete(insert, "_id")
+		_, err = collection.UpdateOne(s.baseContext(), bson.M{"_id": strings.ToLower(profile.Email)},
+			bson.M{"$setOnInsert": insert}, options.Update().SetUpsert(true))
+		if err != nil {
+			return false, err
+		}
+	}
+	return len(profiles) > 0, nil
+}
@@ -0,0 +1,178 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Sent outbox entries are kept this long to investigate lost tasks, then removed by a TTL index
+const sentOutboxRetention = 24 * time.Hour
+
+// RequestWriter writes requests. Implemented by the Service and by Tx to write in a transaction
+type RequestWriter interface {
+	CreateRequest(newRequest types.WhitelistRequest) (primitive.ObjectID, error)
+	UpdateRequest(filter, update interface{}) (bson.M, error)
+	ConditionalUpdateRequest(filter, update interface{}) (types.WhitelistRequest, error)
+	TransitionStatus(id primitive.ObjectID, fromStatus, toStatus string, update bson.M) (types.WhitelistRequest, error)
+}
+
+// Tx writes requests and outbox entries in the transaction of a session, see WithTransaction
+type Tx struct {
+	s   *Service
+	ctx context.Context
+}
+
+// WithTransaction runs fn in a transaction committed once fn returns without error. fn is run again if the
+// transaction is aborted by a transient error, e.g a concurrent write to the same request.
+// Transactions require mongodb to run as a replica set
+func (s *Service) WithTransaction(fn func(tx Tx) error) error {
+	return s.db.UseSession(s.baseContext(), func(sessCtx mongo.SessionContext) error {
+		_, err := sessCtx.WithTransaction(sessCtx, func(txCtx mongo.SessionContext) (interface{}, error) {
+			return nil, fn(Tx{s: s, ctx: txCtx})
+		})
+		return err
+	})
+}
+
+// CreateRequest create new whitelistRequest in the transaction
+func (tx Tx) CreateRequest(newRequest types.WhitelistRequest) (primitive.ObjectID, error) {
+	return tx.s.createRequest(tx.ctx, newRequest)
+}
+
+// UpdateRequest perform partial update to the specified whitelistRequest in the transaction
+func (tx Tx) UpdateRequest(filter, update interface{}) (bson.M, error) {
+	return tx.s.updateRequest(tx.ctx, filter, update)
+}
+
+// ConditionalUpdateRequest atomically updates the request matching the filter in the transaction.
+// Returns mongo.ErrNoDocuments if no request matches
+func (tx Tx) ConditionalUpdateRequest(filter, update interface{}) (types.WhitelistRequest, error) {
+	return tx.s.conditionalUpdateRequest(tx.ctx, filter, update)
+}
+
+// AppendOutbox writes the task of the request to the outbox in the transaction, so it is published by the
+// outbox relay if and only if the change of the request is committed
+func (tx Tx) AppendOutbox(request types.WhitelistRequest) error {
+	body, err := types.EncodeRequestMessage(request)
+	if err != nil {
+		return err
+	}
+	collection := tx.s.db.Database("mc-whitelist").Collection("outbox")
+	_, err = collection.InsertOne(tx.ctx, types.OutboxEntry{
+		ID:        primitive.NewObjectID(),
+		RequestID: request.ID,
+		Sequence:  request.Sequence,
+		Body:      body,
+		CreatedAt: time.Now(),
+	})
+	return err
+}
+
+// ClaimOutboxEntry leases the oldest unsent outbox entry to the relay instance, skipping the entries of the given
+// requests. Entries whose lease expired, e.g as their relay stopped, are claimed again.
+// Returns mongo.ErrNoDocuments if there is no entry to claim
+func (s *Service) ClaimOutboxEntry(owner string, lease time.Duration, skip []primitive.ObjectID) (types.OutboxEntry, error) {
+	collection := s.db.Database("mc-whitelist").Collection("outbox")
+	now := time.Now()
+	filter := bson.M{
+		"sentAt":    bson.M{"$exists": false},
+		"requestId": bson.M{"$nin": skip},
+		"$or": []bson.M{
+			{"leaseUntil": bson.M{"$exists": false}},
+			{"leaseUntil": bson.M{"$lte": now}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{"leaseOwner": owner, "leaseUntil": now.Add(lease)},
+		"$inc": bson.M{"attempts": 1},
+	}
+	after := options.After
+	opt := options.FindOneAndUpdateOptions{
+		ReturnDocument: &after,
+		Sort:           bson.D{{Key: "createdAt", Value: 1}},
+	}
+	var entry types.OutboxEntry
+	err := collection.FindOneAndUpdate(s.baseContext(), filter, update, &opt).Decode(&entry)
+	return entry, err
+}
+
+// HasUnsentOutboxEntryBefore tells if an earlier entry of the same request is not sent yet. Entries are only
+// published once the entries before them are, so the tasks of a request are published in order
+func (s *Service) HasUnsentOutboxEntryBefore(entry types.OutboxEntry) (bool, error) {
+	collection := s.db.Database("mc-whitelist").Collection("outbox")
+	count, err := collection.CountDocuments(s.baseContext(), bson.M{
+		"requestId": entry.RequestID,
+		"sentAt":    bson.M{"$exists": false},
+		"_id":       bson.M{"$ne": entry.ID},
+		"$or": []bson.M{
+			{"sequence": bson.M{"$lt": entry.Sequence}},
+			// e.g requeued tasks keep the sequence of the request
+			{"sequence": entry.Sequence, "createdAt": bson.M{"$lt": entry.CreatedAt}},
+		},
+	})
+	return count > 0, err
+}
+
+// MarkOutboxEntrySent records that the publication of the entry was confirmed. Returns mongo.ErrNoDocuments
+// if the lease of the owner expired in the meantime, in which case the entry may be published again
+func (s *Service) MarkOutboxEntrySent(id primitive.ObjectID, owner string, sentAt time.Time) error {
+	collection := s.db.Database("mc-whitelist").Collection("outbox")
+	result, err := collection.UpdateOne(s.baseContext(), bson.M{"_id": id, "leaseOwner": owner}, bson.M{
+		"$set":   bson.M{"sentAt": sentAt},
+		"$unset": bson.M{"leaseOwner": "", "leaseUntil": ""},
+	})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// ReleaseOutboxEntry gives up the lease of the owner so the entry can be claimed again right away
+func (s *Service) ReleaseOutboxEntry(id primitive.ObjectID, owner string) error {
+	collection := s.db.Database("mc-whitelist").Collection("outbox")
+	_, err := collection.UpdateOne(s.baseContext(), bson.M{"_id": id, "leaseOwner": owner}, bson.M{
+		"$unset": bson.M{"leaseOwner": "", "leaseUntil": ""},
+	})
+	return err
+}
+
+// OutboxBacklog returns the number of unsent outbox entries and the creation time of the oldest one,
+// which is zero if every entry is sent
+func (s *Service) OutboxBacklog() (int64, time.Time, error) {
+	collection := s.db.Database("mc-whitelist").Collection("outbox")
+	unsent := bson.M{"sentAt": bson.M{"$exists": false}}
+	count, err := collection.CountDocuments(s.baseContext(), unsent)
+	if err != nil || count == 0 {
+		return 0, time.Time{}, err
+	}
+	var oldest types.OutboxEntry
+	err = collection.FindOne(s.baseContext(), unsent, options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: 1}})).Decode(&oldest)
+	if err != nil {
+		return count, time.Time{}, err
+	}
+	return count, oldest.CreatedAt, nil
+}
+
+// EnsureOutboxIndexes creates the indexes used by the outbox relay to claim entries and keep the tasks of
+// a request in order. Sent entries are removed after sentOutboxRetention
+func (s *Service) EnsureOutboxIndexes() error {
+	collection := s.db.Database("mc-whitelist").Collection("outbox")
+	_, err := collection.Indexes().CreateMany(s.baseContext(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "requestId", Value: 1}, {Key: "sequence", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "sentAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(sentOutboxRetention.Seconds())),
+		},
+	})
+	return err
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultRequestSort lists the most recently submitted requests first
+const DefaultRequestSort = "-timestamp"
+
+// Fields requests can be sorted by
+var requestSortFields = map[string]bool{
+	"timestamp":            true,
+	"lastUpdatedTimestamp": true,
+	"processedTimestamp":   true,
+	"username":             true,
+	"status":               true,
+}
+
+// RequestQuery selects the requests listed to admins. Empty fields match every request
+type RequestQuery struct {
+	Status string
+	// Requests whose decision has (true) or has not (false) been carried out on the game server
+	OnServer *bool
+	// Part of the username, ignoring case
+	Username string
+	// Email, ignoring case
+	Email string
+	// Op the request has been dispatched to, ignoring case
+	Assignee string
+	// Requests whose applicant can not be emailed as an email bounced
+	Undeliverable bool
+	// Requests flagged with the tag, e.g types.TagUnverifiedReferrer
+	Tag string
+	// Requests vouched for by the referrer, ignoring case
+	Referrer string
+	// Submitted from (inclusive) to (exclusive)
+	From time.Time
+	To   time.Time
+}
+
+// Filter returns the filter of the requests matching the query
+func (q RequestQuery) Filter() bson.M {
+	filter := bson.M{}
+	if q.Status != "" {
+		filter["status"] = q.Status
+	}
+	if q.OnServer != nil {
+		filter["processedAt"] = bson.M{"$exists": *q.OnServer}
+	}
+	if q.Username != "" {
+		filter["username"] = primitive.Regex{Pattern: regexp.QuoteMeta(q.Username), Options: "i"}
+	}
+	if q.Email != "" {
+		filter["email"] = caseInsensitive(q.Email)
+	}
+	if q.Assignee != "" {
+		filter["assignees"] = caseInsensitive(q.Assignee)
+	}
+	if q.Undeliverable {
+		filter["emailUndeliverable"] = true
+	}
+	if q.Tag != "" {
+		filter["tags"] = q.Tag
+	}
+	if q.Referrer != "" {
+		filter["referrerUsername"] = caseInsensitive(q.Referrer)
+	}
+	timestamp := bson.M{}
+	if !q.From.IsZero() {
+		timestamp["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		timestamp["$lt"] = q.To
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	return filter
+}
+
+// ParseRequestSort reads a sort of requests as a field name, prefixed with - for descending order.
+// Requests sorted the same are listed by ID, so pages never overlap
+func ParseRequestSort(value string) (bson.D, error) {
+	if value == "" {
+		value = DefaultRequestSort
+	}
+	field, order := value, 1
+	if strings.HasPrefix(value, "-") {
+		field, order = value[1:], -1
+	}
+	if !requestSortFields[field] {
+		return nil, fmt.Errorf("Unable to sort by %q. Sort by one of timestamp, lastUpdatedTimestamp, processedTimestamp, username, status", field)
+	}
+	return bson.D{{Key: field, Value: order}, {Key: "_id", Value: order}}, nil
+}
+
+// RequestsPage is a page of the requests matching a query
+type RequestsPage struct {
+	Requests []types.WhitelistRequest `json:"requests"`
+	// Number of requests matching the query
+	Total int64 `json:"total"`
+	// Page following this one, 0 on the last page
+	NextPage int64 `json:"nextPage,omitempty"`
+}
+
+// QueryRequests query for a page of the requests matching the filter, starting from page 1. Unlike GetRequests
+// only the requested page is read, for admins to search all requests
+func (s *Service) QueryRequests(filter interface{}, sort bson.D, page, pageSize int64) (RequestsPage, error) {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	filter = ExcludeCanaries(filter)
+	total, err := collection.CountDocuments(s.baseContext(), filter)
+	if err != nil {
+		return RequestsPage{}, err
+	}
+	opts := options.Find().SetSort(sort).SetSkip((page - 1) * pageSize).SetLimit(pageSize)
+	cur, err := collection.Find(s.baseContext(), filter, opts)
+	if err != nil {
+		return RequestsPage{}, err
+	}
+	defer cur.Close(s.baseContext())
+	result := RequestsPage{Requests: make([]types.WhitelistRequest, 0), Total: total}
+	for cur.Next(s.baseContext()) {
+		var request types.WhitelistRequest
+		err := cur.Decode(&request)
+		if err != nil {
+			return RequestsPage{}, err
+		}
+		result.Requests = append(result.Requests, request)
+	}
+	if page*pageSize < total {
+		result.NextPage = page + 1
+	}
+	return result, cur.Err()
+}
+
+// EnsureQueryIndexes creates the indexes used to list and search requests. Usernames are searched by
+// substring, which a text index does not support, so their index is scanned instead of the requests
+func (s *Service) EnsureQueryIndexes() error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	_, err := collection.Indexes().CreateMany(s.baseContext(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "lastUpdatedTimestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "decidedAt", Value: -1}}},
+		{Keys: bson.D{{Key: "assignees", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "username", Value: 1}}},
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+		// Prior requests of the network of new requests are shown to ops
+		{Keys: bson.D{{Key: "submissionIpPrefix", Value: 1}}},
+	})
+	return err
+}
+
+// EnsureIndexes creates the indexes of the collections if they do not exist yet, so fresh deployments do not
+// scan whole collections. Every index is attempted, the first failure is returned
+func (s *Service) EnsureIndexes() error {
+	var firstErr error
+	for _, ensure := range []struct {
+		name  string
+		apply func() error
+	}{
+		{"unique indexes of requests", s.EnsureRequestIndexes},
+		{"query indexes of requests", s.EnsureQueryIndexes},
+		{"indexes of the outbox", s.EnsureOutboxIndexes},
+		{"indexes of retries", s.EnsureRetryIndexes},
+		{"indexes of the audit log", s.EnsureAuditIndexes},
+		{"indexes of bounced emails", s.EnsureBounceIndexes},
+	} {
+		err := ensure.apply()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Unable to create %s: %v", ensure.name, err)
+		}
+	}
+	return firstErr
+}
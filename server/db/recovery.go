@@ -0,0 +1,42 @@
+package db
+
+import (
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SetOnserverStatus records the state of the player of the request on the game server once the task of the
+// status and sequence has been carried out. Nothing is recorded if the request transitioned in the meantime,
+// even back to the same status, the task of the newer transition records its own state. Tasks published before
+// sequences were introduced have none and only check the status
+func (s *Service) SetOnserverStatus(id primitive.ObjectID, status string, sequence int64, onserverStatus string) error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	filter := bson.M{"_id": id, "status": status}
+	if sequence > 0 {
+		filter["sequence"] = bson.M{"$lte": sequence}
+	}
+	_, err := collection.UpdateOne(s.baseContext(), filter, bson.M{
+		"$set": bson.M{"onserverStatus": onserverStatus},
+	})
+	return err
+}
+
+// StuckRequestsFilter matches the requests last updated in the time range whose status implies a completed
+// game server action that was never recorded: approved but not whitelisted, banned but not banned on the game
+// server and deactivated but still whitelisted. Synthetic requests and players imported from an existing whitelist
+// are left out
+func StuckRequestsFilter(since, before time.Time) bson.M {
+	return bson.M{
+		"lastUpdatedTimestamp": bson.M{"$gte": since, "$lt": before},
+		"bench":                bson.M{"$in": []interface{}{nil, ""}},
+		"importedAt":           bson.M{"$exists": false},
+		"$or": []interface{}{
+			bson.M{"status": types.StatusApproved, "onserverStatus": bson.M{"$ne": types.OnserverWhitelisted}},
+			bson.M{"status": types.StatusBanned, "onserverStatus": bson.M{"$ne": types.OnserverBanned}},
+			bson.M{"status": types.StatusDeactivated, "onserverStatus": types.OnserverWhitelisted},
+		},
+	}
+}
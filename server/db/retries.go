@@ -0,0 +1,117 @@
+package db
+
+import (
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Consumed retries are kept this long, then removed by a TTL index. Longer than messages wait in the retry queue,
+// so the original of a forced retry is still recognized as a copy when it comes back
+const consumedRetryRetention = 7 * 24 * time.Hour
+
+// RecordRetry records a message parked in the retry queue
+func (s *Service) RecordRetry(retry types.Retry) error {
+	collection := s.db.Database("mc-whitelist").Collection("retries")
+	_, err := collection.InsertOne(s.baseContext(), retry)
+	return err
+}
+
+// GetRetry query for one retry by ID
+func (s *Service) GetRetry(id primitive.ObjectID) (types.Retry, error) {
+	collection := s.db.Database("mc-whitelist").Collection("retries")
+	var retry types.Retry
+	err := collection.FindOne(s.baseContext(), bson.M{"_id": id}).Decode(&retry)
+	return retry, err
+}
+
+// GetRetries query for retries, the next to be attempted first
+func (s *Service) GetRetries(limit int64, filter interface{}) ([]types.Retry, error) {
+	collection := s.db.Database("mc-whitelist").Collection("retries")
+	opts := options.Find().SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cur, err := collection.Find(s.baseContext(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(s.baseContext())
+	retries := make([]types.Retry, 0)
+	for cur.Next(s.baseContext()) {
+		var retry types.Retry
+		err := cur.Decode(&retry)
+		if err != nil {
+			return nil, err
+		}
+		retries = append(retries, retry)
+	}
+	return retries, cur.Err()
+}
+
+// updateRetry updates the retry if it is in the given status and returns the retry after the update.
+// Returns mongo.ErrNoDocuments if the retry does not exist or is in another status
+func (s *Service) updateRetry(id primitive.ObjectID, status string, set bson.M) (types.Retry, error) {
+	collection := s.db.Database("mc-whitelist").Collection("retries")
+	after := options.After
+	var retry types.Retry
+	err := collection.FindOneAndUpdate(s.baseContext(), bson.M{"_id": id, "status": status}, bson.M{"$set": set},
+		&options.FindOneAndUpdateOptions{ReturnDocument: &after}).Decode(&retry)
+	return retry, err
+}
+
+// ForceRetry marks the parked retry as forced by the actor, before its message is published again
+func (s *Service) ForceRetry(id primitive.ObjectID, actor string) (types.Retry, error) {
+	return s.updateRetry(id, types.RetryParked, bson.M{"status": types.RetryForced, "actor": actor})
+}
+
+// RevertForcedRetry parks the retry again if its message could not be published again
+func (s *Service) RevertForcedRetry(id primitive.ObjectID) error {
+	_, err := s.updateRetry(id, types.RetryForced, bson.M{"status": types.RetryParked})
+	if err == mongo.ErrNoDocuments {
+		// Consumed in the meantime
+		return nil
+	}
+	return err
+}
+
+// AbandonRetry marks the parked retry as abandoned by the actor. Its message is dropped once it comes back
+func (s *Service) AbandonRetry(id primitive.ObjectID, actor string) (types.Retry, error) {
+	return s.updateRetry(id, types.RetryParked, bson.M{"status": types.RetryAbandoned, "actor": actor})
+}
+
+// ConsumeRetry marks the retry of a message coming back to the worker as consumed and returns the status it was
+// in. A parked or forced retry is consumed by the first copy of the message, a consumed or abandoned retry tells
+// the message is to be dropped. Returns mongo.ErrNoDocuments if the retry does not exist (anymore)
+func (s *Service) ConsumeRetry(id primitive.ObjectID, now time.Time) (string, error) {
+	collection := s.db.Database("mc-whitelist").Collection("retries")
+	var retry types.Retry
+	err := collection.FindOneAndUpdate(s.baseContext(), bson.M{
+		"_id":    id,
+		"status": bson.M{"$in": []string{types.RetryParked, types.RetryForced}},
+	}, bson.M{
+		"$set": bson.M{"status": types.RetryConsumed, "consumedAt": now},
+	}).Decode(&retry)
+	if err == mongo.ErrNoDocuments {
+		retry, err = s.GetRetry(id)
+	}
+	return retry.Status, err
+}
+
+// EnsureRetryIndexes creates the indexes used to list retries. Consumed retries are removed after
+// consumedRetryRetention
+func (s *Service) EnsureRetryIndexes() error {
+	collection := s.db.Database("mc-whitelist").Collection("retries")
+	_, err := collection.Indexes().CreateMany(s.baseContext(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "consumedAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(consumedRetryRetention.Seconds())),
+		},
+	})
+	return err
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// WithNextSequence adds the increment of the request's sequence to the update. Every update whose result
+// is published as a task increments it, so the worker can tell which of several queued tasks is the latest
+func WithNextSequence(update bson.M) bson.M {
+	inc, ok := update["$inc"].(bson.M)
+	if !ok {
+		inc = bson.M{}
+	}
+	inc["sequence"] = 1
+	update["$inc"] = inc
+	return update
+}
+
+// ClaimSequence records the sequence as the last applied one of the request unless a later one has already
+// been applied. Returns false and the last applied sequence if the task is stale. Tasks of requests that no
+// longer exist are claimed so they are processed as before
+func (s *Service) ClaimSequence(id primitive.ObjectID, sequence int64) (bool, int64, error) {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	// Equal sequences are claimed again, e.g by retries of the same task
+	err := collection.FindOneAndUpdate(s.baseContext(), bson.M{
+		"_id":             id,
+		"appliedSequence": bson.M{"$not": bson.M{"$gt": sequence}},
+	}, bson.M{
+		"$max": bson.M{"appliedSequence": sequence},
+	}).Err()
+	if err != mongo.ErrNoDocuments {
+		return err == nil, sequence, err
+	}
+	var applied struct {
+		AppliedSequence int64 `bson:"appliedSequence"`
+	}
+	err = collection.FindOne(s.baseContext(), bson.M{"_id": id}).Decode(&applied)
+	if err == mongo.ErrNoDocuments {
+		return true, sequence, nil
+	} else if err != nil {
+		return false, 0, err
+	}
+	return false, applied.AppliedSequence, nil
+}
@@ -0,0 +1,539 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNotFound is returned by a Store for requests that do not exist
+var ErrNotFound = errors.New("Request not found")
+
+// Store reads and writes whitelist requests through typed methods, so callers do not depend on the query
+// language of the backend. MongoStore stores them in MongoDB, MemoryStore in memory, e.g for tests. Only
+// requests are covered: the records kept alongside them, e.g the outbox, retries, timelines and the audit log,
+// are stored by Service behind the narrow typed interfaces of their callers
+type Store interface {
+	// CreateRequest stores the new request as pending and returns its ID
+	CreateRequest(request types.WhitelistRequest) (primitive.ObjectID, error)
+	// GetRequest returns ErrNotFound if there is no request with the ID
+	GetRequest(id primitive.ObjectID) (types.WhitelistRequest, error)
+	// QueryRequests returns the requests matching the filter, most recent first. Canary requests are never returned
+	QueryRequests(filter RequestFilter) ([]types.WhitelistRequest, error)
+	// CountAssignments counts the requests matching the filter assigned to each op, without loading them. Ops
+	// without any are left out. Canary requests are never counted
+	CountAssignments(filter RequestFilter) (map[string]int, error)
+	// DeleteRequest succeeds if there is no request with the ID
+	DeleteRequest(id primitive.ObjectID) error
+	// AddAssignees adds the ops to the assignees of the request, keeping earlier ones, and records they were sent
+	// the request at dispatchedAt. Returns ErrNotFound if there is no request with the ID
+	AddAssignees(id primitive.ObjectID, ops []string, dispatchedAt time.Time) error
+	// SetOnserverStatus records the state of the player on the game server once the task of the request in status
+	// with the sequence was carried out. Nothing is recorded if the request has changed since
+	SetOnserverStatus(id primitive.ObjectID, status string, sequence int64, onserverStatus string) error
+	// TransitionStatus applies the change if the request is still in change.From and increments its sequence, so
+	// of concurrent changes from the same status only the first is stored. Returns ErrConflict otherwise
+	TransitionStatus(id primitive.ObjectID, change StatusChange) (types.WhitelistRequest, error)
+	// TransitionStatusWithTask applies the change like TransitionStatus and writes the task of the changed request
+	// to the outbox with it, the way the API hands changes to the worker. The outbox relay publishes the task if
+	// and only if the change is stored
+	TransitionStatusWithTask(id primitive.ObjectID, change StatusChange) (types.WhitelistRequest, error)
+	// SetAwaitingOps parks the pending request until ops are configured, or releases it. Returns ErrConflict if
+	// the request is no longer pending or is already parked, or released
+	SetAwaitingOps(id primitive.ObjectID, awaiting bool) (types.WhitelistRequest, error)
+	// ReplaceAssignees replaces the assignees of the pending request if they are still the ones given. Returns
+	// ErrConflict otherwise
+	ReplaceAssignees(id primitive.ObjectID, assignees, replacement []string) error
+	// ClaimEscalation flags the pending request as escalated at the time. Returns ErrConflict if the request is
+	// no longer pending or has been escalated already
+	ClaimEscalation(id primitive.ObjectID, at time.Time) error
+	// ClaimDigest records the pending request is sent to ops in a digest at the time, unless it has been sent
+	// in a digest since. Returns ErrConflict otherwise
+	ClaimDigest(id primitive.ObjectID, since, at time.Time) error
+	// ClaimSLANotification records ops are told at the time the pending request is pending longer than the
+	// SLA, unless they have been told after notifiedBefore. Returns ErrConflict otherwise
+	ClaimSLANotification(id primitive.ObjectID, notifiedBefore, at time.Time) error
+	// SetReviewReminded records whether ops have been asked to review the provisional approval. Returns
+	// ErrConflict if the request is no longer a provisional approval or the flag is already set so
+	SetReviewReminded(id primitive.ObjectID, reminded bool) error
+	// RecordFirstJoins records the approved players of the tenant with the usernames, ignoring case, first joined
+	// the game server at the time, unless they joined before. Returns the number of players recorded
+	RecordFirstJoins(serverID string, usernames []string, at time.Time) (int64, error)
+	// SetFollowUp flags the approved request for follow-up, or clears the flag if followUp is nil. Returns
+	// ErrConflict if the request is no longer approved
+	SetFollowUp(id primitive.ObjectID, followUp *types.FollowUp) error
+	// StuckRequests returns the requests last updated at or after since and before before whose decision was
+	// never recorded as carried out on the game server, see StuckRequestsFilter
+	StuckRequests(since, before time.Time) ([]types.WhitelistRequest, error)
+	// SetNetworkSignals records the prior requests from the network of the request on it. Returns ErrNotFound if
+	// there is no request with the ID
+	SetNetworkSignals(id primitive.ObjectID, signals types.NetworkSignals) error
+	// SetReferral records the standing of the referrer of the request on it and tags the request
+	// TagUnverifiedReferrer unless the referrer is a member in good standing. Returns ErrNotFound if there is no
+	// request with the ID
+	SetReferral(id primitive.ObjectID, referral types.Referral) error
+	// CompleteCanary records the canary request went through the pipeline at the time
+	CompleteCanary(id primitive.ObjectID, at time.Time) error
+	// Ping checks the backend can be reached within the timeout
+	Ping(timeout time.Duration) error
+}
+
+// RequestFilter selects requests by QueryRequests. Zero fields do not restrict the requests
+type RequestFilter struct {
+	Statuses []string
+	// Requests of the tenants with the server IDs. Requests of the default tenant have an empty server ID
+	Tenants []string
+	// Requests of the username or email, ignoring case. Either matches if both are set
+	Username string
+	Email    string
+	// Requests submitted at or before SubmittedBefore, and decided after DecidedAfter or at or before DecidedBefore.
+	// Undecided requests count as decided at the zero time
+	SubmittedBefore time.Time
+	DecidedAfter    time.Time
+	DecidedBefore   time.Time
+	// Requests created before the one with the ID
+	BeforeID primitive.ObjectID
+	// Leaves out pending requests parked until ops are configured, or only selects them
+	ExcludeAwaitingOps bool
+	OnlyAwaitingOps    bool
+	// Only requests dispatched to at least one op
+	Assigned bool
+	// Only temporary grants expiring at or before ExpiresBefore
+	ExpiresBefore time.Time
+	// Only members of the event batch with the hex ID
+	BatchID string
+	// Leaves out requests escalated already
+	NotEscalated bool
+	// Only requests first sent in a digest at or before DigestedBefore, and not sent in a digest since
+	// NotDigestedSince
+	DigestedBefore   time.Time
+	NotDigestedSince time.Time
+	// Only requests whose ops have never been told they are pending longer than the SLA, or at or before
+	// SLANotifiedBefore
+	SLANotifiedBefore time.Time
+	// Only provisional approvals to be reviewed at or before ReviewDueBefore, and leaves out the ones ops have
+	// been reminded of
+	ReviewDueBefore   time.Time
+	NotReviewReminded bool
+	// Only requests flagged for follow-up that ops have not dismissed
+	FollowUp bool
+	// Only requests submitted from the network with the hashed prefix
+	SubmissionIPPrefix string
+	// Leaves out the request with the ID, e.g the one whose network is looked up
+	ExcludeID primitive.ObjectID
+	// Leaves out the synthetic requests of load benchmark runs
+	NotBench bool
+	// Maximum number of requests returned, the most recent ones
+	Limit int64
+}
+
+// StatusChange moves a request from one status to another at a time. Approvals and denials are decisions,
+// recorded with the admin who made them and the reason told to the applicant
+type StatusChange struct {
+	From   string
+	To     string
+	At     time.Time
+	Admin  string
+	Reason string
+}
+
+// decision tells if the change decides on the request
+func (c StatusChange) decision() bool {
+	return c.To == types.StatusApproved || c.To == types.StatusDenied
+}
+
+// MongoStore is the Store of the requests in MongoDB
+type MongoStore struct {
+	service *Service
+}
+
+// NewMongoStore returns the Store of the requests of the service
+func NewMongoStore(service *Service) *MongoStore {
+	return &MongoStore{service: service}
+}
+
+func (s *MongoStore) CreateRequest(request types.WhitelistRequest) (primitive.ObjectID, error) {
+	return s.service.CreateRequest(request)
+}
+
+func (s *MongoStore) GetRequest(id primitive.ObjectID) (types.WhitelistRequest, error) {
+	collection := s.service.db.Database("mc-whitelist").Collection("requests")
+	var request types.WhitelistRequest
+	err := collection.FindOne(s.service.baseContext(), bson.M{"_id": id}).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		return types.WhitelistRequest{}, ErrNotFound
+	}
+	return request, err
+}
+
+func (s *MongoStore) QueryRequests(filter RequestFilter) ([]types.WhitelistRequest, error) {
+	collection := s.service.db.Database("mc-whitelist").Collection("requests")
+	opts := options.Find().SetSort(map[string]int{"timestamp": -1})
+	if filter.Limit > 0 {
+		opts.SetLimit(filter.Limit)
+	}
+	cur, err := collection.Find(s.service.baseContext(), ExcludeCanaries(filter.bson()), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(s.service.baseContext())
+	requests := make([]types.WhitelistRequest, 0)
+	for cur.Next(s.service.baseContext()) {
+		var request types.WhitelistRequest
+		if err := cur.Decode(&request); err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, cur.Err()
+}
+
+func (s *MongoStore) CountAssignments(filter RequestFilter) (map[string]int, error) {
+	var counts []struct {
+		Op    string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	err := s.service.aggregate("requests", []bson.M{
+		{"$match": ExcludeCanaries(filter.bson())},
+		{"$unwind": "$assignees"},
+		{"$group": bson.M{"_id": "$assignees", "count": bson.M{"$sum": 1}}},
+	}, &counts)
+	if err != nil {
+		return nil, err
+	}
+	assignments := make(map[string]int, len(counts))
+	for _, count := range counts {
+		assignments[count.Op] = count.Count
+	}
+	return assignments, nil
+}
+
+// bson returns the MongoDB filter of the requests
+func (f RequestFilter) bson() bson.M {
+	filter := bson.M{}
+	if len(f.Statuses) > 0 {
+		filter["status"] = bson.M{"$in": f.Statuses}
+	}
+	if len(f.Tenants) > 0 {
+		serverIDs := make([]interface{}, 0, len(f.Tenants)+1)
+		for _, serverID := range f.Tenants {
+			serverIDs = append(serverIDs, serverID)
+			if serverID == "" {
+				serverIDs = append(serverIDs, nil)
+			}
+		}
+		filter["serverId"] = bson.M{"$in": serverIDs}
+	}
+	switch {
+	case f.Username != "" && f.Email != "":
+		filter["$or"] = []bson.M{
+			{"username": caseInsensitive(f.Username)},
+			{"email": caseInsensitive(f.Email)},
+		}
+	case f.Username != "":
+		filter["username"] = caseInsensitive(f.Username)
+	case f.Email != "":
+		filter["email"] = caseInsensitive(f.Email)
+	}
+	if !f.SubmittedBefore.IsZero() {
+		filter["timestamp"] = bson.M{"$lte": f.SubmittedBefore}
+	}
+	if !f.DecidedAfter.IsZero() || !f.DecidedBefore.IsZero() {
+		decided := bson.M{}
+		if !f.DecidedAfter.IsZero() {
+			decided["$gt"] = f.DecidedAfter
+		}
+		if !f.DecidedBefore.IsZero() {
+			decided["$lte"] = f.DecidedBefore
+		}
+		filter["processedTimestamp"] = decided
+	}
+	if !f.BeforeID.IsZero() {
+		filter["_id"] = bson.M{"$lt": f.BeforeID}
+	}
+	if f.ExcludeAwaitingOps {
+		filter["awaitingOps"] = bson.M{"$ne": true}
+	}
+	if f.OnlyAwaitingOps {
+		filter["awaitingOps"] = true
+	}
+	if f.Assigned {
+		filter["assignees.0"] = bson.M{"$exists": true}
+	}
+	if !f.ExpiresBefore.IsZero() {
+		filter["expiresAt"] = bson.M{"$lte": f.ExpiresBefore}
+	}
+	if f.BatchID != "" {
+		filter["batchId"] = f.BatchID
+	}
+	if f.NotEscalated {
+		filter["escalated"] = bson.M{"$ne": true}
+	}
+	if !f.DigestedBefore.IsZero() {
+		filter["digestedAt"] = bson.M{"$lte": f.DigestedBefore}
+	}
+	if !f.ReviewDueBefore.IsZero() {
+		filter["provisional"] = true
+		filter["reviewAt"] = bson.M{"$lte": f.ReviewDueBefore}
+	}
+	if f.NotReviewReminded {
+		filter["reviewReminded"] = bson.M{"$ne": true}
+	}
+	if f.FollowUp {
+		filter["followUp"] = bson.M{"$exists": true}
+		filter["followUp.dismissedAt"] = bson.M{"$exists": false}
+	}
+	if f.SubmissionIPPrefix != "" {
+		filter["submissionIpPrefix"] = f.SubmissionIPPrefix
+	}
+	if f.NotBench {
+		filter["bench"] = bson.M{"$in": []interface{}{nil, ""}}
+	}
+	// Alternatives besides the one of username and email
+	and := []bson.M{}
+	if !f.ExcludeID.IsZero() {
+		// Kept apart from BeforeID, which also restricts the ID
+		and = append(and, bson.M{"_id": bson.M{"$ne": f.ExcludeID}})
+	}
+	if !f.NotDigestedSince.IsZero() {
+		and = append(and, bson.M{"$or": notDigestedSince(f.NotDigestedSince)})
+	}
+	if !f.SLANotifiedBefore.IsZero() {
+		and = append(and, bson.M{"$or": slaNotifiedBefore(f.SLANotifiedBefore)})
+	}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+	return filter
+}
+
+func notDigestedSince(since time.Time) []bson.M {
+	return []bson.M{
+		{"lastDigestedAt": bson.M{"$exists": false}},
+		{"lastDigestedAt": bson.M{"$lt": since}},
+	}
+}
+
+func slaNotifiedBefore(before time.Time) []bson.M {
+	return []bson.M{
+		{"slaNotifiedAt": bson.M{"$exists": false}},
+		{"slaNotifiedAt": bson.M{"$lte": before}},
+	}
+}
+
+func (s *MongoStore) DeleteRequest(id primitive.ObjectID) error {
+	return s.service.DeleteRequest(id)
+}
+
+func (s *MongoStore) AddAssignees(id primitive.ObjectID, ops []string, dispatchedAt time.Time) error {
+	dispatches := make([]types.Dispatch, 0, len(ops))
+	for _, op := range ops {
+		dispatches = append(dispatches, types.Dispatch{Op: op, Timestamp: dispatchedAt})
+	}
+	// The request is not upserted if it has been removed in the meantime, e.g a timed out canary request
+	_, err := s.service.ConditionalUpdateRequest(bson.M{"_id": id}, bson.M{
+		"$addToSet": bson.M{"assignees": bson.M{"$each": ops}},
+		"$push":     bson.M{"dispatches": bson.M{"$each": dispatches}},
+	})
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *MongoStore) SetOnserverStatus(id primitive.ObjectID, status string, sequence int64, onserverStatus string) error {
+	return s.service.SetOnserverStatus(id, status, sequence, onserverStatus)
+}
+
+func (s *MongoStore) TransitionStatus(id primitive.ObjectID, change StatusChange) (types.WhitelistRequest, error) {
+	return Transition(s.service, id, change.From, change.To, change.update())
+}
+
+// TransitionStatusWithTask requires MongoDB to run as a replica set, see WithTransaction
+func (s *MongoStore) TransitionStatusWithTask(id primitive.ObjectID, change StatusChange) (types.WhitelistRequest, error) {
+	var request types.WhitelistRequest
+	err := s.service.WithTransaction(func(tx Tx) error {
+		var err error
+		request, err = Transition(tx, id, change.From, change.To, change.update())
+		if err != nil {
+			return err
+		}
+		request.PreviousStatus = change.From
+		return tx.AppendOutbox(request)
+	})
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	return request, nil
+}
+
+// update returns the MongoDB update of the fields the change sets besides the status
+func (c StatusChange) update() bson.M {
+	set := bson.M{"lastUpdatedTimestamp": c.At}
+	update := bson.M{"$set": set}
+	if c.decision() {
+		set["admin"] = c.Admin
+		set["processedTimestamp"] = c.At
+		if c.Reason != "" {
+			set["decisionReason"] = c.Reason
+		}
+		update = WithDecidedAt(update, c.At)
+	}
+	return update
+}
+
+func (s *MongoStore) SetAwaitingOps(id primitive.ObjectID, awaiting bool) (types.WhitelistRequest, error) {
+	filter := bson.M{"_id": id, "status": types.StatusPending, "awaitingOps": bson.M{"$ne": true}}
+	update := bson.M{"$set": bson.M{"awaitingOps": true}}
+	if !awaiting {
+		filter["awaitingOps"] = true
+		update = bson.M{"$unset": bson.M{"awaitingOps": ""}}
+	}
+	return s.claim(filter, update)
+}
+
+func (s *MongoStore) ReplaceAssignees(id primitive.ObjectID, assignees, replacement []string) error {
+	_, err := s.claim(bson.M{
+		"_id":       id,
+		"status":    types.StatusPending,
+		"assignees": assignees,
+	}, bson.M{
+		"$set": bson.M{"assignees": replacement},
+	})
+	return err
+}
+
+func (s *MongoStore) ClaimEscalation(id primitive.ObjectID, at time.Time) error {
+	_, err := s.claim(bson.M{
+		"_id":       id,
+		"status":    types.StatusPending,
+		"escalated": bson.M{"$ne": true},
+	}, bson.M{
+		"$set": bson.M{"escalated": true, "escalatedTimestamp": at},
+	})
+	return err
+}
+
+func (s *MongoStore) ClaimDigest(id primitive.ObjectID, since, at time.Time) error {
+	_, err := s.claim(bson.M{
+		"_id":    id,
+		"status": types.StatusPending,
+		"$or":    notDigestedSince(since),
+	}, bson.M{
+		"$set": bson.M{"lastDigestedAt": at},
+		"$min": bson.M{"digestedAt": at},
+	})
+	return err
+}
+
+func (s *MongoStore) ClaimSLANotification(id primitive.ObjectID, notifiedBefore, at time.Time) error {
+	_, err := s.claim(bson.M{
+		"_id":    id,
+		"status": types.StatusPending,
+		"$or":    slaNotifiedBefore(notifiedBefore),
+	}, bson.M{
+		"$set": bson.M{"slaNotifiedAt": at},
+	})
+	return err
+}
+
+func (s *MongoStore) SetReviewReminded(id primitive.ObjectID, reminded bool) error {
+	filter := bson.M{
+		"_id":            id,
+		"status":         types.StatusApproved,
+		"provisional":    true,
+		"reviewReminded": bson.M{"$ne": true},
+	}
+	if !reminded {
+		filter["reviewReminded"] = true
+	}
+	_, err := s.claim(filter, bson.M{
+		"$set": bson.M{"reviewReminded": reminded},
+	})
+	return err
+}
+
+func (s *MongoStore) RecordFirstJoins(serverID string, usernames []string, at time.Time) (int64, error) {
+	if len(usernames) == 0 {
+		return 0, nil
+	}
+	patterns := make([]interface{}, 0, len(usernames))
+	for _, username := range usernames {
+		patterns = append(patterns, caseInsensitive(username))
+	}
+	filter := RequestFilter{Statuses: []string{types.StatusApproved}, Tenants: []string{serverID}}.bson()
+	filter["username"] = bson.M{"$in": patterns}
+	filter["firstJoinedAt"] = bson.M{"$exists": false}
+	collection := s.service.db.Database("mc-whitelist").Collection("requests")
+	result, err := collection.UpdateMany(s.service.baseContext(), filter, bson.M{"$set": bson.M{"firstJoinedAt": at}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (s *MongoStore) SetFollowUp(id primitive.ObjectID, followUp *types.FollowUp) error {
+	update := bson.M{"$set": bson.M{"followUp": followUp}}
+	if followUp == nil {
+		update = bson.M{"$unset": bson.M{"followUp": ""}}
+	}
+	_, err := s.claim(bson.M{"_id": id, "status": types.StatusApproved}, update)
+	return err
+}
+
+func (s *MongoStore) StuckRequests(since, before time.Time) ([]types.WhitelistRequest, error) {
+	return s.service.GetRequests(-1, StuckRequestsFilter(since, before))
+}
+
+func (s *MongoStore) SetNetworkSignals(id primitive.ObjectID, signals types.NetworkSignals) error {
+	_, err := s.service.ConditionalUpdateRequest(bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"networkSignals": signals},
+	})
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *MongoStore) SetReferral(id primitive.ObjectID, referral types.Referral) error {
+	update := bson.M{"$set": bson.M{"referral": referral}}
+	if !referral.Verified() {
+		update["$addToSet"] = bson.M{"tags": types.TagUnverifiedReferrer}
+	}
+	_, err := s.service.ConditionalUpdateRequest(bson.M{"_id": id}, update)
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *MongoStore) CompleteCanary(id primitive.ObjectID, at time.Time) error {
+	_, err := s.service.ConditionalUpdateRequest(bson.M{
+		"_id":    id,
+		"canary": true,
+	}, bson.M{
+		"$set": bson.M{"canaryCompletedTimestamp": at},
+	})
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *MongoStore) Ping(timeout time.Duration) error {
+	return s.service.Ping(timeout)
+}
+
+// claim applies the update to the request if it still matches the filter. Returns ErrConflict otherwise
+func (s *MongoStore) claim(filter, update bson.M) (types.WhitelistRequest, error) {
+	request, err := s.service.ConditionalUpdateRequest(filter, update)
+	if err == mongo.ErrNoDocuments {
+		return types.WhitelistRequest{}, ErrConflict
+	}
+	return request, err
+}
@@ -0,0 +1,435 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, db.NewMemoryStore())
+}
+
+// TestMongoStore runs the same suite against the MongoDB of the test configuration. Skipped if it is not running
+func TestMongoStore(t *testing.T) {
+	service, disconnect := testService(t)
+	defer disconnect()
+	testStore(t, db.NewMongoStore(service))
+}
+
+// testStore checks the behavior every Store has to implement. Requests are created in tenants of their own, so
+// the suite can run against a database holding other requests
+func testStore(t *testing.T, store db.Store) {
+	suffix := primitive.NewObjectID().Hex()[16:]
+	tenant, other := "store-"+suffix, "other-"+suffix
+	var created []primitive.ObjectID
+	defer func() {
+		for _, id := range created {
+			store.DeleteRequest(id)
+		}
+	}()
+	createRequest := func(request types.WhitelistRequest) types.WhitelistRequest {
+		id, err := store.CreateRequest(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, id)
+		request, err = store.GetRequest(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Requests are ordered by the time they were submitted
+		time.Sleep(5 * time.Millisecond)
+		return request
+	}
+	create := func(username, serverID string) types.WhitelistRequest {
+		return createRequest(types.WhitelistRequest{Username: username, Email: username + "@gmail.com", ServerID: serverID})
+	}
+	steve := create("Steve", tenant)
+	alex := create("Alex", tenant)
+	notch := create("Notch", other)
+	if steve.Status != types.StatusPending || steve.Username != "Steve" || steve.Timestamp.IsZero() {
+		t.Errorf("Expected a pending request of Steve, got %+v", steve)
+	}
+	if _, err := store.GetRequest(primitive.NewObjectID()); err != db.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for unknown requests, got %v", err)
+	}
+
+	ids := func(requests []types.WhitelistRequest, err error) []primitive.ObjectID {
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []primitive.ObjectID{}
+		for _, request := range requests {
+			ids = append(ids, request.ID)
+		}
+		return ids
+	}
+	queries := []struct {
+		name     string
+		filter   db.RequestFilter
+		expected []primitive.ObjectID
+	}{
+		{"tenant, most recent first", db.RequestFilter{Tenants: []string{tenant}}, []primitive.ObjectID{alex.ID, steve.ID}},
+		{"tenants", db.RequestFilter{Tenants: []string{tenant, other}, Limit: 2}, []primitive.ObjectID{notch.ID, alex.ID}},
+		{"username ignoring case", db.RequestFilter{Tenants: []string{tenant}, Username: "STEVE"}, []primitive.ObjectID{steve.ID}},
+		{"username or email", db.RequestFilter{Tenants: []string{tenant}, Username: "steve", Email: "alex@gmail.com"},
+			[]primitive.ObjectID{alex.ID, steve.ID}},
+		{"created before", db.RequestFilter{Tenants: []string{tenant}, BeforeID: alex.ID}, []primitive.ObjectID{steve.ID}},
+		{"submitted before", db.RequestFilter{Tenants: []string{tenant}, SubmittedBefore: steve.Timestamp}, []primitive.ObjectID{steve.ID}},
+		{"status", db.RequestFilter{Tenants: []string{tenant}, Statuses: []string{types.StatusDenied}}, []primitive.ObjectID{}},
+	}
+	for _, query := range queries {
+		if got := ids(store.QueryRequests(query.filter)); !equalIDs(got, query.expected) {
+			t.Errorf("%s: expected %v, got %v", query.name, query.expected, got)
+		}
+	}
+
+	// Assignees are added once, every dispatch is recorded
+	dispatchedAt := time.Now().Truncate(time.Millisecond)
+	if err := store.AddAssignees(steve.ID, []string{"op1@gmail.com", "op2@gmail.com"}, dispatchedAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddAssignees(steve.ID, []string{"op2@gmail.com"}, dispatchedAt); err != nil {
+		t.Fatal(err)
+	}
+	steve, _ = store.GetRequest(steve.ID)
+	if len(steve.Assignees) != 2 || len(steve.Dispatches) != 3 || !steve.Dispatches[2].Timestamp.Equal(dispatchedAt) {
+		t.Errorf("Expected two assignees dispatched three times, got %v %v", steve.Assignees, steve.Dispatches)
+	}
+	if err := store.AddAssignees(primitive.NewObjectID(), []string{"op1@gmail.com"}, dispatchedAt); err != db.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for unknown requests, got %v", err)
+	}
+
+	// Only the first of concurrent transitions from the same status is applied
+	deniedAt := time.Now().Truncate(time.Millisecond)
+	change := db.StatusChange{From: types.StatusPending, To: types.StatusDenied, At: deniedAt, Admin: "op1@gmail.com", Reason: "Not now"}
+	denied, err := store.TransitionStatus(steve.ID, change)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if denied.Status != types.StatusDenied || denied.Admin != "op1@gmail.com" || denied.DecisionReason != "Not now" ||
+		!denied.ProcessedTimestamp.Equal(deniedAt) || denied.DecidedAt == nil || !denied.DecidedAt.Equal(deniedAt) ||
+		denied.Sequence != steve.Sequence+1 {
+		t.Errorf("Expected the denial to be recorded, got %+v", denied)
+	}
+	if _, err := store.TransitionStatus(steve.ID, change); err != db.ErrConflict {
+		t.Errorf("Expected ErrConflict for a request no longer pending, got %v", err)
+	}
+	if _, err := store.TransitionStatus(primitive.NewObjectID(), change); err != db.ErrConflict {
+		t.Errorf("Expected ErrConflict for unknown requests, got %v", err)
+	}
+	expired, err := store.TransitionStatus(alex.ID, db.StatusChange{From: types.StatusPending, To: types.StatusExpired, At: deniedAt})
+	if err != nil || expired.Status != types.StatusExpired || !expired.ProcessedTimestamp.IsZero() || expired.DecidedAt != nil {
+		t.Errorf("Expected the request to expire without a decision, got %+v %v", expired, err)
+	}
+	recent := db.RequestFilter{Tenants: []string{tenant}, Statuses: []string{types.StatusDenied}, DecidedAfter: deniedAt.Add(-time.Minute)}
+	if got := ids(store.QueryRequests(recent)); !equalIDs(got, []primitive.ObjectID{steve.ID}) {
+		t.Errorf("Expected the recent denial, got %v", got)
+	}
+	recent.DecidedAfter = deniedAt
+	if got := ids(store.QueryRequests(recent)); len(got) != 0 {
+		t.Errorf("Expected no denial after it, got %v", got)
+	}
+
+	// The state on the game server is only recorded for the status of the task
+	if err := store.SetOnserverStatus(steve.ID, types.StatusApproved, denied.Sequence, types.OnserverWhitelisted); err != nil {
+		t.Fatal(err)
+	}
+	if steve, _ = store.GetRequest(steve.ID); steve.OnserverStatus != "" {
+		t.Errorf("Expected the state of a task of another status to be ignored, got %s", steve.OnserverStatus)
+	}
+	if err := store.SetOnserverStatus(steve.ID, types.StatusDenied, denied.Sequence, types.OnserverRemoved); err != nil {
+		t.Fatal(err)
+	}
+	if steve, _ = store.GetRequest(steve.ID); steve.OnserverStatus != types.OnserverRemoved {
+		t.Errorf("Expected the state on the game server to be recorded, got %s", steve.OnserverStatus)
+	}
+
+	// Requests are parked and released once
+	herobrine := create("Herobrine", tenant)
+	if parked, err := store.SetAwaitingOps(herobrine.ID, true); err != nil || !parked.AwaitingOps {
+		t.Errorf("Expected the request to be parked, got %+v %v", parked, err)
+	}
+	if _, err := store.SetAwaitingOps(herobrine.ID, true); err != db.ErrConflict {
+		t.Errorf("Expected ErrConflict for a request parked already, got %v", err)
+	}
+	if _, err := store.SetAwaitingOps(steve.ID, true); err != db.ErrConflict {
+		t.Errorf("Expected ErrConflict for a request no longer pending, got %v", err)
+	}
+	pending := db.RequestFilter{Tenants: []string{tenant}, Statuses: []string{types.StatusPending}}
+	parkedOnly, notParked := pending, pending
+	parkedOnly.OnlyAwaitingOps = true
+	notParked.ExcludeAwaitingOps = true
+	if got := ids(store.QueryRequests(parkedOnly)); !equalIDs(got, []primitive.ObjectID{herobrine.ID}) {
+		t.Errorf("Expected the parked request, got %v", got)
+	}
+	if got := ids(store.QueryRequests(notParked)); len(got) != 0 {
+		t.Errorf("Expected the parked request to be left out, got %v", got)
+	}
+	if released, err := store.SetAwaitingOps(herobrine.ID, false); err != nil || released.AwaitingOps {
+		t.Errorf("Expected the request to be released, got %+v %v", released, err)
+	}
+	if _, err := store.SetAwaitingOps(herobrine.ID, false); err != db.ErrConflict {
+		t.Errorf("Expected ErrConflict for a request released already, got %v", err)
+	}
+
+	// Assignees are only replaced if they have not changed since they were read
+	assigned := pending
+	assigned.Assigned = true
+	if got := ids(store.QueryRequests(assigned)); len(got) != 0 {
+		t.Errorf("Expected no assigned request, got %v", got)
+	}
+	if err := store.AddAssignees(herobrine.ID, []string{"op1@gmail.com", "op2@gmail.com"}, dispatchedAt); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(store.QueryRequests(assigned)); !equalIDs(got, []primitive.ObjectID{herobrine.ID}) {
+		t.Errorf("Expected the assigned request, got %v", got)
+	}
+	if err := store.ReplaceAssignees(herobrine.ID, []string{"op1@gmail.com"}, []string{"op3@gmail.com"}); err != db.ErrConflict {
+		t.Errorf("Expected ErrConflict for assignees changed since, got %v", err)
+	}
+	if err := store.ReplaceAssignees(herobrine.ID, []string{"op1@gmail.com", "op2@gmail.com"}, []string{"op2@gmail.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if herobrine, _ = store.GetRequest(herobrine.ID); len(herobrine.Assignees) != 1 || herobrine.Assignees[0] != "op2@gmail.com" {
+		t.Errorf("Expected the assignees to be replaced, got %v", herobrine.Assignees)
+	}
+	// The assignments of Steve are no longer pending
+	if assignments, err := store.CountAssignments(pending); err != nil || len(assignments) != 1 || assignments["op2@gmail.com"] != 1 {
+		t.Errorf("Expected one pending assignment of op2, got %v %v", assignments, err)
+	}
+
+	// Escalations, digests and SLA notifications are claimed once
+	claimedAt := time.Now().Truncate(time.Millisecond)
+	if err := store.ClaimEscalation(herobrine.ID, claimedAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ClaimEscalation(herobrine.ID, claimedAt); err != db.ErrConflict {
+		t.Errorf("Expected ErrConflict for a request escalated already, got %v", err)
+	}
+	notEscalated := pending
+	notEscalated.NotEscalated = true
+	if got := ids(store.QueryRequests(notEscalated)); len(got) != 0 {
+		t.Errorf("Expected the escalated request to be left out, got %v", got)
+	}
+	if err := store.ClaimDigest(herobrine.ID, claimedAt, claimedAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ClaimDigest(herobrine.ID, claimedAt, claimedAt); err != db.ErrConflict {
+		t.Errorf("Expected ErrConflict for a request in a digest since, got %v", err)
+	}
+	notDigested := pending
+	notDigested.NotDigestedSince = claimedAt
+	if got := ids(store.QueryRequests(notDigested)); len(got) != 0 {
+		t.Errorf("Expected the request in a digest to be left out, got %v", got)
+	}
+	nextDigest := claimedAt.Add(time.Hour)
+	notDigested.NotDigestedSince = nextDigest
+	notDigested.DigestedBefore = claimedAt
+	if got := ids(store.QueryRequests(notDigested)); !equalIDs(got, []primitive.ObjectID{herobrine.ID}) {
+		t.Errorf("Expected the request digested before the next digest, got %v", got)
+	}
+	if err := store.ClaimDigest(herobrine.ID, nextDigest, nextDigest); err != nil {
+		t.Fatal(err)
+	}
+	if herobrine, _ = store.GetRequest(herobrine.ID); !herobrine.DigestedAt.Equal(claimedAt) || !herobrine.LastDigestedAt.Equal(nextDigest) {
+		t.Errorf("Expected the first and the last digest to be recorded, got %v %v", herobrine.DigestedAt, herobrine.LastDigestedAt)
+	}
+	if err := store.ClaimSLANotification(herobrine.ID, claimedAt.Add(-24*time.Hour), claimedAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ClaimSLANotification(herobrine.ID, claimedAt.Add(-24*time.Hour), claimedAt); err != db.ErrConflict {
+		t.Errorf("Expected ErrConflict for ops told since, got %v", err)
+	}
+	notNotified := pending
+	notNotified.SLANotifiedBefore = claimedAt.Add(-time.Minute)
+	if got := ids(store.QueryRequests(notNotified)); len(got) != 0 {
+		t.Errorf("Expected the request ops were told about to be left out, got %v", got)
+	}
+	notNotified.SLANotifiedBefore = claimedAt
+	if got := ids(store.QueryRequests(notNotified)); !equalIDs(got, []primitive.ObjectID{herobrine.ID}) {
+		t.Errorf("Expected the request ops were told about before, got %v", got)
+	}
+
+	// Provisional approvals, temporary grants and batch members
+	reviewAt, expiresAt := claimedAt.Add(-time.Hour), claimedAt.Add(time.Hour)
+	jeb := createRequest(types.WhitelistRequest{Username: "Jeb", Email: "jeb@gmail.com", ServerID: tenant, Provisional: true,
+		ReviewAt: &reviewAt, ExpiresAt: &expiresAt, BatchID: "batch-" + suffix})
+	if _, err := store.TransitionStatus(jeb.ID, db.StatusChange{From: types.StatusPending, To: types.StatusApproved, At: claimedAt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetReviewReminded(herobrine.ID, true); err != db.ErrConflict {
+		t.Errorf("Expected ErrConflict for a request not approved, got %v", err)
+	}
+	if err := store.SetReviewReminded(jeb.ID, false); err != db.ErrConflict {
+		t.Errorf("Expected ErrConflict for a reminder not sent, got %v", err)
+	}
+	due := db.RequestFilter{Tenants: []string{tenant}, ReviewDueBefore: claimedAt, NotReviewReminded: true}
+	if got := ids(store.QueryRequests(due)); !equalIDs(got, []primitive.ObjectID{jeb.ID}) {
+		t.Errorf("Expected the provisional approval due for review, got %v", got)
+	}
+	if err := store.SetReviewReminded(jeb.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(store.QueryRequests(due)); len(got) != 0 {
+		t.Errorf("Expected the reminded approval to be left out, got %v", got)
+	}
+	if err := store.SetReviewReminded(jeb.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	expiring := db.RequestFilter{Tenants: []string{tenant}, ExpiresBefore: claimedAt}
+	if got := ids(store.QueryRequests(expiring)); len(got) != 0 {
+		t.Errorf("Expected no grant expired yet, got %v", got)
+	}
+	expiring.ExpiresBefore = expiresAt
+	if got := ids(store.QueryRequests(expiring)); !equalIDs(got, []primitive.ObjectID{jeb.ID}) {
+		t.Errorf("Expected the expired grant, got %v", got)
+	}
+	if got := ids(store.QueryRequests(db.RequestFilter{Tenants: []string{tenant}, BatchID: "batch-" + suffix})); !equalIDs(got, []primitive.ObjectID{jeb.ID}) {
+		t.Errorf("Expected the batch member, got %v", got)
+	}
+
+	// First joins and follow-ups of approved players
+	joinedAt := claimedAt.Add(time.Minute)
+	if n, err := store.RecordFirstJoins(tenant, []string{"JEB", "Herobrine"}, joinedAt); err != nil || n != 1 {
+		t.Errorf("Expected the first join of the approved player only, got %d %v", n, err)
+	}
+	if n, err := store.RecordFirstJoins(tenant, []string{"jeb"}, joinedAt.Add(time.Hour)); err != nil || n != 0 {
+		t.Errorf("Expected the first join to be kept, got %d %v", n, err)
+	}
+	if jeb, _ = store.GetRequest(jeb.ID); jeb.FirstJoinedAt == nil || !jeb.FirstJoinedAt.Equal(joinedAt) {
+		t.Errorf("Expected the first join to be recorded, got %v", jeb.FirstJoinedAt)
+	}
+	decided := db.RequestFilter{Statuses: []string{types.StatusApproved}, Tenants: []string{tenant}, DecidedBefore: claimedAt.Add(-time.Minute)}
+	if got := ids(store.QueryRequests(decided)); len(got) != 0 {
+		t.Errorf("Expected no request decided before, got %v", got)
+	}
+	decided.DecidedBefore = claimedAt
+	if got := ids(store.QueryRequests(decided)); !equalIDs(got, []primitive.ObjectID{jeb.ID}) {
+		t.Errorf("Expected the request decided before, got %v", got)
+	}
+	followUp := &types.FollowUp{Reasons: []string{types.FollowUpEmailBounced}, SuggestedActions: []string{types.FollowUpResendEmail}, FlaggedAt: claimedAt}
+	if err := store.SetFollowUp(herobrine.ID, followUp); err != db.ErrConflict {
+		t.Errorf("Expected ErrConflict for a request not approved, got %v", err)
+	}
+	if err := store.SetFollowUp(jeb.ID, followUp); err != nil {
+		t.Fatal(err)
+	}
+	flagged := db.RequestFilter{Tenants: []string{tenant}, FollowUp: true}
+	if got := ids(store.QueryRequests(flagged)); !equalIDs(got, []primitive.ObjectID{jeb.ID}) {
+		t.Errorf("Expected the request flagged for follow-up, got %v", got)
+	}
+	dismissed := *followUp
+	dismissed.DismissedAt = &joinedAt
+	if err := store.SetFollowUp(jeb.ID, &dismissed); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(store.QueryRequests(flagged)); len(got) != 0 {
+		t.Errorf("Expected the dismissed follow-up to be left out, got %v", got)
+	}
+	if err := store.SetFollowUp(jeb.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if jeb, _ = store.GetRequest(jeb.ID); jeb.FollowUp != nil {
+		t.Errorf("Expected the follow-up to be cleared, got %+v", jeb.FollowUp)
+	}
+
+	// Approved players never recorded as whitelisted are stuck, until their state on the game server is recorded
+	isStuck := func() bool {
+		for _, id := range ids(store.StuckRequests(claimedAt.Add(-time.Second), claimedAt.Add(time.Second))) {
+			if id == jeb.ID {
+				return true
+			}
+		}
+		return false
+	}
+	if !isStuck() {
+		t.Error("Expected the approved player who was never whitelisted to be stuck")
+	}
+	if err := store.SetOnserverStatus(jeb.ID, types.StatusApproved, 0, types.OnserverWhitelisted); err != nil {
+		t.Fatal(err)
+	}
+	if isStuck() {
+		t.Error("Expected the whitelisted player not to be stuck")
+	}
+
+	// Prior requests of a network and the standing of referrers
+	prefix := "prefix-" + suffix
+	fromNetwork := func(username, bench string) types.WhitelistRequest {
+		return createRequest(types.WhitelistRequest{Username: username, ServerID: tenant, SubmissionIPPrefix: prefix, Bench: bench})
+	}
+	first, second := fromNetwork("First", ""), fromNetwork("Second", "")
+	fromNetwork("Benched", "bench-"+suffix)
+	network := db.RequestFilter{Tenants: []string{tenant}, SubmissionIPPrefix: prefix, ExcludeID: second.ID, NotBench: true}
+	if got := ids(store.QueryRequests(network)); !equalIDs(got, []primitive.ObjectID{first.ID}) {
+		t.Errorf("Expected the prior request of the network, got %v", got)
+	}
+	signals := types.NetworkSignals{PriorRequests: 1}
+	if err := store.SetNetworkSignals(second.ID, signals); err != nil {
+		t.Fatal(err)
+	}
+	if second, _ = store.GetRequest(second.ID); second.NetworkSignals == nil || second.NetworkSignals.PriorRequests != 1 {
+		t.Errorf("Expected the network signals to be recorded, got %+v", second.NetworkSignals)
+	}
+	if err := store.SetNetworkSignals(primitive.NewObjectID(), signals); err != db.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for unknown requests, got %v", err)
+	}
+	if err := store.SetReferral(first.ID, types.Referral{Standing: types.ReferrerMember}); err != nil {
+		t.Fatal(err)
+	}
+	if first, _ = store.GetRequest(first.ID); first.Referral == nil || len(first.Tags) != 0 {
+		t.Errorf("Expected the referral to be recorded without a tag, got %+v and %v", first.Referral, first.Tags)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.SetReferral(second.ID, types.Referral{Standing: types.ReferrerBanned}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if second, _ = store.GetRequest(second.ID); second.Referral == nil || len(second.Tags) != 1 || second.Tags[0] != types.TagUnverifiedReferrer {
+		t.Errorf("Expected the unverified referral to be tagged once, got %+v and %v", second.Referral, second.Tags)
+	}
+	if err := store.SetReferral(primitive.NewObjectID(), types.Referral{}); err != db.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for unknown requests, got %v", err)
+	}
+
+	// Only canary requests are completed
+	if err := store.CompleteCanary(herobrine.ID, claimedAt); err != db.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a request which is not a canary, got %v", err)
+	}
+	canary := createRequest(types.WhitelistRequest{Username: "canary_" + suffix, ServerID: tenant, Canary: true})
+	if err := store.CompleteCanary(canary.ID, claimedAt); err != nil {
+		t.Fatal(err)
+	}
+	if canary, _ = store.GetRequest(canary.ID); canary.CanaryCompletedTimestamp == nil || !canary.CanaryCompletedTimestamp.Equal(claimedAt) {
+		t.Errorf("Expected the completion of the canary to be recorded, got %v", canary.CanaryCompletedTimestamp)
+	}
+	if err := store.Ping(time.Second); err != nil {
+		t.Errorf("Expected the store to be reachable, got %v", err)
+	}
+
+	if err := store.DeleteRequest(steve.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetRequest(steve.ID); err != db.ErrNotFound {
+		t.Errorf("Expected the request to be deleted, got %v", err)
+	}
+	if err := store.DeleteRequest(steve.ID); err != nil {
+		t.Errorf("Expected deleting a missing request to succeed, got %v", err)
+	}
+}
+
+func equalIDs(a, b []primitive.ObjectID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
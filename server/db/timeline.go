@@ -0,0 +1,20 @@
+package db
+
+import (
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RecordMilestone appends the milestone to the timeline of the request unless a milestone of the same name has
+// been recorded already, so retried tasks keep the time the milestone was first reached
+func (s *Service) RecordMilestone(id primitive.ObjectID, milestone types.Milestone) error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	_, err := collection.UpdateOne(s.baseContext(), bson.M{
+		"_id":           id,
+		"timeline.name": bson.M{"$ne": milestone.Name},
+	}, bson.M{
+		"$push": bson.M{"timeline": milestone},
+	})
+	return err
+}
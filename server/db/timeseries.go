@@ -0,0 +1,149 @@
+package db
+
+import (
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Format of the UTC days the counts are grouped by
+const dayFormat = "%Y-%m-%d"
+
+// dayOf is the aggregation expression of the UTC day of the date field
+func dayOf(field string) bson.M {
+	return bson.M{"$dateToString": bson.M{"format": dayFormat, "date": "$" + field}}
+}
+
+// auditInTenant restricts the filter to the audit entries about requests of the tenant with the server ID.
+// Entries recorded before the server ID was added to their details count towards the default tenant
+func auditInTenant(filter interface{}, serverID string) bson.M {
+	tenantFilter := bson.M{"details.serverId": serverID}
+	if serverID == "" {
+		tenantFilter = bson.M{"details.serverId": bson.M{"$in": []interface{}{nil, ""}}}
+	}
+	return bson.M{"$and": []interface{}{filter, tenantFilter}}
+}
+
+// aggregate runs the pipeline on the collection and decodes every result into results, a pointer to a slice
+func (s *Service) aggregate(collectionName string, pipeline []bson.M, results interface{}) error {
+	collection := s.db.Database("mc-whitelist").Collection(collectionName)
+	cur, err := collection.Aggregate(s.baseContext(), pipeline)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(s.baseContext())
+	return cur.All(s.baseContext(), results)
+}
+
+// CountSubmissions counts the requests of the tenant submitted since the time by UTC day and hour of the day.
+// Canaries are left out
+func (s *Service) CountSubmissions(serverID string, since time.Time) ([]types.SubmissionCount, error) {
+	counts := make([]types.SubmissionCount, 0)
+	err := s.aggregate("requests", []bson.M{
+		{"$match": InTenant(ExcludeCanaries(bson.M{"timestamp": bson.M{"$gte": since}}), serverID)},
+		{"$group": bson.M{
+			"_id":   bson.M{"day": dayOf("timestamp"), "hour": bson.M{"$hour": "$timestamp"}},
+			"count": bson.M{"$sum": 1},
+		}},
+		{"$project": bson.M{"_id": 0, "day": "$_id.day", "hour": "$_id.hour", "count": 1}},
+	}, &counts)
+	return counts, err
+}
+
+// CountDecisions counts the requests of the tenant decided since the time by UTC day of the decision and
+// current status. Canaries are left out
+func (s *Service) CountDecisions(serverID string, since time.Time) ([]types.DecisionCount, error) {
+	counts := make([]types.DecisionCount, 0)
+	err := s.aggregate("requests", []bson.M{
+		{"$match": InTenant(ExcludeCanaries(bson.M{"decidedAt": bson.M{"$gte": since}}), serverID)},
+		{"$group": bson.M{
+			"_id":   bson.M{"day": dayOf("decidedAt"), "status": "$status"},
+			"count": bson.M{"$sum": 1},
+		}},
+		{"$project": bson.M{"_id": 0, "day": "$_id.day", "status": "$_id.status", "count": 1}},
+	}, &counts)
+	return counts, err
+}
+
+// CountOpDecisions counts the requests of the tenant each op approved or denied since the time by UTC day,
+// from the request updates recorded in the audit log
+func (s *Service) CountOpDecisions(serverID string, since time.Time) ([]types.OpDecisionCount, error) {
+	counts := make([]types.OpDecisionCount, 0)
+	err := s.aggregate("audit", []bson.M{
+		{"$match": auditInTenant(bson.M{
+			"action":         "request.update",
+			"timestamp":      bson.M{"$gte": since},
+			"details.status": bson.M{"$in": []string{types.StatusApproved, types.StatusDenied}},
+		}, serverID)},
+		{"$group": bson.M{
+			"_id":   bson.M{"day": dayOf("timestamp"), "op": "$actor", "status": "$details.status"},
+			"count": bson.M{"$sum": 1},
+		}},
+		{"$project": bson.M{"_id": 0, "day": "$_id.day", "op": "$_id.op", "status": "$_id.status", "count": 1}},
+	}, &counts)
+	return counts, err
+}
+
+// CountOpResponses counts the requests of the tenant sent to each op, the requests the op decided first with
+// their response times, and the requests escalated past the op. Requests sent to the op several times count
+// once, from the first time. Canaries are left out
+func (s *Service) CountOpResponses(serverID string) ([]types.OpResponseStats, error) {
+	counts := make([]types.OpResponseStats, 0)
+	err := s.aggregate("requests", []bson.M{
+		{"$match": InTenant(ExcludeCanaries(bson.M{"dispatches.0": bson.M{"$exists": true}}), serverID)},
+		{"$unwind": "$dispatches"},
+		{"$group": bson.M{
+			"_id":                bson.M{"request": "$_id", "op": "$dispatches.op"},
+			"dispatchedAt":       bson.M{"$min": "$dispatches.timestamp"},
+			"respondedBy":        bson.M{"$first": "$respondedBy"},
+			"responseTime":       bson.M{"$first": "$responseTimeInMinutes"},
+			"escalated":          bson.M{"$first": "$escalated"},
+			"escalatedTimestamp": bson.M{"$first": "$escalatedTimestamp"},
+		}},
+		// Only the op who made the first decision responded, later changes of the request are not responses
+		{"$addFields": bson.M{"decided": bson.M{"$eq": []interface{}{"$respondedBy", "$_id.op"}}}},
+		{"$group": bson.M{
+			"_id":           "$_id.op",
+			"assigned":      bson.M{"$sum": 1},
+			"decided":       bson.M{"$sum": bson.M{"$cond": []interface{}{"$decided", 1, 0}}},
+			"responseTimes": bson.M{"$push": bson.M{"$cond": []interface{}{"$decided", "$responseTime", nil}}},
+			"escalatedPast": bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$and": []interface{}{
+				bson.M{"$eq": []interface{}{"$escalated", true}},
+				bson.M{"$lt": []interface{}{"$dispatchedAt", "$escalatedTimestamp"}},
+				bson.M{"$not": []interface{}{"$decided"}},
+			}}, 1, 0}}},
+		}},
+		{"$project": bson.M{"_id": 0, "op": "$_id", "assigned": 1, "decided": 1, "responseTimes": 1, "escalatedPast": 1}},
+	}, &counts)
+	return counts, err
+}
+
+// CountReferrals counts the applicants of the tenant each referrer vouched for, how many of them are approved and
+// how many got banned, most banned applicants first. Referrers are matched ignoring case. Canaries are left out
+func (s *Service) CountReferrals(serverID string) ([]types.ReferrerStats, error) {
+	counts := make([]types.ReferrerStats, 0)
+	err := s.aggregate("requests", []bson.M{
+		{"$match": InTenant(ExcludeCanaries(bson.M{"referrerUsername": bson.M{"$nin": []interface{}{nil, ""}}}), serverID)},
+		{"$group": bson.M{
+			"_id":      bson.M{"$toLower": "$referrerUsername"},
+			"referrer": bson.M{"$first": "$referrerUsername"},
+			"vouched":  bson.M{"$sum": 1},
+			"approved": bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$eq": []interface{}{"$status", types.StatusApproved}}, 1, 0}}},
+			"banned":   bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$eq": []interface{}{"$status", types.StatusBanned}}, 1, 0}}},
+		}},
+		{"$sort": bson.D{{Key: "banned", Value: -1}, {Key: "vouched", Value: -1}, {Key: "_id", Value: 1}}},
+		{"$project": bson.M{"_id": 0, "referrer": 1, "vouched": 1, "approved": 1, "banned": 1}},
+	}, &counts)
+	return counts, err
+}
+
+// EnsureAuditIndexes creates the index used to count the decisions of ops
+func (s *Service) EnsureAuditIndexes() error {
+	collection := s.db.Database("mc-whitelist").Collection("audit")
+	_, err := collection.Indexes().CreateMany(s.baseContext(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "timestamp", Value: -1}}},
+	})
+	return err
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrConflict is returned by TransitionStatus if the request is no longer in the expected status, e.g another
+// op decided it in the meantime
+var ErrConflict = errors.New("Request has been changed concurrently")
+
+// TransitionStatus moves the request from fromStatus to toStatus, applying the rest of the update with it, e.g
+// the metadata of a decision. The request is matched by both its ID and fromStatus in one atomic update, so of
+// concurrent transitions from the same status only the first is stored and published. The sequence of the
+// request is incremented, so the task of the transition supersedes older ones. Returns ErrConflict if the
+// request is not in fromStatus, or does not exist
+func (s *Service) TransitionStatus(id primitive.ObjectID, fromStatus, toStatus string, update bson.M) (types.WhitelistRequest, error) {
+	return Transition(s, id, fromStatus, toStatus, update)
+}
+
+// TransitionStatus moves the status of the request in the transaction, see Service.TransitionStatus
+func (tx Tx) TransitionStatus(id primitive.ObjectID, fromStatus, toStatus string, update bson.M) (types.WhitelistRequest, error) {
+	return Transition(tx, id, fromStatus, toStatus, update)
+}
+
+// Transition moves the status of the request with the writer, see Service.TransitionStatus. The update is not
+// modified
+func Transition(writer RequestWriter, id primitive.ObjectID, fromStatus, toStatus string, update bson.M) (types.WhitelistRequest, error) {
+	transition := bson.M{}
+	for operator, fields := range update {
+		transition[operator] = fields
+	}
+	set := bson.M{}
+	if fields, ok := update["$set"].(bson.M); ok {
+		for field, value := range fields {
+			set[field] = value
+		}
+	}
+	set["status"] = toStatus
+	transition["$set"] = set
+	inc := bson.M{}
+	if fields, ok := update["$inc"].(bson.M); ok {
+		for field, value := range fields {
+			inc[field] = value
+		}
+	}
+	transition["$inc"] = inc
+	transition = WithNextSequence(transition)
+	request, err := writer.ConditionalUpdateRequest(bson.M{"_id": id, "status": fromStatus}, transition)
+	if err == mongo.ErrNoDocuments {
+		return types.WhitelistRequest{}, ErrConflict
+	}
+	return request, err
+}
@@ -0,0 +1,21 @@
+package db
+
+import (
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AddVote atomically adds the vote of the op to the pending request and returns the request with every vote
+// cast so far. Returns mongo.ErrNoDocuments if the request is no longer pending or the op has already voted.
+// The vote completing the quorum always sees the votes cast before it, so the request is decided once
+// every vote is in even if ops vote concurrently
+func (s *Service) AddVote(id primitive.ObjectID, vote types.Vote) (types.WhitelistRequest, error) {
+	return s.ConditionalUpdateRequest(bson.M{
+		"_id":      id,
+		"status":   types.StatusPending,
+		"votes.op": bson.M{"$ne": vote.Op},
+	}, bson.M{
+		"$push": bson.M{"votes": vote},
+	})
+}
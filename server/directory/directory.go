@@ -0,0 +1,84 @@
+// Package directory builds the public member directory of approved players.
+// Only the username, join date and avatar are exported. Emails and other application details
+// never leave the system, and players who opted out are left out entirely
+package directory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// Avatars are rendered by Crafatar from the player's Mojang UUID
+const avatarURLFormat = "https://crafatar.com/avatars/%s?overlay"
+
+var uuidPattern = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// Member is an entry of the directory
+type Member struct {
+	Username  string    `json:"username"`
+	JoinedAt  time.Time `json:"joinedAt"`
+	AvatarURL string    `json:"avatarUrl,omitempty"`
+}
+
+// Directory is the blob published for the community website
+type Directory struct {
+	Members          []Member  `json:"members"`
+	UpdatedTimestamp time.Time `json:"updatedTimestamp"`
+}
+
+// Members lists the approved players who did not opt out, oldest members first.
+// Avatar URLs are only included if withAvatars is set and the player's UUID is known
+func Members(requests []types.WhitelistRequest, withAvatars bool) []Member {
+	members := make([]Member, 0)
+	for _, request := range requests {
+		if request.Status != types.StatusApproved || request.DirectoryOptOut || request.Canary {
+			continue
+		}
+		member := Member{
+			Username: request.Username,
+			JoinedAt: request.ProcessedTimestamp,
+		}
+		if withAvatars {
+			member.AvatarURL, _ = AvatarURL(request.UUID)
+		}
+		members = append(members, member)
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		return members[i].JoinedAt.Before(members[j].JoinedAt)
+	})
+	return members
+}
+
+// AvatarURL derives the avatar URL from a Mojang UUID, with or without dashes.
+// Returns false if the UUID is not valid
+func AvatarURL(uuid string) (string, bool) {
+	normalized := strings.ToLower(strings.Replace(uuid, "-", "", -1))
+	if !uuidPattern.MatchString(normalized) {
+		return "", false
+	}
+	return fmt.Sprintf(avatarURLFormat, normalized), true
+}
+
+// WriteCSV writes the members as CSV with a header row
+func WriteCSV(w io.Writer, members []Member) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"username", "joinedAt", "avatarUrl"})
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		err := writer.Write([]string{member.Username, member.JoinedAt.UTC().Format(time.RFC3339), member.AvatarURL})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,88 @@
+package directory_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/directory"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+var joined = time.Date(2019, 11, 1, 12, 0, 0, 0, time.UTC)
+
+func requests() []types.WhitelistRequest {
+	return []types.WhitelistRequest{
+		{Username: "alex", Email: "alex@example.com", Status: types.StatusApproved, ProcessedTimestamp: joined.Add(time.Hour),
+			UUID: "853c80ef-3c37-49fd-aa49-938b674adae6", Info: map[string]interface{}{"applicationText": "secret"}},
+		{Username: "steve", Email: "steve@example.com", Status: types.StatusApproved, ProcessedTimestamp: joined},
+		{Username: "hidden", Email: "hidden@example.com", Status: types.StatusApproved, ProcessedTimestamp: joined, DirectoryOptOut: true},
+		{Username: "pending", Email: "pending@example.com", Status: types.StatusPending},
+		{Username: "banned", Email: "banned@example.com", Status: types.StatusBanned, ProcessedTimestamp: joined},
+		{Username: "canary_1", Email: "canary_1@canary.invalid", Status: types.StatusApproved, ProcessedTimestamp: joined, Canary: true},
+	}
+}
+
+func TestMembersExcludeOptedOutAndNonMembers(t *testing.T) {
+	members := directory.Members(requests(), true)
+	if len(members) != 2 {
+		t.Fatalf("Expected 2 members, got %+v", members)
+	}
+	if members[0].Username != "steve" || members[1].Username != "alex" {
+		t.Errorf("Expected members ordered by join date, got %+v", members)
+	}
+	if members[0].AvatarURL != "" {
+		t.Errorf("Expected no avatar without uuid, got %s", members[0].AvatarURL)
+	}
+	if members[1].AvatarURL != "https://crafatar.com/avatars/853c80ef3c3749fdaa49938b674adae6?overlay" {
+		t.Errorf("Unexpected avatar url %s", members[1].AvatarURL)
+	}
+	if withoutAvatars := directory.Members(requests(), false); withoutAvatars[1].AvatarURL != "" {
+		t.Errorf("Expected avatars to be left out if disabled, got %s", withoutAvatars[1].AvatarURL)
+	}
+}
+
+func TestExportsNeverContainPrivateDetails(t *testing.T) {
+	members := directory.Members(requests(), true)
+	encoded, err := json.Marshal(directory.Directory{Members: members})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var csv bytes.Buffer
+	if err := directory.WriteCSV(&csv, members); err != nil {
+		t.Fatal(err)
+	}
+	for name, export := range map[string]string{"json": string(encoded), "csv": csv.String()} {
+		for _, private := range []string{"@example.com", "secret", "hidden"} {
+			if strings.Contains(export, private) {
+				t.Errorf("Expected %s export not to contain %q, got %s", name, private, export)
+			}
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	if len(lines) != 3 || lines[0] != "username,joinedAt,avatarUrl" || lines[1] != "steve,2019-11-01T12:00:00Z," {
+		t.Errorf("Unexpected csv export %q", csv.String())
+	}
+}
+
+func TestAvatarURL(t *testing.T) {
+	cases := map[string]bool{
+		"853c80ef3c3749fdaa49938b674adae6":     true,
+		"853C80EF-3C37-49FD-AA49-938B674ADAE6": true,
+		"":                                     false,
+		"853c80ef":                             false,
+		"853c80ef3c3749fdaa49938b674adae6/../": false,
+		"zz3c80ef3c3749fdaa49938b674adae6":     false,
+	}
+	for uuid, valid := range cases {
+		url, ok := directory.AvatarURL(uuid)
+		if ok != valid {
+			t.Errorf("Expected uuid %q validity %v, got %v", uuid, valid, ok)
+		}
+		if ok && url != "https://crafatar.com/avatars/853c80ef3c3749fdaa49938b674adae6?overlay" {
+			t.Errorf("Unexpected avatar url %s for %q", url, uuid)
+		}
+	}
+}
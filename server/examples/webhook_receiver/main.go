@@ -0,0 +1,68 @@
+// Command webhook_receiver is a minimal receiver of the webhooks sent by gatekeeper. It verifies the
+// signature of every request and logs the status changes of requests.
+//
+//	WEBHOOK_KEY_ID=2019-11 WEBHOOK_SECRET=new-secret go run ./examples/webhook_receiver -addr :9000
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/webhook"
+)
+
+// Requests signed longer ago are rejected so captured requests can not be replayed
+const maxSignatureAge = 5 * time.Minute
+
+func main() {
+	addr := flag.String("addr", ":9000", "address to listen on")
+	flag.Parse()
+	keys := []webhook.Key{{ID: os.Getenv("WEBHOOK_KEY_ID"), Secret: os.Getenv("WEBHOOK_SECRET")}}
+	if keys[0].ID == "" || keys[0].Secret == "" {
+		log.Fatal("WEBHOOK_KEY_ID and WEBHOOK_SECRET are required")
+	}
+	http.Handle("/", handler(keys))
+	log.Printf("Listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func handler(keys []webhook.Key) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Unable to read body", http.StatusBadRequest)
+			return
+		}
+		timestamp, err := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+		if err != nil || time.Since(time.Unix(timestamp, 0)) > maxSignatureAge {
+			http.Error(w, "Invalid timestamp", http.StatusUnauthorized)
+			return
+		}
+		if !webhook.Verify(keys, timestamp, body, r.Header.Get(webhook.SignatureHeader)) {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+		var event struct {
+			Event string               `json:"event"`
+			Data  webhook.StatusChange `json:"data"`
+		}
+		err = json.Unmarshal(body, &event)
+		if err != nil {
+			http.Error(w, "Unable to decode event", http.StatusBadRequest)
+			return
+		}
+		if event.Event == webhook.StatusChangeEvent {
+			log.Printf("Request %s of %s: %q -> %q", event.Data.RequestID, event.Data.Username,
+				event.Data.PreviousStatus, event.Data.Status)
+		} else {
+			log.Printf("Received %s event", event.Event)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
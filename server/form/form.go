@@ -0,0 +1,155 @@
+// Package form reads the custom fields communities add to the application form, e.g a referral source or the
+// acknowledgment of the rules, and validates the answers of applicants against them
+package form
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// Answers longer than this are rejected if the field sets no maxLength
+const defaultMaxLength = 500
+
+// Keys are sent by the frontend and stored in requests so they are restricted to a safe alphabet
+var keyPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// ErrInvalidAnswers is returned for answers to fields the form does not have
+var ErrInvalidAnswers = errors.New("Answers do not match the fields of the application form")
+
+// Field is a custom field of the application form. Categorical fields list the Options applicants choose from
+type Field struct {
+	Key       string   `mapstructure:"key" json:"key"`
+	Label     string   `mapstructure:"label" json:"label"`
+	Required  bool     `mapstructure:"required" json:"required"`
+	MaxLength int      `mapstructure:"maxLength" json:"maxLength"`
+	Options   []string `mapstructure:"options" json:"options,omitempty"`
+}
+
+// Fields reads the custom fields of the application form of the tenant, configured in applicationFields
+func Fields(cfg tenant.Config) ([]Field, error) {
+	var fields []Field
+	err := cfg.UnmarshalKey("applicationFields", &fields)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for i, field := range fields {
+		if !keyPattern.MatchString(field.Key) {
+			return nil, fmt.Errorf("Application field key %q may only contain letters, digits and _", field.Key)
+		}
+		if seen[field.Key] {
+			return nil, fmt.Errorf("Duplicate application field key %s", field.Key)
+		}
+		seen[field.Key] = true
+		if field.Label == "" {
+			fields[i].Label = field.Key
+		}
+		if field.MaxLength <= 0 {
+			fields[i].MaxLength = defaultMaxLength
+		}
+	}
+	return fields, nil
+}
+
+// BreakdownField returns the categorical field whose answers the approval rate is broken down by in the stats
+// of the tenant, configured in statsBreakdownField. False if none is configured
+func BreakdownField(cfg tenant.Config) (Field, bool, error) {
+	key := cfg.GetString("statsBreakdownField")
+	if key == "" {
+		return Field{}, false, nil
+	}
+	fields, err := Fields(cfg)
+	if err != nil {
+		return Field{}, false, err
+	}
+	for _, field := range fields {
+		if field.Key == key {
+			if len(field.Options) == 0 {
+				return Field{}, false, fmt.Errorf("statsBreakdownField %s is not a field with options", key)
+			}
+			return field, true, nil
+		}
+	}
+	return Field{}, false, fmt.Errorf("statsBreakdownField %s is not a field of the application form", key)
+}
+
+// Validate checks the application fields and the stats breakdown field of every tenant
+func Validate() error {
+	for _, cfg := range tenant.All() {
+		_, _, err := BreakdownField(cfg)
+		if err == nil {
+			_, err = Fields(cfg)
+		}
+		if err != nil {
+			if cfg.ID != "" {
+				return fmt.Errorf("tenants.%s: %s", cfg.ID, err.Error())
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateAnswers checks the answers against the fields and returns them in the order of the fields, labeled
+// and trimmed. Empty answers to optional fields are left out
+func ValidateAnswers(fields []Field, answers []types.Answer) ([]types.Answer, error) {
+	values := make(map[string]string, len(answers))
+	for _, answer := range answers {
+		if _, ok := values[answer.Key]; ok {
+			return nil, ErrInvalidAnswers
+		}
+		values[answer.Key] = strings.TrimSpace(answer.Value)
+	}
+	validated := make([]types.Answer, 0, len(fields))
+	for _, field := range fields {
+		value := values[field.Key]
+		delete(values, field.Key)
+		if value == "" {
+			if field.Required {
+				return nil, fmt.Errorf("%s is required", field.Label)
+			}
+			continue
+		}
+		if utf8.RuneCountInString(value) > field.MaxLength {
+			return nil, fmt.Errorf("%s may be at most %d characters long", field.Label, field.MaxLength)
+		}
+		if len(field.Options) > 0 {
+			option, ok := matchOption(field.Options, value)
+			if !ok {
+				return nil, fmt.Errorf("%s must be one of %s", field.Label, strings.Join(field.Options, ", "))
+			}
+			value = option
+		}
+		validated = append(validated, types.Answer{Key: field.Key, Label: field.Label, Value: value})
+	}
+	if len(values) > 0 {
+		return nil, ErrInvalidAnswers
+	}
+	return validated, nil
+}
+
+// matchOption returns the option matching the value, ignoring case
+func matchOption(options []string, value string) (string, bool) {
+	for _, option := range options {
+		if strings.EqualFold(option, value) {
+			return option, true
+		}
+	}
+	return "", false
+}
+
+// AnswerTo returns the answer of the request to the field, empty if it did not answer it
+func AnswerTo(request types.WhitelistRequest, key string) string {
+	for _, answer := range request.Answers {
+		if answer.Key == key {
+			return answer.Value
+		}
+	}
+	return ""
+}
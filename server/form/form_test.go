@@ -0,0 +1,117 @@
+package form
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+func setFields() {
+	viper.Set("applicationFields", []interface{}{
+		map[string]interface{}{"key": "referral", "label": "How did you find us?", "required": true, "options": []interface{}{"Friend", "Reddit"}},
+		map[string]interface{}{"key": "rules", "label": "I have read the rules", "required": true},
+		map[string]interface{}{"key": "about", "maxLength": 10},
+	})
+	viper.Set("statsBreakdownField", "referral")
+	viper.Set("tenants", map[string]interface{}{
+		"creative": map[string]interface{}{
+			"applicationFields": []interface{}{},
+		},
+	})
+}
+
+func TestFields(t *testing.T) {
+	setFields()
+	defer viper.Reset()
+	fields, err := Fields(tenant.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 3 || fields[0].Label != "How did you find us?" || fields[1].MaxLength != defaultMaxLength {
+		t.Errorf("Expected the configured fields, got %+v", fields)
+	}
+	if fields[2].Label != "about" || fields[2].MaxLength != 10 {
+		t.Errorf("Expected the key as label of a field without label, got %+v", fields[2])
+	}
+	fields, err = Fields(tenant.Config{ID: "creative"})
+	if err != nil || len(fields) != 0 {
+		t.Errorf("Expected the tenant to override the fields, got %+v %v", fields, err)
+	}
+	if err := Validate(); err == nil || !strings.Contains(err.Error(), "tenants.creative") {
+		t.Errorf("Expected the breakdown field to be missing from the form of the tenant, got %v", err)
+	}
+
+	for _, fields := range [][]interface{}{
+		{map[string]interface{}{"key": "<b>"}},
+		{map[string]interface{}{"key": "rules"}, map[string]interface{}{"key": "rules"}},
+	} {
+		viper.Set("applicationFields", fields)
+		if _, err := Fields(tenant.Default); err == nil {
+			t.Errorf("Expected %v to be rejected", fields)
+		}
+	}
+}
+
+func TestBreakdownField(t *testing.T) {
+	setFields()
+	defer viper.Reset()
+	field, ok, err := BreakdownField(tenant.Default)
+	if err != nil || !ok || field.Key != "referral" {
+		t.Errorf("Expected the referral field, got %+v %v %v", field, ok, err)
+	}
+	viper.Set("statsBreakdownField", "about")
+	if _, _, err := BreakdownField(tenant.Default); err == nil {
+		t.Error("Expected a field without options to be rejected")
+	}
+	viper.Set("statsBreakdownField", "")
+	if _, ok, err := BreakdownField(tenant.Default); ok || err != nil {
+		t.Errorf("Expected no breakdown, got %v %v", ok, err)
+	}
+}
+
+func TestValidateAnswers(t *testing.T) {
+	setFields()
+	defer viper.Reset()
+	fields, err := Fields(tenant.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, err := ValidateAnswers(fields, []types.Answer{
+		{Key: "about", Value: "  builder "},
+		{Key: "rules", Value: "yes"},
+		{Key: "referral", Value: "reddit", Label: "Forged label"},
+	})
+	expected := []types.Answer{
+		{Key: "referral", Label: "How did you find us?", Value: "Reddit"},
+		{Key: "rules", Label: "I have read the rules", Value: "yes"},
+		{Key: "about", Label: "about", Value: "builder"},
+	}
+	if err != nil || !reflect.DeepEqual(answers, expected) {
+		t.Errorf("Expected the answers in the order of the form, got %+v %v", answers, err)
+	}
+
+	for _, answers := range [][]types.Answer{
+		// Required answer missing
+		{{Key: "referral", Value: "Friend"}},
+		{{Key: "referral", Value: "Friend"}, {Key: "rules", Value: " "}},
+		// Not an option
+		{{Key: "referral", Value: "Forum"}, {Key: "rules", Value: "yes"}},
+		// Too long
+		{{Key: "referral", Value: "Friend"}, {Key: "rules", Value: "yes"}, {Key: "about", Value: "building redstone"}},
+		// Unknown field
+		{{Key: "referral", Value: "Friend"}, {Key: "rules", Value: "yes"}, {Key: "discord", Value: "steve#1234"}},
+		// Answered twice
+		{{Key: "referral", Value: "Friend"}, {Key: "rules", Value: "yes"}, {Key: "rules", Value: "no"}},
+	} {
+		if _, err := ValidateAnswers(fields, answers); err == nil {
+			t.Errorf("Expected %+v to be rejected", answers)
+		}
+	}
+	if answers, err := ValidateAnswers(nil, nil); err != nil || len(answers) != 0 {
+		t.Errorf("Expected no answers without fields, got %+v %v", answers, err)
+	}
+}
@@ -0,0 +1,300 @@
+// Package geoip looks up the country of addresses in a local MaxMind database, e.g GeoLite2-Country.mmdb.
+// Only what country lookups need of the MaxMind DB format is implemented
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// The metadata section starts after the last occurrence of the marker
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// The search tree and the data section are separated by 16 zero bytes
+const dataSectionSeparator = 16
+
+// Data types of the data section
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// errInvalidDatabase is returned for files that are not valid MaxMind databases
+var errInvalidDatabase = errors.New("Invalid MaxMind database")
+
+// Reader looks up addresses in a MaxMind database read into memory
+type Reader struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// Offset of the data section in buf
+	dataStart int
+}
+
+// Open reads the MaxMind database at the path
+func Open(path string) (*Reader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(buf)
+}
+
+// New reads the MaxMind database in buf
+func New(buf []byte) (*Reader, error) {
+	start := bytes.LastIndex(buf, metadataMarker)
+	if start < 0 {
+		return nil, errInvalidDatabase
+	}
+	metadataStart := start + len(metadataMarker)
+	metadata, _, err := (&decoder{buf: buf[metadataStart:]}).decode(0)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := metadata.(map[string]interface{})
+	if !ok {
+		return nil, errInvalidDatabase
+	}
+	r := &Reader{buf: buf}
+	for key, target := range map[string]*uint{"node_count": &r.nodeCount, "record_size": &r.recordSize, "ip_version": &r.ipVersion} {
+		value, ok := fields[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("%s: missing %s", errInvalidDatabase.Error(), key)
+		}
+		*target = uint(value)
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", errInvalidDatabase.Error(), r.recordSize)
+	}
+	r.dataStart = int(r.nodeCount*r.recordSize/4) + dataSectionSeparator
+	if r.dataStart > start {
+		return nil, errInvalidDatabase
+	}
+	return r, nil
+}
+
+// Country returns the ISO code of the country of the address, or of the country it is registered in if the
+// database does not know where it is used. Empty if the address is not in the database
+func (r *Reader) Country(ip net.IP) (string, error) {
+	record, err := r.lookup(ip)
+	if err != nil || record == nil {
+		return "", err
+	}
+	fields, _ := record.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := fields[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok && code != "" {
+				return code, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// lookup returns the record of the network of the address, nil if there is none
+func (r *Reader) lookup(ip net.IP) (interface{}, error) {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+	node := uint(0)
+	// IPv4 addresses are stored under ::/96 of IPv6 databases
+	if r.ipVersion == 6 && len(ip) == net.IPv4len {
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+	}
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	} else if node < r.nodeCount {
+		return nil, errInvalidDatabase
+	}
+	offset := int(node-r.nodeCount) - dataSectionSeparator
+	record, _, err := (&decoder{buf: r.buf[r.dataStart:]}).decode(offset)
+	return record, err
+}
+
+// record returns the left (bit 0) or right (bit 1) record of the node
+func (r *Reader) record(node, bit uint) uint {
+	b := r.buf[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// decoder decodes values of a data section. Offsets are relative to the start of buf
+type decoder struct {
+	buf []byte
+}
+
+// decode returns the value at the offset and the offset after it
+func (d *decoder) decode(offset int) (interface{}, int, error) {
+	if offset < 0 || offset >= len(d.buf) {
+		return nil, 0, errInvalidDatabase
+	}
+	control := d.buf[offset]
+	offset++
+	kind := int(control >> 5)
+	if kind == typePointer {
+		target, next, err := d.pointer(control, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(target)
+		return value, next, err
+	}
+	if kind == typeExtended {
+		if offset >= len(d.buf) {
+			return nil, 0, errInvalidDatabase
+		}
+		kind = 7 + int(d.buf[offset])
+		offset++
+	}
+	size, offset, err := d.size(control, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch kind {
+	case typeMap:
+		fields := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			var key, value interface{}
+			key, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errInvalidDatabase
+			}
+			fields[name] = value
+		}
+		return fields, offset, nil
+	case typeArray:
+		values := make([]interface{}, size)
+		for i := range values {
+			values[i], offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return values, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+	if offset+size > len(d.buf) {
+		return nil, 0, errInvalidDatabase
+	}
+	payload := d.buf[offset : offset+size]
+	offset += size
+	switch kind {
+	case typeString:
+		return string(payload), offset, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), payload...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errInvalidDatabase
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errInvalidDatabase
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(payload))), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		return uintOf(payload), offset, nil
+	case typeInt32:
+		return int64(int32(uintOf(payload))), offset, nil
+	}
+	return nil, 0, fmt.Errorf("%s: unsupported data type %d", errInvalidDatabase.Error(), kind)
+}
+
+// size returns the size in the control byte, extended by the bytes after it for large sizes
+func (d *decoder) size(control byte, offset int) (int, int, error) {
+	size := int(control & 0x1F)
+	if size < 29 {
+		return size, offset, nil
+	}
+	extra := size - 28
+	if offset+extra > len(d.buf) {
+		return 0, 0, errInvalidDatabase
+	}
+	value := int(uintOf(d.buf[offset : offset+extra]))
+	switch extra {
+	case 1:
+		size = 29 + value
+	case 2:
+		size = 285 + value
+	default:
+		size = 65821 + value
+	}
+	return size, offset + extra, nil
+}
+
+// pointer returns the offset the pointer points to and the offset after it
+func (d *decoder) pointer(control byte, offset int) (int, int, error) {
+	n := int(control>>3)&0x3 + 1
+	if offset+n > len(d.buf) {
+		return 0, 0, errInvalidDatabase
+	}
+	b := d.buf[offset : offset+n]
+	value := uint64(control & 0x7)
+	switch n {
+	case 1:
+		value = value<<8 | uintOf(b)
+	case 2:
+		value = (value<<16 | uintOf(b)) + 2048
+	case 3:
+		value = (value<<24 | uintOf(b)) + 526336
+	default:
+		value = uintOf(b)
+	}
+	return int(value), offset + n, nil
+}
+
+func uintOf(b []byte) uint64 {
+	var value uint64
+	for _, c := range b {
+		value = value<<8 | uint64(c)
+	}
+	return value
+}
@@ -0,0 +1,92 @@
+package geoip
+
+import (
+	"net"
+	"testing"
+)
+
+// encodeString encodes a short UTF-8 string of the data section
+func encodeString(s string) []byte {
+	return append([]byte{typeString<<5 | byte(len(s))}, s...)
+}
+
+// encodeMap encodes a map of the data section from its already encoded keys and values
+func encodeMap(entries ...[]byte) []byte {
+	encoded := []byte{typeMap<<5 | byte(len(entries)/2)}
+	for _, entry := range entries {
+		encoded = append(encoded, entry...)
+	}
+	return encoded
+}
+
+func encodeUint16(v uint16) []byte {
+	return []byte{typeUint16<<5 | 2, byte(v >> 8), byte(v)}
+}
+
+// testDatabase returns an IPv4 database with 24 bit records holding the country of the network only
+func testDatabase(network *net.IPNet, data []byte) []byte {
+	ones, _ := network.Mask.Size()
+	nodeCount := uint(ones)
+	var tree []byte
+	for i := 0; i < ones; i++ {
+		bit := (network.IP.To4()[i/8] >> (7 - uint(i%8))) & 1
+		next := uint(i + 1)
+		if i == ones-1 {
+			// The record points to the start of the data section
+			next = nodeCount + dataSectionSeparator
+		}
+		records := [2]uint{nodeCount, nodeCount}
+		records[bit] = next
+		for _, record := range records {
+			tree = append(tree, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+	buf := append(tree, make([]byte, dataSectionSeparator)...)
+	buf = append(buf, data...)
+	buf = append(buf, metadataMarker...)
+	return append(buf, encodeMap(
+		encodeString("node_count"), encodeUint16(uint16(nodeCount)),
+		encodeString("record_size"), encodeUint16(24),
+		encodeString("ip_version"), encodeUint16(4),
+	)...)
+}
+
+func TestCountry(t *testing.T) {
+	_, network, _ := net.ParseCIDR("81.2.69.0/24")
+	data := encodeMap(encodeString("country"), encodeMap(encodeString("iso_code"), encodeString("GB")))
+	reader, err := New(testDatabase(network, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"81.2.69.160": "GB",
+		"81.2.69.1":   "GB",
+		"81.2.70.1":   "",
+		"8.8.8.8":     "",
+		"2001:db8::1": "",
+	}
+	for ip, expected := range tests {
+		country, err := reader.Country(net.ParseIP(ip))
+		if err != nil || country != expected {
+			t.Errorf("Country(%s) = %q %v, want %q", ip, country, err, expected)
+		}
+	}
+}
+
+func TestRegisteredCountry(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	data := encodeMap(encodeString("registered_country"), encodeMap(encodeString("iso_code"), encodeString("DE")))
+	reader, err := New(testDatabase(network, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if country, err := reader.Country(net.ParseIP("10.1.2.3")); err != nil || country != "DE" {
+		t.Errorf("Expected the registered country, got %q %v", country, err)
+	}
+}
+
+func TestInvalidDatabase(t *testing.T) {
+	if _, err := New([]byte("not a database")); err == nil {
+		t.Error("Expected a file without metadata to be rejected")
+	}
+}
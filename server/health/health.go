@@ -0,0 +1,150 @@
+// Package health serves liveness and readiness endpoints reflecting the state of the dependencies,
+// e.g to be used as Kubernetes probes:
+//
+//	/healthz: liveness checks only. Fails if the process can not recover by itself
+//	/readyz:  liveness and readiness checks. Fails while a dependency is unavailable
+//
+// Both return 200 if all checks pass and 503 otherwise, with a JSON body reporting every check
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Check reports the state of a dependency. A nil error means healthy
+type Check func() error
+
+// Cached wraps the check to only run it once per ttl so frequent probes do not hammer the dependency
+func Cached(check Check, ttl time.Duration) Check {
+	var mu sync.Mutex
+	var lastErr error
+	var lastRun time.Time
+	return func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !lastRun.IsZero() && time.Since(lastRun) < ttl {
+			return lastErr
+		}
+		lastErr = check()
+		lastRun = time.Now()
+		return lastErr
+	}
+}
+
+// Result is the JSON body returned by the endpoints
+type Result struct {
+	Status string `json:"status"`
+	// Result of every check, "ok" or the error message
+	Checks map[string]string `json:"checks"`
+	// Names of the failed checks
+	Failed []string `json:"failed"`
+}
+
+// Service holds the registered liveness and readiness checks
+type Service struct {
+	mu        sync.RWMutex
+	liveness  map[string]Check
+	readiness map[string]Check
+}
+
+// NewService creates a health service without any checks
+func NewService() *Service {
+	return &Service{
+		liveness:  make(map[string]Check),
+		readiness: make(map[string]Check),
+	}
+}
+
+// AddLivenessCheck registers a check run by both endpoints
+func (s *Service) AddLivenessCheck(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.liveness[name] = check
+}
+
+// AddReadinessCheck registers a check only run by the readiness endpoint
+func (s *Service) AddReadinessCheck(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readiness[name] = check
+}
+
+// Live runs the liveness checks
+func (s *Service) Live() Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return run(s.liveness)
+}
+
+// Ready runs the liveness and readiness checks
+func (s *Service) Ready() Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	checks := make(map[string]Check, len(s.liveness)+len(s.readiness))
+	for name, check := range s.liveness {
+		checks[name] = check
+	}
+	for name, check := range s.readiness {
+		checks[name] = check
+	}
+	return run(checks)
+}
+
+// Handler serves /healthz and /readyz
+func (s *Service) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, s.Live())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, s.Ready())
+	})
+	return mux
+}
+
+// Checks run concurrently so a slow dependency does not delay the others
+func run(checks map[string]Check) Result {
+	result := Result{
+		Status: "ok",
+		Checks: make(map[string]string, len(checks)),
+		Failed: make([]string, 0),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			err := check()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result.Checks[name] = err.Error()
+				result.Failed = append(result.Failed, name)
+			} else {
+				result.Checks[name] = "ok"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	if len(result.Failed) > 0 {
+		result.Status = "unavailable"
+		sort.Strings(result.Failed)
+	}
+	return result
+}
+
+func writeResult(w http.ResponseWriter, result Result) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if len(result.Failed) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(result)
+}
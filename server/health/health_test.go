@@ -0,0 +1,68 @@
+package health_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/health"
+)
+
+func getResult(t *testing.T, handler http.Handler, path string, expectedCode int) health.Result {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+	if rr.Code != expectedCode {
+		t.Fatalf("Expected status code %d for %s, got %d", expectedCode, path, rr.Code)
+	}
+	var result health.Result
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestReadinessReportsFailedChecks(t *testing.T) {
+	svc := health.NewService()
+	svc.AddLivenessCheck("amqp", func() error { return nil })
+	svc.AddReadinessCheck("mongo", func() error { return nil })
+	svc.AddReadinessCheck("rcon", func() error { return errors.New("i/o timeout") })
+	handler := svc.Handler()
+
+	// A game server outage does not make the process unhealthy
+	result := getResult(t, handler, "/healthz", http.StatusOK)
+	if result.Status != "ok" || len(result.Checks) != 1 || result.Checks["amqp"] != "ok" {
+		t.Errorf("Expected only liveness checks to pass, got %+v", result)
+	}
+
+	result = getResult(t, handler, "/readyz", http.StatusServiceUnavailable)
+	if result.Status != "unavailable" || len(result.Failed) != 1 || result.Failed[0] != "rcon" {
+		t.Errorf("Expected the rcon check to fail, got %+v", result)
+	}
+	if result.Checks["rcon"] != "i/o timeout" || result.Checks["mongo"] != "ok" || result.Checks["amqp"] != "ok" {
+		t.Errorf("Expected every check to be reported, got %+v", result.Checks)
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	check := health.Cached(func() error {
+		calls++
+		return errors.New("down")
+	}, 50*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := check(); err == nil {
+			t.Fatal("Expected cached error")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the check to run once within the ttl, got %d", calls)
+	}
+	time.Sleep(60 * time.Millisecond)
+	check()
+	if calls != 2 {
+		t.Errorf("Expected the check to run again after the ttl, got %d", calls)
+	}
+}
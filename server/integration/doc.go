@@ -0,0 +1,4 @@
+// Package integration runs the worker end to end against RabbitMQ, MongoDB and Redis and a fake game server
+// speaking RCON, see rcon/rcontest. The tests are tagged integration so they only run when asked for, with
+// the infrastructure of docker-compose.yml: `make integration-test`
+package integration
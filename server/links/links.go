@@ -0,0 +1,81 @@
+// Package links builds the links to the frontend sent in emails, e.g to the status page of a request
+package links
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+)
+
+// ErrNoFrontendURL is returned if the address of the frontend is not configured
+var ErrNoFrontendURL = errors.New("frontendURL is not set, e.g https://whitelist.example.com")
+
+// Builder builds the links to pages of the frontend. Tokens are escaped, so the frontend reads back the exact
+// tokens they were built with
+type Builder struct {
+	// Address of the frontend, always ending with a slash
+	base string
+}
+
+// NewBuilder checks the address of the frontend is an absolute http(s) URL without query. A path is kept, e.g for
+// a frontend served under /whitelist, with or without trailing slash
+func NewBuilder(base string) (*Builder, error) {
+	base = strings.TrimSpace(base)
+	if base == "" {
+		return nil, ErrNoFrontendURL
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("frontendURL %q is not a URL: %s", base, err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("frontendURL %q must be an absolute http or https URL", base)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("frontendURL %q must not have a query or fragment", base)
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/"
+	u.RawPath = ""
+	return &Builder{base: u.String()}, nil
+}
+
+// ForTenant builds the links to the frontend of the tenant, see tenant.Config.FrontendURL
+func ForTenant(cfg tenant.Config) (*Builder, error) {
+	b, err := NewBuilder(cfg.FrontendURL())
+	if err != nil && cfg.ID != "" {
+		return nil, fmt.Errorf("%s for tenant %s", err.Error(), cfg.ID)
+	}
+	return b, err
+}
+
+// ForTenants builds the links of every tenant by server ID. Fails for the first tenant without a valid frontendURL
+func ForTenants() (map[string]*Builder, error) {
+	builders := make(map[string]*Builder)
+	for _, cfg := range tenant.All() {
+		b, err := ForTenant(cfg)
+		if err != nil {
+			return nil, err
+		}
+		builders[cfg.ID] = b
+	}
+	return builders, nil
+}
+
+// Validate checks every tenant has a valid frontendURL
+func Validate() error {
+	_, err := ForTenants()
+	return err
+}
+
+// StatusLink is the link to the status page of the request the token was signed for
+func (b *Builder) StatusLink(requestToken string) string {
+	return b.base + "status/" + url.PathEscape(requestToken)
+}
+
+// ActionLink is the link to the action page of the request for the op the op token was signed for
+func (b *Builder) ActionLink(requestToken, opToken string) string {
+	return b.base + "action/" + url.PathEscape(requestToken) + "?" + url.Values{"adm": {opToken}}.Encode()
+}
@@ -0,0 +1,158 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// ErrPermanent is returned for emails the SMTP server rejected with a 5xx reply. Sending them again fails the
+// same way. Recipient is set if the address of the recipient was rejected, e.g the mailbox does not exist, as
+// opposed to the email as a whole or the SMTP credentials
+type ErrPermanent struct {
+	Code      int
+	Recipient bool
+	Err       error
+}
+
+func (e *ErrPermanent) Error() string {
+	return e.Err.Error()
+}
+
+// ErrTransient is returned for emails which may be sent if retried later: 4xx replies of the SMTP server and
+// network errors. Code is 0 for network errors
+type ErrTransient struct {
+	Code int
+	Err  error
+}
+
+func (e *ErrTransient) Error() string {
+	return e.Err.Error()
+}
+
+// IsPermanent tells if the email failed for good and must not be retried
+func IsPermanent(err error) bool {
+	_, ok := err.(*ErrPermanent)
+	return ok
+}
+
+// RecipientRejected tells if the email failed for good because the address of the recipient does not exist
+func RecipientRejected(err error) bool {
+	permanent, ok := err.(*ErrPermanent)
+	return ok && permanent.Recipient
+}
+
+// classify types the error of a step of the SMTP conversation by the reply code of the server
+func classify(err error, recipient bool) error {
+	if err == nil {
+		return nil
+	}
+	if reply, ok := err.(*textproto.Error); ok {
+		if reply.Code >= 500 {
+			return &ErrPermanent{Code: reply.Code, Recipient: recipient, Err: err}
+		}
+		return &ErrTransient{Code: reply.Code, Err: err}
+	}
+	return &ErrTransient{Err: err}
+}
+
+// sendMail sends the email like smtp.SendMail, returning ErrPermanent or ErrTransient for failures so they
+// tell the SMTP step that failed
+func sendMail(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return classify(err, false)
+	}
+	defer c.Close()
+	host, _, _ := net.SplitHostPort(addr)
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return classify(err, false)
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err = c.Auth(auth); err != nil {
+				return classify(err, false)
+			}
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		return classify(err, false)
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr); err != nil {
+			return classify(err, true)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return classify(err, false)
+	}
+	if _, err = w.Write(msg); err != nil {
+		return classify(err, false)
+	}
+	if err = w.Close(); err != nil {
+		return classify(err, false)
+	}
+	return classify(c.Quit(), false)
+}
+
+// FailureRate tracks the outcome of the emails sent within the window, so a broken SMTP setup, e.g expired
+// credentials, is noticed before every op address is tried. Rejected recipients are not failures of the setup
+type FailureRate struct {
+	mu       sync.Mutex
+	window   time.Duration
+	outcomes []outcome
+	now      func() time.Time
+}
+
+type outcome struct {
+	at     time.Time
+	failed bool
+}
+
+// Failures tracks the emails sent by Send and SendTracked
+var Failures = NewFailureRate(15 * time.Minute)
+
+// NewFailureRate tracks the outcome of the emails sent within the window
+func NewFailureRate(window time.Duration) *FailureRate {
+	return &FailureRate{window: window, now: time.Now}
+}
+
+// Record counts the outcome of an email
+func (r *FailureRate) Record(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outcomes = append(r.prune(), outcome{at: r.now(), failed: err != nil && !RecipientRejected(err)})
+}
+
+// Rate returns the share of the emails sent within the window which failed, and their number
+func (r *FailureRate) Rate() (float64, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outcomes = r.prune()
+	if len(r.outcomes) == 0 {
+		return 0, 0
+	}
+	failed := 0
+	for _, o := range r.outcomes {
+		if o.failed {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(r.outcomes)), len(r.outcomes)
+}
+
+// prune drops the outcomes older than the window
+func (r *FailureRate) prune() []outcome {
+	cutoff := r.now().Add(-r.window)
+	i := 0
+	for i < len(r.outcomes) && r.outcomes[i].at.Before(cutoff) {
+		i++
+	}
+	return r.outcomes[i:]
+}
@@ -0,0 +1,108 @@
+package mailer
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer answers the SMTP conversation with the reply configured for the command, 250 otherwise
+func fakeSMTPServer(t *testing.T, replies map[string]string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		write := func(reply string) { conn.Write([]byte(reply + "\r\n")) }
+		write("220 localhost ESMTP")
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					write("250 queued")
+				}
+				continue
+			}
+			command := strings.ToUpper(strings.Fields(line + " ")[0])
+			if reply, ok := replies[command]; ok {
+				write(reply)
+				continue
+			}
+			switch command {
+			case "DATA":
+				inData = true
+				write("354 go ahead")
+			case "QUIT":
+				write("221 bye")
+				return
+			default:
+				write("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestSendMailErrors(t *testing.T) {
+	cases := []struct {
+		replies   map[string]string
+		permanent bool
+		transient bool
+		recipient bool
+	}{
+		{replies: map[string]string{}},
+		{replies: map[string]string{"RCPT": "550 5.1.1 no such user"}, permanent: true, recipient: true},
+		{replies: map[string]string{"RCPT": "452 4.2.2 mailbox full"}, transient: true},
+		{replies: map[string]string{"MAIL": "554 5.7.1 sender rejected"}, permanent: true},
+		{replies: map[string]string{"MAIL": "421 4.3.2 try again later"}, transient: true},
+	}
+	for i, c := range cases {
+		addr := fakeSMTPServer(t, c.replies)
+		err := sendMail(addr, nil, "whitelist@example.com", []string{"steve@gmail.com"}, []byte("Subject: Hi\r\n\r\nbody"))
+		_, transient := err.(*ErrTransient)
+		if IsPermanent(err) != c.permanent || transient != c.transient || RecipientRejected(err) != c.recipient {
+			t.Errorf("case %d: unexpected error %#v", i, err)
+		}
+	}
+
+	// Network errors are transient
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+	err := sendMail(addr, nil, "whitelist@example.com", []string{"steve@gmail.com"}, []byte("body"))
+	if transient, ok := err.(*ErrTransient); !ok || transient.Code != 0 {
+		t.Errorf("Expected a transient error without code, got %#v", err)
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	now := time.Now()
+	rate := NewFailureRate(time.Minute)
+	rate.now = func() time.Time { return now }
+	rate.Record(errors.New("connection refused"))
+	rate.Record(&ErrPermanent{Code: 535, Err: errors.New("535 authentication failed")})
+	rate.Record(&ErrPermanent{Code: 550, Recipient: true, Err: errors.New("550 no such user")})
+	rate.Record(nil)
+	if share, sent := rate.Rate(); share != 0.5 || sent != 4 {
+		t.Errorf("Expected half of the emails to have failed, got %v of %d", share, sent)
+	}
+	now = now.Add(2 * time.Minute)
+	if share, sent := rate.Rate(); share != 0 || sent != 0 {
+		t.Errorf("Expected the emails outside the window to be dropped, got %v of %d", share, sent)
+	}
+}
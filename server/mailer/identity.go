@@ -0,0 +1,145 @@
+package mailer
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/viper"
+)
+
+// Events emails are sent for. Each can be sent with its own sender identity, see identityFor
+const (
+	EventConfirmation = "confirmation"
+	EventDecision     = "decision"
+	EventOps          = "ops"
+)
+
+// Events is every event an identity can be configured for under emailIdentities
+var Events = []string{EventConfirmation, EventDecision, EventOps}
+
+// applicantEvents is the event of every applicant template. Other templates are sent to ops or the owner
+var applicantEvents = map[string]string{
+	"confirmation.html":  EventConfirmation,
+	"duplicate.html":     EventConfirmation,
+	"cooldown.html":      EventConfirmation,
+	"banned.html":        EventConfirmation,
+	"referrer.html":      EventConfirmation,
+	"approve.html":       EventDecision,
+	"deny.html":          EventDecision,
+	"waitlisted.html":    EventDecision,
+	"ban.html":           EventDecision,
+	"unban.html":         EventDecision,
+	"expired.html":       EventDecision,
+	"grant_expired.html": EventDecision,
+}
+
+// Identity is who the email is sent as and where replies go. Empty fields are left out of the headers
+type Identity struct {
+	FromName string
+	ReplyTo  string
+}
+
+// eventOf returns the event the email template is sent for
+func eventOf(templateName string) string {
+	if event, ok := applicantEvents[filepath.Base(templateName)]; ok {
+		return event
+	}
+	return EventOps
+}
+
+// identityFor returns the identity emails of the event are sent with. Settings of the event under
+// emailIdentities override the top level emailFromName and emailReplyTo
+func identityFor(event string) Identity {
+	identity := Identity{
+		FromName: viper.GetString("emailFromName"),
+		ReplyTo:  viper.GetString("emailReplyTo"),
+	}
+	if name := viper.GetString("emailIdentities." + event + ".fromName"); name != "" {
+		identity.FromName = name
+	}
+	if replyTo := viper.GetString("emailIdentities." + event + ".replyTo"); replyTo != "" {
+		identity.ReplyTo = replyTo
+	}
+	return identity
+}
+
+// listUnsubscribe returns the List-Unsubscribe header value of applicant emails, empty if not configured. Mail
+// providers show an unsubscribe button for it instead of applicants flagging the email as spam
+func listUnsubscribe() string {
+	target := strings.TrimSpace(viper.GetString("emailListUnsubscribe"))
+	if target == "" {
+		return ""
+	}
+	return "<" + target + ">"
+}
+
+// headers returns the sender headers of the email of the template. From is left to the SMTP server if no sender
+// address is configured, e.g in dry runs
+func headers(templateName string) string {
+	event := eventOf(templateName)
+	identity := identityFor(event)
+	h := ""
+	if sender := viper.GetString("SMTPEmail"); sender != "" {
+		h += "From: " + (&mail.Address{Name: identity.FromName, Address: sender}).String() + "\r\n"
+	}
+	if identity.ReplyTo != "" {
+		replyTo, _ := mail.ParseAddress(identity.ReplyTo)
+		h += "Reply-To: " + replyTo.String() + "\r\n"
+	}
+	if unsubscribe := listUnsubscribe(); unsubscribe != "" && event != EventOps {
+		h += "List-Unsubscribe: " + unsubscribe + "\r\n"
+	}
+	return h
+}
+
+// ValidateIdentities checks the configured sender identities, so malformed addresses are reported on startup
+// instead of failing every email
+func ValidateIdentities() error {
+	err := validateIdentity("emailFromName", "emailReplyTo")
+	if err != nil {
+		return err
+	}
+	for event := range viper.GetStringMap("emailIdentities") {
+		if !knownEvent(event) {
+			return fmt.Errorf("emailIdentities.%s is not a known event. Allowed values: %v", event, Events)
+		}
+		prefix := "emailIdentities." + event + "."
+		err := validateIdentity(prefix+"fromName", prefix+"replyTo")
+		if err != nil {
+			return err
+		}
+	}
+	if target := strings.TrimSpace(viper.GetString("emailListUnsubscribe")); target != "" {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "mailto" && u.Scheme != "https") || strings.ContainsAny(target, "<>") {
+			return fmt.Errorf("emailListUnsubscribe %q must be a mailto: or https: URL", target)
+		}
+	}
+	return nil
+}
+
+// validateIdentity checks the display name can not inject headers and the reply-to address parses
+func validateIdentity(nameKey, replyToKey string) error {
+	if strings.IndexFunc(viper.GetString(nameKey), unicode.IsControl) >= 0 {
+		return fmt.Errorf("%s must not contain control characters", nameKey)
+	}
+	if replyTo := viper.GetString(replyToKey); replyTo != "" {
+		if _, err := mail.ParseAddress(replyTo); err != nil {
+			return fmt.Errorf("%s %q is not a valid address", replyToKey, replyTo)
+		}
+	}
+	return nil
+}
+
+func knownEvent(event string) bool {
+	for _, e := range Events {
+		if strings.EqualFold(e, event) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultLocale is the locale of the templates at the root of the templates directory.
+// Templates of other locales live in a sub directory named after the locale, e.g zh-CN/ops.html
+const DefaultLocale = "en-US"
+
+// SupportedLocales lists the locales emails can be sent in
+var SupportedLocales = []string{DefaultLocale, "zh-CN"}
+
+// NormalizeLocale maps a language tag such as zh, zh_cn or en-GB to a supported locale.
+// Returns an empty string if the language is not supported
+func NormalizeLocale(locale string) string {
+	locale = strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+	for _, supported := range SupportedLocales {
+		if locale == strings.ToLower(supported) {
+			return supported
+		}
+	}
+	// Fall back to the language alone, e.g zh-Hans or zh-TW to zh-CN
+	language := strings.SplitN(locale, "-", 2)[0]
+	for _, supported := range SupportedLocales {
+		if language == strings.ToLower(strings.SplitN(supported, "-", 2)[0]) {
+			return supported
+		}
+	}
+	return ""
+}
+
+// ResolveTemplate returns the path of the template translated to the locale, or the template
+// itself if the locale is not supported or the template is not translated to it
+func ResolveTemplate(templateName, locale string) string {
+	locale = NormalizeLocale(locale)
+	if locale == "" || locale == DefaultLocale {
+		return templateName
+	}
+	localized := filepath.Join(filepath.Dir(templateName), locale, filepath.Base(templateName))
+	if _, err := os.Stat(localized); err != nil {
+		return templateName
+	}
+	return localized
+}
@@ -0,0 +1,42 @@
+package mailer
+
+import "testing"
+
+func TestNormalizeLocale(t *testing.T) {
+	tests := []struct {
+		locale   string
+		expected string
+	}{
+		{"en-US", "en-US"},
+		{"zh_cn", "zh-CN"},
+		{"zh", "zh-CN"},
+		{"zh-TW", "zh-CN"},
+		{"en-GB", "en-US"},
+		{"fr-FR", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if locale := NormalizeLocale(test.locale); locale != test.expected {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.locale, locale)
+		}
+	}
+}
+
+func TestResolveTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		locale   string
+		expected string
+	}{
+		{"./templates/ops.html", "zh-CN", "templates/zh-CN/ops.html"},
+		{"./templates/ops.html", "en-US", "./templates/ops.html"},
+		{"./templates/ops.html", "fr", "./templates/ops.html"},
+		// Untranslated templates fall back to the default locale
+		{"./templates/batch_summary.html", "zh-CN", "./templates/batch_summary.html"},
+	}
+	for _, test := range tests {
+		if resolved := ResolveTemplate(test.template, test.locale); resolved != test.expected {
+			t.Errorf("Expected %q for %s in %q, got %q", test.expected, test.template, test.locale, resolved)
+		}
+	}
+}
@@ -2,10 +2,17 @@ package mailer
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"html/template"
+	"io/ioutil"
 	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/spf13/viper"
 	try "gopkg.in/matryer/try.v1"
@@ -13,6 +20,8 @@ import (
 
 const (
 	mime = "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
+	// TemplatesDir holds the email templates of the default locale, and their translations in sub directories
+	TemplatesDir = "./mailer/templates"
 )
 
 func parseTemplate(fileName string, data interface{}) (string, error) {
@@ -20,6 +29,10 @@ func parseTemplate(fileName string, data interface{}) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	data, err = templateData(fileName, data)
+	if err != nil {
+		return "", err
+	}
 	buffer := new(bytes.Buffer)
 	if err = t.Execute(buffer, data); err != nil {
 		return "", err
@@ -27,25 +40,94 @@ func parseTemplate(fileName string, data interface{}) (string, error) {
 	return buffer.String(), nil
 }
 
+// Render renders the email template with the data the way it is sent, e.g to preview it
+func Render(templateName string, templateData interface{}) (string, error) {
+	return parseTemplate(templateName, templateData)
+}
+
 // Send email from configured SMTP server
 func Send(templateName string, templateData interface{}, subject string, recipent string) error {
+	_, err := SendTracked(templateName, templateData, subject, recipent)
+	return err
+}
+
+// SendTracked sends the email like Send and returns its Message-ID, without angle brackets, so bounces reported
+// by the email provider can be traced back to it
+func SendTracked(templateName string, templateData interface{}, subject string, recipent string) (string, error) {
 	body, err := parseTemplate(templateName, templateData)
 	if err != nil {
-		return err
+		return "", err
 	}
-	content := "To: " + recipent + "\r\nSubject: " + subject + "\r\n" + mime + "\r\n" + body
+	messageID, err := newMessageID(viper.GetString("SMTPEmail"))
+	if err != nil {
+		return "", err
+	}
+	content := message(headers(templateName), recipent, subject, messageID, body)
 	SMTP := fmt.Sprintf("%s:%d", viper.GetString("SMTPServer"), viper.GetInt("SMTPPort"))
 
-	// Retry sending emails
+	// Retry sending emails, unless the SMTP server rejected them for good
 	err = try.Do(func(attempt int) (bool, error) {
-		e := smtp.SendMail(SMTP, smtp.PlainAuth("", viper.GetString("SMTPEmail"), viper.GetString("SMTPPassword"), viper.GetString("SMTPServer")), viper.GetString("SMTPEmail"), []string{recipent}, []byte(content))
-		if e != nil {
+		e := sendMail(SMTP, smtp.PlainAuth("", viper.GetString("SMTPEmail"), viper.GetString("SMTPPassword"), viper.GetString("SMTPServer")), viper.GetString("SMTPEmail"), []string{recipent}, []byte(content))
+		if e != nil && !IsPermanent(e) {
 			time.Sleep(5 * time.Second) // 5 seconds delay between retrys
 		}
-		return attempt < 3, e // try 3 times
+		return attempt < 3 && !IsPermanent(e), e // try 3 times
 	})
+	Failures.Record(err)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return messageID, nil
+}
+
+// newMessageID generates a unique Message-ID in the domain of the sender address
+func newMessageID(sender string) (string, error) {
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(sender, "@"); at >= 0 && at < len(sender)-1 {
+		domain = sender[at+1:]
+	}
+	return fmt.Sprintf("%s.%d@%s", hex.EncodeToString(random), time.Now().Unix(), domain), nil
+}
+
+// WriteToDir returns a function writing emails to files in dir instead of sending them, e.g for dry runs.
+// Each email is written to its own file named after the time, the recipent and the template
+func WriteToDir(dir string) func(templateName string, templateData interface{}, subject string, recipent string) error {
+	return func(templateName string, templateData interface{}, subject string, recipent string) error {
+		body, err := parseTemplate(templateName, templateData)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%s-%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"),
+			fileNameSafe(recipent), strings.TrimSuffix(filepath.Base(templateName), filepath.Ext(templateName)))
+		return ioutil.WriteFile(filepath.Join(dir, name), []byte(message(headers(templateName), recipent, subject, "", body)), 0644)
+	}
+}
+
+// message builds the email from the sender headers, see headers. The Message-ID header is left to the SMTP
+// server if messageID is empty
+func message(sender, recipent, subject, messageID, body string) string {
+	headers := sender + "To: " + recipent + "\r\nSubject: " + subject + "\r\n"
+	if messageID != "" {
+		headers += "Message-ID: <" + messageID + ">\r\n"
+	}
+	return headers + mime + "\r\n" + body
+}
+
+// fileNameSafe replaces the characters of s not allowed in file names on common systems
+func fileNameSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '@' || r == '.' || r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, s)
 }
@@ -0,0 +1,107 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestMessageID(t *testing.T) {
+	first, err := newMessageID("whitelist@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := newMessageID("whitelist@example.com")
+	if first == second || !strings.HasSuffix(first, "@example.com") {
+		t.Errorf("Expected unique Message-IDs in the domain of the sender, got %q and %q", first, second)
+	}
+	if id, _ := newMessageID(""); !strings.HasSuffix(id, "@localhost") {
+		t.Errorf("Expected a Message-ID without sender to be local, got %q", id)
+	}
+	if content := message("", "steve@gmail.com", "Welcome", first, "body"); !strings.Contains(content, "\r\nMessage-ID: <"+first+">\r\n") {
+		t.Errorf("Expected the Message-ID header, got %q", content)
+	}
+	if content := message("", "steve@gmail.com", "Welcome", "", "body"); strings.Contains(content, "Message-ID") {
+		t.Errorf("Expected the Message-ID to be left to the SMTP server, got %q", content)
+	}
+}
+
+func TestSenderHeaders(t *testing.T) {
+	viper.Set("SMTPEmail", "whitelist@example.com")
+	viper.Set("emailFromName", "Gatekeeper")
+	viper.Set("emailReplyTo", "support@example.com")
+	viper.Set("emailListUnsubscribe", "mailto:unsubscribe@example.com")
+	viper.Set("emailIdentities", map[string]interface{}{
+		"decision": map[string]interface{}{"fromName": "Whitelist Team", "replyTo": "Team <team@example.com>"},
+		"ops":      map[string]interface{}{"fromName": "Gatekeeper Bot"},
+	})
+	defer func() {
+		for _, key := range []string{"SMTPEmail", "emailFromName", "emailReplyTo", "emailListUnsubscribe", "emailIdentities"} {
+			viper.Set(key, nil)
+		}
+	}()
+	cases := []struct {
+		template string
+		expected string
+	}{
+		{"./templates/confirmation.html", "From: \"Gatekeeper\" <whitelist@example.com>\r\nReply-To: <support@example.com>\r\n" +
+			"List-Unsubscribe: <mailto:unsubscribe@example.com>\r\n"},
+		{"./templates/zh-CN/approve.html", "From: \"Whitelist Team\" <whitelist@example.com>\r\nReply-To: \"Team\" <team@example.com>\r\n" +
+			"List-Unsubscribe: <mailto:unsubscribe@example.com>\r\n"},
+		// Ops are not offered to unsubscribe
+		{"./templates/ops.html", "From: \"Gatekeeper Bot\" <whitelist@example.com>\r\nReply-To: <support@example.com>\r\n"},
+	}
+	for _, c := range cases {
+		content := message(headers(c.template), "steve@gmail.com", "Subject", "", "body")
+		if !strings.HasPrefix(content, c.expected+"To: steve@gmail.com\r\n") {
+			t.Errorf("Expected the headers of %s to start with %q, got %q", c.template, c.expected, content)
+		}
+	}
+
+	// Non ASCII display names are encoded
+	viper.Set("emailIdentities", nil)
+	viper.Set("emailFromName", "Gatekeeper über")
+	if h := headers("./templates/deny.html"); !strings.HasPrefix(h, "From: =?utf-8?q?Gatekeeper_=C3=BCber?= <whitelist@example.com>\r\n") {
+		t.Errorf("Expected an encoded display name, got %q", h)
+	}
+}
+
+func TestValidateIdentities(t *testing.T) {
+	keys := []string{"emailFromName", "emailReplyTo", "emailListUnsubscribe", "emailIdentities"}
+	defer func() {
+		for _, key := range keys {
+			viper.Set(key, nil)
+		}
+	}()
+	cases := []struct {
+		settings map[string]interface{}
+		valid    bool
+	}{
+		{map[string]interface{}{}, true},
+		{map[string]interface{}{"emailFromName": "Gatekeeper", "emailReplyTo": "Support <support@example.com>",
+			"emailListUnsubscribe": "https://example.com/unsubscribe"}, true},
+		{map[string]interface{}{"emailReplyTo": "support"}, false},
+		{map[string]interface{}{"emailFromName": "Gatekeeper\r\nBcc: everyone@example.com"}, false},
+		{map[string]interface{}{"emailListUnsubscribe": "unsubscribe@example.com"}, false},
+		{map[string]interface{}{"emailIdentities": map[string]interface{}{"ops": map[string]interface{}{"replyTo": "ops@example.com"}}}, true},
+		{map[string]interface{}{"emailIdentities": map[string]interface{}{"ops": map[string]interface{}{"replyTo": "ops at example.com"}}}, false},
+		{map[string]interface{}{"emailIdentities": map[string]interface{}{"newsletter": map[string]interface{}{"fromName": "News"}}}, false},
+	}
+	for _, c := range cases {
+		for _, key := range keys {
+			viper.Set(key, c.settings[key])
+		}
+		if err := ValidateIdentities(); (err == nil) != c.valid {
+			t.Errorf("Expected %v to be valid: %v, got %v", c.settings, c.valid, err)
+		}
+	}
+}
+
+func TestApplicantTemplatesHaveEvents(t *testing.T) {
+	for name, audience := range registry {
+		if _, ok := applicantEvents[name]; (audience == Applicant) != ok {
+			t.Errorf("Expected the event of %s to be registered for applicant templates only", name)
+		}
+	}
+}
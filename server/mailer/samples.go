@@ -0,0 +1,80 @@
+package mailer
+
+// Sample values of the data of email templates, to preview them without a real request
+var sampleFields = map[string]interface{}{
+	"link":             "https://example.com/status/sample",
+	"username":         "Steve",
+	"expiresAt":        "January 2, 2020 15:04 UTC",
+	"reason":           "Sample reason written by the op",
+	"reapplyAfter":     "January 9, 2020 15:04 UTC",
+	"email":            "steve@example.com",
+	"age":              "19",
+	"gender":           "male",
+	"info":             map[string]interface{}{"applicationText": "Sample application text"},
+	"note":             "Sample note of an op",
+	"approvedAt":       "January 2, 2020 15:04 UTC",
+	"votes":            "op1@example.com: Approved, op2@example.com: Denied",
+	"attempt":          "2",
+	"previousUsername": "Steve_",
+	"previousReason":   "Sample reason of the previous denial",
+	"sla":              "24",
+	"submittedAt":      "January 1, 2020 09:30 UTC",
+	"answers":          []map[string]string{{"label": "How did you find us?", "value": "A friend invited me"}},
+	"name":             "Sample event",
+	"endTime":          "January 2, 2020 15:04 UTC",
+	"deactivated":      []string{"Steve", "Alex"},
+	"failed":           []string{"Notch"},
+	"startedAt":        "January 2, 2020 15:04 UTC",
+	"error":            "Sample error",
+	"alert":            "The task queue holds 250 messages, above the threshold of 100",
+	"detectedAt":       "January 2, 2020 15:04 UTC",
+	"author":           "op1@example.com",
+	"comment":          "Sample comment of an op",
+	"country":          "GB",
+	"networkSignals":   "2 prior requests from this network, 1 banned (Alex)",
+	"responseTimes": []map[string]interface{}{{
+		"op":            "op1@example.com",
+		"assigned":      12,
+		"decided":       9,
+		"median":        "2h30m",
+		"escalatedPast": 1,
+	}},
+}
+
+// Sample values of templates whose data differs from the one of the same name in other templates
+var sampleOverrides = map[string]map[string]interface{}{
+	"digest.html": {
+		"requests": []map[string]interface{}{{
+			"username":    "Steve",
+			"age":         "19",
+			"gender":      "male",
+			"submittedAt": "January 1, 2020 09:30 UTC",
+			"link":        "https://example.com/action/sample",
+			"answers":     []map[string]string{{"label": "How did you find us?", "value": "A friend invited me"}},
+		}},
+	},
+	"sla_digest.html": {
+		"requests": []string{"Steve, pending for 30 hours since January 1, 2020 09:30 UTC"},
+	},
+	"followup.html": {
+		"requests": []string{"Steve, approved January 1, 2020 09:30 UTC: email bounced (mailbox does not exist), never joined. Suggested: resendEmail, reachOut, deactivate"},
+	},
+}
+
+// SampleData returns sample data for every field the template is allowed to reference, to preview it
+func SampleData(name string) map[string]interface{} {
+	data := make(map[string]interface{})
+	audience, ok := registry[name]
+	if !ok {
+		return data
+	}
+	for _, field := range audienceFields[audience] {
+		if value, ok := sampleFields[field]; ok {
+			data[field] = value
+		}
+	}
+	for field, value := range sampleOverrides[name] {
+		data[field] = value
+	}
+	return data
+}
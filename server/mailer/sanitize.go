@@ -0,0 +1,30 @@
+package mailer
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// MaxReasonLength is the maximum number of characters of a decision reason shown to the applicant
+const MaxReasonLength = 1000
+
+var markupPattern = regexp.MustCompile(`<[^>]*>`)
+
+// SanitizeReason prepares a decision reason written by an op to be shown to the applicant.
+// Markup and control characters other than line breaks are dropped and the text is truncated.
+// Templates still escape the result when rendering it
+func SanitizeReason(reason string) string {
+	reason = markupPattern.ReplaceAllString(reason, "")
+	reason = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' {
+			return -1
+		}
+		return r
+	}, reason)
+	reason = strings.TrimSpace(reason)
+	if runes := []rune(reason); len(runes) > MaxReasonLength {
+		reason = string(runes[:MaxReasonLength])
+	}
+	return reason
+}
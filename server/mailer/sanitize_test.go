@@ -0,0 +1,30 @@
+package mailer_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tywin1104/mc-gatekeeper/mailer"
+)
+
+func TestSanitizeReason(t *testing.T) {
+	tests := []struct {
+		reason   string
+		expected string
+	}{
+		{"  Griefed at spawn  ", "Griefed at spawn"},
+		{"<script>alert(1)</script>Spam", "alert(1)Spam"},
+		{`<a href="https://evil.example">appeal here</a>`, "appeal here"},
+		{"Line one\nLine two\x00\x1b[31m", "Line one\nLine two[31m"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if sanitized := mailer.SanitizeReason(test.reason); sanitized != test.expected {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.reason, sanitized)
+		}
+	}
+	long := strings.Repeat("理", mailer.MaxReasonLength+10)
+	if sanitized := mailer.SanitizeReason(long); len([]rune(sanitized)) != mailer.MaxReasonLength {
+		t.Errorf("Expected reason to be truncated to %d characters, got %d", mailer.MaxReasonLength, len([]rune(sanitized)))
+	}
+}
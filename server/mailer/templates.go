@@ -0,0 +1,238 @@
+package mailer
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template/parse"
+)
+
+// Audiences of email templates
+const (
+	Applicant = "applicant"
+	Ops       = "ops"
+	Owner     = "owner"
+)
+
+// Data each audience's templates are allowed to reference. Applicant-facing templates must
+// never see ops-only data such as the notes of ops or the answers of the application form
+var audienceFields = map[string][]string{
+	Applicant: {"link", "username", "expiresAt", "reason", "reapplyAfter"},
+	Ops:       {"link", "username", "expiresAt", "email", "age", "gender", "info", "note", "approvedAt", "votes", "attempt", "previousUsername", "previousReason", "requests", "sla", "submittedAt", "answers", "author", "comment", "responseTimes", "country", "networkSignals", "referral", "attachments"},
+	Owner:     {"name", "endTime", "deactivated", "failed", "startedAt", "error", "alert", "detectedAt"},
+}
+
+// registry is the audience of every email template, by file name
+var registry = map[string]string{
+	"approve.html":       Applicant,
+	"deny.html":          Applicant,
+	"ban.html":           Applicant,
+	"confirmation.html":  Applicant,
+	"duplicate.html":     Applicant,
+	"cooldown.html":      Applicant,
+	"waitlisted.html":    Applicant,
+	"banned.html":        Applicant,
+	"referrer.html":      Applicant,
+	"expired.html":       Applicant,
+	"grant_expired.html": Applicant,
+	"unban.html":         Applicant,
+	"ops.html":           Ops,
+	"review.html":        Ops,
+	"disputed.html":      Ops,
+	"cancelled.html":     Ops,
+	"comment.html":       Ops,
+	"sla_digest.html":    Ops,
+	"digest.html":        Ops,
+	"followup.html":      Ops,
+	"batch_summary.html": Owner,
+	"canary_failed.html": Owner,
+	"queue_alert.html":   Owner,
+}
+
+// TemplateInfo describes a registered email template, for admins to preview it
+type TemplateInfo struct {
+	Name     string `json:"name"`
+	Audience string `json:"audience"`
+	// Data the template is allowed to reference
+	Fields []string `json:"fields"`
+	// Locales the template is translated to in dir, the default locale included
+	Locales []string `json:"locales"`
+}
+
+// Registered tells whether name is the file name of a registered email template
+func Registered(name string) bool {
+	_, ok := registry[name]
+	return ok
+}
+
+// Templates lists the registered email templates by name with the locales they are translated to in dir
+func Templates(dir string) []TemplateInfo {
+	templates := make([]TemplateInfo, 0, len(registry))
+	for name, audience := range registry {
+		locales := []string{DefaultLocale}
+		for _, locale := range SupportedLocales {
+			if _, err := os.Stat(filepath.Join(dir, locale, name)); locale != DefaultLocale && err == nil {
+				locales = append(locales, locale)
+			}
+		}
+		templates = append(templates, TemplateInfo{
+			Name:     name,
+			Audience: audience,
+			Fields:   audienceFields[audience],
+			Locales:  locales,
+		})
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name < templates[j].Name
+	})
+	return templates
+}
+
+// allowedFields returns the data the template is allowed to reference
+func allowedFields(templateName string) (map[string]bool, error) {
+	audience, ok := registry[filepath.Base(templateName)]
+	if !ok {
+		return nil, fmt.Errorf("Email template %s is not registered", templateName)
+	}
+	allowed := make(map[string]bool)
+	for _, field := range audienceFields[audience] {
+		allowed[field] = true
+	}
+	return allowed, nil
+}
+
+// templateData builds the data passed to the template, keeping only the fields the template is allowed to reference
+func templateData(templateName string, data interface{}) (map[string]interface{}, error) {
+	allowed, err := allowedFields(templateName)
+	if err != nil {
+		return nil, err
+	}
+	restricted := make(map[string]interface{})
+	switch data := data.(type) {
+	case map[string]string:
+		for key, value := range data {
+			if allowed[key] {
+				restricted[key] = value
+			}
+		}
+	case map[string]interface{}:
+		for key, value := range data {
+			if allowed[key] {
+				restricted[key] = value
+			}
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("Unsupported data of type %T for email template %s", data, templateName)
+	}
+	return restricted, nil
+}
+
+// ValidateTemplates checks every registered template in dir and its translations only reference data
+// allowed for their audience. Referencing other data would otherwise silently render empty
+func ValidateTemplates(dir string) error {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := validateTemplate(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		// Translations are optional, emails fall back to the default locale
+		for _, locale := range SupportedLocales {
+			translation := filepath.Join(dir, locale, name)
+			if _, err := os.Stat(translation); locale == DefaultLocale || err != nil {
+				continue
+			}
+			err = validateTemplate(translation)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateTemplate(path string) error {
+	t, err := template.ParseFiles(path)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+	allowed, _ := allowedFields(name)
+	var forbidden []string
+	for _, field := range referencedFields(t.Tree.Root) {
+		if !allowed[field] {
+			forbidden = append(forbidden, field)
+		}
+	}
+	if len(forbidden) > 0 {
+		return fmt.Errorf("Email template %s references fields not allowed for %s templates: %s",
+			path, registry[name], strings.Join(forbidden, ", "))
+	}
+	return nil
+}
+
+// referencedFields lists the top level fields referenced in the template, e.g link for {{ .link }}
+func referencedFields(node parse.Node) []string {
+	return scopedFields(node, true)
+}
+
+// scopedFields lists the top level fields referenced by the node. dotIsData tells if . is the data passed to the
+// template. Within range and with, . is the element or the value instead, only $.field refers to the data
+func scopedFields(node parse.Node, dotIsData bool) []string {
+	var fields []string
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		for _, n := range node.Nodes {
+			fields = append(fields, scopedFields(n, dotIsData)...)
+		}
+	case *parse.ActionNode:
+		fields = scopedFields(node.Pipe, dotIsData)
+	case *parse.IfNode:
+		fields = branchFields(&node.BranchNode, dotIsData, dotIsData)
+	case *parse.RangeNode:
+		fields = branchFields(&node.BranchNode, dotIsData, false)
+	case *parse.WithNode:
+		fields = branchFields(&node.BranchNode, dotIsData, false)
+	case *parse.TemplateNode:
+		fields = scopedFields(node.Pipe, dotIsData)
+	case *parse.PipeNode:
+		if node == nil {
+			return nil
+		}
+		for _, cmd := range node.Cmds {
+			for _, arg := range cmd.Args {
+				fields = append(fields, scopedFields(arg, dotIsData)...)
+			}
+		}
+	case *parse.ChainNode:
+		fields = scopedFields(node.Node, dotIsData)
+	case *parse.FieldNode:
+		if dotIsData {
+			fields = []string{node.Ident[0]}
+		}
+	case *parse.VariableNode:
+		// $.field refers to the data passed to the template
+		if len(node.Ident) > 1 && node.Ident[0] == "$" {
+			fields = []string{node.Ident[1]}
+		}
+	}
+	return fields
+}
+
+// branchFields lists the fields referenced by the branch. The else branch keeps the dot of the pipe
+func branchFields(node *parse.BranchNode, dotIsData, bodyDotIsData bool) []string {
+	fields := scopedFields(node.Pipe, dotIsData)
+	fields = append(fields, scopedFields(node.List, bodyDotIsData)...)
+	return append(fields, scopedFields(node.ElseList, dotIsData)...)
+}
@@ -0,0 +1,160 @@
+package mailer
+
+import (
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateTemplates(t *testing.T) {
+	err := ValidateTemplates("./templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateTemplatesRejectsForbiddenField(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name := range registry {
+		content, err := ioutil.ReadFile(filepath.Join("./templates", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "approve.html" {
+			// The note of the op is only meant for ops
+			content = append(content, []byte(`{{ if .expiresAt }}{{ $.note }}{{ end }}`)...)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ValidateTemplates(dir)
+	if err == nil {
+		t.Fatal("expected validation error for forbidden field")
+	}
+	if !strings.Contains(err.Error(), "approve.html") || !strings.Contains(err.Error(), "note") {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+}
+
+func TestTemplateDataDropsForbiddenFields(t *testing.T) {
+	data, err := templateData("./mailer/templates/deny.html", map[string]string{
+		"link": "token",
+		"note": "griefed spawn",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || data["link"] != "token" {
+		t.Fatalf("expected only the link to be passed to the template, got %v", data)
+	}
+	_, err = templateData("./mailer/templates/unknown.html", nil)
+	if err == nil {
+		t.Fatal("expected error for unregistered template")
+	}
+}
+
+func TestDecisionReasonRendering(t *testing.T) {
+	for _, name := range []string{"approve.html", "deny.html", "ban.html"} {
+		body, err := parseTemplate("./templates/"+name, map[string]string{"link": "token", "reason": "Spam & <griefing>"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(body, "Spam &amp; &lt;griefing&gt;") {
+			t.Errorf("Expected escaped reason in %s", name)
+		}
+		body, err = parseTemplate("./templates/"+name, map[string]string{"link": "token"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(body, "The admin left") {
+			t.Errorf("Expected no reason block in %s without reason", name)
+		}
+	}
+}
+
+func TestWriteToDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	send := WriteToDir(filepath.Join(dir, "outbox"))
+	err = send("./templates/deny.html", map[string]string{"link": "token"}, "Denied", "steve/../@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "outbox"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one email file, got %v %v", files, err)
+	}
+	if name := files[0].Name(); !strings.HasSuffix(name, "-steve_.._@example.com-deny.eml") {
+		t.Errorf("Unexpected file name %s", name)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "outbox", files[0].Name()))
+	if !strings.HasPrefix(string(content), "To: steve/../@example.com\r\nSubject: Denied\r\n") {
+		t.Errorf("Expected email headers, got %s", content)
+	}
+	if send("./templates/unknown.html", nil, "", "steve@example.com") == nil {
+		t.Error("Expected error for unregistered template")
+	}
+}
+
+func TestAnswersRendering(t *testing.T) {
+	for _, name := range []string{"ops.html", "digest.html"} {
+		answers := []map[string]string{{"label": "How did you find us?", "value": "<script>alert(1)</script>"}}
+		data := map[string]interface{}{"link": "token", "answers": answers}
+		if name == "digest.html" {
+			data = map[string]interface{}{"requests": []map[string]interface{}{{"username": "steve", "answers": answers}}}
+		}
+		body, err := parseTemplate("./templates/"+name, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(body, "<b>How did you find us?</b>: &lt;script&gt;alert(1)&lt;/script&gt;") {
+			t.Errorf("Expected escaped answers in %s", name)
+		}
+	}
+}
+
+func TestReferencedFieldsInRange(t *testing.T) {
+	tmpl, err := template.New("t").Parse(`{{ range .answers }}{{ .label }}{{ $.note }}{{ else }}{{ .email }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := referencedFields(tmpl.Tree.Root)
+	if !reflect.DeepEqual(fields, []string{"answers", "note", "email"}) {
+		t.Errorf("Expected only the fields of the data passed to the template, got %v", fields)
+	}
+}
+
+func TestPreviewEveryTemplate(t *testing.T) {
+	templates := Templates("templates")
+	if len(templates) != len(registry) {
+		t.Fatalf("Expected every registered template to be listed, got %d", len(templates))
+	}
+	for _, info := range templates {
+		for _, locale := range info.Locales {
+			path := filepath.Join("templates", info.Name)
+			if locale != DefaultLocale {
+				path = filepath.Join("templates", locale, info.Name)
+			}
+			html, err := Render(path, SampleData(info.Name))
+			if err != nil || html == "" {
+				t.Errorf("Expected %s to render with its sample data, got %v", path, err)
+			}
+		}
+	}
+	if sample := SampleData("approve.html"); sample["note"] != nil || sample["reason"] == nil {
+		t.Errorf("Expected the sample data of the audience of the template, got %v", sample)
+	}
+}
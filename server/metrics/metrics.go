@@ -0,0 +1,278 @@
+// Package metrics exposes prometheus metrics about the worker and the message queue
+package metrics
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gatekeeper"
+
+var (
+	// MessagesProcessed counts messages handled by the worker by request status
+	MessagesProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_processed_total",
+		Help:      "Number of messages processed by the worker by request status",
+	}, []string{"status"})
+	// ProcessingDuration observes how long the worker takes to process a message by request status
+	ProcessingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "message_processing_duration_seconds",
+		Help:      "Time taken by the worker to process a message by request status",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"status"})
+	// RCONFailures counts commands that failed to run on the game server by command
+	RCONFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rcon_failures_total",
+		Help:      "Number of RCON commands that failed to run on the game server",
+	}, []string{"command"})
+	// RCONCircuitOpen is 1 while the circuit of the game server is open and commands are not issued, 0 otherwise
+	RCONCircuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rcon_circuit_open",
+		Help:      "Whether the circuit of the game server is open and RCON commands are not issued",
+	}, []string{"server"})
+	// Retries counts messages republished to the retry queue
+	Retries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Number of messages republished to the retry queue",
+	})
+	// MaintenanceDeferrals counts game server actions deferred until the end of a maintenance window
+	MaintenanceDeferrals = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "maintenance_deferrals_total",
+		Help:      "Number of game server actions deferred until the end of a maintenance window",
+	})
+	// TaskTimeouts counts tasks which ran past the task deadline and were retried
+	TaskTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "task_timeouts_total",
+		Help:      "Number of tasks which ran past the task deadline and were retried",
+	})
+	// DeadLettered counts messages put to the dead letter queue
+	DeadLettered = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dead_lettered_total",
+		Help:      "Number of messages put to the dead letter queue",
+	})
+	// RejectedMessages counts messages the worker refused to process by reason: unsigned, signature, expired
+	// and replayed. Any of them may be a message crafted by someone with access to the message queue
+	RejectedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_messages_total",
+		Help:      "Number of messages rejected for a missing or invalid signature, their age or a replayed message ID",
+	}, []string{"reason"})
+	// EmailsSent counts emails by template and result (success/failure)
+	EmailsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "emails_sent_total",
+		Help:      "Number of emails sent by template and result",
+	}, []string{"template", "result"})
+	// Reconnects counts re-established connections to the message queue by component
+	Reconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconnects_total",
+		Help:      "Number of times the connection to the message queue got re-established",
+	}, []string{"component"})
+	// CanaryLatency observes how long canary requests take to traverse the pipeline end to end
+	CanaryLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "canary_latency_seconds",
+		Help:      "Time taken by canary requests from submission to completed approval",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+	// CanaryFailures counts canary requests that did not complete within the deadline
+	CanaryFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "canary_failures_total",
+		Help:      "Number of canary requests that did not make it through the pipeline",
+	})
+	// LegacyFieldAliases counts whitelist requests decoded from deprecated JSON field aliases by alias
+	LegacyFieldAliases = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "legacy_field_aliases_total",
+		Help:      "Number of whitelist requests decoded from deprecated JSON field aliases",
+	}, []string{"alias"})
+	// TokenValidationFailures counts requests to the status and action pages with an invalid token by endpoint
+	TokenValidationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_validation_failures_total",
+		Help:      "Number of requests to the status and action pages with an invalid token",
+	}, []string{"endpoint"})
+	// OldSecretTokens counts tokens of links that only decrypt or verify with a previous passphrase by kind
+	// (request/action), so the previous passphrase can be removed once they stop arriving
+	OldSecretTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "old_secret_tokens_total",
+		Help:      "Number of link tokens encrypted or signed with a previous passphrase by kind (request/action)",
+	}, []string{"kind"})
+	// TokenFailureAlerts counts the times failed token validations exceeded tokenFailureAlertThreshold within a minute
+	TokenFailureAlerts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_failure_alerts_total",
+		Help:      "Number of times failed token validations exceeded the alert threshold within a minute",
+	})
+	// TokenAttemptsRejected counts requests rejected because the client or token exceeded the attempt limit
+	TokenAttemptsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_attempts_rejected_total",
+		Help:      "Number of requests to the status and action pages rejected by the attempt limit",
+	})
+	// SubmissionsRateLimited counts applications rejected by the submission limit by scope (email, ip, global)
+	SubmissionsRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "submissions_rate_limited_total",
+		Help:      "Number of applications rejected by the submission limit by scope",
+	}, []string{"scope"})
+	// SubmissionsSkipped counts new requests the worker skipped because their email exceeded the submission limit
+	SubmissionsSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "submissions_skipped_total",
+		Help:      "Number of new requests skipped by the worker because their email exceeded the submission limit",
+	})
+	// CacheReads counts reads of the API by result. Misses and fallbacks are served from db
+	CacheReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_reads_total",
+		Help:      "Number of cached reads of the API by result (hit/miss/fallback)",
+	}, []string{"result"})
+	// StatusCacheReads counts reads of requests for the status page by result. Negative hits are IDs cached as
+	// not found, misses and fallbacks are read from db
+	StatusCacheReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "status_cache_reads_total",
+		Help:      "Number of reads of requests for the status page by result (hit/negative_hit/miss/fallback)",
+	}, []string{"result"})
+	// CacheRebuilds counts rebuilds of the cache after it became reachable again
+	CacheRebuilds = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_rebuilds_total",
+		Help:      "Number of times the cache got rebuilt from db after an outage",
+	})
+	// WebhooksDropped counts webhook deliveries given up on by reason (queue_full, exhausted)
+	WebhooksDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhooks_dropped_total",
+		Help:      "Number of webhook deliveries dropped by reason (queue_full/exhausted)",
+	}, []string{"reason"})
+	// QueueDepth is the number of messages ready in a queue
+	QueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Number of messages ready to be consumed in the queue",
+	}, []string{"queue"})
+	// OldestMessageAge is the age of the oldest task delivered to the worker since the last check of the queues,
+	// counted from its first publication so retried tasks keep aging
+	OldestMessageAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "oldest_message_age_seconds",
+		Help:      "Age of the oldest task delivered to the worker since the last check of the queues",
+	})
+	// QueueAlerts counts alerts sent about the message queue by condition
+	QueueAlerts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_alerts_total",
+		Help:      "Number of alerts sent about the message queue by condition (task_queue_depth/retry_queue_depth/message_age/mail_failure_rate)",
+	}, []string{"condition"})
+	// OpsDispatchPaused is 1 while action emails to ops are paused because most emails fail to send, 0 otherwise
+	OpsDispatchPaused = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ops_dispatch_paused",
+		Help:      "Whether action emails to ops are paused because most emails fail to send",
+	})
+	// Leader tells whether this instance leads and runs the periodic background jobs. Exactly one instance of
+	// a deployment reports 1
+	Leader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "Whether this instance leads and runs the periodic background jobs",
+	})
+	// RecoveredRequests counts tasks republished by the recovery pass by status of the request
+	RecoveredRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "recovered_requests_total",
+		Help:      "Number of requests stuck in a transitional state whose task was republished by the recovery pass, by status",
+	}, []string{"status"})
+	// OutboxPending is the number of outbox entries not published yet
+	OutboxPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "outbox_pending",
+		Help:      "Number of outbox entries not published to the message queue yet",
+	})
+	// OutboxLag is the age of the oldest outbox entry not published yet, 0 if every entry is published
+	OutboxLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "outbox_lag_seconds",
+		Help:      "Age of the oldest outbox entry not published to the message queue yet",
+	})
+	// OutboxPublishDelay observes the time from a change being stored to its task being published by the relay
+	OutboxPublishDelay = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "outbox_publish_delay_seconds",
+		Help:      "Time from an outbox entry being written to its publication being confirmed",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+)
+
+// ObserveProcessing records a processed message of the given request status
+func ObserveProcessing(status string, start time.Time) {
+	MessagesProcessed.WithLabelValues(status).Inc()
+	ProcessingDuration.WithLabelValues(status).Observe(time.Since(start).Seconds())
+}
+
+// RCONFailed records a failed RCON command. Only the command name is kept as label, not its arguments
+func RCONFailed(command string) {
+	fields := strings.Fields(command)
+	name := "unknown"
+	if len(fields) > 0 {
+		name = fields[0]
+	}
+	RCONFailures.WithLabelValues(name).Inc()
+}
+
+// SendFunc sends an email with the given template
+type SendFunc func(templateName string, templateData interface{}, subject string, recipent string) error
+
+// InstrumentSend wraps the email sending function to count successes and failures per template
+func InstrumentSend(send SendFunc) SendFunc {
+	return func(templateName string, templateData interface{}, subject string, recipent string) error {
+		err := send(templateName, templateData, subject, recipent)
+		countSent(templateName, err)
+		return err
+	}
+}
+
+// TrackedSendFunc sends an email with the given template and returns its Message-ID
+type TrackedSendFunc func(templateName string, templateData interface{}, subject string, recipent string) (string, error)
+
+// InstrumentTrackedSend wraps a TrackedSendFunc like InstrumentSend
+func InstrumentTrackedSend(send TrackedSendFunc) TrackedSendFunc {
+	return func(templateName string, templateData interface{}, subject string, recipent string) (string, error) {
+		messageID, err := send(templateName, templateData, subject, recipent)
+		countSent(templateName, err)
+		return messageID, err
+	}
+}
+
+func countSent(templateName string, err error) {
+	template := strings.TrimSuffix(filepath.Base(templateName), filepath.Ext(templateName))
+	if err != nil {
+		EmailsSent.WithLabelValues(template, "failure").Inc()
+	} else {
+		EmailsSent.WithLabelValues(template, "success").Inc()
+	}
+}
+
+// Handler serves the metrics in prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
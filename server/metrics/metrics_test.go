@@ -0,0 +1,38 @@
+package metrics_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+)
+
+func TestInstrumentSend(t *testing.T) {
+	fail := false
+	send := metrics.InstrumentSend(func(templateName string, templateData interface{}, subject string, recipent string) error {
+		if fail {
+			return errors.New("smtp down")
+		}
+		return nil
+	})
+	send("./mailer/templates/approve.html", nil, "subject", "user@gmail.com")
+	fail = true
+	send("./mailer/templates/approve.html", nil, "subject", "user@gmail.com")
+	send("./mailer/templates/approve.html", nil, "subject", "user@gmail.com")
+
+	if count := testutil.ToFloat64(metrics.EmailsSent.WithLabelValues("approve", "success")); count != 1 {
+		t.Errorf("Expected 1 successful email, got %v", count)
+	}
+	if count := testutil.ToFloat64(metrics.EmailsSent.WithLabelValues("approve", "failure")); count != 2 {
+		t.Errorf("Expected 2 failed emails, got %v", count)
+	}
+}
+
+func TestRCONFailedOnlyKeepsCommandName(t *testing.T) {
+	metrics.RCONFailed("whitelist add Steve")
+	metrics.RCONFailed("whitelist remove Alex")
+	if count := testutil.ToFloat64(metrics.RCONFailures.WithLabelValues("whitelist")); count != 2 {
+		t.Errorf("Expected 2 failed whitelist commands, got %v", count)
+	}
+}
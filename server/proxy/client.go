@@ -0,0 +1,111 @@
+// Package proxy carries out whitelist decisions through the REST API of a whitelist plugin of a Velocity or
+// BungeeCord proxy, for networks that whitelist at the proxy which has no RCON.
+//
+// Every action is a POST of a JSON body to the configured endpoint, authenticated with a bearer token:
+//
+//	Authorization: Bearer <serverBackendToken>
+//	{"action": "whitelist", "username": "Steve", "uuid": "8667ba71b85a4004af54457a9734eed7"}
+//
+// The action is one of whitelist, unwhitelist, ban and pardon. The UUID is omitted until the member directory
+// resolved it. Bedrock players joining through Geyser have "platform": "bedrock" and the Floodgate prefix in their
+// username, the platform is omitted for Java players. Any 2xx response means the action is carried out. Actions
+// are retried on failure, so the plugin must accept an action that is already in effect, e.g whitelisting a
+// whitelisted player
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// Actions of the plugin API
+const (
+	ActionWhitelist   = "whitelist"
+	ActionUnwhitelist = "unwhitelist"
+	ActionBan         = "ban"
+	ActionPardon      = "pardon"
+)
+
+// Maximum size of the plugin response included in errors
+const maxResponseBody = 1024
+
+// Action is the body posted to the plugin
+type Action struct {
+	Action   string `json:"action"`
+	Username string `json:"username"`
+	UUID     string `json:"uuid,omitempty"`
+	Platform string `json:"platform,omitempty"`
+}
+
+// Client posts actions to the plugin API of a proxy
+type Client struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+// NewClient creates a client posting actions to the endpoint with the bearer token. A client with a 10 seconds
+// timeout is used if nil
+func NewClient(endpoint, token string, client *http.Client) *Client {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{endpoint: endpoint, token: token, client: client}
+}
+
+// Whitelist adds the player of the request to the whitelist of the proxy
+func (c *Client) Whitelist(request types.WhitelistRequest) error {
+	return c.Do(requestAction(ActionWhitelist, request))
+}
+
+// Unwhitelist removes the player of the request from the whitelist of the proxy
+func (c *Client) Unwhitelist(request types.WhitelistRequest) error {
+	return c.Do(requestAction(ActionUnwhitelist, request))
+}
+
+// Ban bans the player of the request from the network
+func (c *Client) Ban(request types.WhitelistRequest) error {
+	return c.Do(requestAction(ActionBan, request))
+}
+
+// Pardon lifts the ban of the player of the request
+func (c *Client) Pardon(request types.WhitelistRequest) error {
+	return c.Do(requestAction(ActionPardon, request))
+}
+
+func requestAction(action string, request types.WhitelistRequest) Action {
+	return Action{Action: action, Username: request.Username, UUID: request.UUID, Platform: request.Platform}
+}
+
+// Do posts the action to the plugin. An error is returned if the request could not be made or the plugin
+// did not respond with a 2xx status
+func (c *Client) Do(action Action) error {
+	body, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Proxy responded to %s %s with %d: %s", action.Action, action.Username, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+func TestClientPostsActions(t *testing.T) {
+	var received []Action
+	var authorizations []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var action Action
+		json.NewDecoder(r.Body).Decode(&action)
+		received = append(received, action)
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		if action.Username == "Herobrine" {
+			http.Error(w, "player is not whitelisted", http.StatusConflict)
+		}
+	}))
+	defer ts.Close()
+	client := NewClient(ts.URL, "token1", nil)
+
+	steve := types.WhitelistRequest{Username: "Steve", UUID: "8667ba71b85a4004af54457a9734eed7"}
+	for _, do := range []func(types.WhitelistRequest) error{client.Whitelist, client.Unwhitelist, client.Ban, client.Pardon} {
+		if err := do(steve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, action := range []string{ActionWhitelist, ActionUnwhitelist, ActionBan, ActionPardon} {
+		if received[i] != (Action{Action: action, Username: "Steve", UUID: steve.UUID}) {
+			t.Errorf("expected %s of Steve, got %+v", action, received[i])
+		}
+		if authorizations[i] != "Bearer token1" {
+			t.Errorf("expected the bearer token, got %q", authorizations[i])
+		}
+	}
+
+	err := client.Unwhitelist(types.WhitelistRequest{Username: "Herobrine"})
+	if err == nil || !strings.Contains(err.Error(), "409") || !strings.Contains(err.Error(), "player is not whitelisted") {
+		t.Errorf("expected the response of the plugin in the error, got %v", err)
+	}
+}
+
+func TestClientUnreachable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close()
+	if err := NewClient(ts.URL, "token1", nil).Whitelist(types.WhitelistRequest{Username: "Steve"}); err == nil {
+		t.Error("expected an error if the proxy is unreachable")
+	}
+}
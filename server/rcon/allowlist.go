@@ -0,0 +1,93 @@
+package rcon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// Placeholders allow-list entries can use for a single argument, with the values each accepts
+var placeholders = map[string]func(arg string) bool{
+	// A valid Minecraft username, of a Java or a Bedrock player
+	"<player>": utils.ValidPlayerName,
+	// An integer, e.g the number of ticks or seconds
+	"<number>": func(arg string) bool {
+		_, err := strconv.ParseInt(arg, 10, 64)
+		return err == nil
+	},
+	// Letters, digits and any of -_.: e.g a world or gamerule name
+	"<word>": func(arg string) bool {
+		return strings.IndexFunc(arg, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("-_.:", r)
+		}) < 0
+	},
+}
+
+// IsCommandAllowed checks the command against an allow-list of console commands.
+// An entry matches the exact command, unless it ends with " *" in which case it
+// matches the entry's words followed by any arguments. e.g "whitelist *" matches
+// "whitelist add Steve" but not "whitelistfoo". Words of an entry can be placeholders
+// matching a single validated argument, e.g "whitelist add <player>" matches
+// "whitelist add Steve" but not "whitelist add @a"
+func IsCommandAllowed(command string, allowlist []string) bool {
+	// Never allow control characters which could smuggle a second command
+	for _, r := range command {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return false
+	}
+	words := strings.Split(command, " ")
+	for _, entry := range allowlist {
+		entry = strings.TrimSpace(entry)
+		if entry != "" && matchesEntry(words, strings.Split(entry, " ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesEntry matches the words of the command against the words of the entry
+func matchesEntry(words, entry []string) bool {
+	if len(entry) > 1 && entry[len(entry)-1] == "*" {
+		entry = entry[:len(entry)-1]
+		if len(words) < len(entry) {
+			return false
+		}
+		words = words[:len(entry)]
+	}
+	if len(words) != len(entry) {
+		return false
+	}
+	for i, word := range entry {
+		if valid, ok := placeholders[word]; ok {
+			if !valid(words[i]) {
+				return false
+			}
+		} else if words[i] != word {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateAllowlist checks every placeholder of the allow-list is known, so a typo is reported on startup
+// instead of rejecting the command
+func ValidateAllowlist(allowlist []string) error {
+	for _, entry := range allowlist {
+		for _, word := range strings.Fields(entry) {
+			if strings.HasPrefix(word, "<") && strings.HasSuffix(word, ">") {
+				if _, ok := placeholders[word]; !ok {
+					return fmt.Errorf("Unknown placeholder %s in %q. Allowed values: <player>, <number>, <word>", word, entry)
+				}
+			}
+		}
+	}
+	return nil
+}
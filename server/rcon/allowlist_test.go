@@ -0,0 +1,80 @@
+package rcon_test
+
+import (
+	"testing"
+
+	"github.com/tywin1104/mc-gatekeeper/rcon"
+)
+
+func TestIsCommandAllowed(t *testing.T) {
+	allowlist := []string{"save-all", "whitelist reload", "say *"}
+	tests := []struct {
+		command string
+		allowed bool
+	}{
+		{"save-all", true},
+		{"  save-all  ", true},
+		{"save-all flush", false},
+		{"save-alls", false},
+		{"whitelist reload", true},
+		{"whitelist", false},
+		{"whitelist add Steve", false},
+		{"say hello everyone", true},
+		{"say", true},
+		{"sayhello", false},
+		{"saybye everyone", false},
+		{"say hi\nop Steve", false},
+		{"", false},
+		{"stop", false},
+	}
+	for _, test := range tests {
+		if allowed := rcon.IsCommandAllowed(test.command, allowlist); allowed != test.allowed {
+			t.Errorf("IsCommandAllowed(%q) = %v, want %v", test.command, allowed, test.allowed)
+		}
+	}
+}
+
+func TestIsCommandAllowedEmptyAllowlist(t *testing.T) {
+	if rcon.IsCommandAllowed("save-all", nil) {
+		t.Error("No command should be allowed with an empty allow-list")
+	}
+}
+
+func TestIsCommandAllowedPlaceholders(t *testing.T) {
+	allowlist := []string{"whitelist add <player>", "time add <number>", "gamerule <word> *", "*"}
+	tests := []struct {
+		command string
+		allowed bool
+	}{
+		{"whitelist add Steve", true},
+		{"whitelist add St", false},
+		{"whitelist add @a", false},
+		{"whitelist add Steve Alex", false},
+		// Bedrock players named by Floodgate
+		{"whitelist add .Steve_Jobs", true},
+		{"whitelist add .", false},
+		{"whitelist add /Steve", false},
+		{"whitelist add", false},
+		{"time add 100", true},
+		{"time add -5", true},
+		{"time add 1e3", false},
+		{"gamerule keepInventory true", true},
+		{"gamerule keep;Inventory true", false},
+		{"gamerule", false},
+		{"stop", false},
+	}
+	for _, test := range tests {
+		if allowed := rcon.IsCommandAllowed(test.command, allowlist); allowed != test.allowed {
+			t.Errorf("IsCommandAllowed(%q) = %v, want %v", test.command, allowed, test.allowed)
+		}
+	}
+}
+
+func TestValidateAllowlist(t *testing.T) {
+	if err := rcon.ValidateAllowlist([]string{"whitelist add <player>", "say *"}); err != nil {
+		t.Errorf("Expected known placeholders to be valid, got %v", err)
+	}
+	if err := rcon.ValidateAllowlist([]string{"ban <username>"}); err == nil {
+		t.Error("Expected unknown placeholder to be rejected")
+	}
+}
@@ -2,12 +2,14 @@ package rcon
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,6 +34,7 @@ type payload struct {
 // Valve Wiki: https://developer.valvesoftware.com/wiki/Source_RCON_Protocol
 type Client struct {
 	connection net.Conn
+	address    string
 	password   string
 }
 
@@ -48,9 +51,11 @@ func (p *payload) calculatePacketSize() int32 {
 	return int32(len(p.packetBody) + 4 + 4 + 2)
 }
 
-func connectRCON() (*Client, error) {
-	address := fmt.Sprintf("%s:%d", viper.GetString("RCONServer"), viper.GetInt("RCONPort"))
+func address() string {
+	return net.JoinHostPort(viper.GetString("RCONServer"), strconv.Itoa(viper.GetInt("RCONPort")))
+}
 
+func connectRCON(address, password string) (*Client, error) {
 	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
 	if err != nil {
 		return nil, err
@@ -58,7 +63,8 @@ func connectRCON() (*Client, error) {
 
 	client := new(Client)
 	client.connection = conn
-	client.password = viper.GetString("RCONPassword")
+	client.address = address
+	client.password = password
 
 	err = client.sendAuthentication(client.password)
 	if err != nil {
@@ -70,7 +76,7 @@ func connectRCON() (*Client, error) {
 // NewClient contsurct a RCON client againest a running game server and
 // issue a ininial authentication using password
 func NewClient(host string, port int, pass string) (*Client, error) {
-	client, err := connectRCON()
+	client, err := connectRCON(net.JoinHostPort(host, strconv.Itoa(port)), pass)
 	if err != nil {
 		return nil, err
 	}
@@ -90,28 +96,40 @@ func (c *Client) sendAuthentication(pass string) error {
 
 // SendCommand issues command against running game server
 func (c *Client) SendCommand(command string) (string, error) {
+	return c.SendCommandContext(context.Background(), command)
+}
+
+// SendCommandContext issues command against running game server like SendCommand, but gives up once the context
+// is done, e.g when the game server hangs. The connection is dropped then and re-established by the next command
+func (c *Client) SendCommandContext(ctx context.Context, command string) (string, error) {
 	pl := createPayload(serverdataExeccommand, command)
 	var response *payload
-	response, err := c.sendPayload(pl)
+	response, err := c.sendPayloadContext(ctx, pl)
 	if err != nil {
 		// try to reconnect to remote game server when connection drops
 		reconnected := false
-		for i := 1; i <= 3; i++ {
+		for i := 1; i <= 3 && ctx.Err() == nil; i++ {
 			log.Infof("Reconnect to RCON [%d/3]", i)
-			newClient, e := connectRCON()
+			newClient, e := connectRCON(c.address, c.password)
 			if e != nil {
-				time.Sleep(5 * time.Second)
+				select {
+				case <-time.After(5 * time.Second):
+				case <-ctx.Done():
+				}
 				continue
 			} else {
 				c.connection = newClient.connection
 				reconnected = true
-				response, e = c.sendPayload(pl)
+				response, e = c.sendPayloadContext(ctx, pl)
 				if e != nil {
 					return "", e
 				}
 				break
 			}
 		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		if !reconnected {
 			return "", errors.New("Unable to reconnect to RCON server. Game server is down")
 		}
@@ -123,6 +141,52 @@ func (c *Client) SendCommand(command string) (string, error) {
 	return strings.TrimSpace(string(response.packetBody)), nil
 }
 
+// sendPayloadContext sends the payload with the deadline of the context. A late response would be read as
+// the response of the next command so the connection is closed if the deadline is exceeded
+func (c *Client) sendPayloadContext(ctx context.Context, request *payload) (*payload, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return c.sendPayload(request)
+	}
+	err := c.connection.SetDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.sendPayload(request)
+	if err != nil {
+		if !time.Now().Before(deadline) {
+			c.connection.Close()
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+	return response, c.connection.SetDeadline(time.Time{})
+}
+
+// Probe issues the command on a dedicated connection which is closed afterwards. Unlike SendCommand
+// it does not retry and gives up after the timeout, so it is suited for health checks
+func Probe(command string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("tcp", address(), timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return "", err
+	}
+	client := &Client{connection: conn, password: viper.GetString("RCONPassword")}
+	err = client.sendAuthentication(client.password)
+	if err != nil {
+		return "", err
+	}
+	response, err := client.sendPayload(createPayload(serverdataExeccommand, command))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bytes.Trim(response.packetBody, "\x00"))), nil
+}
+
 func (c *Client) sendPayload(request *payload) (*payload, error) {
 	packet, err := createPacketFromPayload(request)
 	if err != nil {
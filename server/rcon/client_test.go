@@ -0,0 +1,113 @@
+package rcon_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/rcon"
+	"github.com/tywin1104/mc-gatekeeper/rcon/rcontest"
+)
+
+func newGameServer(t *testing.T) *rcontest.Server {
+	server, err := rcontest.NewServer("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestSendCommand(t *testing.T) {
+	server := newGameServer(t)
+	defer server.Close()
+	server.Respond(func(command string) string {
+		if command == "list" {
+			return "There are 1 of a max of 20 players online: Steve\n"
+		}
+		return ""
+	})
+	client, err := rcon.NewClient(server.Host(), server.Port(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.SendCommand("list")
+	if err != nil || response != "There are 1 of a max of 20 players online: Steve" {
+		t.Fatalf("expected the trimmed response, got %q %v", response, err)
+	}
+	if _, err := client.SendCommand("whitelist add Steve"); err != nil {
+		t.Fatal(err)
+	}
+	if commands := server.Commands(); len(commands) != 2 || commands[1] != "whitelist add Steve" {
+		t.Errorf("expected the commands to reach the game server, got %v", commands)
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	server := newGameServer(t)
+	defer server.Close()
+	if _, err := rcon.NewClient(server.Host(), server.Port(), "wrong"); err == nil {
+		t.Fatal("expected the authentication to fail")
+	}
+}
+
+func TestReconnectAfterRestart(t *testing.T) {
+	server := newGameServer(t)
+	defer server.Close()
+	client, err := rcon.NewClient(server.Host(), server.Port(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Stop()
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// The dropped connection is re-established and authenticated again
+	if _, err := client.SendCommand("whitelist add Steve"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Received("whitelist add Steve") != 1 {
+		t.Errorf("expected the command to be sent once, got %v", server.Commands())
+	}
+}
+
+func TestSendCommandContextTimeout(t *testing.T) {
+	server := newGameServer(t)
+	defer server.Close()
+	client, err := rcon.NewClient(server.Host(), server.Port(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Hang("save-all")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.SendCommandContext(ctx, "save-all"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the command to time out, got %v", err)
+	}
+	server.Release()
+	// The late response is not read as the response of the next command
+	server.Respond(func(command string) string { return command + " done" })
+	response, err := client.SendCommand("list")
+	if err != nil || response != "list done" {
+		t.Fatalf("expected the response of the command, got %q %v", response, err)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	server := newGameServer(t)
+	defer server.Close()
+	defer viper.Set("RCONServer", nil)
+	defer viper.Set("RCONPort", nil)
+	defer viper.Set("RCONPassword", nil)
+	viper.Set("RCONServer", server.Host())
+	viper.Set("RCONPort", server.Port())
+	viper.Set("RCONPassword", "secret")
+	server.Respond(func(command string) string { return "pong" })
+	if response, err := rcon.Probe("list", time.Second); err != nil || response != "pong" {
+		t.Fatalf("expected the probe to succeed, got %q %v", response, err)
+	}
+	server.Stop()
+	if _, err := rcon.Probe("list", 100*time.Millisecond); err == nil {
+		t.Error("expected the probe to fail while the game server is down")
+	}
+}
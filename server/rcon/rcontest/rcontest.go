@@ -0,0 +1,264 @@
+// Package rcontest provides an in-process game server speaking the Source RCON protocol, for tests of the rcon
+// client and of the worker running commands on the game server. See
+// https://developer.valvesoftware.com/wiki/Source_RCON_Protocol
+package rcontest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	packetIDBadAuth     = -1
+	serverdataAuth      = 3
+	serverdataAuthResp  = 2
+	serverdataExec      = 2
+	serverdataRespValue = 0
+	maxPacketSize       = 4096
+	minPacketSize       = 4 + 4 + 2
+)
+
+// Server is a game server accepting RCON connections on a local port. Commands are recorded and answered with
+// the response of Respond, the empty response by default, like Minecraft answers most commands
+type Server struct {
+	password string
+
+	mu       sync.Mutex
+	addr     string
+	listener net.Listener
+	conns    map[net.Conn]bool
+	commands []string
+	respond  func(command string) string
+	hanging  map[string]bool
+	// released is closed to answer the hanging commands without a response
+	released chan struct{}
+}
+
+// NewServer starts a game server accepting the password on a free local port
+func NewServer(password string) (*Server, error) {
+	s := &Server{
+		password: password,
+		conns:    make(map[net.Conn]bool),
+		hanging:  make(map[string]bool),
+		released: make(chan struct{}),
+	}
+	if err := s.listen("127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Server) listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.addr = listener.Addr().String()
+	s.mu.Unlock()
+	go s.serve(listener)
+	return nil
+}
+
+// Addr is the address the game server listens on, host:port
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// Host is the host the game server listens on, e.g for the RCONServer setting
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr())
+	return host
+}
+
+// Port is the port the game server listens on, e.g for the RCONPort setting
+func (s *Server) Port() int {
+	_, port, _ := net.SplitHostPort(s.Addr())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// Commands returns the commands received by the game server so far, in order. Commands left hanging are included
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Received counts the times the command was received
+func (s *Server) Received(command string) int {
+	count := 0
+	for _, c := range s.Commands() {
+		if c == command {
+			count++
+		}
+	}
+	return count
+}
+
+// Respond sets the function answering the commands. It runs before the response is sent, so it may also act
+// while the client awaits the response
+func (s *Server) Respond(respond func(command string) string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.respond = respond
+}
+
+// Hang leaves the command without a response, like a game server stalling on it, until Release
+func (s *Server) Hang(command string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hanging[command] = true
+}
+
+// Release answers the commands left hanging and answers them right away from then on
+func (s *Server) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hanging = make(map[string]bool)
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+// Stop closes the connections and stops accepting new ones, like the game server going down
+func (s *Server) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = make(map[net.Conn]bool)
+}
+
+// Start accepts connections on the same address again after Stop, like the game server coming back up
+func (s *Server) Start() error {
+	s.mu.Lock()
+	running := s.listener != nil
+	s.mu.Unlock()
+	if running {
+		return errors.New("rcontest: server already running")
+	}
+	return s.listen(s.Addr())
+}
+
+// Close stops the game server and answers the commands left hanging
+func (s *Server) Close() {
+	s.Stop()
+	s.Release()
+}
+
+func (s *Server) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.listener != listener {
+			// Stopped while accepting
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// handle answers the packets of the connection. Commands are only run once the connection is authenticated
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	authenticated := false
+	for {
+		id, packetType, body, err := readPacket(conn)
+		if err != nil {
+			return
+		}
+		switch packetType {
+		case serverdataAuth:
+			authenticated = body == s.password
+			if !authenticated {
+				id = packetIDBadAuth
+			}
+			err = writePacket(conn, id, serverdataAuthResp, "")
+		case serverdataExec:
+			if !authenticated {
+				err = writePacket(conn, packetIDBadAuth, serverdataRespValue, "")
+				break
+			}
+			err = writePacket(conn, id, serverdataRespValue, s.run(body))
+		default:
+			// Minecraft ignores unknown packet types
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// run records the command and returns its response, once released if it hangs
+func (s *Server) run(command string) string {
+	s.mu.Lock()
+	s.commands = append(s.commands, command)
+	hanging := s.hanging[command]
+	released := s.released
+	respond := s.respond
+	s.mu.Unlock()
+	if hanging {
+		<-released
+	}
+	if respond == nil {
+		return ""
+	}
+	return respond(command)
+}
+
+// readPacket reads a packet: size, ID and type as 32-bit little-endian signed integers, then the null-terminated
+// body and an empty null-terminated string
+func readPacket(r io.Reader) (int32, int32, string, error) {
+	var size int32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return 0, 0, "", err
+	}
+	if size < minPacketSize || size > maxPacketSize {
+		return 0, 0, "", errors.New("rcontest: invalid packet size " + strconv.Itoa(int(size)))
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, 0, "", err
+	}
+	id := int32(binary.LittleEndian.Uint32(buf[:4]))
+	packetType := int32(binary.LittleEndian.Uint32(buf[4:8]))
+	body := string(bytes.TrimRight(buf[8:], "\x00"))
+	return id, packetType, body, nil
+}
+
+func writePacket(w io.Writer, id, packetType int32, body string) error {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, int32(len(body)+minPacketSize))
+	binary.Write(buf, binary.LittleEndian, id)
+	binary.Write(buf, binary.LittleEndian, packetType)
+	buf.WriteString(body)
+	buf.Write([]byte{0, 0})
+	_, err := w.Write(buf.Bytes())
+	return err
+}
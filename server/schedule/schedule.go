@@ -0,0 +1,317 @@
+// Package schedule tells when periodic jobs run next. A schedule is either a fixed interval, e.g 15m, or a
+// calendar expression evaluated on the wall clock of a timezone, so a job set to run daily at 09:00 keeps
+// running at 09:00 local time across DST transitions. Supported expressions:
+//
+//	15m, 1h30m               every interval, see time.ParseDuration
+//	hourly, daily, weekly    at the start of every hour, day (00:00) or week (Sunday 00:00)
+//	daily at 09:00           every day at the time of day
+//	weekdays at 09:00        Monday to Friday, weekends for Saturday and Sunday
+//	Mon,Thu at 18:30         on the listed days of the week
+//	30 9 * * 1-5             cron: minute hour day-of-month month day-of-week
+//
+// Wall-clock times skipped when the clock moves forward run at the same offset after the gap, e.g 02:30
+// runs at 03:30. Times repeated when the clock moves back run once
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Schedule tells when a periodic job runs next
+type Schedule interface {
+	// Next returns the first time the job runs strictly after the given time, zero if it never does
+	Next(after time.Time) time.Time
+}
+
+// Location returns the timezone schedules and other times of day are evaluated in, the timezone config, e.g
+// Europe/Berlin. Defaults to UTC
+func Location() (*time.Location, error) {
+	location, err := time.LoadLocation(viper.GetString("timezone"))
+	if err != nil {
+		return nil, fmt.Errorf("timezone: %s", err.Error())
+	}
+	return location, nil
+}
+
+// FromConfig returns the schedule set under the key in the configured timezone, or fallback if it is not set
+func FromConfig(key string, fallback Schedule) (Schedule, error) {
+	expr := viper.GetString(key)
+	if expr == "" {
+		return fallback, nil
+	}
+	location, err := Location()
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := Parse(expr, location)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", key, err.Error())
+	}
+	return schedule, nil
+}
+
+// Parse parses a schedule, either an interval or a calendar expression evaluated in the location
+func Parse(expr string, location *time.Location) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if interval, err := time.ParseDuration(expr); err == nil {
+		if interval <= 0 {
+			return nil, fmt.Errorf("interval %q must be positive", expr)
+		}
+		return Every(interval), nil
+	}
+	return ParseExpression(expr, location)
+}
+
+// every runs at a fixed interval, regardless of the wall clock
+type every time.Duration
+
+// Every returns the schedule running every interval
+func Every(interval time.Duration) Schedule {
+	return every(interval)
+}
+
+func (interval every) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(interval))
+}
+
+// Expressions with a fixed meaning, as cron
+var descriptors = map[string]string{
+	"hourly":  "0 * * * *",
+	"daily":   "0 0 * * *",
+	"weekly":  "0 0 * * 0",
+	"monthly": "0 0 1 * *",
+}
+
+// Day lists of the "<days> at HH:MM" form, as the day-of-week field of cron
+var dayLists = map[string]string{
+	"daily":     "*",
+	"every day": "*",
+	"weekdays":  "1-5",
+	"weekends":  "0,6",
+}
+
+var (
+	monthNames = []string{"january", "february", "march", "april", "may", "june", "july", "august", "september",
+		"october", "november", "december"}
+	dayNames = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+)
+
+// calendar is a cron expression evaluated on the wall clock of its location. Each field is a bit set of the
+// values it matches
+type calendar struct {
+	minute, hour, day, month, weekday uint64
+	// Restricting both days of the month and of the week matches either, as in cron
+	anyDay, anyWeekday bool
+	location           *time.Location
+}
+
+// ParseExpression parses a calendar expression evaluated in the location, so intervals are rejected. Used for
+// jobs that run at a time of day rather than every so often
+func ParseExpression(expr string, location *time.Location) (Schedule, error) {
+	if location == nil {
+		location = time.UTC
+	}
+	expr = strings.ToLower(strings.Join(strings.Fields(expr), " "))
+	if expr == "" {
+		return nil, errors.New("empty schedule")
+	}
+	cron, err := cronOf(strings.TrimPrefix(expr, "@"))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(cron)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, expected an interval like 15m, an expression like \"daily at 09:00\" or 5 cron fields", expr)
+	}
+	c := &calendar{location: location}
+	bounds := []struct {
+		name     string
+		field    *uint64
+		min, max int
+		names    []string
+	}{
+		{"minute", &c.minute, 0, 59, nil},
+		{"hour", &c.hour, 0, 23, nil},
+		{"day of month", &c.day, 1, 31, nil},
+		{"month", &c.month, 1, 12, monthNames},
+		{"day of week", &c.weekday, 0, 7, dayNames},
+	}
+	for i, bound := range bounds {
+		*bound.field, err = parseField(fields[i], bound.min, bound.max, bound.names)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in schedule %q: %s", bound.name, expr, err.Error())
+		}
+	}
+	// Sunday is both 0 and 7
+	if c.weekday&(1<<7) != 0 {
+		c.weekday |= 1
+	}
+	c.anyDay, c.anyWeekday = fields[2] == "*", fields[4] == "*"
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q never runs", expr)
+	}
+	return c, nil
+}
+
+// cronOf translates the readable forms of an expression to cron
+func cronOf(expr string) (string, error) {
+	if cron, ok := descriptors[expr]; ok {
+		return cron, nil
+	}
+	i := strings.LastIndex(expr, " at ")
+	if i < 0 {
+		return expr, nil
+	}
+	days, clock := expr[:i], expr[i+len(" at "):]
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return "", fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	weekdays, ok := dayLists[days]
+	if !ok {
+		weekdays = strings.Replace(days, " ", "", -1)
+	}
+	return fmt.Sprintf("%d %d * * %s", t.Minute(), t.Hour(), weekdays), nil
+}
+
+// parseField parses a cron field, a comma separated list of *, values or ranges, each optionally with a step
+// like */15 or 8-18/2. Values may be given as names, e.g mon or january
+func parseField(field string, min, max int, names []string) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			part = part[:i]
+		}
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			low, err = parseValue(bounds[0], min, max, names)
+			if err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				high, err = parseValue(bounds[1], min, max, names)
+				if err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// As in cron, 5/15 is 5-max/15
+				high = max
+			}
+			if high < low {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		}
+		for value := low; value <= high; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+	return set, nil
+}
+
+func parseValue(s string, min, max int, names []string) (int, error) {
+	if value, err := strconv.Atoi(s); err == nil {
+		if value < min || value > max {
+			return 0, fmt.Errorf("%d is out of range %d-%d", value, min, max)
+		}
+		return value, nil
+	}
+	// Names may be abbreviated to 3 letters at least
+	if len(s) >= 3 {
+		for i, name := range names {
+			if strings.HasPrefix(name, s) {
+				return i + min, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("invalid value %q", s)
+}
+
+// Calendars are not searched further ahead, e.g Feb 29 on a Monday is at most 28 years apart
+const searchYears = 30
+
+func (c *calendar) Next(after time.Time) time.Time {
+	local := after.In(c.location)
+	// The wall clock is walked in UTC, which has no DST transitions. Only matching wall-clock times are
+	// converted to the location
+	wall := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), 0, 0, time.UTC).Add(time.Minute)
+	end := wall.AddDate(searchYears, 0, 0)
+	for wall.Before(end) {
+		switch {
+		case !has(c.month, int(wall.Month())):
+			wall = time.Date(wall.Year(), wall.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchesDay(wall):
+			wall = time.Date(wall.Year(), wall.Month(), wall.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !has(c.hour, wall.Hour()):
+			wall = wall.Truncate(time.Hour).Add(time.Hour)
+		case !has(c.minute, wall.Minute()):
+			wall = wall.Add(time.Minute)
+		default:
+			// Skipped wall-clock times are normalized past the gap. A repeated time is converted to one of
+			// its occurrences, so it runs once
+			next := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, c.location)
+			if next.After(after) {
+				return next
+			}
+			wall = wall.Add(time.Minute)
+		}
+	}
+	return time.Time{}
+}
+
+func (c *calendar) matchesDay(wall time.Time) bool {
+	day, weekday := has(c.day, wall.Day()), has(c.weekday, int(wall.Weekday()))
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+func has(set uint64, value int) bool {
+	return set&(1<<uint(value)) != 0
+}
+
+// Longest wait before the wall clock is checked again, so calendar schedules follow clock adjustments
+const maxWait = time.Minute
+
+// Tick delivers the current time on the returned channel each time the schedule runs, like time.Tick. Runs
+// missed while the receiver is busy are skipped. The channel is never closed
+func Tick(schedule Schedule) <-chan time.Time {
+	ticks := make(chan time.Time)
+	go func() {
+		for {
+			next := schedule.Next(time.Now())
+			if next.IsZero() {
+				return
+			}
+			for wait := time.Until(next); wait > 0; wait = time.Until(next) {
+				if wait > maxWait {
+					wait = maxWait
+				}
+				time.Sleep(wait)
+			}
+			ticks <- time.Now()
+		}
+	}()
+	return ticks
+}
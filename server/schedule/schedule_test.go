@@ -0,0 +1,154 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func TestNext(t *testing.T) {
+	toronto := mustLoad(t, "America/Toronto")
+	berlin := mustLoad(t, "Europe/Berlin")
+	tests := []struct {
+		expr      string
+		location  *time.Location
+		after     time.Time
+		scheduled []time.Time
+	}{
+		{"15m", toronto, time.Date(2019, 11, 20, 13, 7, 0, 0, time.UTC), []time.Time{
+			time.Date(2019, 11, 20, 13, 22, 0, 0, time.UTC),
+			time.Date(2019, 11, 20, 13, 37, 0, 0, time.UTC),
+		}},
+		// 09:00 in Toronto is 13:00 UTC in summer and 14:00 UTC in winter, the clock moved back on Nov 3
+		{"daily at 09:00", toronto, time.Date(2019, 11, 1, 14, 0, 0, 0, time.UTC), []time.Time{
+			time.Date(2019, 11, 2, 13, 0, 0, 0, time.UTC),
+			time.Date(2019, 11, 3, 14, 0, 0, 0, time.UTC),
+			time.Date(2019, 11, 4, 14, 0, 0, 0, time.UTC),
+		}},
+		// 01:30 happens twice on Nov 3 and runs once
+		{"daily at 01:30", toronto, time.Date(2019, 11, 2, 5, 30, 0, 0, time.UTC), []time.Time{
+			time.Date(2019, 11, 3, 5, 30, 0, 0, time.UTC),
+			time.Date(2019, 11, 4, 6, 30, 0, 0, time.UTC),
+		}},
+		// 02:30 is skipped on Mar 31 as Berlin moves from 02:00 to 03:00, it runs at 03:30 instead
+		{"daily at 02:30", berlin, time.Date(2019, 3, 30, 1, 30, 0, 0, time.UTC), []time.Time{
+			time.Date(2019, 3, 31, 1, 30, 0, 0, time.UTC),
+			time.Date(2019, 4, 1, 0, 30, 0, 0, time.UTC),
+		}},
+		// Hourly runs are an hour of real time apart across the gap
+		{"hourly", berlin, time.Date(2019, 3, 31, 0, 30, 0, 0, time.UTC), []time.Time{
+			time.Date(2019, 3, 31, 1, 0, 0, 0, time.UTC),
+			time.Date(2019, 3, 31, 2, 0, 0, 0, time.UTC),
+		}},
+		{"weekdays at 18:30", time.UTC, time.Date(2019, 11, 22, 19, 0, 0, 0, time.UTC), []time.Time{
+			time.Date(2019, 11, 25, 18, 30, 0, 0, time.UTC),
+			time.Date(2019, 11, 26, 18, 30, 0, 0, time.UTC),
+		}},
+		{"Mon,thursday at 08:00", time.UTC, time.Date(2019, 11, 20, 0, 0, 0, 0, time.UTC), []time.Time{
+			time.Date(2019, 11, 21, 8, 0, 0, 0, time.UTC),
+			time.Date(2019, 11, 25, 8, 0, 0, 0, time.UTC),
+		}},
+		{"*/20 8-9 * * *", time.UTC, time.Date(2019, 11, 20, 9, 30, 0, 0, time.UTC), []time.Time{
+			time.Date(2019, 11, 20, 9, 40, 0, 0, time.UTC),
+			time.Date(2019, 11, 21, 8, 0, 0, 0, time.UTC),
+		}},
+		// Days of the month and of the week restricted both match either
+		{"0 0 1 * 7", time.UTC, time.Date(2019, 11, 28, 0, 0, 0, 0, time.UTC), []time.Time{
+			time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2019, 12, 8, 0, 0, 0, 0, time.UTC),
+		}},
+		{"0 12 29 feb *", time.UTC, time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC), []time.Time{
+			time.Date(2020, 2, 29, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC),
+		}},
+	}
+	for _, test := range tests {
+		schedule, err := Parse(test.expr, test.location)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		after := test.after
+		for _, scheduled := range test.scheduled {
+			next := schedule.Next(after)
+			if !next.Equal(scheduled) {
+				t.Errorf("%s: expected the run after %v at %v, got %v", test.expr, after.UTC(), scheduled, next.UTC())
+				break
+			}
+			after = next
+		}
+	}
+}
+
+func TestParseRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"-5m",
+		"0s",
+		"sometimes",
+		"daily at 9am",
+		"daily at 25:00",
+		"funday at 09:00",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"0 0 30 feb *",
+	} {
+		if _, err := Parse(expr, time.UTC); err == nil {
+			t.Errorf("Expected %q to be rejected", expr)
+		}
+	}
+	if _, err := ParseExpression("15m", time.UTC); err == nil {
+		t.Error("Expected an interval not to be accepted as expression")
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	defer viper.Set("timezone", nil)
+	defer viper.Set("testSchedule", nil)
+	fallback := Every(time.Hour)
+	schedule, err := FromConfig("testSchedule", fallback)
+	if err != nil || schedule != fallback {
+		t.Fatalf("Expected the fallback if the schedule is not set, got %v %v", schedule, err)
+	}
+	viper.Set("timezone", "Asia/Tokyo")
+	viper.Set("testSchedule", "daily at 09:00")
+	schedule, err = FromConfig("testSchedule", fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 09:00 in Tokyo is midnight UTC
+	next := schedule.Next(time.Date(2019, 11, 20, 12, 0, 0, 0, time.UTC))
+	if !next.Equal(time.Date(2019, 11, 21, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the schedule to be evaluated in the timezone, got %v", next.UTC())
+	}
+	viper.Set("timezone", "Mars/Olympus")
+	if _, err := FromConfig("testSchedule", fallback); err == nil {
+		t.Error("Expected an unknown timezone to be rejected")
+	}
+}
+
+func TestTick(t *testing.T) {
+	ticks := Tick(Every(10 * time.Millisecond))
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ticks:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the schedule to tick")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// Action links of the old format are accepted for requests submitted within this period if
+// legacyActionLinkGraceDays is not configured
+const defaultLegacyActionLinkGraceDays = 7
+
+var (
+	// errActionLinkExpired is returned for authentic action links past their expiry
+	errActionLinkExpired = errors.New("Action link has expired")
+	// errActionLinkUsed is returned for action links an op has already made a decision with
+	errActionLinkUsed = errors.New("Action link has already been used")
+)
+
+// nonceStore tracks the nonces of action links so each link can only be used once. Implemented by the cache
+type nonceStore interface {
+	ActionNonceState(nonce string) (string, error)
+	ConsumeActionNonce(nonce string) (bool, error)
+}
+
+func legacyActionLinkGrace() time.Duration {
+	days := defaultLegacyActionLinkGraceDays
+	if viper.IsSet("legacyActionLinkGraceDays") {
+		days = viper.GetInt("legacyActionLinkGraceDays")
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// parseOpToken returns the op of the adm token of an action link and the nonce of signed tokens, and which
+// of the passphrase secrets it was issued with. Old tokens only carry the encrypted op email and have no nonce
+func parseOpToken(admToken string) (utils.ActionToken, bool, int, error) {
+	if utils.IsLegacyToken(admToken) {
+		opEmail, secret, err := utils.DecodeAndDecryptWith(admToken, utils.PassphraseSecrets())
+		if err != nil {
+			return utils.ActionToken{}, true, 0, err
+		}
+		return utils.ActionToken{Op: opEmail}, true, secret, nil
+	}
+	token, secret, err := utils.ParseActionTokenWith(admToken, utils.PassphraseSecrets(), time.Now())
+	return token, false, secret, err
+}
+
+// countOldSecret records a token of the kind that was issued with a previous passphrase, so admins can tell
+// when the previous passphrases are no longer needed
+func (svc *Service) countOldSecret(kind string, secret int) {
+	if secret == 0 {
+		return
+	}
+	metrics.OldSecretTokens.WithLabelValues(kind).Inc()
+	svc.logger.WithFields(logrus.Fields{
+		"kind":               kind,
+		"previousPassphrase": secret,
+	}).Info("Token issued with a previous passphrase")
+}
+
+// checkOpToken checks that the token was issued for the request and has not been used. Old tokens are only
+// accepted for requests submitted within the grace period, as they were issued before tokens expired
+func (svc *Service) checkOpToken(token utils.ActionToken, legacy bool, request types.WhitelistRequest) error {
+	if legacy {
+		if time.Since(request.Timestamp) >= legacyActionLinkGrace() {
+			return errActionLinkExpired
+		}
+		return nil
+	}
+	if token.RequestID != request.ID.Hex() {
+		return errInvalidToken
+	}
+	if svc.nonces == nil {
+		return nil
+	}
+	state, err := svc.nonces.ActionNonceState(token.Nonce)
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to get state of action link nonce")
+		return errors.New("Unable to verify action link")
+	}
+	switch state {
+	case cache.NonceUnused:
+		return nil
+	case cache.NonceConsumed:
+		return errActionLinkUsed
+	}
+	// Registered when the link was sent. Unknown nonces were never issued
+	return errInvalidToken
+}
+
+// consumeActionLink marks the action link used once the op has acted on it. Links of the old format
+// stay valid until the grace period ends
+func (svc *Service) consumeActionLink(admToken string) {
+	token, legacy, _, err := parseOpToken(admToken)
+	if err != nil || legacy || svc.nonces == nil {
+		return
+	}
+	_, err = svc.nonces.ConsumeActionNonce(token.Nonce)
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+			"ID":  token.RequestID,
+		}).Error("Unable to mark action link as used")
+	}
+}
+
+// actionLinkStatus is the response status of the errors of action links that are authentic but no longer valid
+func actionLinkStatus(err error) (int, bool) {
+	switch err {
+	case errActionLinkExpired:
+		return http.StatusGone, true
+	case errActionLinkUsed:
+		return http.StatusConflict, true
+	}
+	return 0, false
+}
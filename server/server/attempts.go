@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+)
+
+const (
+	defaultTokenAttemptLimit  = 10
+	defaultTokenAttemptWindow = 15 * time.Minute
+	// Failures of all clients are compared to tokenFailureAlertThreshold within this window
+	tokenFailureAlertWindow = time.Minute
+	// Length of the token prefix attempts are counted by. It is the start of the encoded nonce of legacy tokens
+	// and of the signature of signed tokens
+	tokenPrefixLength   = 16
+	invalidTokenMessage = "Invalid or expired link"
+)
+
+// errInvalidToken is returned for every token that fails validation so outsiders can not
+// tell a malformed token from a token of a request that does not exist or an unassigned op
+var errInvalidToken = errors.New(invalidTokenMessage)
+
+// attemptCounter counts attempts per key in fixed windows. Implemented by the cache
+type attemptCounter interface {
+	CountAttempt(key string, window time.Duration) (int64, time.Duration, error)
+	GetAttempts(key string) (int64, time.Duration, error)
+}
+
+func tokenAttemptLimit() int64 {
+	if !viper.IsSet("tokenAttemptLimit") {
+		return defaultTokenAttemptLimit
+	}
+	return viper.GetInt64("tokenAttemptLimit")
+}
+
+func tokenAttemptWindow() time.Duration {
+	window := time.Duration(viper.GetInt("tokenAttemptWindowMinutes")) * time.Minute
+	if window <= 0 {
+		return defaultTokenAttemptWindow
+	}
+	return window
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only trusted if the API
+// is configured to run behind a reverse proxy, otherwise clients could pick any address
+func clientIP(r *http.Request) string {
+	if viper.GetBool("trustForwardedFor") {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// attemptKeys returns the keys failed token validations of the request are counted by:
+// the client address, hashed unless addresses are stored raw, and the prefix of the request ID token
+func attemptKeys(r *http.Request) []string {
+	address, _, _ := storedIP(clientIP(r))
+	keys := []string{"token:ip:" + address}
+	token := mux.Vars(r)["requestIdEncoded"]
+	// The header and claims of signed tokens start the same for every request
+	if i := strings.LastIndex(token, "."); i >= 0 {
+		token = token[i+1:]
+	}
+	if len(token) > tokenPrefixLength {
+		token = token[:tokenPrefixLength]
+	}
+	if token != "" {
+		keys = append(keys, "token:prefix:"+token)
+	}
+	return keys
+}
+
+// limitTokenAttempts rejects requests of clients and tokens that failed token validation
+// tokenAttemptLimit times within the window, until the window ends
+func (svc *Service) limitTokenAttempts(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := tokenAttemptLimit()
+		if svc.attempts == nil || limit <= 0 {
+			next(w, r)
+			return
+		}
+		for _, key := range attemptKeys(r) {
+			count, ttl, err := svc.attempts.GetAttempts(key)
+			if err != nil {
+				// Do not lock legit users out while the cache is unavailable
+				svc.logger.WithFields(logrus.Fields{
+					"err": err.Error(),
+				}).Warn("Unable to get token attempts")
+				break
+			}
+			if count >= limit {
+				metrics.TokenAttemptsRejected.Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(ttl.Seconds()))))
+				http.Error(w, "Too many attempts. Try again later", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// tokenError replies to a request whose token could not be validated. Invalid tokens count towards
+// the attempt limit of the client and the token
+func (svc *Service) tokenError(w http.ResponseWriter, r *http.Request, err error) {
+	if statusCode, ok := actionLinkStatus(err); ok {
+		http.Error(w, err.Error(), statusCode)
+		return
+	}
+	if err != errInvalidToken {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	svc.countTokenFailure(r)
+	http.Error(w, invalidTokenMessage, http.StatusBadRequest)
+}
+
+func (svc *Service) countTokenFailure(r *http.Request) {
+	endpoint := "unknown"
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			endpoint = r.Method + " " + template
+		}
+	}
+	metrics.TokenValidationFailures.WithLabelValues(endpoint).Inc()
+	if svc.attempts == nil {
+		return
+	}
+	log := svc.logger
+	if tokenAttemptLimit() > 0 {
+		for _, key := range attemptKeys(r) {
+			_, _, err := svc.attempts.CountAttempt(key, tokenAttemptWindow())
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"err": err.Error(),
+				}).Warn("Unable to count token attempt")
+				return
+			}
+		}
+	}
+	threshold := viper.GetInt64("tokenFailureAlertThreshold")
+	if threshold <= 0 {
+		return
+	}
+	failures, _, err := svc.attempts.CountAttempt("token:failures", tokenFailureAlertWindow)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warn("Unable to count token failure")
+		return
+	}
+	// Alert once per window when the threshold is crossed
+	if failures == threshold {
+		metrics.TokenFailureAlerts.Inc()
+		log.WithFields(logrus.Fields{
+			"failures":  failures,
+			"threshold": threshold,
+		}).Error("Failed token validations exceeded the alert threshold. Tokens may be being guessed")
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/worker"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// awayBody is the body of a request marking an op away
+type awayBody struct {
+	AwayUntil time.Time `json:"awayUntil"`
+	Reason    string    `json:"reason"`
+}
+
+// parseAwayBody reads until when the op is away, which must be in the future
+func parseAwayBody(r *http.Request, now time.Time) (awayBody, error) {
+	var body awayBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return body, errors.New("Invalid away body. Expected awayUntil as a RFC 3339 time")
+	}
+	if !body.AwayUntil.After(now) {
+		return body, errors.New("awayUntil must be in the future")
+	}
+	return body, nil
+}
+
+// configuredOp tells whether the op is configured for any tenant
+func configuredOp(email string) bool {
+	for _, cfg := range tenant.All() {
+		ops, err := worker.ParseTenantOps(cfg)
+		if err != nil {
+			continue
+		}
+		for _, op := range ops {
+			if strings.EqualFold(op.Email, email) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func awayAuditEntry(action, actor string, away types.OpAway) types.AuditEntry {
+	details := map[string]interface{}{"op": strings.ToLower(away.Op)}
+	if !away.AwayUntil.IsZero() {
+		details["awayUntil"] = away.AwayUntil
+	}
+	if away.Reason != "" {
+		details["reason"] = away.Reason
+	}
+	return types.AuditEntry{
+		Action:    action,
+		Actor:     actor,
+		Details:   details,
+		Timestamp: time.Now(),
+	}
+}
+
+// HandleGetAwayOps list the ops away at the moment, the first back first
+func (svc *Service) HandleGetAwayOps() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		away, err := svc.dbService.GetAwayOps(time.Now())
+		if err != nil {
+			http.Error(w, "Unable to get away ops", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get away ops")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ops": away})
+	}
+}
+
+// HandleSetOpAway mark the op away until the given time. Away ops are not dispatched requests, and the
+// pending requests assigned to them are re-dispatched to other ops
+func (svc *Service) HandleSetOpAway() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op := mux.Vars(r)["op"]
+		if !svc.knownOp(op) {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		body, err := parseAwayBody(r, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		actor := getActor(r)
+		away := types.OpAway{
+			Op:        strings.ToLower(op),
+			AwayUntil: body.AwayUntil,
+			Reason:    body.Reason,
+			Actor:     actor,
+			Timestamp: time.Now(),
+		}
+		err = svc.dbService.SetOpAway(away)
+		if err != nil {
+			http.Error(w, "Unable to set op away", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"op":  op,
+			}).Error("Unable to set op away")
+			return
+		}
+		svc.audit(awayAuditEntry("op.away", actor, away))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "away": away})
+	}
+}
+
+// HandleSetOpBack mark the op back before the time they were away until. Their next requests are dispatched
+// to them right away
+func (svc *Service) HandleSetOpBack() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op := mux.Vars(r)["op"]
+		err := svc.dbService.RemoveOpAway(op)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to set op back", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"op":  op,
+			}).Error("Unable to set op back")
+			return
+		}
+		svc.audit(awayAuditEntry("op.back", getActor(r), types.OpAway{Op: op}))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success"})
+	}
+}
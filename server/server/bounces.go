@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Largest body of email events read
+const maxEmailEventsBody = 1 << 20
+
+// bounceEvent is a permanent delivery failure of an email reported by the email provider
+type bounceEvent struct {
+	// Without angle brackets, as returned by mailer.SendTracked
+	MessageID string
+	Email     string
+	Reason    string
+}
+
+// normalizeMessageID strips the angle brackets Message-IDs are written with in headers
+func normalizeMessageID(messageID string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(messageID), "<"), ">")
+}
+
+// sendGridEvent is an event of the SendGrid event webhook. smtp-id is the Message-ID header of the email
+type sendGridEvent struct {
+	Event     string `json:"event"`
+	Type      string `json:"type"`
+	Email     string `json:"email"`
+	Reason    string `json:"reason"`
+	MessageID string `json:"smtp-id"`
+}
+
+// parseSendGridEvents reads the hard bounces of a batch of SendGrid events. Blocks are temporary and left out
+func parseSendGridEvents(body []byte) ([]bounceEvent, error) {
+	var events []sendGridEvent
+	err := json.Unmarshal(body, &events)
+	if err != nil {
+		return nil, errors.New("Invalid events. Expected an array of SendGrid events")
+	}
+	bounces := make([]bounceEvent, 0)
+	for _, event := range events {
+		if event.Event != "bounce" || event.Type == "blocked" {
+			continue
+		}
+		bounces = append(bounces, bounceEvent{
+			MessageID: normalizeMessageID(event.MessageID),
+			Email:     event.Email,
+			Reason:    event.Reason,
+		})
+	}
+	return bounces, nil
+}
+
+// snsMessage is the envelope of Amazon SNS notifications SES events are delivered in
+type snsMessage struct {
+	Type         string `json:"Type"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+}
+
+// sesNotification is a bounce notification of Amazon SES
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	Bounce           struct {
+		BounceType        string `json:"bounceType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Mail struct {
+		CommonHeaders struct {
+			MessageID string `json:"messageId"`
+		} `json:"commonHeaders"`
+	} `json:"mail"`
+}
+
+// parseSESNotification reads the permanent bounces of an SES notification delivered by SNS. The URL confirming
+// the subscription is returned for subscription confirmations, which need to be confirmed by the owner
+func parseSESNotification(body []byte) ([]bounceEvent, string, error) {
+	var message snsMessage
+	err := json.Unmarshal(body, &message)
+	if err != nil {
+		return nil, "", errors.New("Invalid events. Expected an SNS message")
+	}
+	if message.Type == "SubscriptionConfirmation" {
+		return []bounceEvent{}, message.SubscribeURL, nil
+	}
+	var notification sesNotification
+	err = json.Unmarshal([]byte(message.Message), &notification)
+	if err != nil {
+		return nil, "", errors.New("Invalid events. Expected an SES notification")
+	}
+	bounces := make([]bounceEvent, 0)
+	if notification.NotificationType != "Bounce" || notification.Bounce.BounceType != "Permanent" {
+		return bounces, "", nil
+	}
+	for _, recipient := range notification.Bounce.BouncedRecipients {
+		bounces = append(bounces, bounceEvent{
+			MessageID: normalizeMessageID(notification.Mail.CommonHeaders.MessageID),
+			Email:     recipient.EmailAddress,
+			Reason:    recipient.DiagnosticCode,
+		})
+	}
+	return bounces, "", nil
+}
+
+// HandleEmailEvents receive the delivery events of the email provider configured by emailEventsProvider, sendgrid or
+// ses, at /api/v1/email-events?token=<emailEventsToken>. On a hard bounce the request the email was sent for is
+// flagged undeliverable and no more emails are sent to the address
+func (svc *Service) HandleEmailEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := viper.GetString("emailEventsToken")
+		if token == "" {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(token)) != 1 {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEmailEventsBody))
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		var bounces []bounceEvent
+		if viper.GetString("emailEventsProvider") == "ses" {
+			var subscribeURL string
+			bounces, subscribeURL, err = parseSESNotification(body)
+			if subscribeURL != "" {
+				svc.logger.WithFields(logrus.Fields{
+					"subscribeURL": subscribeURL,
+				}).Warning("Email events subscription to confirm. Open the URL to start receiving bounces")
+			}
+		} else {
+			bounces, err = parseSendGridEvents(body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, bounce := range bounces {
+			err = svc.recordBounce(bounce)
+			if err != nil {
+				// The email provider delivers the events again
+				http.Error(w, "Unable to record bounce", http.StatusInternalServerError)
+				svc.logger.WithFields(logrus.Fields{
+					"err":       err.Error(),
+					"messageID": bounce.MessageID,
+				}).Error("Unable to record bounce")
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "bounces": len(bounces)})
+	}
+}
+
+// recordBounce flags the request the bounced email was sent for and suppresses the address. The address is
+// suppressed even if the email is not traced back to a request, e.g if it was sent before Message-IDs were recorded
+func (svc *Service) recordBounce(bounce bounceEvent) error {
+	suppression := types.EmailSuppression{Email: bounce.Email, Reason: bounce.Reason, Timestamp: time.Now()}
+	if bounce.MessageID != "" {
+		request, err := svc.dbService.MarkEmailUndeliverable(bounce.MessageID, bounce.Reason)
+		if err == nil {
+			suppression.RequestID = request.ID.Hex()
+			if suppression.Email == "" {
+				suppression.Email = request.Email
+			}
+			svc.refreshCachedRequests(request.ID)
+			entry := requestAuditEntry("request.bounce", "email provider", request, nil)
+			entry.Details["reason"] = bounce.Reason
+			svc.audit(entry)
+		} else if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+	if suppression.Email == "" {
+		return nil
+	}
+	svc.logger.WithFields(logrus.Fields{
+		"requestID": suppression.RequestID,
+		"reason":    bounce.Reason,
+	}).Warning("Email bounced. No more emails are sent to the address")
+	return svc.dbService.SuppressEmail(suppression)
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+)
+
+// Header telling whether the response was read from the cache or from db
+const servedFromHeader = "X-Served-From"
+
+// cacheResult classifies a cached read by its error. Reads of a cache not filled yet are misses, reads
+// failing for any other reason are fallbacks
+func cacheResult(err error) string {
+	switch err {
+	case nil:
+		return "hit"
+	case cache.ErrRequestsNotCached:
+		return "miss"
+	default:
+		return "fallback"
+	}
+}
+
+// setServedFrom sets the served-from header of the response and counts the read
+func setServedFrom(w http.ResponseWriter, result string) {
+	metrics.CacheReads.WithLabelValues(result).Inc()
+	if result == "hit" {
+		w.Header().Set(servedFromHeader, "cache")
+	} else {
+		w.Header().Set(servedFromHeader, "db")
+	}
+}
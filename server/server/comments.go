@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultCommentsPageSize = 20
+	maxCommentsPageSize     = 100
+	// MaxCommentLength is the maximum number of characters of a comment
+	MaxCommentLength = 2000
+)
+
+// CommentBody is the comment an op leaves on a request
+type CommentBody struct {
+	Text string `json:"text"`
+}
+
+// newComment validates the comment of the op
+func newComment(body CommentBody, op string, now time.Time) (types.Comment, error) {
+	text := strings.TrimSpace(body.Text)
+	if text == "" {
+		return types.Comment{}, errors.New("text is required")
+	}
+	if len([]rune(text)) > MaxCommentLength {
+		return types.Comment{}, fmt.Errorf("text must not be longer than %d characters", MaxCommentLength)
+	}
+	return types.Comment{ID: primitive.NewObjectID(), Author: op, Text: text, Timestamp: now}, nil
+}
+
+// commentTask is the task telling the ops assigned to the request, but the author, about the comment
+func commentTask(request types.WhitelistRequest, comment types.Comment) types.CommentTask {
+	ops := make([]string, 0, len(request.Assignees))
+	for _, op := range request.Assignees {
+		if !strings.EqualFold(op, comment.Author) {
+			ops = append(ops, op)
+		}
+	}
+	// The worker only needs the new comment
+	request.Comments = nil
+	return types.CommentTask{Request: request, Comment: comment, Ops: ops}
+}
+
+// parseCommentsPage reads the page of comments to list. Pages of ?pageSize= comments start at ?page=1
+func parseCommentsPage(values url.Values) (int64, int64, error) {
+	page, pageSize := int64(1), int64(defaultCommentsPageSize)
+	var err error
+	if value := values.Get("page"); value != "" {
+		page, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || page < 1 {
+			return 0, 0, errors.New("Invalid page. Pages start at 1")
+		}
+	}
+	if value := values.Get("pageSize"); value != "" {
+		pageSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || pageSize < 1 || pageSize > maxCommentsPageSize {
+			return 0, 0, fmt.Errorf("Invalid pageSize. Use 1 to %d", maxCommentsPageSize)
+		}
+	}
+	return page, pageSize, nil
+}
+
+// HandleGetComments list the comments of the ops on the request from the action page, oldest first. Pages of
+// ?pageSize= comments start at ?page=1
+func (svc *Service) HandleGetComments() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request, _, err := svc.verifyMatchingTokens(mux.Vars(r)["requestIdEncoded"], r.URL.Query().Get("adm"))
+		if err != nil {
+			svc.tokenError(w, r, err)
+			return
+		}
+		page, pageSize, err := parseCommentsPage(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := svc.dbService.GetComments(request.ID, page, pageSize)
+		if err != nil {
+			http.Error(w, "Unable to get comments", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"ID":  request.ID.Hex(),
+			}).Error("Unable to get comments")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// HandleAddComment let an op assigned to the request comment on it from the action page, e.g to vouch for the
+// applicant before deciding. Commenting does not use up the action link. The other assignees are told if
+// commentNotification is configured
+func (svc *Service) HandleAddComment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request, opEmail, err := svc.verifyMatchingTokens(mux.Vars(r)["requestIdEncoded"], r.URL.Query().Get("adm"))
+		if err != nil {
+			svc.tokenError(w, r, err)
+			return
+		}
+		var body CommentBody
+		err = json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, "Unable to decode request body", http.StatusBadRequest)
+			return
+		}
+		comment, err := newComment(body, opEmail, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		commentedRequest, err := svc.dbService.AddComment(request.ID, comment)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to add comment", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"ID":  request.ID.Hex(),
+			}).Error("Unable to add comment")
+			return
+		}
+		entry := requestAuditEntry("request.comment", opEmail, commentedRequest, nil)
+		entry.Details["comment"] = comment.Text
+		svc.audit(entry)
+		svc.refreshCachedRequests(request.ID)
+		svc.notifyComment(commentedRequest, comment)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "comment": comment})
+	}
+}
+
+// notifyComment publishes the task for the worker to tell the other assignees about the comment. Best effort
+// only, the comment is on the action page anyway
+func (svc *Service) notifyComment(request types.WhitelistRequest, comment types.Comment) {
+	task := commentTask(request, comment)
+	switch viper.GetString("commentNotification") {
+	case "email":
+		if len(task.Ops) == 0 {
+			return
+		}
+	case "webhook":
+	default:
+		return
+	}
+	err := svc.broker.PublishCommentTask(task)
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+			"ID":  request.ID.Hex(),
+		}).Error("Unable to publish comment task")
+	}
+}
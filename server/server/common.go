@@ -3,11 +3,16 @@ package server
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/mailer"
 	"github.com/tywin1104/mc-gatekeeper/types"
 	"github.com/tywin1104/mc-gatekeeper/utils"
 	"go.mongodb.org/mongo-driver/bson"
@@ -16,26 +21,155 @@ import (
 
 // Update the request object's metadata and add corresponding task to broker
 func (svc *Service) updateRequestByID(requestID string, reqBody []byte, admin string) (types.WhitelistRequest, int, error) {
-	log := svc.logger
+	requestedChange, statusCode, err := svc.requestChange(reqBody, admin)
+	if err != nil {
+		return types.WhitelistRequest{}, statusCode, err
+	}
+	currentStatus := ""
+	if requestedChange["status"] == types.StatusUnbanned {
+		// Only banned requests can be unbanned. Claimed atomically so concurrent unbans pardon the player once
+		currentStatus = types.StatusBanned
+	}
+	return svc.applyRequestChange(requestID, requestedChange, admin, currentStatus)
+}
+
+// requestChange validates the change requested by the admin or op and adds the metadata derived from it
+func (svc *Service) requestChange(reqBody []byte, admin string) (bson.M, int, error) {
 	var requestedChange bson.M
 	json.Unmarshal(reqBody, &requestedChange)
 	// Update the admin field to be the op'e email behind adm email token
 	requestedChange["admin"] = admin
+	// The sequence is only ever incremented
+	delete(requestedChange, "sequence")
+	delete(requestedChange, "appliedSequence")
+	// Votes are only ever added by ops voting
+	delete(requestedChange, "votes")
 	// update timestamp metadata according to different type of status change
+	// Temporary grants can only be made when approving a request
+	if expiresAt, ok := requestedChange["expiresAt"]; ok {
+		if requestedChange["status"] != types.StatusApproved {
+			return nil, http.StatusBadRequest, errors.New("expiresAt can only be set when approving a request")
+		}
+		expiresAtTime, err := parseTimestamp(expiresAt)
+		if err != nil || !expiresAtTime.After(time.Now()) {
+			return nil, http.StatusBadRequest, errors.New("expiresAt must be a RFC3339 timestamp in the future")
+		}
+		requestedChange["expiresAt"] = expiresAtTime
+	}
+	// Approvals can be attached to an active event batch to be deactivated together with it
+	if batchID, ok := requestedChange["batchId"]; ok {
+		if requestedChange["status"] != types.StatusApproved {
+			return nil, http.StatusBadRequest, errors.New("batchId can only be set when approving a request")
+		}
+		batchIDStr, _ := batchID.(string)
+		_batchID, err := primitive.ObjectIDFromHex(batchIDStr)
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("Invalid batchId")
+		}
+		batches, err := svc.dbService.GetBatches(bson.M{"_id": _batchID, "status": types.BatchStatusActive})
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.New("Unable to get batch")
+		}
+		if len(batches) == 0 {
+			return nil, http.StatusBadRequest, errors.New("Batch does not exist or has already ended")
+		}
+		requestedChange["batchId"] = _batchID.Hex()
+	}
+	// Provisional approvals are reviewed again by ops at reviewAt. All approvals
+	// are provisional if provisionalApprovals is set, except temporary grants which end anyway
+	provisional, ok := requestedChange["provisional"].(bool)
+	if !ok && requestedChange["status"] == types.StatusApproved && requestedChange["expiresAt"] == nil {
+		provisional = viper.GetBool("provisionalApprovals")
+	}
+	delete(requestedChange, "provisional")
+	if provisional {
+		if requestedChange["status"] != types.StatusApproved {
+			return nil, http.StatusBadRequest, errors.New("provisional can only be set when approving a request")
+		}
+		if requestedChange["expiresAt"] != nil {
+			return nil, http.StatusBadRequest, errors.New("Temporary grants can not be provisional")
+		}
+		reviewAt := time.Now().Add(provisionalReviewPeriod())
+		if requestedReviewAt, ok := requestedChange["reviewAt"]; ok {
+			var err error
+			reviewAt, err = parseTimestamp(requestedReviewAt)
+			if err != nil || !reviewAt.After(time.Now()) {
+				return nil, http.StatusBadRequest, errors.New("reviewAt must be a RFC3339 timestamp in the future")
+			}
+		}
+		requestedChange["provisional"] = true
+		requestedChange["reviewAt"] = reviewAt
+	} else if _, ok := requestedChange["reviewAt"]; ok {
+		return nil, http.StatusBadRequest, errors.New("reviewAt can only be set for provisional approvals")
+	}
+	// The decision reason is told to the applicant. A new decision without reason clears the previous one
+	reason, err := decisionReason(requestedChange)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if reason != nil {
+		requestedChange["decisionReason"] = *reason
+	}
 	if newStatus, ok := requestedChange["status"]; ok {
-		if newStatus == "Approved" || newStatus == "Denied" {
+		if newStatus == types.StatusApproved || newStatus == types.StatusDenied {
 			requestedChange["processedTimestamp"] = time.Now()
 			requestedChange["lastUpdatedTimestamp"] = time.Now()
-		} else if newStatus == "Deactivated" || newStatus == "Banned" {
+		} else if newStatus == types.StatusDeactivated || newStatus == types.StatusBanned || newStatus == types.StatusUnbanned {
 			requestedChange["lastUpdatedTimestamp"] = time.Now()
 		}
 	}
+	return requestedChange, http.StatusOK, nil
+}
+
+// applyRequestChange updates the request and publishes it for the worker. The request is only changed if it is
+// still in currentStatus, the status it was read in if empty, so concurrent changes of ops and admins never
+// overwrite each other. Otherwise http.StatusConflict is returned
+func (svc *Service) applyRequestChange(requestID string, requestedChange bson.M, admin string, currentStatus string) (types.WhitelistRequest, int, error) {
+	return svc.applyRequestChangeInBulk(requestID, requestedChange, admin, currentStatus, "")
+}
 
+// applyRequestChangeInBulk applies the change like applyRequestChange, as part of the bulk decision with the ID
+func (svc *Service) applyRequestChangeInBulk(requestID string, requestedChange bson.M, admin string, currentStatus string,
+	bulkID string) (types.WhitelistRequest, int, error) {
+	log := svc.logger
+	var err error
 	_id, _ := primitive.ObjectIDFromHex(requestID)
-	updatedRequest, err := svc.dbService.UpdateRequest(bson.D{{"_id", _id}}, bson.M{
-		"$set": requestedChange,
+	if currentStatus == "" {
+		current, err := svc.getRequestByID(requestID)
+		if err == errRequestNotFound {
+			return types.WhitelistRequest{}, http.StatusNotFound, err
+		} else if err != nil {
+			log.WithFields(logrus.Fields{
+				"err":       err.Error(),
+				"requestID": requestID,
+			}).Error("Unable to get request")
+			return types.WhitelistRequest{}, http.StatusInternalServerError, errors.New("Unable to update request")
+		}
+		currentStatus = current.Status
+	}
+	newStatus := currentStatus
+	if status, ok := requestedChange["status"]; ok {
+		newStatus, ok = status.(string)
+		if !ok {
+			return types.WhitelistRequest{}, http.StatusBadRequest, errors.New("status must be a string")
+		}
+	}
+	update := bson.M{"$set": requestedChange}
+	if decidedAt, ok := requestedChange["processedTimestamp"].(time.Time); ok {
+		update = db.WithDecidedAt(update, decidedAt)
+	}
+	// Store the change and add the updated request to the broker for worker to process
+	updatedRequestObj, err := svc.writeAndPublish(func(writer db.RequestWriter) (types.WhitelistRequest, error) {
+		updatedRequestObj, err := writer.TransitionStatus(_id, currentStatus, newStatus, update)
+		updatedRequestObj.PreviousStatus = currentStatus
+		updatedRequestObj.BulkID = bulkID
+		return updatedRequestObj, err
 	})
-	if err != nil {
+	if err == db.ErrConflict {
+		return types.WhitelistRequest{}, http.StatusConflict, conflictError(requestedChange, currentStatus)
+	} else if err == errTaskNotPublished {
+		return types.WhitelistRequest{}, http.StatusInternalServerError, errors.New("Unable to update request")
+	} else if err != nil {
 		log.WithFields(logrus.Fields{
 			"err":             err.Error(),
 			"requestID":       requestID,
@@ -43,38 +177,169 @@ func (svc *Service) updateRequestByID(requestID string, reqBody []byte, admin st
 		}).Error("Unable to update request")
 		return types.WhitelistRequest{}, http.StatusInternalServerError, errors.New("Unable to update request")
 	}
-	// Add updated request to the broker for worker to process
-	// convert bson.M to struct
-	var updatedRequestObj types.WhitelistRequest
-	bsonBytes, _ := bson.Marshal(updatedRequest)
-	bson.Unmarshal(bsonBytes, &updatedRequestObj)
+	svc.audit(requestAuditEntry("request.update", admin, updatedRequestObj, requestedChange))
+	if decidedAt, ok := requestedChange["processedTimestamp"].(time.Time); ok {
+		svc.recordResponseTime(updatedRequestObj, admin, decidedAt)
+	}
+	return updatedRequestObj, http.StatusOK, nil
+}
 
-	// Publish the updatedRequestObj to broker
-	err = svc.broker.Publish(updatedRequestObj)
+// recordResponseTime records how long the op took to decide the request since it was sent to them, if this is
+// the first decision on the request. Decisions of ops the request was never sent to, e.g in broadcast mode or
+// from the dashboard, are not responses and are left out of the response times of ops
+func (svc *Service) recordResponseTime(request types.WhitelistRequest, op string, decidedAt time.Time) {
+	// db times are stored in milliseconds
+	if request.RespondedBy != "" || request.DecidedAt == nil || decidedAt.Sub(*request.DecidedAt) >= time.Millisecond {
+		return
+	}
+	responseTime, ok := request.ResponseTime(op, decidedAt)
+	if !ok {
+		return
+	}
+	err := svc.dbService.RecordResponseTime(request.ID, op, responseTime.Minutes())
 	if err != nil {
-		log.WithFields(logrus.Fields{
-			"error":             err.Error(),
-			"updatedReqeustObj": updatedRequestObj,
-		}).Error("Unable to publish message to broker")
-		return types.WhitelistRequest{}, http.StatusInternalServerError, errors.New("Unable to update request")
+		svc.logger.WithFields(logrus.Fields{
+			"err":       err.Error(),
+			"requestID": request.ID.Hex(),
+		}).Error("Unable to record response time of op")
 	}
-	return updatedRequestObj, http.StatusOK, nil
 }
 
-// Get request object from db by encrypted and url-encoded request ID
-func (svc *Service) getRequestByEncryptedID(requestIDEncoded string) (types.WhitelistRequest, int, error) {
-	log := svc.logger
-	requestID, err := utils.DecodeAndDecrypt(requestIDEncoded, viper.GetString("passphrase"))
+func conflictError(requestedChange bson.M, currentStatus string) error {
+	if requestedChange["status"] == types.StatusUnbanned {
+		return errors.New("Only banned requests can be unbanned")
+	}
+	return fmt.Errorf("Request is no longer %s", strings.ToLower(currentStatus))
+}
+
+// UpdateRequest applies the change to the request the same way ops and admins do through the API and
+// publishes the task for the worker, e.g for the admin CLI. The request must exist
+func (svc *Service) UpdateRequest(requestID string, change map[string]interface{}, actor string) (types.WhitelistRequest, error) {
+	_, err := svc.getRequestByID(requestID)
 	if err != nil {
-		log.WithFields(logrus.Fields{
-			"err":      err.Error(),
-			"urlParam": requestIDEncoded,
-		}).Warn("Unable to decode requestID token")
-		return types.WhitelistRequest{}, http.StatusBadRequest, errors.New("Unable to decode token")
+		return types.WhitelistRequest{}, err
+	}
+	reqBody, err := json.Marshal(change)
+	if err != nil {
+		return types.WhitelistRequest{}, err
 	}
+	updatedRequest, _, err := svc.updateRequestByID(requestID, reqBody, actor)
+	return updatedRequest, err
+}
 
-	_id, _ := primitive.ObjectIDFromHex(string(requestID))
-	requests, err := svc.dbService.GetRequests(1, bson.D{{"_id", _id}})
+// RequeueRequest publishes the task of the request's current status again, e.g when the game server
+// was unreachable until the task was dead-lettered. The last update time is bumped so the worker does
+// not skip it as a task it already processed
+func (svc *Service) RequeueRequest(requestID string, actor string) (types.WhitelistRequest, error) {
+	request, err := svc.getRequestByID(requestID)
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	requeuedRequest, err := svc.writeAndPublish(func(writer db.RequestWriter) (types.WhitelistRequest, error) {
+		requeuedRequest, err := writer.ConditionalUpdateRequest(bson.M{"_id": request.ID}, bson.M{
+			"$set": bson.M{"lastUpdatedTimestamp": time.Now()},
+		})
+		// The status does not change
+		requeuedRequest.PreviousStatus = requeuedRequest.Status
+		return requeuedRequest, err
+	})
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	svc.audit(requestAuditEntry("request.requeue", actor, requeuedRequest, nil))
+	return requeuedRequest, nil
+}
+
+func (svc *Service) getRequestByID(requestID string) (types.WhitelistRequest, error) {
+	_id, err := primitive.ObjectIDFromHex(requestID)
+	if err != nil {
+		return types.WhitelistRequest{}, errors.New("Invalid request ID")
+	}
+	requests, err := svc.dbService.GetRequests(1, bson.M{"_id": _id})
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	if len(requests) == 0 {
+		return types.WhitelistRequest{}, errRequestNotFound
+	}
+	return requests[0], nil
+}
+
+// errRequestNotFound is returned by getRequestByID if no request has the ID
+var errRequestNotFound = errors.New("Resource not found")
+
+// requestAuditEntry records a change made to a request by an op, an admin or the admin CLI
+func requestAuditEntry(action, actor string, request types.WhitelistRequest, change bson.M) types.AuditEntry {
+	details := map[string]interface{}{
+		"requestId": request.ID.Hex(),
+		"username":  request.Username,
+		"status":    request.Status,
+	}
+	// Tells the tenant of the request apart, e.g for the op leaderboard
+	if request.ServerID != "" {
+		details["serverId"] = request.ServerID
+	}
+	// Only what the actor asked for. Timestamps are derived and the actor is already recorded
+	for _, field := range []string{"expiresAt", "batchId", "provisional", "reviewAt", "decisionReason"} {
+		if value, ok := change[field]; ok {
+			details[field] = value
+		}
+	}
+	return types.AuditEntry{
+		Action:    action,
+		Actor:     actor,
+		Details:   details,
+		Timestamp: time.Now(),
+	}
+}
+
+// audit appends the entry to the audit log. Best effort only
+func (svc *Service) audit(entry types.AuditEntry) {
+	err := svc.dbService.CreateAuditEntry(entry)
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err":    err.Error(),
+			"action": entry.Action,
+		}).Warning("Unable to write audit log entry")
+	}
+}
+
+// decisionReason validates the decision reason of the requested change. It returns the reason to
+// store, nil if the change is not a decision and thus leaves the current reason untouched
+func decisionReason(requestedChange bson.M) (*string, error) {
+	value, ok := requestedChange["decisionReason"]
+	switch requestedChange["status"] {
+	case types.StatusApproved, types.StatusDenied, types.StatusBanned:
+	default:
+		if ok {
+			return nil, errors.New("decisionReason can only be set when approving, denying or banning a request")
+		}
+		return nil, nil
+	}
+	reason := ""
+	if ok {
+		str, isString := value.(string)
+		if !isString {
+			return nil, errors.New("decisionReason must be a string")
+		}
+		reason = strings.TrimSpace(str)
+	}
+	if len([]rune(reason)) > mailer.MaxReasonLength {
+		return nil, fmt.Errorf("decisionReason must not be longer than %d characters", mailer.MaxReasonLength)
+	}
+	return &reason, nil
+}
+
+// Get request object from db by the request ID token of a link issued for one of the purposes.
+// Encrypted request IDs of links sent before links were signed are accepted for any purpose
+func (svc *Service) getRequestByEncryptedID(requestIDEncoded string, purposes ...string) (types.WhitelistRequest, int, error) {
+	log := svc.logger
+	_id, err := svc.decodeRequestToken(requestIDEncoded, purposes...)
+	if err != nil {
+		return types.WhitelistRequest{}, http.StatusBadRequest, err
+	}
+	requestID := _id.Hex()
+	requests, err := svc.dbService.GetRequests(1, bson.M{"_id": _id})
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err":       err.Error(),
@@ -83,8 +348,61 @@ func (svc *Service) getRequestByEncryptedID(requestIDEncoded string) (types.Whit
 		return types.WhitelistRequest{}, http.StatusInternalServerError, errors.New("Unable to get reqeuest by ID")
 	}
 	if len(requests) == 0 {
-		return types.WhitelistRequest{}, http.StatusBadRequest, errors.New("Resource not found")
+		return types.WhitelistRequest{}, http.StatusBadRequest, errInvalidToken
 	}
 	request := requests[0]
 	return request, http.StatusOK, nil
 }
+
+// decodeRequestToken returns the ID of the request the token is for, errInvalidToken if it is not valid for any
+// of the purposes
+func (svc *Service) decodeRequestToken(requestIDEncoded string, purposes ...string) (primitive.ObjectID, error) {
+	log := svc.logger
+	var requestID string
+	var err error
+	if utils.IsLegacyToken(requestIDEncoded) {
+		var secret int
+		requestID, secret, err = utils.DecodeAndDecryptWith(requestIDEncoded, utils.PassphraseSecrets())
+		if err == nil {
+			svc.countOldSecret("request", secret)
+		}
+	} else {
+		requestID, err = utils.VerifyToken(requestIDEncoded, purposes...)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":      err.Error(),
+			"urlParam": requestIDEncoded,
+		}).Warn("Unable to decode requestID token")
+		return primitive.NilObjectID, errInvalidToken
+	}
+	_id, err := primitive.ObjectIDFromHex(requestID)
+	if err != nil {
+		return primitive.NilObjectID, errInvalidToken
+	}
+	return _id, nil
+}
+
+// getStatusRequest returns the request shown on the status page. Read through the cache, so pages refreshed
+// by applicants do not hit db, and from db while the cache is not available
+func (svc *Service) getStatusRequest(requestIDEncoded string, purposes ...string) (types.WhitelistRequest, error) {
+	if svc.cache == nil || !svc.cache.Available() {
+		request, _, err := svc.getRequestByEncryptedID(requestIDEncoded, purposes...)
+		return request, err
+	}
+	_id, err := svc.decodeRequestToken(requestIDEncoded, purposes...)
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	request, err := svc.cache.GetRequestByID(_id)
+	if err == cache.ErrRequestNotFound {
+		return types.WhitelistRequest{}, errInvalidToken
+	} else if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err":       err.Error(),
+			"requestID": _id.Hex(),
+		}).Error("Unable to get reqeuest by ID")
+		return types.WhitelistRequest{}, errors.New("Unable to get reqeuest by ID")
+	}
+	return request, nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/worker"
+)
+
+// reapplyAfter returns when the player of the new request may apply again if one of their requests was denied
+// within reapplyCooldownHours, or the zero time. Resubmissions of a denied request are limited by
+// resubmissionLimit instead
+func (svc *Service) reapplyAfter(newRequest types.WhitelistRequest, now time.Time) (time.Time, error) {
+	if worker.ReapplyCooldown(tenant.Config{ID: newRequest.ServerID}) == 0 || newRequest.PreviousRequestID != "" {
+		return time.Time{}, nil
+	}
+	denials, err := svc.store.QueryRequests(worker.DenialsInCooldown(newRequest, now))
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"error":      err.Error(),
+			"newRequest": newRequest,
+		}).Error("Unable to check for recent denials")
+		return time.Time{}, err
+	}
+	_, reapplyAfter, _ := worker.CooldownDenial(denials, now)
+	return reapplyAfter, nil
+}
+
+// reapplyCountdown returns when the applicant of the denied request may apply again and the seconds left until
+// then, for the status page to show a countdown. Nil and 0 once they may apply
+func reapplyCountdown(request types.WhitelistRequest, now time.Time) (*time.Time, int) {
+	reapplyAfter, ok := worker.ReapplyAfter(request)
+	if !ok || !reapplyAfter.After(now) {
+		return nil, 0
+	}
+	return &reapplyAfter, int(math.Ceil(reapplyAfter.Sub(now).Seconds()))
+}
+
+// reapplyCooldownMessage tells the applicant when they may apply again
+func reapplyCooldownMessage(reapplyAfter time.Time) string {
+	return "Your previous request was denied recently. You may submit another request after " +
+		reapplyAfter.UTC().Format("January 2, 2006 15:04 MST")
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/attachments"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErasureBody selects the requests whose personal data is erased: one request by ID or every request of an
+// email. Requests that never got approved are deleted instead of anonymized if Delete is set
+type ErasureBody struct {
+	RequestID string `json:"requestId"`
+	Email     string `json:"email"`
+	Delete    bool   `json:"delete"`
+}
+
+// ErasureResult lists the IDs of the requests anonymized and of the requests deleted
+type ErasureResult struct {
+	Erased  []string `json:"erased"`
+	Deleted []string `json:"deleted"`
+}
+
+// erasedRequests returns the requests selected by the body
+func (svc *Service) erasedRequests(body ErasureBody) ([]types.WhitelistRequest, int, error) {
+	if (body.RequestID == "") == (body.Email == "") {
+		return nil, http.StatusBadRequest, errors.New("Either requestId or email is required")
+	}
+	var requests []types.WhitelistRequest
+	var err error
+	if body.RequestID != "" {
+		_id, idErr := primitive.ObjectIDFromHex(body.RequestID)
+		if idErr != nil {
+			return nil, http.StatusBadRequest, errors.New("Invalid request ID")
+		}
+		requests, err = svc.dbService.GetRequests(1, bson.M{"_id": _id})
+	} else {
+		requests, err = svc.dbService.FindRequestsOfEmail(body.Email)
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("Unable to get requests")
+	}
+	if len(requests) == 0 {
+		return nil, http.StatusNotFound, errors.New("Resource not found")
+	}
+	return requests, http.StatusOK, nil
+}
+
+// eraseRequests anonymizes or deletes the selected requests and refreshes them in the cache. Only the
+// erasure is recorded in the audit log, not the erased values
+func (svc *Service) eraseRequests(body ErasureBody, actor string) (ErasureResult, int, error) {
+	requests, statusCode, err := svc.erasedRequests(body)
+	if err != nil {
+		return ErasureResult{}, statusCode, err
+	}
+	result := ErasureResult{Erased: []string{}, Deleted: []string{}}
+	ids := make([]primitive.ObjectID, 0, len(requests))
+	defer func() {
+		// Also the requests erased before a failure
+		svc.refreshErasedRequests(ids, len(result.Deleted) > 0)
+	}()
+	for _, request := range requests {
+		// Deleted first, so the request still references them if it fails
+		if err = deleteAttachments(request); err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"ID":  request.ID.Hex(),
+			}).Error("Unable to delete the attachments of erased request")
+			return result, http.StatusInternalServerError, errors.New("Unable to delete the attachments of request " + request.ID.Hex())
+		}
+		deleted := false
+		if body.Delete && db.Deletable(request) {
+			err = svc.dbService.DeleteUnapprovedRequest(request.ID)
+			// Anonymized instead if it got approved in the meantime
+			deleted = err == nil
+			if err == mongo.ErrNoDocuments {
+				err = nil
+			}
+		}
+		if err == nil && !deleted {
+			request, err = svc.dbService.EraseRequest(request.ID, time.Now())
+		}
+		if err == mongo.ErrNoDocuments {
+			// Removed in the meantime, nothing left to erase
+			continue
+		} else if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"ID":  request.ID.Hex(),
+			}).Error("Unable to erase request")
+			return result, http.StatusInternalServerError, errors.New("Unable to erase request " + request.ID.Hex())
+		}
+		ids = append(ids, request.ID)
+		if deleted {
+			result.Deleted = append(result.Deleted, request.ID.Hex())
+		} else {
+			result.Erased = append(result.Erased, request.ID.Hex())
+		}
+		entry := requestAuditEntry("request.erase", actor, request, nil)
+		entry.Details["deleted"] = deleted
+		svc.audit(entry)
+	}
+	return result, http.StatusOK, nil
+}
+
+// deleteAttachments deletes the files attached to the request. They stay stored if attachments have been
+// disabled since, which is reported instead
+func deleteAttachments(request types.WhitelistRequest) error {
+	if len(request.Attachments) == 0 {
+		return nil
+	}
+	store, err := attachments.FromConfig()
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		return errors.New("attachmentsStorage is not set, the attachments of the request can not be deleted")
+	}
+	return attachments.DeleteAll(store, request.Attachments)
+}
+
+// refreshErasedRequests removes the erased values from the cache. The stats are synced again if requests
+// have been deleted. Best effort only, the admin CLI has no cache
+func (svc *Service) refreshErasedRequests(ids []primitive.ObjectID, deleted bool) {
+	if svc.cache == nil || len(ids) == 0 {
+		return
+	}
+	svc.refreshCachedRequests(ids...)
+	if !deleted {
+		return
+	}
+	err := svc.cache.SyncStats()
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to sync stats after deleting requests")
+	}
+}
+
+// EraseRequests erases the personal data of the requests the same way admins do through the API, e.g for the
+// admin CLI
+func (svc *Service) EraseRequests(body ErasureBody, actor string) (ErasureResult, error) {
+	result, _, err := svc.eraseRequests(body, actor)
+	return result, err
+}
+
+// HandleEraseRequests erase the personal data of an applicant on their request. The email and the answers
+// of the application are anonymized, the username and status are kept for the whitelist and the stats
+func (svc *Service) HandleEraseRequests() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body ErasureBody
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		result, statusCode, err := svc.eraseRequests(body, getActor(r))
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "success",
+			"erased":  result.Erased,
+			"deleted": result.Deleted,
+		})
+	}
+}
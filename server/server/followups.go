@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Dismissing a follow-up records ops dealt with it, e.g after reaching out to the player
+const followUpDismiss = "dismiss"
+
+// followUpBody is the body of an action on a request flagged for follow-up
+type followUpBody struct {
+	Action string `json:"action"`
+}
+
+// HandleGetFollowUps list the approved requests flagged for follow-up with the suggested actions, most recent first
+func (svc *Service) HandleGetFollowUps() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requests, err := svc.store.QueryRequests(db.RequestFilter{
+			Statuses: []string{types.StatusApproved},
+			FollowUp: true,
+		})
+		if err != nil {
+			http.Error(w, "Unable to get follow-ups", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get follow-ups")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"followUps": requests})
+	}
+}
+
+// HandleFollowUp act on a request flagged for follow-up through the existing flows: resendEmail resends the
+// decision email, deactivate deactivates the player and dismiss clears the flag once ops reached out
+func (svc *Service) HandleFollowUp() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body followUpBody
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		switch body.Action {
+		case types.FollowUpResendEmail, types.FollowUpDeactivate, followUpDismiss:
+		default:
+			http.Error(w, fmt.Sprintf("Unknown action %q. Allowed values: [%s, %s, %s]", body.Action,
+				types.FollowUpResendEmail, types.FollowUpDeactivate, followUpDismiss), http.StatusBadRequest)
+			return
+		}
+		requestID := mux.Vars(r)["requestId"]
+		_id, err := primitive.ObjectIDFromHex(requestID)
+		if err != nil {
+			http.Error(w, "Invalid request ID", http.StatusBadRequest)
+			return
+		}
+		request, err := svc.store.GetRequest(_id)
+		if err == db.ErrNotFound {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to get request", http.StatusInternalServerError)
+			return
+		}
+		if request.Status != types.StatusApproved || request.FollowUp == nil || request.FollowUp.DismissedAt != nil {
+			http.Error(w, "Request is not flagged for follow-up", http.StatusConflict)
+			return
+		}
+		actor := getActor(r)
+		statusCode := http.StatusOK
+		switch body.Action {
+		case types.FollowUpResendEmail:
+			_, statusCode, err = svc.resendEmail(requestID, ResendBody{Email: types.EmailDecision}, actor)
+		case types.FollowUpDeactivate:
+			_, statusCode, err = svc.applyRequestChange(requestID, bson.M{
+				"status":               types.StatusDeactivated,
+				"lastUpdatedTimestamp": time.Now(),
+			}, actor, types.StatusApproved)
+		case followUpDismiss:
+			statusCode, err = svc.dismissFollowUp(request, actor)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success"})
+	}
+}
+
+// dismissFollowUp clears the follow-up flag of the request for good and records it in the audit log
+func (svc *Service) dismissFollowUp(request types.WhitelistRequest, actor string) (int, error) {
+	now := time.Now()
+	followUp := *request.FollowUp
+	followUp.DismissedAt = &now
+	followUp.DismissedBy = actor
+	err := svc.store.SetFollowUp(request.ID, &followUp)
+	if err == db.ErrConflict {
+		return http.StatusConflict, errors.New("Request is no longer approved")
+	} else if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err":       err.Error(),
+			"requestID": request.ID.Hex(),
+		}).Error("Unable to dismiss follow-up")
+		return http.StatusInternalServerError, errors.New("Unable to dismiss follow-up")
+	}
+	entry := requestAuditEntry("request.followup.dismiss", actor, request, nil)
+	entry.Details["reasons"] = followUp.Reasons
+	svc.audit(entry)
+	return http.StatusOK, nil
+}
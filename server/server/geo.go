@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/geoip"
+)
+
+// countryReader returns the reader of the geo database at geoipDatabasePath, opened on first use. Nil if no
+// database is configured or it can not be read, so requests are not enriched
+func (svc *Service) countryReader() *geoip.Reader {
+	path := viper.GetString("geoipDatabasePath")
+	svc.countriesMu.Lock()
+	defer svc.countriesMu.Unlock()
+	if path == svc.countriesPath {
+		return svc.countries
+	}
+	svc.countriesPath = path
+	svc.countries = nil
+	if path == "" {
+		return nil
+	}
+	reader, err := geoip.Open(path)
+	if os.IsNotExist(err) {
+		svc.logger.WithFields(logrus.Fields{
+			"path": path,
+		}).Info("Geo database not found. Requests are not enriched with their country")
+		return nil
+	} else if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"path": path,
+			"err":  err.Error(),
+		}).Warning("Unable to read geo database. Requests are not enriched with their country")
+		return nil
+	}
+	svc.countries = reader
+	return reader
+}
+
+// submissionCountry returns the ISO code of the country of the address. Best effort only, empty if unknown
+func (svc *Service) submissionCountry(ip string) string {
+	reader := svc.countryReader()
+	parsed := net.ParseIP(ip)
+	if reader == nil || parsed == nil {
+		return ""
+	}
+	country, err := reader.Country(parsed)
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to look up the country of the submission address")
+		return ""
+	}
+	return country
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/attachments"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Room for the multipart headers around an uploaded file of the maximum size
+const multipartOverhead = 64 << 10
+
+// attachmentStore returns the store of attachments, writing the error if attachments are disabled or the store
+// can not be set up
+func (svc *Service) attachmentStore(w http.ResponseWriter) attachments.Store {
+	store, err := attachments.FromConfig()
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to set up the store of attachments")
+		http.Error(w, "Unable to store attachments", http.StatusInternalServerError)
+		return nil
+	}
+	if store == nil {
+		http.Error(w, "Attachments are not accepted", http.StatusNotFound)
+	}
+	return store
+}
+
+// HandleUploadAttachment stores an image the applicant attaches to the request they are about to submit, sent
+// as the file field of a multipart form. The key of the stored file is returned for the attachments of the
+// new request
+func (svc *Service) HandleUploadAttachment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := svc.attachmentStore(w)
+		if store == nil {
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, attachments.MaxBytes()+multipartOverhead)
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "The attachment must be sent as the file field of a multipart form, at most the maximum size", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(file, attachments.MaxBytes()+1))
+		if err != nil {
+			http.Error(w, "Unable to read the attachment", http.StatusBadRequest)
+			return
+		}
+		contentType, err := attachments.Check(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key, err := attachments.NewKey(contentType)
+		if err == nil {
+			err = store.Put(key, contentType, data)
+		}
+		if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to store attachment")
+			http.Error(w, "Unable to store the attachment", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"key": key})
+	}
+}
+
+// validateAttachments checks the new request only references as many attachments as allowed, by the keys
+// returned on upload
+func validateAttachments(newRequest *types.WhitelistRequest) error {
+	if len(newRequest.Attachments) == 0 {
+		newRequest.Attachments = nil
+		return nil
+	}
+	if !attachments.Enabled() {
+		return errors.New("Attachments are not accepted")
+	}
+	if len(newRequest.Attachments) > attachments.MaxCount() {
+		return fmt.Errorf("At most %d attachments are accepted", attachments.MaxCount())
+	}
+	seen := make(map[string]bool)
+	for _, key := range newRequest.Attachments {
+		if !attachments.ValidKey(key) || seen[key] {
+			return fmt.Errorf("Invalid attachment %q", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// HandleGetAttachment serves the attachment of a signed download link, see utils.AttachmentURL
+func (svc *Service) HandleGetAttachment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := utils.VerifyAttachmentToken(mux.Vars(r)["attachmentToken"])
+		if err == utils.ErrTokenExpired {
+			http.Error(w, "The link has expired", http.StatusGone)
+			return
+		} else if err != nil || !attachments.ValidKey(key) {
+			svc.tokenError(w, r, errInvalidToken)
+			return
+		}
+		store := svc.attachmentStore(w)
+		if store == nil {
+			return
+		}
+		file, err := store.Get(key)
+		if err == attachments.ErrNotFound {
+			// Erased since the link was signed
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"key": key,
+			}).Error("Unable to read attachment")
+			http.Error(w, "Unable to read the attachment", http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+		// Only images are stored, the type is not sniffed again by browsers
+		w.Header().Set("Content-Type", attachments.ContentType(key))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Disposition", "inline")
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, file)
+	}
+}
+
+// HandleGetRequestAttachments returns the download links of the attachments of a request for the dashboard.
+// They are signed on every view and expire after attachments.ViewLinkTTL
+func (svc *Service) HandleGetRequestAttachments() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_id, err := primitive.ObjectIDFromHex(mux.Vars(r)["requestId"])
+		if err != nil {
+			http.Error(w, "Invalid requestId", http.StatusBadRequest)
+			return
+		}
+		requests, err := svc.dbService.GetRequests(1, bson.M{"_id": _id})
+		if err != nil {
+			http.Error(w, "Unable to get request", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get request")
+			return
+		} else if len(requests) == 0 {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		links, err := attachments.Links(requests[0].Attachments, attachments.ViewLinkTTL)
+		if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to sign attachment links")
+			http.Error(w, "Unable to sign attachment links", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"attachments": links})
+	}
+}
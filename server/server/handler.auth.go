@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"net/http"
 	"time"
@@ -73,6 +75,24 @@ func (svc *Service) HandleAdminSignin() http.HandlerFunc {
 	}
 }
 
+// authenticate accepts requests carrying one of the configured API keys in the X-API-Key header,
+// otherwise falls back to verifying the jwt auth token
+func (svc *Service) authenticate(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		for _, apiKey := range viper.GetStringSlice("apiKeys") {
+			if apiKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+				// Expose the API key caller the same way the jwt middleware exposes admin users
+				token := &jwt.Token{Claims: jwt.MapClaims{"username": "api-key"}, Valid: true}
+				next(w, r.WithContext(context.WithValue(r.Context(), "user", token)))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	svc.GetAuthMiddleware().HandlerWithNext(w, r, next)
+}
+
 // GetAuthMiddleware return the auth middleware which verifys jwt auth token
 func (svc *Service) GetAuthMiddleware() *jwtmiddleware.JWTMiddleware {
 	if authMiddleware == nil {
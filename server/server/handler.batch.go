@@ -0,0 +1,286 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type batchBody struct {
+	Name    string    `json:"name"`
+	EndTime time.Time `json:"endTime"`
+}
+
+// validate checks a new batch or a change to an existing one
+// Zero fields are allowed when the batch is only partially updated
+func (b batchBody) validate(partial bool) error {
+	if strings.TrimSpace(b.Name) == "" && !partial {
+		return errors.New("Batch name is required")
+	}
+	if b.EndTime.IsZero() {
+		if partial {
+			return nil
+		}
+		return errors.New("Batch endTime is required")
+	}
+	if !b.EndTime.After(time.Now()) {
+		return errors.New("Batch endTime must be in the future")
+	}
+	return nil
+}
+
+// HandleCreateBatch create a new event batch that approvals can be attached to
+func (svc *Service) HandleCreateBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body batchBody
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		if err := body.validate(false); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		batch, err := svc.dbService.CreateBatch(types.Batch{
+			Name:    strings.TrimSpace(body.Name),
+			EndTime: body.EndTime,
+		})
+		if err != nil {
+			http.Error(w, "Unable to create batch", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to create batch")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"batch": batch})
+	}
+}
+
+// HandleGetBatches get all event batches
+func (svc *Service) HandleGetBatches() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batches, err := svc.dbService.GetBatches(bson.M{})
+		if err != nil {
+			http.Error(w, "Unable to get batches", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get batches")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"batches": batches})
+	}
+}
+
+// HandleGetBatchByID get an event batch together with its members and stats
+func (svc *Service) HandleGetBatchByID() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batch, statusCode, err := svc.getBatchByID(mux.Vars(r)["batchId"])
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		members, err := svc.dbService.GetRequests(-1, bson.M{"batchId": batch.ID.Hex()})
+		if err != nil {
+			http.Error(w, "Unable to get batch members", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get batch members")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"batch":   batch,
+			"members": members,
+			"stats":   batchStats(batch, members),
+		})
+	}
+}
+
+// HandlePatchBatchByID rename an active batch or move its end time
+func (svc *Service) HandlePatchBatchByID() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_id, err := primitive.ObjectIDFromHex(mux.Vars(r)["batchId"])
+		if err != nil {
+			http.Error(w, "Invalid batchId", http.StatusBadRequest)
+			return
+		}
+		var body batchBody
+		err = json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		if err := body.validate(true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		change := bson.M{}
+		if name := strings.TrimSpace(body.Name); name != "" {
+			change["name"] = name
+		}
+		if !body.EndTime.IsZero() {
+			change["endTime"] = body.EndTime
+		}
+		if len(change) == 0 {
+			http.Error(w, "Nothing to update", http.StatusBadRequest)
+			return
+		}
+		// Batches that already ended can no longer be changed
+		batch, err := svc.dbService.ConditionalUpdateBatch(bson.M{
+			"_id":    _id,
+			"status": types.BatchStatusActive,
+		}, bson.M{"$set": change})
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Batch does not exist or has already ended", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to update batch", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "updated": batch})
+	}
+}
+
+// HandleDeleteBatch delete a batch. Its members are kept as permanent members
+func (svc *Service) HandleDeleteBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batch, statusCode, err := svc.getBatchByID(mux.Vars(r)["batchId"])
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		members, err := svc.dbService.GetRequests(-1, bson.M{"batchId": batch.ID.Hex()})
+		if err != nil {
+			http.Error(w, "Unable to get batch members", http.StatusInternalServerError)
+			return
+		}
+		_, err = svc.dbService.UpdateRequests(bson.M{"batchId": batch.ID.Hex()}, bson.M{
+			"$unset": bson.M{"batchId": ""},
+		})
+		if err != nil {
+			http.Error(w, "Unable to detach batch members", http.StatusInternalServerError)
+			return
+		}
+		err = svc.dbService.DeleteBatch(batch.ID)
+		if err != nil && err != mongo.ErrNoDocuments {
+			http.Error(w, "Unable to delete batch", http.StatusInternalServerError)
+			return
+		}
+		memberIDs := make([]primitive.ObjectID, 0, len(members))
+		for _, member := range members {
+			memberIDs = append(memberIDs, member.ID)
+		}
+		svc.refreshCachedRequests(memberIDs...)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success"})
+	}
+}
+
+// HandleDetachBatchMember convert a member of an active batch to a permanent member
+func (svc *Service) HandleDetachBatchMember() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		batch, statusCode, err := svc.getBatchByID(vars["batchId"])
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		if batch.Status != types.BatchStatusActive {
+			http.Error(w, "Batch has already ended", http.StatusConflict)
+			return
+		}
+		requestID, err := primitive.ObjectIDFromHex(vars["requestId"])
+		if err != nil {
+			http.Error(w, "Invalid requestId", http.StatusBadRequest)
+			return
+		}
+		detachedRequest, err := svc.dbService.ConditionalUpdateRequest(bson.M{
+			"_id":     requestID,
+			"batchId": batch.ID.Hex(),
+		}, bson.M{
+			"$unset": bson.M{"batchId": ""},
+			"$set":   bson.M{"lastUpdatedTimestamp": time.Now()},
+		})
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Request is not a member of the batch", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to detach request", http.StatusInternalServerError)
+			return
+		}
+		_, err = svc.dbService.ConditionalUpdateBatch(bson.M{"_id": batch.ID}, bson.M{
+			"$inc": bson.M{"detachedCount": 1},
+		})
+		if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err":     err.Error(),
+				"batchId": batch.ID.Hex(),
+			}).Warning("Unable to update detached count of batch")
+		}
+		svc.refreshCachedRequests(requestID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "updated": detachedRequest})
+	}
+}
+
+func (svc *Service) getBatchByID(batchID string) (types.Batch, int, error) {
+	_id, err := primitive.ObjectIDFromHex(batchID)
+	if err != nil {
+		return types.Batch{}, http.StatusBadRequest, errors.New("Invalid batchId")
+	}
+	batches, err := svc.dbService.GetBatches(bson.M{"_id": _id})
+	if err != nil {
+		return types.Batch{}, http.StatusInternalServerError, errors.New("Unable to get batch")
+	}
+	if len(batches) == 0 {
+		return types.Batch{}, http.StatusNotFound, errors.New("Resource not found")
+	}
+	return batches[0], http.StatusOK, nil
+}
+
+// refreshCachedRequests updates the cached entries of the requests. Best effort only
+func (svc *Service) refreshCachedRequests(ids ...primitive.ObjectID) {
+	err := svc.cache.RefreshRequests(ids...)
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to refresh all requests in cache")
+	}
+}
+
+func batchStats(batch types.Batch, members []types.WhitelistRequest) types.BatchStats {
+	stats := types.BatchStats{
+		Members:  int64(len(members)),
+		Detached: batch.DetachedCount,
+	}
+	for _, member := range members {
+		switch member.Status {
+		case types.StatusApproved:
+			stats.Approved++
+		case types.StatusDeactivated:
+			stats.Deactivated++
+		case types.StatusBanned:
+			stats.Banned++
+		}
+	}
+	return stats
+}
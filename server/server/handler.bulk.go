@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxBulkDecisionSize is the most requests decided by one bulk decision
+const maxBulkDecisionSize = 100
+
+// Results of the requests of a bulk decision
+const (
+	bulkResultOK       = "ok"
+	bulkResultConflict = "conflict"
+	bulkResultNotFound = "not-found"
+	bulkResultInvalid  = "invalid"
+	bulkResultError    = "error"
+)
+
+// bulkResult is the outcome of the decision on one request of a bulk decision
+type bulkResult struct {
+	ID     string `json:"id"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HandleBulkDecision approves or denies up to maxBulkDecisionSize pending requests at once, e.g the applicants of
+// an event. Each request is decided on its own like with HandleInternalPatchRequestByID, so the response tells
+// the result of every request and the others are decided even if some fail
+func (svc *Service) HandleBulkDecision() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		ids, err := bulkDecisionIDs(body["ids"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		delete(body, "ids")
+		status := body["status"]
+		if status != types.StatusApproved && status != types.StatusDenied {
+			http.Error(w, fmt.Sprintf("status must be %s or %s", types.StatusApproved, types.StatusDenied), http.StatusBadRequest)
+			return
+		}
+		// The change is validated once, e.g the decision reason and the event batch approvals are attached to
+		reqBody, _ := json.Marshal(body)
+		requestedChange, statusCode, err := svc.requestChange(reqBody, "admin")
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		bulkID := primitive.NewObjectID().Hex()
+		load := func(ids []primitive.ObjectID) ([]types.WhitelistRequest, error) {
+			return svc.dbService.GetRequests(-1, bson.M{"_id": bson.M{"$in": ids}})
+		}
+		results, err := decideInBulk(ids, load, func(request types.WhitelistRequest) (int, error) {
+			_, statusCode, err := svc.applyRequestChangeInBulk(request.ID.Hex(), requestedChange, "admin", request.Status, bulkID)
+			return statusCode, err
+		})
+		if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get requests of bulk decision")
+			http.Error(w, "Unable to get requests", http.StatusInternalServerError)
+			return
+		}
+		succeeded := 0
+		for _, result := range results {
+			if result.Result == bulkResultOK {
+				succeeded++
+			}
+		}
+		svc.logger.WithFields(logrus.Fields{
+			"bulkId":    bulkID,
+			"status":    status,
+			"succeeded": succeeded,
+			"failed":    len(results) - succeeded,
+		}).Info("Bulk decision applied")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"bulkId":    bulkID,
+			"status":    status,
+			"succeeded": succeeded,
+			"failed":    len(results) - succeeded,
+			"results":   results,
+		})
+	}
+}
+
+// bulkDecisionIDs returns the IDs of the requests to decide, without duplicates
+func bulkDecisionIDs(value interface{}) ([]string, error) {
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, errors.New("ids must be a non-empty list of request IDs")
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, item := range list {
+		id, ok := item.(string)
+		if !ok {
+			return nil, errors.New("ids must be a non-empty list of request IDs")
+		}
+		id = strings.TrimSpace(id)
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > maxBulkDecisionSize {
+		return nil, fmt.Errorf("At most %d requests can be decided at once", maxBulkDecisionSize)
+	}
+	return ids, nil
+}
+
+// decideInBulk decides the requests with the IDs in order with decide. The requests are loaded at once and only
+// pending and disputed requests are decided. decide returns the status code of the change, http.StatusConflict
+// if the request changed status in the meantime
+func decideInBulk(ids []string, load func(ids []primitive.ObjectID) ([]types.WhitelistRequest, error),
+	decide func(request types.WhitelistRequest) (int, error)) ([]bulkResult, error) {
+	results := make([]bulkResult, len(ids))
+	var objectIDs []primitive.ObjectID
+	for i, id := range ids {
+		results[i].ID = id
+		objectID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			results[i].Result, results[i].Error = bulkResultInvalid, "Invalid request ID"
+			continue
+		}
+		objectIDs = append(objectIDs, objectID)
+	}
+	requests := make(map[string]types.WhitelistRequest)
+	if len(objectIDs) > 0 {
+		found, err := load(objectIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, request := range found {
+			requests[request.ID.Hex()] = request
+		}
+	}
+	for i := range results {
+		if results[i].Result != "" {
+			continue
+		}
+		request, ok := requests[results[i].ID]
+		if !ok {
+			results[i].Result, results[i].Error = bulkResultNotFound, errRequestNotFound.Error()
+			continue
+		}
+		if request.Status != types.StatusPending && request.Status != types.StatusDisputed {
+			results[i].Result, results[i].Error = bulkResultConflict, "Request is "+strings.ToLower(request.Status)
+			continue
+		}
+		statusCode, err := decide(request)
+		switch {
+		case err == nil:
+			results[i].Result = bulkResultOK
+		case statusCode == http.StatusConflict:
+			results[i].Result, results[i].Error = bulkResultConflict, err.Error()
+		case statusCode == http.StatusNotFound:
+			results[i].Result, results[i].Error = bulkResultNotFound, err.Error()
+		default:
+			results[i].Result, results[i].Error = bulkResultError, err.Error()
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Actor of cancellations in the audit log
+const applicantActor = "applicant"
+
+// errRequestWithdrawn is returned to ops acting on a request the applicant has cancelled
+var errRequestWithdrawn = errors.New("Request was withdrawn by the applicant")
+
+// HandleCancelRequest let the applicant withdraw their pending request from the status page. The worker
+// tells the assigned ops so they do not act on the action email
+func (svc *Service) HandleCancelRequest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request, _, err := svc.getRequestByEncryptedID(mux.Vars(r)["requestIdEncoded"], utils.PurposeStatus)
+		if err != nil {
+			svc.tokenError(w, r, err)
+			return
+		}
+		// Only the first of concurrent decisions and cancellations is applied
+		cancelledRequest, err := svc.writeAndPublish(func(writer db.RequestWriter) (types.WhitelistRequest, error) {
+			cancelledRequest, err := writer.TransitionStatus(request.ID, types.StatusPending, types.StatusCancelled, bson.M{
+				"$set": bson.M{"lastUpdatedTimestamp": time.Now()},
+			})
+			cancelledRequest.PreviousStatus = types.StatusPending
+			return cancelledRequest, err
+		})
+		if err == db.ErrConflict {
+			http.Error(w, "Only pending requests can be cancelled", http.StatusConflict)
+			return
+		} else if err != nil && err != errTaskNotPublished {
+			http.Error(w, "Unable to cancel request", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"ID":  request.ID.Hex(),
+			}).Error("Unable to cancel request")
+			return
+		}
+		// If its task is not published the request stays cancelled. Stats are corrected by the next sync
+		svc.audit(requestAuditEntry("request.cancel", applicantActor, cancelledRequest, nil))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success"})
+	}
+}
+
+// withdrawnError tells ops that a decision did not apply because the applicant cancelled the request
+// in the meantime. Returns err otherwise
+func (svc *Service) withdrawnError(requestID string, err error) error {
+	request, readErr := svc.getRequestByID(requestID)
+	if readErr == nil && request.Status == types.StatusCancelled {
+		return errRequestWithdrawn
+	}
+	return err
+}
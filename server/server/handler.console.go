@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/rcon"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type consoleCommand struct {
+	Command string `json:"command"`
+}
+
+const (
+	// Interval the task of a console command is polled at while waiting for the server response
+	consolePollInterval = 250 * time.Millisecond
+	// Seconds waited for the server response if consoleResponseTimeoutSeconds is not configured
+	defaultConsoleResponseTimeoutSeconds = 5
+)
+
+// consoleEnabled reports whether the console endpoints are enabled. They are disabled unless explicitly enabled
+func consoleEnabled() bool {
+	return viper.GetBool("consoleEnabled")
+}
+
+// HandleRunConsoleCommand queue an allow-listed console command for the worker to run on the game server
+// The raw server response is returned if the worker runs the command within consoleResponseTimeoutSeconds,
+// otherwise it is available asynchronously through the task status endpoint
+func (svc *Service) HandleRunConsoleCommand() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := svc.logger
+		if !consoleEnabled() {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		var body consoleCommand
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		if !rcon.IsCommandAllowed(body.Command, viper.GetStringSlice("consoleAllowlist")) {
+			http.Error(w, "Command is not allowed", http.StatusForbidden)
+			return
+		}
+		task := types.ConsoleTask{
+			Command: body.Command,
+			Actor:   getActor(r),
+		}
+		task.ID, err = svc.dbService.CreateTask(task)
+		if err != nil {
+			http.Error(w, "Unable to create console task", http.StatusInternalServerError)
+			log.WithFields(logrus.Fields{
+				"err":  err.Error(),
+				"task": task,
+			}).Error("Unable to create console task")
+			return
+		}
+		err = svc.broker.PublishConsoleTask(task)
+		if err != nil {
+			http.Error(w, "Unable to create console task", http.StatusInternalServerError)
+			log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"task":  task,
+			}).Error("Unable to publish message to broker")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		timeoutSeconds := defaultConsoleResponseTimeoutSeconds
+		if viper.IsSet("consoleResponseTimeoutSeconds") {
+			timeoutSeconds = viper.GetInt("consoleResponseTimeoutSeconds")
+		}
+		timeout := time.Duration(timeoutSeconds) * time.Second
+		if completed, ok := svc.waitForConsoleTask(r.Context(), task.ID, timeout); ok {
+			w.WriteHeader(http.StatusOK)
+			msg := map[string]interface{}{
+				"message":  "success",
+				"task":     task.ID,
+				"status":   completed.Status,
+				"response": completed.Response,
+				"error":    completed.Error,
+			}
+			json.NewEncoder(w).Encode(msg)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		msg := map[string]interface{}{"message": "success", "task": task.ID}
+		json.NewEncoder(w).Encode(msg)
+	}
+}
+
+// waitForConsoleTask polls the task until the worker completed it, for at most the timeout. Returns false if
+// the task is not completed in time, e.g while the game server is down and the command is retried
+func (svc *Service) waitForConsoleTask(ctx context.Context, id primitive.ObjectID, timeout time.Duration) (types.ConsoleTask, bool) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return types.ConsoleTask{}, false
+		case <-time.After(consolePollInterval):
+		}
+		task, err := svc.dbService.GetTask(id)
+		if err == nil && (task.Status == "Completed" || task.Status == "Failed") {
+			return task, true
+		}
+	}
+	return types.ConsoleTask{}, false
+}
+
+// HandleGetTaskByID get the current status and server response of a console task
+func (svc *Service) HandleGetTaskByID() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !consoleEnabled() {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		_id, err := primitive.ObjectIDFromHex(mux.Vars(r)["taskId"])
+		if err != nil {
+			http.Error(w, "Invalid taskId", http.StatusBadRequest)
+			return
+		}
+		task, err := svc.dbService.GetTask(_id)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to get task", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"task": task})
+	}
+}
+
+// Get the admin username from the validated jwt token set by the auth middleware
+func getActor(r *http.Request) string {
+	token, ok := r.Context().Value("user").(*jwt.Token)
+	if !ok {
+		return ""
+	}
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		if username, ok := claims["username"].(string); ok {
+			return username
+		}
+	}
+	return ""
+}
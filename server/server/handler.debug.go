@@ -0,0 +1,266 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Maximum number of messages peeked per queue if debugQueuePeekLimit is not configured
+	defaultDebugQueuePeekLimit = 50
+	// Number of recent audit entries and console tasks included in the debug view
+	debugHistoryLimit = 10
+)
+
+// requestDebug is everything known about one request across db, cache, message queue and scheduler
+type requestDebug struct {
+	Request types.WhitelistRequest `json:"request"`
+	// Ops the action email was sent to
+	NotifiedOps   []string           `json:"notifiedOps"`
+	Cache         cacheDebug         `json:"cache"`
+	Queues        []queueDebug       `json:"queues"`
+	Scheduled     []scheduledAction  `json:"scheduled"`
+	AuditEntries  []types.AuditEntry `json:"auditEntries"`
+	RCONResponses []rconResponse     `json:"rconResponses"`
+	Errors        []string           `json:"errors,omitempty"`
+}
+
+type cacheDebug struct {
+	Cached bool `json:"cached"`
+	// Whether the cached copy matches the document in db
+	InSync bool                    `json:"inSync"`
+	Entry  *types.WhitelistRequest `json:"entry,omitempty"`
+}
+
+type queueDebug struct {
+	Queue string `json:"queue"`
+	// Number of ready messages in the queue. Only up to debugQueuePeekLimit of them are scanned
+	Ready     int             `json:"ready"`
+	Scanned   int             `json:"scanned"`
+	Truncated bool            `json:"truncated"`
+	Messages  []queuedMessage `json:"messages"`
+	Error     string          `json:"error,omitempty"`
+}
+
+type queuedMessage struct {
+	// Position of the message among the ready messages of the queue
+	Position    int                    `json:"position"`
+	Status      string                 `json:"status"`
+	Redelivered bool                   `json:"redelivered"`
+	Headers     map[string]interface{} `json:"headers,omitempty"`
+}
+
+type scheduledAction struct {
+	Action  string    `json:"action"`
+	DueAt   time.Time `json:"dueAt"`
+	Overdue bool      `json:"overdue"`
+}
+
+type rconResponse struct {
+	TaskID    primitive.ObjectID `json:"taskId"`
+	Command   string             `json:"command"`
+	Status    string             `json:"status"`
+	Response  string             `json:"response"`
+	Error     string             `json:"error,omitempty"`
+	Timestamp time.Time          `json:"timestamp"`
+}
+
+// debugSources are the raw states gathered for a request. Lookups that failed are recorded in Errors
+type debugSources struct {
+	Request        types.WhitelistRequest
+	Batch          *types.Batch
+	CachedRequests []types.WhitelistRequest
+	Queues         []queueDebug
+	AuditEntries   []types.AuditEntry
+	Tasks          []types.ConsoleTask
+	Errors         []string
+}
+
+// HandleGetRequestDebug assemble everything known about a single request to help debugging stuck requests:
+// the document in db, its cached copy, pending messages in the task, retry and dead letter queues,
+// scheduled actions and recent audit entries and RCON responses about the player. Lookups are best effort,
+// failures are reported in the response instead of failing the request
+func (svc *Service) HandleGetRequestDebug() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_id, err := primitive.ObjectIDFromHex(mux.Vars(r)["requestId"])
+		if err != nil {
+			http.Error(w, "Invalid requestId", http.StatusBadRequest)
+			return
+		}
+		requests, err := svc.dbService.GetRequests(1, bson.M{"_id": _id})
+		if err != nil {
+			http.Error(w, "Unable to get request", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get request")
+			return
+		} else if len(requests) == 0 {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		sources := svc.gatherDebugSources(requests[0])
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"debug": assembleRequestDebug(sources, time.Now())})
+	}
+}
+
+func (svc *Service) gatherDebugSources(request types.WhitelistRequest) debugSources {
+	sources := debugSources{Request: request}
+	if request.BatchID != "" {
+		batch, _, err := svc.getBatchByID(request.BatchID)
+		if err != nil {
+			sources.Errors = append(sources.Errors, "batch: "+err.Error())
+		} else {
+			sources.Batch = &batch
+		}
+	}
+	cachedRequests, err := svc.cache.GetAllRequests()
+	if err != nil {
+		sources.Errors = append(sources.Errors, "cache: "+err.Error())
+	} else {
+		sources.CachedRequests = cachedRequests
+	}
+
+	limit := viper.GetInt("debugQueuePeekLimit")
+	if limit <= 0 {
+		limit = defaultDebugQueuePeekLimit
+	}
+	for _, name := range svc.broker.Topology().Queues() {
+		queue := queueDebug{Queue: name, Messages: make([]queuedMessage, 0)}
+		ready, deliveries, err := svc.broker.Peek(name, limit)
+		if err != nil {
+			queue.Error = err.Error()
+		}
+		queue.Ready = ready
+		queue.Scanned = len(deliveries)
+		queue.Truncated = ready > len(deliveries)
+		queue.Messages = matchQueuedMessages(request.ID, deliveries)
+		sources.Queues = append(sources.Queues, queue)
+	}
+
+	// Audit entries and console tasks do not reference requests, match them by the player's username
+	auditEntries, err := svc.dbService.GetAuditEntries(debugHistoryLimit, bson.M{
+		"details.command": db.MentionsWord(request.Username),
+	})
+	if err != nil {
+		sources.Errors = append(sources.Errors, "audit: "+err.Error())
+	}
+	sources.AuditEntries = auditEntries
+	tasks, err := svc.dbService.GetTasks(debugHistoryLimit, bson.M{
+		"command": db.MentionsWord(request.Username),
+	})
+	if err != nil {
+		sources.Errors = append(sources.Errors, "tasks: "+err.Error())
+	}
+	sources.Tasks = tasks
+	return sources
+}
+
+// matchQueuedMessages find the messages about the request among the peeked deliveries.
+// Messages that are not whitelist requests, e.g console tasks, are skipped
+func matchQueuedMessages(requestID primitive.ObjectID, deliveries []amqp.Delivery) []queuedMessage {
+	messages := make([]queuedMessage, 0)
+	for i, d := range deliveries {
+		if taskType, _ := d.Headers[types.TaskTypeHeader].(string); taskType != "" {
+			continue
+		}
+		message, _, err := types.DecodeRequestMessage(d.Body)
+		if err != nil || message.ID != requestID {
+			continue
+		}
+		messages = append(messages, queuedMessage{
+			Position:    i,
+			Status:      message.Status,
+			Redelivered: d.Redelivered,
+			Headers:     d.Headers,
+		})
+	}
+	return messages
+}
+
+func assembleRequestDebug(sources debugSources, now time.Time) requestDebug {
+	request := sources.Request
+	debug := requestDebug{
+		Request:       request,
+		NotifiedOps:   request.Assignees,
+		Queues:        sources.Queues,
+		Scheduled:     scheduledActions(request, sources.Batch, now),
+		AuditEntries:  sources.AuditEntries,
+		RCONResponses: make([]rconResponse, 0),
+		Errors:        sources.Errors,
+	}
+	if debug.NotifiedOps == nil {
+		debug.NotifiedOps = make([]string, 0)
+	}
+	if debug.Queues == nil {
+		debug.Queues = make([]queueDebug, 0)
+	}
+	if debug.AuditEntries == nil {
+		debug.AuditEntries = make([]types.AuditEntry, 0)
+	}
+	for _, cached := range sources.CachedRequests {
+		if cached.ID == request.ID {
+			entry := cached
+			debug.Cache.Cached = true
+			debug.Cache.Entry = &entry
+			debug.Cache.InSync = sameJSON(cached, request)
+			break
+		}
+	}
+	for _, task := range sources.Tasks {
+		debug.RCONResponses = append(debug.RCONResponses, rconResponse{
+			TaskID:    task.ID,
+			Command:   task.Command,
+			Status:    task.Status,
+			Response:  task.Response,
+			Error:     task.Error,
+			Timestamp: task.CompletedTimestamp,
+		})
+	}
+	return debug
+}
+
+// scheduledActions lists the actions background loops will take on the request and when
+func scheduledActions(request types.WhitelistRequest, batch *types.Batch, now time.Time) []scheduledAction {
+	actions := make([]scheduledAction, 0)
+	add := func(action string, dueAt time.Time) {
+		actions = append(actions, scheduledAction{Action: action, DueAt: dueAt, Overdue: !dueAt.After(now)})
+	}
+	switch request.Status {
+	case types.StatusPending:
+		if minutes := viper.GetInt("escalationAfterMinutes"); minutes > 0 && !request.Escalated {
+			add("escalate", request.Timestamp.Add(time.Duration(minutes)*time.Minute))
+		}
+		if hours := viper.GetInt("pendingTTLHours"); hours > 0 {
+			add("expire", request.Timestamp.Add(time.Duration(hours)*time.Hour))
+		}
+	case types.StatusApproved:
+		if request.ExpiresAt != nil {
+			add("deactivateGrant", *request.ExpiresAt)
+		}
+		if request.Provisional && request.ReviewAt != nil && !request.ReviewReminded {
+			add("remindReview", *request.ReviewAt)
+		}
+		if batch != nil && batch.Status == types.BatchStatusActive {
+			add("deactivateBatch", batch.EndTime)
+		}
+	}
+	return actions
+}
+
+func sameJSON(a, b interface{}) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(encodedA) == string(encodedB)
+}
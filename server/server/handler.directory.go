@@ -0,0 +1,197 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/directory"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Mojang allows 600 profile lookups per 10 minutes, shared with the skin lookups
+const defaultDirectoryUUIDLookupsPerRun = 50
+
+type directoryOptOut struct {
+	OptOut bool `json:"optOut"`
+}
+
+// HandleGetDirectory export the member directory of approved players as JSON, or as CSV with ?format=csv
+func (svc *Service) HandleGetDirectory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		members, err := svc.directoryMembers()
+		if err != nil {
+			http.Error(w, "Unable to get members", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get members")
+			return
+		}
+		if r.URL.Query().Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="members.csv"`)
+			w.WriteHeader(http.StatusOK)
+			directory.WriteCSV(w, members)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(directory.Directory{Members: members, UpdatedTimestamp: time.Now()})
+	}
+}
+
+// HandleGetPublicDirectory serve the periodically generated member directory to the community website.
+// Only available if the owner configured directoryPublicToken, which must be passed as ?token=
+func (svc *Service) HandleGetPublicDirectory() http.HandlerFunc {
+	return publicDirectoryHandler(svc.cache.GetDirectory, svc.logger)
+}
+
+func publicDirectoryHandler(getDirectory func() ([]byte, error), log *logrus.Entry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := viper.GetString("directoryPublicToken")
+		if token == "" {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(token)) != 1 {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		blob, err := getDirectory()
+		if err != nil {
+			http.Error(w, "Member directory is not available yet", http.StatusServiceUnavailable)
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warning("Unable to get member directory")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write(blob)
+	}
+}
+
+// HandleDirectoryOptOut let the player hide or show themselves in the member directory from their status page
+func (svc *Service) HandleDirectoryOptOut() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request, _, err := svc.getRequestByEncryptedID(mux.Vars(r)["requestIdEncoded"], utils.PurposeStatus)
+		if err != nil {
+			svc.tokenError(w, r, err)
+			return
+		}
+		var body directoryOptOut
+		err = json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		_, err = svc.dbService.ConditionalUpdateRequest(bson.M{"_id": request.ID}, bson.M{
+			"$set": bson.M{"directoryOptOut": body.OptOut},
+		})
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to update request", http.StatusInternalServerError)
+			return
+		}
+		svc.refreshCachedRequests(request.ID)
+		// Regenerate the published directory right away so opted-out players disappear immediately
+		if viper.GetString("directoryPublicToken") != "" {
+			err = svc.publishDirectory()
+			if err != nil {
+				http.Error(w, "Unable to update member directory", http.StatusInternalServerError)
+				svc.logger.WithFields(logrus.Fields{
+					"err": err.Error(),
+				}).Error("Unable to update member directory")
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "directoryOptOut": body.OptOut})
+	}
+}
+
+// RegenerateDirectory resolve the Mojang UUIDs of members missing one for their avatars
+// and publish the member directory to the cache
+func (svc *Service) RegenerateDirectory() error {
+	if viper.GetBool("directoryAvatars") {
+		svc.resolveMemberUUIDs()
+	}
+	return svc.publishDirectory()
+}
+
+func (svc *Service) publishDirectory() error {
+	members, err := svc.directoryMembers()
+	if err != nil {
+		return err
+	}
+	blob, err := json.Marshal(directory.Directory{Members: members, UpdatedTimestamp: time.Now()})
+	if err != nil {
+		return err
+	}
+	return svc.cache.SetDirectory(blob)
+}
+
+func (svc *Service) directoryMembers() ([]directory.Member, error) {
+	requests, err := svc.dbService.GetRequests(-1, bson.M{
+		"status":          types.StatusApproved,
+		"directoryOptOut": bson.M{"$ne": true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return directory.Members(requests, viper.GetBool("directoryAvatars")), nil
+}
+
+// resolveMemberUUIDs looks up a limited number of missing UUIDs per run to stay within
+// Mojang's rate limit. Best effort only, members without UUID are listed without avatar
+func (svc *Service) resolveMemberUUIDs() {
+	limit := int64(viper.GetInt("directoryUUIDLookupsPerRun"))
+	if limit <= 0 {
+		limit = defaultDirectoryUUIDLookupsPerRun
+	}
+	requests, err := svc.dbService.GetRequests(limit, bson.M{
+		"status":          types.StatusApproved,
+		"directoryOptOut": bson.M{"$ne": true},
+		"uuid":            bson.M{"$exists": false},
+		// Bedrock players have no Mojang account
+		"platform": bson.M{"$ne": utils.PlatformBedrock},
+	})
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to get members without uuid")
+		return
+	}
+	for _, request := range requests {
+		uuid, err := getUUID(request.Username)
+		if _, ok := err.(*RateLimitError); ok {
+			return
+		} else if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"username": request.Username,
+				"err":      err.Error(),
+			}).Debug("Unable to get uuid for the member")
+			continue
+		}
+		_, err = svc.dbService.ConditionalUpdateRequest(bson.M{"_id": request.ID}, bson.M{
+			"$set": bson.M{"uuid": uuid},
+		})
+		if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"username": request.Username,
+				"err":      err.Error(),
+			}).Warning("Unable to store uuid of the member")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type emailCorrection struct {
+	Email string `json:"email"`
+}
+
+// resentEmail is the email sent again to the corrected address: the decision once the request is decided,
+// the confirmation until then
+func resentEmail(request types.WhitelistRequest) string {
+	switch request.Status {
+	case types.StatusApproved, types.StatusDenied, types.StatusBanned:
+		return types.EmailDecision
+	}
+	return types.EmailConfirmation
+}
+
+// correctEmail replaces the email of a pending or decided request and queues the most recent email of the
+// request to be sent again to the corrected address. The correction is recorded in the audit log
+func (svc *Service) correctEmail(requestID string, email string, actor string) (types.WhitelistRequest, bool, int, error) {
+	_id, err := primitive.ObjectIDFromHex(requestID)
+	if err != nil {
+		return types.WhitelistRequest{}, false, http.StatusBadRequest, errors.New("Invalid request ID")
+	}
+	requests, err := svc.dbService.GetRequests(1, bson.M{"_id": _id})
+	if err != nil {
+		return types.WhitelistRequest{}, false, http.StatusInternalServerError, errors.New("Unable to get request")
+	}
+	if len(requests) == 0 {
+		return types.WhitelistRequest{}, false, http.StatusNotFound, errors.New("Resource not found")
+	}
+	request := requests[0]
+	if strings.EqualFold(strings.TrimSpace(email), request.Email) {
+		return types.WhitelistRequest{}, false, http.StatusBadRequest, errors.New("Email is unchanged")
+	}
+	correctedRequest, err := svc.dbService.CorrectRequestEmail(request, email)
+	switch {
+	case err == db.ErrInvalidEmail:
+		return types.WhitelistRequest{}, false, http.StatusBadRequest, err
+	case err == db.ErrEmailInUse:
+		return types.WhitelistRequest{}, false, http.StatusConflict, err
+	case err == mongo.ErrNoDocuments:
+		return types.WhitelistRequest{}, false, http.StatusConflict, errors.New("Only the email of pending or decided requests can be corrected")
+	case err != nil:
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+			"ID":  requestID,
+		}).Error("Unable to correct email of request")
+		return types.WhitelistRequest{}, false, http.StatusInternalServerError, errors.New("Unable to correct email")
+	}
+	svc.refreshCachedRequests(correctedRequest.ID)
+
+	// The correction is kept even if the email can not be queued, it may be resent later
+	resent := true
+	task, _, err := resendTask(correctedRequest, ResendBody{Email: resentEmail(correctedRequest)}, actor)
+	if err == nil {
+		err = svc.broker.PublishResendTask(task)
+	}
+	if err != nil {
+		resent = false
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+			"ID":  requestID,
+		}).Error("Unable to resend email to corrected address")
+	}
+	entry := requestAuditEntry("request.email", actor, correctedRequest, nil)
+	entry.Details["oldEmail"] = request.Email
+	entry.Details["newEmail"] = correctedRequest.Email
+	if resent {
+		entry.Details["resent"] = task.Email
+	}
+	svc.audit(entry)
+	return correctedRequest, resent, http.StatusOK, nil
+}
+
+// HandleCorrectEmail replace the email of a request, e.g an address the applicant typo'd, and send the most
+// recent email of the request again to the corrected address
+func (svc *Service) HandleCorrectEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body emailCorrection
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		correctedRequest, resent, statusCode, err := svc.correctEmail(mux.Vars(r)["requestId"], body.Email, getActor(r))
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "success",
+			"updated": correctedRequest,
+			"resent":  resent,
+		})
+	}
+}
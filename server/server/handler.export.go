@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const exportDateLayout = "2006-01-02"
+
+// HandleExportRequests streams the requests as CSV (?format=csv, default) or JSON lines (?format=jsonl) for reporting.
+// Requests can be filtered by ?status= and submission time with ?from= (inclusive) and ?to= (exclusive) as dates
+// or RFC3339 times. ?columns= selects the columns and ?redact=true masks the email addresses
+func (svc *Service) HandleExportRequests() http.HandlerFunc {
+	return exportHandler(svc.dbService.ExportRequests, svc.logger)
+}
+
+func exportHandler(export func(io.Writer, interface{}, db.ExportOptions) (int64, error), log *logrus.Entry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		opts := db.ExportOptions{
+			Format: query.Get("format"),
+			Redact: query.Get("redact") == "true",
+		}
+		if opts.Format == "" {
+			opts.Format = db.ExportFormatCSV
+		}
+		if columns := query.Get("columns"); columns != "" {
+			opts.Columns = strings.Split(columns, ",")
+		}
+		err := opts.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter, err := exportFilter(query.Get("status"), query.Get("from"), query.Get("to"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filename := "requests-" + time.Now().Format("20060102") + "." + opts.Format
+		if opts.Format == db.ExportFormatCSV {
+			w.Header().Set("Content-Type", "text/csv")
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		w.WriteHeader(http.StatusOK)
+		count, err := export(w, filter, opts)
+		if err != nil {
+			// The status is sent already, the client gets a truncated export
+			log.WithFields(logrus.Fields{
+				"err":      err.Error(),
+				"exported": count,
+			}).Error("Unable to export requests")
+			return
+		}
+		log.WithFields(logrus.Fields{
+			"exported": count,
+			"format":   opts.Format,
+			"redacted": opts.Redact,
+		}).Info("Requests exported")
+	}
+}
+
+// exportFilter filters requests by status and by submission time from (inclusive) to (exclusive)
+func exportFilter(status, from, to string) (bson.M, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	timestamp := bson.M{}
+	if from != "" {
+		t, err := parseExportTime(from)
+		if err != nil {
+			return nil, err
+		}
+		timestamp["$gte"] = t
+	}
+	if to != "" {
+		t, err := parseExportTime(to)
+		if err != nil {
+			return nil, err
+		}
+		timestamp["$lt"] = t
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	return filter, nil
+}
+
+func parseExportTime(value string) (time.Time, error) {
+	if t, err := time.Parse(exportDateLayout, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %q. Use a date (YYYY-MM-DD) or an RFC3339 time", value)
+	}
+	return t, nil
+}
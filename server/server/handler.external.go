@@ -3,47 +3,77 @@ package server
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/form"
+	"github.com/tywin1104/mc-gatekeeper/mailer"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
 	"github.com/tywin1104/mc-gatekeeper/types"
 	"github.com/tywin1104/mc-gatekeeper/utils"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/tywin1104/mc-gatekeeper/worker"
 )
 
 // HandleGetRequestByID get one request by encoded id
 func (svc *Service) HandleGetRequestByID() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		request, statusCode, err := svc.getRequestByEncryptedID(mux.Vars(r)["requestIdEncoded"])
+		// The action page of ops shows the request as well
+		request, err := svc.getStatusRequest(mux.Vars(r)["requestIdEncoded"], utils.PurposeStatus, utils.PurposeAction)
 		if err != nil {
-			http.Error(w, err.Error(), statusCode)
+			svc.tokenError(w, r, err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		// For external facing get request, only display non-sensitive necessary fields
-		msg := map[string]map[string]interface{}{"request": {
-			"username":  request.Username,
-			"email":     request.Email,
-			"status":    request.Status,
-			"timestamp": request.Timestamp,
-			"info":      request.Info,
-			"age":       request.Age,
-			"_id":       request.ID.Hex(),
-			"gender":    request.Gender,
-		}}
+		view := externalRequestView(request)
+		// Position of approved requests waiting for a free slot on the game server
+		view["waitlistPosition"] = svc.waitlistPosition(request)
+		msg := map[string]map[string]interface{}{"request": view}
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(msg)
 	}
 }
 
+// externalRequestView is the request as shown on the status and action pages. For external facing get request,
+// only display non-sensitive necessary fields, e.g not the ops assigned, their votes and comments or the note
+// of the admin
+func externalRequestView(request types.WhitelistRequest) map[string]interface{} {
+	reapplyAfter, reapplyCooldownSeconds := reapplyCountdown(request, time.Now())
+	return map[string]interface{}{
+		"username":  request.Username,
+		"email":     request.Email,
+		"status":    request.Status,
+		"timestamp": request.Timestamp,
+		"info":      request.Info,
+		"age":       request.Age,
+		"_id":       request.ID.Hex(),
+		"gender":    request.Gender,
+		"answers":   request.Answers,
+		// Approved players can opt out of the member directory from the status page
+		"directoryOptOut": request.DirectoryOptOut,
+		// The action page offers ops to review provisional approvals
+		"provisional":        request.Provisional,
+		"processedTimestamp": request.ProcessedTimestamp,
+		// Progress of the request, without the ops involved
+		"timeline": applicantTimeline(request),
+		// When the applicant of a denied request may apply again
+		"reapplyAfter":           reapplyAfter,
+		"reapplyCooldownSeconds": reapplyCooldownSeconds,
+	}
+}
+
 // HandleCreateRequest create new request
 func (svc *Service) HandleCreateRequest() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log := svc.logger
 		// Validate request body
 		var newRequest types.WhitelistRequest
 		reqBody, err := ioutil.ReadAll(r.Body)
@@ -56,43 +86,97 @@ func (svc *Service) HandleCreateRequest() http.HandlerFunc {
 			http.Error(w, "Unable to unmarshal request body", http.StatusInternalServerError)
 			return
 		}
+		// Only resubmissions are linked to a previous request
+		newRequest.PreviousRequestID = ""
+		newRequest.Attempt = 0
+		svc.submitRequest(w, r, newRequest)
+	}
+}
 
-		// Validate new request
-		statusCode, err := svc.validateCreateRequest(&newRequest)
-		if err != nil {
-			http.Error(w, err.Error(), statusCode)
-			return
-		}
+// submitRequest validates, stores and publishes a new request and writes the response
+func (svc *Service) submitRequest(w http.ResponseWriter, r *http.Request, newRequest types.WhitelistRequest) {
+	log := svc.logger
+	// Only accepted while one of the application windows of the tenant is open
+	if state := worker.ApplicationWindowAt(tenant.Config{ID: tenant.Normalize(newRequest.ServerID)}, time.Now()); !state.Open {
+		http.Error(w, applicationsClosedMessage(state), http.StatusForbidden)
+		return
+	}
+	// Limit applications before anything is stored or published
+	if limited, ttl := svc.limitSubmission(newRequest.Email, clientIP(r)); limited {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(ttl.Seconds()))))
+		http.Error(w, "Too many applications. Try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// Unsupported languages fall back to the default locale
+	newRequest.Locale = mailer.NormalizeLocale(newRequest.Locale)
+	newRequest.ServerID = tenant.Normalize(newRequest.ServerID)
+	newRequest.Platform = strings.ToLower(strings.TrimSpace(newRequest.Platform))
+	newRequest.Username = worker.NormalizeRequestUsername(newRequest)
+	// Only requests created by the import or the benchmark are marked as such
+	newRequest.ImportedAt = nil
+	newRequest.Bench = ""
+	newRequest.Sequence = 0
+	newRequest.SubmissionIP, newRequest.SubmissionIPPrefix, newRequest.SubmissionIPHashed = storedIP(clientIP(r))
+	// Looked up before the address is hashed. The signals of the network are collected by the worker
+	newRequest.SubmissionCountry = svc.submissionCountry(clientIP(r))
+	newRequest.NetworkSignals = nil
+	// The standing of the referrer is checked by the worker
+	newRequest.ReferrerUsername = strings.TrimSpace(newRequest.ReferrerUsername)
+	newRequest.Referral = nil
+	newRequest.Tags = nil
 
-		// Add to db
-		newRequestID, err := svc.dbService.CreateRequest(newRequest)
+	// Validate new request
+	statusCode, err := svc.validateCreateRequest(&newRequest)
+	if err != nil {
+		http.Error(w, err.Error(), statusCode)
+		return
+	}
+	// Checked after bans, which are never lifted by waiting
+	reapplyAfter, err := svc.reapplyAfter(newRequest, time.Now())
+	if err != nil {
+		http.Error(w, "Unable to validate new request", http.StatusInternalServerError)
+		return
+	} else if !reapplyAfter.IsZero() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(reapplyAfter).Seconds()))))
+		http.Error(w, reapplyCooldownMessage(reapplyAfter), http.StatusTooManyRequests)
+		return
+	}
+
+	// Add to db and to the message queue for worker to process
+	createdRequest, err := svc.writeAndPublish(func(writer db.RequestWriter) (types.WhitelistRequest, error) {
+		newRequestID, err := writer.CreateRequest(newRequest)
 		if err != nil {
-			http.Error(w, "Unable to create new request", http.StatusInternalServerError)
-			log.WithFields(logrus.Fields{
-				"err":        err.Error(),
-				"newRequest": newRequest,
-			}).Error("Unable to create new request")
-			return
+			return types.WhitelistRequest{}, err
 		}
-		// Add new whitelist request to the message queue for worker to process
 		// Need to fill in the ID field as it is generated from the db side
-		newRequest.ID = newRequestID
+		createdRequest := newRequest
+		createdRequest.ID = newRequestID
 		// Set initial status to be pending
-		newRequest.Status = "Pending"
-		err = svc.broker.Publish(newRequest)
-		if err != nil {
-			http.Error(w, "Unable to create new request", http.StatusInternalServerError)
-			log.WithFields(logrus.Fields{
-				"error":      err.Error(),
-				"newRequest": newRequest,
-			}).Error("Unable to publish message to broker")
-			return
+		createdRequest.Status = types.StatusPending
+		return createdRequest, nil
+	})
+	if db.IsDuplicateKeyError(err) {
+		// Another request for the same username or email got created concurrently
+		http.Error(w, pendingRequestMessage, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to create new request", http.StatusInternalServerError)
+		log.WithFields(logrus.Fields{
+			"err":        err.Error(),
+			"newRequest": newRequest,
+		}).Error("Unable to create new request")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	msg := map[string]interface{}{"message": "success", "created": createdRequest.ID}
+	// Let the client show a banner that applications are not currently being reviewed
+	if viper.GetBool("announceReviewPaused") {
+		if ops, err := svc.opsOf(tenant.Config{ID: newRequest.ServerID}); err == nil && len(ops) == 0 {
+			msg["reviewPaused"] = true
 		}
-
-		w.WriteHeader(http.StatusCreated)
-		msg := map[string]interface{}{"message": "success", "created": newRequestID}
-		json.NewEncoder(w).Encode(msg)
 	}
+	json.NewEncoder(w).Encode(msg)
 }
 
 // HandlePatchRequestByID update the request by encrypted id
@@ -109,11 +193,15 @@ func (svc *Service) HandlePatchRequestByID() http.HandlerFunc {
 		// Only proceed if two tokens are matching correctly
 		request, opEmail, err := svc.verifyMatchingTokens(mux.Vars(r)["requestIdEncoded"], admToken)
 		if err != nil {
-			http.Error(w, "Tokens do not match", http.StatusBadRequest)
+			svc.tokenError(w, r, err)
+			return
+		}
+		if request.Status == types.StatusCancelled {
+			http.Error(w, errRequestWithdrawn.Error(), http.StatusConflict)
 			return
 		}
 		// Only update a request if its status is still pending
-		if request.Status != "Pending" {
+		if request.Status != types.StatusPending {
 			http.Error(w, "Request is already fulfilled", http.StatusBadRequest)
 			return
 		}
@@ -122,25 +210,59 @@ func (svc *Service) HandlePatchRequestByID() http.HandlerFunc {
 			http.Error(w, "Unable to read request body", http.StatusBadRequest)
 			return
 		}
-		// Update the request in db and add new task to broker
-		updatedRequest, statusCode, err := svc.updateRequestByID(request.ID.Hex(), reqBody, opEmail)
+		// Update the request in db and add new task to broker, or record the vote of the op
+		updatedRequest, statusCode, err := svc.decideRequest(request, reqBody, opEmail)
 		if err != nil {
 			http.Error(w, err.Error(), statusCode)
 			return
 		}
+		svc.consumeActionLink(admToken)
 		w.Header().Set("Content-Type", "application/json")
 		msg := map[string]interface{}{"message": "success", "updated": updatedRequest}
-		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(statusCode)
 		json.NewEncoder(w).Encode(msg)
 	}
 }
 
+const pendingRequestMessage = "There is a pending request associated with this username or email. " +
+	"You can not submit another request at this time. If you haven't received " +
+	"result within 24 hours, please contact admin"
+
 func (svc *Service) validateCreateRequest(newRequest *types.WhitelistRequest) (int, error) {
-	// Prevent new request from a approved or pending username
-	foundRequests, err := svc.dbService.GetRequests(-1, bson.M{
-		"username": newRequest.Username,
-		"status":   bson.M{"$in": []string{"Pending", "Approved", "Banned"}},
-	})
+	if !tenant.Known(newRequest.ServerID) {
+		return http.StatusBadRequest, tenant.ErrUnknownTenant
+	}
+	if !utils.ValidPlatform(newRequest.Platform) {
+		return http.StatusBadRequest, fmt.Errorf("Unknown platform %q. Allowed values: [%s, %s]", newRequest.Platform,
+			utils.PlatformJava, utils.PlatformBedrock)
+	}
+	if newRequest.Platform == utils.PlatformBedrock && !worker.BedrockEnabled(tenant.Config{ID: newRequest.ServerID}) {
+		return http.StatusBadRequest, errors.New("Bedrock players can not join this server")
+	}
+	if err := worker.ValidateRequestUsername(*newRequest); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := worker.ValidateReferrer(*newRequest); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := validateAttachments(newRequest); err != nil {
+		return http.StatusBadRequest, err
+	}
+	fields, err := form.Fields(tenant.Config{ID: newRequest.ServerID})
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"error":    err.Error(),
+			"serverId": newRequest.ServerID,
+		}).Error("Unable to read application fields")
+		return http.StatusInternalServerError, errors.New("Unable to validate new request")
+	}
+	newRequest.Answers, err = form.ValidateAnswers(fields, newRequest.Answers)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	// Prevent new request from a approved, pending, disputed or banned username or email of the tenant
+	foundRequests, err := svc.dbService.FindDuplicateRequests(newRequest.ServerID, newRequest.Username, newRequest.Email,
+		[]string{types.StatusPending, types.StatusDisputed, types.StatusApproved, types.StatusWaitlisted, types.StatusBanned}, nil)
 	if err != nil {
 		svc.logger.WithFields(logrus.Fields{
 			"error":      err.Error(),
@@ -151,15 +273,23 @@ func (svc *Service) validateCreateRequest(newRequest *types.WhitelistRequest) (i
 	if len(foundRequests) > 0 {
 		var message string
 		foundRequest := foundRequests[0]
-		if foundRequest.Status == "Approved" {
-			message = "The request associated with this username is already approved"
+		// Banned users are rejected regardless of other requests they have
+		for _, request := range foundRequests {
+			if request.Status == types.StatusBanned {
+				foundRequest = request
+				break
+			}
+		}
+		if foundRequest.Status == types.StatusApproved {
+			message = "The request associated with this username or email is already approved"
+			return http.StatusConflict, errors.New(message)
+		} else if foundRequest.Status == types.StatusWaitlisted {
+			message = "The request associated with this username or email is already approved and waiting for a free slot"
 			return http.StatusConflict, errors.New(message)
-		} else if foundRequest.Status == "Pending" {
-			message = "There is a pending request associated with this username. " +
-				"You can not submit another request at this time. If you haven't received " +
-				"result within 24 hours, please contact admin"
+		} else if foundRequest.Status == types.StatusPending || foundRequest.Status == types.StatusDisputed {
+			message = pendingRequestMessage
 			return http.StatusUnprocessableEntity, errors.New(message)
-		} else if foundRequest.Status == "Banned" {
+		} else if foundRequest.Status == types.StatusBanned {
 			message = "The user has been banned from the server"
 			return http.StatusForbidden, errors.New(message)
 		}
@@ -182,7 +312,7 @@ func (svc *Service) HandleVerifyMatchingTokens() http.HandlerFunc {
 		admToken := keys[0]
 		_, _, err := svc.verifyMatchingTokens(mux.Vars(r)["requestIdEncoded"], admToken)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			svc.tokenError(w, r, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -190,27 +320,41 @@ func (svc *Service) HandleVerifyMatchingTokens() http.HandlerFunc {
 }
 
 // returns request object and corresponding op's email if tokens match
-// return err if either token is invalid or two tokens does not match by assignee relation
+// return errInvalidToken if either token is invalid or two tokens does not match by assignee relation,
+// and errActionLinkExpired or errActionLinkUsed for authentic action links that are no longer valid
 func (svc *Service) verifyMatchingTokens(requestIDToken, admToken string) (types.WhitelistRequest, string, error) {
 	log := svc.logger
-	opEmail, err := utils.DecodeAndDecrypt(admToken, viper.GetString("passphrase"))
-	if err != nil {
+	opToken, legacy, secret, err := parseOpToken(admToken)
+	if err == utils.ErrTokenExpired {
+		return types.WhitelistRequest{}, "", errActionLinkExpired
+	} else if err != nil {
 		log.WithFields(logrus.Fields{
 			"err": err.Error(),
-		}).Error("Unable to decode adm token")
-		return types.WhitelistRequest{}, "", err
+		}).Warn("Unable to decode adm token")
+		return types.WhitelistRequest{}, "", errInvalidToken
 	}
-	request, _, err := svc.getRequestByEncryptedID(requestIDToken)
+	svc.countOldSecret("action", secret)
+	opEmail := opToken.Op
+	request, _, err := svc.getRequestByEncryptedID(requestIDToken, utils.PurposeAction)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err": err.Error(),
 		}).Error("Unable to get request by enceyptedID")
 		return types.WhitelistRequest{}, "", err
 	}
+	// Compare against every assignee so the response time does not depend on the match
+	matched := false
 	for _, op := range request.Assignees {
-		if opEmail == op {
-			return request, opEmail, nil
+		if utils.ConstantTimeEqual(opEmail, op) {
+			matched = true
 		}
 	}
-	return types.WhitelistRequest{}, "", errors.New("Tokens do not match")
+	if !matched {
+		return types.WhitelistRequest{}, "", errInvalidToken
+	}
+	err = svc.checkOpToken(opToken, legacy, request)
+	if err != nil {
+		return types.WhitelistRequest{}, "", err
+	}
+	return request, opEmail, nil
 }
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/form"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/worker"
+)
+
+// HandleGetApplicationForm get the custom fields of the application form of the tenant, for the frontend to
+// render them. New requests are validated against the same fields
+func (svc *Service) HandleGetApplicationForm() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serverID, err := queriedTenant(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fields, err := form.Fields(tenant.Config{ID: serverID})
+		if err != nil {
+			http.Error(w, "Unable to get application form", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"fields": fields})
+	}
+}
+
+// HandleGetApplicationWindow tells if the tenant accepts new requests at the moment, so the frontend can hide the
+// application form while applications are closed
+func (svc *Service) HandleGetApplicationWindow() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serverID, err := queriedTenant(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		state := worker.ApplicationWindowAt(tenant.Config{ID: serverID}, time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(state)
+	}
+}
+
+// applicationsClosedMessage tells applicants submitting while applications are closed when they can apply again
+func applicationsClosedMessage(state worker.ApplicationWindowState) string {
+	if state.NextOpening == nil {
+		return "Applications are closed at the moment. Thank you for your interest"
+	}
+	return "Applications are closed at the moment. The next application window opens at " + state.NextOpening.UTC().Format(time.RFC3339)
+}
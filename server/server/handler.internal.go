@@ -2,27 +2,54 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// HandleGetRequests handle get requests from authenticated admin user
+// HandleGetRequests handle get requests from authenticated admin user.
+// Requests are listed most recently updated first and can be paged with the status, offset and limit query parameters
 func (svc *Service) HandleGetRequests() http.HandlerFunc {
+	return requestsHandler(svc.cache.Available, svc.cache.GetRequestsPage, svc.dbService.GetRequests, svc.logger)
+}
+
+func requestsHandler(cacheAvailable func() bool,
+	getCachedPage func(status string, offset, limit int64) ([]types.WhitelistRequest, int64, error),
+	getRequests func(limit int64, filter interface{}) ([]types.WhitelistRequest, error),
+	log *logrus.Entry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log := svc.logger
-		var msg map[string]interface{}
+		page, err := parseRequestsPage(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		// Try to fetch value from cache first
-		cachedRequests, err := svc.cache.GetAllRequests()
+		var requests []types.WhitelistRequest
+		var total int64
+		err = cache.ErrUnavailable
+		if cacheAvailable() {
+			requests, total, err = getCachedPage(page.status, page.offset, page.limit)
+		}
+		result := cacheResult(err)
 		if err != nil {
 			log.Debug("Fetch result from db")
-			requests, err := svc.dbService.GetRequests(-1, bson.D{{}})
+			filter := bson.M{}
+			if page.status != "" {
+				filter["status"] = page.status
+			}
+			allRequests, err := getRequests(-1, filter)
 			if err != nil {
 				http.Error(w, "Unable to get all requests", http.StatusInternalServerError)
 				log.WithFields(logrus.Fields{
@@ -30,17 +57,76 @@ func (svc *Service) HandleGetRequests() http.HandlerFunc {
 				}).Error("Unable to get all requests")
 				return
 			}
-			msg = map[string]interface{}{"requests": requests}
+			cache.SortByLastUpdated(allRequests)
+			requests, total = pageRequests(allRequests, page)
 		} else {
 			log.Debug("Got cached results")
-			msg = map[string]interface{}{"requests": cachedRequests}
 		}
+		msg := map[string]interface{}{"requests": requests, "total": total}
 		w.Header().Set("Content-Type", "application/json")
+		setServedFrom(w, result)
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(msg)
 	}
 }
 
+// requestsPage selects the requests listed to admin users
+type requestsPage struct {
+	// Empty to list requests of every status
+	status string
+	offset int64
+	// Negative to list every request from offset
+	limit int64
+}
+
+// parseRequestsPage reads the optional status, offset and limit query parameters of the requests listing
+func parseRequestsPage(query url.Values) (requestsPage, error) {
+	page := requestsPage{status: query.Get("status"), limit: -1}
+	if !knownStatus(page.status) {
+		return page, fmt.Errorf("Unknown status %q", page.status)
+	}
+	if offset := query.Get("offset"); offset != "" {
+		value, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil || value < 0 {
+			return page, errors.New("Invalid offset")
+		}
+		page.offset = value
+	}
+	if limit := query.Get("limit"); limit != "" {
+		value, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || value < 0 {
+			return page, errors.New("Invalid limit")
+		}
+		page.limit = value
+	}
+	return page, nil
+}
+
+// knownStatus tells if requests may be in the status. The empty status stands for every status
+func knownStatus(status string) bool {
+	switch status {
+	case "", types.StatusPending, types.StatusApproved, types.StatusDenied, types.StatusBanned,
+		types.StatusDeactivated, types.StatusUnbanned, types.StatusExpired, types.StatusDisputed, types.StatusCancelled,
+		types.StatusWaitlisted:
+		return true
+	}
+	return false
+}
+
+// pageRequests returns the page of the sorted requests and the total number of requests
+func pageRequests(requests []types.WhitelistRequest, page requestsPage) ([]types.WhitelistRequest, int64) {
+	total := int64(len(requests))
+	start := page.offset
+	if start > total {
+		start = total
+	}
+	end := total
+	if page.limit >= 0 && start+page.limit < total {
+		end = start + page.limit
+	}
+	return requests[start:end], total
+}
+
 // HandleInternalPatchRequestByID handle patch request from authenticated admin user
 func (svc *Service) HandleInternalPatchRequestByID() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -76,6 +162,67 @@ func (svc *Service) HandleInternalPatchRequestByID() http.HandlerFunc {
 	}
 }
 
+// HandleGetStats get the current stats from cache. The real-time stats are calculated from db
+// while the cache is unavailable
+func (svc *Service) HandleGetStats() http.HandlerFunc {
+	return statsHandler(svc.cache.Available, svc.cache.GetStats, svc.dbService.GetRequests, svc.logger)
+}
+
+func statsHandler(cacheAvailable func() bool, getCachedStats func(serverID string) (types.Stats, error),
+	getRequests func(limit int64, filter interface{}) ([]types.WhitelistRequest, error),
+	log *logrus.Entry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Stats are kept per tenant
+		serverID, err := queriedTenant(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var stats types.Stats
+		err = cache.ErrUnavailable
+		if cacheAvailable() {
+			stats, err = getCachedStats(serverID)
+		}
+		result := cacheResult(err)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warn("Unable to get stats from cache. Calculating them from db")
+			requests, err := getRequests(-1, db.InTenant(bson.M{}, serverID))
+			if err != nil {
+				http.Error(w, "Unable to get stats", http.StatusInternalServerError)
+				log.WithFields(logrus.Fields{
+					"err": err.Error(),
+				}).Error("Unable to get stats")
+				return
+			}
+			stats = cache.StatsFromRequests(requests)
+			stats.ServerID = serverID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		setServedFrom(w, result)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"stats": stats})
+	}
+}
+
+// HandleResync re-synchronize all requests and stats in cache from db
+func (svc *Service) HandleResync() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := svc.cache.SyncStats()
+		if err != nil {
+			http.Error(w, "Unable to sync cache", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to sync cache")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success"})
+	}
+}
+
 func parseTimestamp(timestamp interface{}) (time.Time, error) {
 	timestampStr := fmt.Sprintf("%v", timestamp)
 	t, err := time.Parse(time.RFC3339, timestampStr)
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+const (
+	defaultQueueLoadNormalThreshold = 5
+	defaultQueueLoadHighThreshold   = 20
+	// The whitelist is considered near capacity once this share of the capacity is taken
+	nearCapacityRatio = 0.9
+)
+
+// queueLoadFragment is the public view of the current review queue shown on the application form
+type queueLoadFragment struct {
+	Load                        string    `json:"load"`
+	Pending                     *int64    `json:"pending,omitempty"`
+	MedianDecisionTimeInMinutes float64   `json:"medianDecisionTimeInMinutes"`
+	NearCapacity                *bool     `json:"nearCapacity,omitempty"`
+	UpdatedTimestamp            time.Time `json:"updatedTimestamp"`
+}
+
+// HandleGetQueueLoad get the current load of the review queue for applicants
+func (svc *Service) HandleGetQueueLoad() http.HandlerFunc {
+	return queueLoadHandler(svc.cache.GetQueueLoad, svc.logger)
+}
+
+func queueLoadHandler(getQueueLoad func(serverID string) (types.QueueLoad, error), log *logrus.Entry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The frontend of each tenant shows the load of its own queue
+		serverID, err := queriedTenant(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		load, err := getQueueLoad(serverID)
+		if err != nil {
+			http.Error(w, "Unable to get queue load", http.StatusInternalServerError)
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get queue load")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// The snapshot is only refreshed with the aggregate stats so it is safe to cache
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(newQueueLoadFragment(load))
+	}
+}
+
+// newQueueLoadFragment buckets the queue load into qualitative bands
+// Exact counts are left out in privacy mode
+func newQueueLoadFragment(load types.QueueLoad) queueLoadFragment {
+	fragment := queueLoadFragment{
+		Load:                        loadBand(load.Pending),
+		MedianDecisionTimeInMinutes: load.MedianDecisionTimeInMinutes,
+		UpdatedTimestamp:            load.UpdatedTimestamp,
+	}
+	if !viper.GetBool("queueLoadPrivacyMode") {
+		pending := load.Pending
+		fragment.Pending = &pending
+	}
+	// Only report capacity if the owner configured a capacity for the whitelist
+	if capacity := viper.GetInt64("whitelistCapacity"); capacity > 0 {
+		nearCapacity := float64(load.Approved) >= float64(capacity)*nearCapacityRatio
+		fragment.NearCapacity = &nearCapacity
+	}
+	return fragment
+}
+
+func loadBand(pending int64) string {
+	normalThreshold := viper.GetInt64("queueLoadNormalThreshold")
+	if normalThreshold <= 0 {
+		normalThreshold = defaultQueueLoadNormalThreshold
+	}
+	highThreshold := viper.GetInt64("queueLoadHighThreshold")
+	if highThreshold <= 0 {
+		highThreshold = defaultQueueLoadHighThreshold
+	}
+	switch {
+	case pending >= highThreshold:
+		return "high"
+	case pending >= normalThreshold:
+		return "normal"
+	default:
+		return "low"
+	}
+}
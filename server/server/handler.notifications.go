@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Maximum number of failed notifications listed
+const failedNotificationsLimit = 100
+
+// HandleGetFailedNotifications list the decision emails the worker gave up sending and that have not been
+// resent yet, most recent first
+func (svc *Service) HandleGetFailedNotifications() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		notifications, err := svc.dbService.GetFailedNotifications(failedNotificationsLimit, bson.M{"resentAt": bson.M{"$exists": false}})
+		if err != nil {
+			http.Error(w, "Unable to get failed notifications", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get failed notifications")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"notifications": notifications})
+	}
+}
+
+// HandleResendFailedNotification queue the decision email of a failed notification to be sent again. The
+// decision is not carried out on the game server again. Only the email of the current decision is resent
+func (svc *Service) HandleResendFailedNotification() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := svc.logger
+		_id, err := primitive.ObjectIDFromHex(mux.Vars(r)["notificationId"])
+		if err != nil {
+			http.Error(w, "Invalid notificationId", http.StatusBadRequest)
+			return
+		}
+		notification, err := svc.dbService.GetFailedNotification(_id)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to get failed notification", http.StatusInternalServerError)
+			return
+		}
+		requests, err := svc.dbService.GetRequests(1, bson.M{"_id": notification.RequestID})
+		if err != nil {
+			http.Error(w, "Unable to get request", http.StatusInternalServerError)
+			return
+		}
+		if len(requests) == 0 {
+			http.Error(w, "Request no longer exists", http.StatusGone)
+			return
+		}
+		request := requests[0]
+		if request.Status != notification.Status {
+			http.Error(w, "Request has been updated since. The decision email is outdated", http.StatusConflict)
+			return
+		}
+		err = svc.broker.PublishDecisionEmail(request)
+		if err != nil {
+			http.Error(w, "Unable to resend notification", http.StatusInternalServerError)
+			log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"ID":    request.ID.Hex(),
+			}).Error("Unable to publish message to broker")
+			return
+		}
+		err = svc.dbService.MarkNotificationResent(_id, time.Now())
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"ID":  _id.Hex(),
+			}).Warning("Unable to record notification as resent")
+		}
+		svc.audit(types.AuditEntry{
+			Action: "notification.resend",
+			Actor:  getActor(r),
+			Details: map[string]interface{}{
+				"requestId": request.ID.Hex(),
+				"username":  request.Username,
+				"status":    request.Status,
+			},
+			Timestamp: time.Now(),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success"})
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// Fields of the public stats an owner may expose with publicStatsFields
+const (
+	publicTotalApproved       = "totalApproved"
+	publicTotalRequests       = "totalRequests"
+	publicApprovalRate        = "approvalRate"
+	publicAverageDecisionTime = "averageDecisionTimeInMinutes"
+	publicRequestsThisWeek    = "requestsThisWeek"
+)
+
+// PublicStatsFields are the fields publicStatsFields may list
+var PublicStatsFields = []string{publicTotalApproved, publicTotalRequests, publicApprovalRate, publicAverageDecisionTime, publicRequestsThisWeek}
+
+const (
+	// The stats only change with the periodic refresh of the cache, so websites may cache them for long
+	publicStatsCacheControl = "public, max-age=300, s-maxage=600"
+	// Clients are told to come back after this long while the stats are not cached yet
+	publicStatsRetryAfter = 60 * time.Second
+)
+
+// ValidatePublicStatsFields checks publicStatsFields only lists known fields
+func ValidatePublicStatsFields() error {
+	for _, field := range viper.GetStringSlice("publicStatsFields") {
+		known := false
+		for _, f := range PublicStatsFields {
+			known = known || f == field
+		}
+		if !known {
+			return fmt.Errorf("Unknown field %q. Allowed values: %v", field, PublicStatsFields)
+		}
+	}
+	return nil
+}
+
+// HandleGetPublicStats serve the stats listed in publicStatsFields to community websites, e.g the number of
+// whitelisted players. Only available if the owner configured publicStatsFields. The stats are only read from
+// the cache, never counted in db on the request path
+func (svc *Service) HandleGetPublicStats() http.HandlerFunc {
+	return publicStatsHandler(svc.cache.Available, svc.cache.GetStats, svc.cache.GetTimeSeriesCounts, svc.logger)
+}
+
+func publicStatsHandler(cacheAvailable func() bool, getStats func(serverID string) (types.Stats, error),
+	getTimeSeriesCounts func(serverID string) (types.TimeSeriesCounts, error), log *logrus.Entry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fields := viper.GetStringSlice("publicStatsFields")
+		if len(fields) == 0 {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		setPublicStatsOrigin(w, r)
+		serverID, err := queriedTenant(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		unavailable := func(err error) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(publicStatsRetryAfter.Seconds())))
+			http.Error(w, "Stats are not available yet. Try again later", http.StatusServiceUnavailable)
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warning("Unable to get public stats from cache")
+		}
+		if !cacheAvailable() {
+			unavailable(cache.ErrUnavailable)
+			return
+		}
+		stats, err := getStats(serverID)
+		if err != nil {
+			unavailable(err)
+			return
+		}
+		public := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			switch field {
+			case publicTotalApproved:
+				public[field] = stats.Approved
+			case publicTotalRequests:
+				public[field] = stats.Pending + stats.Denied + stats.Approved + stats.Banned + stats.Deactivated + stats.Expired + stats.Cancelled
+			case publicApprovalRate:
+				public[field] = 0.0
+				if decided := stats.Approved + stats.Denied; decided > 0 {
+					public[field] = float64(stats.Approved) / float64(decided)
+				}
+			case publicAverageDecisionTime:
+				public[field] = stats.AverageDecisionTimeInMinutes
+			case publicRequestsThisWeek:
+				counts, err := getTimeSeriesCounts(serverID)
+				if err != nil {
+					unavailable(err)
+					return
+				}
+				var submitted int64
+				for _, day := range cache.TimeSeriesFromCounts(counts, 7, time.Now()).Days {
+					submitted += day.Submitted
+				}
+				public[field] = submitted
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", publicStatsCacheControl)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(public)
+	}
+}
+
+// setPublicStatsOrigin restricts the origins allowed to fetch the public stats to publicStatsOrigins, if
+// configured. Otherwise any website may embed them like the rest of the API
+func setPublicStatsOrigin(w http.ResponseWriter, r *http.Request) {
+	origins := viper.GetStringSlice("publicStatsOrigins")
+	if len(origins) == 0 {
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	for _, allowed := range origins {
+		if allowed == origin {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			return
+		}
+	}
+	w.Header().Del("Access-Control-Allow-Origin")
+}
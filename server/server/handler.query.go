@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	defaultQueryPageSize = 50
+	maxQueryPageSize     = 500
+)
+
+// requestQuery is a search of the requests with the page to list
+type requestQuery struct {
+	query    db.RequestQuery
+	sort     bson.D
+	page     int64
+	pageSize int64
+}
+
+// HandleQueryRequests search all requests in db, unlike the listing served from the cache. Requests can be
+// filtered by ?status=, ?onServer=true|false, ?username= (part of it), ?email=, ?assignee=, ?undeliverable=true
+// for requests whose applicant can not be emailed, and submission time with ?from= (inclusive) and ?to= (exclusive). ?sort= is a field, prefixed with - for descending order.
+// Pages of ?pageSize= requests start at ?page=1
+func (svc *Service) HandleQueryRequests() http.HandlerFunc {
+	return queryRequestsHandler(svc.dbService.QueryRequests, svc.logger)
+}
+
+func queryRequestsHandler(queryRequests func(filter interface{}, sort bson.D, page, pageSize int64) (db.RequestsPage, error),
+	log *logrus.Entry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseRequestQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := queryRequests(q.query.Filter(), q.sort, q.page, q.pageSize)
+		if err != nil {
+			http.Error(w, "Unable to query requests", http.StatusInternalServerError)
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to query requests")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// parseRequestQuery reads the filters, sort and page of a search of the requests
+func parseRequestQuery(values url.Values) (requestQuery, error) {
+	q := requestQuery{
+		query: db.RequestQuery{
+			Status:   values.Get("status"),
+			Username: values.Get("username"),
+			Email:    values.Get("email"),
+			Assignee: values.Get("assignee"),
+			Tag:      values.Get("tag"),
+			Referrer: values.Get("referrer"),
+		},
+		page:     1,
+		pageSize: defaultQueryPageSize,
+	}
+	if !knownStatus(q.query.Status) {
+		return q, fmt.Errorf("Unknown status %q", q.query.Status)
+	}
+	if onServer := values.Get("onServer"); onServer != "" {
+		value, err := strconv.ParseBool(onServer)
+		if err != nil {
+			return q, errors.New("Invalid onServer. Use true or false")
+		}
+		q.query.OnServer = &value
+	}
+	if undeliverable := values.Get("undeliverable"); undeliverable != "" {
+		value, err := strconv.ParseBool(undeliverable)
+		if err != nil {
+			return q, errors.New("Invalid undeliverable. Use true or false")
+		}
+		q.query.Undeliverable = value
+	}
+	var err error
+	if from := values.Get("from"); from != "" {
+		q.query.From, err = parseExportTime(from)
+		if err != nil {
+			return q, err
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		q.query.To, err = parseExportTime(to)
+		if err != nil {
+			return q, err
+		}
+	}
+	q.sort, err = db.ParseRequestSort(values.Get("sort"))
+	if err != nil {
+		return q, err
+	}
+	if page := values.Get("page"); page != "" {
+		q.page, err = strconv.ParseInt(page, 10, 64)
+		if err != nil || q.page < 1 {
+			return q, errors.New("Invalid page. Pages start at 1")
+		}
+	}
+	if pageSize := values.Get("pageSize"); pageSize != "" {
+		q.pageSize, err = strconv.ParseInt(pageSize, 10, 64)
+		if err != nil || q.pageSize < 1 || q.pageSize > maxQueryPageSize {
+			return q, fmt.Errorf("Invalid pageSize. Use 1 to %d", maxQueryPageSize)
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// defaultResubmissionLimit is the number of times a denied request can be resubmitted
+const defaultResubmissionLimit = 2
+
+// resubmissionLimit is the number of times the applicant can resubmit an original request after it was
+// denied. 0 disables resubmissions
+func resubmissionLimit() int {
+	if !viper.IsSet("resubmissionLimit") {
+		return defaultResubmissionLimit
+	}
+	return viper.GetInt("resubmissionLimit")
+}
+
+// HandleResubmitRequest let the applicant of a denied request submit a corrected request linked to it from the
+// status page, e.g with the spelling of the username fixed. Ops see the previous denial in the action email
+func (svc *Service) HandleResubmitRequest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		previousRequest, _, err := svc.getRequestByEncryptedID(mux.Vars(r)["requestIdEncoded"], utils.PurposeStatus)
+		if err != nil {
+			svc.tokenError(w, r, err)
+			return
+		}
+		var newRequest types.WhitelistRequest
+		reqBody, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		err = json.Unmarshal(reqBody, &newRequest)
+		if err != nil {
+			http.Error(w, "Unable to unmarshal request body", http.StatusInternalServerError)
+			return
+		}
+		statusCode, err := svc.validateResubmission(previousRequest)
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		// The status link was sent to the email of the previous request, so it is kept
+		newRequest.Email = previousRequest.Email
+		newRequest.ServerID = previousRequest.ServerID
+		newRequest.PreviousRequestID = previousRequest.ID.Hex()
+		newRequest.Attempt = resubmissionAttempt(previousRequest)
+		svc.submitRequest(w, r, newRequest)
+	}
+}
+
+// resubmissionAttempt is the attempt of the request resubmitting the previous request. Requests submitted
+// from the application form are the first attempt
+func resubmissionAttempt(previousRequest types.WhitelistRequest) int {
+	if previousRequest.Attempt < 1 {
+		return 2
+	}
+	return previousRequest.Attempt + 1
+}
+
+// validateResubmission checks that the previous request can be resubmitted: it was denied, has not been
+// resubmitted yet, is below the resubmission limit and the player has not been banned since
+func (svc *Service) validateResubmission(previousRequest types.WhitelistRequest) (int, error) {
+	if previousRequest.Status != types.StatusDenied {
+		return http.StatusConflict, errors.New("Only denied requests can be resubmitted")
+	}
+	if resubmissionAttempt(previousRequest)-1 > resubmissionLimit() {
+		return http.StatusForbidden, errors.New("The request can not be resubmitted anymore")
+	}
+	resubmissions, err := svc.dbService.GetRequests(1, bson.M{"previousRequestId": previousRequest.ID.Hex()})
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+			"ID":  previousRequest.ID.Hex(),
+		}).Error("Unable to validate resubmission")
+		return http.StatusInternalServerError, errors.New("Unable to validate new request")
+	}
+	if len(resubmissions) > 0 {
+		return http.StatusConflict, errors.New("The request has already been resubmitted")
+	}
+	// The new username and email are checked like those of any new request
+	banned, err := svc.dbService.FindDuplicateRequests(previousRequest.ServerID, previousRequest.Username, previousRequest.Email,
+		[]string{types.StatusBanned}, nil)
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+			"ID":  previousRequest.ID.Hex(),
+		}).Error("Unable to validate resubmission")
+		return http.StatusInternalServerError, errors.New("Unable to validate new request")
+	}
+	if len(banned) > 0 {
+		return http.StatusForbidden, errors.New("The user has been banned from the server")
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Outcomes of the review of a provisional approval
+const (
+	ReviewConfirm    = "confirm"
+	ReviewExtend     = "extend"
+	ReviewDeactivate = "deactivate"
+)
+
+// Trial period of provisional approvals if provisionalReviewDays is not configured
+const defaultProvisionalReviewDays = 14
+
+type reviewBody struct {
+	Outcome string `json:"outcome"`
+	// Number of days to extend the trial period by. Defaults to provisionalReviewDays
+	Days int `json:"days"`
+}
+
+func provisionalReviewPeriod() time.Duration {
+	days := viper.GetInt("provisionalReviewDays")
+	if days <= 0 {
+		days = defaultProvisionalReviewDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// HandleReviewRequest let an op review a provisional approval from the link of the review reminder:
+// confirm makes the membership permanent, extend schedules another review and deactivate
+// un-whitelists the player through the deactivation task
+func (svc *Service) HandleReviewRequest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admToken := r.URL.Query().Get("adm")
+		request, opEmail, err := svc.verifyMatchingTokens(mux.Vars(r)["requestIdEncoded"], admToken)
+		if err != nil {
+			svc.tokenError(w, r, err)
+			return
+		}
+		var review reviewBody
+		err = json.NewDecoder(r.Body).Decode(&review)
+		if err != nil {
+			http.Error(w, "Unable to decode request body", http.StatusBadRequest)
+			return
+		}
+		update, err := reviewUpdate(request, review, opEmail, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Only the first review of the approval is applied
+		writeReview := func(writer db.RequestWriter) (types.WhitelistRequest, error) {
+			updatedRequest, err := writer.ConditionalUpdateRequest(bson.M{
+				"_id":         request.ID,
+				"status":      types.StatusApproved,
+				"provisional": true,
+			}, update)
+			if review.Outcome == ReviewDeactivate {
+				updatedRequest.PreviousStatus = types.StatusApproved
+			}
+			return updatedRequest, err
+		}
+		var updatedRequest types.WhitelistRequest
+		if review.Outcome == ReviewDeactivate {
+			updatedRequest, err = svc.writeAndPublish(writeReview)
+		} else {
+			updatedRequest, err = writeReview(svc.dbService)
+		}
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Request is not awaiting review", http.StatusConflict)
+			return
+		} else if err == errTaskNotPublished {
+			http.Error(w, "Unable to deactivate request", http.StatusInternalServerError)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to review request", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"ID":  request.ID.Hex(),
+			}).Error("Unable to review request")
+			return
+		}
+		svc.consumeActionLink(admToken)
+		svc.logger.WithFields(logrus.Fields{
+			"ID":      request.ID.Hex(),
+			"outcome": review.Outcome,
+			"op":      opEmail,
+		}).Info("Provisional approval reviewed")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "updated": updatedRequest})
+	}
+}
+
+// reviewUpdate is the update applying the outcome of the review to a provisional approval
+func reviewUpdate(request types.WhitelistRequest, review reviewBody, op string, now time.Time) (bson.M, error) {
+	if request.Status != types.StatusApproved || !request.Provisional {
+		return nil, errors.New("Request is not awaiting review")
+	}
+	clearReview := bson.M{"provisional": "", "reviewAt": "", "reviewReminded": ""}
+	switch review.Outcome {
+	case ReviewConfirm:
+		return bson.M{
+			"$set":   bson.M{"admin": op, "lastUpdatedTimestamp": now},
+			"$unset": clearReview,
+		}, nil
+	case ReviewExtend:
+		if review.Days < 0 {
+			return nil, errors.New("days must be positive")
+		}
+		period := provisionalReviewPeriod()
+		if review.Days > 0 {
+			period = time.Duration(review.Days) * 24 * time.Hour
+		}
+		// Extend from the later of the scheduled review and now, so late reviews still get the full period
+		from := now
+		if request.ReviewAt != nil && request.ReviewAt.After(now) {
+			from = *request.ReviewAt
+		}
+		return bson.M{
+			"$set": bson.M{"reviewAt": from.Add(period), "reviewReminded": false},
+		}, nil
+	case ReviewDeactivate:
+		return db.WithNextSequence(bson.M{
+			"$set":   bson.M{"status": types.StatusDeactivated, "admin": op, "lastUpdatedTimestamp": now},
+			"$unset": clearReview,
+		}), nil
+	}
+	return nil, errors.New("outcome must be one of [confirm, extend, deactivate]")
+}
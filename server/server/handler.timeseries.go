@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// statsDays reads the number of days, today included, the time-windowed stats are queried for with ?days=.
+// All the days retained by default
+func statsDays(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("days")
+	if value == "" {
+		return cache.TimeSeriesDays, nil
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 1 || days > cache.TimeSeriesDays {
+		return 0, fmt.Errorf("Invalid days. Expected a number from 1 to %d", cache.TimeSeriesDays)
+	}
+	return days, nil
+}
+
+// HandleGetTimeSeries get the submissions and decisions per day and the submissions by hour of the day of the
+// tenant over the last days. Counted from db while the cache is unavailable
+func (svc *Service) HandleGetTimeSeries() http.HandlerFunc {
+	return timeSeriesHandler(svc.cache.Available, svc.cache.GetTimeSeriesCounts,
+		func(serverID string) (types.TimeSeriesCounts, error) {
+			return cache.CountTimeSeries(svc.dbService, serverID, time.Now())
+		}, svc.logger)
+}
+
+func timeSeriesHandler(cacheAvailable func() bool, getCachedCounts, countCounts func(serverID string) (types.TimeSeriesCounts, error),
+	log *logrus.Entry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serverID, err := queriedTenant(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		days, err := statsDays(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var counts types.TimeSeriesCounts
+		err = cache.ErrUnavailable
+		if cacheAvailable() {
+			counts, err = getCachedCounts(serverID)
+		}
+		result := cacheResult(err)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warn("Unable to get time series from cache. Counting them in db")
+			counts, err = countCounts(serverID)
+			if err != nil {
+				http.Error(w, "Unable to get time series", http.StatusInternalServerError)
+				log.WithFields(logrus.Fields{
+					"err": err.Error(),
+				}).Error("Unable to get time series")
+				return
+			}
+		}
+		series := cache.TimeSeriesFromCounts(counts, days, time.Now())
+		series.ServerID = serverID
+		w.Header().Set("Content-Type", "application/json")
+		setServedFrom(w, result)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"timeseries": series})
+	}
+}
+
+// HandleGetOpStats get the approvals and denials of each op of the tenant over the last days, most decisions
+// first, and how quickly each op responds to the requests sent to them. Counted from db while the cache is
+// unavailable
+func (svc *Service) HandleGetOpStats() http.HandlerFunc {
+	return opStatsHandler(svc.cache.Available, svc.cache.GetOpDecisionCounts,
+		func(serverID string) (types.OpDecisionCounts, error) {
+			return cache.CountOpDecisions(svc.dbService, serverID, time.Now())
+		},
+		func(serverID string) ([]types.OpResponseStats, error) {
+			stats, err := svc.cache.GetStats(serverID)
+			return stats.AggregateStats.OpResponse, err
+		},
+		func(serverID string) ([]types.OpResponseStats, error) {
+			return cache.CountOpResponses(svc.dbService, serverID)
+		}, svc.logger)
+}
+
+func opStatsHandler(cacheAvailable func() bool, getCachedCounts, countCounts func(serverID string) (types.OpDecisionCounts, error),
+	getCachedResponses, countResponses func(serverID string) ([]types.OpResponseStats, error), log *logrus.Entry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serverID, err := queriedTenant(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		days, err := statsDays(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var counts types.OpDecisionCounts
+		var responses []types.OpResponseStats
+		err = cache.ErrUnavailable
+		if cacheAvailable() {
+			counts, err = getCachedCounts(serverID)
+			if err == nil {
+				responses, err = getCachedResponses(serverID)
+			}
+		}
+		result := cacheResult(err)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warn("Unable to get op stats from cache. Counting them in db")
+			counts, err = countCounts(serverID)
+			if err == nil {
+				responses, err = countResponses(serverID)
+			}
+			if err != nil {
+				http.Error(w, "Unable to get op stats", http.StatusInternalServerError)
+				log.WithFields(logrus.Fields{
+					"err": err.Error(),
+				}).Error("Unable to get op stats")
+				return
+			}
+		}
+		// Aggregate stats cached before response times were recorded have none
+		if responses == nil {
+			responses = []types.OpResponseStats{}
+		}
+		leaderboard := cache.OpLeaderboardFromCounts(counts, days, time.Now())
+		leaderboard.ServerID = serverID
+		w.Header().Set("Content-Type", "application/json")
+		setServedFrom(w, result)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ops": leaderboard, "responseTimes": responses})
+	}
+}
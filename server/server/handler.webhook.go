@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/webhook"
+)
+
+type webhookPing struct {
+	URL string `json:"url"`
+}
+
+// HandleGetWebhooks get the configured webhook endpoints with the IDs of their signing keys and
+// the source IPs receivers should allow. Secrets are never returned
+func (svc *Service) HandleGetWebhooks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		endpoints, err := webhook.ParseEndpoints()
+		if err != nil {
+			http.Error(w, "Invalid webhooks configuration", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Invalid webhooks configuration")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"webhooks":  endpoints,
+			"sourceIPs": viper.GetStringSlice("webhookSourceIPs"),
+		})
+	}
+}
+
+// HandlePingWebhook send a signed test event to a configured webhook endpoint and report its response
+// so integrators can verify their signature verification
+func (svc *Service) HandlePingWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body webhookPing
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		// Only configured endpoints can be pinged as their keys are needed to sign the request
+		endpoint, ok, err := webhook.FindEndpoint(body.URL)
+		if err != nil {
+			http.Error(w, "Invalid webhooks configuration", http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, "Webhook endpoint is not configured", http.StatusNotFound)
+			return
+		}
+		result, err := svc.webhookSender.Ping(endpoint)
+		if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"url": endpoint.URL,
+				"err": err.Error(),
+			}).Warning("Unable to deliver test webhook")
+			http.Error(w, "Unable to deliver test webhook: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": result})
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// How client addresses are stored and used in cache keys
+const (
+	IPStorageHash = "hash"
+	IPStorageRaw  = "raw"
+)
+
+// IPStorageMode returns how client addresses are stored. Addresses are stored as salted hashes unless
+// ipStorageMode is raw. Hashes only allow equality checks, e.g matching addresses by CIDR is not possible
+func IPStorageMode() string {
+	if viper.GetString("ipStorageMode") == IPStorageRaw {
+		return IPStorageRaw
+	}
+	return IPStorageHash
+}
+
+// hashIP hashes an address or prefix with the configured salt. The passphrase is used if no salt is configured.
+// Rotating the salt makes the hashes stored before unmatchable by the new ones
+func hashIP(value string) string {
+	salt := viper.GetString("ipHashSalt")
+	if salt == "" {
+		salt = viper.GetString("passphrase")
+	}
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ipPrefix returns the network of the address, /24 for IPv4 and /48 for IPv6, so addresses
+// of the same network can be told apart from unrelated ones. Empty for invalid addresses
+func ipPrefix(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// storedIP returns the address and its prefix the way they are stored in the configured mode,
+// and if they are hashed
+func storedIP(ip string) (string, string, bool) {
+	prefix := ipPrefix(ip)
+	if IPStorageMode() == IPStorageRaw {
+		return ip, prefix, false
+	}
+	if prefix != "" {
+		prefix = hashIP(prefix)
+	}
+	return hashIP(ip), prefix, true
+}
+
+// hashedSubmissionIP returns the update hashing the raw submission address of the request
+func hashedSubmissionIP(request types.WhitelistRequest) bson.M {
+	address, prefix, _ := storedIP(request.SubmissionIP)
+	return bson.M{"$set": bson.M{
+		"submissionIp":       address,
+		"submissionIpPrefix": prefix,
+		"submissionIpHashed": true,
+	}}
+}
+
+// MigrateSubmissionIPs hashes the raw submission addresses stored before switching to the hash mode and
+// returns the number of requests migrated. Hashed addresses are kept if switching back to the raw mode
+func MigrateSubmissionIPs(dbService *db.Service, logger *logrus.Entry) (int, error) {
+	if IPStorageMode() != IPStorageHash {
+		return 0, nil
+	}
+	requests, err := dbService.GetRequests(-1, bson.M{
+		"submissionIp":       bson.M{"$exists": true, "$ne": ""},
+		"submissionIpHashed": bson.M{"$ne": true},
+	})
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, request := range requests {
+		// Only hash addresses that are still raw in case another instance migrates concurrently
+		_, err = dbService.ConditionalUpdateRequest(bson.M{
+			"_id":                request.ID,
+			"submissionIpHashed": bson.M{"$ne": true},
+		}, hashedSubmissionIP(request))
+		if err == mongo.ErrNoDocuments {
+			continue
+		} else if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	if migrated > 0 {
+		logger.WithFields(logrus.Fields{
+			"migrated": migrated,
+		}).Info("Hashed the stored submission addresses")
+	}
+	return migrated, nil
+}
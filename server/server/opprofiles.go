@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/worker"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// opProfileBody is the body of a request setting the profile of an op
+type opProfileBody struct {
+	DisplayName    string              `json:"displayName"`
+	Tenants        []string            `json:"tenants"`
+	Notifications  map[string][]string `json:"notifications"`
+	TelegramChatID string              `json:"telegramChatID"`
+	Digest         bool                `json:"digest"`
+}
+
+// parseOpProfileBody reads the profile of the op. The op handles the default tenant if no tenant is given.
+// Notifications may only name known events and channels, Telegram requires the chat of the op
+func parseOpProfileBody(r *http.Request) (opProfileBody, error) {
+	var body opProfileBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return body, errors.New("Invalid op profile body")
+	}
+	if body.Tenants == nil {
+		body.Tenants = []string{tenant.Default.ID}
+	}
+	for i, serverID := range body.Tenants {
+		body.Tenants[i] = tenant.Normalize(serverID)
+		if !tenant.Known(body.Tenants[i]) {
+			return body, fmt.Errorf("Unknown tenant %q", serverID)
+		}
+	}
+	for event, channels := range body.Notifications {
+		if !knownValue(types.OpEvents, event) {
+			return body, fmt.Errorf("Unknown event %q, expected one of %v", event, types.OpEvents)
+		}
+		for _, channel := range channels {
+			switch channel {
+			case types.OpChannelEmail:
+			case types.OpChannelTelegram:
+				if body.TelegramChatID == "" {
+					return body, errors.New("telegramChatID is required to notify the op through Telegram")
+				}
+			default:
+				return body, fmt.Errorf("Unknown channel %q of event %s", channel, event)
+			}
+		}
+	}
+	return body, nil
+}
+
+func knownValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// opsOf returns the ops of the tenant the worker dispatches requests to, see worker.ProfileOps. The ops config
+// if the profiles can not be read
+func (svc *Service) opsOf(cfg tenant.Config) ([]worker.Op, error) {
+	profiles, err := svc.dbService.GetOpProfiles()
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to get op profiles. Using the ops config")
+		profiles = nil
+	}
+	return worker.ProfileOps(profiles, cfg)
+}
+
+// knownOp tells whether the op has a profile or is configured for any tenant
+func (svc *Service) knownOp(email string) bool {
+	if _, err := svc.dbService.GetOpProfile(email); err == nil {
+		return true
+	}
+	return configuredOp(email)
+}
+
+func opProfileAuditEntry(action, actor string, profile types.OpProfile) types.AuditEntry {
+	details := map[string]interface{}{"op": strings.ToLower(profile.Email)}
+	if action != "op.profile.removed" {
+		details["tenants"] = profile.Tenants
+		details["notifications"] = profile.Notifications
+		details["digest"] = profile.Digest
+	}
+	return types.AuditEntry{
+		Action:    action,
+		Actor:     actor,
+		Details:   details,
+		Timestamp: time.Now(),
+	}
+}
+
+// HandleGetOpProfiles list the profiles of the ops, ordered by email
+func (svc *Service) HandleGetOpProfiles() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		profiles, err := svc.dbService.GetOpProfiles()
+		if err != nil {
+			http.Error(w, "Unable to get op profiles", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get op profiles")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"profiles": profiles})
+	}
+}
+
+// HandleSetOpProfile add the op or replace their profile. Once there are profiles requests are dispatched to
+// the ops of the profiles instead of the ops config. Changes take effect on the next dispatch
+func (svc *Service) HandleSetOpProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op := mux.Vars(r)["op"]
+		if !strings.Contains(op, "@") {
+			http.Error(w, "The op must be an email address", http.StatusBadRequest)
+			return
+		}
+		body, err := parseOpProfileBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		actor := getActor(r)
+		profile := types.OpProfile{
+			Email:          strings.ToLower(op),
+			DisplayName:    body.DisplayName,
+			Tenants:        body.Tenants,
+			Notifications:  body.Notifications,
+			TelegramChatID: body.TelegramChatID,
+			Digest:         body.Digest,
+			Actor:          actor,
+			Timestamp:      time.Now(),
+		}
+		err = svc.dbService.SetOpProfile(profile)
+		if err != nil {
+			http.Error(w, "Unable to set op profile", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"op":  op,
+			}).Error("Unable to set op profile")
+			return
+		}
+		svc.audit(opProfileAuditEntry("op.profile.set", actor, profile))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "profile": profile})
+	}
+}
+
+// HandleRemoveOpProfile remove the op. They are no longer dispatched requests nor notified
+func (svc *Service) HandleRemoveOpProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op := mux.Vars(r)["op"]
+		err := svc.dbService.RemoveOpProfile(op)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to remove op profile", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"op":  op,
+			}).Error("Unable to remove op profile")
+			return
+		}
+		svc.audit(opProfileAuditEntry("op.profile.removed", getActor(r), types.OpProfile{Email: op}))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success"})
+	}
+}
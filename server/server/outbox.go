@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// errTaskNotPublished is returned with directPublish if the change is stored but its task could not be published
+var errTaskNotPublished = errors.New("Unable to publish message to broker")
+
+// writeAndPublish stores the change made by write and hands the task of the request it returns to the worker.
+// The task is written to the outbox in the same transaction as the change and published by the outbox relay
+// of the worker, so a stored change is never left without its task. With directPublish the change is written
+// without transaction and the task is published right after, e.g to roll back if mongodb does not run as a
+// replica set. Errors of write are returned as they are. The stored request is cached for the status page right
+// away, as the worker refreshes the cache only once it handled the task
+func (svc *Service) writeAndPublish(write func(writer db.RequestWriter) (types.WhitelistRequest, error)) (types.WhitelistRequest, error) {
+	request, err := svc.writeAndPublishTask(write)
+	if err == nil || err == errTaskNotPublished {
+		svc.cacheStatusRequest(request)
+	}
+	return request, err
+}
+
+func (svc *Service) writeAndPublishTask(write func(writer db.RequestWriter) (types.WhitelistRequest, error)) (types.WhitelistRequest, error) {
+	if viper.GetBool("directPublish") {
+		request, err := write(svc.dbService)
+		if err != nil {
+			return types.WhitelistRequest{}, err
+		}
+		err = svc.broker.Publish(request)
+		if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+				"ID":  request.ID.Hex(),
+			}).Error("Unable to publish message to broker")
+			return request, errTaskNotPublished
+		}
+		return request, nil
+	}
+	var request types.WhitelistRequest
+	err := svc.dbService.WithTransaction(func(tx db.Tx) error {
+		var err error
+		request, err = write(tx)
+		if err != nil {
+			return err
+		}
+		return tx.AppendOutbox(request)
+	})
+	if err != nil {
+		return types.WhitelistRequest{}, err
+	}
+	return request, nil
+}
+
+// cacheStatusRequest caches the request for the status page. Not cached requests are read from db on the next
+// view, so failures are only logged
+func (svc *Service) cacheStatusRequest(request types.WhitelistRequest) {
+	if svc.cache == nil || request.ID.IsZero() {
+		return
+	}
+	err := svc.cache.SetRequestByID(request)
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+			"ID":  request.ID.Hex(),
+		}).Warning("Unable to cache request for the status page")
+	}
+}
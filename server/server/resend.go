@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Emails of a request are resent at most once within this window if resendCooldownMinutes is not configured
+const defaultResendCooldown = 5 * time.Minute
+
+var errNoDecision = errors.New("Request has no decision yet. There is no decision email to resend")
+
+// ResendBody selects the email of the request to resend, and the op the action email is resent to.
+// The action email is resent to every assigned op if no op is given
+type ResendBody struct {
+	Email string `json:"email"`
+	Op    string `json:"op"`
+}
+
+func resendCooldown() time.Duration {
+	cooldown := time.Duration(viper.GetInt("resendCooldownMinutes")) * time.Minute
+	if cooldown <= 0 {
+		return defaultResendCooldown
+	}
+	return cooldown
+}
+
+// resendTask validates the email to resend and returns the task for the worker to send it
+func resendTask(request types.WhitelistRequest, body ResendBody, actor string) (types.ResendTask, int, error) {
+	task := types.ResendTask{
+		ID:      primitive.NewObjectID(),
+		Request: request,
+		Email:   body.Email,
+		Actor:   actor,
+	}
+	if body.Op != "" && body.Email != types.EmailOpsAction {
+		return task, http.StatusBadRequest, errors.New("op can only be given when resending the ops action email")
+	}
+	switch body.Email {
+	case types.EmailConfirmation:
+	case types.EmailDecision:
+		switch request.Status {
+		case types.StatusApproved, types.StatusDenied, types.StatusBanned:
+		case types.StatusPending, types.StatusDisputed:
+			return task, http.StatusConflict, errNoDecision
+		default:
+			return task, http.StatusConflict, fmt.Errorf("There is no decision email of %s requests", strings.ToLower(request.Status))
+		}
+	case types.EmailOpsAction:
+		if request.Status != types.StatusPending {
+			return task, http.StatusConflict, fmt.Errorf("Request is no longer pending. Ops can not act on %s requests", strings.ToLower(request.Status))
+		}
+		if len(request.Assignees) == 0 {
+			return task, http.StatusConflict, errors.New("Request has not been dispatched to ops yet")
+		}
+		task.Ops = request.Assignees
+		if body.Op != "" {
+			task.Ops = nil
+			for _, op := range request.Assignees {
+				if strings.EqualFold(op, body.Op) {
+					task.Ops = []string{op}
+				}
+			}
+			if task.Ops == nil {
+				return task, http.StatusBadRequest, fmt.Errorf("%s is not assigned to the request", body.Op)
+			}
+		}
+	default:
+		return task, http.StatusBadRequest, fmt.Errorf("Unknown email %q. Allowed values: [%s, %s, %s]",
+			body.Email, types.EmailConfirmation, types.EmailDecision, types.EmailOpsAction)
+	}
+	return task, http.StatusAccepted, nil
+}
+
+// resendEmail publishes the task for the worker to send the email of the request again and records it in the
+// audit log. Emails of a request are resent at most once per cooldown, unless the cache is unavailable
+func (svc *Service) resendEmail(requestID string, body ResendBody, actor string) (types.ResendTask, int, error) {
+	_id, err := primitive.ObjectIDFromHex(requestID)
+	if err != nil {
+		return types.ResendTask{}, http.StatusBadRequest, errors.New("Invalid request ID")
+	}
+	requests, err := svc.dbService.GetRequests(1, bson.M{"_id": _id})
+	if err != nil {
+		return types.ResendTask{}, http.StatusInternalServerError, errors.New("Unable to get request")
+	}
+	if len(requests) == 0 {
+		return types.ResendTask{}, http.StatusNotFound, errors.New("Resource not found")
+	}
+	request := requests[0]
+	task, statusCode, err := resendTask(request, body, actor)
+	if err != nil {
+		return task, statusCode, err
+	}
+	if svc.attempts != nil {
+		count, ttl, err := svc.attempts.CountAttempt("resend:"+request.ID.Hex(), resendCooldown())
+		if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warn("Unable to count resends of the request")
+		} else if count > 1 {
+			wait := time.Duration(math.Ceil(ttl.Seconds())) * time.Second
+			return task, http.StatusTooManyRequests, fmt.Errorf("An email of the request has been resent recently. Try again in %s", wait)
+		}
+	}
+	err = svc.broker.PublishResendTask(task)
+	if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"ID":    request.ID.Hex(),
+		}).Error("Unable to publish message to broker")
+		return task, http.StatusInternalServerError, errors.New("Unable to resend email")
+	}
+	entry := requestAuditEntry("request.resend", actor, request, nil)
+	entry.Details["email"] = task.Email
+	if task.Ops != nil {
+		entry.Details["ops"] = task.Ops
+	}
+	svc.audit(entry)
+	return task, http.StatusAccepted, nil
+}
+
+// ResendEmail queues the email of the request to be sent again the same way admins do through the API, e.g for
+// the admin CLI
+func (svc *Service) ResendEmail(requestID string, body ResendBody, actor string) (types.ResendTask, error) {
+	task, _, err := svc.resendEmail(requestID, body, actor)
+	return task, err
+}
+
+// HandleResendEmail queue an email of the request to be sent again, e.g once the applicant fixed a typo in their
+// address or found the email in their spam folder
+func (svc *Service) HandleResendEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body ResendBody
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		task, statusCode, err := svc.resendEmail(mux.Vars(r)["requestId"], body, getActor(r))
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "task": task.ID})
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Maximum number of retries listed
+const retriesLimit = 100
+
+// retryStatus reads the status of the retries to list. Parked retries are listed by default
+func retryStatus(r *http.Request) (string, error) {
+	switch status := r.URL.Query().Get("status"); status {
+	case "":
+		return types.RetryParked, nil
+	case types.RetryParked, types.RetryForced, types.RetryAbandoned:
+		return status, nil
+	}
+	return "", errors.New("Invalid status. Expected one of Parked, Forced, Abandoned")
+}
+
+// retryHeaders converts the headers of a parked message read back from the db to values the message queue
+// accepts. Arrays are decoded as primitive.A
+func retryHeaders(stored map[string]interface{}) amqp.Table {
+	headers := make(amqp.Table, len(stored))
+	for key, value := range stored {
+		if array, ok := value.(primitive.A); ok {
+			value = []interface{}(array)
+		}
+		headers[key] = value
+	}
+	return headers
+}
+
+// HandleGetRetries list the messages the worker parked in the retry queue, the next to be retried first.
+// Forced and abandoned retries are listed with the status query parameter
+func (svc *Service) HandleGetRetries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := retryStatus(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		retries, err := svc.dbService.GetRetries(retriesLimit, bson.M{"status": status})
+		if err != nil {
+			http.Error(w, "Unable to get retries", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get retries")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"retries": retries})
+	}
+}
+
+// retryNotParked tells why a retry could not be forced or abandoned
+func (svc *Service) retryNotParked(w http.ResponseWriter, id primitive.ObjectID) {
+	_, err := svc.dbService.GetRetry(id)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Resource not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to get retry", http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, "The message is no longer parked in the retry queue", http.StatusConflict)
+}
+
+func retryAuditEntry(action, actor string, retry types.Retry) types.AuditEntry {
+	return types.AuditEntry{
+		Action: action,
+		Actor:  actor,
+		Details: map[string]interface{}{
+			"retryId":   retry.ID.Hex(),
+			"requestId": retry.RequestID,
+			"action":    retry.Action,
+			"attempt":   retry.Attempt,
+		},
+		Timestamp: time.Now(),
+	}
+}
+
+// HandleForceRetry publish a parked message again for the worker to retry it right away. The copy left in the
+// retry queue is dropped by the worker once it comes back
+func (svc *Service) HandleForceRetry() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_id, err := primitive.ObjectIDFromHex(mux.Vars(r)["retryId"])
+		if err != nil {
+			http.Error(w, "Invalid retryId", http.StatusBadRequest)
+			return
+		}
+		actor := getActor(r)
+		retry, err := svc.dbService.ForceRetry(_id, actor)
+		if err == mongo.ErrNoDocuments {
+			svc.retryNotParked(w, _id)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to force retry", http.StatusInternalServerError)
+			return
+		}
+		err = svc.broker.PublishRetry(retry.Body, retryHeaders(retry.Headers))
+		if err != nil {
+			http.Error(w, "Unable to force retry", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err":     err.Error(),
+				"retryId": _id.Hex(),
+			}).Error("Unable to publish message to broker")
+			err = svc.dbService.RevertForcedRetry(_id)
+			if err != nil {
+				svc.logger.WithFields(logrus.Fields{
+					"err":     err.Error(),
+					"retryId": _id.Hex(),
+				}).Error("Unable to park retry again")
+			}
+			return
+		}
+		svc.audit(retryAuditEntry("retry.force", actor, retry))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "retry": retry})
+	}
+}
+
+// HandleAbandonRetry give up on a parked message. The worker drops it once it comes back instead of
+// attempting it again
+func (svc *Service) HandleAbandonRetry() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_id, err := primitive.ObjectIDFromHex(mux.Vars(r)["retryId"])
+		if err != nil {
+			http.Error(w, "Invalid retryId", http.StatusBadRequest)
+			return
+		}
+		actor := getActor(r)
+		retry, err := svc.dbService.AbandonRetry(_id, actor)
+		if err == mongo.ErrNoDocuments {
+			svc.retryNotParked(w, _id)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to abandon retry", http.StatusInternalServerError)
+			return
+		}
+		svc.audit(retryAuditEntry("retry.abandon", actor, retry))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "retry": retry})
+	}
+}
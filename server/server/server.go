@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sync"
@@ -11,53 +12,86 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"github.com/tywin1104/mc-gatekeeper/broker"
 	"github.com/tywin1104/mc-gatekeeper/cache"
 	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/geoip"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
 	"github.com/tywin1104/mc-gatekeeper/server/sse"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/webhook"
 )
 
 // Service represents struct that deals with database level operations
 type Service struct {
 	dbService *db.Service
+	// Requests read and written through typed methods, see db.Store
+	store     db.Store
 	router    *mux.Router
 	broker    *broker.Service
 	sseServer *sse.Broker
 	logger    *logrus.Entry
 	cache     *cache.Service
+	handler   http.Handler
+	once      sync.Once
+	// Sends signed test events to webhook endpoints
+	webhookSender *webhook.Sender
+	// Counts failed token validations of the status and action pages
+	attempts attemptCounter
+	// Nonces of the action links sent to ops
+	nonces nonceStore
+	// Geo database of the submission countries and the path it was opened from, see countryReader
+	countries     *geoip.Reader
+	countriesPath string
+	countriesMu   sync.Mutex
 }
 
 // NewService create new mongoDb service that handles database level operations
-func NewService(db *db.Service, broker *broker.Service, cache *cache.Service, sseServer *sse.Broker, logger *logrus.Entry) *Service {
-	return &Service{
-		dbService: db,
-		router:    mux.NewRouter().StrictSlash(true),
-		broker:    broker,
-		cache:     cache,
-		sseServer: sseServer,
-		logger:    logger,
+func NewService(dbService *db.Service, broker *broker.Service, cache *cache.Service, sseServer *sse.Broker, logger *logrus.Entry) *Service {
+	svc := &Service{
+		dbService:     dbService,
+		store:         db.NewMongoStore(dbService),
+		router:        mux.NewRouter().StrictSlash(true),
+		broker:        broker,
+		cache:         cache,
+		sseServer:     sseServer,
+		logger:        logger,
+		webhookSender: webhook.NewSender(nil),
 	}
+	// Token attempts are not limited without cache, e.g from the admin CLI
+	if cache != nil {
+		svc.attempts = cache
+		svc.nonces = cache
+	}
+	return svc
 }
 
-// Listen opens up the http port for REST API and register all routes
-func (svc *Service) Listen(port string, wg *sync.WaitGroup) {
-	svc.routes()
-
-	// Configure CORS
-	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST", "PATCH"},
-		AllowedHeaders: []string{"*"},
+// Handler registers all routes and returns the http handler serving the REST API
+func (svc *Service) Handler() http.Handler {
+	svc.once.Do(func() {
+		svc.routes()
+		// Configure CORS
+		c := cors.New(cors.Options{
+			AllowedOrigins: []string{"*"},
+			AllowedMethods: []string{"GET", "POST", "PATCH", "PUT", "DELETE"},
+			AllowedHeaders: []string{"*"},
+		})
+		svc.handler = c.Handler(svc.router)
 	})
+	return svc.handler
+}
 
+// Listen opens up the http port for REST API and register all routes
+func (svc *Service) Listen(port string, wg *sync.WaitGroup) {
 	// Listen and serve
-	handler := c.Handler(svc.router)
+	handler := svc.Handler()
 
 	// capture http related metrics
 	wrappedH := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		m := httpsnoop.CaptureMetrics(handler, w, r)
-		// Skip logging health checks as they are constantly called by kubernetes probes
-		if r.URL.String() != "/health" {
+		// Skip logging health checks and metrics scrapes as they are constantly called
+		if r.URL.String() != "/health" && r.URL.String() != "/metrics" {
 			svc.logger.Debugf("%s %s (code=%d dt=%s)",
 				r.Method,
 				r.URL,
@@ -91,9 +125,23 @@ func (svc *Service) routes() {
 	// Endpoints that are "external" to the users through cilent application
 	external := svc.router.PathPrefix("/api/v1/requests").Subrouter()
 	external.HandleFunc("/", svc.HandleCreateRequest()).Methods("POST")
+	external.HandleFunc("/attachments", svc.HandleUploadAttachment()).Methods("POST")
 	external.Handle("/stats/events", svc.sseServer).Methods("GET")
-	external.HandleFunc("/{requestIdEncoded}", svc.HandleGetRequestByID()).Methods("GET")
-	external.HandleFunc("/{requestIdEncoded}", svc.HandlePatchRequestByID()).Methods("PATCH").Queries("adm", "{adm}")
+	external.HandleFunc("/load", svc.HandleGetQueueLoad()).Methods("GET")
+	external.HandleFunc("/form", svc.HandleGetApplicationForm()).Methods("GET")
+	external.HandleFunc("/window", svc.HandleGetApplicationWindow()).Methods("GET")
+	// Endpoints taking the request ID token of the status and action pages limit failed token validations
+	external.HandleFunc("/{requestIdEncoded}", svc.limitTokenAttempts(svc.HandleGetRequestByID())).Methods("GET")
+	external.HandleFunc("/{requestIdEncoded}", svc.limitTokenAttempts(svc.HandlePatchRequestByID())).Methods("PATCH").Queries("adm", "{adm}")
+	external.HandleFunc("/{requestIdEncoded}/directory", svc.limitTokenAttempts(svc.HandleDirectoryOptOut())).Methods("PATCH")
+	external.HandleFunc("/{requestIdEncoded}/review", svc.limitTokenAttempts(svc.HandleReviewRequest())).Methods("POST").Queries("adm", "{adm}")
+	external.HandleFunc("/{requestIdEncoded}/comments", svc.limitTokenAttempts(svc.HandleGetComments())).Methods("GET").Queries("adm", "{adm}")
+	external.HandleFunc("/{requestIdEncoded}/comments", svc.limitTokenAttempts(svc.HandleAddComment())).Methods("POST").Queries("adm", "{adm}")
+	external.HandleFunc("/{requestIdEncoded}/cancel", svc.limitTokenAttempts(svc.HandleCancelRequest())).Methods("POST")
+	external.HandleFunc("/{requestIdEncoded}/resubmit", svc.limitTokenAttempts(svc.HandleResubmitRequest())).Methods("POST")
+
+	// Delivery events of the email provider, authenticated by the token configured with it
+	svc.router.HandleFunc("/api/v1/email-events", svc.HandleEmailEvents()).Methods("POST")
 
 	// Endpoint to authenticate admin user
 	auth := svc.router.PathPrefix("/api/v1/auth").Subrouter()
@@ -102,24 +150,208 @@ func (svc *Service) routes() {
 	// Endpoints for internal(admin) consumptiono only that are wrapped by auth middleware
 	internal := svc.router.PathPrefix("/api/v1/internal/requests").Subrouter()
 	internal.Handle("/", negroni.New(
-		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.HandlerFunc(svc.authenticate),
 		negroni.Wrap(svc.HandleGetRequests()),
 	)).Methods("GET")
+	internal.Handle("/query", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleQueryRequests()),
+	)).Methods("GET")
+	internal.Handle("/export", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleExportRequests()),
+	)).Methods("GET")
+	internal.Handle("/bulk", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleBulkDecision()),
+	)).Methods("POST")
 	internal.Handle("/{requestId}", negroni.New(
-		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.HandlerFunc(svc.authenticate),
 		negroni.Wrap(svc.HandleInternalPatchRequestByID()),
 	)).Methods("PATCH")
+	internal.Handle("/{requestId}/email", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleCorrectEmail()),
+	)).Methods("PATCH")
+	internal.Handle("/{requestId}/resend", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleResendEmail()),
+	)).Methods("POST")
+	internal.Handle("/{requestId}/debug", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetRequestDebug()),
+	)).Methods("GET")
+	internal.Handle("/{requestId}/attachments", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetRequestAttachments()),
+	)).Methods("GET")
+
+	// Owner only endpoints to run console commands on the game server and track their status
+	internalTasks := svc.router.PathPrefix("/api/v1/internal").Subrouter()
+	internalTasks.Handle("/stats", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetStats()),
+	)).Methods("GET")
+	internalTasks.Handle("/stats/timeseries", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetTimeSeries()),
+	)).Methods("GET")
+	internalTasks.Handle("/stats/ops", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetOpStats()),
+	)).Methods("GET")
+	internalTasks.Handle("/resync", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleResync()),
+	)).Methods("POST")
+	// Commands run on the game server by owners only, so API keys are not accepted
+	internalTasks.Handle("/console", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleRunConsoleCommand()),
+	)).Methods("POST")
+	internalTasks.Handle("/tasks/{taskId}", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleGetTaskByID()),
+	)).Methods("GET")
+	internalTasks.Handle("/directory", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetDirectory()),
+	)).Methods("GET")
+	internalTasks.Handle("/webhooks", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetWebhooks()),
+	)).Methods("GET")
+	internalTasks.Handle("/webhooks/ping", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandlePingWebhook()),
+	)).Methods("POST")
+	internalTasks.Handle("/erasures", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleEraseRequests()),
+	)).Methods("POST")
+	internalTasks.Handle("/retries", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetRetries()),
+	)).Methods("GET")
+	internalTasks.Handle("/retries/{retryId}/retry", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleForceRetry()),
+	)).Methods("POST")
+	internalTasks.Handle("/retries/{retryId}/abandon", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleAbandonRetry()),
+	)).Methods("POST")
+	internalTasks.Handle("/templates", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetTemplates()),
+	)).Methods("GET")
+	internalTasks.Handle("/templates/{name}/preview", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandlePreviewTemplate()),
+	)).Methods("POST")
+	internalTasks.Handle("/templates/{name}/test-send", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleTestSendTemplate()),
+	)).Methods("POST")
+	internalTasks.Handle("/ops/away", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetAwayOps()),
+	)).Methods("GET")
+	internalTasks.Handle("/ops/{op}/away", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleSetOpAway()),
+	)).Methods("PUT")
+	internalTasks.Handle("/ops/{op}/away", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleSetOpBack()),
+	)).Methods("DELETE")
+	internalTasks.Handle("/ops/profiles", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetOpProfiles()),
+	)).Methods("GET")
+	internalTasks.Handle("/ops/{op}/profile", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleSetOpProfile()),
+	)).Methods("PUT")
+	internalTasks.Handle("/ops/{op}/profile", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleRemoveOpProfile()),
+	)).Methods("DELETE")
+	internalTasks.Handle("/notifications/failed", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetFailedNotifications()),
+	)).Methods("GET")
+	internalTasks.Handle("/notifications/failed/{notificationId}/resend", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleResendFailedNotification()),
+	)).Methods("POST")
+	internalTasks.Handle("/followups", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetFollowUps()),
+	)).Methods("GET")
+	internalTasks.Handle("/followups/{requestId}", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleFollowUp()),
+	)).Methods("POST")
+
+	// Event batches of temporary members that are deactivated together
+	batches := svc.router.PathPrefix("/api/v1/internal/batches").Subrouter()
+	batches.Handle("/", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleCreateBatch()),
+	)).Methods("POST")
+	batches.Handle("/", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetBatches()),
+	)).Methods("GET")
+	batches.Handle("/{batchId}", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleGetBatchByID()),
+	)).Methods("GET")
+	batches.Handle("/{batchId}", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandlePatchBatchByID()),
+	)).Methods("PATCH")
+	batches.Handle("/{batchId}", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleDeleteBatch()),
+	)).Methods("DELETE")
+	batches.Handle("/{batchId}/members/{requestId}", negroni.New(
+		negroni.HandlerFunc(svc.authenticate),
+		negroni.Wrap(svc.HandleDetachBatchMember()),
+	)).Methods("DELETE")
 
 	// Server health endpoint
 	svc.router.HandleFunc("/health", svc.HandleHealthCheck()).Methods("GET")
+	// Prometheus metrics are served here unless a dedicated metricsPort is configured
+	if viper.GetString("metricsPort") == "" {
+		svc.router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	}
+	// Signed download links of attachments, sent to ops
+	svc.router.HandleFunc("/api/v1/attachments/{attachmentToken}", svc.limitTokenAttempts(svc.HandleGetAttachment())).Methods("GET")
+	// Member directory for the community website, fetched with the public directory token
+	svc.router.HandleFunc("/api/v1/directory", svc.HandleGetPublicDirectory()).Methods("GET")
+	// Stats the owner chose to make public, for the community website
+	svc.router.HandleFunc("/api/v1/stats/public", svc.HandleGetPublicStats()).Methods("GET")
+	// API version endpoint used by clients to negotiate compatibility
+	svc.router.HandleFunc("/api/v1/schema", svc.HandleGetSchema()).Methods("GET")
 	// Recaptcha verification endpoint
 	svc.router.HandleFunc("/api/v1/recaptcha/verify", svc.handleVerifyRecaptcha()).Methods("POST")
 	// Endpoint to verify validity of action page on the client
-	svc.router.HandleFunc("/api/v1/verify/{requestIdEncoded}", svc.HandleVerifyMatchingTokens()).Methods("GET").Queries("adm", "{adm}")
+	svc.router.HandleFunc("/api/v1/verify/{requestIdEncoded}", svc.limitTokenAttempts(svc.HandleVerifyMatchingTokens())).Methods("GET").Queries("adm", "{adm}")
 	// Endpoint to get minecraft user's current skin (QR Code). Used by client application to verify user identity
 	svc.router.HandleFunc("/api/v1/minecraft/user/{minecraftUsername}/skin/", svc.handleGetSkinURLByUsername()).Methods("GET")
 }
 
+// HandleGetSchema returns the version of the API served
+func (svc *Service) HandleGetSchema() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"apiVersion": types.APIVersion})
+	}
+}
+
 //HandleHealthCheck signals the server is running
 func (svc *Service) HandleHealthCheck() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,1861 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/attachments"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/form"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"github.com/tywin1104/mc-gatekeeper/webhook"
+	"github.com/tywin1104/mc-gatekeeper/worker"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func getQueueLoadFragment(t *testing.T, load types.QueueLoad) map[string]interface{} {
+	handler := queueLoadHandler(func(serverID string) (types.QueueLoad, error) {
+		return load, nil
+	}, logrus.NewEntry(logrus.New()))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/requests/load", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	var fragment map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &fragment); err != nil {
+		t.Fatal(err)
+	}
+	return fragment
+}
+
+func TestQueueLoadBandThresholds(t *testing.T) {
+	viper.Set("queueLoadNormalThreshold", 3)
+	viper.Set("queueLoadHighThreshold", 10)
+	defer viper.Set("queueLoadNormalThreshold", nil)
+	defer viper.Set("queueLoadHighThreshold", nil)
+
+	cases := map[int64]string{0: "low", 2: "low", 3: "normal", 9: "normal", 10: "high", 50: "high"}
+	for pending, expected := range cases {
+		fragment := getQueueLoadFragment(t, types.QueueLoad{Pending: pending})
+		if fragment["load"] != expected {
+			t.Errorf("Expected load %q for %d pending requests, got %v", expected, pending, fragment["load"])
+		}
+	}
+}
+
+func TestQueueLoadDefaultBandThresholds(t *testing.T) {
+	if band := loadBand(defaultQueueLoadNormalThreshold - 1); band != "low" {
+		t.Errorf("Expected low band, got %s", band)
+	}
+	if band := loadBand(defaultQueueLoadHighThreshold); band != "high" {
+		t.Errorf("Expected high band, got %s", band)
+	}
+}
+
+func TestQueueLoadPrivacyMode(t *testing.T) {
+	load := types.QueueLoad{Pending: 7, Approved: 95, MedianDecisionTimeInMinutes: 42}
+	viper.Set("whitelistCapacity", 100)
+	defer viper.Set("whitelistCapacity", nil)
+
+	fragment := getQueueLoadFragment(t, load)
+	if fragment["pending"] != float64(7) {
+		t.Errorf("Expected exact pending count, got %v", fragment["pending"])
+	}
+	if fragment["nearCapacity"] != true {
+		t.Errorf("Expected whitelist to be near capacity, got %v", fragment["nearCapacity"])
+	}
+
+	viper.Set("queueLoadPrivacyMode", true)
+	defer viper.Set("queueLoadPrivacyMode", nil)
+	fragment = getQueueLoadFragment(t, load)
+	if _, ok := fragment["pending"]; ok {
+		t.Errorf("Expected pending count to be redacted in privacy mode, got %v", fragment["pending"])
+	}
+	if fragment["load"] != "normal" || fragment["medianDecisionTimeInMinutes"] != float64(42) {
+		t.Errorf("Expected qualitative load to be kept in privacy mode, got %v", fragment)
+	}
+}
+
+func TestQueueLoadCapacityGateDisabled(t *testing.T) {
+	fragment := getQueueLoadFragment(t, types.QueueLoad{Approved: 1000})
+	if _, ok := fragment["nearCapacity"]; ok {
+		t.Errorf("Expected no capacity information without whitelistCapacity, got %v", fragment["nearCapacity"])
+	}
+}
+
+func TestQueueLoadUnavailable(t *testing.T) {
+	handler := queueLoadHandler(func(serverID string) (types.QueueLoad, error) {
+		return types.QueueLoad{}, errors.New("cache miss")
+	}, logrus.NewEntry(logrus.New()))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/requests/load", nil))
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, rr.Code)
+	}
+}
+
+func TestQueueLoadOfTenant(t *testing.T) {
+	viper.Set("tenants", map[string]interface{}{"creative": map[string]interface{}{}})
+	defer viper.Set("tenants", nil)
+	var queried []string
+	handler := queueLoadHandler(func(serverID string) (types.QueueLoad, error) {
+		queried = append(queried, serverID)
+		return types.QueueLoad{}, nil
+	}, logrus.NewEntry(logrus.New()))
+	for target, expected := range map[string]int{
+		"/api/v1/requests/load":                   http.StatusOK,
+		"/api/v1/requests/load?serverId=Creative": http.StatusOK,
+		"/api/v1/requests/load?serverId=skyblock": http.StatusBadRequest,
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		if rr.Code != expected {
+			t.Errorf("%s: expected status code %d, got %d", target, expected, rr.Code)
+		}
+	}
+	sort.Strings(queried)
+	if strings.Join(queried, ",") != ",creative" {
+		t.Errorf("Expected the load of the default and the creative tenant to be read, got %v", queried)
+	}
+}
+
+func TestPingWebhook(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+		if !webhook.Verify([]webhook.Key{{ID: "k1", Secret: "secret1"}}, timestamp, body, r.Header.Get(webhook.SignatureHeader)) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("verified"))
+	}))
+	defer receiver.Close()
+	viper.Set("webhooks", []interface{}{
+		map[string]interface{}{
+			"url": receiver.URL,
+			"keys": []interface{}{
+				map[string]interface{}{"id": "k2", "secret": "secret2"},
+				map[string]interface{}{"id": "k1", "secret": "secret1"},
+			},
+		},
+	})
+	defer viper.Set("webhooks", nil)
+	svc := &Service{
+		logger:        logrus.NewEntry(logrus.New()),
+		webhookSender: webhook.NewSender(receiver.Client()),
+	}
+
+	rr := httptest.NewRecorder()
+	svc.HandlePingWebhook().ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/internal/webhooks/ping",
+		strings.NewReader(`{"url": "`+receiver.URL+`"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	var response map[string]webhook.DeliveryResult
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	if response["result"].StatusCode != http.StatusOK || response["result"].Body != "verified" {
+		t.Errorf("Expected the receiver to verify the ping, got %+v", response["result"])
+	}
+
+	// Endpoints that are not configured can not be pinged
+	rr = httptest.NewRecorder()
+	svc.HandlePingWebhook().ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/internal/webhooks/ping",
+		strings.NewReader(`{"url": "http://example.com/hook"}`)))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+// A request stuck pending: its action emails keep failing so it sits in the retry queue,
+// the cached copy predates the escalation and it is past its pendingTTL
+func stuckRequestDebugSources() debugSources {
+	requestID, _ := primitive.ObjectIDFromHex("5dc0f1a2b3c4d5e6f7a8b9c0")
+	otherID, _ := primitive.ObjectIDFromHex("5dc0f1a2b3c4d5e6f7a8b9c1")
+	taskID, _ := primitive.ObjectIDFromHex("5dc0f1a2b3c4d5e6f7a8b9c2")
+	auditID, _ := primitive.ObjectIDFromHex("5dc0f1a2b3c4d5e6f7a8b9c3")
+	submitted := time.Date(2019, 11, 1, 12, 0, 0, 0, time.UTC)
+	request := types.WhitelistRequest{
+		ID:                 requestID,
+		Username:           "steve",
+		Email:              "steve@example.com",
+		Age:                20,
+		Gender:             "male",
+		Status:             types.StatusPending,
+		Timestamp:          submitted,
+		Assignees:          []string{"op1@example.com"},
+		Escalated:          true,
+		EscalatedTimestamp: submitted.Add(time.Hour),
+	}
+	cached := request
+	cached.Escalated = false
+	cached.EscalatedTimestamp = time.Time{}
+
+	body, _ := json.Marshal(request)
+	other, _ := json.Marshal(types.WhitelistRequest{ID: otherID, Status: types.StatusApproved})
+	deliveries := []amqp.Delivery{
+		{Body: other},
+		{Body: []byte(`{"_id":"` + requestID.Hex() + `","command":"list"}`), Headers: amqp.Table{types.TaskTypeHeader: types.ConsoleTaskType}},
+		{Body: body, Redelivered: true, Headers: amqp.Table{"x-retry-count": int32(3), "x-failed-ops": []interface{}{"op2@example.com"}}},
+	}
+	return debugSources{
+		Request:        request,
+		CachedRequests: []types.WhitelistRequest{cached},
+		Queues: []queueDebug{
+			{Queue: "tasks", Messages: matchQueuedMessages(requestID, nil)},
+			{Queue: "retry.queue", Ready: 120, Scanned: 3, Truncated: true, Messages: matchQueuedMessages(requestID, deliveries)},
+			{Queue: "dead.letter.queue", Messages: make([]queuedMessage, 0), Error: "channel closed"},
+		},
+		AuditEntries: []types.AuditEntry{{
+			ID:        auditID,
+			Action:    "console.command",
+			Actor:     "admin",
+			Details:   map[string]interface{}{"command": "whitelist add steve", "response": "Added steve to the whitelist"},
+			Timestamp: submitted.Add(2 * time.Hour),
+		}},
+		Tasks: []types.ConsoleTask{{
+			ID:                 taskID,
+			Command:            "whitelist add steve",
+			Actor:              "admin",
+			Status:             "Completed",
+			Response:           "Added steve to the whitelist",
+			Timestamp:          submitted.Add(2 * time.Hour),
+			CompletedTimestamp: submitted.Add(2*time.Hour + time.Second),
+		}},
+		Errors: []string{"tasks: partial result"},
+	}
+}
+
+func TestRequestDebugGolden(t *testing.T) {
+	viper.Set("escalationAfterMinutes", 60)
+	viper.Set("pendingTTLHours", 48)
+	defer viper.Set("escalationAfterMinutes", nil)
+	defer viper.Set("pendingTTLHours", nil)
+
+	now := time.Date(2019, 11, 4, 12, 0, 0, 0, time.UTC)
+	debug := assembleRequestDebug(stuckRequestDebugSources(), now)
+	actual, err := json.MarshalIndent(debug, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "request_debug.golden.json")
+	if *update {
+		if err := ioutil.WriteFile(golden, append(actual, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(expected), actual) {
+		t.Errorf("Debug view does not match %s, run with -update if the change is intended\n%s", golden, actual)
+	}
+}
+
+func TestScheduledActionsOfApprovedRequest(t *testing.T) {
+	now := time.Now()
+	expiresAt := now.Add(time.Hour)
+	batch := types.Batch{Status: types.BatchStatusActive, EndTime: now.Add(-time.Minute)}
+	actions := scheduledActions(types.WhitelistRequest{
+		Status:    types.StatusApproved,
+		ExpiresAt: &expiresAt,
+	}, &batch, now)
+	if len(actions) != 2 {
+		t.Fatalf("Expected grant and batch deactivation to be scheduled, got %+v", actions)
+	}
+	if actions[0].Action != "deactivateGrant" || actions[0].Overdue {
+		t.Errorf("Expected upcoming grant deactivation, got %+v", actions[0])
+	}
+	if actions[1].Action != "deactivateBatch" || !actions[1].Overdue {
+		t.Errorf("Expected overdue batch deactivation, got %+v", actions[1])
+	}
+
+	batch.Status = types.BatchStatusEnded
+	if actions := scheduledActions(types.WhitelistRequest{Status: types.StatusApproved}, &batch, now); len(actions) != 0 {
+		t.Errorf("Expected nothing scheduled once the batch ended, got %+v", actions)
+	}
+}
+
+func TestPublicDirectoryToken(t *testing.T) {
+	blob := []byte(`{"members":[{"username":"steve","joinedAt":"2019-11-01T12:00:00Z"}]}`)
+	handler := publicDirectoryHandler(func() ([]byte, error) {
+		return blob, nil
+	}, logrus.NewEntry(logrus.New()))
+	get := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+		return rr
+	}
+
+	// The public directory is disabled unless the owner configures a token
+	if rr := get("/api/v1/directory?token="); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d while disabled, got %d", http.StatusNotFound, rr.Code)
+	}
+	viper.Set("directoryPublicToken", "community-site")
+	defer viper.Set("directoryPublicToken", nil)
+	if rr := get("/api/v1/directory?token=guess"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d for a wrong token, got %d", http.StatusUnauthorized, rr.Code)
+	}
+	rr := get("/api/v1/directory?token=community-site")
+	if rr.Code != http.StatusOK || rr.Body.String() != string(blob) {
+		t.Errorf("Expected the generated directory, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	handler = publicDirectoryHandler(func() ([]byte, error) {
+		return nil, errors.New("redigo: nil returned")
+	}, logrus.NewEntry(logrus.New()))
+	if rr := get("/api/v1/directory?token=community-site"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d before the directory is generated, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+}
+
+func TestReviewOutcomes(t *testing.T) {
+	now := time.Date(2019, 11, 20, 12, 0, 0, 0, time.UTC)
+	reviewAt := now.Add(-time.Hour)
+	provisional := types.WhitelistRequest{
+		ID:          primitive.NewObjectID(),
+		Username:    "user1",
+		Status:      types.StatusApproved,
+		Provisional: true,
+		ReviewAt:    &reviewAt,
+	}
+	viper.Set("provisionalReviewDays", 14)
+	defer viper.Set("provisionalReviewDays", nil)
+
+	// Confirm makes the membership permanent
+	update, err := reviewUpdate(provisional, reviewBody{Outcome: ReviewConfirm}, "op1@gmail.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := update["$set"].(bson.M)["status"]; ok {
+		t.Fatalf("expected confirm to keep the status, got %v", update)
+	}
+	if _, ok := update["$unset"].(bson.M)["provisional"]; !ok {
+		t.Fatalf("expected confirm to clear the provisional flag, got %v", update)
+	}
+
+	// Extend schedules another review from now since the review is overdue
+	update, err = reviewUpdate(provisional, reviewBody{Outcome: ReviewExtend, Days: 7}, "op1@gmail.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := update["$set"].(bson.M)
+	if !set["reviewAt"].(time.Time).Equal(now.Add(7*24*time.Hour)) || set["reviewReminded"] != false {
+		t.Fatalf("expected review to be rescheduled in 7 days, got %v", update)
+	}
+	// Extending before the review date extends the scheduled review with the default period
+	upcoming := now.Add(24 * time.Hour)
+	provisional.ReviewAt = &upcoming
+	update, _ = reviewUpdate(provisional, reviewBody{Outcome: ReviewExtend}, "op1@gmail.com", now)
+	if !update["$set"].(bson.M)["reviewAt"].(time.Time).Equal(upcoming.Add(14 * 24 * time.Hour)) {
+		t.Fatalf("expected review to be rescheduled 14 days after the scheduled review, got %v", update)
+	}
+
+	// Deactivate goes through the deactivation task
+	update, err = reviewUpdate(provisional, reviewBody{Outcome: ReviewDeactivate}, "op1@gmail.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update["$set"].(bson.M)["status"] != types.StatusDeactivated {
+		t.Fatalf("expected deactivate to deactivate the request, got %v", update)
+	}
+
+	_, err = reviewUpdate(provisional, reviewBody{Outcome: "ban"}, "op1@gmail.com", now)
+	if err == nil {
+		t.Fatal("expected error for unknown outcome")
+	}
+	// Requests already reviewed or never provisional can not be reviewed
+	permanent := provisional
+	permanent.Provisional = false
+	_, err = reviewUpdate(permanent, reviewBody{Outcome: ReviewConfirm}, "op1@gmail.com", now)
+	if err == nil {
+		t.Fatal("expected error for a permanent approval")
+	}
+	deactivated := provisional
+	deactivated.Status = types.StatusDeactivated
+	_, err = reviewUpdate(deactivated, reviewBody{Outcome: ReviewExtend}, "op1@gmail.com", now)
+	if err == nil {
+		t.Fatal("expected error for a deactivated request")
+	}
+}
+
+func TestParseRequestsPage(t *testing.T) {
+	page, err := parseRequestsPage(url.Values{})
+	if err != nil || page != (requestsPage{limit: -1}) {
+		t.Fatalf("expected every request to be listed by default, got %+v %v", page, err)
+	}
+	page, err = parseRequestsPage(url.Values{"status": {types.StatusPending}, "offset": {"20"}, "limit": {"10"}})
+	if err != nil || page != (requestsPage{status: types.StatusPending, offset: 20, limit: 10}) {
+		t.Fatalf("unexpected page %+v %v", page, err)
+	}
+	for _, query := range []url.Values{
+		{"status": {"Unknown"}},
+		{"offset": {"-1"}},
+		{"limit": {"ten"}},
+	} {
+		if _, err := parseRequestsPage(query); err == nil {
+			t.Errorf("expected error for %v", query)
+		}
+	}
+}
+
+func TestQueryRequests(t *testing.T) {
+	var gotFilter bson.M
+	var gotSort bson.D
+	var gotPage, gotPageSize int64
+	handler := queryRequestsHandler(func(filter interface{}, sort bson.D, page, pageSize int64) (db.RequestsPage, error) {
+		gotFilter, gotSort, gotPage, gotPageSize = filter.(bson.M), sort, page, pageSize
+		return db.RequestsPage{Requests: []types.WhitelistRequest{{Username: "steve"}}, Total: 3, NextPage: 3}, nil
+	}, logrus.NewEntry(logrus.New()))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET",
+		"/api/v1/internal/requests/query?status=Approved&onServer=false&undeliverable=true&username=ste&tag=unverified-referrer&referrer=Alex&from=2019-11-01&sort=username&page=2&pageSize=1", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the requests to be queried, got %d %s", rr.Code, rr.Body.String())
+	}
+	if gotFilter["status"] != types.StatusApproved || gotFilter["processedAt"].(bson.M)["$exists"] != false ||
+		gotFilter["timestamp"] == nil || gotFilter["username"] == nil || gotFilter["emailUndeliverable"] != true ||
+		gotFilter["tags"] != types.TagUnverifiedReferrer || gotFilter["referrerUsername"] == nil {
+		t.Errorf("Unexpected filter %v", gotFilter)
+	}
+	if gotSort[0].Key != "username" || gotSort[0].Value != 1 || gotPage != 2 || gotPageSize != 1 {
+		t.Errorf("Unexpected sort %v or page %d of %d", gotSort, gotPage, gotPageSize)
+	}
+	var response db.RequestsPage
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Requests) != 1 || response.Total != 3 || response.NextPage != 3 {
+		t.Errorf("Unexpected page %+v", response)
+	}
+
+	for _, query := range []url.Values{
+		{"status": {"Unknown"}},
+		{"onServer": {"maybe"}},
+		{"undeliverable": {"maybe"}},
+		{"from": {"yesterday"}},
+		{"sort": {"-email"}},
+		{"page": {"0"}},
+		{"pageSize": {"1000"}},
+	} {
+		if _, err := parseRequestQuery(query); err == nil {
+			t.Errorf("expected error for %v", query)
+		}
+	}
+}
+
+func TestPageRequests(t *testing.T) {
+	requests := make([]types.WhitelistRequest, 5)
+	for i := range requests {
+		requests[i].Username = strconv.Itoa(i)
+	}
+	usernames := func(requests []types.WhitelistRequest) string {
+		names := make([]string, 0, len(requests))
+		for _, request := range requests {
+			names = append(names, request.Username)
+		}
+		return strings.Join(names, ",")
+	}
+	tests := []struct {
+		page     requestsPage
+		expected string
+	}{
+		{requestsPage{limit: -1}, "0,1,2,3,4"},
+		{requestsPage{offset: 1, limit: 2}, "1,2"},
+		{requestsPage{offset: 4, limit: 2}, "4"},
+		{requestsPage{offset: 3, limit: -1}, "3,4"},
+		{requestsPage{offset: 7, limit: 2}, ""},
+		{requestsPage{limit: 0}, ""},
+	}
+	for _, test := range tests {
+		page, total := pageRequests(requests, test.page)
+		if usernames(page) != test.expected || total != 5 {
+			t.Errorf("expected %q of 5 for %+v, got %q of %d", test.expected, test.page, usernames(page), total)
+		}
+	}
+}
+
+func TestRequestsServedFrom(t *testing.T) {
+	cached := []types.WhitelistRequest{{Username: "cached"}}
+	stored := []types.WhitelistRequest{{Username: "stored"}}
+	getRequests := func(limit int64, filter interface{}) ([]types.WhitelistRequest, error) {
+		return stored, nil
+	}
+	tests := []struct {
+		name      string
+		available bool
+		cacheErr  error
+		expected  string
+		source    string
+		result    string
+	}{
+		{"hit", true, nil, "cached", "cache", "hit"},
+		{"not cached yet", true, cache.ErrRequestsNotCached, "stored", "db", "miss"},
+		{"cache error", true, errors.New("connection refused"), "stored", "db", "fallback"},
+		{"cache unavailable", false, nil, "stored", "db", "fallback"},
+	}
+	for _, test := range tests {
+		before := testutil.ToFloat64(metrics.CacheReads.WithLabelValues(test.result))
+		handler := requestsHandler(func() bool {
+			return test.available
+		}, func(status string, offset, limit int64) ([]types.WhitelistRequest, int64, error) {
+			return cached, 1, test.cacheErr
+		}, getRequests, logrus.NewEntry(logrus.New()))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/internal/requests/", nil))
+		var response struct {
+			Requests []types.WhitelistRequest `json:"requests"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Requests) != 1 || response.Requests[0].Username != test.expected {
+			t.Errorf("%s: expected requests of %s, got %+v", test.name, test.expected, response.Requests)
+		}
+		if source := rr.Header().Get(servedFromHeader); source != test.source {
+			t.Errorf("%s: expected to be served from %s, got %q", test.name, test.source, source)
+		}
+		if counted := testutil.ToFloat64(metrics.CacheReads.WithLabelValues(test.result)) - before; counted != 1 {
+			t.Errorf("%s: expected one %s read to be counted, got %v", test.name, test.result, counted)
+		}
+	}
+}
+
+func TestStatsCalculatedFromDbWhileCacheUnavailable(t *testing.T) {
+	submitted := time.Now().Add(-time.Hour)
+	handler := statsHandler(func() bool {
+		return false
+	}, func(serverID string) (types.Stats, error) {
+		t.Fatal("Expected the unavailable cache not to be read")
+		return types.Stats{}, nil
+	}, func(limit int64, filter interface{}) ([]types.WhitelistRequest, error) {
+		return []types.WhitelistRequest{
+			{Status: types.StatusPending, Timestamp: submitted},
+			{Status: types.StatusApproved, Gender: "female", Age: 20, Timestamp: submitted, ProcessedTimestamp: submitted.Add(30 * time.Minute)},
+			{Status: types.StatusDenied, Timestamp: submitted, ProcessedTimestamp: submitted.Add(10 * time.Minute)},
+		}, nil
+	}, logrus.NewEntry(logrus.New()))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/internal/stats", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get(servedFromHeader) != "db" {
+		t.Fatalf("Expected stats served from db, got %d %q", rr.Code, rr.Header().Get(servedFromHeader))
+	}
+	var response struct {
+		Stats types.Stats `json:"stats"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	stats := response.Stats
+	if stats.Pending != 1 || stats.Approved != 1 || stats.Denied != 1 || stats.FemaleCount != 1 ||
+		stats.AgeGroup2Count != 1 || stats.AverageResponseTimeInMinutes != 20 {
+		t.Errorf("Unexpected stats calculated from db %+v", stats)
+	}
+}
+
+func TestStatsDays(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		days  int
+		valid bool
+	}{
+		{"", 90, true},
+		{"?days=7", 7, true},
+		{"?days=90", 90, true},
+		{"?days=0", 0, false},
+		{"?days=91", 0, false},
+		{"?days=week", 0, false},
+	} {
+		days, err := statsDays(httptest.NewRequest("GET", "/api/v1/internal/stats/timeseries"+test.query, nil))
+		if (err == nil) != test.valid || days != test.days {
+			t.Errorf("%q: expected %d, got %d %v", test.query, test.days, days, err)
+		}
+	}
+}
+
+func TestTimeSeriesCountedInDbWhileCacheUnavailable(t *testing.T) {
+	today := time.Now().UTC().Format("2006-01-02")
+	handler := timeSeriesHandler(func() bool {
+		return false
+	}, func(serverID string) (types.TimeSeriesCounts, error) {
+		t.Fatal("Expected the unavailable cache not to be read")
+		return types.TimeSeriesCounts{}, nil
+	}, func(serverID string) (types.TimeSeriesCounts, error) {
+		return types.TimeSeriesCounts{
+			Submissions: []types.SubmissionCount{{Day: today, Hour: 10, Count: 2}},
+		}, nil
+	}, logrus.NewEntry(logrus.New()))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/internal/stats/timeseries?days=7", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get(servedFromHeader) != "db" {
+		t.Fatalf("Expected time series served from db, got %d %q", rr.Code, rr.Header().Get(servedFromHeader))
+	}
+	var response struct {
+		TimeSeries types.TimeSeries `json:"timeseries"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	series := response.TimeSeries
+	if len(series.Days) != 7 || series.To != today || series.Days[6].Submitted != 2 || series.SubmissionsByHour[10] != 2 {
+		t.Errorf("Unexpected time series counted in db %+v", series)
+	}
+}
+
+func TestVoteOutcome(t *testing.T) {
+	viper.Set("approvalQuorum", 2)
+	viper.Set("banQuorum", 3)
+	defer viper.Set("approvalQuorum", nil)
+	defer viper.Set("banQuorum", nil)
+	vote := func(op, decision string) types.Vote {
+		return types.Vote{Op: op, Decision: decision}
+	}
+	tests := []struct {
+		votes    []types.Vote
+		expected string
+	}{
+		{nil, ""},
+		{[]types.Vote{vote("op1", types.StatusApproved)}, ""},
+		{[]types.Vote{vote("op1", types.StatusApproved), vote("op2", types.StatusApproved)}, types.StatusApproved},
+		{[]types.Vote{vote("op1", types.StatusDenied), vote("op2", types.StatusDenied)}, types.StatusDenied},
+		{[]types.Vote{vote("op1", types.StatusApproved), vote("op2", types.StatusDenied)}, types.StatusDisputed},
+		// Bans need their own quorum
+		{[]types.Vote{vote("op1", types.StatusBanned), vote("op2", types.StatusBanned)}, ""},
+		{[]types.Vote{vote("op1", types.StatusBanned), vote("op2", types.StatusBanned), vote("op3", types.StatusBanned)}, types.StatusBanned},
+		{[]types.Vote{vote("op1", types.StatusBanned), vote("op2", types.StatusDenied)}, types.StatusDisputed},
+	}
+	for _, test := range tests {
+		if outcome := voteOutcome(test.votes); outcome != test.expected {
+			t.Errorf("Expected %q for votes %+v, got %q", test.expected, test.votes, outcome)
+		}
+	}
+}
+
+func TestQuorumDefaults(t *testing.T) {
+	if quorum(types.StatusApproved) != 1 || quorum(types.StatusBanned) != 1 {
+		t.Errorf("Expected decisions to need a single op by default, got %d %d", quorum(types.StatusApproved), quorum(types.StatusBanned))
+	}
+	// Bans need as many ops as approvals unless configured otherwise
+	viper.Set("approvalQuorum", 2)
+	defer viper.Set("approvalQuorum", nil)
+	if quorum(types.StatusBanned) != 2 {
+		t.Errorf("Expected bans to default to the approval quorum, got %d", quorum(types.StatusBanned))
+	}
+	if quorum(types.StatusDeactivated) != 1 {
+		t.Errorf("Expected other changes to be applied right away, got %d", quorum(types.StatusDeactivated))
+	}
+}
+
+func TestDecisionReason(t *testing.T) {
+	reason, err := decisionReason(bson.M{"status": types.StatusDenied, "decisionReason": "  Griefed at spawn "})
+	if err != nil || reason == nil || *reason != "Griefed at spawn" {
+		t.Fatalf("expected trimmed reason, got %v %v", reason, err)
+	}
+	// A new decision without reason clears the previous one
+	reason, err = decisionReason(bson.M{"status": types.StatusApproved})
+	if err != nil || reason == nil || *reason != "" {
+		t.Fatalf("expected reason to be cleared, got %v %v", reason, err)
+	}
+	// Other changes leave the reason untouched
+	reason, err = decisionReason(bson.M{"directoryOptOut": true})
+	if err != nil || reason != nil {
+		t.Fatalf("expected reason to be left untouched, got %v %v", reason, err)
+	}
+	for _, change := range []bson.M{
+		{"status": types.StatusDeactivated, "decisionReason": "Inactive"},
+		{"status": types.StatusDenied, "decisionReason": 42},
+		{"status": types.StatusBanned, "decisionReason": strings.Repeat("a", 1001)},
+	} {
+		if _, err := decisionReason(change); err == nil {
+			t.Errorf("expected error for %v", change)
+		}
+	}
+}
+
+func TestRequestAuditEntry(t *testing.T) {
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "steve", Status: types.StatusDenied}
+	entry := requestAuditEntry("request.update", "cli:alice", request, bson.M{
+		"status":               types.StatusDenied,
+		"decisionReason":       "Incomplete application",
+		"lastUpdatedTimestamp": time.Now(),
+	})
+	if entry.Action != "request.update" || entry.Actor != "cli:alice" {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	if entry.Details["requestId"] != request.ID.Hex() || entry.Details["status"] != types.StatusDenied ||
+		entry.Details["decisionReason"] != "Incomplete application" {
+		t.Errorf("unexpected details %v", entry.Details)
+	}
+	if _, ok := entry.Details["lastUpdatedTimestamp"]; ok {
+		t.Errorf("derived fields should not be recorded, got %v", entry.Details)
+	}
+}
+
+// fakeAttempts counts attempts in memory. Windows never end
+type fakeAttempts struct {
+	counts  map[string]int64
+	windows map[string]time.Duration
+}
+
+func (f *fakeAttempts) CountAttempt(key string, window time.Duration) (int64, time.Duration, error) {
+	if _, ok := f.windows[key]; !ok {
+		f.windows[key] = window
+	}
+	f.counts[key]++
+	return f.counts[key], f.windows[key], nil
+}
+
+func (f *fakeAttempts) GetAttempts(key string) (int64, time.Duration, error) {
+	return f.counts[key], f.windows[key], nil
+}
+
+func TestTokenGuessingBurst(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	viper.Set("tokenAttemptLimit", 10)
+	viper.Set("tokenAttemptWindowMinutes", 5)
+	viper.Set("tokenFailureAlertThreshold", 15)
+	defer viper.Set("tokenAttemptLimit", nil)
+	defer viper.Set("tokenAttemptWindowMinutes", nil)
+	defer viper.Set("tokenFailureAlertThreshold", nil)
+	svc := &Service{
+		logger:   logrus.NewEntry(logrus.New()),
+		attempts: &fakeAttempts{counts: make(map[string]int64), windows: make(map[string]time.Duration)},
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/verify/{requestIdEncoded}", svc.limitTokenAttempts(svc.HandleVerifyMatchingTokens())).Queries("adm", "{adm}")
+	alertsBefore := testutil.ToFloat64(metrics.TokenFailureAlerts)
+	failuresBefore := testutil.ToFloat64(metrics.TokenValidationFailures.WithLabelValues("GET /api/v1/verify/{requestIdEncoded}"))
+	verify := func(token, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/verify/"+token+"?adm=guess", nil)
+		r.RemoteAddr = ip + ":50000"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, r)
+		return rr
+	}
+
+	// Guessing tokens from one address locks the address out
+	for i := 0; i < 10; i++ {
+		rr := verify(fmt.Sprintf("guess%d", i), "203.0.113.1")
+		if rr.Code != http.StatusBadRequest || strings.TrimSpace(rr.Body.String()) != invalidTokenMessage {
+			t.Fatalf("Expected generic invalid token response, got %d %q", rr.Code, rr.Body.String())
+		}
+	}
+	rr := verify("guess10", "203.0.113.1")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "300" {
+		t.Errorf("Expected lockout with retry after 300 seconds, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	// Other clients are not affected
+	if rr := verify("guess11", "203.0.113.2"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected other clients not to be locked out, got %d", rr.Code)
+	}
+
+	// Guessing the tail of a token from many addresses locks the token prefix out
+	prefix := "AAAAAAAAAAAAAAAA"
+	for i := 0; i < 10; i++ {
+		verify(fmt.Sprintf("%s%d", prefix, i), fmt.Sprintf("198.51.100.%d", i))
+	}
+	if rr := verify(prefix+"x", "198.51.100.200"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected token prefix to be locked out, got %d", rr.Code)
+	}
+
+	if failures := testutil.ToFloat64(metrics.TokenValidationFailures.WithLabelValues("GET /api/v1/verify/{requestIdEncoded}")) - failuresBefore; failures != 21 {
+		t.Errorf("Expected 21 failed token validations, got %v", failures)
+	}
+	// The alert is raised once when the threshold is crossed
+	if alerts := testutil.ToFloat64(metrics.TokenFailureAlerts) - alertsBefore; alerts != 1 {
+		t.Errorf("Expected 1 alert, got %v", alerts)
+	}
+}
+
+func TestStoredIPHashMode(t *testing.T) {
+	viper.Set("ipHashSalt", "salt")
+	defer viper.Set("ipHashSalt", nil)
+	address, prefix, hashed := storedIP("203.0.113.7")
+	if !hashed || address == "203.0.113.7" || len(address) != 64 {
+		t.Fatalf("Expected a hashed address, got %q", address)
+	}
+	if prefix != hashIP("203.0.113.0/24") {
+		t.Errorf("Expected the hashed /24 network, got %q", prefix)
+	}
+	// Equal addresses and networks have equal hashes
+	sameAddress, _, _ := storedIP("203.0.113.7")
+	otherAddress, samePrefix, _ := storedIP("203.0.113.8")
+	if sameAddress != address || otherAddress == address || samePrefix != prefix {
+		t.Errorf("Expected hashes to allow equality checks, got %q %q %q", sameAddress, otherAddress, samePrefix)
+	}
+	// Rotating the salt changes the hashes
+	viper.Set("ipHashSalt", "rotated")
+	if rotated, _, _ := storedIP("203.0.113.7"); rotated == address {
+		t.Error("Expected the hash to depend on the salt")
+	}
+}
+
+func TestStoredIPRawMode(t *testing.T) {
+	viper.Set("ipStorageMode", IPStorageRaw)
+	defer viper.Set("ipStorageMode", nil)
+	for ip, expectedPrefix := range map[string]string{
+		"203.0.113.7":          "203.0.113.0/24",
+		"2001:db8:1:2::1":      "2001:db8:1::/48",
+		"not an address":       "",
+		"::ffff:198.51.100.20": "198.51.100.0/24",
+	} {
+		address, prefix, hashed := storedIP(ip)
+		if hashed || address != ip || prefix != expectedPrefix {
+			t.Errorf("%s: expected raw address and prefix %q, got %q %q %v", ip, expectedPrefix, address, prefix, hashed)
+		}
+	}
+}
+
+func TestAttemptKeysIPStorageModes(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/verify/token", nil)
+	r.RemoteAddr = "203.0.113.7:50000"
+	if keys := attemptKeys(r); keys[0] != "token:ip:"+hashIP("203.0.113.7") {
+		t.Errorf("Expected the hashed address in hash mode, got %v", keys)
+	}
+	viper.Set("ipStorageMode", IPStorageRaw)
+	defer viper.Set("ipStorageMode", nil)
+	if keys := attemptKeys(r); keys[0] != "token:ip:203.0.113.7" {
+		t.Errorf("Expected the raw address in raw mode, got %v", keys)
+	}
+}
+
+func TestAttemptKeysOfSignedTokens(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	first, _ := utils.SignToken(primitive.NewObjectID().Hex(), utils.PurposeStatus, 0)
+	second, _ := utils.SignToken(primitive.NewObjectID().Hex(), utils.PurposeStatus, 0)
+	keys := func(token string) []string {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/requests/"+token, nil), map[string]string{"requestIdEncoded": token})
+		return attemptKeys(r)
+	}
+	// Signed tokens start the same, so attempts are counted by the start of the signature
+	if prefix := keys(first)[1]; prefix == keys(second)[1] || !strings.HasPrefix(first[strings.LastIndex(first, ".")+1:], strings.TrimPrefix(prefix, "token:prefix:")) {
+		t.Errorf("Expected attempts to be counted by the signature of the token, got %s", prefix)
+	}
+}
+
+func TestHashedSubmissionIP(t *testing.T) {
+	request := types.WhitelistRequest{SubmissionIP: "203.0.113.7", SubmissionIPPrefix: "203.0.113.0/24"}
+	set := hashedSubmissionIP(request)["$set"].(bson.M)
+	if set["submissionIp"] != hashIP("203.0.113.7") || set["submissionIpPrefix"] != hashIP("203.0.113.0/24") || set["submissionIpHashed"] != true {
+		t.Errorf("Expected the raw address and prefix to be hashed, got %v", set)
+	}
+	// Hashes are never sent to clients
+	encoded, _ := json.Marshal(types.WhitelistRequest{SubmissionIP: "hash", SubmissionIPHashed: true})
+	if strings.Contains(string(encoded), "hash") {
+		t.Errorf("Expected submission address to be left out of JSON, got %s", encoded)
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	var gotFilter bson.M
+	var gotOpts db.ExportOptions
+	handler := exportHandler(func(w io.Writer, filter interface{}, opts db.ExportOptions) (int64, error) {
+		gotFilter = filter.(bson.M)
+		gotOpts = opts
+		w.Write([]byte("username\n"))
+		return 0, nil
+	}, logrus.NewEntry(logrus.New()))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/internal/requests/export?status=Approved&from=2019-10-01&to=2019-11-01&columns=username,email&redact=true", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/csv" ||
+		!strings.HasPrefix(rr.Header().Get("Content-Disposition"), `attachment; filename="requests-`) {
+		t.Fatalf("Expected a CSV attachment, got %d %v", rr.Code, rr.Header())
+	}
+	timestamp := gotFilter["timestamp"].(bson.M)
+	if gotFilter["status"] != "Approved" || !timestamp["$gte"].(time.Time).Equal(time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)) ||
+		!timestamp["$lt"].(time.Time).Equal(time.Date(2019, 11, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected filter %v", gotFilter)
+	}
+	if !gotOpts.Redact || len(gotOpts.Columns) != 2 || gotOpts.Columns[1] != "email" {
+		t.Errorf("Unexpected options %+v", gotOpts)
+	}
+
+	for _, query := range []string{"format=xml", "columns=password", "from=yesterday"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/internal/requests/export?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", query, http.StatusBadRequest, rr.Code)
+		}
+	}
+}
+
+func TestSubmissionLimits(t *testing.T) {
+	viper.Set("submissionLimitPerEmail", 2)
+	viper.Set("submissionLimitPerIP", 3)
+	viper.Set("submissionLimitGlobal", 0)
+	defer viper.Set("submissionLimitPerEmail", nil)
+	defer viper.Set("submissionLimitPerIP", nil)
+	defer viper.Set("submissionLimitGlobal", nil)
+	attempts := &fakeAttempts{counts: make(map[string]int64), windows: make(map[string]time.Duration)}
+	svc := &Service{
+		logger:   logrus.NewEntry(logrus.New()),
+		attempts: attempts,
+	}
+	rejectedBefore := testutil.ToFloat64(metrics.SubmissionsRateLimited.WithLabelValues("email"))
+
+	for i := 0; i < 2; i++ {
+		if limited, _ := svc.limitSubmission("Kid@gmail.com", "203.0.113.1"); limited {
+			t.Fatalf("Expected application %d to be accepted", i+1)
+		}
+	}
+	// Emails are limited ignoring case
+	limited, ttl := svc.limitSubmission("kid@gmail.com", "203.0.113.1")
+	if !limited || ttl != time.Hour {
+		t.Fatalf("Expected the email to be limited for the hour, got %v %v", limited, ttl)
+	}
+	if attempts.counts["submit:limited:kid@gmail.com"] != 1 {
+		t.Errorf("Expected the email to be marked for the worker, got %v", attempts.counts)
+	}
+	// Rejected applications do not count towards the address
+	if limited, _ := svc.limitSubmission("other@gmail.com", "203.0.113.1"); limited {
+		t.Error("Expected another email of the address to be accepted")
+	}
+	if limited, _ := svc.limitSubmission("third@gmail.com", "203.0.113.1"); !limited {
+		t.Error("Expected the address to be limited")
+	}
+	if limited, _ := svc.limitSubmission("third@gmail.com", "203.0.113.2"); limited {
+		t.Error("Expected other addresses not to be limited")
+	}
+	if rejected := testutil.ToFloat64(metrics.SubmissionsRateLimited.WithLabelValues("email")) - rejectedBefore; rejected != 1 {
+		t.Errorf("Expected 1 application rejected by the email limit, got %v", rejected)
+	}
+	if _, ok := attempts.counts["submit:global"]; ok {
+		t.Error("Expected the disabled global limit not to be counted")
+	}
+}
+
+type fakeNonces map[string]string
+
+func (f fakeNonces) ActionNonceState(nonce string) (string, error) {
+	return f[nonce], nil
+}
+
+func (f fakeNonces) ConsumeActionNonce(nonce string) (bool, error) {
+	if f[nonce] != cache.NonceUnused {
+		return false, nil
+	}
+	f[nonce] = cache.NonceConsumed
+	return true, nil
+}
+
+func TestActionLinkSingleUse(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	nonces := fakeNonces{"nonce1": cache.NonceUnused}
+	svc := &Service{logger: logrus.NewEntry(logrus.New()), nonces: nonces}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Timestamp: time.Now()}
+	admToken, _ := utils.SignActionToken(utils.ActionToken{
+		Op:        "op1@gmail.com",
+		RequestID: request.ID.Hex(),
+		Nonce:     "nonce1",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}, "passphrase")
+
+	token, legacy, _, err := parseOpToken(admToken)
+	if err != nil || legacy || token.Op != "op1@gmail.com" {
+		t.Fatalf("Expected signed token of op1, got %+v %v %v", token, legacy, err)
+	}
+	if err := svc.checkOpToken(token, legacy, request); err != nil {
+		t.Fatalf("Expected unused link to be valid, got %v", err)
+	}
+	if err := svc.checkOpToken(token, legacy, types.WhitelistRequest{ID: primitive.NewObjectID()}); err != errInvalidToken {
+		t.Errorf("Expected link of another request to be invalid, got %v", err)
+	}
+	svc.consumeActionLink(admToken)
+	if err := svc.checkOpToken(token, legacy, request); err != errActionLinkUsed {
+		t.Errorf("Expected used link to be rejected, got %v", err)
+	}
+	token.Nonce = "unknown"
+	if err := svc.checkOpToken(token, legacy, request); err != errInvalidToken {
+		t.Errorf("Expected link with unknown nonce to be invalid, got %v", err)
+	}
+
+	// Expired and used links are told apart from invalid ones
+	for err, statusCode := range map[error]int{errActionLinkExpired: http.StatusGone, errActionLinkUsed: http.StatusConflict, errInvalidToken: http.StatusBadRequest} {
+		rr := httptest.NewRecorder()
+		svc.tokenError(rr, httptest.NewRequest("GET", "/api/v1/verify/id?adm=token", nil), err)
+		if rr.Code != statusCode {
+			t.Errorf("Expected %d for %v, got %d", statusCode, err, rr.Code)
+		}
+	}
+	expiredToken, _ := utils.SignActionToken(utils.ActionToken{Op: "op1@gmail.com", ExpiresAt: time.Now().Unix() - 1}, "passphrase")
+	if _, _, _, err := parseOpToken(expiredToken); err != utils.ErrTokenExpired {
+		t.Errorf("Expected expired token, got %v", err)
+	}
+}
+
+func TestActionLinkAfterPassphraseRotation(t *testing.T) {
+	viper.Set("passphrase", "old passphrase")
+	defer viper.Set("previousPassphrases", nil)
+	defer viper.Set("passphrase", "passphrase")
+	legacyToken, _ := utils.EncodeAndEncrypt("op1@gmail.com", "old passphrase")
+	signedToken, _ := utils.SignActionToken(utils.ActionToken{
+		Op:        "op1@gmail.com",
+		Nonce:     "nonce1",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}, "old passphrase")
+
+	viper.Set("passphrase", "new passphrase")
+	viper.Set("previousPassphrases", []string{"old passphrase"})
+	for _, admToken := range []string{legacyToken, signedToken} {
+		token, _, secret, err := parseOpToken(admToken)
+		if err != nil || token.Op != "op1@gmail.com" || secret != 1 {
+			t.Errorf("Expected token of the previous passphrase to be valid, got %+v %d %v", token, secret, err)
+		}
+	}
+
+	viper.Set("previousPassphrases", nil)
+	if _, _, _, err := parseOpToken(legacyToken); err != utils.ErrUnknownSecret {
+		t.Errorf("Expected legacy token of a removed passphrase to be rejected, got %v", err)
+	}
+	if _, _, _, err := parseOpToken(signedToken); err != utils.ErrTokenSignature {
+		t.Errorf("Expected signed token of a removed passphrase to be rejected, got %v", err)
+	}
+}
+
+func TestLegacyActionLinkGracePeriod(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	defer viper.Set("legacyActionLinkGraceDays", nil)
+	svc := &Service{logger: logrus.NewEntry(logrus.New()), nonces: fakeNonces{}}
+	admToken, _ := utils.EncodeAndEncrypt("op1@gmail.com", "passphrase")
+	token, legacy, _, err := parseOpToken(admToken)
+	if err != nil || !legacy || token.Op != "op1@gmail.com" {
+		t.Fatalf("Expected legacy token of op1, got %+v %v %v", token, legacy, err)
+	}
+	recent := types.WhitelistRequest{ID: primitive.NewObjectID(), Timestamp: time.Now().Add(-6 * 24 * time.Hour)}
+	old := types.WhitelistRequest{ID: primitive.NewObjectID(), Timestamp: time.Now().Add(-8 * 24 * time.Hour)}
+	if err := svc.checkOpToken(token, legacy, recent); err != nil {
+		t.Errorf("Expected legacy link within the grace period to be valid, got %v", err)
+	}
+	if err := svc.checkOpToken(token, legacy, old); err != errActionLinkExpired {
+		t.Errorf("Expected legacy link after the grace period to be expired, got %v", err)
+	}
+	viper.Set("legacyActionLinkGraceDays", 0)
+	if err := svc.checkOpToken(token, legacy, recent); err != errActionLinkExpired {
+		t.Errorf("Expected legacy links to be rejected without grace period, got %v", err)
+	}
+}
+
+func TestResubmissionEligibility(t *testing.T) {
+	defer viper.Set("resubmissionLimit", nil)
+	svc := &Service{logger: logrus.New().WithField("origin", "server")}
+	pending := types.WhitelistRequest{ID: primitive.NewObjectID(), Status: types.StatusPending}
+	if statusCode, err := svc.validateResubmission(pending); statusCode != http.StatusConflict || err == nil {
+		t.Errorf("Expected only denied requests to be resubmittable, got %d %v", statusCode, err)
+	}
+
+	original := types.WhitelistRequest{ID: primitive.NewObjectID(), Status: types.StatusDenied}
+	if attempt := resubmissionAttempt(original); attempt != 2 {
+		t.Errorf("Expected the first resubmission to be attempt 2, got %d", attempt)
+	}
+	// The original request and 2 resubmissions have been denied
+	exhausted := types.WhitelistRequest{ID: primitive.NewObjectID(), Status: types.StatusDenied, Attempt: 3}
+	if statusCode, err := svc.validateResubmission(exhausted); statusCode != http.StatusForbidden || err == nil {
+		t.Errorf("Expected the default limit of 2 resubmissions, got %d %v", statusCode, err)
+	}
+	viper.Set("resubmissionLimit", 0)
+	if statusCode, _ := svc.validateResubmission(original); statusCode != http.StatusForbidden {
+		t.Errorf("Expected resubmissions to be disabled, got %d", statusCode)
+	}
+}
+
+func TestResendTask(t *testing.T) {
+	pending := types.WhitelistRequest{ID: primitive.NewObjectID(), Status: types.StatusPending, Assignees: []string{"op1@gmail.com", "op2@gmail.com"}}
+	denied := types.WhitelistRequest{ID: primitive.NewObjectID(), Status: types.StatusDenied, Assignees: []string{"op1@gmail.com"}}
+	tests := []struct {
+		request    types.WhitelistRequest
+		body       ResendBody
+		statusCode int
+		ops        []string
+	}{
+		{pending, ResendBody{Email: types.EmailConfirmation}, http.StatusAccepted, nil},
+		{denied, ResendBody{Email: types.EmailDecision}, http.StatusAccepted, nil},
+		{pending, ResendBody{Email: types.EmailDecision}, http.StatusConflict, nil},
+		{pending, ResendBody{Email: types.EmailOpsAction}, http.StatusAccepted, []string{"op1@gmail.com", "op2@gmail.com"}},
+		{pending, ResendBody{Email: types.EmailOpsAction, Op: "OP2@gmail.com"}, http.StatusAccepted, []string{"op2@gmail.com"}},
+		{pending, ResendBody{Email: types.EmailOpsAction, Op: "op3@gmail.com"}, http.StatusBadRequest, nil},
+		{denied, ResendBody{Email: types.EmailOpsAction}, http.StatusConflict, nil},
+		{denied, ResendBody{Email: types.EmailDecision, Op: "op1@gmail.com"}, http.StatusBadRequest, nil},
+		{denied, ResendBody{Email: "welcome"}, http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		task, statusCode, err := resendTask(test.request, test.body, "admin")
+		if statusCode != test.statusCode || (err == nil) != (statusCode == http.StatusAccepted) {
+			t.Errorf("%s of a %s request: expected %d, got %d %v", test.body.Email, test.request.Status, test.statusCode, statusCode, err)
+			continue
+		}
+		if err == nil && (task.Request.ID != test.request.ID || task.Actor != "admin" || fmt.Sprint(task.Ops) != fmt.Sprint(test.ops)) {
+			t.Errorf("%s of a %s request: unexpected task %+v", test.body.Email, test.request.Status, task)
+		}
+	}
+	if _, _, err := resendTask(pending, ResendBody{Email: types.EmailDecision}, "admin"); err != errNoDecision {
+		t.Errorf("Expected a clear message when the request has no decision yet, got %v", err)
+	}
+}
+
+func TestEmailResentToCorrectedAddress(t *testing.T) {
+	for status, expected := range map[string]string{
+		types.StatusPending:  types.EmailConfirmation,
+		types.StatusDisputed: types.EmailConfirmation,
+		types.StatusApproved: types.EmailDecision,
+		types.StatusDenied:   types.EmailDecision,
+		types.StatusBanned:   types.EmailDecision,
+	} {
+		request := types.WhitelistRequest{Status: status}
+		if email := resentEmail(request); email != expected {
+			t.Errorf("Expected the %s email to be resent for %s requests, got %s", expected, status, email)
+		}
+		if _, _, err := resendTask(request, ResendBody{Email: resentEmail(request)}, "admin"); err != nil {
+			t.Errorf("Expected the email of %s requests to be resendable, got %v", status, err)
+		}
+	}
+}
+
+func TestErasureBody(t *testing.T) {
+	svc := &Service{}
+	for _, body := range []ErasureBody{
+		{},
+		{RequestID: primitive.NewObjectID().Hex(), Email: "steve@gmail.com"},
+		{RequestID: "not-an-id"},
+	} {
+		if _, statusCode, err := svc.erasedRequests(body); err == nil || statusCode != http.StatusBadRequest {
+			t.Errorf("Expected %+v to be rejected, got %d %v", body, statusCode, err)
+		}
+	}
+}
+
+func TestGetApplicationForm(t *testing.T) {
+	viper.Set("applicationFields", []interface{}{
+		map[string]interface{}{"key": "referral", "label": "How did you find us?", "required": true},
+	})
+	defer viper.Set("applicationFields", nil)
+	svc := &Service{}
+	rr := httptest.NewRecorder()
+	svc.HandleGetApplicationForm().ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/requests/form", nil))
+	var body struct {
+		Fields []form.Field `json:"fields"`
+	}
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &body) != nil {
+		t.Fatalf("Expected the application form, got %d %s", rr.Code, rr.Body.String())
+	}
+	if len(body.Fields) != 1 || body.Fields[0].Key != "referral" || !body.Fields[0].Required {
+		t.Errorf("Expected the configured fields, got %+v", body.Fields)
+	}
+	rr = httptest.NewRecorder()
+	svc.HandleGetApplicationForm().ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/requests/form?serverId=unknown", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected unknown tenants to be rejected, got %d", rr.Code)
+	}
+}
+
+func TestApplicationWindow(t *testing.T) {
+	opens := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	viper.Set("applicationWindows", []interface{}{map[string]interface{}{
+		"opens":  opens.Format(time.RFC3339),
+		"closes": opens.Add(24 * time.Hour).Format(time.RFC3339),
+	}})
+	defer viper.Set("applicationWindows", nil)
+	svc := &Service{}
+	rr := httptest.NewRecorder()
+	svc.HandleGetApplicationWindow().ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/requests/window", nil))
+	var state worker.ApplicationWindowState
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &state) != nil {
+		t.Fatalf("Expected the state of the application window, got %d %s", rr.Code, rr.Body.String())
+	}
+	if state.Open || state.NextOpening == nil || !state.NextOpening.Equal(opens) {
+		t.Errorf("Expected applications to be closed until %v, got %+v", opens, state)
+	}
+
+	// Submissions are rejected with the next opening before anything is stored
+	rr = httptest.NewRecorder()
+	svc.HandleCreateRequest().ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/requests/", strings.NewReader(`{"username":"Steve","email":"steve@gmail.com"}`)))
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), opens.Format(time.RFC3339)) {
+		t.Errorf("Expected the submission to be rejected with the next opening, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRetryHeaders(t *testing.T) {
+	headers := retryHeaders(map[string]interface{}{
+		"x-retry-count":   int32(2),
+		"x-failed-ops":    primitive.A{"op1@gmail.com"},
+		types.PhaseHeader: types.PhaseEmail,
+	})
+	if err := headers.Validate(); err != nil {
+		t.Fatalf("Expected headers the message queue accepts, got %v", err)
+	}
+	if ops, ok := headers["x-failed-ops"].([]interface{}); !ok || len(ops) != 1 || headers["x-retry-count"] != int32(2) {
+		t.Errorf("Unexpected headers %v", headers)
+	}
+}
+
+func TestRetryStatus(t *testing.T) {
+	for query, expected := range map[string]string{
+		"":                  types.RetryParked,
+		"?status=Abandoned": types.RetryAbandoned,
+		"?status=Consumed":  "",
+	} {
+		status, err := retryStatus(httptest.NewRequest("GET", "/api/v1/internal/retries"+query, nil))
+		if status != expected || (expected == "") != (err != nil) {
+			t.Errorf("Expected status %q for %q, got %q %v", expected, query, status, err)
+		}
+	}
+}
+
+func TestParseAwayBody(t *testing.T) {
+	now := time.Now()
+	for body, valid := range map[string]bool{
+		`{"awayUntil": "` + now.Add(time.Hour).Format(time.RFC3339) + `", "reason": "vacation"}`: true,
+		`{"awayUntil": "` + now.Add(-time.Hour).Format(time.RFC3339) + `"}`:                      false,
+		`{"reason": "vacation"}`:    false,
+		`{"awayUntil": "tomorrow"}`: false,
+	} {
+		_, err := parseAwayBody(httptest.NewRequest("PUT", "/api/v1/internal/ops/op@gmail.com/away", strings.NewReader(body)), now)
+		if valid != (err == nil) {
+			t.Errorf("Expected %s to be valid: %v, got %v", body, valid, err)
+		}
+	}
+}
+
+func TestParseEmailEvents(t *testing.T) {
+	bounces, err := parseSendGridEvents([]byte(`[
+		{"event": "bounce", "type": "bounce", "email": "steve@gmail.com", "reason": "550 User unknown", "smtp-id": "<abc@example.com>"},
+		{"event": "bounce", "type": "blocked", "email": "alex@gmail.com", "smtp-id": "<def@example.com>"},
+		{"event": "delivered", "email": "notch@gmail.com", "smtp-id": "<ghi@example.com>"}
+	]`))
+	if err != nil || len(bounces) != 1 {
+		t.Fatalf("Expected only the hard bounce, got %v %v", bounces, err)
+	}
+	if bounces[0] != (bounceEvent{MessageID: "abc@example.com", Email: "steve@gmail.com", Reason: "550 User unknown"}) {
+		t.Errorf("Unexpected bounce %+v", bounces[0])
+	}
+	if _, err := parseSendGridEvents([]byte(`{"event": "bounce"}`)); err == nil {
+		t.Error("Expected events not in an array to be rejected")
+	}
+
+	notification := func(bounceType string) []byte {
+		message, _ := json.Marshal(map[string]interface{}{
+			"notificationType": "Bounce",
+			"bounce": map[string]interface{}{
+				"bounceType":        bounceType,
+				"bouncedRecipients": []map[string]string{{"emailAddress": "steve@gmail.com", "diagnosticCode": "smtp; 550 5.1.1 user unknown"}},
+			},
+			"mail": map[string]interface{}{"commonHeaders": map[string]string{"messageId": "<abc@example.com>"}},
+		})
+		body, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": string(message)})
+		return body
+	}
+	bounces, _, err = parseSESNotification(notification("Permanent"))
+	if err != nil || len(bounces) != 1 || bounces[0].MessageID != "abc@example.com" || bounces[0].Email != "steve@gmail.com" {
+		t.Errorf("Expected the permanent bounce, got %v %v", bounces, err)
+	}
+	if bounces, _, err = parseSESNotification(notification("Transient")); err != nil || len(bounces) != 0 {
+		t.Errorf("Expected transient bounces to be left out, got %v %v", bounces, err)
+	}
+	_, subscribeURL, err := parseSESNotification([]byte(`{"Type": "SubscriptionConfirmation", "SubscribeURL": "https://sns.amazonaws.com/confirm"}`))
+	if err != nil || subscribeURL != "https://sns.amazonaws.com/confirm" {
+		t.Errorf("Expected the subscription to be confirmed by the owner, got %q %v", subscribeURL, err)
+	}
+}
+
+func TestEmailEventsNeedToken(t *testing.T) {
+	svc := &Service{}
+	for token, expected := range map[string]int{"": http.StatusNotFound, "secret": http.StatusUnauthorized} {
+		viper.Set("emailEventsToken", token)
+		rr := httptest.NewRecorder()
+		svc.HandleEmailEvents().ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/email-events?token=guess", strings.NewReader("[]")))
+		if rr.Code != expected {
+			t.Errorf("Expected %d with token %q configured, got %d", expected, token, rr.Code)
+		}
+	}
+	viper.Set("emailEventsToken", nil)
+}
+
+func TestTestSendTemplate(t *testing.T) {
+	// Template paths are relative to the server directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	var sentTemplate, sentTo string
+	var sentData interface{}
+	audited := make([]types.AuditEntry, 0)
+	handler := testSendHandler(func(templateName string, templateData interface{}, subject string, recipent string) error {
+		sentTemplate, sentData, sentTo = templateName, templateData, recipent
+		return nil
+	}, func(entry types.AuditEntry) {
+		audited = append(audited, entry)
+	}, logrus.NewEntry(logrus.New()))
+	router := mux.NewRouter()
+	router.Handle("/templates/{name}/test-send", handler)
+	send := func(name, body string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/templates/"+name+"/test-send", strings.NewReader(body)))
+		return rr.Code
+	}
+	if code := send("approve.html", `{"email": "admin@gmail.com", "locale": "zh-CN"}`); code != http.StatusOK {
+		t.Fatalf("Expected the test email to be sent, got %d", code)
+	}
+	if sentTemplate != filepath.Join("mailer", "templates", "zh-CN", "approve.html") || sentTo != "admin@gmail.com" {
+		t.Errorf("Expected the translated template the worker sends, got %s to %s", sentTemplate, sentTo)
+	}
+	if data, ok := sentData.(map[string]interface{}); !ok || data["reason"] == nil {
+		t.Errorf("Expected the sample data of the template, got %v", sentData)
+	}
+	if len(audited) != 1 || audited[0].Action != "template.testSend" {
+		t.Errorf("Expected the test send to be audited, got %v", audited)
+	}
+	for name, body := range map[string]string{
+		"approve.html":  `{"email": "not an email"}`,
+		"unknown.html":  `{"email": "admin@gmail.com"}`,
+		"../config.yml": `{"email": "admin@gmail.com"}`,
+	} {
+		if code := send(name, body); code == http.StatusOK {
+			t.Errorf("Expected %s %s to be rejected", name, body)
+		}
+	}
+}
+
+func TestNewComment(t *testing.T) {
+	now := time.Now()
+	comment, err := newComment(CommentBody{Text: "  My cousin, I vouch  "}, "op1@gmail.com", now)
+	if err != nil || comment.Text != "My cousin, I vouch" || comment.Author != "op1@gmail.com" || comment.ID.IsZero() {
+		t.Errorf("Expected the trimmed comment of the op, got %+v, %v", comment, err)
+	}
+	for _, text := range []string{"", "   ", strings.Repeat("a", MaxCommentLength+1)} {
+		if _, err := newComment(CommentBody{Text: text}, "op1@gmail.com", now); err == nil {
+			t.Errorf("Expected a comment of %d characters to be rejected", len(text))
+		}
+	}
+	request := types.WhitelistRequest{
+		Assignees: []string{"OP1@gmail.com", "op2@gmail.com", "op3@gmail.com"},
+		Comments:  []types.Comment{{Author: "op2@gmail.com", Text: "Earlier comment"}},
+	}
+	task := commentTask(request, comment)
+	if !reflect.DeepEqual(task.Ops, []string{"op2@gmail.com", "op3@gmail.com"}) || task.Request.Comments != nil {
+		t.Errorf("Expected the other assignees to be notified of the new comment only, got %+v", task)
+	}
+}
+
+func TestParseCommentsPage(t *testing.T) {
+	for query, expected := range map[string][2]int64{
+		"":                     {1, defaultCommentsPageSize},
+		"page=3&pageSize=10":   {3, 10},
+		"page=0":               {0, 0},
+		"pageSize=1000":        {0, 0},
+		"page=two&pageSize=10": {0, 0},
+	} {
+		values, _ := url.ParseQuery(query)
+		page, pageSize, err := parseCommentsPage(values)
+		if (err != nil) != (expected[0] == 0) || page != expected[0] || pageSize != expected[1] {
+			t.Errorf("Expected %q to be page %v, got %d, %d, %v", query, expected, page, pageSize, err)
+		}
+	}
+}
+
+func TestPublicStats(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	available := true
+	getStats := func(serverID string) (types.Stats, error) {
+		return types.Stats{Approved: 3, Denied: 1, Pending: 2, AverageDecisionTimeInMinutes: 12}, nil
+	}
+	getCounts := func(serverID string) (types.TimeSeriesCounts, error) {
+		return types.TimeSeriesCounts{Submissions: []types.SubmissionCount{
+			{Day: time.Now().UTC().Format("2006-01-02"), Hour: 1, Count: 4},
+			{Day: time.Now().UTC().AddDate(0, 0, -30).Format("2006-01-02"), Hour: 1, Count: 9},
+		}}, nil
+	}
+	handler := publicStatsHandler(func() bool { return available }, getStats, getCounts, log)
+	get := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/stats/public", nil)
+		r.Header.Set("Origin", origin)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	if rr := get(""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected public stats to be disabled without fields, got %d", rr.Code)
+	}
+
+	viper.Set("publicStatsFields", []string{publicTotalApproved, publicApprovalRate, publicRequestsThisWeek})
+	defer viper.Set("publicStatsFields", nil)
+	rr := get("")
+	if rr.Code != http.StatusOK || rr.Header().Get("Cache-Control") != publicStatsCacheControl {
+		t.Fatalf("Expected cacheable public stats, got %d with Cache-Control %q", rr.Code, rr.Header().Get("Cache-Control"))
+	}
+	var public map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &public)
+	expected := map[string]interface{}{publicTotalApproved: 3.0, publicApprovalRate: 0.75, publicRequestsThisWeek: 4.0}
+	if !reflect.DeepEqual(public, expected) {
+		t.Errorf("Expected only the configured fields %v, got %v", expected, public)
+	}
+
+	viper.Set("publicStatsOrigins", []string{"https://example.com"})
+	defer viper.Set("publicStatsOrigins", nil)
+	if rr := get("https://example.com"); rr.Header().Get("Access-Control-Allow-Origin") != "https://example.com" {
+		t.Errorf("Expected the configured origin to be allowed")
+	}
+	if rr := get("https://other.com"); rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected other origins not to be allowed")
+	}
+
+	available = false
+	if rr := get(""); rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected 503 with Retry-After while the cache is unavailable, got %d", rr.Code)
+	}
+}
+
+func TestExternalRequestViewHidesOps(t *testing.T) {
+	submitted := time.Date(2019, 11, 7, 9, 0, 0, 0, time.UTC)
+	decided := submitted.Add(2 * time.Hour)
+	ops := []string{"alice@example.com", "bob@example.com"}
+	request := types.WhitelistRequest{
+		ID:        primitive.NewObjectID(),
+		Username:  "steve",
+		Status:    types.StatusApproved,
+		Timestamp: submitted,
+		DecidedAt: &decided,
+		Admin:     ops[1],
+		Note:      "Vouched for by a member",
+		Assignees: ops,
+		Votes: []types.Vote{
+			{Op: ops[0], Decision: types.StatusApproved},
+			{Op: ops[1], Decision: types.StatusApproved},
+		},
+		Comments:    []types.Comment{{Author: ops[0], Text: "Vouched for by a member"}},
+		Dispatches:  []types.Dispatch{{Op: ops[0], Timestamp: submitted}},
+		RespondedBy: ops[1],
+		Timeline: []types.Milestone{
+			{Name: types.MilestoneSubmitted, At: submitted},
+			{Name: types.MilestoneOpsNotified, At: submitted.Add(time.Minute), Ops: ops},
+			{Name: types.MilestoneApproved, At: decided, Reviewers: 2, Ops: ops},
+		},
+	}
+	encoded, err := json.Marshal(externalRequestView(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range append(ops, request.Note) {
+		if strings.Contains(string(encoded), secret) {
+			t.Errorf("Expected %q to be left out of the status page, got %s", secret, encoded)
+		}
+	}
+	var view struct {
+		Timeline []map[string]interface{} `json:"timeline"`
+	}
+	json.Unmarshal(encoded, &view)
+	expected := []map[string]interface{}{
+		{"name": types.MilestoneSubmitted, "at": submitted.Format(time.RFC3339)},
+		{"name": types.MilestoneOpsNotified, "at": submitted.Add(time.Minute).Format(time.RFC3339)},
+		{"name": types.MilestoneApproved, "at": decided.Format(time.RFC3339), "reviewers": 2.0},
+	}
+	if !reflect.DeepEqual(view.Timeline, expected) {
+		t.Errorf("Expected timeline %v, got %v", expected, view.Timeline)
+	}
+
+	// The admin view keeps the ops
+	admin, _ := json.Marshal(request)
+	if !strings.Contains(string(admin), `"ops":["alice@example.com","bob@example.com"]`) {
+		t.Errorf("Expected the ops in the admin view, got %s", admin)
+	}
+}
+
+func TestReapplyCountdown(t *testing.T) {
+	viper.Set("reapplyCooldownHours", 24)
+	defer viper.Set("reapplyCooldownHours", nil)
+	now := time.Now()
+	denied := types.WhitelistRequest{Status: types.StatusDenied, Admin: "op1@gmail.com", ProcessedTimestamp: now.Add(-time.Hour)}
+	reapplyAfter, seconds := reapplyCountdown(denied, now)
+	if reapplyAfter == nil || !reapplyAfter.Equal(now.Add(23*time.Hour)) || seconds != 23*60*60 {
+		t.Errorf("Expected the applicant to wait 23 more hours, got %v %d", reapplyAfter, seconds)
+	}
+	if view := externalRequestView(denied); view["reapplyAfter"] == nil || view["reapplyCooldownSeconds"].(int) <= 0 {
+		t.Errorf("Expected the status page to show the countdown, got %v", view)
+	}
+	// Expired requests were never decided, banned players never may apply
+	for _, status := range []string{types.StatusExpired, types.StatusBanned} {
+		request := denied
+		request.Status = status
+		if reapplyAfter, seconds := reapplyCountdown(request, now); reapplyAfter != nil || seconds != 0 {
+			t.Errorf("Expected no cooldown for %s requests, got %v", status, reapplyAfter)
+		}
+	}
+	if reapplyAfter, _ := reapplyCountdown(denied, now.Add(24*time.Hour)); reapplyAfter != nil {
+		t.Errorf("Expected no countdown once the cooldown ended, got %v", reapplyAfter)
+	}
+	if message := reapplyCooldownMessage(now.Add(23 * time.Hour)); !strings.Contains(message, now.Add(23*time.Hour).UTC().Format("January 2, 2006")) {
+		t.Errorf("Expected the message to tell when the applicant may reapply, got %s", message)
+	}
+
+	// New requests of the player are rejected at the API until then
+	store := db.NewMemoryStore()
+	svc := &Service{logger: logrus.NewEntry(logrus.New()), store: store}
+	id, _ := store.CreateRequest(types.WhitelistRequest{Username: "Steve", Email: "steve@gmail.com"})
+	store.TransitionStatus(id, db.StatusChange{From: types.StatusPending, To: types.StatusDenied, At: now.Add(-time.Hour), Admin: "op1@gmail.com"})
+	if until, err := svc.reapplyAfter(types.WhitelistRequest{Username: "STEVE", Email: "alex@gmail.com"}, now); err != nil || !until.Equal(now.Add(23*time.Hour)) {
+		t.Errorf("Expected the request to be rejected until the cooldown ends, got %v %v", until, err)
+	}
+	if until, _ := svc.reapplyAfter(types.WhitelistRequest{Username: "Alex", Email: "alex@gmail.com"}, now); !until.IsZero() {
+		t.Errorf("Expected other players to apply, got %v", until)
+	}
+}
+
+func TestWaitlistPosition(t *testing.T) {
+	store := db.NewMemoryStore()
+	svc := &Service{logger: logrus.NewEntry(logrus.New()), store: store}
+	waitlist := func(username, serverID string) types.WhitelistRequest {
+		id, _ := store.CreateRequest(types.WhitelistRequest{Username: username, ServerID: serverID})
+		store.TransitionStatus(id, db.StatusChange{From: types.StatusPending, To: types.StatusApproved, At: time.Now()})
+		request, _ := store.TransitionStatus(id, db.StatusChange{From: types.StatusApproved, To: types.StatusWaitlisted, At: time.Now()})
+		time.Sleep(5 * time.Millisecond)
+		return request
+	}
+	steve := waitlist("Steve", "")
+	waitlist("Notch", "creative")
+	alex := waitlist("Alex", "")
+	if position := svc.waitlistPosition(steve); position != 1 {
+		t.Errorf("Expected the oldest waitlisted request to be first, got %d", position)
+	}
+	if position := svc.waitlistPosition(alex); position != 2 {
+		t.Errorf("Expected requests of other tenants not to count, got %d", position)
+	}
+	alex.Status = types.StatusApproved
+	if position := svc.waitlistPosition(alex); position != 0 {
+		t.Errorf("Expected no position once promoted, got %d", position)
+	}
+}
+
+func TestFollowUps(t *testing.T) {
+	store := db.NewMemoryStore()
+	svc := &Service{logger: logrus.NewEntry(logrus.New()), store: store}
+	approve := func(username string, followUp *types.FollowUp) primitive.ObjectID {
+		id, _ := store.CreateRequest(types.WhitelistRequest{Username: username})
+		store.TransitionStatus(id, db.StatusChange{From: types.StatusPending, To: types.StatusApproved, At: time.Now()})
+		if followUp != nil {
+			store.SetFollowUp(id, followUp)
+		}
+		return id
+	}
+	now := time.Now()
+	steve := approve("Steve", &types.FollowUp{Reasons: []string{types.FollowUpNeverJoined}, SuggestedActions: []string{types.FollowUpReachOut, types.FollowUpDeactivate}, FlaggedAt: now})
+	alex := approve("Alex", nil)
+	approve("Notch", &types.FollowUp{Reasons: []string{types.FollowUpEmailBounced}, FlaggedAt: now, DismissedAt: &now})
+
+	// Dismissed follow-ups are not listed
+	w := httptest.NewRecorder()
+	svc.HandleGetFollowUps()(w, httptest.NewRequest("GET", "/api/v1/internal/followups", nil))
+	var body struct {
+		FollowUps []types.WhitelistRequest `json:"followUps"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the follow-ups, got %d %v", w.Code, err)
+	}
+	if len(body.FollowUps) != 1 || body.FollowUps[0].ID != steve || fmt.Sprint(body.FollowUps[0].FollowUp.SuggestedActions) != "[reachOut deactivate]" {
+		t.Errorf("Expected the flagged request with its suggested actions, got %+v", body.FollowUps)
+	}
+
+	act := func(id, action string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/internal/followups/"+id, strings.NewReader(`{"action": "`+action+`"}`))
+		svc.HandleFollowUp()(w, mux.SetURLVars(r, map[string]string{"requestId": id}))
+		return w
+	}
+	tests := []struct {
+		id, action string
+		code       int
+	}{
+		{steve.Hex(), types.FollowUpReachOut, http.StatusBadRequest},
+		{"invalid", followUpDismiss, http.StatusBadRequest},
+		{primitive.NewObjectID().Hex(), followUpDismiss, http.StatusNotFound},
+		{alex.Hex(), types.FollowUpDeactivate, http.StatusConflict},
+	}
+	for _, test := range tests {
+		if w := act(test.id, test.action); w.Code != test.code {
+			t.Errorf("Expected %d for %s of %s, got %d %s", test.code, test.action, test.id, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestApplicantTimelineOfLegacyRequest(t *testing.T) {
+	submitted := time.Date(2019, 11, 7, 9, 0, 0, 0, time.UTC)
+	request := types.WhitelistRequest{
+		Status:             types.StatusDenied,
+		Timestamp:          submitted,
+		ProcessedTimestamp: submitted.Add(time.Hour),
+		Admin:              "alice@example.com",
+	}
+	expected := []applicantMilestone{
+		{Name: types.MilestoneSubmitted, At: submitted},
+		{Name: types.MilestoneDenied, At: submitted.Add(time.Hour), Reviewers: 1},
+	}
+	if timeline := applicantTimeline(request); !reflect.DeepEqual(timeline, expected) {
+		t.Errorf("Expected milestones told by the fields of the request %+v, got %+v", expected, timeline)
+	}
+}
+
+func TestValidateBedrockRequest(t *testing.T) {
+	svc := &Service{logger: logrus.NewEntry(logrus.New())}
+	request := types.WhitelistRequest{Username: "Steve Jobs", Platform: utils.PlatformBedrock}
+	request.Username = worker.NormalizeRequestUsername(request)
+	if request.Username != ".Steve_Jobs" {
+		t.Errorf("Expected the gamertag to be named like Floodgate names it, got %q", request.Username)
+	}
+	if code, err := svc.validateCreateRequest(&request); code != http.StatusBadRequest || err == nil {
+		t.Errorf("Expected Bedrock players to be rejected while Bedrock is disabled, got %d %v", code, err)
+	}
+
+	viper.Set("bedrockEnabled", true)
+	defer viper.Set("bedrockEnabled", nil)
+	for _, invalid := range []types.WhitelistRequest{
+		{Username: "Steve", Platform: "pocket"},
+		{Username: "Steve", Platform: utils.PlatformBedrock},
+		{Username: ".Steve", Platform: utils.PlatformJava},
+	} {
+		if code, err := svc.validateCreateRequest(&invalid); code != http.StatusBadRequest || err == nil {
+			t.Errorf("Expected %+v to be rejected, got %d %v", invalid, code, err)
+		}
+	}
+}
+
+func TestBulkDecisionIDs(t *testing.T) {
+	ids, err := bulkDecisionIDs([]interface{}{"a", " b ", "a"})
+	if err != nil || !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Errorf("expected deduplicated IDs, got %v %v", ids, err)
+	}
+	for _, value := range []interface{}{nil, []interface{}{}, []interface{}{1}, "a"} {
+		if _, err := bulkDecisionIDs(value); err == nil {
+			t.Errorf("expected %v to be rejected", value)
+		}
+	}
+	tooMany := make([]interface{}, maxBulkDecisionSize+1)
+	for i := range tooMany {
+		tooMany[i] = strconv.Itoa(i)
+	}
+	if _, err := bulkDecisionIDs(tooMany); err == nil {
+		t.Error("expected more than maxBulkDecisionSize IDs to be rejected")
+	}
+}
+
+func TestDecideInBulk(t *testing.T) {
+	pending, disputed, approved, racing, failing, missing :=
+		primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID(),
+		primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	loads := 0
+	load := func(ids []primitive.ObjectID) ([]types.WhitelistRequest, error) {
+		loads++
+		return []types.WhitelistRequest{
+			{ID: pending, Status: types.StatusPending},
+			{ID: disputed, Status: types.StatusDisputed},
+			{ID: approved, Status: types.StatusApproved},
+			{ID: racing, Status: types.StatusPending},
+			{ID: failing, Status: types.StatusPending},
+		}, nil
+	}
+	var decided []primitive.ObjectID
+	decide := func(request types.WhitelistRequest) (int, error) {
+		decided = append(decided, request.ID)
+		switch request.ID {
+		case racing:
+			return http.StatusConflict, errors.New("Request was decided concurrently")
+		case failing:
+			return http.StatusInternalServerError, errors.New("Unable to update request")
+		}
+		return http.StatusOK, nil
+	}
+	ids := []string{pending.Hex(), disputed.Hex(), approved.Hex(), racing.Hex(), failing.Hex(), missing.Hex(), "nope"}
+	results, err := decideInBulk(ids, load, decide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{bulkResultOK, bulkResultOK, bulkResultConflict, bulkResultConflict, bulkResultError,
+		bulkResultNotFound, bulkResultInvalid}
+	for i, result := range results {
+		if result.ID != ids[i] || result.Result != expected[i] {
+			t.Errorf("expected %s to be %s, got %+v", ids[i], expected[i], result)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("expected the requests to be loaded at once, got %d loads", loads)
+	}
+	if len(decided) != 4 {
+		t.Errorf("expected only pending and disputed requests to be decided, got %v", decided)
+	}
+
+	if _, err := decideInBulk([]string{pending.Hex()}, func([]primitive.ObjectID) ([]types.WhitelistRequest, error) {
+		return nil, errors.New("db down")
+	}, decide); err == nil {
+		t.Error("expected the load error to be returned")
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for key, value := range map[string]interface{}{
+		"attachmentsStorage": attachments.StorageLocal,
+		"attachmentsDir":     dir,
+		"apiURL":             "https://api.example.com",
+		"linkSigningKeys":    []interface{}{map[string]interface{}{"id": "k1", "secret": "secret"}},
+	} {
+		viper.Set(key, value)
+		defer viper.Set(key, nil)
+	}
+	svc := &Service{logger: logrus.NewEntry(logrus.New())}
+	upload := func(data []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "proof.png")
+		part.Write(data)
+		form.Close()
+		req := httptest.NewRequest("POST", "/api/v1/requests/attachments", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rr := httptest.NewRecorder()
+		svc.HandleUploadAttachment().ServeHTTP(rr, req)
+		return rr
+	}
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	rr := upload(png)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	var response map[string]string
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	key := response["key"]
+	if rr := upload([]byte("<svg onload=alert(1)>")); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected other types to be rejected, got %d", rr.Code)
+	}
+
+	request := types.WhitelistRequest{Attachments: []string{key}}
+	if err := validateAttachments(&request); err != nil {
+		t.Errorf("Expected the uploaded attachment to be accepted, got %v", err)
+	}
+	for _, keys := range [][]string{{"../../etc/passwd"}, {key, key}, {key, key + "1", key + "2", key + "3"}} {
+		if err := validateAttachments(&types.WhitelistRequest{Attachments: keys}); err == nil {
+			t.Errorf("Expected attachments %v to be rejected", keys)
+		}
+	}
+
+	download := func(link string) *httptest.ResponseRecorder {
+		token := strings.TrimPrefix(link, "https://api.example.com/api/v1/attachments/")
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/attachments/"+token, nil), map[string]string{"attachmentToken": token})
+		rr := httptest.NewRecorder()
+		svc.HandleGetAttachment().ServeHTTP(rr, req)
+		return rr
+	}
+	links, err := attachments.Links(request.Attachments, time.Hour)
+	if err != nil || len(links) != 1 {
+		t.Fatalf("Expected a link of the attachment, got %v %v", links, err)
+	}
+	rr = download(links[0].URL)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), png) || rr.Header().Get("Content-Type") != "image/png" ||
+		rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Expected the attachment to be served, got %d %v", rr.Code, rr.Header())
+	}
+	if rr := download("forged"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid link to be rejected, got %d", rr.Code)
+	}
+
+	// Erasing the request deletes its attachments
+	if err := deleteAttachments(request); err != nil {
+		t.Fatal(err)
+	}
+	if rr := download(links[0].URL); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected an erased attachment not to be served, got %d", rr.Code)
+	}
+	viper.Set("attachmentsStorage", nil)
+	if err := deleteAttachments(request); err == nil {
+		t.Error("Expected attachments that can not be deleted to be reported")
+	}
+}
+
+func TestParseOpProfileBody(t *testing.T) {
+	defer viper.Set("tenants", nil)
+	viper.Set("tenants", map[string]interface{}{"creative": map[string]interface{}{}})
+	parse := func(body string) (opProfileBody, error) {
+		return parseOpProfileBody(httptest.NewRequest("PUT", "/api/v1/internal/ops/op1@gmail.com/profile", strings.NewReader(body)))
+	}
+	profile, err := parse(`{"digest": true}`)
+	if err != nil || len(profile.Tenants) != 1 || profile.Tenants[0] != "" || !profile.Digest {
+		t.Fatalf("expected the op to handle the default tenant, got %v %v", profile, err)
+	}
+	profile, err = parse(`{"tenants": ["", " Creative"], "notifications": {"request": ["email", "telegram"], "comment": []}, "telegramChatID": "42"}`)
+	if err != nil || profile.Tenants[1] != "creative" {
+		t.Fatalf("expected the profile to be valid, got %v %v", profile, err)
+	}
+	for _, body := range []string{
+		`{"tenants": ["survival"]}`,
+		`{"notifications": {"ban": ["email"]}}`,
+		`{"notifications": {"request": ["discord"]}}`,
+		`{"notifications": {"request": ["telegram"]}}`,
+		`{"tenants": "creative"}`,
+	} {
+		if _, err := parse(body); err == nil {
+			t.Errorf("expected %s to be rejected", body)
+		}
+	}
+}
+
+func TestAPIKeysNotAcceptedOnOwnerRoutes(t *testing.T) {
+	viper.Set("apiKeys", []string{"key1"})
+	defer viper.Set("apiKeys", nil)
+	svc := &Service{router: mux.NewRouter().StrictSlash(true), logger: logrus.NewEntry(logrus.New())}
+	svc.routes()
+	for _, route := range []struct{ method, path string }{
+		{"POST", "/api/v1/internal/console"},
+		{"GET", "/api/v1/internal/tasks/" + primitive.NewObjectID().Hex()},
+	} {
+		r := httptest.NewRequest(route.method, route.path, strings.NewReader(`{"command":"list"}`))
+		r.Header.Set("X-API-Key", "key1")
+		rr := httptest.NewRecorder()
+		svc.router.ServeHTTP(rr, r)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected API keys to be refused on %s %s, got %d", route.method, route.path, rr.Code)
+		}
+	}
+	// Other admin endpoints still accept them
+	var authenticated bool
+	next := func(w http.ResponseWriter, r *http.Request) { authenticated = true }
+	r := httptest.NewRequest("GET", "/api/v1/internal/stats", nil)
+	r.Header.Set("X-API-Key", "key1")
+	svc.authenticate(httptest.NewRecorder(), r, next)
+	if !authenticated {
+		t.Error("Expected the API key to be accepted on admin endpoints")
+	}
+}
@@ -72,7 +72,7 @@ func TestMain(m *testing.M) {
 	sseServer := sse.NewServer(serverLogger)
 	// Setup redis cache
 	cacheService = cache.NewService(dbSvc, sseServer)
-	err = cacheService.SyncCache()
+	err = cacheService.SyncStats()
 	if err != nil {
 		log.Fatal("Unable to sync cache values: " + err.Error())
 	}
@@ -201,6 +201,35 @@ func TestCreateDupRequest(t *testing.T) {
 	}
 }
 
+func TestCreateDupRequestSameEmailDifferentCase(t *testing.T) {
+	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
+	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest1)
+
+	// Try to create request with another username but the same email should fail
+	var jsonStr = []byte(`{
+		"info": {
+		  "applicationText": "I'd like to join the server"
+		},
+		"username": "user1alt",
+		"email": "USER1@gmail.com",
+		"age": 19,
+		"gender": "female"
+	  }`)
+
+	req, err := http.NewRequest("POST", "/api/v1/requests/", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.HandleCreateRequest())
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusUnprocessableEntity)
+	}
+}
+
 func TestCreateRequestWithAlreadyApproved(t *testing.T) {
 	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
 	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest5)
@@ -259,6 +288,47 @@ func TestCreateRequestAfterDenial(t *testing.T) {
 	}
 }
 
+func TestResubmitRequest(t *testing.T) {
+	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
+	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest4)
+	token, err := utils.SignToken(newRequest4.ID.Hex(), utils.PurposeStatus, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The applicant fixes the spelling of the username
+	var jsonStr = []byte(`{
+		"info": {
+		  "applicationText": "I'd like to join the server"
+		},
+		"username": "user4_fixed",
+		"email": "someone@gmail.com",
+		"age": 29,
+		"gender": "male"
+	  }`)
+	for _, expected := range []int{http.StatusCreated, http.StatusConflict} {
+		req, err := http.NewRequest("POST", "/api/v1/requests/", bytes.NewBuffer(jsonStr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = mux.SetURLVars(req, map[string]string{"requestIdEncoded": token})
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.HandleResubmitRequest()).ServeHTTP(rr, req)
+		if status := rr.Code; status != expected {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, expected)
+		}
+	}
+
+	var resubmission types.WhitelistRequest
+	err = dbClient.Database("mc-whitelist").Collection("requests").FindOne(context.TODO(), bson.M{"username": "user4_fixed"}).Decode(&resubmission)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resubmission.PreviousRequestID != newRequest4.ID.Hex() || resubmission.Attempt != 2 || resubmission.Email != "user4@gmail.com" {
+		t.Errorf("Expected the resubmission to be linked to the denied request, got %+v", resubmission)
+	}
+}
+
 func TestGetRequestByIDExternal(t *testing.T) {
 	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
 	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest3)
@@ -344,6 +414,78 @@ func TestUpdateRequestByID(t *testing.T) {
 	}
 }
 
+func TestCancelRequest(t *testing.T) {
+	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
+	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest1)
+	// Encoded request ID for newReuqest1
+	vars := map[string]string{
+		"requestIdEncoded": "MP4QqcxRRN7CIJYcmpO81XldXzY30aIvflB00D_Qh6E-TVkBab9ygcmaOortaa4WUwFMuw==",
+	}
+	for _, expected := range []int{http.StatusOK, http.StatusConflict} {
+		req, err := http.NewRequest("POST", "/api/v1/requests/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.HandleCancelRequest()).ServeHTTP(rr, mux.SetURLVars(req, vars))
+		if status := rr.Code; status != expected {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, expected)
+		}
+	}
+
+	// Ops can no longer decide on the withdrawn request
+	req, err := http.NewRequest("PATCH", "/api/v1/requests/", bytes.NewBuffer([]byte(`{"status": "Approved"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, vars)
+	q := req.URL.Query()
+	q.Add("adm", "Xt-mlteCyiQe7sSS0HnLUOGJSgIW0lpi_SkYz7sahK411cgi5ecE8uQ=")
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.HandlePatchRequestByID()).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+}
+
+func TestUpdateRequestByIDRecordsVote(t *testing.T) {
+	viper.Set("approvalQuorum", 2)
+	defer viper.Set("approvalQuorum", nil)
+	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
+	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest1)
+	vote := func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PATCH", "/api/v1/requests/", bytes.NewBuffer([]byte(`{"status": "Approved"}`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = mux.SetURLVars(req, map[string]string{
+			"requestIdEncoded": "MP4QqcxRRN7CIJYcmpO81XldXzY30aIvflB00D_Qh6E-TVkBab9ygcmaOortaa4WUwFMuw==",
+		})
+		q := req.URL.Query()
+		q.Add("adm", "Xt-mlteCyiQe7sSS0HnLUOGJSgIW0lpi_SkYz7sahK411cgi5ecE8uQ=")
+		req.URL.RawQuery = q.Encode()
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.HandlePatchRequestByID()).ServeHTTP(rr, req)
+		return rr
+	}
+	rr := vote()
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	var response map[string]map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	votes, _ := response["updated"]["votes"].([]interface{})
+	if response["updated"]["status"] != types.StatusPending || len(votes) != 1 {
+		t.Errorf("Expected the request to stay pending with one vote, got %v", response["updated"])
+	}
+	// Each op votes once
+	if rr = vote(); rr.Code != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+}
+
 func TestUpdateRequestByIDMatchingFailed(t *testing.T) {
 	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
 	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest3)
@@ -527,7 +669,7 @@ func TestGetRequestsInternal(t *testing.T) {
 	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest2)
 	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest3)
 	// Need to manually sync cache as we add entries directly into db without going through all the process
-	err := cacheService.SyncCache()
+	err := cacheService.SyncStats()
 	if err != nil {
 		log.Fatal("Unable to sync cache values: " + err.Error())
 	}
@@ -710,3 +852,195 @@ func TestInternalUpdateRequestFail(t *testing.T) {
 			status, http.StatusBadRequest)
 	}
 }
+
+func TestInternalUnbanOnlyBanned(t *testing.T) {
+	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
+	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest1)
+	banned := *newRequest2
+	banned.Status = types.StatusBanned
+	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), banned)
+	tokenStr := getAdminToken(t)
+	unban := func(id string) int {
+		req, err := http.NewRequest("PATCH", "/api/v1/internal/requests/"+id, bytes.NewBufferString(`{"status": "Unbanned"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tokenStr)
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// The pending request was never banned
+	if status := unban(newRequest1.ID.Hex()); status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+	var pending types.WhitelistRequest
+	dbClient.Database("mc-whitelist").Collection("requests").FindOne(context.TODO(), bson.M{"_id": newRequest1.ID}).Decode(&pending)
+	if pending.Status != types.StatusPending {
+		t.Errorf("Expected the request to stay pending, got %s", pending.Status)
+	}
+	// The banned player is unbanned once
+	for _, expected := range []int{http.StatusOK, http.StatusConflict} {
+		if status := unban(banned.ID.Hex()); status != expected {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, expected)
+		}
+	}
+}
+
+func getAdminToken(t *testing.T) string {
+	var jsonStr = []byte(`{"username": "testadmin", "password": "testadminpassword"}`)
+	req, err := http.NewRequest("POST", "/api/v1/auth/", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.HandleAdminSignin()).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	var response map[string]map[string]interface{}
+	json.Unmarshal([]byte(rr.Body.String()), &response)
+	return fmt.Sprintf("%v", response["token"]["value"])
+}
+
+func TestFollowUpActions(t *testing.T) {
+	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
+	tokenStr := getAdminToken(t)
+	flaggedAt := time.Now().Add(-time.Hour)
+	for _, request := range []*types.WhitelistRequest{newRequest1, newRequest2} {
+		flagged := *request
+		flagged.Status = "Approved"
+		flagged.FollowUp = &types.FollowUp{Reasons: []string{types.FollowUpNeverJoined}, SuggestedActions: []string{types.FollowUpReachOut, types.FollowUpDeactivate}, FlaggedAt: flaggedAt}
+		dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), flagged)
+	}
+	act := func(id, action string) int {
+		req, err := http.NewRequest("POST", "/api/v1/internal/followups/"+id, bytes.NewBufferString(`{"action": "`+action+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tokenStr)
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Ops dismiss the follow-up once they reached out, and deactivate the player who never joined
+	if status := act(newRequest1.ID.Hex(), "dismiss"); status != http.StatusOK {
+		t.Errorf("Expected the follow-up to be dismissed, got %d", status)
+	}
+	if status := act(newRequest2.ID.Hex(), types.FollowUpDeactivate); status != http.StatusOK {
+		t.Errorf("Expected the player to be deactivated, got %d", status)
+	}
+	var dismissed, deactivated types.WhitelistRequest
+	dbClient.Database("mc-whitelist").Collection("requests").FindOne(context.TODO(), bson.M{"_id": newRequest1.ID}).Decode(&dismissed)
+	dbClient.Database("mc-whitelist").Collection("requests").FindOne(context.TODO(), bson.M{"_id": newRequest2.ID}).Decode(&deactivated)
+	if dismissed.FollowUp == nil || dismissed.FollowUp.DismissedAt == nil || dismissed.FollowUp.DismissedBy != "admin" {
+		t.Errorf("Expected the dismissal to be recorded, got %+v", dismissed.FollowUp)
+	}
+	if deactivated.Status != types.StatusDeactivated {
+		t.Errorf("Expected the player to be deactivated, got %s", deactivated.Status)
+	}
+	if status := act(newRequest1.ID.Hex(), "dismiss"); status != http.StatusConflict {
+		t.Errorf("Expected a dismissed follow-up to be left alone, got %d", status)
+	}
+
+	req, err := http.NewRequest("GET", "/api/v1/internal/followups", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	var response map[string][]types.WhitelistRequest
+	json.Unmarshal([]byte(rr.Body.String()), &response)
+	if rr.Code != http.StatusOK || len(response["followUps"]) != 0 {
+		t.Errorf("Expected no follow-up left, got %d %v", rr.Code, response["followUps"])
+	}
+}
+
+func TestDetachBatchMemberBeforeExpiry(t *testing.T) {
+	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
+	dbClient.Database("mc-whitelist").Collection("batches").DeleteMany(context.TODO(), bson.M{})
+	tokenStr := getAdminToken(t)
+
+	// Create a batch ending in one day
+	endTime := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	jsonStr := []byte(`{"name": "build competition", "endTime": "` + endTime + `"}`)
+	req, err := http.NewRequest("POST", "/api/v1/internal/batches/", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+	var created map[string]types.Batch
+	json.Unmarshal([]byte(rr.Body.String()), &created)
+	batchID := created["batch"].ID.Hex()
+
+	// Attach two approved guests to the batch
+	guest1 := *newRequest1
+	guest1.Status = "Approved"
+	guest1.BatchID = batchID
+	guest2 := *newRequest2
+	guest2.Status = "Approved"
+	guest2.BatchID = batchID
+	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), guest1)
+	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), guest2)
+
+	// Detach one of them before the batch ends
+	req, err = http.NewRequest("DELETE", "/api/v1/internal/batches/"+batchID+"/members/"+guest1.ID.Hex(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	// Only the remaining guest is still a member of the batch
+	req, err = http.NewRequest("GET", "/api/v1/internal/batches/"+batchID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	var response struct {
+		Members []types.WhitelistRequest `json:"members"`
+		Stats   types.BatchStats         `json:"stats"`
+	}
+	json.Unmarshal([]byte(rr.Body.String()), &response)
+	if len(response.Members) != 1 || response.Members[0].ID != guest2.ID {
+		t.Errorf("Expected only %s to remain in the batch, got %v", guest2.Username, response.Members)
+	}
+	if response.Stats.Members != 1 || response.Stats.Approved != 1 || response.Stats.Detached != 1 {
+		t.Errorf("Unexpected batch stats %+v", response.Stats)
+	}
+
+	// Detaching the same request twice fails as it is no longer a member
+	req, err = http.NewRequest("DELETE", "/api/v1/internal/batches/"+batchID+"/members/"+guest1.ID.Hex(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+)
+
+// Applications are limited per hour
+const submissionLimitWindow = time.Hour
+
+const (
+	defaultSubmissionLimitPerEmail = 3
+	defaultSubmissionLimitPerIP    = 10
+	defaultSubmissionLimitGlobal   = 100
+)
+
+// submissionLimit caps the applications counted by key within the window. Scope is the metrics label
+type submissionLimit struct {
+	scope string
+	key   string
+	limit int64
+}
+
+func configuredLimit(key string, fallback int64) int64 {
+	if !viper.IsSet(key) {
+		return fallback
+	}
+	return viper.GetInt64(key)
+}
+
+// submissionLimits returns the limits applying to an application from the email and client address.
+// Limits set to 0 are disabled
+func submissionLimits(email, ip string) []submissionLimit {
+	address, _, _ := storedIP(ip)
+	limits := []submissionLimit{
+		{"email", cache.SubmissionEmailKey(email), configuredLimit("submissionLimitPerEmail", defaultSubmissionLimitPerEmail)},
+		{"ip", "submit:ip:" + address, configuredLimit("submissionLimitPerIP", defaultSubmissionLimitPerIP)},
+		{"global", "submit:global", configuredLimit("submissionLimitGlobal", defaultSubmissionLimitGlobal)},
+	}
+	enabled := make([]submissionLimit, 0, len(limits))
+	for _, limit := range limits {
+		if limit.limit > 0 {
+			enabled = append(enabled, limit)
+		}
+	}
+	return enabled
+}
+
+// limitSubmission counts the application against the submission limits. If a limit has already been reached
+// the application is not counted and the time until the limit's window ends is returned. Emails reaching
+// their limit are marked for the window, so the worker skips their applications still in the queue
+func (svc *Service) limitSubmission(email, ip string) (bool, time.Duration) {
+	if svc.attempts == nil {
+		return false, 0
+	}
+	log := svc.logger
+	limits := submissionLimits(email, ip)
+	for _, limit := range limits {
+		count, ttl, err := svc.attempts.GetAttempts(limit.key)
+		if err != nil {
+			// Do not turn applicants away while the cache is unavailable
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warn("Unable to get submission attempts")
+			return false, 0
+		}
+		if count < limit.limit {
+			continue
+		}
+		metrics.SubmissionsRateLimited.WithLabelValues(limit.scope).Inc()
+		if ttl <= 0 {
+			ttl = submissionLimitWindow
+		}
+		if limit.scope == "email" {
+			_, _, err = svc.attempts.CountAttempt(cache.SubmissionLimitedKey(email), ttl)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"err": err.Error(),
+				}).Warn("Unable to mark email as rate limited")
+			}
+		}
+		log.WithFields(logrus.Fields{
+			"scope": limit.scope,
+			"limit": limit.limit,
+		}).Warn("Application rejected by the submission limit")
+		return true, ttl
+	}
+	for _, limit := range limits {
+		_, _, err := svc.attempts.CountAttempt(limit.key, submissionLimitWindow)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warn("Unable to count submission attempt")
+			break
+		}
+	}
+	return false, 0
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/mailer"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/worker"
+)
+
+// TemplateBody is the body of a template preview or test send. The sample data of the template is used if no
+// data is given. Email is the address test sends go to
+type TemplateBody struct {
+	Data     map[string]interface{} `json:"data"`
+	Locale   string                 `json:"locale"`
+	ServerID string                 `json:"serverId"`
+	Email    string                 `json:"email"`
+}
+
+// templateToRender reads the template of the route and the body, and returns the path of the template the worker
+// sends to the tenant in the locale with the data to render it with
+func templateToRender(r *http.Request) (string, TemplateBody, int, error) {
+	name := mux.Vars(r)["name"]
+	if !mailer.Registered(name) {
+		return "", TemplateBody{}, http.StatusNotFound, errors.New("Resource not found")
+	}
+	var body TemplateBody
+	// The body is optional for previews
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil && err != io.EOF {
+		return "", body, http.StatusBadRequest, errors.New("Unable to read request body")
+	}
+	cfg, err := tenant.Get(body.ServerID)
+	if err != nil {
+		return "", body, http.StatusBadRequest, err
+	}
+	if body.Locale != "" && mailer.NormalizeLocale(body.Locale) == "" {
+		return "", body, http.StatusBadRequest, errors.New("Unsupported locale")
+	}
+	if body.Data == nil {
+		body.Data = mailer.SampleData(name)
+	}
+	return worker.TemplatePath(cfg, name, body.Locale), body, http.StatusOK, nil
+}
+
+// HandleGetTemplates list the email templates with their audience, the data they can reference and the locales
+// they are translated to
+func (svc *Service) HandleGetTemplates() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"templates": mailer.Templates(mailer.TemplatesDir)})
+	}
+}
+
+// HandlePreviewTemplate render an email template the way the worker sends it and return the HTML
+func (svc *Service) HandlePreviewTemplate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path, body, statusCode, err := templateToRender(r)
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		html, err := mailer.Render(path, body.Data)
+		if err != nil {
+			// Broken templates are what previews are for
+			http.Error(w, "Unable to render template: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, html)
+	}
+}
+
+// HandleTestSendTemplate send an email template rendered the way the worker sends it to the given address
+func (svc *Service) HandleTestSendTemplate() http.HandlerFunc {
+	return testSendHandler(worker.Mailer(), svc.audit, svc.logger)
+}
+
+func testSendHandler(send metrics.SendFunc, audit func(types.AuditEntry), log *logrus.Entry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path, body, statusCode, err := templateToRender(r)
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		email, err := db.ValidateEmail(body.Email)
+		if err != nil {
+			http.Error(w, "Invalid email", http.StatusBadRequest)
+			return
+		}
+		name := mux.Vars(r)["name"]
+		err = send(path, body.Data, "[Test] "+name, email)
+		if err != nil {
+			http.Error(w, "Unable to send test email: "+err.Error(), http.StatusBadGateway)
+			log.WithFields(logrus.Fields{
+				"template": name,
+				"err":      err.Error(),
+			}).Warning("Unable to send test email")
+			return
+		}
+		audit(types.AuditEntry{
+			Action:    "template.testSend",
+			Actor:     getActor(r),
+			Details:   map[string]interface{}{"template": name, "email": email, "locale": body.Locale, "serverId": body.ServerID},
+			Timestamp: time.Now(),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success"})
+	}
+}
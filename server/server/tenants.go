@@ -0,0 +1,17 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+)
+
+// queriedTenant returns the server ID of the tenant queried with ?serverId=, the default tenant if none
+// is given. Returns tenant.ErrUnknownTenant for server IDs that are not configured
+func queriedTenant(r *http.Request) (string, error) {
+	serverID := tenant.Normalize(r.URL.Query().Get("serverId"))
+	if !tenant.Known(serverID) {
+		return "", tenant.ErrUnknownTenant
+	}
+	return serverID, nil
+}
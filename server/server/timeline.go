@@ -0,0 +1,43 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// applicantMilestone is a milestone of the timeline as shown on the status page. The ops involved are left out,
+// the applicant is only told how many ops took part in the decision
+type applicantMilestone struct {
+	Name      string    `json:"name"`
+	At        time.Time `json:"at"`
+	Reviewers int       `json:"reviewers,omitempty"`
+}
+
+// applicantTimeline projects the timeline of the request for the applicant, oldest milestone first. Requests
+// stored before timelines were recorded, or decided but not processed by the worker yet, get the milestones
+// their fields tell
+func applicantTimeline(request types.WhitelistRequest) []applicantMilestone {
+	timeline := request.Timeline
+	if _, ok := request.Milestone(types.MilestoneSubmitted); !ok {
+		timeline = append([]types.Milestone{{Name: types.MilestoneSubmitted, At: request.Timestamp}}, timeline...)
+	}
+	if decision, ok := request.DecisionMilestone(); ok {
+		if _, recorded := request.Milestone(decision.Name); !recorded {
+			timeline = append(timeline, decision)
+		}
+	}
+	projected := make([]applicantMilestone, 0, len(timeline))
+	for _, milestone := range timeline {
+		projected = append(projected, applicantMilestone{
+			Name:      milestone.Name,
+			At:        milestone.At,
+			Reviewers: milestone.Reviewers,
+		})
+	}
+	sort.SliceStable(projected, func(i, j int) bool {
+		return projected[i].At.Before(projected[j].At)
+	})
+	return projected
+}
@@ -0,0 +1,113 @@
+//go:build integration
+// +build integration
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Ops deciding the same request at once through the API: the change of the first is stored with its task in the
+// outbox, every other one conflicts and leaves nothing to publish. Needs mongodb to run as a replica set
+func TestConcurrentDecisionsPublishOneTask(t *testing.T) {
+	viper.Set("directPublish", false)
+	defer viper.Set("directPublish", true)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(viper.GetString("mongodbConn")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+	dbService := db.NewService(client)
+	svc := &Service{logger: logrus.NewEntry(logrus.New()), dbService: dbService, store: db.NewMongoStore(dbService)}
+
+	id, err := svc.store.CreateRequest(types.WhitelistRequest{Username: "concurrent", Email: "concurrent@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox := client.Database("mc-whitelist").Collection("outbox")
+	defer outbox.DeleteMany(context.Background(), bson.M{"requestId": id})
+	defer svc.store.DeleteRequest(id)
+	pending, err := svc.store.GetRequest(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var winners []types.WhitelistRequest
+	conflicts := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			op := fmt.Sprintf("op%d@gmail.com", i)
+			decision := types.StatusApproved
+			if i%2 == 1 {
+				decision = types.StatusDenied
+			}
+			now := time.Now()
+			request, statusCode, err := svc.applyRequestChange(id.Hex(), bson.M{
+				"status":               decision,
+				"admin":                op,
+				"processedTimestamp":   now,
+				"lastUpdatedTimestamp": now,
+			}, op, types.StatusPending)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				winners = append(winners, request)
+			case statusCode == http.StatusConflict:
+				conflicts++
+			default:
+				t.Errorf("Unexpected error of %s: %d %v", op, statusCode, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(winners) != 1 || conflicts != 19 {
+		t.Fatalf("Expected one decision to win and the others to conflict, got %d winners and %d conflicts", len(winners), conflicts)
+	}
+	stored, err := svc.store.GetRequest(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	winner := winners[0]
+	if stored.Status != winner.Status || stored.Admin != winner.Admin || stored.Sequence != pending.Sequence+1 {
+		t.Errorf("Expected the stored request to be the winning decision with the next sequence, got %+v and %+v", stored, winner)
+	}
+
+	var entries []types.OutboxEntry
+	cur, err := outbox.Find(context.Background(), bson.M{"requestId": id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cur.All(context.Background(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected one outbox entry, got %d", len(entries))
+	}
+	task, _, err := types.DecodeRequestMessage(entries[0].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Status != winner.Status || task.Admin != winner.Admin || entries[0].Sequence != stored.Sequence {
+		t.Errorf("Expected the task of the winning decision, got %+v", task)
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// approvalQuorum is the number of ops who must agree to approve or deny a request
+func approvalQuorum() int {
+	if n := viper.GetInt("approvalQuorum"); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// banQuorum is the number of ops who must agree to ban a player. Defaults to approvalQuorum
+func banQuorum() int {
+	if !viper.IsSet("banQuorum") {
+		return approvalQuorum()
+	}
+	if n := viper.GetInt("banQuorum"); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// quorum is the number of matching votes of ops needed to decide on a request. Other changes are
+// applied right away
+func quorum(decision interface{}) int {
+	switch decision {
+	case types.StatusApproved, types.StatusDenied:
+		return approvalQuorum()
+	case types.StatusBanned:
+		return banQuorum()
+	}
+	return 1
+}
+
+// voteOutcome is the status the votes decide the request on, empty until the quorum of matching votes is
+// reached. Conflicting votes dispute the request
+func voteOutcome(votes []types.Vote) string {
+	if len(votes) == 0 {
+		return ""
+	}
+	decision := votes[0].Decision
+	for _, vote := range votes[1:] {
+		if vote.Decision != decision {
+			return types.StatusDisputed
+		}
+	}
+	if len(votes) >= quorum(decision) {
+		return decision
+	}
+	return ""
+}
+
+// decideRequest applies the decision of an op on a pending request. Decisions needing the approval of more
+// than one op are recorded as votes until the quorum is reached. Returns http.StatusAccepted if the vote
+// has been recorded without deciding on the request
+func (svc *Service) decideRequest(request types.WhitelistRequest, reqBody []byte, op string) (types.WhitelistRequest, int, error) {
+	requestedChange, statusCode, err := svc.requestChange(reqBody, op)
+	if err != nil {
+		return types.WhitelistRequest{}, statusCode, err
+	}
+	if quorum(requestedChange["status"]) <= 1 {
+		// Ops only act on pending requests, e.g not on requests withdrawn in the meantime
+		decidedRequest, statusCode, err := svc.applyRequestChange(request.ID.Hex(), requestedChange, op, types.StatusPending)
+		if statusCode == http.StatusConflict {
+			err = svc.withdrawnError(request.ID.Hex(), err)
+		}
+		return decidedRequest, statusCode, err
+	}
+	decision, _ := requestedChange["status"].(string)
+	votedRequest, err := svc.dbService.AddVote(request.ID, types.Vote{
+		Op:        op,
+		Decision:  decision,
+		Timestamp: time.Now(),
+	})
+	if err == mongo.ErrNoDocuments {
+		return types.WhitelistRequest{}, http.StatusConflict, svc.withdrawnError(request.ID.Hex(),
+			errors.New("Request is already fulfilled or you have already voted on it"))
+	} else if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+			"ID":  request.ID.Hex(),
+		}).Error("Unable to record vote")
+		return types.WhitelistRequest{}, http.StatusInternalServerError, errors.New("Unable to record vote")
+	}
+	svc.audit(voteAuditEntry(op, votedRequest, decision))
+	switch voteOutcome(votedRequest.Votes) {
+	case "":
+		return votedRequest, http.StatusAccepted, nil
+	case types.StatusDisputed:
+		return svc.disputeRequest(votedRequest, op)
+	}
+	// The op completing the quorum decides with their change, e.g their decision reason
+	decidedRequest, statusCode, err := svc.applyRequestChange(request.ID.Hex(), requestedChange, op, types.StatusPending)
+	if statusCode == http.StatusConflict {
+		if svc.withdrawnError(request.ID.Hex(), err) == errRequestWithdrawn {
+			return types.WhitelistRequest{}, http.StatusConflict, errRequestWithdrawn
+		}
+		// Decided by a concurrent vote
+		return votedRequest, http.StatusAccepted, nil
+	}
+	return decidedRequest, statusCode, err
+}
+
+// disputeRequest marks the pending request ops voted differently on as disputed and publishes it so the
+// worker notifies all ops. The owner decides on disputed requests from the dashboard
+func (svc *Service) disputeRequest(request types.WhitelistRequest, op string) (types.WhitelistRequest, int, error) {
+	disputedRequest, err := svc.writeAndPublish(func(writer db.RequestWriter) (types.WhitelistRequest, error) {
+		disputedRequest, err := writer.TransitionStatus(request.ID, types.StatusPending, types.StatusDisputed, bson.M{
+			"$set": bson.M{"lastUpdatedTimestamp": time.Now()},
+		})
+		disputedRequest.PreviousStatus = types.StatusPending
+		return disputedRequest, err
+	})
+	if err == db.ErrConflict {
+		// Disputed or decided by a concurrent vote
+		return request, http.StatusAccepted, nil
+	} else if err == errTaskNotPublished {
+		return types.WhitelistRequest{}, http.StatusInternalServerError, errors.New("Unable to record vote")
+	} else if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+			"ID":  request.ID.Hex(),
+		}).Error("Unable to dispute request")
+		return types.WhitelistRequest{}, http.StatusInternalServerError, errors.New("Unable to record vote")
+	}
+	svc.audit(requestAuditEntry("request.dispute", op, disputedRequest, nil))
+	return disputedRequest, http.StatusAccepted, nil
+}
+
+func voteAuditEntry(op string, request types.WhitelistRequest, decision string) types.AuditEntry {
+	entry := requestAuditEntry("request.vote", op, request, nil)
+	entry.Details["decision"] = decision
+	entry.Details["votes"] = len(request.Votes)
+	return entry
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/worker"
+)
+
+// waitlistPosition returns the position of the waitlisted request on the waitlist of its tenant, 1 being promoted
+// next. 0 if the request is not waitlisted or the position is unknown
+func (svc *Service) waitlistPosition(request types.WhitelistRequest) int {
+	if request.Status != types.StatusWaitlisted {
+		return 0
+	}
+	ahead, err := svc.store.QueryRequests(worker.WaitlistedBefore(request))
+	if err != nil {
+		// Best effort only. The status page is shown without the position
+		svc.logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"ID":    request.ID.Hex(),
+		}).Warning("Unable to read the position on the waitlist")
+		return 0
+	}
+	return len(ahead)
+}
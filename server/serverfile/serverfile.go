@@ -0,0 +1,285 @@
+// Package serverfile carries out whitelist decisions by editing the whitelist.json and banned-players.json files
+// of a vanilla game server running on the same host, for servers which do not enable RCON.
+//
+// Each change takes an exclusive flock on the file, reads it, adds or removes the entry of the player and
+// replaces the file atomically by renaming a temporary file over it. Files not existing yet are created. Fields
+// of existing entries this package does not know about are kept. The game server only reads the files on startup
+// and on "whitelist reload", so the reload command is run after every action if configured. It is run even if
+// the file was already up to date, so an action retried after a failed reload reloads again
+package serverfile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// Files of the game server directory
+const (
+	WhitelistFile     = "whitelist.json"
+	BannedPlayersFile = "banned-players.json"
+)
+
+// Source and reason of the bans written to banned-players.json
+const (
+	banSource     = "mc-gatekeeper"
+	defaultReason = "Banned by an operator."
+)
+
+// Time the reload command has to finish
+const reloadTimeout = 30 * time.Second
+
+// ErrBedrockPlayer is returned for Bedrock players without UUID. They have no Mojang account to resolve it with
+var ErrBedrockPlayer = errors.New("Bedrock players can not be added to the files of the game server without their Floodgate UUID")
+
+// entry is an entry of whitelist.json or banned-players.json. Values are kept as they are read
+type entry map[string]json.RawMessage
+
+func (e entry) field(name string) string {
+	var value string
+	json.Unmarshal(e[name], &value)
+	return value
+}
+
+// matches tells if the entry is the one of the player, by UUID or by name ignoring case
+func (e entry) matches(uuid, name string) bool {
+	if uuid != "" && strings.EqualFold(e.field("uuid"), uuid) {
+		return true
+	}
+	return strings.EqualFold(e.field("name"), name)
+}
+
+// Backend edits the files of the game server in Dir
+type Backend struct {
+	Dir string
+	// Command run after every action so the game server reads the files again, e.g sending "whitelist reload" to
+	// its console. Nothing is run if empty
+	ReloadCommand []string
+	// Resolves the UUID of players the member directory did not resolve yet. Defaults to the Mojang API
+	ResolveUUID func(username string) (string, error)
+	now         func() time.Time
+}
+
+// NewBackend creates a backend editing the files of the game server in dir. The reload command is split on
+// whitespace and run without a shell
+func NewBackend(dir, reloadCommand string) *Backend {
+	return &Backend{Dir: dir, ReloadCommand: strings.Fields(reloadCommand), ResolveUUID: mojangUUID, now: time.Now}
+}
+
+// Whitelist adds the player to whitelist.json
+func (b *Backend) Whitelist(request types.WhitelistRequest) error {
+	uuid, err := b.uuid(request)
+	if err != nil {
+		return err
+	}
+	return b.apply(WhitelistFile, func(entries []entry) ([]entry, bool) {
+		return add(entries, uuid, request.Username, map[string]interface{}{"uuid": uuid, "name": request.Username})
+	})
+}
+
+// Unwhitelist removes the player from whitelist.json
+func (b *Backend) Unwhitelist(request types.WhitelistRequest) error {
+	return b.apply(WhitelistFile, func(entries []entry) ([]entry, bool) {
+		return remove(entries, dashed(request.UUID), request.Username)
+	})
+}
+
+// Ban adds the player to banned-players.json. The player is not kicked, the ban applies once the game server
+// reads the file again
+func (b *Backend) Ban(request types.WhitelistRequest) error {
+	uuid, err := b.uuid(request)
+	if err != nil {
+		return err
+	}
+	reason := request.DecisionReason
+	if reason == "" {
+		reason = defaultReason
+	}
+	return b.apply(BannedPlayersFile, func(entries []entry) ([]entry, bool) {
+		return add(entries, uuid, request.Username, map[string]interface{}{
+			"uuid":    uuid,
+			"name":    request.Username,
+			"created": b.now().Format("2006-01-02 15:04:05 -0700"),
+			"source":  banSource,
+			"expires": "forever",
+			"reason":  reason,
+		})
+	})
+}
+
+// Pardon removes the player from banned-players.json
+func (b *Backend) Pardon(request types.WhitelistRequest) error {
+	return b.apply(BannedPlayersFile, func(entries []entry) ([]entry, bool) {
+		return remove(entries, dashed(request.UUID), request.Username)
+	})
+}
+
+// uuid returns the dashed UUID of the player, which the game server requires in its files
+func (b *Backend) uuid(request types.WhitelistRequest) (string, error) {
+	if request.UUID != "" {
+		return dashed(request.UUID), nil
+	}
+	if request.Platform == utils.PlatformBedrock {
+		return "", ErrBedrockPlayer
+	}
+	uuid, err := b.ResolveUUID(request.Username)
+	if err != nil {
+		return "", fmt.Errorf("Unable to resolve the UUID of %s: %s", request.Username, err.Error())
+	}
+	return dashed(uuid), nil
+}
+
+// add appends the entry of the player unless the file already has one
+func add(entries []entry, uuid, name string, fields map[string]interface{}) ([]entry, bool) {
+	for _, e := range entries {
+		if e.matches(uuid, name) {
+			return entries, false
+		}
+	}
+	added := make(entry)
+	for k, v := range fields {
+		added[k], _ = json.Marshal(v)
+	}
+	return append(entries, added), true
+}
+
+// remove drops the entries of the player
+func remove(entries []entry, uuid, name string) ([]entry, bool) {
+	kept := make([]entry, 0, len(entries))
+	for _, e := range entries {
+		if !e.matches(uuid, name) {
+			kept = append(kept, e)
+		}
+	}
+	return kept, len(kept) != len(entries)
+}
+
+// apply changes the entries of the file while holding an exclusive lock on it, then runs the reload command
+func (b *Backend) apply(name string, change func([]entry) ([]entry, bool)) error {
+	path := filepath.Join(b.Dir, name)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("Unable to lock %s: %s", path, err.Error())
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	entries := []entry{}
+	if strings.TrimSpace(string(data)) != "" {
+		err = json.Unmarshal(data, &entries)
+		if err != nil {
+			return fmt.Errorf("Unable to read %s: %s", path, err.Error())
+		}
+	}
+	entries, changed := change(entries)
+	// A file created by the lock is written so the game server does not read an empty file
+	if changed || len(data) == 0 {
+		err = writeAtomically(path, entries)
+		if err != nil {
+			return err
+		}
+	}
+	return b.reload()
+}
+
+// writeAtomically writes the entries to a temporary file renamed over the file, so the game server never reads
+// a partly written file
+func writeAtomically(path string, entries []entry) error {
+	encoded, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(encoded, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil {
+		os.Chmod(tmp.Name(), info.Mode())
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (b *Backend) reload() error {
+	if len(b.ReloadCommand) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, b.ReloadCommand[0], b.ReloadCommand[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Reload command failed: %s: %s", err.Error(), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// dashed formats the UUID the way the game server writes it, e.g 8667ba71-b85a-4004-af54-457a9734eed7
+func dashed(uuid string) string {
+	plain := strings.ToLower(strings.Replace(uuid, "-", "", -1))
+	if len(plain) != 32 {
+		return uuid
+	}
+	return plain[:8] + "-" + plain[8:12] + "-" + plain[12:16] + "-" + plain[16:20] + "-" + plain[20:]
+}
+
+// mojangUUID looks up the UUID of the player with the Mojang API
+func mojangUUID(username string) (string, error) {
+	u := url.URL{
+		Scheme: "https",
+		Host:   "api.mojang.com",
+		Path:   "users/profiles/minecraft/" + username,
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	// Add user-agent to prevent cloudfront 403 response
+	req.Header.Set("User-Agent", "minecraft")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+	var profile struct {
+		ID string `json:"id"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&profile)
+	if err != nil {
+		return "", err
+	}
+	return profile.ID, nil
+}
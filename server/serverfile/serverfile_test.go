@@ -0,0 +1,138 @@
+package serverfile
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+func newTestBackend(t *testing.T) (*Backend, string) {
+	dir, err := ioutil.TempDir("", "serverfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := NewBackend(dir, "touch "+filepath.Join(dir, "reloaded"))
+	backend.ResolveUUID = func(username string) (string, error) {
+		if username == "Herobrine" {
+			return "", errors.New("status code: 404")
+		}
+		return "853c80ef3c3749fdaa49938b674adae6", nil
+	}
+	backend.now = func() time.Time { return time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC) }
+	return backend, dir
+}
+
+func readEntries(t *testing.T, path string) []map[string]interface{} {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("expected a valid file, got %s: %v", data, err)
+	}
+	return entries
+}
+
+func TestWhitelist(t *testing.T) {
+	backend, dir := newTestBackend(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, WhitelistFile)
+	// The file of the game server has fields this backend does not know about
+	ioutil.WriteFile(path, []byte(`[{"uuid": "069a79f4-44e9-4726-a5be-fca90e38aaf5", "name": "Notch", "note": "owner"}]`), 0600)
+
+	steve := types.WhitelistRequest{Username: "Steve", UUID: "8667ba71b85a4004af54457a9734eed7"}
+	for i := 0; i < 2; i++ {
+		if err := backend.Whitelist(steve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := readEntries(t, path)
+	if len(entries) != 2 || entries[0]["note"] != "owner" {
+		t.Fatalf("expected Steve to be added once and the other entries kept, got %v", entries)
+	}
+	if entries[1]["uuid"] != "8667ba71-b85a-4004-af54-457a9734eed7" || entries[1]["name"] != "Steve" {
+		t.Errorf("expected the entry of Steve with the dashed UUID, got %v", entries[1])
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("expected the mode of the file to be kept, got %v", info.Mode())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "reloaded")); err != nil {
+		t.Errorf("expected the reload command to be run, got %v", err)
+	}
+
+	// The UUID of players the member directory did not resolve yet is looked up
+	if err := backend.Whitelist(types.WhitelistRequest{Username: "Alex"}); err != nil {
+		t.Fatal(err)
+	}
+	if entries := readEntries(t, path); len(entries) != 3 || entries[2]["uuid"] != "853c80ef-3c37-49fd-aa49-938b674adae6" {
+		t.Errorf("expected the entry of Alex with the resolved UUID, got %v", entries)
+	}
+	err := backend.Whitelist(types.WhitelistRequest{Username: "Herobrine"})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected the failed lookup in the error, got %v", err)
+	}
+
+	// Players are removed by name, ignoring case, if their UUID is not known
+	if err := backend.Unwhitelist(types.WhitelistRequest{Username: "steve"}); err != nil {
+		t.Fatal(err)
+	}
+	if entries := readEntries(t, path); len(entries) != 2 || entries[0]["name"] != "Notch" || entries[1]["name"] != "Alex" {
+		t.Errorf("expected Steve to be removed, got %v", entries)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, ".*")); len(leftovers) != 0 {
+		t.Errorf("expected no temporary file to be left, got %v", leftovers)
+	}
+}
+
+func TestBan(t *testing.T) {
+	backend, dir := newTestBackend(t)
+	defer os.RemoveAll(dir)
+	backend.ReloadCommand = nil
+	path := filepath.Join(dir, BannedPlayersFile)
+
+	// The file does not exist until the first ban
+	griefer := types.WhitelistRequest{Username: "Griefer", UUID: "8667ba71b85a4004af54457a9734eed7", DecisionReason: "Griefing"}
+	if err := backend.Ban(griefer); err != nil {
+		t.Fatal(err)
+	}
+	entries := readEntries(t, path)
+	if len(entries) != 1 || entries[0]["reason"] != "Griefing" || entries[0]["expires"] != "forever" ||
+		entries[0]["created"] != "2020-05-01 12:00:00 +0000" || entries[0]["source"] != banSource {
+		t.Fatalf("expected the ban of the player, got %v", entries)
+	}
+	if err := backend.Pardon(griefer); err != nil {
+		t.Fatal(err)
+	}
+	if entries := readEntries(t, path); len(entries) != 0 {
+		t.Errorf("expected the player to be pardoned, got %v", entries)
+	}
+	// Pardoning a player who is not banned succeeds, so failed actions can be retried
+	if err := backend.Pardon(griefer); err != nil {
+		t.Error(err)
+	}
+	// Removing a player from a file which does not exist yet leaves a valid empty file
+	if err := backend.Unwhitelist(griefer); err != nil {
+		t.Fatal(err)
+	}
+	if entries := readEntries(t, filepath.Join(dir, WhitelistFile)); len(entries) != 0 {
+		t.Errorf("expected an empty whitelist, got %v", entries)
+	}
+}
+
+func TestReloadFailure(t *testing.T) {
+	backend, dir := newTestBackend(t)
+	defer os.RemoveAll(dir)
+	backend.ReloadCommand = []string{"false"}
+	err := backend.Whitelist(types.WhitelistRequest{Username: "Steve", UUID: "8667ba71b85a4004af54457a9734eed7"})
+	if err == nil || !strings.Contains(err.Error(), "Reload command failed") {
+		t.Errorf("expected the failed reload to fail the action so it is retried, got %v", err)
+	}
+}
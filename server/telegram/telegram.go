@@ -0,0 +1,77 @@
+// Package telegram sends messages to a Telegram chat through the Bot API, e.g to confirm bans to the ops right
+// away while griefing is going on.
+//
+// Messages are sent with the sendMessage method of the bot:
+//
+//	POST https://api.telegram.org/bot<telegramBotToken>/sendMessage
+//	{"chat_id": "<telegramChatID>", "text": "...", "disable_web_page_preview": true}
+package telegram
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultAPIURL is the Bot API messages are sent to
+const DefaultAPIURL = "https://api.telegram.org"
+
+// Maximum size of the Bot API response included in errors
+const maxResponseBody = 1024
+
+// Message is the body posted to the sendMessage method
+type Message struct {
+	ChatID                string `json:"chat_id"`
+	Text                  string `json:"text"`
+	DisableWebPagePreview bool   `json:"disable_web_page_preview"`
+}
+
+// Client sends messages to a chat as a bot
+type Client struct {
+	apiURL string
+	token  string
+	chatID string
+	client *http.Client
+}
+
+// NewClient creates a client sending messages to the chat as the bot with the token. DefaultAPIURL is used if
+// apiURL is empty and a client with a 5 seconds timeout is used if nil, so an unreachable Bot API never holds
+// up the caller for long
+func NewClient(apiURL, token, chatID string, client *http.Client) *Client {
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	return &Client{apiURL: strings.TrimRight(apiURL, "/"), token: token, chatID: chatID, client: client}
+}
+
+// Send sends the text to the chat. An error is returned if the request could not be made or the Bot API did not
+// respond with a 2xx status. The token is left out of errors
+func (c *Client) Send(text string) error {
+	body, err := json.Marshal(Message{ChatID: c.chatID, Text: text, DisableWebPagePreview: true})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.apiURL+"/bot"+c.token+"/sendMessage", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to create Telegram request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to reach the Telegram Bot API: %s", strings.Replace(err.Error(), c.token, "***", -1))
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Telegram Bot API responded with %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package telegram
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientSendsMessages(t *testing.T) {
+	var received []Message
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message Message
+		json.NewDecoder(r.Body).Decode(&message)
+		received = append(received, message)
+		paths = append(paths, r.URL.Path)
+		if message.ChatID == "unknown" {
+			http.Error(w, `{"ok":false,"description":"Bad Request: chat not found"}`, http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	if err := NewClient(ts.URL+"/", "123:abc", "-1001", nil).Send("Steve was banned"); err != nil {
+		t.Fatal(err)
+	}
+	if received[0] != (Message{ChatID: "-1001", Text: "Steve was banned", DisableWebPagePreview: true}) {
+		t.Errorf("expected the message to the chat, got %+v", received[0])
+	}
+	if paths[0] != "/bot123:abc/sendMessage" {
+		t.Errorf("expected the sendMessage method of the bot, got %s", paths[0])
+	}
+
+	err := NewClient(ts.URL, "123:abc", "unknown", nil).Send("Steve was banned")
+	if err == nil || !strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "chat not found") {
+		t.Errorf("expected the response of the Bot API in the error, got %v", err)
+	}
+}
+
+func TestClientUnreachableHidesToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close()
+	err := NewClient(ts.URL, "123:secret", "-1001", nil).Send("Steve was banned")
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected an error without the bot token, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package tenant
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/config"
+)
+
+// ErrUnknownTenant is returned for server IDs not configured in the tenants section
+var ErrUnknownTenant = errors.New("Unknown server ID")
+
+// Server IDs are used in config keys and cache keys so they are restricted to a safe alphabet
+var serverIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Config reads the settings of a community served by the deployment. The settings of a tenant are nested
+// under its server ID in the tenants section, e.g
+//
+//	tenants:
+//	  survival:
+//	    RCONServer: survival.example.com
+//	    ops:
+//	      - op@example.com
+//	    approvedEmailTitle: Welcome to Survival
+//
+// Settings not overridden by the tenant fall back to the top level settings, which are also the settings
+// of the default tenant with an empty server ID. Reloadable settings are read from the last reload, see config.Get
+type Config struct {
+	ID string
+}
+
+// Default is the tenant configured by the top level settings
+var Default = Config{}
+
+// Normalize returns the server ID as used in the config. Viper lowercases config keys
+func Normalize(serverID string) string {
+	return strings.ToLower(strings.TrimSpace(serverID))
+}
+
+// IDs returns the sorted server IDs of the configured tenants, without the default tenant
+func IDs() []string {
+	ids := []string{}
+	for id := range viper.GetStringMap("tenants") {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// All returns the default tenant followed by the configured tenants
+func All() []Config {
+	tenants := []Config{Default}
+	for _, id := range IDs() {
+		tenants = append(tenants, Config{ID: id})
+	}
+	return tenants
+}
+
+// Known tells if the server ID is the default tenant or a configured tenant
+func Known(serverID string) bool {
+	if serverID == "" {
+		return true
+	}
+	return serverID == Normalize(serverID) && viper.IsSet("tenants."+serverID)
+}
+
+// Get returns the config of the tenant with the server ID, or ErrUnknownTenant
+func Get(serverID string) (Config, error) {
+	if !Known(serverID) {
+		return Config{}, ErrUnknownTenant
+	}
+	return Config{ID: serverID}, nil
+}
+
+// Validate checks the server IDs of the configured tenants
+func Validate() error {
+	for _, id := range IDs() {
+		if !serverIDPattern.MatchString(id) {
+			return fmt.Errorf("tenants.%s: server IDs may only contain lowercase letters, digits, - and _", id)
+		}
+	}
+	return nil
+}
+
+func (c Config) key(key string) string {
+	return "tenants." + c.ID + "." + key
+}
+
+// Overrides tells if the tenant sets the setting itself
+func (c Config) Overrides(key string) bool {
+	return c.ID != "" && config.IsSet(c.key(key))
+}
+
+// IsSet tells if the setting is set for the tenant or at the top level
+func (c Config) IsSet(key string) bool {
+	return c.Overrides(key) || config.IsSet(key)
+}
+
+// Get returns the setting of the tenant, or the top level setting if the tenant does not override it
+func (c Config) Get(key string) interface{} {
+	if c.Overrides(key) {
+		return config.Get(c.key(key))
+	}
+	return config.Get(key)
+}
+
+// GetString returns the setting of the tenant as a string
+func (c Config) GetString(key string) string {
+	if c.Overrides(key) {
+		return config.GetString(c.key(key))
+	}
+	return config.GetString(key)
+}
+
+// GetInt returns the setting of the tenant as an int
+func (c Config) GetInt(key string) int {
+	if c.Overrides(key) {
+		return config.GetInt(c.key(key))
+	}
+	return config.GetInt(key)
+}
+
+// GetBool returns the setting of the tenant as a bool
+func (c Config) GetBool(key string) bool {
+	if c.Overrides(key) {
+		return config.GetBool(c.key(key))
+	}
+	return config.GetBool(key)
+}
+
+// GetStringSlice returns the setting of the tenant as a string slice
+func (c Config) GetStringSlice(key string) []string {
+	if c.Overrides(key) {
+		return config.GetStringSlice(c.key(key))
+	}
+	return config.GetStringSlice(key)
+}
+
+// UnmarshalKey decodes the setting of the tenant into rawVal
+func (c Config) UnmarshalKey(key string, rawVal interface{}) error {
+	if c.Overrides(key) {
+		return config.UnmarshalKey(c.key(key), rawVal)
+	}
+	return config.UnmarshalKey(key, rawVal)
+}
+
+// FrontendURL is the address of the frontend links in emails point to, see links.Builder. The top level
+// frontendURL may be set with FRONTEND_DEPLOYED_URL
+func (c Config) FrontendURL() string {
+	return c.GetString("frontendURL")
+}
+
+// Key namespaces the cache key by the tenant. The keys of the default tenant are left as they are so
+// deployments serving one community keep their cache
+func (c Config) Key(key string) string {
+	if c.ID == "" {
+		return key
+	}
+	return key + ":" + c.ID
+}
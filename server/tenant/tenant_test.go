@@ -0,0 +1,103 @@
+package tenant
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func setTenants() {
+	viper.Set("approvedEmailTitle", "Welcome")
+	viper.Set("tenants", map[string]interface{}{
+		"survival": map[string]interface{}{
+			"RCONServer":         "survival.example.com",
+			"approvedEmailTitle": "Welcome to Survival",
+			"frontendURL":        "https://survival.example.com",
+		},
+		"creative": map[string]interface{}{},
+	})
+}
+
+func resetTenants() {
+	viper.Set("approvedEmailTitle", nil)
+	viper.Set("tenants", nil)
+}
+
+func TestTenantSettingsFallBackToTopLevel(t *testing.T) {
+	setTenants()
+	defer resetTenants()
+	survival, err := Get("survival")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title := survival.GetString("approvedEmailTitle"); title != "Welcome to Survival" {
+		t.Errorf("Expected the title of the tenant, got %q", title)
+	}
+	if !survival.Overrides("RCONServer") {
+		t.Error("Expected the tenant to have its own game server")
+	}
+	creative, _ := Get("creative")
+	if title := creative.GetString("approvedEmailTitle"); title != "Welcome" {
+		t.Errorf("Expected the top level title, got %q", title)
+	}
+	if creative.Overrides("RCONServer") || Default.Overrides("RCONServer") {
+		t.Error("Expected no game server of their own")
+	}
+	if title := Default.GetString("approvedEmailTitle"); title != "Welcome" {
+		t.Errorf("Expected the default tenant to use the top level title, got %q", title)
+	}
+}
+
+func TestKnownTenants(t *testing.T) {
+	setTenants()
+	defer resetTenants()
+	if ids := IDs(); !reflect.DeepEqual(ids, []string{"creative", "survival"}) {
+		t.Errorf("Expected sorted server IDs, got %v", ids)
+	}
+	if all := All(); len(all) != 3 || all[0] != Default {
+		t.Errorf("Expected the default tenant first, got %v", all)
+	}
+	for serverID, known := range map[string]bool{"": true, "survival": true, "Survival": false, "skyblock": false} {
+		if Known(serverID) != known {
+			t.Errorf("Known(%q) = %v, want %v", serverID, !known, known)
+		}
+	}
+	if _, err := Get("skyblock"); err != ErrUnknownTenant {
+		t.Errorf("Expected unknown tenant, got %v", err)
+	}
+	if Normalize(" Survival ") != "survival" {
+		t.Error("Expected server IDs to be normalized to the config keys")
+	}
+}
+
+func TestValidateTenants(t *testing.T) {
+	defer resetTenants()
+	viper.Set("tenants", map[string]interface{}{"sky.block": map[string]interface{}{}})
+	if err := Validate(); err == nil {
+		t.Error("Expected server ID with a dot to be rejected")
+	}
+	setTenants()
+	if err := Validate(); err != nil {
+		t.Errorf("Expected valid server IDs, got %v", err)
+	}
+}
+
+func TestFrontendURLAndKeys(t *testing.T) {
+	setTenants()
+	defer resetTenants()
+	viper.Set("frontendURL", "https://whitelist.example.com/")
+	defer viper.Set("frontendURL", nil)
+	if url := (Config{ID: "survival"}).FrontendURL(); url != "https://survival.example.com" {
+		t.Errorf("Expected the frontend of the tenant, got %q", url)
+	}
+	if url := (Config{ID: "creative"}).FrontendURL(); url != "https://whitelist.example.com/" {
+		t.Errorf("Expected the deployed frontend, got %q", url)
+	}
+	if key := Default.Key("Stats"); key != "Stats" {
+		t.Errorf("Expected the keys of the default tenant to be kept, got %q", key)
+	}
+	if key := (Config{ID: "survival"}).Key("Stats"); key != "Stats:survival" {
+		t.Errorf("Expected the key to be namespaced, got %q", key)
+	}
+}
@@ -0,0 +1,222 @@
+package topology
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+const (
+	defaultTaskQueue              = "whitelist.request.queue"
+	defaultHighPriorityTaskQueue  = "whitelist.request.high.queue"
+	defaultRetryExchange          = "retry.ex"
+	defaultRetryQueue             = "retry.queue"
+	defaultHighPriorityRetryQueue = "retry.high.queue"
+	defaultDeadLetterExchange     = "dead.letter.ex"
+	defaultDeadLetterQueue        = "dead.letter.queue"
+	// Messages not consumed within 24 hours are dead-lettered
+	taskMessageTTL = int32(8.64e+7)
+)
+
+// Names of the exchanges and queues the application relies on
+type Names struct {
+	// TaskQueue is consumed by the worker. It is published to through the default exchange
+	TaskQueue string
+	// HighPriorityTaskQueue is consumed by the worker ahead of TaskQueue. Tasks marked with types.PriorityHeader,
+	// e.g bans, are published to it through the default exchange
+	HighPriorityTaskQueue string
+	// RetryExchange routes messages to be retried to RetryQueue
+	RetryExchange string
+	// RetryQueue holds messages until their per-message expiration elapses and then
+	// dead-letters them back to TaskQueue
+	RetryQueue string
+	// HighPriorityRetryQueue holds high priority messages to be retried and dead-letters them back to
+	// HighPriorityTaskQueue. It is published to through the default exchange
+	HighPriorityRetryQueue string
+	// DeadLetterExchange receives messages rejected from TaskQueue, e.g once max retries is reached
+	DeadLetterExchange string
+	// DeadLetterQueue is the parking lot of dead-lettered messages kept for later investigation
+	DeadLetterQueue string
+}
+
+// Prefix is prepended to every name so multiple deployments, e.g staging and production, can share a broker
+// without consuming each other's messages. It is queuePrefix, or topologyPrefix as it used to be named
+func Prefix() string {
+	if viper.IsSet("queuePrefix") {
+		return viper.GetString("queuePrefix")
+	}
+	return viper.GetString("topologyPrefix")
+}
+
+// Validate checks the prefix is not configured twice with different values, so the worker and the producers
+// can not resolve different names
+func Validate() error {
+	if viper.IsSet("queuePrefix") && viper.GetString("topologyPrefix") != "" && viper.GetString("queuePrefix") != viper.GetString("topologyPrefix") {
+		return fmt.Errorf("queuePrefix %q and topologyPrefix %q differ, only set queuePrefix", viper.GetString("queuePrefix"), viper.GetString("topologyPrefix"))
+	}
+	return nil
+}
+
+// FromConfig returns the names configured, falling back to the defaults, with the Prefix. Every exchange and
+// queue is declared, consumed and published to by these names, so the worker and the producers agree on them
+func FromConfig() Names {
+	prefix := Prefix()
+	name := func(key, fallback string) string {
+		if value := viper.GetString(key); value != "" {
+			return prefix + value
+		}
+		return prefix + fallback
+	}
+	return Names{
+		TaskQueue:              name("taskQueueName", defaultTaskQueue),
+		HighPriorityTaskQueue:  name("highPriorityTaskQueueName", defaultHighPriorityTaskQueue),
+		RetryExchange:          name("retryExchangeName", defaultRetryExchange),
+		RetryQueue:             name("retryQueueName", defaultRetryQueue),
+		HighPriorityRetryQueue: name("highPriorityRetryQueueName", defaultHighPriorityRetryQueue),
+		DeadLetterExchange:     name("deadLetterExchangeName", defaultDeadLetterExchange),
+		DeadLetterQueue:        name("deadLetterQueueName", defaultDeadLetterQueue),
+	}
+}
+
+// Fields lists the names by role, e.g to log the resolved topology on startup
+func (names Names) Fields() map[string]interface{} {
+	return map[string]interface{}{
+		"taskQueue":              names.TaskQueue,
+		"highPriorityTaskQueue":  names.HighPriorityTaskQueue,
+		"retryExchange":          names.RetryExchange,
+		"retryQueue":             names.RetryQueue,
+		"highPriorityRetryQueue": names.HighPriorityRetryQueue,
+		"deadLetterExchange":     names.DeadLetterExchange,
+		"deadLetterQueue":        names.DeadLetterQueue,
+	}
+}
+
+// Queues returns the queues of the topology
+func (names Names) Queues() []string {
+	return []string{names.HighPriorityTaskQueue, names.TaskQueue, names.HighPriorityRetryQueue, names.RetryQueue, names.DeadLetterQueue}
+}
+
+// TaskQueueOf returns the task queue a message with the headers is published to
+func (names Names) TaskQueueOf(headers amqp.Table) string {
+	if priority, _ := headers[types.PriorityHeader].(string); priority == types.PriorityHigh {
+		return names.HighPriorityTaskQueue
+	}
+	return names.TaskQueue
+}
+
+// RetryRouteOf returns the exchange and routing key a message with the headers is published with to be retried.
+// High priority retries wait in their own queue, so they come back to the high priority task queue
+func (names Names) RetryRouteOf(headers amqp.Table) (string, string) {
+	if priority, _ := headers[types.PriorityHeader].(string); priority == types.PriorityHigh {
+		return "", names.HighPriorityRetryQueue
+	}
+	return names.RetryExchange, ""
+}
+
+// Declare declares every exchange, queue and binding of the topology on the channel.
+// Declarations are idempotent so it is safe to call on every connection. Arguments must
+// stay the same across versions as redeclaring a queue with different ones closes the channel
+func Declare(ch *amqp.Channel, names Names) error {
+	for _, exchange := range []string{names.DeadLetterExchange, names.RetryExchange} {
+		err := ch.ExchangeDeclare(
+			exchange, // name
+			"fanout", // type
+			true,     // durable
+			false,    // auto-deleted
+			false,    // internal
+			false,    // no-wait
+			nil,      // arguments
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := ch.QueueDeclare(
+		names.DeadLetterQueue, // name
+		true,                  // durable
+		false,                 // delete when unused
+		false,                 // exclusive
+		false,                 // no-wait
+		nil,                   // arguments
+	)
+	if err != nil {
+		return err
+	}
+	err = ch.QueueBind(
+		names.DeadLetterQueue,    // queue name
+		"",                       // routing key
+		names.DeadLetterExchange, // exchange
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	// A separate high priority queue rather than x-max-priority, as the arguments of the existing task queue
+	// can not change
+	for _, queue := range []string{names.TaskQueue, names.HighPriorityTaskQueue} {
+		args := make(amqp.Table)
+		args["x-dead-letter-exchange"] = names.DeadLetterExchange
+		args["x-message-ttl"] = taskMessageTTL
+		_, err = ch.QueueDeclare(
+			queue, // name
+			true,  // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			args,  // arguments
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Expired retries go back to their task queue through the default exchange
+	retryQueues := map[string]string{
+		names.RetryQueue:             names.TaskQueue,
+		names.HighPriorityRetryQueue: names.HighPriorityTaskQueue,
+	}
+	for retryQueue, taskQueue := range retryQueues {
+		args := make(amqp.Table)
+		args["x-dead-letter-exchange"] = ""
+		args["x-dead-letter-routing-key"] = taskQueue
+		_, err = ch.QueueDeclare(
+			retryQueue, // name
+			true,       // durable
+			false,      // delete when unused
+			false,      // exclusive
+			false,      // no-wait
+			args,       // arguments
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return ch.QueueBind(
+		names.RetryQueue,    // queue name
+		"",                  // routing key
+		names.RetryExchange, // exchange
+		false,
+		nil,
+	)
+}
+
+// DeclareFromConfig dials the configured message queue and declares the configured topology
+func DeclareFromConfig() (Names, error) {
+	names := FromConfig()
+	conn, err := amqp.Dial(viper.GetString("rabbitMQConn"))
+	if err != nil {
+		return names, err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return names, err
+	}
+	defer ch.Close()
+	return names, Declare(ch, names)
+}
@@ -0,0 +1,264 @@
+package topology_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/topology"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+var log = logrus.New()
+
+func TestMain(m *testing.M) {
+	// Mock the main application using the test configuration file
+	viper.SetConfigName("config_test")
+	viper.AddConfigPath("../")
+	viper.AutomaticEnv()
+	viper.SetConfigType("yml")
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Fatal("Error reading config file")
+	}
+	os.Exit(m.Run())
+}
+
+// declareTestTopology declares a topology under a unique prefix on a fresh channel.
+// The returned function removes it
+func declareTestTopology(t *testing.T) (*amqp.Channel, topology.Names, func()) {
+	return declareTopology(t, fmt.Sprintf("test.%d.", time.Now().UnixNano()), true)
+}
+
+// declareTopology declares the topology of the prefix on a fresh channel. The returned function removes it if
+// remove is set and closes the channel
+func declareTopology(t *testing.T, prefix string, remove bool) (*amqp.Channel, topology.Names, func()) {
+	viper.Set("queuePrefix", prefix)
+	defer viper.Set("queuePrefix", nil)
+	names := topology.FromConfig()
+
+	conn, err := amqp.Dial(viper.GetString("rabbitMQConn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		if !remove {
+			conn.Close()
+			return
+		}
+		for _, queue := range names.Queues() {
+			ch.QueueDelete(queue, false, false, false)
+		}
+		ch.ExchangeDelete(names.RetryExchange, false, false)
+		ch.ExchangeDelete(names.DeadLetterExchange, false, false)
+		conn.Close()
+	}
+	// Declaring twice must not fail on a broker where the topology already exists
+	for i := 0; i < 2; i++ {
+		err = topology.Declare(ch, names)
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	return ch, names, cleanup
+}
+
+// waitForMessage polls the queue until a message is available or the timeout elapses
+func waitForMessage(t *testing.T, ch *amqp.Channel, queue string, timeout time.Duration) amqp.Delivery {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		d, ok, err := ch.Get(queue, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			return d
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("No message received on %s within %s", queue, timeout)
+	return amqp.Delivery{}
+}
+
+func TestFromConfig(t *testing.T) {
+	viper.Set("queuePrefix", "staging.")
+	viper.Set("retryQueueName", "wait.queue")
+	defer viper.Set("queuePrefix", nil)
+	defer viper.Set("retryQueueName", "")
+
+	names := topology.FromConfig()
+	expected := topology.Names{
+		TaskQueue:              "staging." + viper.GetString("taskQueueName"),
+		HighPriorityTaskQueue:  "staging.whitelist.request.high.queue",
+		RetryExchange:          "staging.retry.ex",
+		RetryQueue:             "staging.wait.queue",
+		HighPriorityRetryQueue: "staging.retry.high.queue",
+		DeadLetterExchange:     "staging.dead.letter.ex",
+		DeadLetterQueue:        "staging.dead.letter.queue",
+	}
+	if names != expected {
+		t.Errorf("Expected %+v, got %+v", expected, names)
+	}
+	if names.Fields()["retryQueue"] != "staging.wait.queue" {
+		t.Errorf("Expected the resolved names to be logged, got %v", names.Fields())
+	}
+
+	// The prefix used to be named topologyPrefix
+	defer viper.Set("topologyPrefix", "")
+	viper.Set("queuePrefix", nil)
+	viper.Set("topologyPrefix", "staging.")
+	if legacy := topology.FromConfig(); legacy != expected {
+		t.Errorf("Expected topologyPrefix to be read without queuePrefix, got %+v", legacy)
+	}
+	if err := topology.Validate(); err != nil {
+		t.Error(err)
+	}
+	viper.Set("queuePrefix", "prod.")
+	if err := topology.Validate(); err == nil {
+		t.Error("Expected different queuePrefix and topologyPrefix to be rejected")
+	}
+}
+
+func TestPrefixedTopologyIsolated(t *testing.T) {
+	// The unprefixed topology of production is left declared, other deployments may be using it
+	prodCh, prod, closeProd := declareTopology(t, "", false)
+	defer closeProd()
+	stagingCh, staging, cleanup := declareTestTopology(t)
+	defer cleanup()
+	received := make(chan amqp.Delivery, 16)
+	for _, queue := range []string{staging.TaskQueue, staging.HighPriorityTaskQueue} {
+		deliveries, err := stagingCh.Consume(queue, "", false, false, false, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for d := range deliveries {
+				received <- d
+			}
+		}()
+	}
+
+	body := []byte(fmt.Sprintf("prod.%d", time.Now().UnixNano()))
+	publish := func(exchange, key string, expiration string) {
+		err := prodCh.Publish(exchange, key, false, false, amqp.Publishing{Body: body, Expiration: expiration})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish("", prod.TaskQueue, "")
+	publish("", prod.HighPriorityTaskQueue, "")
+	// Retried through the unprefixed retry exchange, back to the unprefixed task queue
+	publish(prod.RetryExchange, "", "200")
+	select {
+	case d := <-received:
+		t.Errorf("Expected the prefixed worker not to receive messages of the unprefixed topology, got %q", d.Body)
+	case <-time.After(2 * time.Second):
+	}
+	// Taken off the unprefixed queues, so they do not reach production consumers
+	for _, queue := range []string{prod.TaskQueue, prod.TaskQueue, prod.HighPriorityTaskQueue} {
+		for {
+			d, ok, err := prodCh.Get(queue, false)
+			if err != nil || !ok {
+				break
+			}
+			if string(d.Body) == string(body) {
+				d.Ack(false)
+				break
+			}
+			d.Nack(false, true)
+		}
+	}
+}
+
+func TestRetriedMessageComesBack(t *testing.T) {
+	ch, names, cleanup := declareTestTopology(t)
+	defer cleanup()
+	err := ch.Publish(names.RetryExchange, "", false, false, amqp.Publishing{
+		Body:       []byte("retry"),
+		Expiration: "500",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The message waits in the retry queue until it expires
+	if _, ok, err := ch.Get(names.TaskQueue, true); err != nil || ok {
+		t.Fatalf("Expected the message to wait before being retried, got %v %v", ok, err)
+	}
+	d := waitForMessage(t, ch, names.TaskQueue, 5*time.Second)
+	d.Ack(false)
+	if string(d.Body) != "retry" {
+		t.Errorf("Expected the retried message, got %q", d.Body)
+	}
+}
+
+func TestPriorityRoutes(t *testing.T) {
+	names := topology.FromConfig()
+	high := amqp.Table{types.PriorityHeader: types.PriorityHigh}
+	if queue := names.TaskQueueOf(high); queue != names.HighPriorityTaskQueue {
+		t.Errorf("Expected high priority tasks to be published to %s, got %s", names.HighPriorityTaskQueue, queue)
+	}
+	if queue := names.TaskQueueOf(amqp.Table{}); queue != names.TaskQueue {
+		t.Errorf("Expected tasks to be published to %s, got %s", names.TaskQueue, queue)
+	}
+	if exchange, key := names.RetryRouteOf(high); exchange != "" || key != names.HighPriorityRetryQueue {
+		t.Errorf("Expected high priority retries to wait in %s, got %q %q", names.HighPriorityRetryQueue, exchange, key)
+	}
+	if exchange, key := names.RetryRouteOf(nil); exchange != names.RetryExchange || key != "" {
+		t.Errorf("Expected retries to be published to %s, got %q %q", names.RetryExchange, exchange, key)
+	}
+}
+
+func TestHighPriorityRetryComesBack(t *testing.T) {
+	ch, names, cleanup := declareTestTopology(t)
+	defer cleanup()
+	headers := amqp.Table{types.PriorityHeader: types.PriorityHigh}
+	exchange, key := names.RetryRouteOf(headers)
+	err := ch.Publish(exchange, key, false, false, amqp.Publishing{
+		Headers:    headers,
+		Body:       []byte("ban"),
+		Expiration: "500",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := waitForMessage(t, ch, names.HighPriorityTaskQueue, 5*time.Second)
+	d.Ack(false)
+	if string(d.Body) != "ban" {
+		t.Errorf("Expected the retried ban back in the high priority queue, got %q", d.Body)
+	}
+	if _, ok, err := ch.Get(names.TaskQueue, true); err != nil || ok {
+		t.Errorf("Expected nothing in the task queue, got %v %v", ok, err)
+	}
+}
+
+func TestRejectedMessageIsParked(t *testing.T) {
+	ch, names, cleanup := declareTestTopology(t)
+	defer cleanup()
+	err := ch.Publish("", names.TaskQueue, false, false, amqp.Publishing{Body: []byte("exhausted")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Messages whose retries are exhausted are rejected without requeue by the worker
+	d := waitForMessage(t, ch, names.TaskQueue, 5*time.Second)
+	err = d.Nack(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parked := waitForMessage(t, ch, names.DeadLetterQueue, 5*time.Second)
+	parked.Ack(false)
+	if string(parked.Body) != "exhausted" {
+		t.Errorf("Expected the rejected message to be parked, got %q", parked.Body)
+	}
+}
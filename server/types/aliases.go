@@ -0,0 +1,47 @@
+package types
+
+import "encoding/json"
+
+// LegacyFieldAliases maps the JSON field names used by older producers, e.g forks of the frontend,
+// to the canonical field names of WhitelistRequest. Aliases are accepted when decoding during a
+// transition period and never used when encoding
+var LegacyFieldAliases = map[string]string{
+	"userName": "username",
+	"mail":     "email",
+}
+
+// LegacyAliasUsed is called whenever a whitelist request is decoded from a legacy alias.
+// Set it to report the deprecated usage
+var LegacyAliasUsed = func(alias, canonical string) {}
+
+// UnmarshalJSON decodes a whitelist request accepting the legacy aliases of its fields.
+// The canonical field wins if both the alias and the canonical field are present
+func (r *WhitelistRequest) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	aliased := false
+	for alias, canonical := range LegacyFieldAliases {
+		value, ok := fields[alias]
+		if !ok {
+			continue
+		}
+		aliased = true
+		LegacyAliasUsed(alias, canonical)
+		delete(fields, alias)
+		if _, ok := fields[canonical]; !ok {
+			fields[canonical] = value
+		}
+	}
+	if aliased {
+		data, err = json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+	}
+	// Decode with the default decoding of the struct
+	type whitelistRequest WhitelistRequest
+	return json.Unmarshal(data, (*whitelistRequest)(r))
+}
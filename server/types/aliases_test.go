@@ -0,0 +1,80 @@
+package types_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+func decode(t *testing.T, payload string) (types.WhitelistRequest, []string) {
+	var used []string
+	types.LegacyAliasUsed = func(alias, canonical string) {
+		used = append(used, alias)
+	}
+	defer func() { types.LegacyAliasUsed = func(alias, canonical string) {} }()
+	var request types.WhitelistRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		t.Fatal(err)
+	}
+	return request, used
+}
+
+func TestLegacyAliases(t *testing.T) {
+	for alias, canonical := range types.LegacyFieldAliases {
+		request, used := decode(t, `{"`+alias+`": "value", "age": 20}`)
+		encoded, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]interface{}
+		json.Unmarshal(encoded, &fields)
+		if fields[canonical] != "value" {
+			t.Errorf("%s: expected alias to decode into %s, got %s", alias, canonical, encoded)
+		}
+		if _, ok := fields[alias]; ok && alias != canonical {
+			t.Errorf("%s: expected only the canonical name to be encoded, got %s", alias, encoded)
+		}
+		if len(used) != 1 || used[0] != alias {
+			t.Errorf("%s: expected the alias usage to be reported, got %v", alias, used)
+		}
+		if request.Age != 20 {
+			t.Errorf("%s: expected other fields to be decoded, got %+v", alias, request)
+		}
+	}
+}
+
+func TestMixedLegacyAndCanonicalFields(t *testing.T) {
+	request, used := decode(t, `{"userName": "steve", "email": "steve@example.com", "gender": "male"}`)
+	if request.Username != "steve" || request.Email != "steve@example.com" || request.Gender != "male" {
+		t.Errorf("unexpected request %+v", request)
+	}
+	if len(used) != 1 {
+		t.Errorf("expected one alias usage, got %v", used)
+	}
+}
+
+func TestCanonicalFieldWinsOverAlias(t *testing.T) {
+	// The order of the fields does not matter
+	for _, payload := range []string{
+		`{"mail": "old@example.com", "email": "new@example.com"}`,
+		`{"email": "new@example.com", "mail": "old@example.com"}`,
+	} {
+		request, _ := decode(t, payload)
+		if request.Email != "new@example.com" {
+			t.Errorf("expected the canonical field to win for %s, got %s", payload, request.Email)
+		}
+	}
+}
+
+func TestCanonicalPayloadReportsNoAlias(t *testing.T) {
+	request, used := decode(t, `{"username": "alex", "email": "alex@example.com"}`)
+	if len(used) != 0 || request.Username != "alex" {
+		t.Errorf("expected canonical payload to decode without aliases, got %+v and %v", request, used)
+	}
+	encoded, _ := json.Marshal(request)
+	if !strings.Contains(string(encoded), `"username":"alex"`) {
+		t.Errorf("expected canonical names when encoding, got %s", encoded)
+	}
+}
@@ -0,0 +1,64 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// RequestSchemaVersion is the version of the envelope the request tasks are published in. Bump it with a
+// migration in requestMigrations whenever a field of the request is renamed or changes meaning, so messages
+// still in the queues are read as they were meant
+const RequestSchemaVersion = 2
+
+// ErrUnknownSchemaVersion is returned for messages published by a newer version, e.g during a rollback. They are
+// parked for the newer version to process instead of being misread
+var ErrUnknownSchemaVersion = errors.New("Unknown schema version of the message")
+
+// RequestMessage is the envelope of the request tasks published to the queues. Messages published before the
+// envelope are the bare request and read as version 1
+type RequestMessage struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	Request       WhitelistRequest `json:"request"`
+}
+
+// requestMigrations upgrade the request of a message of the version to the next version
+var requestMigrations = map[int]func(json.RawMessage) (json.RawMessage, error){
+	// The request of version 1 was published bare. Only the envelope was added
+	1: func(request json.RawMessage) (json.RawMessage, error) {
+		return request, nil
+	},
+}
+
+// EncodeRequestMessage encodes the request task in the envelope of the current schema version
+func EncodeRequestMessage(request WhitelistRequest) ([]byte, error) {
+	return json.Marshal(RequestMessage{SchemaVersion: RequestSchemaVersion, Request: request})
+}
+
+// DecodeRequestMessage decodes the request task of a message of any known schema version, migrated to the current
+// one, and returns the version it was published in. Returns ErrUnknownSchemaVersion for newer versions
+func DecodeRequestMessage(body []byte) (WhitelistRequest, int, error) {
+	var envelope struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		Request       json.RawMessage `json:"request"`
+	}
+	err := json.Unmarshal(body, &envelope)
+	if err != nil {
+		return WhitelistRequest{}, 0, err
+	}
+	version, request := envelope.SchemaVersion, envelope.Request
+	if version == 0 {
+		version, request = 1, json.RawMessage(body)
+	}
+	if version > RequestSchemaVersion {
+		return WhitelistRequest{}, version, ErrUnknownSchemaVersion
+	}
+	for v := version; v < RequestSchemaVersion; v++ {
+		request, err = requestMigrations[v](request)
+		if err != nil {
+			return WhitelistRequest{}, version, err
+		}
+	}
+	var decoded WhitelistRequest
+	err = json.Unmarshal(request, &decoded)
+	return decoded, version, err
+}
@@ -0,0 +1,106 @@
+package types_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+func TestDecodeRequestMessage(t *testing.T) {
+	current, err := types.EncodeRequestMessage(types.WhitelistRequest{Username: "Steve", Status: types.StatusApproved})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope map[string]interface{}
+	json.Unmarshal(current, &envelope)
+	if envelope["schemaVersion"] != float64(types.RequestSchemaVersion) {
+		t.Errorf("Expected the message to be stamped with the current schema version, got %s", current)
+	}
+	cases := []struct {
+		body     string
+		username string
+		version  int
+	}{
+		{string(current), "Steve", types.RequestSchemaVersion},
+		// Published before the envelope
+		{`{"username": "Steve", "status": "Approved"}`, "Steve", 1},
+		// Legacy aliases of version 1 messages are still accepted
+		{`{"userName": "Alex", "status": "Pending"}`, "Alex", 1},
+	}
+	for _, c := range cases {
+		request, version, err := types.DecodeRequestMessage([]byte(c.body))
+		if err != nil || request.Username != c.username || version != c.version {
+			t.Errorf("Expected %s to decode as version %d, got %v %d %v", c.body, c.version, request, version, err)
+		}
+	}
+
+	_, version, err := types.DecodeRequestMessage([]byte(`{"schemaVersion": 99, "request": {"username": "Steve"}}`))
+	if err != types.ErrUnknownSchemaVersion || version != 99 {
+		t.Errorf("Expected messages of newer versions to be rejected, got %d %v", version, err)
+	}
+	if _, _, err := types.DecodeRequestMessage([]byte(`not json`)); err == nil {
+		t.Error("Expected invalid messages to be rejected")
+	}
+}
+
+func TestMessageSignature(t *testing.T) {
+	body := []byte(`{"schemaVersion":2,"request":{"status":"Approved"}}`)
+	secrets := utils.Secrets{Primary: "passphrase"}
+	if _, _, err := types.VerifyMessage(map[string]interface{}{}, body, secrets); err != types.ErrUnsignedMessage {
+		t.Errorf("Expected a message without signature to be unsigned, got %v", err)
+	}
+	headers := map[string]interface{}{types.SignatureHeader: "stale", types.PublishedAtHeader: int64(1)}
+	due := time.Now().Add(time.Minute)
+	if err := types.SignMessage(headers, body, due, "passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	id, signedAt, err := types.VerifyMessage(headers, body, secrets)
+	if err != nil || id == "" || signedAt.Unix() != due.Unix() {
+		t.Errorf("Expected the signed message to verify as signed at %s, got %s with ID %q: %v", due, signedAt, id, err)
+	}
+	if headers[types.PublishedAtHeader] != int64(1) {
+		t.Error("Expected the other headers to be kept")
+	}
+	republished := map[string]interface{}{}
+	for k, v := range headers {
+		republished[k] = v
+	}
+	types.SignMessage(republished, body, due, "passphrase")
+	if republished[types.MessageIDHeader] == id {
+		t.Error("Expected a republished message to get a new message ID")
+	}
+	headers[types.MessageIDHeader] = "replayed"
+	if _, _, err := types.VerifyMessage(headers, body, secrets); err != types.ErrMessageSignature {
+		t.Errorf("Expected a message with another ID not to verify, got %v", err)
+	}
+
+	// The headers deciding how the task is processed can not be edited either
+	tampered := map[string]interface{}{
+		types.TaskTypeHeader:         types.ConsoleTaskType,
+		types.CompletedStepsHeader:   int32(types.StepServerAction),
+		types.PhaseHeader:            types.PhaseEmail,
+		types.PriorityHeader:         types.PriorityHigh,
+		types.SkipConfirmationHeader: true,
+	}
+	for name, value := range tampered {
+		signed := map[string]interface{}{types.CompletedStepsHeader: int64(0)}
+		types.SignMessage(signed, body, due, "passphrase")
+		if _, _, err := types.VerifyMessage(signed, body, secrets); err != nil {
+			t.Fatalf("Expected the signed message to verify, got %v", err)
+		}
+		signed[name] = value
+		if _, _, err := types.VerifyMessage(signed, body, secrets); err != types.ErrMessageSignature {
+			t.Errorf("Expected a message with %s edited not to verify, got %v", name, err)
+		}
+	}
+	// Integers come back from the queue in any size
+	signed := map[string]interface{}{types.CompletedStepsHeader: int32(3)}
+	types.SignMessage(signed, body, due, "passphrase")
+	signed[types.CompletedStepsHeader] = int64(3)
+	if _, _, err := types.VerifyMessage(signed, body, secrets); err != nil {
+		t.Errorf("Expected the signature to verify with the integer of another size, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package types
+
+import "strings"
+
+// Standings of the referrer of a request
+const (
+	// ReferrerMember has an approved request and was never banned
+	ReferrerMember = "member"
+	// ReferrerBanned has been banned, whatever their other requests
+	ReferrerBanned = "banned"
+	// ReferrerNotMember applied but is not approved, e.g pending or deactivated
+	ReferrerNotMember = "not-member"
+	// ReferrerUnknown never applied
+	ReferrerUnknown = "unknown"
+)
+
+// TagUnverifiedReferrer flags requests vouched for by someone who is not a member in good standing
+const TagUnverifiedReferrer = "unverified-referrer"
+
+// Referral is the standing of the referrer of a request when the request was submitted, shown to ops only
+type Referral struct {
+	Standing string `bson:"standing" json:"standing"`
+	// ReferrerRequestID is the hex ID of the approved request of the referrer, if they are a member
+	ReferrerRequestID string `bson:"referrerRequestId,omitempty" json:"referrerRequestId,omitempty"`
+}
+
+// Verified tells if the referrer is a member in good standing
+func (r Referral) Verified() bool {
+	return r.Standing == ReferrerMember
+}
+
+// Summary describes the referral to ops, e.g "Vouched for by Steve, who is banned"
+func (r Referral) Summary(referrer string) string {
+	switch r.Standing {
+	case ReferrerMember:
+		return "Vouched for by " + referrer + ", a member in good standing"
+	case ReferrerBanned:
+		return "Vouched for by " + referrer + ", who is banned"
+	case ReferrerNotMember:
+		return "Vouched for by " + referrer + ", who is not a member"
+	}
+	return "Vouched for by " + referrer + ", who never applied"
+}
+
+// ReferralOf finds the standing of a referrer from their requests. A ban outweighs any approved request
+func ReferralOf(referrerRequests []WhitelistRequest) Referral {
+	referral := Referral{Standing: ReferrerUnknown}
+	for _, request := range referrerRequests {
+		switch {
+		case request.Status == StatusBanned:
+			return Referral{Standing: ReferrerBanned}
+		case request.Status == StatusApproved && referral.Standing != ReferrerMember:
+			referral = Referral{Standing: ReferrerMember, ReferrerRequestID: request.ID.Hex()}
+		case referral.Standing == ReferrerUnknown:
+			referral.Standing = ReferrerNotMember
+		}
+	}
+	return referral
+}
+
+// SameReferrer tells if the referrer names the applicant, who can not vouch for themselves
+func SameReferrer(referrer, username string) bool {
+	return strings.EqualFold(strings.TrimSpace(referrer), strings.TrimSpace(username))
+}
+
+// ReferrerStats are the applicants a referrer vouched for and how many of them got banned later, so admins can
+// spot referrers vouching for troublemakers
+type ReferrerStats struct {
+	Referrer string `bson:"referrer" json:"referrer"`
+	Vouched  int    `bson:"vouched" json:"vouched"`
+	Approved int    `bson:"approved" json:"approved"`
+	Banned   int    `bson:"banned" json:"banned"`
+}
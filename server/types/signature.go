@@ -0,0 +1,91 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// Headers of the signature of the messages published to the queues, so a message crafted by anyone with access
+// to the vhost, e.g approving a request, is not processed. The message ID is unique to every publication so a
+// captured message can not be replayed, and the signing time bounds how long a message is accepted for
+const (
+	SignatureHeader = "x-signature"
+	SignedAtHeader  = "x-signed-at"
+	MessageIDHeader = "x-message-id"
+)
+
+// signedHeaders are the headers deciding how a message is processed, covered by the signature in this order so
+// e.g a decision task can not be turned into a console task or skip its steps
+var signedHeaders = []string{TaskTypeHeader, CompletedStepsHeader, PhaseHeader, PriorityHeader, SkipConfirmationHeader}
+
+var (
+	// ErrUnsignedMessage is returned for messages without signature, e.g published before messages were signed
+	ErrUnsignedMessage = errors.New("Message is not signed")
+	// ErrMessageSignature is returned for messages not signed with any of the secrets or edited since
+	ErrMessageSignature = errors.New("Invalid message signature")
+)
+
+// SignMessage stamps the headers with a new message ID and the signature of the body. Messages are signed as of
+// the time they are due, e.g once their delay in the retry queue is over, so their age counts from then. The
+// signature headers of the message republished, e.g a retry, are replaced
+func SignMessage(headers map[string]interface{}, body []byte, dueAt time.Time, secret string) error {
+	id, err := utils.NewNonce()
+	if err != nil {
+		return err
+	}
+	signedAt := dueAt.Unix()
+	headers[MessageIDHeader] = id
+	headers[SignedAtHeader] = signedAt
+	headers[SignatureHeader] = utils.SignMessage(body, signedAt, id, canonicalHeaders(headers), secret)
+	return nil
+}
+
+// VerifyMessage checks the message is signed with any of the secrets, and returns its ID and the time it was
+// signed at
+func VerifyMessage(headers map[string]interface{}, body []byte, secrets utils.Secrets) (string, time.Time, error) {
+	signature, _ := headers[SignatureHeader].(string)
+	if signature == "" {
+		return "", time.Time{}, ErrUnsignedMessage
+	}
+	id, _ := headers[MessageIDHeader].(string)
+	var signedAt int64
+	switch v := headers[SignedAtHeader].(type) {
+	case int64:
+		signedAt = v
+	case int32:
+		signedAt = int64(v)
+	default:
+		return "", time.Time{}, ErrMessageSignature
+	}
+	if id == "" || !utils.VerifyMessage(body, signedAt, id, canonicalHeaders(headers), signature, secrets) {
+		return "", time.Time{}, ErrMessageSignature
+	}
+	return id, time.Unix(signedAt, 0), nil
+}
+
+// canonicalHeaders returns the signed headers as one "name:value" line each, in the order of signedHeaders. Absent
+// headers have an empty value. Integers are written the same whichever size they come back from the queue with
+func canonicalHeaders(headers map[string]interface{}) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		value := headers[name]
+		switch v := value.(type) {
+		case nil:
+			value = ""
+		case int8:
+			value = int64(v)
+		case int16:
+			value = int64(v)
+		case int32:
+			value = int64(v)
+		case int:
+			value = int64(v)
+		}
+		fmt.Fprintf(&b, "%s:%v\n", name, value)
+	}
+	return b.String()
+}
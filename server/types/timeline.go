@@ -0,0 +1,66 @@
+package types
+
+import "time"
+
+// Milestones of the processing of a request, recorded by the worker once reached
+const (
+	MilestoneSubmitted   = "submitted"
+	MilestoneOpsNotified = "opsNotified"
+	MilestoneApproved    = "approved"
+	MilestoneDenied      = "denied"
+	MilestoneWhitelisted = "whitelisted"
+)
+
+// Milestone is a step of the processing of a request. Only the first time a milestone is reached is kept
+type Milestone struct {
+	Name string    `bson:"name" json:"name"`
+	At   time.Time `bson:"at" json:"at"`
+	// Reviewers is the number of ops who took part in the decision, set for decision milestones
+	Reviewers int `bson:"reviewers,omitempty" json:"reviewers,omitempty"`
+	// Ops notified of the request or who took part in the decision. Never shown to the applicant
+	Ops []string `bson:"ops,omitempty" json:"ops,omitempty"`
+}
+
+// DecisionMilestone is the milestone of the decision on the request, or false if the request is undecided.
+// The reviewers are the ops who voted for the decision, or the admin who made it if decided without votes
+func (r WhitelistRequest) DecisionMilestone() (Milestone, bool) {
+	var name string
+	switch r.Status {
+	case StatusApproved:
+		name = MilestoneApproved
+	case StatusDenied:
+		name = MilestoneDenied
+	default:
+		return Milestone{}, false
+	}
+	at := r.ProcessedTimestamp
+	if r.DecidedAt != nil {
+		at = *r.DecidedAt
+	}
+	var ops []string
+	seen := make(map[string]bool)
+	for _, vote := range r.Votes {
+		if vote.Decision == r.Status && !seen[vote.Op] {
+			seen[vote.Op] = true
+			ops = append(ops, vote.Op)
+		}
+	}
+	if len(ops) == 0 && r.Admin != "" {
+		ops = []string{r.Admin}
+	}
+	reviewers := len(ops)
+	if reviewers == 0 {
+		reviewers = 1
+	}
+	return Milestone{Name: name, At: at, Reviewers: reviewers, Ops: ops}, true
+}
+
+// Milestone returns the milestone of the timeline with the name, or false if it has not been reached
+func (r WhitelistRequest) Milestone(name string) (Milestone, bool) {
+	for _, milestone := range r.Timeline {
+		if milestone.Name == name {
+			return milestone, true
+		}
+	}
+	return Milestone{}, false
+}
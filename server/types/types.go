@@ -1,11 +1,38 @@
 package types
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// APIVersion is the version of the HTTP API served by the server.
+// Clients are compatible with any server of the same major version
+const APIVersion = "1.0.0"
+
+// Statuses a whitelist request goes through
+const (
+	StatusPending     = "Pending"
+	StatusApproved    = "Approved"
+	StatusDenied      = "Denied"
+	StatusBanned      = "Banned"
+	StatusDeactivated = "Deactivated"
+	// StatusUnbanned marks a banned request that an op pardoned. The player may apply again
+	StatusUnbanned = "Unbanned"
+	// StatusExpired marks a request that stayed pending longer than the configured pendingTTL
+	StatusExpired = "Expired"
+	// StatusDisputed marks a pending request ops voted differently on. It awaits a decision of the owner
+	StatusDisputed = "Disputed"
+	// StatusCancelled marks a pending request the applicant withdrew from the status page
+	StatusCancelled = "Cancelled"
+	// StatusWaitlisted marks an approved request whose player did not fit on the game server, see maxWhitelisted.
+	// It is approved again once a player is removed
+	StatusWaitlisted = "Waitlisted"
+)
+
 // WhitelistRequest represent a whitelist request issued by the requester player
 type WhitelistRequest struct {
 	ID                   primitive.ObjectID     `bson:"_id" json:"_id"`
@@ -21,4 +48,727 @@ type WhitelistRequest struct {
 	Note                 string                 `bson:"note" json:"note" json:",omitempty"`
 	Info                 map[string]interface{} `bson:"info" json:"info" json:",omitempty"`
 	Assignees            []string               `bson:"assignees" json:"assignees" json:",omitempty"`
+	Escalated            bool                   `bson:"escalated" json:"escalated"`
+	EscalatedTimestamp   time.Time              `bson:"escalatedTimestamp" json:"escalatedTimestamp"`
+	// ServerID is the community the request was submitted to if the deployment serves several of them.
+	// Empty for the default community configured by the top level settings
+	ServerID string `bson:"serverId,omitempty" json:"serverId,omitempty"`
+	// Locale is the language the applicant filled the form in. Applicant emails are sent in it
+	Locale string `bson:"locale,omitempty" json:"locale,omitempty"`
+	// Platform is the edition the player joins from, utils.PlatformJava or utils.PlatformBedrock. Empty for Java players
+	// who applied before Bedrock players could. The username of Bedrock players has the Floodgate prefix
+	Platform string `bson:"platform,omitempty" json:"platform,omitempty"`
+	// DecisionReason is written by the op when deciding on the request and told to the applicant
+	DecisionReason string `bson:"decisionReason,omitempty" json:"decisionReason,omitempty"`
+	// ExpiresAt is set by the op for temporary grants. The player is deactivated once it passes
+	ExpiresAt *time.Time `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	// BatchID is the hex ID of the event batch the approval is attached to
+	BatchID string `bson:"batchId,omitempty" json:"batchId,omitempty"`
+	// UUID is the Mojang UUID of the player, resolved when the member directory is generated
+	UUID string `bson:"uuid,omitempty" json:"uuid,omitempty"`
+	// DirectoryOptOut is set by the player from the status page to be left out of the member directory
+	DirectoryOptOut bool `bson:"directoryOptOut,omitempty" json:"directoryOptOut,omitempty"`
+	// AwaitingOps marks a pending request parked because no ops were configured when it was submitted
+	AwaitingOps bool `bson:"awaitingOps,omitempty" json:"awaitingOps,omitempty"`
+	// Provisional approvals are reviewed again by ops at ReviewAt, e.g after a trial period
+	Provisional bool       `bson:"provisional,omitempty" json:"provisional,omitempty"`
+	ReviewAt    *time.Time `bson:"reviewAt,omitempty" json:"reviewAt,omitempty"`
+	// ReviewReminded is set once ops have been asked to review the provisional approval
+	ReviewReminded bool `bson:"reviewReminded,omitempty" json:"reviewReminded,omitempty"`
+	// Canary requests are synthetic requests verifying the pipeline end to end. Their side effects are
+	// harmless and they are left out of stats, listings and exports
+	Canary                   bool       `bson:"canary,omitempty" json:"canary,omitempty"`
+	CanaryCompletedTimestamp *time.Time `bson:"canaryCompletedTimestamp,omitempty" json:"canaryCompletedTimestamp,omitempty"`
+	// ImportedAt is set for approved requests created from an existing whitelist.json. They were
+	// never decided by an op and their email is a placeholder ending with ImportedEmailDomain
+	ImportedAt *time.Time `bson:"importedAt,omitempty" json:"importedAt,omitempty"`
+	// SubmissionIP is the address the request was submitted from and SubmissionIPPrefix its network. Both are
+	// salted hashes if SubmissionIPHashed is set. Never sent to clients
+	SubmissionIP       string `bson:"submissionIp,omitempty" json:"-"`
+	SubmissionIPPrefix string `bson:"submissionIpPrefix,omitempty" json:"-"`
+	SubmissionIPHashed bool   `bson:"submissionIpHashed,omitempty" json:"-"`
+	// SubmissionCountry is the ISO code of the country the request was submitted from, if a geo database is
+	// configured. NetworkSignals summarizes the prior requests from the same network. Both are shown to ops only
+	SubmissionCountry string          `bson:"submissionCountry,omitempty" json:"submissionCountry,omitempty"`
+	NetworkSignals    *NetworkSignals `bson:"networkSignals,omitempty" json:"networkSignals,omitempty"`
+	// ReferrerUsername is the member who vouched for the applicant. Referral is their standing found by the worker
+	ReferrerUsername string    `bson:"referrerUsername,omitempty" json:"referrerUsername,omitempty"`
+	Referral         *Referral `bson:"referral,omitempty" json:"referral,omitempty"`
+	// Tags flag the request to ops, e.g TagUnverifiedReferrer
+	Tags []string `bson:"tags,omitempty" json:"tags,omitempty"`
+	// Attachments are the keys of the files the applicant attached, e.g proof they own the account. Only served
+	// through signed links, see the attachments package
+	Attachments []string `bson:"attachments,omitempty" json:"attachments,omitempty"`
+	// PreviousRequestID is the hex ID of the denied request this request resubmits. Attempt counts the
+	// submissions of the original request, starting at 2 for the first resubmission
+	PreviousRequestID string `bson:"previousRequestId,omitempty" json:"previousRequestId,omitempty"`
+	Attempt           int    `bson:"attempt,omitempty" json:"attempt,omitempty"`
+	// Bench is the ID of the load benchmark run that submitted the synthetic request
+	Bench string `bson:"bench,omitempty" json:"bench,omitempty"`
+	// Sequence is incremented by every change published as a task and carried in the message.
+	// AppliedSequence is the sequence of the last task the worker applied, older tasks are skipped
+	Sequence        int64 `bson:"sequence,omitempty" json:"sequence,omitempty"`
+	AppliedSequence int64 `bson:"appliedSequence,omitempty" json:"-"`
+	// Votes of ops on the request if decisions need the approval of more than one op
+	Votes []Vote `bson:"votes,omitempty" json:"votes,omitempty"`
+	// OnserverStatus is the state of the player on the game server, recorded once the worker carried out the
+	// task of the status. Unset for requests whose tasks never reached the game server
+	OnserverStatus string `bson:"onserverStatus,omitempty" json:"onserverStatus,omitempty"`
+	// Comments ops exchanged about the request, oldest first. Never shown to the applicant
+	Comments []Comment `bson:"comments,omitempty" json:"comments,omitempty"`
+	// SubmittedAt is when the request was submitted, DecidedAt when an op first approved or denied it and
+	// ProcessedAt when the worker first carried out the decision, e.g whitelisted the player. They are unset
+	// for requests stored before they were introduced, and DecidedAt and ProcessedAt for undecided requests
+	SubmittedAt *time.Time `bson:"submittedAt,omitempty" json:"submittedAt,omitempty"`
+	DecidedAt   *time.Time `bson:"decidedAt,omitempty" json:"decidedAt,omitempty"`
+	ProcessedAt *time.Time `bson:"processedAt,omitempty" json:"processedAt,omitempty"`
+	// DigestedAt is when the request was first sent to ops in a digest and LastDigestedAt the last time,
+	// if ops get pending requests in a daily digest
+	DigestedAt     *time.Time `bson:"digestedAt,omitempty" json:"digestedAt,omitempty"`
+	LastDigestedAt *time.Time `bson:"lastDigestedAt,omitempty" json:"lastDigestedAt,omitempty"`
+	// Answers to the custom fields of the application form configured by the community, in the order of the form
+	Answers []Answer `bson:"answers,omitempty" json:"answers,omitempty"`
+	// ErasedAt is when the personal data of the applicant was erased on their request. The email is replaced
+	// by a placeholder ending with ErasedEmailDomain
+	ErasedAt *time.Time `bson:"erasedAt,omitempty" json:"erasedAt,omitempty"`
+	// SLANotifiedAt is when ops were last told the request is pending longer than the SLA
+	SLANotifiedAt *time.Time `bson:"slaNotifiedAt,omitempty" json:"slaNotifiedAt,omitempty"`
+	// MessageIDs are the Message-IDs of the last emails sent to the applicant, so bounces can be traced back to
+	// the request. EmailUndeliverable is set once one of them bounced permanently, for the reason told by the
+	// email provider. Nothing more is sent to the address
+	MessageIDs         []string `bson:"messageIds,omitempty" json:"-"`
+	EmailUndeliverable bool     `bson:"emailUndeliverable,omitempty" json:"emailUndeliverable,omitempty"`
+	EmailBounceReason  string   `bson:"emailBounceReason,omitempty" json:"emailBounceReason,omitempty"`
+	// FirstJoinedAt is when the approved player was first seen online on the game server. Players are only seen
+	// while they are online when the worker polls the game server, see joinTrackingIntervalMinutes
+	FirstJoinedAt *time.Time `bson:"firstJoinedAt,omitempty" json:"firstJoinedAt,omitempty"`
+	// FollowUp flags an approved player who may never have got in, so ops can reach out
+	FollowUp *FollowUp `bson:"followUp,omitempty" json:"followUp,omitempty"`
+	// Dispatches are the times the request was sent to each op, by action email or digest. RespondedBy is the op
+	// who first decided the request and ResponseTimeInMinutes the time from the first dispatch to them to the
+	// decision. Both are unset if the request was decided by an op it was never sent to, e.g an owner from the
+	// dashboard
+	Dispatches            []Dispatch `bson:"dispatches,omitempty" json:"dispatches,omitempty"`
+	RespondedBy           string     `bson:"respondedBy,omitempty" json:"respondedBy,omitempty"`
+	ResponseTimeInMinutes *float64   `bson:"responseTimeInMinutes,omitempty" json:"responseTimeInMinutes,omitempty"`
+	// Timeline are the milestones of the processing of the request, in the order they were reached. The applicant
+	// is shown them without the ops involved
+	Timeline []Milestone `bson:"timeline,omitempty" json:"timeline,omitempty"`
+	// PreviousStatus is the status the request was in before the change, set by publishers of the change
+	// so the worker can notify webhook endpoints. Never stored
+	PreviousStatus string `bson:"-" json:"previousStatus,omitempty"`
+	// BulkID is the ID of the bulk decision the change is part of, set by publishers of the change so the worker can
+	// tell webhook endpoints about the whole bulk at once. Never stored
+	BulkID string `bson:"-" json:"bulkId,omitempty"`
+}
+
+// Reasons an approved request is flagged for follow-up
+const (
+	// FollowUpEmailBounced is a bounced email of the applicant, e.g the approval telling them how to join
+	FollowUpEmailBounced = "emailBounced"
+	// FollowUpNeverJoined is a player never seen online on the game server since the approval
+	FollowUpNeverJoined = "neverJoined"
+)
+
+// Actions suggested to ops for a request flagged for follow-up
+const (
+	// FollowUpResendEmail resends the decision email, once the address is corrected
+	FollowUpResendEmail = "resendEmail"
+	// FollowUpReachOut asks ops to contact the player another way, e.g on Discord
+	FollowUpReachOut = "reachOut"
+	// FollowUpDeactivate deactivates the player, freeing their place on the game server
+	FollowUpDeactivate = "deactivate"
+)
+
+// FollowUp tells why an approved request is flagged and what ops may do about it. DismissedAt is set once ops
+// dealt with it, and the request is not flagged again
+type FollowUp struct {
+	Reasons          []string   `bson:"reasons" json:"reasons"`
+	SuggestedActions []string   `bson:"suggestedActions" json:"suggestedActions"`
+	FlaggedAt        time.Time  `bson:"flaggedAt" json:"flaggedAt"`
+	DismissedAt      *time.Time `bson:"dismissedAt,omitempty" json:"dismissedAt,omitempty"`
+	DismissedBy      string     `bson:"dismissedBy,omitempty" json:"dismissedBy,omitempty"`
+}
+
+// Answer is the answer of the applicant to a custom field of the application form. The label is kept so the
+// answer still reads the same once the form changes
+type Answer struct {
+	Key   string `bson:"key" json:"key"`
+	Label string `bson:"label" json:"label"`
+	Value string `bson:"value" json:"value"`
+}
+
+// Dispatch is a time the request was sent to the op
+type Dispatch struct {
+	Op        string    `bson:"op" json:"op"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// ResponseTime is the time from the first dispatch of the request to the op until decidedAt, or false if the
+// request was never sent to the op or only after decidedAt
+func (r WhitelistRequest) ResponseTime(op string, decidedAt time.Time) (time.Duration, bool) {
+	var first time.Time
+	for _, dispatch := range r.Dispatches {
+		if dispatch.Op == op && (first.IsZero() || dispatch.Timestamp.Before(first)) {
+			first = dispatch.Timestamp
+		}
+	}
+	if first.IsZero() || decidedAt.Before(first) {
+		return 0, false
+	}
+	return decidedAt.Sub(first), true
+}
+
+// Vote is the decision of an op on a request whose decisions need the approval of more than one op
+type Vote struct {
+	Op        string    `bson:"op" json:"op"`
+	Decision  string    `bson:"decision" json:"decision"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// Comment is a message an op left on a request for the other ops assigned to it, e.g to vouch for the applicant
+type Comment struct {
+	ID        primitive.ObjectID `bson:"_id" json:"_id"`
+	Author    string             `bson:"author" json:"author"`
+	Text      string             `bson:"text" json:"text"`
+	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+// ImportedEmailDomain is the domain of the placeholder emails of imported requests. The .invalid
+// top level domain is reserved so nothing is ever delivered to it
+const ImportedEmailDomain = "imported.invalid"
+
+// ErasedEmailDomain is the domain of the placeholder emails of requests whose personal data has been erased
+const ErasedEmailDomain = "erased.invalid"
+
+// PlaceholderEmail tells if the email is the placeholder of an imported or erased request, which has no email
+// of the player to send to
+func PlaceholderEmail(email string) bool {
+	email = strings.ToLower(email)
+	return strings.HasSuffix(email, "@"+ImportedEmailDomain) || strings.HasSuffix(email, "@"+ErasedEmailDomain)
+}
+
+// WhitelistEntry is an entry of the whitelist.json file of a vanilla game server
+type WhitelistEntry struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+}
+
+// Statuses of an event batch
+const (
+	BatchStatusActive = "Active"
+	BatchStatusEnded  = "Ended"
+)
+
+// Batch represent a named group of temporary members, e.g guests of a build competition,
+// who are deactivated together once the batch ends
+type Batch struct {
+	ID      primitive.ObjectID `bson:"_id" json:"_id"`
+	Name    string             `bson:"name" json:"name"`
+	EndTime time.Time          `bson:"endTime" json:"endTime"`
+	Status  string             `bson:"status" json:"status"`
+	// Number of members converted to permanent members before the batch ended
+	DetachedCount  int64     `bson:"detachedCount" json:"detachedCount"`
+	Timestamp      time.Time `bson:"timestamp" json:"timestamp"`
+	EndedTimestamp time.Time `bson:"endedTimestamp" json:"endedTimestamp"`
+}
+
+// BatchStats summarize the members of a batch by status
+type BatchStats struct {
+	Members     int64 `json:"members"`
+	Approved    int64 `json:"approved"`
+	Deactivated int64 `json:"deactivated"`
+	Banned      int64 `json:"banned"`
+	Detached    int64 `json:"detached"`
+}
+
+// Stats is composed of both thre real-time stats that got updated in real-time after each
+// application status change AND aggregate stats that are analyzed and updated at a regular interval
+type Stats struct {
+	Pending                      int64          `redis:"pending" json:"pending"`
+	Denied                       int64          `redis:"denied" json:"denied"`
+	Approved                     int64          `redis:"approved" json:"approved"`
+	Banned                       int64          `redis:"banned" json:"banned"`
+	Deactivated                  int64          `redis:"deactivated" json:"deactivated"`
+	Expired                      int64          `redis:"expired" json:"expired"`
+	Cancelled                    int64          `redis:"cancelled" json:"cancelled"`
+	AverageResponseTimeInMinutes float64        `redis:"averageResponseTimeInMinutes" json:"averageResponseTimeInMinutes"`
+	TotalResponseTimeInMinutes   float64        `redis:"totalResponseTimeInMinutes" json:"totalResponseTimeInMinutes"`
+	MaleCount                    int64          `redis:"maleCount" json:"maleCount"`
+	FemaleCount                  int64          `redis:"femaleCount" json:"femaleCount"`
+	OtherGenderCount             int64          `redis:"otherGenderCount" json:"otherGenderCount"`
+	AgeGroup1Count               int64          `redis:"ageGroup1Count" json:"ageGroup1Count"`
+	AgeGroup2Count               int64          `redis:"ageGroup2Count" json:"ageGroup2Count"`
+	AgeGroup3Count               int64          `redis:"ageGroup3Count" json:"ageGroup3Count"`
+	AgeGroup4Count               int64          `redis:"ageGroup4Count" json:"ageGroup4Count"`
+	AggregateStats               AggregateStats `redis:"-" json:"aggregateStats"`
+	// ServerID is the community the stats are of, empty for the default community
+	ServerID string `redis:"-" json:"serverId,omitempty"`
+	// Decisions of ops and the time from the submission of each request to its decision. Updated on every
+	// decision and recomputed from the request timestamps when the aggregate stats are reconciled
+	Decisions                    int64   `redis:"decisions" json:"decisions"`
+	TotalDecisionTimeInMinutes   float64 `redis:"totalDecisionTimeInMinutes" json:"totalDecisionTimeInMinutes"`
+	AverageDecisionTimeInMinutes float64 `redis:"averageDecisionTimeInMinutes" json:"averageDecisionTimeInMinutes"`
+	// Approved members by the platform they join from, counted like the gender and age groups
+	JavaCount    int64 `redis:"javaCount" json:"javaCount"`
+	BedrockCount int64 `redis:"bedrockCount" json:"bedrockCount"`
+}
+
+// AggregateStats are records of some time-consuming results. The performance of ops is updated on every
+// decision, everything is recomputed at regular intervals
+type AggregateStats struct {
+	OvertimeCount    int                     `json:"overtimeCount"`
+	AdminPerformance map[string]*Performance `json:"adminPerformance"`
+	// ResubmissionRate is the share of denied requests the applicant resubmitted
+	ResubmissionRate float64 `json:"resubmissionRate"`
+	// Latency of the requests decided over the last 7 and 30 days
+	Latency []LatencyStats `json:"latency"`
+	// ApprovalBreakdown is the approval rate by the answers to the configured statsBreakdownField, if any
+	ApprovalBreakdown *ApprovalBreakdown `json:"approvalBreakdown,omitempty"`
+	// OpResponse is how quickly each op responds to the requests sent to them, by op
+	OpResponse []OpResponseStats `json:"opResponse"`
+	// Referrers are the members who vouched for applicants, most banned applicants first
+	Referrers []ReferrerStats `json:"referrers"`
+}
+
+// ApprovalBreakdown is the approval rate of decided requests by their answer to a field of the application form
+type ApprovalBreakdown struct {
+	Field   string           `json:"field"`
+	Answers []AnswerApproval `json:"answers"`
+}
+
+// AnswerApproval is the approval rate of the decided requests with the answer. The answer is empty for requests
+// which did not answer the field, e.g submitted before the field was added
+type AnswerApproval struct {
+	Answer       string  `json:"answer"`
+	Decided      int     `json:"decided"`
+	Approved     int     `json:"approved"`
+	ApprovalRate float64 `json:"approvalRate"`
+}
+
+// LatencyStats are the percentiles of how long applicants waited for the requests decided over the last Days
+// days. Time to decision is from the submission to the decision of an op, time to whitelist from the
+// submission to the worker whitelisting the player. Imported requests and requests never decided are left out
+type LatencyStats struct {
+	Days                  int     `json:"days"`
+	Decisions             int     `json:"decisions"`
+	DecisionP50InMinutes  float64 `json:"decisionP50InMinutes"`
+	DecisionP95InMinutes  float64 `json:"decisionP95InMinutes"`
+	Whitelisted           int     `json:"whitelisted"`
+	WhitelistP50InMinutes float64 `json:"whitelistP50InMinutes"`
+	WhitelistP95InMinutes float64 `json:"whitelistP95InMinutes"`
+}
+
+// SubmissionCount is the number of requests submitted on a UTC day, e.g 2019-11-03, within an hour of the day
+type SubmissionCount struct {
+	Day   string `bson:"day" json:"day"`
+	Hour  int    `bson:"hour" json:"hour"`
+	Count int64  `bson:"count" json:"count"`
+}
+
+// DecisionCount is the number of requests decided on a UTC day which are now in the status
+type DecisionCount struct {
+	Day    string `bson:"day" json:"day"`
+	Status string `bson:"status" json:"status"`
+	Count  int64  `bson:"count" json:"count"`
+}
+
+// OpDecisionCount is the number of requests an op approved or denied on a UTC day, from the audit log
+type OpDecisionCount struct {
+	Day    string `bson:"day" json:"day"`
+	Op     string `bson:"op" json:"op"`
+	Status string `bson:"status" json:"status"`
+	Count  int64  `bson:"count" json:"count"`
+}
+
+// TimeSeriesCounts are the daily counts the time-windowed stats are summed from, so any range within the
+// retained days is served without querying db again
+type TimeSeriesCounts struct {
+	Submissions      []SubmissionCount `json:"submissions"`
+	Decisions        []DecisionCount   `json:"decisions"`
+	UpdatedTimestamp time.Time         `json:"updatedTimestamp"`
+}
+
+// OpDecisionCounts are the daily counts the op leaderboard is summed from
+type OpDecisionCounts struct {
+	Decisions        []OpDecisionCount `json:"decisions"`
+	UpdatedTimestamp time.Time         `json:"updatedTimestamp"`
+}
+
+// TimeSeries are the submissions and decisions of each day of a range, and the submissions by hour of the day
+// (UTC) over the range. Days without any activity are listed with zero counts
+type TimeSeries struct {
+	ServerID          string     `json:"serverId,omitempty"`
+	From              string     `json:"from"`
+	To                string     `json:"to"`
+	Days              []DayStats `json:"days"`
+	SubmissionsByHour []int64    `json:"submissionsByHour"`
+	UpdatedTimestamp  time.Time  `json:"updatedTimestamp"`
+}
+
+// DayStats are the requests submitted on a day and the requests decided on it by their current status
+type DayStats struct {
+	Date      string           `json:"date"`
+	Submitted int64            `json:"submitted"`
+	Decided   map[string]int64 `json:"decided"`
+}
+
+// OpLeaderboard are the decisions of each op over a range, most decisions first
+type OpLeaderboard struct {
+	ServerID         string    `json:"serverId,omitempty"`
+	From             string    `json:"from"`
+	To               string    `json:"to"`
+	Ops              []OpStats `json:"ops"`
+	UpdatedTimestamp time.Time `json:"updatedTimestamp"`
+}
+
+// OpStats are the requests an op approved and denied. The approval rate is 0 if the op decided none
+type OpStats struct {
+	Op           string  `json:"op"`
+	Decisions    int64   `json:"decisions"`
+	Approved     int64   `json:"approved"`
+	Denied       int64   `json:"denied"`
+	ApprovalRate float64 `json:"approvalRate"`
+}
+
+// NetworkSignals are the prior requests submitted from the network of a request, so ops reviewing it see if it
+// comes from the same network as a banned player. BannedUsernames holds up to MaxSignalUsernames of them
+type NetworkSignals struct {
+	PriorRequests   int      `bson:"priorRequests" json:"priorRequests"`
+	PriorBanned     int      `bson:"priorBanned" json:"priorBanned"`
+	BannedUsernames []string `bson:"bannedUsernames,omitempty" json:"bannedUsernames,omitempty"`
+}
+
+// MaxSignalUsernames is the maximum number of banned usernames listed in NetworkSignals
+const MaxSignalUsernames = 5
+
+// Summary describes the signals to ops, e.g "2 prior requests from this network, 1 banned (Steve)". Empty if
+// there are no prior requests
+func (s NetworkSignals) Summary() string {
+	if s.PriorRequests == 0 {
+		return ""
+	}
+	summary := fmt.Sprintf("%d prior requests from this network", s.PriorRequests)
+	if s.PriorRequests == 1 {
+		summary = "1 prior request from this network"
+	}
+	if s.PriorBanned > 0 {
+		summary += fmt.Sprintf(", %d banned", s.PriorBanned)
+		if len(s.BannedUsernames) > 0 {
+			summary += " (" + strings.Join(s.BannedUsernames, ", ") + ")"
+		}
+	}
+	return summary
+}
+
+// OpResponseStats are the requests sent to an op and how the op responded. Decided counts the requests the op
+// decided first, MedianResponseTimeInMinutes is over them. EscalatedPast counts the requests escalated while
+// assigned to the op which the op did not decide. Decisions on requests never sent to the op are left out
+type OpResponseStats struct {
+	Op                          string  `bson:"op" json:"op"`
+	Assigned                    int64   `bson:"assigned" json:"assigned"`
+	Decided                     int64   `bson:"decided" json:"decided"`
+	MedianResponseTimeInMinutes float64 `bson:"-" json:"medianResponseTimeInMinutes"`
+	EscalatedPast               int64   `bson:"escalatedPast" json:"escalatedPast"`
+	// Response times of the decided requests, only read from db to compute the median
+	ResponseTimes []*float64 `bson:"responseTimes" json:"-"`
+}
+
+// QueueLoad is a snapshot of the current review queue, refreshed together with the aggregate stats
+type QueueLoad struct {
+	Pending  int64 `json:"pending"`
+	Approved int64 `json:"approved"`
+	// Median time to decide requests processed recently
+	MedianDecisionTimeInMinutes float64   `json:"medianDecisionTimeInMinutes"`
+	UpdatedTimestamp            time.Time `json:"updatedTimestamp"`
+}
+
+// Performance contains stats information about each ops
+type Performance struct {
+	TotalHandled                 int     `json:"totalHandled"`
+	AverageResponseTimeInMinutes float64 `json:"averageResponseTimeInMinutes"`
+	TotalResponseTimeInMinutes   float64 `json:"-"`
+}
+
+// TaskTypeHeader is the message header used to tell system tasks apart from whitelist request tasks
+const TaskTypeHeader = "x-task-type"
+
+// PublishedAtHeader is the message header holding the unix time a task was first published at. Retries keep
+// it, so it tells how long a task has been looping through the queues
+const PublishedAtHeader = "x-published-at"
+
+// PriorityHeader is the message header marking the tasks processed ahead of the others, see HighPriority. Retries
+// keep it, so they come back to the queue they were taken from
+const PriorityHeader = "x-priority"
+
+// PriorityHigh marks a task published to the high priority task queue
+const PriorityHigh = "high"
+
+// HighPriority tells whether the tasks of requests with the status jump the queue of new applications, so e.g the
+// ban of a griefer does not wait behind a backlog of application emails
+func HighPriority(status string) bool {
+	return status == StatusBanned || status == StatusDeactivated
+}
+
+// ConsoleTaskType marks a message carrying a ConsoleTask
+const ConsoleTaskType = "console"
+
+// ResendTaskType marks a message carrying a ResendTask
+const ResendTaskType = "resend"
+
+// CommentTaskType marks a message carrying a CommentTask
+const CommentTaskType = "comment"
+
+// Emails of a request admins may resend
+const (
+	EmailConfirmation = "confirmation"
+	EmailDecision     = "decision"
+	EmailOpsAction    = "ops-action"
+)
+
+// ResendTask asks the worker to send an email of a request again, e.g one caught by a spam filter. The links
+// in the email are signed anew
+type ResendTask struct {
+	ID      primitive.ObjectID `json:"_id"`
+	Request WhitelistRequest   `json:"request"`
+	// One of EmailConfirmation, EmailDecision and EmailOpsAction
+	Email string `json:"email"`
+	// Ops the action email is resent to
+	Ops   []string `json:"ops,omitempty"`
+	Actor string   `json:"actor"`
+}
+
+// CommentTask asks the worker to tell the other ops assigned to a request about a new comment on it
+type CommentTask struct {
+	Request WhitelistRequest `json:"request"`
+	Comment Comment          `json:"comment"`
+	// Ops notified by email, every assignee but the author
+	Ops []string `json:"ops"`
+}
+
+// RetryIDHeader is the message header holding the hex ID of the Retry recorded for a message parked in the retry
+// queue. The worker consumes the record when the message comes back, see Retry
+const RetryIDHeader = "x-retry-id"
+
+// Statuses of a retry
+const (
+	// RetryParked marks a message waiting in the retry queue
+	RetryParked = "Parked"
+	// RetryForced marks a message an admin published again to be retried right away
+	RetryForced = "Forced"
+	// RetryAbandoned marks a message an admin gave up on. It is dropped once it comes back
+	RetryAbandoned = "Abandoned"
+	// RetryConsumed marks a message that came back to the worker. Copies coming back later are dropped
+	RetryConsumed = "Consumed"
+)
+
+// Retry records a message the worker parked in the retry queue, so admins can see what is waiting without
+// the management UI of the message queue, retry it right away or abandon it
+type Retry struct {
+	ID primitive.ObjectID `bson:"_id" json:"_id"`
+	// TaskType is the task type header of the message, empty for whitelist request tasks
+	TaskType string `bson:"taskType,omitempty" json:"taskType,omitempty"`
+	// RequestID is the hex ID of the request the task is about, or of the console task
+	RequestID     string    `bson:"requestId,omitempty" json:"requestId,omitempty"`
+	Action        string    `bson:"action" json:"action"`
+	Attempt       int       `bson:"attempt" json:"attempt"`
+	NextAttemptAt time.Time `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	LastError     string    `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	Status        string    `bson:"status" json:"status"`
+	// Actor is the admin who forced or abandoned the retry
+	Actor      string     `bson:"actor,omitempty" json:"actor,omitempty"`
+	Timestamp  time.Time  `bson:"timestamp" json:"timestamp"`
+	ConsumedAt *time.Time `bson:"consumedAt,omitempty" json:"consumedAt,omitempty"`
+	// Message parked, published again if the retry is forced
+	Body    []byte                 `bson:"body" json:"-"`
+	Headers map[string]interface{} `bson:"headers" json:"-"`
+}
+
+// PhaseHeader is the message header holding the phase of a decision task left to carry out. A decision whose
+// game server action succeeded but whose email failed is retried with PhaseEmail, so only the email is sent again.
+// Tasks carrying out a decision on the game server track their progress with CompletedStepsHeader instead, and
+// only read it for messages published before
+const PhaseHeader = "x-phase"
+
+// CompletedStepsHeader is the message header holding the bitmask of the steps of a game server task completed
+// by earlier attempts. Updated on every retry publication, so a retry resumes from the first incomplete step
+const CompletedStepsHeader = "x-completed-steps"
+
+// SkipConfirmationHeader is set on retries of new request tasks, so the applicant only gets one confirmation email
+// and the request is not checked for duplicates again
+const SkipConfirmationHeader = "x-skip-confirmation"
+
+// Steps of the tasks carrying out a decision on the game server, in the order they are run
+const (
+	// StepServerAction runs the command of the decision on the game server
+	StepServerAction = 1 << iota
+	// StepPersistOnserverStatus records the state of the player on the game server
+	StepPersistOnserverStatus
+	// StepNotifyApplicant tells the applicant about the decision. Run first while the game server is in
+	// maintenance, as emails do not touch it
+	StepNotifyApplicant
+)
+
+// PhaseEmail marks a decision task of which only the decision email is left to send
+const PhaseEmail = "email"
+
+// PhaseServer marks a task of which only the game server action is left to carry out, the emails were sent the
+// first time. Set on tasks deferred until the end of a maintenance window and tasks republished by the recovery
+// pass before CompletedStepsHeader
+const PhaseServer = "server"
+
+// States of the player of a request on the game server, see WhitelistRequest.OnserverStatus
+const (
+	OnserverWhitelisted = "Whitelisted"
+	OnserverBanned      = "Banned"
+	// Neither whitelisted nor banned, e.g once deactivated or unbanned
+	OnserverRemoved = "Removed"
+)
+
+// ConsoleTask represent an allow-listed console command issued by the server owner
+// which is run on the game server by the worker
+type ConsoleTask struct {
+	ID                 primitive.ObjectID `bson:"_id" json:"_id"`
+	Command            string             `bson:"command" json:"command"`
+	Actor              string             `bson:"actor" json:"actor"`
+	Status             string             `bson:"status" json:"status"`
+	Response           string             `bson:"response" json:"response"`
+	Error              string             `bson:"error" json:"error,omitempty"`
+	Timestamp          time.Time          `bson:"timestamp" json:"timestamp"`
+	CompletedTimestamp time.Time          `bson:"completedTimestamp" json:"completedTimestamp"`
+}
+
+// FailedNotification is a decision email that could not be sent after max retries. Admins resend it once the
+// cause, e.g an unreachable SMTP server, is fixed
+type FailedNotification struct {
+	ID        primitive.ObjectID `bson:"_id" json:"_id"`
+	RequestID primitive.ObjectID `bson:"requestId" json:"requestId"`
+	ServerID  string             `bson:"serverId,omitempty" json:"serverId,omitempty"`
+	Username  string             `bson:"username" json:"username"`
+	Email     string             `bson:"email" json:"email"`
+	Status    string             `bson:"status" json:"status"`
+	Error     string             `bson:"error" json:"error"`
+	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+	ResentAt  *time.Time         `bson:"resentAt,omitempty" json:"resentAt,omitempty"`
+}
+
+// OutboxEntry is a task of a request change written in the same transaction as the change. The outbox relay
+// publishes the entries of a request in order and marks them sent, see worker.relayOutbox
+type OutboxEntry struct {
+	ID        primitive.ObjectID `bson:"_id" json:"_id"`
+	RequestID primitive.ObjectID `bson:"requestId" json:"requestId"`
+	Sequence  int64              `bson:"sequence" json:"sequence"`
+	// Body is the serialized task, as fields such as PreviousStatus are not stored with the request
+	Body      []byte    `bson:"body" json:"-"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	// Set once the message queue confirmed the publication
+	SentAt *time.Time `bson:"sentAt,omitempty" json:"sentAt,omitempty"`
+	// Relay instance the entry is claimed by until the lease expires
+	LeaseOwner string     `bson:"leaseOwner,omitempty" json:"leaseOwner,omitempty"`
+	LeaseUntil *time.Time `bson:"leaseUntil,omitempty" json:"leaseUntil,omitempty"`
+	Attempts   int        `bson:"attempts" json:"attempts"`
+}
+
+// EmailSuppression is an address emails are no longer sent to because an email to it bounced permanently
+type EmailSuppression struct {
+	Email     string    `bson:"_id" json:"email"`
+	Reason    string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	RequestID string    `bson:"requestId,omitempty" json:"requestId,omitempty"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// OpAway records that an op is away, e.g on vacation, until AwayUntil. Away ops are not dispatched new
+// requests and the pending requests assigned to them are dispatched to other ops. Op is the lowercase email
+type OpAway struct {
+	Op        string    `bson:"_id" json:"op"`
+	AwayUntil time.Time `bson:"awayUntil" json:"awayUntil"`
+	Reason    string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	Actor     string    `bson:"actor" json:"actor"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// Events ops are notified about. Ops choose the channels of each in their OpProfile
+const (
+	// OpEventRequest is the action email of a new request, also sent when it is re-dispatched or escalated
+	OpEventRequest = "request"
+	// OpEventReview is the reminder to review a provisional approval
+	OpEventReview = "review"
+	// OpEventComment is a comment of another op on a request assigned to the op
+	OpEventComment = "comment"
+	// OpEventDispute is a request ops voted differently on
+	OpEventDispute = "dispute"
+	// OpEventCancel is a request assigned to the op withdrawn by the applicant
+	OpEventCancel = "cancel"
+	// OpEventSLA is the digest of the requests pending longer than the SLA
+	OpEventSLA = "sla"
+	// OpEventFollowUp is the weekly report of the approved players flagged for follow-up
+	OpEventFollowUp = "followUp"
+)
+
+// OpEvents is every event ops can choose the channels of
+var OpEvents = []string{OpEventRequest, OpEventReview, OpEventComment, OpEventDispute, OpEventCancel, OpEventSLA, OpEventFollowUp}
+
+// Channels ops are notified through
+const (
+	OpChannelEmail = "email"
+	// OpChannelTelegram sends the op a message in their chat with the bot of telegramBotToken
+	OpChannelTelegram = "telegram"
+)
+
+// OpProfile is an op handling requests, managed by admins. Once there are profiles, requests are dispatched to
+// the ops of the profiles and the ops config only seeds them. Email is the lowercase email
+type OpProfile struct {
+	Email       string `bson:"_id" json:"email"`
+	DisplayName string `bson:"displayName,omitempty" json:"displayName,omitempty"`
+	// Server IDs of the tenants the op handles the requests of. The default tenant has the empty server ID
+	Tenants []string `bson:"tenants" json:"tenants"`
+	// Notifications are the channels the op is notified through by event, see OpEvents. Events left out are
+	// emailed, an empty list mutes the event
+	Notifications map[string][]string `bson:"notifications,omitempty" json:"notifications,omitempty"`
+	// TelegramChatID is the chat the Telegram notifications of the op are sent to
+	TelegramChatID string `bson:"telegramChatID,omitempty" json:"telegramChatID,omitempty"`
+	// Digest opts the op into the daily digest of pending requests instead of an action email for each new request
+	Digest    bool      `bson:"digest" json:"digest"`
+	Actor     string    `bson:"actor" json:"actor"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// Channels returns the channels the op is notified through about the event
+func (p OpProfile) Channels(event string) []string {
+	if channels, ok := p.Notifications[event]; ok {
+		return channels
+	}
+	return []string{OpChannelEmail}
+}
+
+// HandlesTenant tells if the op handles the requests of the tenant with the server ID
+func (p OpProfile) HandlesTenant(serverID string) bool {
+	for _, id := range p.Tenants {
+		if id == serverID {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditEntry represent a record of a privileged action performed in the system
+type AuditEntry struct {
+	ID        primitive.ObjectID     `bson:"_id" json:"_id"`
+	Action    string                 `bson:"action" json:"action"`
+	Actor     string                 `bson:"actor" json:"actor"`
+	Details   map[string]interface{} `bson:"details" json:"details"`
+	Timestamp time.Time              `bson:"timestamp" json:"timestamp"`
+	// Signature is the HMAC of SignedContent of entries that must not be edited unnoticed, e.g console commands
+	Signature string `bson:"signature,omitempty" json:"signature,omitempty"`
+}
+
+// SignedContent returns the content of the entry covered by its signature. The timestamp is in milliseconds,
+// the precision it is stored with
+func (e AuditEntry) SignedContent() ([]byte, error) {
+	return json.Marshal(struct {
+		Action    string                 `json:"action"`
+		Actor     string                 `json:"actor"`
+		Details   map[string]interface{} `json:"details"`
+		Timestamp int64                  `json:"timestamp"`
+	}{e.Action, e.Actor, e.Details, e.Timestamp.UnixNano() / int64(time.Millisecond)})
 }
@@ -0,0 +1,119 @@
+package types_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestResponseTime(t *testing.T) {
+	sent := time.Date(2019, 11, 7, 9, 0, 0, 0, time.UTC)
+	request := types.WhitelistRequest{Dispatches: []types.Dispatch{
+		{Op: "bob", Timestamp: sent.Add(time.Hour)},
+		{Op: "alice", Timestamp: sent},
+		// Sent again on escalation
+		{Op: "alice", Timestamp: sent.Add(2 * time.Hour)},
+	}}
+	cases := []struct {
+		op        string
+		decidedAt time.Time
+		expected  time.Duration
+		ok        bool
+	}{
+		{"alice", sent.Add(3 * time.Hour), 3 * time.Hour, true},
+		{"bob", sent.Add(90 * time.Minute), 30 * time.Minute, true},
+		// Decided by an op the request was never sent to, e.g in broadcast mode
+		{"carol", sent.Add(time.Hour), 0, false},
+		// Decided before it was sent to the op
+		{"bob", sent.Add(time.Minute), 0, false},
+	}
+	for _, c := range cases {
+		responseTime, ok := request.ResponseTime(c.op, c.decidedAt)
+		if responseTime != c.expected || ok != c.ok {
+			t.Errorf("Expected response time of %s to be %v %v, got %v %v", c.op, c.expected, c.ok, responseTime, ok)
+		}
+	}
+}
+
+func TestNetworkSignalsSummary(t *testing.T) {
+	tests := []struct {
+		signals types.NetworkSignals
+		summary string
+	}{
+		{types.NetworkSignals{}, ""},
+		{types.NetworkSignals{PriorRequests: 1}, "1 prior request from this network"},
+		{types.NetworkSignals{PriorRequests: 2, PriorBanned: 1}, "2 prior requests from this network, 1 banned"},
+		{types.NetworkSignals{PriorRequests: 3, PriorBanned: 2, BannedUsernames: []string{"Steve", "Alex"}}, "3 prior requests from this network, 2 banned (Steve, Alex)"},
+	}
+	for _, test := range tests {
+		if summary := test.signals.Summary(); summary != test.summary {
+			t.Errorf("Summary() of %+v = %q, want %q", test.signals, summary, test.summary)
+		}
+	}
+}
+
+func TestDecisionMilestone(t *testing.T) {
+	decided := time.Date(2019, 11, 7, 9, 0, 0, 0, time.UTC)
+	vote := func(op, decision string) types.Vote {
+		return types.Vote{Op: op, Decision: decision}
+	}
+	tests := []struct {
+		request   types.WhitelistRequest
+		name      string
+		reviewers int
+		ops       []string
+	}{
+		{types.WhitelistRequest{Status: types.StatusApproved, Admin: "alice@example.com"}, types.MilestoneApproved, 1, []string{"alice@example.com"}},
+		// Only the ops who voted for the decision made it, each once
+		{types.WhitelistRequest{Status: types.StatusDenied, Admin: "bob@example.com", Votes: []types.Vote{
+			vote("alice@example.com", types.StatusApproved),
+			vote("bob@example.com", types.StatusDenied),
+			vote("carol@example.com", types.StatusDenied),
+			vote("carol@example.com", types.StatusDenied),
+		}}, types.MilestoneDenied, 2, []string{"bob@example.com", "carol@example.com"}},
+		// Decided without a known op, e.g imported
+		{types.WhitelistRequest{Status: types.StatusApproved}, types.MilestoneApproved, 1, nil},
+	}
+	for _, test := range tests {
+		test.request.DecidedAt = &decided
+		milestone, ok := test.request.DecisionMilestone()
+		if !ok || milestone.Name != test.name || milestone.Reviewers != test.reviewers || !milestone.At.Equal(decided) ||
+			!reflect.DeepEqual(milestone.Ops, test.ops) {
+			t.Errorf("Expected %s by %d reviewers %v at %v, got %+v", test.name, test.reviewers, test.ops, decided, milestone)
+		}
+	}
+	if _, ok := (types.WhitelistRequest{Status: types.StatusPending}).DecisionMilestone(); ok {
+		t.Errorf("Expected no decision milestone for a pending request")
+	}
+}
+
+func TestReferralOf(t *testing.T) {
+	approved := types.WhitelistRequest{ID: primitive.NewObjectID(), Status: types.StatusApproved}
+	tests := []struct {
+		requests []types.WhitelistRequest
+		expected types.Referral
+	}{
+		{nil, types.Referral{Standing: types.ReferrerUnknown}},
+		{[]types.WhitelistRequest{{Status: types.StatusDenied}, {Status: types.StatusPending}}, types.Referral{Standing: types.ReferrerNotMember}},
+		{[]types.WhitelistRequest{{Status: types.StatusDenied}, approved}, types.Referral{Standing: types.ReferrerMember, ReferrerRequestID: approved.ID.Hex()}},
+		// A ban outweighs an approved request, e.g the member applied again with another email
+		{[]types.WhitelistRequest{approved, {Status: types.StatusBanned}}, types.Referral{Standing: types.ReferrerBanned}},
+	}
+	for _, test := range tests {
+		if referral := types.ReferralOf(test.requests); referral != test.expected {
+			t.Errorf("expected %+v for %v, got %+v", test.expected, test.requests, referral)
+		}
+	}
+	if !(types.Referral{Standing: types.ReferrerMember}).Verified() || (types.Referral{Standing: types.ReferrerNotMember}).Verified() {
+		t.Error("expected only members in good standing to be verified")
+	}
+	if summary := (types.Referral{Standing: types.ReferrerBanned}).Summary("Alex"); summary != "Vouched for by Alex, who is banned" {
+		t.Errorf("unexpected summary %q", summary)
+	}
+	if !types.SameReferrer(" steve", "Steve") || types.SameReferrer("Alex", "Steve") {
+		t.Error("expected referrers to be compared ignoring case and whitespace")
+	}
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTokenSignature is returned for tokens that are malformed or not signed with the secret
+	ErrTokenSignature = errors.New("Invalid token signature")
+	// ErrTokenExpired is returned for authentic tokens past their expiry
+	ErrTokenExpired = errors.New("Token has expired")
+)
+
+// ActionToken is the claim of an action link sent to an op. The nonce makes the link single use
+type ActionToken struct {
+	Op        string `json:"op"`
+	RequestID string `json:"req"`
+	Nonce     string `json:"nonce"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// NewNonce returns a random url safe nonce
+func NewNonce() (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return b64.RawURLEncoding.EncodeToString(nonce), nil
+}
+
+// SignActionToken encodes the token as <base64 claim>.<base64 HMAC-SHA256 of the claim>
+func SignActionToken(token ActionToken, secret string) (string, error) {
+	claim, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	payload := b64.RawURLEncoding.EncodeToString(claim)
+	return payload + "." + b64.RawURLEncoding.EncodeToString(signAction(payload, secret)), nil
+}
+
+// ParseActionToken verifies the signature of the token before checking its expiry, so only authentic
+// tokens are reported as expired
+func ParseActionToken(s, secret string, now time.Time) (ActionToken, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return ActionToken{}, ErrTokenSignature
+	}
+	signature, err := b64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, signAction(parts[0], secret)) {
+		return ActionToken{}, ErrTokenSignature
+	}
+	claim, err := b64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ActionToken{}, ErrTokenSignature
+	}
+	var token ActionToken
+	err = json.Unmarshal(claim, &token)
+	if err != nil {
+		return ActionToken{}, ErrTokenSignature
+	}
+	if now.Unix() >= token.ExpiresAt {
+		return token, ErrTokenExpired
+	}
+	return token, nil
+}
+
+// ParseActionTokenWith parses the token with the first of the secrets it is signed with and reports which one:
+// 0 for the primary, i for Previous[i-1]. Returns ErrTokenSignature if it is signed with none of them
+func ParseActionTokenWith(s string, secrets Secrets, now time.Time) (ActionToken, int, error) {
+	for i, secret := range secrets.all() {
+		token, err := ParseActionToken(s, secret, now)
+		if err != ErrTokenSignature {
+			return token, i, err
+		}
+	}
+	return ActionToken{}, 0, ErrTokenSignature
+}
+
+func signAction(payload, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("action." + payload))
+	return mac.Sum(nil)
+}
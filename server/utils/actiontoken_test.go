@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActionToken(t *testing.T) {
+	now := time.Unix(1573000000, 0)
+	token := ActionToken{Op: "op1@gmail.com", RequestID: "5dc4dc43f7310f4c2a005673", Nonce: "nonce", ExpiresAt: now.Add(time.Hour).Unix()}
+	signed, err := SignActionToken(token, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsLegacyToken(signed) {
+		t.Error("Expected signed token not to be taken for a legacy token")
+	}
+	parsed, err := ParseActionToken(signed, "passphrase", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != token {
+		t.Errorf("Expected %+v, got %+v", token, parsed)
+	}
+
+	if _, err := ParseActionToken(signed, "passphrase", now.Add(time.Hour)); err != ErrTokenExpired {
+		t.Errorf("Expected expired token, got %v", err)
+	}
+	if _, err := ParseActionToken(signed, "other passphrase", now); err != ErrTokenSignature {
+		t.Errorf("Expected token signed with another secret to be rejected, got %v", err)
+	}
+	// Extending the expiry invalidates the signature
+	token.ExpiresAt = now.Add(24 * time.Hour).Unix()
+	forged, _ := SignActionToken(token, "passphrase")
+	tampered := strings.Split(forged, ".")[0] + "." + strings.Split(signed, ".")[1]
+	if _, err := ParseActionToken(tampered, "passphrase", now); err != ErrTokenSignature {
+		t.Errorf("Expected tampered token to be rejected, got %v", err)
+	}
+	if _, err := ParseActionToken("garbage", "passphrase", now); err != ErrTokenSignature {
+		t.Errorf("Expected malformed token to be rejected, got %v", err)
+	}
+
+	legacy, _ := EncodeAndEncrypt("op1@gmail.com", "passphrase")
+	if !IsLegacyToken(legacy) {
+		t.Error("Expected encrypted op email to be taken for a legacy token")
+	}
+}
+
+func TestActionTokenOfPreviousSecret(t *testing.T) {
+	now := time.Unix(1573000000, 0)
+	token := ActionToken{Op: "op1@gmail.com", Nonce: "nonce", ExpiresAt: now.Add(time.Hour).Unix()}
+	signed, _ := SignActionToken(token, "old passphrase")
+	secrets := Secrets{Primary: "new passphrase", Previous: []string{"older passphrase", "old passphrase"}}
+	parsed, secret, err := ParseActionTokenWith(signed, secrets, now)
+	if err != nil || parsed != token || secret != 2 {
+		t.Errorf("Expected token of the second previous secret, got %+v %d %v", parsed, secret, err)
+	}
+	// Authentic tokens of previous secrets still expire
+	if _, _, err := ParseActionTokenWith(signed, secrets, now.Add(time.Hour)); err != ErrTokenExpired {
+		t.Errorf("Expected expired token, got %v", err)
+	}
+	if _, _, err := ParseActionTokenWith(signed, Secrets{Primary: "new passphrase"}, now); err != ErrTokenSignature {
+		t.Errorf("Expected token of an unknown secret to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// PurposeAttachment tokens identify the attachment served by a download link
+const PurposeAttachment = "attachment"
+
+// AttachmentURL returns the link downloading the attachment of the key from the API at apiURL. The key is
+// signed into the link, which expires after ttl
+func AttachmentURL(apiURL, key string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", errors.New("Attachment links must expire")
+	}
+	base, err := url.Parse(strings.TrimRight(strings.TrimSpace(apiURL), "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return "", errors.New("apiURL must be the absolute http or https URL of the API, e.g https://api.whitelist.example.com")
+	}
+	token, err := SignToken(key, PurposeAttachment, ttl)
+	if err != nil {
+		return "", err
+	}
+	return base.String() + "/api/v1/attachments/" + url.PathEscape(token), nil
+}
+
+// VerifyAttachmentToken returns the key of the attachment of the token of a download link, see VerifyToken
+func VerifyAttachmentToken(token string) (string, error) {
+	return VerifyToken(token, PurposeAttachment)
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestAttachmentURL(t *testing.T) {
+	defer viper.Set("linkSigningKeys", nil)
+	setSigningKeys(SigningKey{ID: "2019-11", Secret: "secret"})
+	key := "0123456789abcdef0123456789abcdef.png"
+	link, err := AttachmentURL("https://api.example.com/", key, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "https://api.example.com/api/v1/attachments/"
+	if !strings.HasPrefix(link, prefix) {
+		t.Fatalf("Expected a link to the API, got %s", link)
+	}
+	token := strings.TrimPrefix(link, prefix)
+	if verified, err := VerifyAttachmentToken(token); err != nil || verified != key {
+		t.Errorf("Expected the key of the link back, got %q %v", verified, err)
+	}
+	// Status and action tokens do not download attachments, nor the other way around
+	statusToken, _ := SignToken(key, PurposeStatus, time.Hour)
+	if _, err := VerifyAttachmentToken(statusToken); err != ErrTokenPurpose {
+		t.Errorf("Expected a status token to be rejected, got %v", err)
+	}
+	if _, err := VerifyToken(token, PurposeStatus, PurposeAction); err != ErrTokenPurpose {
+		t.Errorf("Expected an attachment token to be rejected as status token, got %v", err)
+	}
+	if _, err := AttachmentURL("https://api.example.com", key, 0); err == nil {
+		t.Error("Expected links that never expire to be refused")
+	}
+	if _, err := AttachmentURL("", key, time.Hour); err == nil {
+		t.Error("Expected the address of the API to be required")
+	}
+}
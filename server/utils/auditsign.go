@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	b64 "encoding/base64"
+)
+
+// SignAudit returns the base64 HMAC-SHA256 of the content of an audit entry, so entries edited in db after
+// the fact are detected
+func SignAudit(content []byte, secret string) string {
+	return b64.RawURLEncoding.EncodeToString(signAudit(content, secret))
+}
+
+// VerifyAudit reports whether the signature is of the content with any of the secrets, so entries signed
+// before a rotation still verify
+func VerifyAudit(content []byte, signature string, secrets Secrets) bool {
+	decoded, err := b64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	for _, secret := range secrets.all() {
+		if hmac.Equal(decoded, signAudit(content, secret)) {
+			return true
+		}
+	}
+	return false
+}
+
+func signAudit(content []byte, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("audit."))
+	mac.Write(content)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,20 @@
+package utils
+
+import "testing"
+
+func TestAuditSignature(t *testing.T) {
+	content := []byte(`{"action":"console.command","actor":"owner"}`)
+	signature := SignAudit(content, "old passphrase")
+	if !VerifyAudit(content, signature, Secrets{Primary: "passphrase", Previous: []string{"old passphrase"}}) {
+		t.Error("Expected the signature of a previous secret to verify")
+	}
+	if VerifyAudit(content, signature, Secrets{Primary: "passphrase"}) {
+		t.Error("Expected the signature not to verify with another secret")
+	}
+	if VerifyAudit([]byte(`{"action":"console.command","actor":"op"}`), signature, Secrets{Primary: "old passphrase"}) {
+		t.Error("Expected the signature not to verify for edited content")
+	}
+	if VerifyAudit(content, "not base64!", Secrets{Primary: "old passphrase"}) {
+		t.Error("Expected a malformed signature not to verify")
+	}
+}
@@ -5,11 +5,35 @@ import (
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/subtle"
 	b64 "encoding/base64"
 	"encoding/hex"
+	"errors"
 	"io"
+
+	"github.com/spf13/viper"
 )
 
+// ErrUnknownSecret is returned for data none of the secrets decrypts
+var ErrUnknownSecret = errors.New("Data is not encrypted with any of the secrets")
+
+// Secrets are the primary secret data is encrypted with and the previous secrets it replaced, most recent
+// first. Data encrypted before a rotation still decrypts as long as its secret is listed
+type Secrets struct {
+	Primary  string
+	Previous []string
+}
+
+// PassphraseSecrets reads the passphrase and the previousPassphrases it replaced
+func PassphraseSecrets() Secrets {
+	return Secrets{Primary: viper.GetString("passphrase"), Previous: viper.GetStringSlice("previousPassphrases")}
+}
+
+// all returns every secret, the primary first
+func (s Secrets) all() []string {
+	return append([]string{s.Primary}, s.Previous...)
+}
+
 func createHash(key string) string {
 	hasher := md5.New()
 	hasher.Write([]byte(key))
@@ -41,6 +65,9 @@ func decrypt(data []byte, passphrase string) ([]byte, error) {
 		return nil, err
 	}
 	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
@@ -71,3 +98,25 @@ func DecodeAndDecrypt(s, passphrase string) (string, error) {
 	}
 	return string(bytes), nil
 }
+
+// DecodeAndDecryptWith decrypts the data with the first of the secrets that works and reports which one did:
+// 0 for the primary, i for Previous[i-1]. Returns ErrUnknownSecret if none works
+func DecodeAndDecryptWith(s string, secrets Secrets) (string, int, error) {
+	sDec, err := b64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return "", 0, err
+	}
+	for i, secret := range secrets.all() {
+		bytes, err := decrypt(sDec, secret)
+		if err == nil {
+			return string(bytes), i, nil
+		}
+	}
+	return "", 0, ErrUnknownSecret
+}
+
+// ConstantTimeEqual compares two strings in a time independent of their content
+// so valid values can not be guessed byte by byte from response times
+func ConstantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
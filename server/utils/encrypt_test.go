@@ -0,0 +1,30 @@
+package utils
+
+import "testing"
+
+func TestDecryptAfterRotation(t *testing.T) {
+	oldToken, _ := EncodeAndEncrypt("5dc4dc43f7310f4c2a005673", "old passphrase")
+	secrets := Secrets{Primary: "new passphrase", Previous: []string{"old passphrase"}}
+	newToken, _ := EncodeAndEncrypt("5dc4dc43f7310f4c2a005674", secrets.Primary)
+	for _, test := range []struct {
+		token  string
+		data   string
+		secret int
+	}{
+		{oldToken, "5dc4dc43f7310f4c2a005673", 1},
+		{newToken, "5dc4dc43f7310f4c2a005674", 0},
+	} {
+		data, secret, err := DecodeAndDecryptWith(test.token, secrets)
+		if err != nil || data != test.data || secret != test.secret {
+			t.Errorf("Expected %s with secret %d, got %q %d %v", test.data, test.secret, data, secret, err)
+		}
+	}
+
+	// Tokens of a secret that is no longer listed fail cleanly
+	if data, _, err := DecodeAndDecryptWith(oldToken, Secrets{Primary: "new passphrase"}); err != ErrUnknownSecret || data != "" {
+		t.Errorf("Expected token of an unknown secret to be rejected, got %q %v", data, err)
+	}
+	if _, _, err := DecodeAndDecryptWith("not base64!", secrets); err == nil {
+		t.Error("Expected malformed token to be rejected")
+	}
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+)
+
+const (
+	// PurposeStatus tokens identify the request on the status page of the applicant
+	PurposeStatus = "status"
+	// PurposeAction tokens identify the request on the action page of an op
+	PurposeAction = "action"
+	// ID of the key derived from the passphrase if no link signing keys are configured
+	passphraseKeyID = "passphrase"
+)
+
+// ErrTokenPurpose is returned for authentic tokens issued for another purpose, e.g a status link used for an action
+var ErrTokenPurpose = errors.New("Token is not valid for this purpose")
+
+// SigningKey is a secret link tokens are signed with, identified by the kid header of the token
+type SigningKey struct {
+	ID     string `mapstructure:"id"`
+	Secret string `mapstructure:"secret"`
+}
+
+// LinkClaims is the claim of the token in the links of emails
+type LinkClaims struct {
+	RequestID string `json:"rid"`
+	Purpose   string `json:"purpose"`
+	jwt.StandardClaims
+}
+
+// LinkSigningKeys reads the configured keys of link tokens. New tokens are signed with the first key, tokens
+// signed with any of the keys are accepted. The passphrase and the previous passphrases are used if no keys
+// are configured, so rotating the passphrase does not invalidate links
+func LinkSigningKeys() ([]SigningKey, error) {
+	var keys []SigningKey
+	err := viper.UnmarshalKey("linkSigningKeys", &keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		for _, secret := range PassphraseSecrets().all() {
+			keys = append(keys, SigningKey{ID: passphraseKeyID, Secret: secret})
+		}
+		return keys, nil
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key.ID == "" || key.Secret == "" {
+			return nil, errors.New("Link signing key without id or secret")
+		}
+		if seen[key.ID] {
+			return nil, fmt.Errorf("Duplicate link signing key id %s", key.ID)
+		}
+		seen[key.ID] = true
+	}
+	return keys, nil
+}
+
+// SignToken issues a HS256 JWT of the request for the purpose, signed with the primary link signing key.
+// The token expires after ttl, or never if ttl is 0
+func SignToken(requestID, purpose string, ttl time.Duration) (string, error) {
+	keys, err := LinkSigningKeys()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := LinkClaims{
+		RequestID:      requestID,
+		Purpose:        purpose,
+		StandardClaims: jwt.StandardClaims{IssuedAt: now.Unix()},
+	}
+	if ttl > 0 {
+		claims.ExpiresAt = now.Add(ttl).Unix()
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = keys[0].ID
+	return token.SignedString([]byte(keys[0].Secret))
+}
+
+// VerifyToken returns the request ID of the token if it is signed by one of the link signing keys, has not
+// expired and was issued for one of the purposes. Returns ErrTokenSignature, ErrTokenExpired or ErrTokenPurpose
+func VerifyToken(token string, purposes ...string) (string, error) {
+	keys, err := LinkSigningKeys()
+	if err != nil {
+		return "", err
+	}
+	var claims LinkClaims
+	// Only the expiry is checked so tokens issued by a host with a clock slightly ahead are accepted
+	parser := &jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Alg()}, SkipClaimsValidation: true}
+	// Keys derived from the passphrases share their id, so every key of the id is tried
+	err = ErrTokenSignature
+	for _, key := range keys {
+		claims = LinkClaims{}
+		_, err = parser.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+			if kid, _ := t.Header["kid"].(string); kid != key.ID {
+				return nil, ErrTokenSignature
+			}
+			return []byte(key.Secret), nil
+		})
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", ErrTokenSignature
+	}
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return "", ErrTokenExpired
+	}
+	for _, purpose := range purposes {
+		if claims.Purpose == purpose {
+			return claims.RequestID, nil
+		}
+	}
+	return "", ErrTokenPurpose
+}
+
+// IsLegacyToken reports whether the token is a request ID encrypted by EncodeAndEncrypt, as sent in links
+// before they were signed
+func IsLegacyToken(token string) bool {
+	return !strings.Contains(token, ".")
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func setSigningKeys(keys ...SigningKey) {
+	configured := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		configured = append(configured, map[string]interface{}{"id": key.ID, "secret": key.Secret})
+	}
+	viper.Set("linkSigningKeys", configured)
+}
+
+func TestLinkTokenKeyRotation(t *testing.T) {
+	defer viper.Set("linkSigningKeys", nil)
+	oldKey := SigningKey{ID: "2019-10", Secret: "old-secret"}
+	newKey := SigningKey{ID: "2019-11", Secret: "new-secret"}
+	setSigningKeys(oldKey)
+	oldToken, err := SignToken("5dc4dc43f7310f4c2a005673", PurposeStatus, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Links signed with the old key stay valid while it is still configured
+	setSigningKeys(newKey, oldKey)
+	newToken, err := SignToken("5dc4dc43f7310f4c2a005673", PurposeStatus, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		requestID, err := VerifyToken(token, PurposeStatus)
+		if err != nil || requestID != "5dc4dc43f7310f4c2a005673" {
+			t.Errorf("Expected token to be valid during rotation, got %q %v", requestID, err)
+		}
+	}
+
+	// Once the old key is removed only links signed with the new key are valid
+	setSigningKeys(newKey)
+	if _, err := VerifyToken(oldToken, PurposeStatus); err != ErrTokenSignature {
+		t.Errorf("Expected token of removed key to be rejected, got %v", err)
+	}
+	if _, err := VerifyToken(newToken, PurposeStatus); err != nil {
+		t.Errorf("Expected token of new key to be valid, got %v", err)
+	}
+	// A key with the same id and another secret does not verify the token
+	setSigningKeys(SigningKey{ID: "2019-11", Secret: "leaked"})
+	if _, err := VerifyToken(newToken, PurposeStatus); err != ErrTokenSignature {
+		t.Errorf("Expected token to be rejected with another secret, got %v", err)
+	}
+}
+
+func TestLinkTokenTampering(t *testing.T) {
+	defer viper.Set("linkSigningKeys", nil)
+	setSigningKeys(SigningKey{ID: "k1", Secret: "secret"})
+	token, err := SignToken("5dc4dc43f7310f4c2a005673", PurposeStatus, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	other, _ := SignToken("5dc4dc43f7310f4c2a005674", PurposeAction, 0)
+	tampered := []string{
+		// Claims of another request with the signature of the original token
+		parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2],
+		parts[0] + "." + parts[1] + "." + parts[2][:len(parts[2])-2] + "AA",
+		// Unsigned tokens are rejected
+		"eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0." + parts[1] + ".",
+		"garbage",
+	}
+	for _, token := range tampered {
+		if _, err := VerifyToken(token, PurposeStatus, PurposeAction); err != ErrTokenSignature {
+			t.Errorf("Expected tampered token %s to be rejected, got %v", token, err)
+		}
+	}
+}
+
+func TestLinkTokenPurposeAndExpiry(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	// The passphrase signs tokens if no keys are configured
+	statusToken, err := SignToken("5dc4dc43f7310f4c2a005673", PurposeStatus, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyToken(statusToken, PurposeAction); err != ErrTokenPurpose {
+		t.Errorf("Expected status token to be rejected for actions, got %v", err)
+	}
+	if _, err := VerifyToken(statusToken, PurposeStatus, PurposeAction); err != nil {
+		t.Errorf("Expected status token to be valid for either purpose, got %v", err)
+	}
+	if IsLegacyToken(statusToken) {
+		t.Error("Expected signed token not to be taken for a legacy token")
+	}
+	shortToken, _ := SignToken("5dc4dc43f7310f4c2a005673", PurposeAction, time.Second)
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := VerifyToken(shortToken, PurposeAction); err != ErrTokenExpired {
+		t.Errorf("Expected expired token, got %v", err)
+	}
+}
+
+func TestLinkSigningKeysValidation(t *testing.T) {
+	defer viper.Set("linkSigningKeys", nil)
+	setSigningKeys(SigningKey{ID: "k1", Secret: "a"}, SigningKey{ID: "k1", Secret: "b"})
+	if _, err := LinkSigningKeys(); err == nil {
+		t.Error("Expected duplicate key ids to be rejected")
+	}
+	setSigningKeys(SigningKey{ID: "k1"})
+	if _, err := LinkSigningKeys(); err == nil {
+		t.Error("Expected key without secret to be rejected")
+	}
+}
+
+func TestLinkTokenPassphraseRotation(t *testing.T) {
+	defer viper.Set("previousPassphrases", nil)
+	defer viper.Set("passphrase", nil)
+	viper.Set("passphrase", "old passphrase")
+	oldToken, err := SignToken("5dc4dc43f7310f4c2a005673", PurposeStatus, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("passphrase", "new passphrase")
+	viper.Set("previousPassphrases", []string{"old passphrase"})
+	if requestID, err := VerifyToken(oldToken, PurposeStatus); err != nil || requestID != "5dc4dc43f7310f4c2a005673" {
+		t.Errorf("Expected token of the previous passphrase to be valid, got %q %v", requestID, err)
+	}
+	viper.Set("previousPassphrases", nil)
+	if _, err := VerifyToken(oldToken, PurposeStatus); err != ErrTokenSignature {
+		t.Errorf("Expected token of a removed passphrase to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"strconv"
+)
+
+// SignMessage returns the base64 HMAC-SHA256 of the body of a queue message, the unix time it is signed at, its
+// ID and its canonical headers, so messages published to the queues by anyone but the API server and the worker
+// are detected
+func SignMessage(body []byte, signedAt int64, id, headers, secret string) string {
+	return b64.RawURLEncoding.EncodeToString(signMessage(body, signedAt, id, headers, secret))
+}
+
+// VerifyMessage reports whether the signature is of the message with any of the secrets, so messages published
+// before a rotation still verify
+func VerifyMessage(body []byte, signedAt int64, id, headers, signature string, secrets Secrets) bool {
+	decoded, err := b64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	for _, secret := range secrets.all() {
+		if hmac.Equal(decoded, signMessage(body, signedAt, id, headers, secret)) {
+			return true
+		}
+	}
+	return false
+}
+
+func signMessage(body []byte, signedAt int64, id, headers, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("message." + strconv.FormatInt(signedAt, 10) + "." + id + "." + headers + "."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
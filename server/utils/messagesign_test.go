@@ -0,0 +1,23 @@
+package utils
+
+import "testing"
+
+func TestMessageSignature(t *testing.T) {
+	body := []byte(`{"schemaVersion":2,"request":{"status":"Approved"}}`)
+	signature := SignMessage(body, 1700000000, "id", "x-phase:email\n", "old passphrase")
+	if !VerifyMessage(body, 1700000000, "id", "x-phase:email\n", signature, Secrets{Primary: "passphrase", Previous: []string{"old passphrase"}}) {
+		t.Error("Expected the signature of a previous secret to verify")
+	}
+	if VerifyMessage(body, 1700000000, "other id", "x-phase:email\n", signature, Secrets{Primary: "old passphrase"}) {
+		t.Error("Expected the signature not to verify with another message ID")
+	}
+	if VerifyMessage(body, 1800000000, "id", "x-phase:email\n", signature, Secrets{Primary: "old passphrase"}) {
+		t.Error("Expected the signature not to verify with another signing time")
+	}
+	if VerifyMessage([]byte(`{"schemaVersion":2,"request":{"status":"Banned"}}`), 1700000000, "id", "x-phase:email\n", signature, Secrets{Primary: "old passphrase"}) {
+		t.Error("Expected the signature not to verify for an edited body")
+	}
+	if VerifyMessage(body, 1700000000, "id", "x-phase:\n", signature, Secrets{Primary: "old passphrase"}) {
+		t.Error("Expected the signature not to verify for edited headers")
+	}
+}
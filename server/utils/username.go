@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 16
+)
+
+// ErrInvalidUsername is returned for usernames Minecraft does not allow. Only letters, digits and underscores are
+// allowed, so a username can not smuggle whitespace or a second command into the RCON commands it is used in
+var ErrInvalidUsername = errors.New("Invalid username. Minecraft usernames are 3 to 16 letters, digits or underscores")
+
+// NormalizeUsername trims the whitespace pasted around the username. The case is kept, usernames are
+// compared ignoring case
+func NormalizeUsername(username string) string {
+	return strings.TrimSpace(username)
+}
+
+// ValidateUsername checks the normalized username is a valid Minecraft username: 3 to 16 ASCII letters,
+// digits or underscores
+func ValidateUsername(username string) error {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return ErrInvalidUsername
+	}
+	for _, r := range username {
+		valid := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_'
+		if !valid {
+			return ErrInvalidUsername
+		}
+	}
+	return nil
+}
+
+// Platforms players join the game server from. Bedrock players join through Geyser and are named by Floodgate
+// after their Xbox gamertag, prefixed so they can not clash with the usernames of Java players
+const (
+	PlatformJava    = "java"
+	PlatformBedrock = "bedrock"
+)
+
+// DefaultBedrockPrefix is the username prefix of Bedrock players unless Floodgate is configured otherwise
+const DefaultBedrockPrefix = "."
+
+// bedrockPrefixChars are the characters a Bedrock username prefix may use. None of them can smuggle whitespace or
+// a second command into the RCON commands the username is used in
+const bedrockPrefixChars = ".*!~+-#"
+
+// ErrInvalidBedrockUsername is returned for Bedrock usernames Floodgate does not give
+var ErrInvalidBedrockUsername = errors.New("Invalid username. Bedrock gamertags are letters, digits, spaces or underscores, " +
+	"and at most 16 characters with the prefix")
+
+// ValidPlatform tells if the platform is known. Requests without platform are from Java players
+func ValidPlatform(platform string) bool {
+	return platform == "" || platform == PlatformJava || platform == PlatformBedrock
+}
+
+// ValidBedrockPrefix tells if the prefix can be used for Bedrock usernames: empty, or up to 2 of the characters
+// Floodgate is commonly configured with
+func ValidBedrockPrefix(prefix string) bool {
+	if len(prefix) > 2 {
+		return false
+	}
+	for _, r := range prefix {
+		if !strings.ContainsRune(bedrockPrefixChars, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeBedrockUsername turns the gamertag into the username Floodgate gives the player: the whitespace around
+// it trimmed, spaces replaced with underscores, the prefix added if missing and cut to 16 characters
+func NormalizeBedrockUsername(username, prefix string) string {
+	username = strings.Replace(NormalizeUsername(username), " ", "_", -1)
+	if !strings.HasPrefix(username, prefix) {
+		username = prefix + username
+	}
+	if len(username) > maxUsernameLength {
+		username = username[:maxUsernameLength]
+	}
+	return username
+}
+
+// IsInvalidUsername tells if the error is the validation error of a Java or a Bedrock username
+func IsInvalidUsername(err error) bool {
+	return err == ErrInvalidUsername || err == ErrInvalidBedrockUsername
+}
+
+// ValidateBedrockUsername checks the normalized username is the prefix followed by the gamertag as Floodgate names
+// the player: at least one ASCII letter, digit or underscore and 16 characters at most overall
+func ValidateBedrockUsername(username, prefix string) error {
+	gamertag := strings.TrimPrefix(username, prefix)
+	if !strings.HasPrefix(username, prefix) || gamertag == "" || len(username) > maxUsernameLength {
+		return ErrInvalidBedrockUsername
+	}
+	for _, r := range gamertag {
+		valid := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_'
+		if !valid {
+			return ErrInvalidBedrockUsername
+		}
+	}
+	return nil
+}
+
+// ValidPlayerName tells if the name is a valid Java username or a Bedrock username with any valid prefix, e.g an
+// argument of a console command which may name players of any tenant
+func ValidPlayerName(name string) bool {
+	if ValidateUsername(name) == nil {
+		return true
+	}
+	gamertag := strings.TrimLeft(name, bedrockPrefixChars)
+	prefix := name[:len(name)-len(gamertag)]
+	return prefix != "" && ValidBedrockPrefix(prefix) && ValidateBedrockUsername(name, prefix) == nil
+}
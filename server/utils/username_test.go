@@ -0,0 +1,117 @@
+package utils
+
+import "testing"
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		valid    bool
+	}{
+		{"letters", "Steve", true},
+		{"digits and underscore", "alex_2019", true},
+		{"minimum length", "abc", true},
+		{"maximum length", "abcdefghijklmnop", true},
+		{"too short", "ab", false},
+		{"17 chars", "abcdefghijklmnopq", false},
+		{"empty", "", false},
+		{"space", "Steve Jobs", false},
+		{"trailing newline", "Steve\n", false},
+		{"second command", "Steve\nop Griefer", false},
+		{"semicolon", "Steve;op", false},
+		{"control character", "Ste\x00ve", false},
+		{"tab", "Steve\tx", false},
+		{"cyrillic homoglyph", "Stеve", false},
+		{"fullwidth letters", "Ｓteve", false},
+		{"accented letter", "Stéve", false},
+		{"hyphen", "Steve-1", false},
+	}
+	for _, test := range tests {
+		err := ValidateUsername(test.username)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected %q to be valid, got %v", test.name, test.username, err)
+		}
+		if !test.valid && err != ErrInvalidUsername {
+			t.Errorf("%s: expected %q to be invalid, got %v", test.name, test.username, err)
+		}
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		username   string
+		normalized string
+	}{
+		{"Steve", "Steve"},
+		{"  Steve ", "Steve"},
+		{"Steve\n", "Steve"},
+		{"\tSteve\r\n", "Steve"},
+		{"Ste ve", "Ste ve"},
+	}
+	for _, test := range tests {
+		if normalized := NormalizeUsername(test.username); normalized != test.normalized {
+			t.Errorf("Expected %q to be normalized to %q, got %q", test.username, test.normalized, normalized)
+		}
+	}
+}
+
+func TestValidateBedrockUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		prefix   string
+		valid    bool
+	}{
+		{".Steve", ".", true},
+		{".St", ".", true},
+		{".x", ".", true},
+		{".Steve_Jobs_2019", ".", true},
+		{"*Steve", "*", true},
+		{"Steve", "", true},
+		{"Steve", ".", false},
+		{".", ".", false},
+		{".Steve_Jobs_20191", ".", false},
+		{".Steve Jobs", ".", false},
+		{".Steve;op", ".", false},
+		{".Steve\nop Griefer", ".", false},
+		{"..Steve", ".", false},
+	}
+	for _, test := range tests {
+		err := ValidateBedrockUsername(test.username, test.prefix)
+		if test.valid && err != nil {
+			t.Errorf("Expected %q with prefix %q to be valid, got %v", test.username, test.prefix, err)
+		}
+		if !test.valid && err != ErrInvalidBedrockUsername {
+			t.Errorf("Expected %q with prefix %q to be invalid, got %v", test.username, test.prefix, err)
+		}
+	}
+}
+
+func TestNormalizeBedrockUsername(t *testing.T) {
+	tests := []struct {
+		username   string
+		prefix     string
+		normalized string
+	}{
+		{"Steve", ".", ".Steve"},
+		{".Steve", ".", ".Steve"},
+		{" Steve Jobs\n", ".", ".Steve_Jobs"},
+		{"Steve", "*", "*Steve"},
+		{"Steve", "", "Steve"},
+		// Cut to 16 characters like Floodgate does
+		{"ABCDEFGHIJKLMNOP", ".", ".ABCDEFGHIJKLMNO"},
+	}
+	for _, test := range tests {
+		if normalized := NormalizeBedrockUsername(test.username, test.prefix); normalized != test.normalized {
+			t.Errorf("Expected %q to be normalized to %q, got %q", test.username, test.normalized, normalized)
+		}
+	}
+}
+
+func TestValidBedrockPrefix(t *testing.T) {
+	for prefix, valid := range map[string]bool{"": true, ".": true, "*": true, "#!": true, "...": false, "a": false,
+		" ": false, "/": false, ";": false} {
+		if ValidBedrockPrefix(prefix) != valid {
+			t.Errorf("Expected prefix %q to be valid: %v", prefix, valid)
+		}
+	}
+}
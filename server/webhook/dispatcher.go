@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+)
+
+const (
+	// StatusChangeEvent is sent whenever the status of a request changes
+	StatusChangeEvent = "request.status"
+	// QueueAlertEvent is sent when the message queue backs up or messages get stuck in it
+	QueueAlertEvent = "queue.alert"
+	// CommentEvent is sent when an op comments on a request, if commentNotification is webhook
+	CommentEvent = "request.comment"
+	// BulkDecisionEvent is sent once for the status changes of a bulk decision, if bulkDecisionWebhookSummary is set
+	BulkDecisionEvent = "requests.bulk"
+	// Deliveries waiting to be sent, including retries. Deliveries are dropped while the queue is full
+	deliveryQueueSize = 1000
+)
+
+// StatusChange is the data of a StatusChangeEvent. PreviousStatus is empty for new requests
+type StatusChange struct {
+	RequestID      string    `json:"requestId"`
+	Username       string    `json:"username"`
+	PreviousStatus string    `json:"previousStatus"`
+	Status         string    `json:"status"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// BulkDecision is the data of a BulkDecisionEvent. Changes are the status changes of the requests of the bulk
+// decision processed by the worker sending the event
+type BulkDecision struct {
+	BulkID    string         `json:"bulkId"`
+	Status    string         `json:"status"`
+	Changes   []StatusChange `json:"changes"`
+	Timestamp time.Time      `json:"timestamp"`
+}
+
+// QueueAlert is the data of a QueueAlertEvent. Value exceeded Threshold, both are a number of messages
+// for depth conditions and seconds for the message age
+type QueueAlert struct {
+	Condition string    `json:"condition"`
+	Queue     string    `json:"queue"`
+	Value     int64     `json:"value"`
+	Threshold int64     `json:"threshold"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Comment is the data of a CommentEvent. Author is the email of the op
+type Comment struct {
+	RequestID string    `json:"requestId"`
+	Username  string    `json:"username"`
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type delivery struct {
+	endpoint Endpoint
+	event    Event
+	attempt  int
+}
+
+// Dispatcher delivers events to all configured endpoints in the background. Failed deliveries are
+// retried with an exponential backoff and dropped after maxAttempts
+type Dispatcher struct {
+	send        func(Endpoint, Event) (DeliveryResult, error)
+	deliveries  chan delivery
+	maxAttempts int
+	backoff     time.Duration
+	logger      *logrus.Entry
+}
+
+// NewDispatcher creates a dispatcher sending events with the sender. The first retry is made after backoff,
+// doubling the delay for every further attempt
+func NewDispatcher(sender *Sender, maxAttempts int, backoff time.Duration, logger *logrus.Entry) *Dispatcher {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &Dispatcher{
+		send:        sender.Send,
+		deliveries:  make(chan delivery, deliveryQueueSize),
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		logger:      logger,
+	}
+}
+
+// Run sends the queued deliveries until the process exits
+func (d *Dispatcher) Run() {
+	for delivery := range d.deliveries {
+		d.deliver(delivery)
+	}
+}
+
+// Enqueue queues the event for every configured endpoint. Never blocks: the event is dropped for
+// endpoints it can not be queued for
+func (d *Dispatcher) Enqueue(event Event) {
+	endpoints, err := ParseEndpoints()
+	if err != nil {
+		d.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Invalid webhooks configuration")
+		return
+	}
+	for _, endpoint := range endpoints {
+		d.queue(delivery{endpoint: endpoint, event: event, attempt: 1})
+	}
+}
+
+func (d *Dispatcher) queue(delivery delivery) {
+	select {
+	case d.deliveries <- delivery:
+	default:
+		d.drop(delivery, "queue_full")
+	}
+}
+
+// deliver sends the event to the endpoint. Deliveries not answered with a 2xx response are queued
+// again after the backoff of the attempt
+func (d *Dispatcher) deliver(delivery delivery) {
+	result, err := d.send(delivery.endpoint, delivery.event)
+	if err == nil && result.StatusCode >= 200 && result.StatusCode < 300 {
+		return
+	}
+	fields := logrus.Fields{
+		"url":     delivery.endpoint.URL,
+		"event":   delivery.event.Event,
+		"attempt": delivery.attempt,
+	}
+	if err != nil {
+		fields["err"] = err.Error()
+	} else {
+		fields["statusCode"] = result.StatusCode
+	}
+	d.logger.WithFields(fields).Warning("Unable to deliver webhook")
+	if delivery.attempt >= d.maxAttempts {
+		d.drop(delivery, "exhausted")
+		return
+	}
+	delay := d.backoff << uint(delivery.attempt-1)
+	delivery.attempt++
+	time.AfterFunc(delay, func() {
+		d.queue(delivery)
+	})
+}
+
+func (d *Dispatcher) drop(delivery delivery, reason string) {
+	metrics.WebhooksDropped.WithLabelValues(reason).Inc()
+	d.logger.WithFields(logrus.Fields{
+		"url":     delivery.endpoint.URL,
+		"event":   delivery.event.Event,
+		"attempt": delivery.attempt,
+		"reason":  reason,
+	}).Error("Webhook delivery dropped")
+}
@@ -0,0 +1,213 @@
+// Package webhook delivers signed event notifications to external systems, e.g a Discord bot.
+//
+// Each request carries the following headers so receivers can verify authenticity:
+//
+//	X-Webhook-Timestamp: unix time the request was signed at
+//	X-Webhook-Key-Id:    ID of the primary signing key of the endpoint
+//	X-Webhook-Signature: comma separated <keyID>=<hex HMAC-SHA256 of "<timestamp>.<body>"> for every key
+//
+// Keys are rotated without downtime by adding the new key in front of the old one, letting receivers
+// pick up the new key and removing the old key afterwards
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// TimestampHeader carries the unix time the request was signed at
+	TimestampHeader = "X-Webhook-Timestamp"
+	// KeyIDHeader carries the ID of the primary signing key
+	KeyIDHeader = "X-Webhook-Key-Id"
+	// SignatureHeader carries the signatures of the request by every key of the endpoint
+	SignatureHeader = "X-Webhook-Signature"
+	// PingEvent is sent to let integrators verify their verification code
+	PingEvent = "ping"
+	// Maximum size of the receiver response kept in a DeliveryResult
+	maxResponseBody = 4096
+)
+
+// Key is a shared secret used to sign requests to an endpoint
+type Key struct {
+	ID     string `mapstructure:"id" json:"id"`
+	Secret string `mapstructure:"secret" json:"-"`
+}
+
+// Endpoint is an external system receiving webhooks. The first key is the primary key
+type Endpoint struct {
+	URL  string `mapstructure:"url" json:"url"`
+	Keys []Key  `mapstructure:"keys" json:"keys"`
+}
+
+// Event is the payload delivered to endpoints
+type Event struct {
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// DeliveryResult reports how an endpoint responded to a delivery
+type DeliveryResult struct {
+	StatusCode         int      `json:"statusCode"`
+	Body               string   `json:"body"`
+	DurationInMillisec int64    `json:"durationInMillisec"`
+	KeyIDs             []string `json:"keyIds"`
+}
+
+// ParseEndpoints reads the configured webhook endpoints
+func ParseEndpoints() ([]Endpoint, error) {
+	var endpoints []Endpoint
+	err := viper.UnmarshalKey("webhooks", &endpoints)
+	if err != nil {
+		return nil, err
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.URL == "" {
+			return nil, errors.New("Webhook endpoint url is required")
+		}
+		if len(endpoint.Keys) == 0 {
+			return nil, fmt.Errorf("Webhook endpoint %s has no signing keys", endpoint.URL)
+		}
+		seen := make(map[string]bool)
+		for _, key := range endpoint.Keys {
+			if key.ID == "" || key.Secret == "" {
+				return nil, fmt.Errorf("Webhook endpoint %s has a key without id or secret", endpoint.URL)
+			}
+			if seen[key.ID] {
+				return nil, fmt.Errorf("Webhook endpoint %s has duplicate key id %s", endpoint.URL, key.ID)
+			}
+			seen[key.ID] = true
+		}
+	}
+	return endpoints, nil
+}
+
+// FindEndpoint returns the configured endpoint with the given url
+func FindEndpoint(url string) (Endpoint, bool, error) {
+	endpoints, err := ParseEndpoints()
+	if err != nil {
+		return Endpoint{}, false, err
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.URL == url {
+			return endpoint, true, nil
+		}
+	}
+	return Endpoint{}, false, nil
+}
+
+// Sign computes the hex HMAC-SHA256 signature of the body signed at the given unix timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureHeaderValue signs the body with every key of the endpoint
+func SignatureHeaderValue(keys []Key, timestamp int64, body []byte) string {
+	signatures := make([]string, 0, len(keys))
+	for _, key := range keys {
+		signatures = append(signatures, key.ID+"="+Sign(key.Secret, timestamp, body))
+	}
+	return strings.Join(signatures, ",")
+}
+
+// Verify checks the signature header of a received webhook against the receiver's keys.
+// A request is authentic if any signature was made by one of the known keys
+func Verify(keys []Key, timestamp int64, body []byte, signatureHeader string) bool {
+	secrets := make(map[string]string)
+	for _, key := range keys {
+		secrets[key.ID] = key.Secret
+	}
+	for _, signature := range strings.Split(signatureHeader, ",") {
+		parts := strings.SplitN(strings.TrimSpace(signature), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		secret, ok := secrets[parts[0]]
+		if !ok {
+			continue
+		}
+		if hmac.Equal([]byte(parts[1]), []byte(Sign(secret, timestamp, body))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sender delivers signed webhooks over http
+type Sender struct {
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewSender creates a sender with the given http client. A client with a 10 seconds timeout is used if nil
+func NewSender(client *http.Client) *Sender {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Sender{client: client, now: time.Now}
+}
+
+// Send delivers the event to the endpoint. Any response from the receiver is reported in the result,
+// an error is only returned if the request could not be made
+func (s *Sender) Send(endpoint Endpoint, event Event) (DeliveryResult, error) {
+	if len(endpoint.Keys) == 0 {
+		return DeliveryResult{}, fmt.Errorf("Webhook endpoint %s has no signing keys", endpoint.URL)
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return DeliveryResult{}, err
+	}
+	timestamp := s.now().Unix()
+	req, err := http.NewRequest("POST", endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return DeliveryResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(KeyIDHeader, endpoint.Keys[0].ID)
+	req.Header.Set(SignatureHeader, SignatureHeaderValue(endpoint.Keys, timestamp, body))
+
+	keyIDs := make([]string, 0, len(endpoint.Keys))
+	for _, key := range endpoint.Keys {
+		keyIDs = append(keyIDs, key.ID)
+	}
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return DeliveryResult{}, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	return DeliveryResult{
+		StatusCode:         resp.StatusCode,
+		Body:               string(respBody),
+		DurationInMillisec: time.Since(start).Nanoseconds() / int64(time.Millisecond),
+		KeyIDs:             keyIDs,
+	}, nil
+}
+
+// Ping sends a signed test event to the endpoint
+func (s *Sender) Ping(endpoint Endpoint) (DeliveryResult, error) {
+	return s.Send(endpoint, Event{
+		Event:     PingEvent,
+		Timestamp: s.now(),
+		Data:      map[string]string{"message": "This is a test webhook"},
+	})
+}
@@ -0,0 +1,225 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/webhook"
+)
+
+var oldKey = webhook.Key{ID: "2019-10", Secret: "old-secret"}
+var newKey = webhook.Key{ID: "2019-11", Secret: "new-secret"}
+
+func TestSignWithMultipleKeys(t *testing.T) {
+	body := []byte(`{"event":"ping"}`)
+	var timestamp int64 = 1573000000
+	header := webhook.SignatureHeaderValue([]webhook.Key{newKey, oldKey}, timestamp, body)
+
+	signatures := strings.Split(header, ",")
+	if len(signatures) != 2 {
+		t.Fatalf("Expected one signature per key, got %s", header)
+	}
+	if signatures[0] != newKey.ID+"="+webhook.Sign(newKey.Secret, timestamp, body) {
+		t.Errorf("Expected the primary key signature first, got %s", signatures[0])
+	}
+	if signatures[1] != oldKey.ID+"="+webhook.Sign(oldKey.Secret, timestamp, body) {
+		t.Errorf("Expected the old key signature second, got %s", signatures[1])
+	}
+
+	// Receivers knowing either key accept the request during rotation
+	if !webhook.Verify([]webhook.Key{oldKey}, timestamp, body, header) {
+		t.Error("Expected receiver with the old key to verify the request")
+	}
+	if !webhook.Verify([]webhook.Key{newKey}, timestamp, body, header) {
+		t.Error("Expected receiver with the new key to verify the request")
+	}
+	// Tampered bodies, replayed timestamps and unknown keys are rejected
+	if webhook.Verify([]webhook.Key{oldKey, newKey}, timestamp, []byte(`{"event":"pong"}`), header) {
+		t.Error("Expected tampered body to fail verification")
+	}
+	if webhook.Verify([]webhook.Key{oldKey, newKey}, timestamp+1, body, header) {
+		t.Error("Expected different timestamp to fail verification")
+	}
+	if webhook.Verify([]webhook.Key{{ID: "2019-10", Secret: "wrong"}}, timestamp, body, header) {
+		t.Error("Expected wrong secret to fail verification")
+	}
+}
+
+func TestPingStubReceiver(t *testing.T) {
+	var receivedKeyID string
+	var receivedEvent webhook.Event
+	// The stub receiver only knows the old key, as if it has not rotated yet
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp, err := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+		if err != nil || !webhook.Verify([]webhook.Key{oldKey}, timestamp, body, r.Header.Get(webhook.SignatureHeader)) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		receivedKeyID = r.Header.Get(webhook.KeyIDHeader)
+		json.Unmarshal(body, &receivedEvent)
+		w.Write([]byte("pong"))
+	}))
+	defer receiver.Close()
+
+	sender := webhook.NewSender(receiver.Client())
+	result, err := sender.Ping(webhook.Endpoint{URL: receiver.URL, Keys: []webhook.Key{newKey, oldKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusOK || result.Body != "pong" {
+		t.Errorf("Expected receiver to accept the ping, got %d %s", result.StatusCode, result.Body)
+	}
+	if receivedKeyID != newKey.ID {
+		t.Errorf("Expected primary key id %s, got %s", newKey.ID, receivedKeyID)
+	}
+	if receivedEvent.Event != webhook.PingEvent {
+		t.Errorf("Expected ping event, got %s", receivedEvent.Event)
+	}
+	if len(result.KeyIDs) != 2 || result.KeyIDs[0] != newKey.ID || result.KeyIDs[1] != oldKey.ID {
+		t.Errorf("Expected result to report the signing key ids, got %v", result.KeyIDs)
+	}
+
+	// Once the old key is removed the receiver rejects the request and the result reports it
+	result, err = sender.Ping(webhook.Endpoint{URL: receiver.URL, Keys: []webhook.Key{newKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected receiver to reject the ping, got %d", result.StatusCode)
+	}
+}
+
+func TestParseEndpoints(t *testing.T) {
+	defer viper.Set("webhooks", nil)
+	viper.Set("webhooks", []interface{}{
+		map[string]interface{}{
+			"url": "https://bot.example.com/hook",
+			"keys": []interface{}{
+				map[string]interface{}{"id": "2019-11", "secret": "new-secret"},
+				map[string]interface{}{"id": "2019-10", "secret": "old-secret"},
+			},
+		},
+	})
+	endpoints, err := webhook.ParseEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || len(endpoints[0].Keys) != 2 || endpoints[0].Keys[0] != newKey {
+		t.Errorf("Unexpected endpoints %+v", endpoints)
+	}
+
+	viper.Set("webhooks", []interface{}{
+		map[string]interface{}{
+			"url": "https://bot.example.com/hook",
+			"keys": []interface{}{
+				map[string]interface{}{"id": "2019-11", "secret": "a"},
+				map[string]interface{}{"id": "2019-11", "secret": "b"},
+			},
+		},
+	})
+	if _, err := webhook.ParseEndpoints(); err == nil {
+		t.Error("Expected duplicate key ids to be rejected")
+	}
+}
+
+func configureEndpoint(url string) {
+	viper.Set("webhooks", []interface{}{
+		map[string]interface{}{
+			"url":  url,
+			"keys": []interface{}{map[string]interface{}{"id": newKey.ID, "secret": newKey.Secret}},
+		},
+	})
+}
+
+func TestDispatcherRetriesSignedStatusChange(t *testing.T) {
+	received := make(chan webhook.StatusChange, 1)
+	attempts := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+		if !webhook.Verify([]webhook.Key{newKey}, timestamp, body, r.Header.Get(webhook.SignatureHeader)) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		var event struct {
+			Event string               `json:"event"`
+			Data  webhook.StatusChange `json:"data"`
+		}
+		json.Unmarshal(body, &event)
+		if event.Event == webhook.StatusChangeEvent {
+			received <- event.Data
+		}
+	}))
+	defer receiver.Close()
+	defer viper.Set("webhooks", nil)
+	configureEndpoint(receiver.URL)
+
+	dispatcher := webhook.NewDispatcher(webhook.NewSender(receiver.Client()), 5, time.Millisecond, logrus.NewEntry(logrus.New()))
+	go dispatcher.Run()
+	dispatcher.Enqueue(webhook.Event{
+		Event:     webhook.StatusChangeEvent,
+		Timestamp: time.Now(),
+		Data: webhook.StatusChange{
+			RequestID:      "5dc2b8f7b4c1a2e3f4a5b6c7",
+			Username:       "steve",
+			PreviousStatus: "Pending",
+			Status:         "Approved",
+			Timestamp:      time.Now(),
+		},
+	})
+	select {
+	case change := <-received:
+		if change.Username != "steve" || change.PreviousStatus != "Pending" || change.Status != "Approved" {
+			t.Errorf("Unexpected status change %+v", change)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the status change to be delivered after retries")
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestDispatcherDropsAfterMaxAttempts(t *testing.T) {
+	attempts := make(chan struct{}, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts <- struct{}{}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+	defer viper.Set("webhooks", nil)
+	configureEndpoint(receiver.URL)
+
+	before := testutil.ToFloat64(metrics.WebhooksDropped.WithLabelValues("exhausted"))
+	dispatcher := webhook.NewDispatcher(webhook.NewSender(receiver.Client()), 2, time.Millisecond, logrus.NewEntry(logrus.New()))
+	go dispatcher.Run()
+	dispatcher.Enqueue(webhook.Event{Event: webhook.StatusChangeEvent, Timestamp: time.Now()})
+
+	deadline := time.After(5 * time.Second)
+	for dropped := 0.0; dropped != 1; dropped = testutil.ToFloat64(metrics.WebhooksDropped.WithLabelValues("exhausted")) - before {
+		select {
+		case <-deadline:
+			t.Fatal("Expected the delivery to be dropped")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if len(attempts) != 2 {
+		t.Errorf("Expected 2 attempts before dropping, got %d", len(attempts))
+	}
+}
@@ -0,0 +1,207 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// Set on new request tasks held until the application window opened, so they are processed once back
+const applicationHoldHeader = "x-held-for-application-window"
+
+// maxApplicationsOpen is the longest applications are told to stay open for, when windows follow each other
+const maxApplicationsOpen = 366 * 24 * time.Hour
+
+// maxApplicationWindow is the longest a recurring application window lasts, so occurrences of consecutive months
+// never overlap
+const maxApplicationWindow = 28 * 24 * time.Hour
+
+// ApplicationWindow is a window during which new requests are accepted. Recurring windows open every month on Day
+// at Hour:Minute wall clock time in Location and last Duration. Explicit windows are open from Opens until Closes
+type ApplicationWindow struct {
+	Day, Hour, Minute int
+	Duration          time.Duration
+	Location          *time.Location
+	Opens, Closes     time.Time
+}
+
+// ApplicationWindowState tells if requests are accepted. ClosesAt is set while the window is open, NextOpening
+// while it is closed unless no window opens anymore
+type ApplicationWindowState struct {
+	Open        bool       `json:"open"`
+	ClosesAt    *time.Time `json:"closesAt,omitempty"`
+	NextOpening *time.Time `json:"nextOpening,omitempty"`
+}
+
+// ParseApplicationWindows reads the application windows of the tenant, the top level windows if the tenant has
+// none of its own. Requests are accepted at any time without windows
+func ParseApplicationWindows(cfg tenant.Config) ([]ApplicationWindow, error) {
+	entries, _ := cfg.Get("applicationWindows").([]interface{})
+	windows := make([]ApplicationWindow, 0, len(entries))
+	for i, entry := range entries {
+		window, err := parseApplicationWindow(stringKeys(entry))
+		if err != nil {
+			return nil, fmt.Errorf("applicationWindows[%d]: %s", i, err.Error())
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// ValidateApplicationWindows checks the application windows of every tenant
+func ValidateApplicationWindows() error {
+	for _, cfg := range tenant.All() {
+		_, err := ParseApplicationWindows(cfg)
+		if err != nil && cfg.ID != "" {
+			return fmt.Errorf("%s of tenant %s", err.Error(), cfg.ID)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseApplicationWindow(fields map[string]interface{}) (ApplicationWindow, error) {
+	if fields["opens"] != nil || fields["closes"] != nil {
+		opens, err := parseWindowTime(fields["opens"])
+		if err != nil {
+			return ApplicationWindow{}, fmt.Errorf("invalid opens: %s", err.Error())
+		}
+		closes, err := parseWindowTime(fields["closes"])
+		if err != nil {
+			return ApplicationWindow{}, fmt.Errorf("invalid closes: %s", err.Error())
+		}
+		if !closes.After(opens) {
+			return ApplicationWindow{}, errors.New("closes must be after opens")
+		}
+		return ApplicationWindow{Opens: opens, Closes: closes}, nil
+	}
+	day, ok := fields["day"].(int)
+	if !ok || day < 1 || day > 28 {
+		return ApplicationWindow{}, fmt.Errorf("invalid day %v, expected the day of the month from 1 to 28", fields["day"])
+	}
+	start, err := parseTimeOfDay(fields["start"])
+	if err != nil {
+		return ApplicationWindow{}, err
+	}
+	if start >= 24*time.Hour {
+		return ApplicationWindow{}, fmt.Errorf("invalid start %q, expected HH:MM before 24:00", fields["start"])
+	}
+	window := ApplicationWindow{
+		Day:      day,
+		Hour:     int(start / time.Hour),
+		Minute:   int(start % time.Hour / time.Minute),
+		Location: defaultLocation(),
+	}
+	duration, _ := fields["duration"].(string)
+	window.Duration, err = time.ParseDuration(strings.TrimSpace(duration))
+	if err != nil || window.Duration <= 0 || window.Duration > maxApplicationWindow {
+		return ApplicationWindow{}, fmt.Errorf("invalid duration %q, expected e.g 168h, at most 672h", duration)
+	}
+	if timezone, _ := fields["timezone"].(string); timezone != "" {
+		window.Location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return ApplicationWindow{}, fmt.Errorf("unknown timezone %q", timezone)
+		}
+	}
+	return window, nil
+}
+
+// parseWindowTime reads a RFC 3339 time, which YAML may have decoded already
+func parseWindowTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		return time.Parse(time.RFC3339, strings.TrimSpace(v))
+	}
+	return time.Time{}, fmt.Errorf("%v is not a RFC 3339 time", value)
+}
+
+// occurrences returns the start and end of the occurrences of the window which may be in progress at t or start
+// after it, the earliest first
+func (w ApplicationWindow) occurrences(t time.Time) [][2]time.Time {
+	if !w.Opens.IsZero() {
+		return [][2]time.Time{{w.Opens, w.Closes}}
+	}
+	local := t.In(w.Location)
+	spans := make([][2]time.Time, 0, 3)
+	for months := -1; months <= 1; months++ {
+		start := time.Date(local.Year(), local.Month()+time.Month(months), w.Day, w.Hour, w.Minute, 0, 0, w.Location)
+		spans = append(spans, [2]time.Time{start, start.Add(w.Duration)})
+	}
+	return spans
+}
+
+// applicationWindowState tells if one of the windows is open at t. Windows overlapping or following each other
+// without a gap count as one, up to maxApplicationsOpen
+func applicationWindowState(windows []ApplicationWindow, t time.Time) ApplicationWindowState {
+	if len(windows) == 0 {
+		return ApplicationWindowState{Open: true}
+	}
+	end := t
+	for extended := true; extended && end.Sub(t) < maxApplicationsOpen; {
+		extended = false
+		for _, window := range windows {
+			for _, span := range window.occurrences(end) {
+				if !end.Before(span[0]) && span[1].After(end) {
+					end = span[1]
+					extended = true
+				}
+			}
+		}
+	}
+	if end.After(t) {
+		return ApplicationWindowState{Open: true, ClosesAt: &end}
+	}
+	var next *time.Time
+	for _, window := range windows {
+		for _, span := range window.occurrences(t) {
+			if span[0].After(t) && (next == nil || span[0].Before(*next)) {
+				start := span[0]
+				next = &start
+			}
+		}
+	}
+	return ApplicationWindowState{NextOpening: next}
+}
+
+// ApplicationWindowAt tells if the tenant accepts new requests at t. Invalid windows are rejected on startup, see
+// ParseApplicationWindows, and accept requests at any time otherwise
+func ApplicationWindowAt(cfg tenant.Config, t time.Time) ApplicationWindowState {
+	windows, err := ParseApplicationWindows(cfg)
+	if err != nil {
+		return ApplicationWindowState{Open: true}
+	}
+	return applicationWindowState(windows, t)
+}
+
+// holdOutsideApplicationWindow holds new requests submitted while the applications of the tenant were closed until
+// the next window opens, e.g submitted while the window closed on the API server first. Requests submitted before
+// the window closed are processed normally. Returns true if the request is held
+func (worker *Worker) holdOutsideApplicationWindow(d amqp.Delivery, request types.WhitelistRequest) bool {
+	if held, _ := d.Headers[applicationHoldHeader].(bool); held || request.Canary || request.Bench != "" || request.Timestamp.IsZero() {
+		return false
+	}
+	state := ApplicationWindowAt(requestTenant(request), request.Timestamp)
+	if state.Open || state.NextOpening == nil || !state.NextOpening.After(time.Now()) {
+		return false
+	}
+	action := "Hold request of " + request.Username + " until the application window opens"
+	if worker.deferTask(d, time.Until(*state.NextOpening), action, errApplicationsClosed, amqp.Table{applicationHoldHeader: true}) {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":    request.ID.Hex(),
+			"until": state.NextOpening.Format(time.RFC3339),
+		}).Warning("Request submitted outside of the application windows. Held until the next window opens")
+	}
+	return true
+}
+
+// errApplicationsClosed is recorded as the cause of held requests, see holdOutsideApplicationWindow
+var errApplicationsClosed = errors.New("Applications closed")
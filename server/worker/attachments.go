@@ -0,0 +1,28 @@
+package worker
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/attachments"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// attachmentsTemplateData returns the signed links to the attachments of the request shown to ops in the action
+// email. Best effort only, the email is sent without them if they can not be signed
+func (worker *Worker) attachmentsTemplateData(request types.WhitelistRequest) []string {
+	if len(request.Attachments) == 0 {
+		return nil
+	}
+	links, err := attachments.Links(request.Attachments, attachments.EmailLinkTTL())
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Warning("Unable to sign the links to the attachments of the request")
+		return nil
+	}
+	urls := make([]string, 0, len(links))
+	for _, link := range links {
+		urls = append(urls, link.URL)
+	}
+	return urls
+}
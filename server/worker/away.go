@@ -0,0 +1,133 @@
+package worker
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// opAvailabilityStore tells which ops are away, e.g on vacation. Implemented by the db
+type opAvailabilityStore interface {
+	GetAwayOps(now time.Time) ([]types.OpAway, error)
+}
+
+// awayOps returns the lowercase emails of the ops away at the time. Read on every dispatch, so ops marked
+// back are dispatched requests again right away. Nobody is away if it can not be told
+func (worker *Worker) awayOps(now time.Time) map[string]bool {
+	away := make(map[string]bool)
+	if worker.availability == nil {
+		return away
+	}
+	records, err := worker.availability.GetAwayOps(now)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to get away ops. Dispatching to every op")
+		return away
+	}
+	for _, record := range records {
+		away[strings.ToLower(record.Op)] = true
+	}
+	return away
+}
+
+// presentOps leaves out the away ops. Falls back to all the ops if every op is away so requests are never
+// sent to nobody
+func presentOps(ops []string, away map[string]bool) []string {
+	present := make([]string, 0, len(ops))
+	for _, op := range ops {
+		if !away[strings.ToLower(op)] {
+			present = append(present, op)
+		}
+	}
+	if len(present) == 0 {
+		return ops
+	}
+	return present
+}
+
+// withoutAwayOps splits the assignees into the ones still present and the away ones
+func withoutAwayOps(assignees []string, away map[string]bool) ([]string, []string) {
+	remaining := make([]string, 0, len(assignees))
+	removed := make([]string, 0)
+	for _, op := range assignees {
+		if away[strings.ToLower(op)] {
+			removed = append(removed, op)
+		} else {
+			remaining = append(remaining, op)
+		}
+	}
+	return remaining, removed
+}
+
+// excludingOps returns the ops which are not in excluded, ignoring case
+func excludingOps(ops, excluded []string) []string {
+	skip := make(map[string]bool, len(excluded))
+	for _, op := range excluded {
+		skip[strings.ToLower(op)] = true
+	}
+	kept := make([]string, 0, len(ops))
+	for _, op := range ops {
+		if !skip[strings.ToLower(op)] {
+			kept = append(kept, op)
+		}
+	}
+	return kept
+}
+
+// redispatchFromAwayOps dispatches the pending requests assigned to away ops to ops who are not assigned yet,
+// chosen by the dispatching strategy among the present ops. The away ops are removed from the assignees.
+// Requests are left with their assignees if no other op can take them. Ops get pending requests with the
+// next digest in digest mode, so nothing is re-dispatched
+func (worker *Worker) redispatchFromAwayOps() error {
+	if digestMode() {
+		return nil
+	}
+	away := worker.awayOps(time.Now())
+	if len(away) == 0 {
+		return nil
+	}
+	assignedRequests, err := worker.store.QueryRequests(db.RequestFilter{
+		Statuses:           []string{types.StatusPending},
+		ExcludeAwaitingOps: true,
+		Assigned:           true,
+	})
+	if err != nil {
+		return err
+	}
+	for _, request := range assignedRequests {
+		remaining, removed := withoutAwayOps(request.Assignees, away)
+		if len(removed) == 0 || !tenant.Known(request.ServerID) {
+			continue
+		}
+		targets := excludingOps(worker.getTargetOps(requestTenant(request)), request.Assignees)
+		if len(targets) == 0 {
+			continue
+		}
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		// Claim the request by its assignees so concurrent workers do not re-dispatch it twice
+		err := worker.store.ReplaceAssignees(request.ID, request.Assignees, remaining)
+		if err == db.ErrConflict {
+			continue
+		} else if err != nil {
+			return err
+		}
+		worker.logger.WithFields(logrus.Fields{
+			"ID":      request.ID.Hex(),
+			"awayOps": removed,
+			"targets": targets,
+		}).Info("Assigned ops are away. Re-dispatching request")
+		notifiedOps, _, err := worker.emailToOps(request, targets)
+		if err != nil {
+			return err
+		}
+		worker.addAssignees(request, notifiedOps)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/tywin1104/mc-gatekeeper/proxy"
+	"github.com/tywin1104/mc-gatekeeper/serverfile"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// Integrations carrying out decisions on the game server, selected by serverBackend
+const (
+	rconBackend = "rcon"
+	httpBackend = "http"
+	fileBackend = "file"
+)
+
+// errNoRCON is returned for commands of tenants whose game server is only reachable through the proxy plugin
+// or its files
+var errNoRCON = errors.New("No RCON server configured. The game server is managed through serverBackend")
+
+// ServerBackend carries out decisions on the game server. Implemented by the RCON commands of the tenant,
+// by proxy.Client and by serverfile.Backend. Failed actions are retried, so they must be safe to carry out again
+type ServerBackend interface {
+	Whitelist(request types.WhitelistRequest) error
+	Unwhitelist(request types.WhitelistRequest) error
+	Ban(request types.WhitelistRequest) error
+	Pardon(request types.WhitelistRequest) error
+}
+
+// ValidateServerBackends checks the serverBackend of every tenant, the endpoint of the http backends and the
+// game server directory of the file backends
+func ValidateServerBackends() error {
+	for _, cfg := range tenant.All() {
+		err := validateServerBackend(cfg)
+		if err != nil && cfg.ID != "" {
+			return fmt.Errorf("%s of tenant %s", err.Error(), cfg.ID)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateServerBackend(cfg tenant.Config) error {
+	switch backend := cfg.GetString("serverBackend"); backend {
+	case "", rconBackend:
+	case httpBackend:
+		endpoint, err := url.Parse(cfg.GetString("serverBackendURL"))
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return fmt.Errorf("serverBackendURL %q must be an absolute http(s) URL", cfg.GetString("serverBackendURL"))
+		}
+		if cfg.GetString("serverBackendToken") == "" {
+			return errors.New("Empty serverBackendToken")
+		}
+	case fileBackend:
+		dir := cfg.GetString("serverBackendDir")
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("serverBackendDir %q must be the directory of the game server", dir)
+		}
+		// Bedrock players have no Mojang UUID for the files
+		if BedrockEnabled(cfg) {
+			return errors.New("bedrockEnabled requires serverBackend rcon or http")
+		}
+	default:
+		return fmt.Errorf("Unknown serverBackend %q. Allowed values: [%s, %s, %s]", backend, rconBackend, httpBackend, fileBackend)
+	}
+	return nil
+}
+
+// usesRCON tells if the tenant can run commands on its game server. Tenants managed through the proxy plugin
+// or the files of the game server may still configure RCON for console commands and the reconciliation
+func usesRCON(cfg tenant.Config) bool {
+	backend := cfg.GetString("serverBackend")
+	return (backend != httpBackend && backend != fileBackend) || cfg.GetString("RCONServer") != ""
+}
+
+// backendFor returns the backend carrying out the decisions on the game server of the tenant
+func (worker *Worker) backendFor(cfg tenant.Config) ServerBackend {
+	backend := cfg.GetString("serverBackend")
+	if backend != httpBackend && backend != fileBackend {
+		return rconCommands{worker: worker}
+	}
+	if DryRun() {
+		return &dryRunBackend{logger: worker.logger}
+	}
+	if backend == fileBackend {
+		return serverfile.NewBackend(cfg.GetString("serverBackendDir"), cfg.GetString("serverBackendReloadCommand"))
+	}
+	return proxy.NewClient(cfg.GetString("serverBackendURL"), cfg.GetString("serverBackendToken"), nil)
+}
+
+// rconCommands runs the configured commands of the actions on the game server of the request's tenant
+type rconCommands struct {
+	worker *Worker
+}
+
+func (b rconCommands) Whitelist(request types.WhitelistRequest) error {
+	return b.worker.runAction(approveCommandKey, request)
+}
+
+func (b rconCommands) Unwhitelist(request types.WhitelistRequest) error {
+	return b.worker.runAction(deactivateCommandKey, request)
+}
+
+func (b rconCommands) Ban(request types.WhitelistRequest) error {
+	return b.worker.runAction(banCommandKey, request)
+}
+
+func (b rconCommands) Pardon(request types.WhitelistRequest) error {
+	return b.worker.runAction(unbanCommandKey, request)
+}
@@ -0,0 +1,54 @@
+package worker
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/telegram"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// alerter sends urgent messages to the ops, e.g a Telegram chat
+type alerter interface {
+	Send(text string) error
+}
+
+// newBanAlerter returns the Telegram chat bans are confirmed in if telegramBanAlerts is set. Independent of the
+// email and webhook notifications
+func newBanAlerter() alerter {
+	if !viper.GetBool("telegramBanAlerts") {
+		return nil
+	}
+	return telegram.NewClient(viper.GetString("telegramAPIURL"), viper.GetString("telegramBotToken"),
+		viper.GetString("telegramChatID"), nil)
+}
+
+// banAlertText is the message confirming the ban of the request on the game server, or telling it failed for good
+func banAlertText(request types.WhitelistRequest, err error) string {
+	if err != nil {
+		return fmt.Sprintf("Ban of %s FAILED on the game server: %s. Request %s", request.Username, err.Error(), request.ID.Hex())
+	}
+	text := fmt.Sprintf("%s is banned on the game server. Request %s", request.Username, request.ID.Hex())
+	if request.Admin != "" {
+		text += ", banned by " + request.Admin
+	}
+	return text
+}
+
+// alertBan tells the ops whether the ban of the request landed on the game server. The message is sent in the
+// background and failures are only logged, so the alert never holds up or fails the task
+func (worker *Worker) alertBan(request types.WhitelistRequest, err error) {
+	if worker.banAlerts == nil {
+		return
+	}
+	text := banAlertText(request, err)
+	go func() {
+		if err := worker.banAlerts.Send(text); err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"username": request.Username,
+				"err":      err.Error(),
+			}).Warning("Unable to send the ban alert")
+		}
+	}()
+}
@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// Decision reason of new requests denied because the player has been banned before
+const bannedDenialReason = "previously banned"
+
+// rejectBanned checks the banned usernames in the cache before the request is dispatched to ops.
+// Banned emails are checked with the duplicates by rejectDuplicate
+func (worker *Worker) rejectBanned(request types.WhitelistRequest) bool {
+	banned, err := worker.cache.IsUsernameBanned(request.ServerID, request.Username)
+	if err != nil {
+		// The duplicate check still finds banned requests in db
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Warning("Unable to check banned usernames")
+		return false
+	}
+	if !banned {
+		return false
+	}
+	return worker.denyBanned(request)
+}
+
+// denyBanned denies a new request of a banned player without dispatching it to ops and tells the
+// applicant why. Returns false if the request could not be denied, so it is dispatched as usual
+func (worker *Worker) denyBanned(request types.WhitelistRequest) bool {
+	deniedRequest, err := worker.store.TransitionStatus(request.ID, bannedDenial(time.Now()))
+	if err == db.ErrConflict {
+		// The request has been decided or removed in the meantime
+		return true
+	} else if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Error("Unable to deny request of banned player")
+		return false
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"ID":       request.ID.Hex(),
+		"username": request.Username,
+	}).Warning("Request of banned player denied. Skip dispatching to ops")
+	// Counted as submitted and then denied
+	worker.updateCache(request)
+	worker.updateCache(deniedRequest)
+	worker.emailBannedRejection(deniedRequest)
+	// Told as submitted and then denied
+	worker.notifyStatusChange(request)
+	deniedRequest.PreviousStatus = types.StatusPending
+	worker.notifyStatusChange(deniedRequest)
+	return true
+}
+
+func bannedDenial(now time.Time) db.StatusChange {
+	return db.StatusChange{
+		From:   types.StatusPending,
+		To:     types.StatusDenied,
+		At:     now,
+		Admin:  workerActor,
+		Reason: bannedDenialReason,
+	}
+}
+
+// updateBannedUsernames keeps the banned usernames in the cache in line with a ban or an unban. Best effort
+// only, they are rebuilt from db when the stats are synced
+func (worker *Worker) updateBannedUsernames(request types.WhitelistRequest) {
+	var err error
+	if request.Status == types.StatusBanned {
+		err = worker.requestCache.AddBannedUsername(request.ServerID, request.Username)
+	} else {
+		err = worker.requestCache.RemoveBannedUsername(request.ServerID, request.Username)
+	}
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"username": request.Username,
+			"err":      err.Error(),
+		}).Warning("Unable to update banned usernames in cache")
+	}
+}
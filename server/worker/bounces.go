@@ -0,0 +1,73 @@
+package worker
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/mailer"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// bounceStore keeps the addresses emails bounced from and the Message-IDs of the emails sent to applicants.
+// Implemented by the db
+type bounceStore interface {
+	EmailSuppressed(email string) (bool, error)
+	RecordMessageID(id primitive.ObjectID, messageID string) error
+	MarkRequestEmailUndeliverable(id primitive.ObjectID, reason string) error
+}
+
+// emailSuppressed tells whether emails to the applicant bounced permanently. Emails are sent if it can not be told
+func (worker *Worker) emailSuppressed(request types.WhitelistRequest) bool {
+	if request.EmailUndeliverable {
+		return true
+	}
+	if worker.bounces == nil {
+		return false
+	}
+	suppressed, err := worker.bounces.EmailSuppressed(request.Email)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Warning("Unable to check whether emails to the applicant bounced. Sending anyway")
+		return false
+	}
+	return suppressed
+}
+
+// recordMessageID keeps the Message-ID of the email sent to the applicant on the request. Best effort only, a
+// bounce of an email whose Message-ID is not recorded still suppresses the address
+func (worker *Worker) recordMessageID(request types.WhitelistRequest, messageID string) {
+	if worker.bounces == nil || messageID == "" {
+		return
+	}
+	err := worker.bounces.RecordMessageID(request.ID, messageID)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Warning("Unable to record Message-ID of email")
+	}
+}
+
+// flagUndeliverable flags the request EmailUndeliverable if the mail server of the applicant rejected their
+// address for good, so the email is not retried. Returns false for other errors
+func (worker *Worker) flagUndeliverable(request types.WhitelistRequest, emailErr error) bool {
+	if !mailer.RecipientRejected(emailErr) {
+		return false
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"ID":     request.ID.Hex(),
+		"reason": emailErr.Error(),
+	}).Warning("Address of the applicant rejected by the mail server. Email not retried")
+	if worker.bounces == nil {
+		return true
+	}
+	err := worker.bounces.MarkRequestEmailUndeliverable(request.ID, emailErr.Error())
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Error("Unable to flag request email undeliverable")
+	}
+	return true
+}
@@ -0,0 +1,218 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+)
+
+const (
+	defaultRCONBreakerThreshold = 5
+	defaultRCONTimeout          = 10 * time.Second
+	defaultRCONBreakerCooldown  = time.Minute
+	// Harmless command issued to find out if the game server recovered
+	probeCommand = "list"
+)
+
+var (
+	errCircuitOpen = errors.New("Circuit open. Commands are not issued on the game server until it recovers")
+	errRCONTimeout = errors.New("Game server did not respond to the command in time")
+)
+
+// contextExecutor is implemented by executors which can give up on a command, like rcon.Client
+type contextExecutor interface {
+	SendCommandContext(ctx context.Context, command string) (string, error)
+}
+
+func rconTimeout() time.Duration {
+	timeout := time.Duration(viper.GetInt("rconTimeoutSeconds")) * time.Second
+	if timeout <= 0 {
+		return defaultRCONTimeout
+	}
+	return timeout
+}
+
+// rconBreakerThreshold is the number of consecutive failures opening the circuit. 0 disables the breaker
+func rconBreakerThreshold() int {
+	if !viper.IsSet("rconBreakerThreshold") {
+		return defaultRCONBreakerThreshold
+	}
+	return viper.GetInt("rconBreakerThreshold")
+}
+
+func rconBreakerCooldown() time.Duration {
+	cooldown := time.Duration(viper.GetInt("rconBreakerCooldownSeconds")) * time.Second
+	if cooldown <= 0 {
+		return defaultRCONBreakerCooldown
+	}
+	return cooldown
+}
+
+// sendCommand runs the command on the game server, giving up after timeout. Executors which can not be
+// interrupted keep running the command in the background
+func sendCommand(executor RCONExecutor, command string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if e, ok := executor.(contextExecutor); ok {
+		response, err := e.SendCommandContext(ctx, command)
+		if err == context.DeadlineExceeded {
+			return "", errRCONTimeout
+		}
+		return response, err
+	}
+	type result struct {
+		response string
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		response, err := executor.SendCommand(command)
+		done <- result{response, err}
+	}()
+	select {
+	case r := <-done:
+		return r.response, r.err
+	case <-ctx.Done():
+		return "", errRCONTimeout
+	}
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	// Cooldown elapsed, a probe is being issued
+	circuitHalfOpen
+)
+
+// circuitBreaker stops issuing commands on a game server after rconBreakerThreshold consecutive failures. Once
+// open, commands fail with errCircuitOpen for rconBreakerCooldownSeconds, then the game server is probed before
+// the next command. The circuit closes if the probe succeeds and opens again otherwise
+type circuitBreaker struct {
+	mu       sync.Mutex
+	server   string
+	state    circuitState
+	failures int
+	openedAt time.Time
+	now      func() time.Time
+}
+
+func newCircuitBreaker(server string) *circuitBreaker {
+	if server == "" {
+		server = "default"
+	}
+	return &circuitBreaker{server: server, now: time.Now}
+}
+
+// allow tells if a command may be issued, and if the game server must be probed first
+func (b *circuitBreaker) allow() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < rconBreakerCooldown() {
+			return false, errCircuitOpen
+		}
+		b.state = circuitHalfOpen
+		return true, nil
+	case circuitHalfOpen:
+		// Another command is probing the game server
+		return false, errCircuitOpen
+	}
+	return false, nil
+}
+
+// succeeded closes the circuit. Returns true if it was open
+func (b *circuitBreaker) succeeded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := b.state != circuitClosed
+	b.state = circuitClosed
+	b.failures = 0
+	metrics.RCONCircuitOpen.WithLabelValues(b.server).Set(0)
+	return wasOpen
+}
+
+// failed counts a failed command or probe. Returns true if the circuit has just been opened, so it is
+// reported once instead of for every command failing while it is open
+func (b *circuitBreaker) failed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	switch {
+	case b.state == circuitHalfOpen:
+		b.state = circuitOpen
+		b.openedAt = b.now()
+		return false
+	case b.state == circuitClosed && rconBreakerThreshold() > 0 && b.failures >= rconBreakerThreshold():
+		b.state = circuitOpen
+		b.openedAt = b.now()
+		metrics.RCONCircuitOpen.WithLabelValues(b.server).Set(1)
+		return true
+	}
+	return false
+}
+
+// openSince returns when the circuit opened, and false if it is closed
+func (b *circuitBreaker) openSince() (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.openedAt, b.state != circuitClosed
+}
+
+// breakerFor returns the circuit breaker of the game server of the tenant. Tenants sharing the game server of
+// the default tenant share its breaker too
+func (worker *Worker) breakerFor(cfg tenant.Config) *circuitBreaker {
+	server := ""
+	if cfg.ID != "" && cfg.Overrides("RCONServer") {
+		server = cfg.ID
+	}
+	worker.breakersMu.Lock()
+	defer worker.breakersMu.Unlock()
+	if worker.breakers == nil {
+		worker.breakers = make(map[string]*circuitBreaker)
+	}
+	breaker, ok := worker.breakers[server]
+	if !ok {
+		breaker = newCircuitBreaker(server)
+		worker.breakers[server] = breaker
+	}
+	return breaker
+}
+
+// openCircuits reports the game servers whose circuit is open, for the readiness check
+func (worker *Worker) openCircuits() error {
+	worker.breakersMu.Lock()
+	defer worker.breakersMu.Unlock()
+	var open []string
+	for _, breaker := range worker.breakers {
+		if since, ok := breaker.openSince(); ok {
+			open = append(open, fmt.Sprintf("%s (since %s)", breaker.server, since.Format(time.RFC3339)))
+		}
+	}
+	if len(open) == 0 {
+		return nil
+	}
+	sort.Strings(open)
+	return fmt.Errorf("Circuit open for game servers: %v", open)
+}
+
+// logGameServerError logs the failure of a task on the game server. Tasks failing because the circuit is open
+// are only logged at debug level, the circuit opening has been reported already
+func (worker *Worker) logGameServerError(fields logrus.Fields, err error, msg string) {
+	fields["err"] = err.Error()
+	if err == errCircuitOpen {
+		worker.logger.WithFields(fields).Debug(msg)
+		return
+	}
+	worker.logger.WithFields(fields).Error(msg)
+}
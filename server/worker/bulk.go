@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/webhook"
+)
+
+// Status changes of a bulk decision are summarized once none arrived for this long
+const bulkSummaryDelay = 5 * time.Second
+
+// bulkNotifier collects the status changes of the requests of bulk decisions and sends each bulk decision to the
+// webhook endpoints as one event, instead of an event per request. Changes are collected until none of the bulk
+// decision arrived for the delay
+type bulkNotifier struct {
+	send  func(webhook.Event)
+	delay time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingBulk
+}
+
+// pendingBulk is a bulk decision waiting for more of its changes
+type pendingBulk struct {
+	decision webhook.BulkDecision
+	timer    *time.Timer
+}
+
+func newBulkNotifier(send func(webhook.Event), delay time.Duration) *bulkNotifier {
+	return &bulkNotifier{send: send, delay: delay, pending: make(map[string]*pendingBulk)}
+}
+
+// add collects the status change of a request of the bulk decision and postpones the summary
+func (n *bulkNotifier) add(bulkID string, change webhook.StatusChange) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	bulk, ok := n.pending[bulkID]
+	if !ok {
+		bulk = &pendingBulk{decision: webhook.BulkDecision{BulkID: bulkID, Status: change.Status}}
+		bulk.timer = time.AfterFunc(n.delay, func() { n.flush(bulkID) })
+		n.pending[bulkID] = bulk
+	} else {
+		bulk.timer.Reset(n.delay)
+	}
+	bulk.decision.Changes = append(bulk.decision.Changes, change)
+}
+
+// flush sends the summary of the bulk decision if it has not been sent yet
+func (n *bulkNotifier) flush(bulkID string) {
+	n.mu.Lock()
+	bulk, ok := n.pending[bulkID]
+	delete(n.pending, bulkID)
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+	bulk.timer.Stop()
+	bulk.decision.Timestamp = time.Now()
+	n.send(webhook.Event{
+		Event:     webhook.BulkDecisionEvent,
+		Timestamp: bulk.decision.Timestamp,
+		Data:      bulk.decision,
+	})
+}
+
+// flushAll sends the summaries of all bulk decisions right away, e.g when the worker stops
+func (n *bulkNotifier) flushAll() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	bulkIDs := make([]string, 0, len(n.pending))
+	for bulkID := range n.pending {
+		bulkIDs = append(bulkIDs, bulkID)
+	}
+	n.mu.Unlock()
+	for _, bulkID := range bulkIDs {
+		n.flush(bulkID)
+	}
+}
@@ -0,0 +1,159 @@
+package worker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Stats changes of processed tasks are applied at least this often, and once this many accumulated
+	statsFlushInterval = 2 * time.Second
+	statsBatchSize     = 50
+)
+
+// requestRefresher shares the refreshes of cached requests between concurrent tasks. A refresh asked for while
+// another one runs waits for it to finish and joins the next one, together with every request asked for in the
+// meantime. A burst of decisions thus refreshes the cache in a few db queries, and no task is handed a refresh
+// which started before its change
+type requestRefresher struct {
+	refresh func(ids ...primitive.ObjectID) error
+
+	mu      sync.Mutex
+	running bool
+	next    *refreshRound
+}
+
+// refreshRound is a refresh of the requests asked for while the previous one ran
+type refreshRound struct {
+	ids  []primitive.ObjectID
+	seen map[primitive.ObjectID]bool
+	done chan struct{}
+	err  error
+}
+
+func newRequestRefresher(refresh func(ids ...primitive.ObjectID) error) *requestRefresher {
+	return &requestRefresher{refresh: refresh}
+}
+
+// refreshRequests refreshes the requests along with those of concurrent callers and returns the error of the
+// shared refresh
+func (r *requestRefresher) refreshRequests(ids ...primitive.ObjectID) error {
+	r.mu.Lock()
+	if r.next == nil {
+		r.next = &refreshRound{seen: make(map[primitive.ObjectID]bool), done: make(chan struct{})}
+	}
+	round := r.next
+	for _, id := range ids {
+		if !round.seen[id] {
+			round.seen[id] = true
+			round.ids = append(round.ids, id)
+		}
+	}
+	if !r.running {
+		r.running = true
+		go r.run()
+	}
+	r.mu.Unlock()
+	<-round.done
+	return round.err
+}
+
+// run refreshes the rounds one after the other until none is waiting
+func (r *requestRefresher) run() {
+	for {
+		r.mu.Lock()
+		round := r.next
+		r.next = nil
+		if round == nil {
+			r.running = false
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+		round.err = r.refresh(round.ids...)
+		close(round.done)
+	}
+}
+
+// statsBatcher adds up the stats changes of processed tasks by tenant and applies them every statsFlushInterval,
+// or as soon as statsBatchSize changes accumulated. A burst of decisions thus updates the stats in a few atomic
+// updates instead of one contended transaction per task. Changes are added up, never sampled, so counts stay exact
+type statsBatcher struct {
+	apply  func(serverID string, delta cache.StatsDelta) error
+	logger *logrus.Entry
+
+	mu      sync.Mutex
+	pending map[string]cache.StatsDelta
+	changes int
+	full    chan struct{}
+	// Held while flushing, so a flush on shutdown waits for the one in progress
+	flushMu sync.Mutex
+}
+
+func newStatsBatcher(apply func(serverID string, delta cache.StatsDelta) error, logger *logrus.Entry) *statsBatcher {
+	return &statsBatcher{
+		apply:   apply,
+		logger:  logger,
+		pending: make(map[string]cache.StatsDelta),
+		full:    make(chan struct{}, 1),
+	}
+}
+
+// add queues the stats change of the tenant for the next flush
+func (b *statsBatcher) add(serverID string, delta cache.StatsDelta) {
+	if delta.Changes == 0 {
+		return
+	}
+	b.mu.Lock()
+	pending := b.pending[serverID]
+	pending.Add(delta)
+	b.pending[serverID] = pending
+	b.changes += delta.Changes
+	full := b.changes >= statsBatchSize
+	b.mu.Unlock()
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run flushes the stats changes every interval and whenever a batch is full
+func (b *statsBatcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		}
+		b.flush()
+	}
+}
+
+// flush applies the stats changes accumulated. Changes failing to apply, e.g while the cache is unavailable, are
+// not kept: the stats are recounted from db on the next sync, which would count them twice
+func (b *statsBatcher) flush() {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[string]cache.StatsDelta)
+	b.changes = 0
+	b.mu.Unlock()
+	for serverID, delta := range pending {
+		err := b.apply(serverID, delta)
+		if err != nil {
+			b.logger.WithFields(logrus.Fields{
+				"serverID": serverID,
+				"changes":  delta.Changes,
+				"err":      err.Error(),
+			}).Warning("Unable to update stats in cache")
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Canary requests run this harmless command on the game server instead of whitelisting anyone
+	canaryCommand = "list"
+	// Canary requests are dispatched to this op only. Its emails go to the canary mailbox
+	canaryOp = "canary"
+	// Deadline for a canary request to complete if canaryDeadlineSeconds is not configured
+	defaultCanaryDeadline = 2 * time.Minute
+)
+
+var errCanaryDeadline = errors.New("deadline exceeded")
+
+// canaryPipeline drives a canary request through the pipeline
+type canaryPipeline interface {
+	// submit creates the canary request and publishes it as a new request
+	submit(request types.WhitelistRequest) (primitive.ObjectID, error)
+	// approve approves the canary request and publishes the approval
+	approve(request types.WhitelistRequest) error
+	get(id primitive.ObjectID) (types.WhitelistRequest, error)
+	remove(id primitive.ObjectID) error
+}
+
+// workerCanaryPipeline sends canary requests through the message queue the worker consumes
+type workerCanaryPipeline struct {
+	worker *Worker
+}
+
+func (p workerCanaryPipeline) submit(request types.WhitelistRequest) (primitive.ObjectID, error) {
+	id, err := p.worker.store.CreateRequest(request)
+	if err != nil {
+		return id, err
+	}
+	request.ID = id
+	request.Status = types.StatusPending
+	return id, p.worker.publishRequest(request, nil)
+}
+
+func (p workerCanaryPipeline) approve(request types.WhitelistRequest) error {
+	approvedRequest, err := p.worker.store.TransitionStatus(request.ID, db.StatusChange{
+		From:  types.StatusPending,
+		To:    types.StatusApproved,
+		At:    time.Now(),
+		Admin: canaryOp,
+	})
+	if err != nil {
+		return err
+	}
+	return p.worker.publishRequest(approvedRequest, nil)
+}
+
+func (p workerCanaryPipeline) get(id primitive.ObjectID) (types.WhitelistRequest, error) {
+	return p.worker.store.GetRequest(id)
+}
+
+func (p workerCanaryPipeline) remove(id primitive.ObjectID) error {
+	return p.worker.store.DeleteRequest(id)
+}
+
+// Periodically send a canary request through the pipeline every canaryIntervalMinutes. 0 disables canaries
+func (worker *Worker) canaryLoop() {
+	var lastRun time.Time
+	for range schedule.Tick(schedule.Every(60 * time.Second)) {
+		interval := time.Duration(viper.GetInt("canaryIntervalMinutes")) * time.Minute
+		if interval <= 0 || time.Since(lastRun) < interval || !worker.leading() {
+			continue
+		}
+		// The approval of the canary would be deferred past its deadline and alert the owner for nothing
+		if _, ok := worker.inMaintenance(tenant.Default, time.Now()); ok {
+			continue
+		}
+		lastRun = time.Now()
+		worker.checkCanary(workerCanaryPipeline{worker}, canaryDeadline(), time.Second)
+	}
+}
+
+func canaryDeadline() time.Duration {
+	if seconds := viper.GetInt("canaryDeadlineSeconds"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultCanaryDeadline
+}
+
+// checkCanary runs a canary request and records its latency. The owner is alerted if it fails
+func (worker *Worker) checkCanary(pipeline canaryPipeline, deadline, pollInterval time.Duration) error {
+	start := time.Now()
+	latency, err := runCanary(pipeline, start, deadline, pollInterval)
+	if err != nil {
+		metrics.CanaryFailures.Inc()
+		worker.logger.WithFields(logrus.Fields{
+			"err":      err.Error(),
+			"deadline": deadline.String(),
+		}).Error("Canary request failed. The pipeline may be broken")
+		worker.emailCanaryFailed(start, err)
+		return err
+	}
+	metrics.CanaryLatency.Observe(latency.Seconds())
+	worker.logger.WithFields(logrus.Fields{
+		"latency": latency.String(),
+	}).Info("Canary request completed")
+	return nil
+}
+
+// runCanary submits a canary request, approves it once it is dispatched and waits for the approval to complete.
+// Returns the end-to-end latency. The canary request is removed afterwards
+func runCanary(pipeline canaryPipeline, start time.Time, deadline, pollInterval time.Duration) (time.Duration, error) {
+	id, err := pipeline.submit(newCanaryRequest(start))
+	if err != nil {
+		return 0, fmt.Errorf("Unable to submit canary request: %s", err.Error())
+	}
+	defer pipeline.remove(id)
+	timeout := start.Add(deadline)
+	dispatched, err := waitForCanary(pipeline, id, timeout, pollInterval, func(request types.WhitelistRequest) bool {
+		return len(request.Assignees) > 0
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Canary request was not dispatched to ops: %s", err.Error())
+	}
+	err = pipeline.approve(dispatched)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to approve canary request: %s", err.Error())
+	}
+	completed, err := waitForCanary(pipeline, id, timeout, pollInterval, func(request types.WhitelistRequest) bool {
+		return request.CanaryCompletedTimestamp != nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Canary approval was not completed: %s", err.Error())
+	}
+	return completed.CanaryCompletedTimestamp.Sub(start), nil
+}
+
+// waitForCanary polls the canary request until it reaches the expected state or the timeout passes
+func waitForCanary(pipeline canaryPipeline, id primitive.ObjectID, timeout time.Time, pollInterval time.Duration, reached func(types.WhitelistRequest) bool) (types.WhitelistRequest, error) {
+	for {
+		request, err := pipeline.get(id)
+		if err != nil && err != db.ErrNotFound {
+			return request, err
+		}
+		if err == nil && reached(request) {
+			return request, nil
+		}
+		if time.Now().After(timeout) {
+			return request, errCanaryDeadline
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func newCanaryRequest(start time.Time) types.WhitelistRequest {
+	// Unique among pending requests and a valid Minecraft username of at most 16 characters
+	username := "canary_" + strconv.FormatInt(start.Unix()%1e9, 10)
+	return types.WhitelistRequest{
+		Username: username,
+		Email:    username + "@canary.invalid",
+		Canary:   true,
+		Info:     map[string]interface{}{"applicationText": "Canary request verifying the pipeline"},
+	}
+}
+
+// completeCanary records the completion of the canary request for the canary job
+func (worker *Worker) completeCanary(request types.WhitelistRequest) {
+	err := worker.store.CompleteCanary(request.ID, time.Now())
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Warning("Unable to record completion of canary request")
+	}
+}
+
+// gameCommand is the command run on the game server for the request. Canary requests run a harmless command instead
+func gameCommand(request types.WhitelistRequest, command string) string {
+	if request.Canary {
+		return canaryCommand
+	}
+	return command
+}
+
+// sendRequestMail sends an email about the request. Emails about canary requests go to the
+// canary mailbox instead, or nowhere if canaryEmail is not configured
+func (worker *Worker) sendRequestMail(request types.WhitelistRequest, templateName string, templateData interface{}, subject string, recipent string) error {
+	if request.Canary {
+		recipent = viper.GetString("canaryEmail")
+		if recipent == "" {
+			return nil
+		}
+		subject = "[Canary] " + subject
+	}
+	return worker.sendMail(templateName, templateData, subject, recipent)
+}
+
+// emailCanaryFailed alerts the owner that a canary request did not make it through the pipeline
+func (worker *Worker) emailCanaryFailed(start time.Time, canaryErr error) error {
+	recipent := viper.GetString("ownerEmail")
+	if recipent == "" {
+		return nil
+	}
+	err := worker.sendMail("./mailer/templates/canary_failed.html", map[string]string{
+		"startedAt": formatExpiry(start),
+		"error":     canaryErr.Error(),
+	}, "[Alert] Canary request failed", recipent)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"recipent": recipent,
+			"err":      err,
+		}).Error("Failed to send canary failure email")
+	}
+	return err
+}
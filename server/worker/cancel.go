@@ -0,0 +1,54 @@
+package worker
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// notifyOpsOnCancel reports whether the ops assigned to a request are told when the applicant withdraws it.
+// Defaults to true
+func notifyOpsOnCancel() bool {
+	return !viper.IsSet("notifyOpsOnCancel") || viper.GetBool("notifyOpsOnCancel")
+}
+
+// processCancel handles a request withdrawn by the applicant. Nothing has to be done on the server as
+// only pending requests can be cancelled, the assigned ops are told so they do not act on it
+func (worker *Worker) processCancel(ctx context.Context, d amqp.Delivery, request types.WhitelistRequest) {
+	log := worker.taskLogger(ctx)
+	log.WithFields(logrus.Fields{
+		"username": request.Username,
+		"ID":       request.ID,
+		"Type":     "Cancel Task",
+	}).Info("Received new task")
+	worker.updateCache(request)
+	if notifyOpsOnCancel() {
+		worker.emailCancellation(request)
+	}
+	worker.notifyStatusChange(request)
+	worker.completeTask(d, requestTaskKey(request))
+}
+
+// emailCancellation tells the ops assigned to the request that it was withdrawn. Best effort only
+func (worker *Worker) emailCancellation(request types.WhitelistRequest) {
+	subject := "[Withdrawn] Request of " + request.Username
+	profiles := worker.profilesByOp()
+	for _, op := range request.Assignees {
+		_, err := worker.notifyOp(profiles, types.OpEventCancel, op, func() error {
+			return worker.sendRequestMail(request, requestTemplate(request, "./mailer/templates/cancelled.html", opsLocale(op)), map[string]string{
+				"username": request.Username,
+			}, subject, op)
+		}, func() string {
+			return subject
+		})
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"recipent": op,
+				"err":      err,
+				"ID":       request.ID.Hex(),
+			}).Error("Failed to send cancellation email to op")
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// Actions run on the game server. Each is configured as a command template or a list of them
+const (
+	approveCommandKey    = "approveCommand"
+	deactivateCommandKey = "deactivateCommand"
+	banCommandKey        = "banCommand"
+	unbanCommandKey      = "unbanCommand"
+)
+
+// Commands of the vanilla game server, used if an action is not configured
+var defaultCommandTemplates = map[string][]string{
+	approveCommandKey:    {"whitelist add {{.Username}}"},
+	deactivateCommandKey: {"whitelist remove {{.Username}}"},
+	banCommandKey:        {"ban {{.Username}}"},
+	unbanCommandKey:      {"pardon {{.Username}}"},
+}
+
+// Commands of Floodgate, used for Bedrock players if an action is not configured for them. Bedrock players have
+// no Mojang account, so the vanilla whitelist can not look them up. Bans fall back to the commands of Java players
+var defaultBedrockCommandTemplates = map[string][]string{
+	approveCommandKey:    {"fwhitelist add {{.Gamertag}}"},
+	deactivateCommandKey: {"fwhitelist remove {{.Gamertag}}"},
+}
+
+// bedrockCommandKey is the key of the action's commands for Bedrock players, e.g bedrockApproveCommand
+func bedrockCommandKey(key string) string {
+	return "bedrock" + strings.ToUpper(key[:1]) + key[1:]
+}
+
+// commandData is what command templates are rendered with: the fields of the request and the gamertag of
+// Bedrock players, their username without the Floodgate prefix
+type commandData struct {
+	types.WhitelistRequest
+	Gamertag string
+}
+
+// ValidateCommandTemplates parses the command templates of every action of every tenant and renders them
+// for a sample request, so unknown fields and syntax errors are reported on startup instead of the first
+// time the action is run
+func ValidateCommandTemplates() error {
+	for _, cfg := range tenant.All() {
+		samples := []types.WhitelistRequest{{ServerID: cfg.ID, Username: "Steve", UUID: "8667ba71b85a4004af54457a9734eed7"}}
+		if BedrockEnabled(cfg) {
+			samples = append(samples, types.WhitelistRequest{ServerID: cfg.ID, Username: BedrockPrefix(cfg) + "Steve",
+				Platform: utils.PlatformBedrock})
+		}
+		for key := range defaultCommandTemplates {
+			for _, sample := range samples {
+				commands, err := renderCommands(cfg, key, sample)
+				if err != nil {
+					return err
+				}
+				for i, command := range commands {
+					if strings.TrimSpace(command) == "" {
+						return fmt.Errorf("%s[%d] renders an empty command", commandKeyOf(key, sample), i)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// configuredTemplates returns the configured templates of the key for the tenant, either a single template
+// or a list. nil if not configured
+func configuredTemplates(cfg tenant.Config, key string) []string {
+	switch v := cfg.Get(key).(type) {
+	case nil:
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	default:
+		if templates := cfg.GetStringSlice(key); len(templates) > 0 {
+			return templates
+		}
+	}
+	return nil
+}
+
+// commandTemplates returns the templates of the action for the request. Bedrock players get the commands
+// configured for them, then the Floodgate commands, then the commands of Java players
+func commandTemplates(cfg tenant.Config, key string, request types.WhitelistRequest) []string {
+	if request.Platform == utils.PlatformBedrock {
+		if templates := configuredTemplates(cfg, bedrockCommandKey(key)); templates != nil {
+			return templates
+		}
+		if templates, ok := defaultBedrockCommandTemplates[key]; ok {
+			return templates
+		}
+	}
+	if templates := configuredTemplates(cfg, key); templates != nil {
+		return templates
+	}
+	return defaultCommandTemplates[key]
+}
+
+// commandKeyOf names the commands of the action for the request in errors
+func commandKeyOf(key string, request types.WhitelistRequest) string {
+	if request.Platform == utils.PlatformBedrock {
+		return bedrockCommandKey(key)
+	}
+	return key
+}
+
+// renderCommands renders the commands of the action for the request, e.g {{.Username}}, {{.UUID}} and {{.Gamertag}}
+func renderCommands(cfg tenant.Config, key string, request types.WhitelistRequest) ([]string, error) {
+	templates := commandTemplates(cfg, key, request)
+	data := commandData{WhitelistRequest: request, Gamertag: request.Username}
+	if request.Platform == utils.PlatformBedrock {
+		data.Gamertag = strings.TrimPrefix(request.Username, BedrockPrefix(cfg))
+	}
+	name := commandKeyOf(key, request)
+	commands := make([]string, 0, len(templates))
+	for i, text := range templates {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %s", name, i, err.Error())
+		}
+		var command bytes.Buffer
+		err = tmpl.Execute(&command, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %s", name, i, err.Error())
+		}
+		commands = append(commands, strings.TrimSpace(command.String()))
+	}
+	return commands, nil
+}
+
+// runAction runs the commands of the action for the request on the game server in order. It stops at the
+// first failing command, so the whole action is retried and the commands must be safe to run again
+func (worker *Worker) runAction(key string, request types.WhitelistRequest) error {
+	// Usernames are validated by the API. Requests stored before may still smuggle a second command
+	err := ValidateRequestUsername(request)
+	if err != nil {
+		return err
+	}
+	commands, err := renderCommands(requestTenant(request), key, request)
+	if err != nil {
+		return err
+	}
+	for _, command := range commands {
+		_, err = worker.issueTenantRCON(requestTenant(request), gameCommand(request, command))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/webhook"
+)
+
+func commentTaskKey(task types.CommentTask) string {
+	return "comment:" + task.Comment.ID.Hex()
+}
+
+// processCommentTask tells the other ops assigned to the request about the comment of an op, by email with a
+// new action link or as a webhook depending on commentNotification. Nothing is run on the game server.
+// Retry if the email failed, only to the ops whose email failed
+func (worker *Worker) processCommentTask(ctx context.Context, d amqp.Delivery) {
+	log := worker.taskLogger(ctx)
+	var task types.CommentTask
+	err := json.Unmarshal(d.Body, &task)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"messageBody": d.Body,
+			"err":         err,
+		}).Error("Unable to decode message into commentTask")
+		d.Nack(false, false)
+		return
+	}
+	request := task.Request
+	log.WithFields(logrus.Fields{
+		"username": request.Username,
+		"ID":       request.ID,
+		"author":   task.Comment.Author,
+		"Type":     "Comment Task",
+	}).Info("Received new task")
+	if worker.taskProcessed(d, commentTaskKey(task)) {
+		d.Ack(false)
+		return
+	}
+
+	switch viper.GetString("commentNotification") {
+	case "email":
+		ops := task.Ops
+		if failedOps := headerStrings(d.Headers, failedOpsHeader); failedOps != nil {
+			ops = failedOps
+		}
+		_, failedOps, err := worker.emailActionLinks(request, ops, types.OpEventComment, "./mailer/templates/comment.html",
+			"[Comment] Request of "+request.Username, map[string]interface{}{
+				"username": request.Username,
+				"author":   task.Comment.Author,
+				"comment":  task.Comment.Text,
+			})
+		if err != nil {
+			worker.retryMsgWithDelay(d, "Email comment on request of "+request.Username+" to ops", err, nil)
+			return
+		}
+		if len(failedOps) > 0 {
+			worker.retryMsgWithDelay(d, "Email comment on request of "+request.Username+" to ops", errOpsNotEmailed(failedOps), amqp.Table{
+				failedOpsHeader: toTableArray(failedOps),
+			})
+			return
+		}
+	case "webhook":
+		worker.notifyComment(task)
+	}
+	worker.completeTask(d, commentTaskKey(task))
+}
+
+// notifyComment queues a webhook telling the endpoints an op commented on the request. Deliveries are sent in
+// the background so they never hold up the task
+func (worker *Worker) notifyComment(task types.CommentTask) {
+	if worker.webhooks == nil {
+		return
+	}
+	worker.webhooks.Enqueue(webhook.Event{
+		Event:     webhook.CommentEvent,
+		Timestamp: time.Now(),
+		Data: webhook.Comment{
+			RequestID: task.Request.ID.Hex(),
+			Username:  task.Request.Username,
+			Author:    task.Comment.Author,
+			Text:      task.Comment.Text,
+			Timestamp: task.Comment.Timestamp,
+		},
+	})
+}
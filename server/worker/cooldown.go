@@ -0,0 +1,139 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// ReapplyCooldown is how long a player has to wait after a denial before applying again, reapplyCooldownHours.
+// 0 disables the cooldown
+func ReapplyCooldown(cfg tenant.Config) time.Duration {
+	hours := cfg.GetInt("reapplyCooldownHours")
+	if hours <= 0 {
+		return 0
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// ReapplyAfter returns when the player of the denied request may apply again. False if the request is not
+// denied or there is no cooldown. Only decisions of ops and admins start a cooldown: the worker denies requests
+// of banned players, which never may apply, and requests it can not accept as submitted, e.g with an invalid
+// username, which the applicant should fix right away
+func ReapplyAfter(request types.WhitelistRequest) (time.Time, bool) {
+	cooldown := ReapplyCooldown(requestTenant(request))
+	if cooldown == 0 || request.Status != types.StatusDenied || request.Admin == workerActor ||
+		request.ProcessedTimestamp.IsZero() {
+		return time.Time{}, false
+	}
+	return request.ProcessedTimestamp.Add(cooldown), true
+}
+
+// CooldownDenial returns the denial among the requests which keeps the player from applying at now, the one
+// whose cooldown ends last. False if the player may apply. Expired requests were never decided, so only
+// denials are considered
+func CooldownDenial(requests []types.WhitelistRequest, now time.Time) (types.WhitelistRequest, time.Time, bool) {
+	var denial types.WhitelistRequest
+	var until time.Time
+	for _, request := range requests {
+		reapplyAfter, ok := ReapplyAfter(request)
+		if ok && reapplyAfter.After(now) && reapplyAfter.After(until) {
+			denial, until = request, reapplyAfter
+		}
+	}
+	return denial, until, !until.IsZero()
+}
+
+// DenialsInCooldown selects the denials of the username or email of the request recent enough to be in their
+// cooldown at now
+func DenialsInCooldown(request types.WhitelistRequest, now time.Time) db.RequestFilter {
+	return db.RequestFilter{
+		Statuses:     []string{types.StatusDenied},
+		Tenants:      []string{request.ServerID},
+		Username:     request.Username,
+		Email:        request.Email,
+		DecidedAfter: now.Add(-ReapplyCooldown(requestTenant(request))),
+	}
+}
+
+// rejectInCooldown checks for a denial of the same username or email within the cooldown, in case the
+// request was published before it was decided. If found, the request is discarded like a duplicate and the
+// applicant is told when they may reapply. Resubmissions of a denied request are limited by resubmissionLimit
+// instead
+func (worker *Worker) rejectInCooldown(request types.WhitelistRequest) bool {
+	if ReapplyCooldown(requestTenant(request)) == 0 || request.PreviousRequestID != "" {
+		return false
+	}
+	now := time.Now()
+	denials, err := worker.store.QueryRequests(DenialsInCooldown(request, now))
+	if err != nil {
+		// Best effort only. Process the request as usual
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Warning("Unable to check for recent denials")
+		return false
+	}
+	denial, reapplyAfter, ok := CooldownDenial(denials, now)
+	if !ok {
+		return false
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"ID":           request.ID.Hex(),
+		"deniedID":     denial.ID.Hex(),
+		"reapplyAfter": reapplyAfter,
+	}).Warning("Request submitted within the cooldown of a denial. Skip dispatching to ops")
+	err = worker.store.DeleteRequest(request.ID)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Error("Unable to delete request submitted within the cooldown")
+	} else {
+		worker.refreshCachedRequests(request.ID)
+	}
+	worker.emailCooldown(request, denial, reapplyAfter)
+	return true
+}
+
+// emailCooldown tells the applicant their new request was not submitted because of the recent denial, with
+// when they may reapply and a link to the status of the denied request
+func (worker *Worker) emailCooldown(whitelistRequest, denial types.WhitelistRequest, reapplyAfter time.Time) error {
+	log := worker.logger
+	subject := requestTenant(whitelistRequest).GetString("cooldownEmailTitle")
+	if subject == "" {
+		subject = requestTenant(whitelistRequest).GetString("deniedEmailTitle")
+	}
+	requestIDToken, err := utils.SignToken(denial.ID.Hex(), utils.PurposeStatus, statusLinkTTL())
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to encode requestID Token")
+		return err
+	}
+	builder, err := worker.linksOf(requestTenant(whitelistRequest))
+	if err != nil {
+		return err
+	}
+	templateData := map[string]string{
+		"link":         builder.StatusLink(requestIDToken),
+		"reapplyAfter": formatExpiry(reapplyAfter),
+	}
+	err = worker.sendApplicantMail(whitelistRequest, "./mailer/templates/cooldown.html", templateData, subject, false)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+			"err":      err,
+			"ID":       whitelistRequest.ID.Hex(),
+		}).Error("Failed to send cooldown email")
+	} else {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+		}).Info("Cooldown email sent")
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Time a task may take before it is retried, if taskTimeoutSeconds is not set
+const defaultTaskTimeout = 2 * time.Minute
+
+// taskTimeout is the deadline of each task, so a hung dependency does not stall the lane of the task
+func taskTimeout() time.Duration {
+	if seconds := viper.GetInt("taskTimeoutSeconds"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultTaskTimeout
+}
+
+type taskIDKey struct{}
+
+// withTaskID returns the context of the task with the generated ID the logs of the task are correlated by
+func withTaskID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, taskIDKey{}, primitive.NewObjectID().Hex())
+}
+
+// taskIDOf returns the ID of the task of the context, empty outside of tasks
+func taskIDOf(ctx context.Context) string {
+	id, _ := ctx.Value(taskIDKey{}).(string)
+	return id
+}
+
+// taskLogger returns the logger of the task of the context, which includes the task ID in every entry
+func (worker *Worker) taskLogger(ctx context.Context) *logrus.Entry {
+	if id := taskIDOf(ctx); id != "" {
+		return worker.logger.WithField("taskID", id)
+	}
+	return worker.logger
+}
+
+// taskAcknowledger settles the delivery of a task until the task timed out. The delivery is retried once the
+// task timed out, so the task still running must not settle it as well
+type taskAcknowledger struct {
+	amqp.Acknowledger
+	mu       sync.Mutex
+	settled  bool
+	timedOut bool
+}
+
+func (a *taskAcknowledger) settle(settle func() error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.timedOut {
+		return nil
+	}
+	a.settled = true
+	return settle()
+}
+
+func (a *taskAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.settle(func() error { return a.Acknowledger.Ack(tag, multiple) })
+}
+
+func (a *taskAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return a.settle(func() error { return a.Acknowledger.Nack(tag, multiple, requeue) })
+}
+
+func (a *taskAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.settle(func() error { return a.Acknowledger.Reject(tag, requeue) })
+}
+
+// timeOut takes the delivery over from the task. False if the task settled it already
+func (a *taskAcknowledger) timeOut() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.settled {
+		return false
+	}
+	a.timedOut = true
+	return true
+}
+
+// process handles a single delivery within the task deadline. Deliveries are processed concurrently in lanes.
+// A task running past the deadline is retried like a failed one and left to finish in the background, its
+// operations bound to the context of the task fail soon after
+func (worker *Worker) process(d amqp.Delivery) {
+	ctx, cancel := context.WithTimeout(withTaskID(context.Background()), taskTimeout())
+	defer cancel()
+	acknowledger := &taskAcknowledger{Acknowledger: d.Acknowledger}
+	task := d
+	if d.Acknowledger != nil {
+		task.Acknowledger = acknowledger
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		worker.processTask(ctx, task)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	if !acknowledger.timeOut() {
+		return
+	}
+	worker.taskLogger(ctx).WithFields(logrus.Fields{
+		"timeout": taskTimeout().String(),
+	}).Error("Task ran past its deadline")
+	metrics.TaskTimeouts.Inc()
+	worker.retryMsgWithDelay(d, "Process task "+taskIDOf(ctx), ctx.Err(), nil)
+}
@@ -0,0 +1,256 @@
+package worker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/mailer"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// Modes of dispatching new requests to ops
+const (
+	dispatchImmediate = "immediate"
+	dispatchDigest    = "digest"
+)
+
+// Time of day digests are sent at if digestTime is not configured
+const defaultDigestTime = "09:00"
+
+// digestMode tells whether ops get the pending requests in a daily digest instead of an action email for
+// each new request
+func digestMode() bool {
+	return viper.GetString("dispatchingMode") == dispatchDigest
+}
+
+// digestSchedule returns when digests are sent. digestTime is a time of day (HH:MM) or a schedule expression,
+// e.g "weekdays at 08:00", evaluated in digestTimezone. Defaults to the timezone config
+func digestSchedule() (schedule.Schedule, error) {
+	expr := viper.GetString("digestTime")
+	if expr == "" {
+		expr = defaultDigestTime
+	}
+	if timeOfDay, err := parseTimeOfDay(expr); err == nil && timeOfDay < 24*time.Hour {
+		expr = "daily at " + expr
+	}
+	location, err := schedule.Location()
+	if timezone := viper.GetString("digestTimezone"); timezone != "" {
+		location, err = time.LoadLocation(timezone)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("digestTimezone: %s", err.Error())
+	}
+	digests, err := schedule.ParseExpression(expr, location)
+	if err != nil {
+		return nil, fmt.Errorf("digestTime %q is invalid, expected HH:MM or a schedule expression: %s", expr, err.Error())
+	}
+	return digests, nil
+}
+
+// validateDispatchingMode checks the dispatching mode and the digest schedule, so a typo is reported on
+// startup instead of silently never sending a digest
+func validateDispatchingMode() error {
+	switch mode := viper.GetString("dispatchingMode"); mode {
+	case "", dispatchImmediate:
+		return nil
+	case dispatchDigest:
+		_, err := digestSchedule()
+		return err
+	default:
+		return fmt.Errorf("dispatchingMode %q is not supported, expected %s or %s", mode, dispatchImmediate, dispatchDigest)
+	}
+}
+
+// dueDigestTime returns the latest time a digest was scheduled at after since and at or before now, zero if
+// none was. Digests missed in between are sent as one
+func dueDigestTime(digests schedule.Schedule, since, now time.Time) time.Time {
+	var scheduled time.Time
+	for next := digests.Next(since); !next.IsZero() && !next.After(now); next = digests.Next(next) {
+		scheduled = next
+	}
+	return scheduled
+}
+
+// Send the digest of the pending requests once its scheduled time has passed. Digests scheduled before the
+// worker started are not sent. Outside digest mode only ops who opted into the digest get it
+func (worker *Worker) digestLoop() {
+	lastChecked := time.Now()
+	for now := range schedule.Tick(schedule.Every(time.Minute)) {
+		if !digestMode() && !worker.anyDigestOps() {
+			lastChecked = now
+			continue
+		}
+		digests, err := digestSchedule()
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Invalid digest schedule")
+			continue
+		}
+		scheduled := dueDigestTime(digests, lastChecked, now)
+		if scheduled.IsZero() {
+			continue
+		}
+		lastChecked = now
+		// Followers skip the digest, the leader sends it
+		worker.runAsLeader("send digest of pending requests", func() error {
+			return worker.sendDigest(scheduled, now)
+		})
+	}
+}
+
+// sendDigest sends the digest of the pending requests of each tenant to its ops
+func (worker *Worker) sendDigest(scheduled, now time.Time) error {
+	for _, cfg := range tenant.All() {
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		err := worker.sendTenantDigest(cfg, scheduled, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendTenantDigest emails the target ops of the tenant one digest listing every pending request of the tenant
+// with its action link. Each request is claimed first, so concurrent workers do not send the digest twice and
+// escalation can tell the request has been sent to ops. Nothing is sent if no request is pending. Outside digest
+// mode the digest is only sent to the ops who opted into it
+func (worker *Worker) sendTenantDigest(cfg tenant.Config, scheduled, now time.Time) error {
+	targetOps := worker.getTargetOps(cfg)
+	if !digestMode() {
+		targetOps = worker.digestOps(cfg, worker.profilesByOp())
+		if len(targetOps) == 0 {
+			return nil
+		}
+	}
+	pendingRequests, err := worker.store.QueryRequests(db.RequestFilter{
+		Statuses: []string{types.StatusPending},
+		Tenants:  []string{cfg.ID},
+		// Parked requests have nobody to be sent to
+		ExcludeAwaitingOps: true,
+		NotDigestedSince:   scheduled,
+	})
+	if err != nil {
+		return err
+	}
+	claimed := make([]types.WhitelistRequest, 0, len(pendingRequests))
+	for _, request := range pendingRequests {
+		err := worker.store.ClaimDigest(request.ID, scheduled, now)
+		if err == db.ErrConflict {
+			continue
+		} else if err != nil {
+			return err
+		}
+		claimed = append(claimed, request)
+	}
+	if len(claimed) == 0 {
+		worker.logger.WithFields(logrus.Fields{
+			"serverId": cfg.ID,
+		}).Info("No pending requests. Skipping digest")
+		return nil
+	}
+	subject := fmt.Sprintf("[Action Required] %d pending whitelist request(s)", len(claimed))
+	// The digest is still sent if the response times can not be counted
+	responseTimes, err := cache.CountOpResponses(worker.opResponses, cfg.ID)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"serverId": cfg.ID,
+			"err":      err.Error(),
+		}).Warning("Unable to count response times of ops for the digest")
+	}
+	notifiedOps := []string{}
+	for _, op := range targetOps {
+		entries, err := worker.digestEntries(claimed, op)
+		if err == nil {
+			err = worker.sendMail(mailer.ResolveTemplate(tenantTemplate(cfg, "./mailer/templates/digest.html"), opsLocale(op)), map[string]interface{}{
+				"requests":      entries,
+				"responseTimes": digestResponseTimes(responseTimes),
+			}, subject, op)
+		}
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"recipent": op,
+				"err":      err,
+			}).Error("Failed to send digest to op")
+			continue
+		}
+		notifiedOps = append(notifiedOps, op)
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"serverId": cfg.ID,
+		"requests": len(claimed),
+		"ops":      notifiedOps,
+	}).Info("Digest of pending requests sent")
+	for _, request := range claimed {
+		worker.addAssignees(request, notifiedOps)
+		worker.recordOpsNotified(request, notifiedOps)
+	}
+	return nil
+}
+
+// digestEntries lists the requests for the digest of the op, each with an action link only valid for the op
+func (worker *Worker) digestEntries(requests []types.WhitelistRequest, op string) ([]map[string]interface{}, error) {
+	entries := make([]map[string]interface{}, 0, len(requests))
+	for _, request := range requests {
+		builder, err := worker.linksOf(requestTenant(request))
+		if err != nil {
+			return nil, err
+		}
+		requestIDToken, err := utils.SignToken(request.ID.Hex(), utils.PurposeAction, ActionLinkTTL())
+		if err != nil {
+			return nil, err
+		}
+		opToken, err := worker.actionToken(request, op)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, map[string]interface{}{
+			"username":    request.Username,
+			"age":         strconv.FormatInt(request.Age, 10),
+			"gender":      request.Gender,
+			"submittedAt": formatExpiry(request.Timestamp),
+			"link":        builder.ActionLink(requestIDToken, opToken),
+			"answers":     answersTemplateData(request),
+		})
+	}
+	return entries, nil
+}
+
+// digestResponseTimes lists how quickly each op responds to the requests sent to them for the digest
+func digestResponseTimes(stats []types.OpResponseStats) []map[string]interface{} {
+	rows := make([]map[string]interface{}, 0, len(stats))
+	for _, s := range stats {
+		median := "-"
+		if s.Decided > 0 {
+			median = formatMinutes(s.MedianResponseTimeInMinutes)
+		}
+		rows = append(rows, map[string]interface{}{
+			"op":            s.Op,
+			"assigned":      s.Assigned,
+			"decided":       s.Decided,
+			"median":        median,
+			"escalatedPast": s.EscalatedPast,
+		})
+	}
+	return rows
+}
+
+// formatMinutes formats a duration in minutes to the minute for emails, e.g 2h30m
+func formatMinutes(minutes float64) string {
+	d := time.Duration(minutes * float64(time.Minute)).Round(time.Minute)
+	if d < time.Minute {
+		return "<1m"
+	}
+	return strings.TrimSuffix(d.String(), "0s")
+}
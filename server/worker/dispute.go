@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// processDispute tells all ops that their votes on the request conflict. The owner decides on disputed
+// requests from the dashboard. Best effort only, the dispute is visible on the dashboard anyway
+func (worker *Worker) processDispute(ctx context.Context, d amqp.Delivery, request types.WhitelistRequest) {
+	log := worker.taskLogger(ctx)
+	log.WithFields(logrus.Fields{
+		"username": request.Username,
+		"ID":       request.ID,
+		"Type":     "Dispute Task",
+	}).Info("Received new task")
+	// Disputed requests are still counted as pending in the stats
+	worker.refreshCachedRequests(request.ID)
+	configuredOps, err := worker.opsOf(requestTenant(request))
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Invalid ops configuration")
+		worker.completeTask(d, requestTaskKey(request))
+		return
+	}
+	subject := "[Disputed] Request of " + request.Username
+	profiles := worker.profilesByOp()
+	for _, op := range opEmails(configuredOps) {
+		_, err = worker.notifyOp(profiles, types.OpEventDispute, op, func() error {
+			return worker.sendRequestMail(request, requestTemplate(request, "./mailer/templates/disputed.html", opsLocale(op)), map[string]string{
+				"username": request.Username,
+				"votes":    formatVotes(request.Votes),
+			}, subject, op)
+		}, func() string {
+			return subject + ". Votes: " + formatVotes(request.Votes)
+		})
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"recipent": op,
+				"err":      err,
+				"ID":       request.ID.Hex(),
+			}).Error("Failed to send dispute email to op")
+		}
+	}
+	worker.notifyStatusChange(request)
+	worker.completeTask(d, requestTaskKey(request))
+}
+
+func formatVotes(votes []types.Vote) string {
+	formatted := make([]string, 0, len(votes))
+	for _, vote := range votes {
+		formatted = append(formatted, vote.Op+": "+vote.Decision)
+	}
+	return strings.Join(formatted, ", ")
+}
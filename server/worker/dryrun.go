@@ -0,0 +1,79 @@
+package worker
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/config"
+	"github.com/tywin1104/mc-gatekeeper/mailer"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/proxy"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// Directory emails are written to in dry runs if dryRunMailDir is not configured
+const defaultDryRunMailDir = "./dry-run-mail"
+
+// DryRun reports whether the side effects of tasks are simulated: commands are logged instead of being run on
+// the game server and emails are written to dryRunMailDir instead of being sent. Requests are still stored and
+// cached as usual. The test environment always runs dry
+func DryRun() bool {
+	return config.DryRun()
+}
+
+// Mailer returns the function emails are sent with, which writes them to dryRunMailDir in dry runs
+func Mailer() metrics.SendFunc {
+	if DryRun() {
+		return metrics.InstrumentSend(mailer.WriteToDir(dryRunMailDir()))
+	}
+	return metrics.InstrumentSend(mailer.Send)
+}
+
+func dryRunMailDir() string {
+	if dir := viper.GetString("dryRunMailDir"); dir != "" {
+		return dir
+	}
+	return defaultDryRunMailDir
+}
+
+// dryRunExecutor logs commands instead of running them on the game server and reports them as successful
+type dryRunExecutor struct {
+	logger *logrus.Entry
+}
+
+func (e *dryRunExecutor) SendCommand(command string) (string, error) {
+	e.logger.WithFields(logrus.Fields{
+		"command": command,
+	}).Info("Dry run. Command not sent to the game server")
+	return "", nil
+}
+
+// dryRunBackend logs the actions instead of sending them to the proxy plugin or writing them to the files of the
+// game server and reports them as successful
+type dryRunBackend struct {
+	logger *logrus.Entry
+}
+
+func (b *dryRunBackend) Whitelist(request types.WhitelistRequest) error {
+	return b.log(proxy.ActionWhitelist, request)
+}
+
+func (b *dryRunBackend) Unwhitelist(request types.WhitelistRequest) error {
+	return b.log(proxy.ActionUnwhitelist, request)
+}
+
+func (b *dryRunBackend) Ban(request types.WhitelistRequest) error {
+	return b.log(proxy.ActionBan, request)
+}
+
+func (b *dryRunBackend) Pardon(request types.WhitelistRequest) error {
+	return b.log(proxy.ActionPardon, request)
+}
+
+func (b *dryRunBackend) log(action string, request types.WhitelistRequest) error {
+	b.logger.WithFields(logrus.Fields{
+		"action":   action,
+		"username": request.Username,
+		"serverId": request.ServerID,
+	}).Info("Dry run. Action not carried out on the game server")
+	return nil
+}
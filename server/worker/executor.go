@@ -0,0 +1,45 @@
+package worker
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/rcon"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+)
+
+// RCONExecutor runs commands on the game server. Implemented by rcon.Client
+type RCONExecutor interface {
+	SendCommand(command string) (string, error)
+}
+
+// CommandFunc adapts a function to an RCONExecutor
+type CommandFunc func(command string) (string, error)
+
+// SendCommand calls f(command)
+func (f CommandFunc) SendCommand(command string) (string, error) {
+	return f(command)
+}
+
+// NewRCONExecutor connects to the configured game server. In dry runs commands are only logged and no
+// game server is connected to. No game server is connected to either if it is managed through the proxy plugin
+// without RCON
+func NewRCONExecutor(logger *logrus.Entry) (RCONExecutor, error) {
+	return newTenantExecutor(tenant.Default, logger)
+}
+
+// newTenantExecutor connects to the game server of the tenant. Commands fail with errNoRCON if the game server
+// of the tenant is only managed through the proxy plugin
+func newTenantExecutor(cfg tenant.Config, logger *logrus.Entry) (RCONExecutor, error) {
+	if DryRun() {
+		return &dryRunExecutor{logger: logger}, nil
+	}
+	if !usesRCON(cfg) {
+		return CommandFunc(func(command string) (string, error) {
+			return "", errNoRCON
+		}), nil
+	}
+	client, err := rcon.NewClient(cfg.GetString("RCONServer"), cfg.GetInt("RCONPort"), cfg.GetString("RCONPassword"))
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
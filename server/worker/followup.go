@@ -0,0 +1,284 @@
+package worker
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/mailer"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+const followUpCheckInterval = time.Hour
+
+// e.g "There are 2 of a max of 20 players online: Steve, Alex" or "There are 2/20 players online:\nSteve, Alex"
+var onlinePlayersPattern = regexp.MustCompile(`There are (\d+)(?: of a max of |/)\d+ players online`)
+
+// joinTracking tells whether the game servers are polled for the players online, so approved players who never
+// joined can be told apart
+func joinTracking() bool {
+	return viper.GetInt("joinTrackingIntervalMinutes") > 0
+}
+
+// Periodically record the first time approved players are seen online on the game servers
+func (worker *Worker) joinTrackingLoop() {
+	var lastRun time.Time
+	for range schedule.Tick(schedule.Every(time.Minute)) {
+		interval := time.Duration(viper.GetInt("joinTrackingIntervalMinutes")) * time.Minute
+		if interval <= 0 || time.Since(lastRun) < interval {
+			continue
+		}
+		lastRun = time.Now()
+		worker.runAsLeader("record first joins of approved players", func() error {
+			return worker.trackJoins(time.Now())
+		})
+	}
+}
+
+// trackJoins records the approved players online on the game server of each tenant as joined. Game servers in
+// maintenance or without RCON are skipped
+func (worker *Worker) trackJoins(now time.Time) error {
+	for _, cfg := range tenant.All() {
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		if _, ok := worker.inMaintenance(cfg, now); ok || !usesRCON(cfg) {
+			continue
+		}
+		response, err := worker.issueTenantRCON(cfg, "list")
+		if err == nil {
+			var online []string
+			online, err = parseOnlinePlayers(response)
+			if err == nil {
+				var recorded int64
+				recorded, err = worker.store.RecordFirstJoins(cfg.ID, online, now)
+				if recorded > 0 {
+					worker.logger.WithFields(logrus.Fields{
+						"serverId": cfg.ID,
+						"players":  recorded,
+					}).Info("Recorded first joins of approved players")
+				}
+			}
+		}
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"serverId": cfg.ID,
+				"err":      err.Error(),
+			}).Warning("Unable to list the players online on the game server")
+		}
+	}
+	return nil
+}
+
+// parseOnlinePlayers parses the response of the list command into usernames. An error is returned if the
+// response is not recognized or lists fewer players than it counts
+func parseOnlinePlayers(response string) ([]string, error) {
+	match := onlinePlayersPattern.FindStringSubmatch(response)
+	if match == nil {
+		return nil, fmt.Errorf("Unrecognized list response %q", response)
+	}
+	count, _ := strconv.Atoi(match[1])
+	usernames := []string{}
+	if i := strings.Index(response, ":"); i >= 0 {
+		for _, username := range strings.Split(response[i+1:], ",") {
+			if username = strings.TrimSpace(username); username != "" {
+				usernames = append(usernames, username)
+			}
+		}
+	}
+	if len(usernames) != count {
+		return nil, fmt.Errorf("List response lists %d out of %d players", len(usernames), count)
+	}
+	return usernames, nil
+}
+
+// followUpOf tells whether the approved request needs a follow-up and which actions are suggested. The reasons
+// are a bounced email of the applicant and, if joins are tracked, a player never seen online. Returns nil if
+// the player needs no follow-up
+func followUpOf(request types.WhitelistRequest, tracked bool, now time.Time) *types.FollowUp {
+	bounced := request.EmailUndeliverable
+	neverJoined := tracked && request.FirstJoinedAt == nil
+	if !bounced && !neverJoined {
+		return nil
+	}
+	followUp := &types.FollowUp{Reasons: []string{}, SuggestedActions: []string{}, FlaggedAt: now}
+	if request.FollowUp != nil {
+		followUp.FlaggedAt = request.FollowUp.FlaggedAt
+	}
+	if bounced {
+		followUp.Reasons = append(followUp.Reasons, types.FollowUpEmailBounced)
+		followUp.SuggestedActions = append(followUp.SuggestedActions, types.FollowUpResendEmail)
+	}
+	if neverJoined {
+		followUp.Reasons = append(followUp.Reasons, types.FollowUpNeverJoined)
+		followUp.SuggestedActions = append(followUp.SuggestedActions, types.FollowUpReachOut, types.FollowUpDeactivate)
+	}
+	return followUp
+}
+
+// sameFollowUp tells whether the request is already flagged for the same reasons
+func sameFollowUp(current, next *types.FollowUp) bool {
+	if current == nil || next == nil {
+		return current == next
+	}
+	return strings.Join(current.Reasons, ",") == strings.Join(next.Reasons, ",")
+}
+
+// Periodically flag the players approved more than followUpAfterDays ago who may never have got in, and email ops
+// the report of the flagged players on followUpReportSchedule
+func (worker *Worker) followUpLoop() {
+	lastChecked, lastFlagged := time.Now(), time.Time{}
+	for now := range schedule.Tick(schedule.Every(time.Minute)) {
+		if viper.GetInt("followUpAfterDays") <= 0 {
+			lastChecked = now
+			continue
+		}
+		if now.Sub(lastFlagged) >= followUpCheckInterval {
+			lastFlagged = now
+			worker.runAsLeader("flag approved players for follow-up", func() error {
+				return worker.flagFollowUps(now)
+			})
+		}
+		reports, err := schedule.FromConfig("followUpReportSchedule", nil)
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Invalid follow-up report schedule")
+			continue
+		}
+		if reports == nil {
+			lastChecked = now
+			continue
+		}
+		if dueDigestTime(reports, lastChecked, now).IsZero() {
+			continue
+		}
+		lastChecked = now
+		worker.runAsLeader("send follow-up report", func() error {
+			return worker.sendFollowUpReports()
+		})
+	}
+}
+
+// flagFollowUps flags the players approved more than followUpAfterDays ago who need a follow-up, and clears the
+// flag of the ones who no longer do, e.g once they joined. Follow-ups dismissed by ops are kept
+func (worker *Worker) flagFollowUps(now time.Time) error {
+	approved, err := worker.store.QueryRequests(db.RequestFilter{
+		Statuses:      []string{types.StatusApproved},
+		DecidedBefore: now.AddDate(0, 0, -viper.GetInt("followUpAfterDays")),
+	})
+	if err != nil {
+		return err
+	}
+	tracked := joinTracking()
+	flagged := 0
+	for _, request := range approved {
+		if request.FollowUp != nil && request.FollowUp.DismissedAt != nil {
+			continue
+		}
+		followUp := followUpOf(request, tracked, now)
+		if sameFollowUp(request.FollowUp, followUp) {
+			continue
+		}
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		err := worker.store.SetFollowUp(request.ID, followUp)
+		if err == db.ErrConflict {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if followUp != nil {
+			flagged++
+		}
+	}
+	if flagged > 0 {
+		worker.logger.WithFields(logrus.Fields{
+			"requests": flagged,
+		}).Info("Approved players flagged for follow-up")
+	}
+	return nil
+}
+
+// sendFollowUpReports emails the ops of each tenant the players of the tenant flagged for follow-up. Nothing is
+// sent if none is flagged
+func (worker *Worker) sendFollowUpReports() error {
+	for _, cfg := range tenant.All() {
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		flagged, err := worker.store.QueryRequests(db.RequestFilter{
+			Statuses: []string{types.StatusApproved},
+			Tenants:  []string{cfg.ID},
+			FollowUp: true,
+		})
+		if err != nil {
+			return err
+		}
+		if len(flagged) == 0 {
+			continue
+		}
+		err = worker.emailFollowUpReport(cfg, flagged)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emailFollowUpReport sends the report of the flagged players to every op of the tenant. Best effort per op
+func (worker *Worker) emailFollowUpReport(cfg tenant.Config, requests []types.WhitelistRequest) error {
+	configuredOps, err := worker.opsOf(cfg)
+	if err != nil {
+		return err
+	}
+	entries := followUpReport(requests)
+	subject := fmt.Sprintf("[Follow-up] %d approved player(s) may not have joined", len(requests))
+	profiles := worker.profilesByOp()
+	for _, op := range opEmails(configuredOps) {
+		_, err = worker.notifyOp(profiles, types.OpEventFollowUp, op, func() error {
+			return worker.sendMail(mailer.ResolveTemplate(tenantTemplate(cfg, "./mailer/templates/followup.html"), opsLocale(op)),
+				map[string]interface{}{"requests": entries}, subject, op)
+		}, func() string {
+			return subject + "\n" + strings.Join(entries, "\n")
+		})
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"recipent": op,
+				"err":      err,
+			}).Error("Failed to send follow-up report to op")
+		}
+	}
+	return nil
+}
+
+// followUpReport lists the flagged players with why they are flagged and the suggested actions
+func followUpReport(requests []types.WhitelistRequest) []string {
+	entries := make([]string, 0, len(requests))
+	for _, request := range requests {
+		reasons := make([]string, 0, len(request.FollowUp.Reasons))
+		for _, reason := range request.FollowUp.Reasons {
+			switch reason {
+			case types.FollowUpEmailBounced:
+				if request.EmailBounceReason == "" {
+					reasons = append(reasons, "email bounced")
+				} else {
+					reasons = append(reasons, "email bounced ("+request.EmailBounceReason+")")
+				}
+			case types.FollowUpNeverJoined:
+				reasons = append(reasons, "never joined")
+			}
+		}
+		entries = append(entries, fmt.Sprintf("%s, approved %s: %s. Suggested: %s", request.Username,
+			formatExpiry(request.ProcessedTimestamp), strings.Join(reasons, ", "), strings.Join(request.FollowUp.SuggestedActions, ", ")))
+	}
+	return entries
+}
@@ -0,0 +1,112 @@
+package worker
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// Completed tasks are remembered long enough to outlive any redelivery
+const processedTaskTTL = 24 * time.Hour
+
+// Emails sent to applicants are remembered longer than tasks are retried or deferred for
+const sentEmailTTL = 14 * 24 * time.Hour
+
+// taskLedger records completed tasks so redelivered messages do not repeat their side effects
+type taskLedger interface {
+	IsTaskProcessed(key string) (bool, error)
+	MarkTaskProcessed(key string, ttl time.Duration) error
+}
+
+// requestTaskKey identifies the task of a request message. The last update distinguishes
+// a request set to the same status again, e.g re-approved after a deactivation
+func requestTaskKey(request types.WhitelistRequest) string {
+	return request.ID.Hex() + ":" + request.Status + ":" + strconv.FormatInt(request.LastUpdatedTimestamp.UnixNano(), 10)
+}
+
+// emailLedger records the emails sent to applicants, so a task redelivered or retried after its email was sent,
+// e.g because the worker stopped before acking it, does not send it again
+type emailLedger interface {
+	ClaimEmail(key string, ttl time.Duration) (bool, error)
+	ReleaseEmail(key string) error
+}
+
+// emailKey identifies the email of the template about the request in its current status
+func emailKey(request types.WhitelistRequest, template string) string {
+	return requestTaskKey(request) + ":" + strings.TrimSuffix(filepath.Base(template), filepath.Ext(template))
+}
+
+func consoleTaskKey(task types.ConsoleTask) string {
+	return "console:" + task.ID.Hex()
+}
+
+// taskProcessed checks whether the task has already been completed, e.g by a delivery that was
+// not acked before the connection got lost. If the ledger is unavailable the task is processed anyway
+func (worker *Worker) taskProcessed(d amqp.Delivery, key string) bool {
+	processed, err := worker.processedTasks.IsTaskProcessed(key)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"task": key,
+			"err":  err.Error(),
+		}).Warning("Unable to check whether task has already been processed. Processing it anyway")
+		return false
+	}
+	if processed {
+		worker.logger.WithFields(logrus.Fields{
+			"task":        key,
+			"redelivered": d.Redelivered,
+		}).Info("Task has already been processed. Skipping")
+	}
+	return processed
+}
+
+// completeTask records the task as completed and acks the delivery. The task is recorded first
+// so a redelivery is skipped even if the ack gets lost
+func (worker *Worker) completeTask(d amqp.Delivery, key string) {
+	err := worker.processedTasks.MarkTaskProcessed(key, processedTaskTTL)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"task": key,
+			"err":  err.Error(),
+		}).Warning("Unable to record task as processed. A redelivery would process it again")
+	}
+	d.Ack(false)
+}
+
+// claimEmail records the email of the template as sent before it is sent. Returns false if it has already been
+// sent. If the ledger is unavailable the email is sent anyway, like tasks are processed anyway
+func (worker *Worker) claimEmail(request types.WhitelistRequest, template string) bool {
+	if worker.sentEmails == nil {
+		return true
+	}
+	claimed, err := worker.sentEmails.ClaimEmail(emailKey(request, template), sentEmailTTL)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":       request.ID.Hex(),
+			"template": template,
+			"err":      err.Error(),
+		}).Warning("Unable to check whether email has already been sent. Sending it anyway")
+		return true
+	}
+	return claimed
+}
+
+// releaseEmail forgets the email of the template which failed to send, so the retry sends it
+func (worker *Worker) releaseEmail(request types.WhitelistRequest, template string) {
+	if worker.sentEmails == nil {
+		return
+	}
+	err := worker.sentEmails.ReleaseEmail(emailKey(request, template))
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":       request.ID.Hex(),
+			"template": template,
+			"err":      err.Error(),
+		}).Warning("Unable to release failed email. A retry would not send it")
+	}
+}
@@ -0,0 +1,78 @@
+package worker
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// lanes process deliveries concurrently while keeping the order of deliveries with the same key.
+// Each key is hashed onto one of a fixed set of lanes which process their deliveries sequentially,
+// so e.g a Deactivate for a player is never applied before their earlier Approve
+type lanes struct {
+	queues []chan amqp.Delivery
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newLanes starts n lanes calling process for each delivery. Each lane buffers up to
+// buffer deliveries, which is the prefetch count so dispatching does not block
+func newLanes(n, buffer int, process func(amqp.Delivery)) *lanes {
+	if n < 1 {
+		n = 1
+	}
+	l := &lanes{
+		queues: make([]chan amqp.Delivery, n),
+		quit:   make(chan struct{}),
+	}
+	for i := range l.queues {
+		l.queues[i] = make(chan amqp.Delivery, buffer)
+		l.wg.Add(1)
+		go l.run(l.queues[i], process)
+	}
+	return l
+}
+
+func (l *lanes) run(queue chan amqp.Delivery, process func(amqp.Delivery)) {
+	defer l.wg.Done()
+	for {
+		// Stop before picking up the next delivery once the lanes are drained
+		select {
+		case <-l.quit:
+			return
+		default:
+		}
+		select {
+		case <-l.quit:
+			return
+		case d := <-queue:
+			process(d)
+		}
+	}
+}
+
+// dispatch queues the delivery on the lane of the key
+func (l *lanes) dispatch(key string, d amqp.Delivery) {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	l.queues[hash.Sum32()%uint32(len(l.queues))] <- d
+}
+
+// drain waits for the deliveries being processed to finish and stops the lanes.
+// Deliveries still queued are dropped. They are unacknowledged so the message queue redelivers them
+func (l *lanes) drain() {
+	close(l.quit)
+	l.wg.Wait()
+}
+
+// laneKey orders whitelist request tasks by player and console tasks among themselves
+func laneKey(d amqp.Delivery) string {
+	if taskType, _ := d.Headers[types.TaskTypeHeader].(string); taskType != "" {
+		return taskType
+	}
+	message, _, _ := types.DecodeRequestMessage(d.Body)
+	return "request:" + strings.ToLower(message.Username)
+}
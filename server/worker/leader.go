@@ -0,0 +1,41 @@
+package worker
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errLeadershipLost stops a periodic job midway once another instance leads, so the steps left are carried out
+// by the job of the new leader instead of twice
+var errLeadershipLost = errors.New("Leadership lost. Leaving the rest of the job to the new leader")
+
+// leaderElection tells whether this instance leads. Implemented by the cache
+type leaderElection interface {
+	IsLeader() bool
+}
+
+// leading reports whether this instance runs the periodic background jobs. Messages are consumed by every
+// instance. An instance without leader election always leads
+func (worker *Worker) leading() bool {
+	return worker.leader == nil || worker.leader.IsLeader()
+}
+
+// runAsLeader runs the periodic job only if this instance leads. The job is expected to check leading before
+// each step with side effects, e.g sending an email, and to return errLeadershipLost once it no longer leads
+func (worker *Worker) runAsLeader(job string, run func() error) bool {
+	if !worker.leading() {
+		return false
+	}
+	err := run()
+	if err == errLeadershipLost {
+		worker.logger.WithFields(logrus.Fields{
+			"job": job,
+		}).Warning(err.Error())
+	} else if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to " + job)
+	}
+	return true
+}
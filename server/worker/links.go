@@ -0,0 +1,52 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// Action links are valid for this long if actionLinkTTLHours is not configured
+const defaultActionLinkTTL = 7 * 24 * time.Hour
+
+// nonceStore registers the nonces of action links so each link can only be used once. Implemented by the cache
+type nonceStore interface {
+	StoreActionNonce(nonce string, ttl time.Duration) error
+}
+
+// statusLinkTTL is how long the status links sent to applicants are valid. 0 if they do not expire
+func statusLinkTTL() time.Duration {
+	return time.Duration(viper.GetInt("statusLinkTTLDays")) * 24 * time.Hour
+}
+
+// ActionLinkTTL is how long action links sent to ops are valid
+func ActionLinkTTL() time.Duration {
+	ttl := time.Duration(viper.GetInt("actionLinkTTLHours")) * time.Hour
+	if ttl <= 0 {
+		return defaultActionLinkTTL
+	}
+	return ttl
+}
+
+// actionToken signs a single use token of the op for the action page of the request and registers its nonce
+func (worker *Worker) actionToken(whitelistRequest types.WhitelistRequest, op string) (string, error) {
+	nonce, err := utils.NewNonce()
+	if err != nil {
+		return "", err
+	}
+	ttl := ActionLinkTTL()
+	if worker.actionNonces != nil {
+		err = worker.actionNonces.StoreActionNonce(nonce, ttl)
+		if err != nil {
+			return "", err
+		}
+	}
+	return utils.SignActionToken(utils.ActionToken{
+		Op:        op,
+		RequestID: whitelistRequest.ID.Hex(),
+		Nonce:     nonce,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	}, utils.PassphraseSecrets().Primary)
+}
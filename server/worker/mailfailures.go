@@ -0,0 +1,72 @@
+package worker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/webhook"
+)
+
+const (
+	// Condition of the alert about emails failing to send, see queueAlerts for the others
+	alertMailFailureRate            = "mail_failure_rate"
+	defaultMailFailureRateThreshold = 0.5
+	// The failure rate is only trusted once this many emails have been sent lately
+	minMailFailureSamples = 5
+)
+
+// errMailFailing is recorded as the cause of new request tasks deferred while most emails fail
+var errMailFailing = errors.New("Most emails fail to send. Action emails to ops paused")
+
+// mailFailureRateThreshold is the share of failed emails from which ops dispatch is paused. 0 disables the pause
+func mailFailureRateThreshold() float64 {
+	if !viper.IsSet("mailFailureRateThreshold") {
+		return defaultMailFailureRateThreshold
+	}
+	return viper.GetFloat64("mailFailureRateThreshold")
+}
+
+// mailFailing tells if most emails sent lately failed, and the share of them which failed. Rejected addresses
+// are not counted, they are no failure of the SMTP setup
+func (worker *Worker) mailFailing() (float64, bool) {
+	if worker.mailFailures == nil {
+		return 0, false
+	}
+	rate, sent := worker.mailFailures.Rate()
+	threshold := mailFailureRateThreshold()
+	failing := threshold > 0 && sent >= minMailFailureSamples && rate >= threshold
+	if failing {
+		metrics.OpsDispatchPaused.Set(1)
+	} else {
+		metrics.OpsDispatchPaused.Set(0)
+	}
+	return rate, failing
+}
+
+// pauseOpsDispatch defers the new request task instead of trying every op address while emails fail, and alerts
+// the owner at most once per queueAlertCooldownMinutes. Like a deferral for maintenance, it does not count
+// towards maxRetries
+func (worker *Worker) pauseOpsDispatch(d amqp.Delivery, request types.WhitelistRequest, rate float64) {
+	now := time.Now()
+	if worker.queueMonitor != nil && worker.queueMonitor.allow(alertMailFailureRate, now, queueAlertCooldown()) {
+		worker.sendQueueAlert(webhook.QueueAlert{
+			Condition: alertMailFailureRate,
+			Queue:     worker.topology.TaskQueue,
+			Value:     int64(rate * 100),
+			Threshold: int64(mailFailureRateThreshold() * 100),
+			Timestamp: now,
+		})
+	}
+	action := "Dispatch action emails to ops for " + request.Username
+	if worker.deferTask(d, retryDelay(0), action, errMailFailing, amqp.Table{types.SkipConfirmationHeader: true}) {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":   request.ID.Hex(),
+			"rate": rate,
+		}).Warning("Most emails fail to send. Action emails to ops paused")
+	}
+}
@@ -0,0 +1,218 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maintenanceMargin lands deferred tasks a bit after the end of the window, once the game server is back up
+const maintenanceMargin = time.Minute
+
+// maxMaintenance is the longest tasks are deferred for at once
+const maxMaintenance = 7 * 24 * time.Hour
+
+// MaintenanceWindow is a recurring window during which the game server is down, e.g for its nightly restart.
+// It starts at Hour:Minute wall clock time in Location on the given Days, every day if none, and lasts Duration
+type MaintenanceWindow struct {
+	Hour, Minute int
+	Duration     time.Duration
+	Location     *time.Location
+	Days         []time.Weekday
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseMaintenanceWindows reads the maintenance windows of the game server of the tenant, the top level windows
+// if the tenant has none of its own
+func ParseMaintenanceWindows(cfg tenant.Config) ([]MaintenanceWindow, error) {
+	entries, _ := cfg.Get("maintenanceWindows").([]interface{})
+	windows := make([]MaintenanceWindow, 0, len(entries))
+	for i, entry := range entries {
+		window, err := parseMaintenanceWindow(stringKeys(entry))
+		if err != nil {
+			return nil, fmt.Errorf("maintenanceWindows[%d]: %s", i, err.Error())
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// ValidateMaintenanceWindows checks the maintenance windows of every tenant
+func ValidateMaintenanceWindows() error {
+	for _, cfg := range tenant.All() {
+		_, err := ParseMaintenanceWindows(cfg)
+		if err != nil && cfg.ID != "" {
+			return fmt.Errorf("%s of tenant %s", err.Error(), cfg.ID)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseMaintenanceWindow(fields map[string]interface{}) (MaintenanceWindow, error) {
+	start, err := parseTimeOfDay(fields["start"])
+	if err != nil {
+		return MaintenanceWindow{}, err
+	}
+	if start >= 24*time.Hour {
+		return MaintenanceWindow{}, fmt.Errorf("invalid start %q, expected HH:MM before 24:00", fields["start"])
+	}
+	window := MaintenanceWindow{
+		Hour:     int(start / time.Hour),
+		Minute:   int(start % time.Hour / time.Minute),
+		Location: defaultLocation(),
+	}
+	duration, _ := fields["duration"].(string)
+	window.Duration, err = time.ParseDuration(strings.TrimSpace(duration))
+	if err != nil || window.Duration <= 0 || window.Duration > 24*time.Hour {
+		return MaintenanceWindow{}, fmt.Errorf("invalid duration %q, expected e.g 30m, at most 24h", duration)
+	}
+	if timezone, _ := fields["timezone"].(string); timezone != "" {
+		window.Location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return MaintenanceWindow{}, fmt.Errorf("unknown timezone %q", timezone)
+		}
+	}
+	days, _ := fields["days"].([]interface{})
+	for _, value := range days {
+		name, _ := value.(string)
+		day, ok := parseWeekday(name)
+		if !ok {
+			return MaintenanceWindow{}, fmt.Errorf("unknown day %q, expected e.g Mon", name)
+		}
+		window.Days = append(window.Days, day)
+	}
+	return window, nil
+}
+
+// parseWeekday accepts the name of the day or its first three letters, e.g Monday or Mon
+func parseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) < 3 {
+		return 0, false
+	}
+	day, ok := weekdays[name[:3]]
+	return day, ok && strings.HasPrefix(strings.ToLower(day.String()), name)
+}
+
+// endAt returns the end of the occurrence of the window in progress at t, the zero time if none is. Occurrences
+// start at the wall clock time of their day, so they follow daylight saving time, and last Duration of elapsed
+// time. Occurrences starting the day before may still be in progress after midnight
+func (w MaintenanceWindow) endAt(t time.Time) time.Time {
+	local := t.In(w.Location)
+	for daysBack := 0; daysBack <= 1; daysBack++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()-daysBack, 12, 0, 0, 0, w.Location)
+		if !w.onDay(day.Weekday()) {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), w.Hour, w.Minute, 0, 0, w.Location)
+		end := start.Add(w.Duration)
+		if !t.Before(start) && t.Before(end) {
+			return end
+		}
+	}
+	return time.Time{}
+}
+
+func (w MaintenanceWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceEnd tells if the game server is in one of the windows at t and when it is over. Windows
+// overlapping or following each other without a gap count as one, up to maxMaintenance so windows covering
+// the whole day still let the tasks come back once in a while
+func maintenanceEnd(windows []MaintenanceWindow, t time.Time) (time.Time, bool) {
+	end := t
+	for extended := true; extended && end.Sub(t) < maxMaintenance; {
+		extended = false
+		for _, window := range windows {
+			if windowEnd := window.endAt(end); windowEnd.After(end) {
+				end = windowEnd
+				extended = true
+			}
+		}
+	}
+	return end, end.After(t)
+}
+
+// inMaintenance tells if the game server of the tenant is in a maintenance window and when it is over. Invalid
+// windows are rejected on startup, see ParseMaintenanceWindows
+func (worker *Worker) inMaintenance(cfg tenant.Config, t time.Time) (time.Time, bool) {
+	windows, err := ParseMaintenanceWindows(cfg)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"serverId": cfg.ID,
+			"err":      err.Error(),
+		}).Warning("Invalid maintenance windows. Ignored")
+		return time.Time{}, false
+	}
+	return maintenanceEnd(windows, t)
+}
+
+// deferGameServerTask republishes the task to the retry queue so it comes back once the maintenance window is
+// over, see inMaintenance
+func (worker *Worker) deferGameServerTask(d amqp.Delivery, until time.Time, action string, headers amqp.Table) {
+	if worker.deferTask(d, time.Until(until)+maintenanceMargin, action, errMaintenance, headers) {
+		worker.logger.WithFields(logrus.Fields{
+			"action": action,
+			"until":  until.Format(time.RFC3339),
+		}).Info("Game server in maintenance. Action deferred until the end of the window")
+		metrics.MaintenanceDeferrals.Inc()
+	}
+}
+
+// deferTask republishes the task with the headers to the retry queue so it comes back after the delay. Unlike a
+// retry, the deferral does not count towards maxRetries. Returns false if the task is requeued instead
+func (worker *Worker) deferTask(d amqp.Delivery, delay time.Duration, action string, cause error, headers amqp.Table) bool {
+	newHeaders := make(amqp.Table)
+	for k, v := range d.Headers {
+		newHeaders[k] = v
+	}
+	for k, v := range headers {
+		newHeaders[k] = v
+	}
+	retryID := primitive.NewObjectID()
+	newHeaders[types.RetryIDHeader] = retryID.Hex()
+	err := worker.publishRetry(d, newHeaders, delay)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"action": action,
+			"cause":  cause.Error(),
+			"err":    err.Error(),
+		}).Error("Unable to defer message. Requeue the message")
+		d.Nack(false, true)
+		return false
+	}
+	worker.recordRetry(d, retryID, action, cause, newHeaders, delay)
+	d.Ack(false)
+	return true
+}
+
+// errMaintenance is recorded as the cause of deferred tasks, see deferGameServerTask
+var errMaintenance = errors.New("Game server in maintenance")
@@ -0,0 +1,244 @@
+package worker
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/telegram"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// opProfileStore keeps the profiles of the ops, managed by admins. Implemented by the db
+type opProfileStore interface {
+	GetOpProfiles() ([]types.OpProfile, error)
+	SeedOpProfiles(profiles []types.OpProfile) (bool, error)
+}
+
+// ConfiguredOpProfiles returns a profile for every op of the ops config of the tenants, handling the tenants the
+// op is configured for, to seed the profiles with
+func ConfiguredOpProfiles(now time.Time) ([]types.OpProfile, error) {
+	profiles := []types.OpProfile{}
+	index := make(map[string]int)
+	for _, cfg := range tenant.All() {
+		ops, err := ParseTenantOps(cfg)
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range ops {
+			email := strings.ToLower(op.Email)
+			i, ok := index[email]
+			if !ok {
+				index[email] = len(profiles)
+				profiles = append(profiles, types.OpProfile{Email: email, Actor: workerActor, Timestamp: now})
+				i = len(profiles) - 1
+			}
+			if !profiles[i].HandlesTenant(cfg.ID) {
+				profiles[i].Tenants = append(profiles[i].Tenants, cfg.ID)
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// seedOpProfiles migrates the ops config to profiles unless admins manage the ops already. Best effort only,
+// the ops config is used until there are profiles
+func (worker *Worker) seedOpProfiles() {
+	if worker.opProfiles == nil {
+		return
+	}
+	profiles, err := ConfiguredOpProfiles(time.Now())
+	if err == nil {
+		var seeded bool
+		seeded, err = worker.opProfiles.SeedOpProfiles(profiles)
+		if seeded {
+			worker.logger.WithFields(logrus.Fields{
+				"ops": len(profiles),
+			}).Info("Op profiles seeded from the ops config")
+		}
+	}
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to seed op profiles from the ops config")
+	}
+}
+
+// profilesByOp returns the profiles of the ops by lowercase email. Read on every dispatch, so changes of the
+// profiles take effect right away. Nil if there are no profiles or they can not be read, the ops config is used then
+func (worker *Worker) profilesByOp() map[string]types.OpProfile {
+	if worker.opProfiles == nil {
+		return nil
+	}
+	profiles, err := worker.opProfiles.GetOpProfiles()
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to get op profiles. Using the ops config")
+		return nil
+	}
+	if len(profiles) == 0 {
+		return nil
+	}
+	byOp := make(map[string]types.OpProfile, len(profiles))
+	for _, profile := range profiles {
+		byOp[strings.ToLower(profile.Email)] = profile
+	}
+	return byOp
+}
+
+// opsOf returns the ops of the tenant, see ProfileOps
+func (worker *Worker) opsOf(cfg tenant.Config) ([]Op, error) {
+	return profileOps(worker.profilesByOp(), cfg)
+}
+
+// ProfileOps returns the ops of the profiles handling the tenant, ordered by email, once there are profiles. The
+// ops config of the tenant until then. The availability windows and locales of ops stay in the ops config
+func ProfileOps(profiles []types.OpProfile, cfg tenant.Config) ([]Op, error) {
+	var byOp map[string]types.OpProfile
+	if len(profiles) > 0 {
+		byOp = make(map[string]types.OpProfile, len(profiles))
+		for _, profile := range profiles {
+			byOp[strings.ToLower(profile.Email)] = profile
+		}
+	}
+	return profileOps(byOp, cfg)
+}
+
+func profileOps(profiles map[string]types.OpProfile, cfg tenant.Config) ([]Op, error) {
+	configured, err := ParseTenantOps(cfg)
+	if err != nil || profiles == nil {
+		return configured, err
+	}
+	settings := make(map[string]Op, len(configured))
+	for _, op := range configured {
+		settings[strings.ToLower(op.Email)] = op
+	}
+	emails := make([]string, 0, len(profiles))
+	for email := range profiles {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	ops := []Op{}
+	for _, email := range emails {
+		if !profiles[email].HandlesTenant(cfg.ID) {
+			continue
+		}
+		op := settings[email]
+		op.Email = email
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// noOpsFor tells if the tenant has no ops to dispatch requests to, see NoOpsConfigured
+func (worker *Worker) noOpsFor(cfg tenant.Config) bool {
+	ops, err := worker.opsOf(cfg)
+	return err == nil && len(ops) == 0
+}
+
+// anyOps tells if any tenant has ops to dispatch requests to
+func (worker *Worker) anyOps() bool {
+	for _, cfg := range tenant.All() {
+		if !worker.noOpsFor(cfg) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutDigestOps leaves out the ops who opted into the daily digest instead of an action email for each new
+// request. Falls back to all the ops if every op opted in, so requests are never sent to nobody
+func withoutDigestOps(ops []string, profiles map[string]types.OpProfile) []string {
+	kept := make([]string, 0, len(ops))
+	for _, op := range ops {
+		if !profiles[strings.ToLower(op)].Digest {
+			kept = append(kept, op)
+		}
+	}
+	if len(kept) == 0 {
+		return ops
+	}
+	return kept
+}
+
+// digestOps returns the ops of the tenant who opted into the daily digest, available and not away. Only used
+// while new requests are dispatched right away, in digest mode every op gets the digest
+func (worker *Worker) digestOps(cfg tenant.Config, profiles map[string]types.OpProfile) []string {
+	ops, err := profileOps(profiles, cfg)
+	if err != nil {
+		return nil
+	}
+	opted := []Op{}
+	for _, op := range ops {
+		if profiles[op.Email].Digest {
+			opted = append(opted, op)
+		}
+	}
+	if len(opted) == 0 {
+		return nil
+	}
+	now := time.Now()
+	return presentOps(availableOps(opted, now), worker.awayOps(now))
+}
+
+// anyDigestOps tells if any op opted into the daily digest
+func (worker *Worker) anyDigestOps() bool {
+	for _, profile := range worker.profilesByOp() {
+		if profile.Digest {
+			return true
+		}
+	}
+	return false
+}
+
+// newOpChats returns the chats of ops with the bot of telegramBotToken, nil if no bot is configured
+func newOpChats() func(chatID string) alerter {
+	token := viper.GetString("telegramBotToken")
+	if token == "" {
+		return nil
+	}
+	return func(chatID string) alerter {
+		return telegram.NewClient(viper.GetString("telegramAPIURL"), token, chatID, nil)
+	}
+}
+
+// notifyOp notifies the op about the event through the channels of their profile. email sends the email to the
+// op and text returns the Telegram message. Ops without a profile are emailed. Ops who chose Telegram are emailed
+// instead if they have no chat or no bot is configured, so they are not left out. Returns false if the op muted
+// the event
+func (worker *Worker) notifyOp(profiles map[string]types.OpProfile, event, op string, email func() error, text func() string) (bool, error) {
+	profile, ok := profiles[strings.ToLower(op)]
+	if !ok {
+		return true, email()
+	}
+	channels := profile.Channels(event)
+	if len(channels) == 0 {
+		return false, nil
+	}
+	sendEmail := false
+	var err error
+	for _, channel := range channels {
+		switch channel {
+		case types.OpChannelTelegram:
+			if worker.opChats == nil || profile.TelegramChatID == "" {
+				sendEmail = true
+				continue
+			}
+			if sendErr := worker.opChats(profile.TelegramChatID).Send(text()); sendErr != nil && err == nil {
+				err = sendErr
+			}
+		default:
+			sendEmail = true
+		}
+	}
+	if sendEmail {
+		if emailErr := email(); emailErr != nil && err == nil {
+			err = emailErr
+		}
+	}
+	return true, err
+}
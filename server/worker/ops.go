@@ -0,0 +1,216 @@
+package worker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/mailer"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+)
+
+// Op represents an op who handles whitelist applications. An op without
+// availability windows is considered available at any time. Locale is the language
+// of the emails sent to the op and defaults to opsLocale
+type Op struct {
+	Email        string
+	Locale       string
+	Availability []AvailabilityWindow
+}
+
+// AvailabilityWindow is a daily time window in the timezone config (UTC by default) during which an op handles
+// applications. Start is inclusive and End is exclusive. A window with End before Start wraps around midnight
+type AvailabilityWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseOps reads the configured ops. Each entry is either a plain email address
+// or an object with an email and an optional list of availability windows, e.g.
+//
+//	ops:
+//	  - op1@gmail.com
+//	  - email: op2@gmail.com
+//	    locale: zh-CN
+//	    availability:
+//	      - start: "00:00"
+//	        end: "12:00"
+func ParseOps() ([]Op, error) {
+	return ParseTenantOps(tenant.Default)
+}
+
+// ParseTenantOps reads the ops of the tenant, the top level ops if the tenant has no ops of its own
+func ParseTenantOps(cfg tenant.Config) ([]Op, error) {
+	entries, ok := cfg.Get("ops").([]interface{})
+	if !ok {
+		// Also accept ops set as a string slice. e.g from environment variables
+		ops := []Op{}
+		for _, email := range cfg.GetStringSlice("ops") {
+			ops = append(ops, Op{Email: email})
+		}
+		return ops, nil
+	}
+	ops := make([]Op, 0, len(entries))
+	for i, entry := range entries {
+		switch v := entry.(type) {
+		case string:
+			ops = append(ops, Op{Email: v})
+		case map[interface{}]interface{}, map[string]interface{}:
+			fields := stringKeys(v)
+			email, _ := fields["email"].(string)
+			if email == "" {
+				return nil, fmt.Errorf("ops[%d] is missing the email field", i)
+			}
+			op := Op{Email: email}
+			if locale, _ := fields["locale"].(string); locale != "" {
+				op.Locale = mailer.NormalizeLocale(locale)
+				if op.Locale == "" {
+					return nil, fmt.Errorf("ops[%d].locale %q is not supported, expected one of %v", i, locale, mailer.SupportedLocales)
+				}
+			}
+			windows, _ := fields["availability"].([]interface{})
+			for j, w := range windows {
+				window, err := parseWindow(stringKeys(w))
+				if err != nil {
+					return nil, fmt.Errorf("ops[%d].availability[%d]: %s", i, j, err.Error())
+				}
+				op.Availability = append(op.Availability, window)
+			}
+			ops = append(ops, op)
+		default:
+			return nil, fmt.Errorf("ops[%d] must be an email address or an object with an email field", i)
+		}
+	}
+	return ops, nil
+}
+
+// NoOpsConfigured tells if the ops list of the tenant is empty, e.g on a fresh install. New requests
+// are parked until ops are configured instead of being dispatched to nobody
+func NoOpsConfigured(cfg tenant.Config) bool {
+	ops, err := ParseTenantOps(cfg)
+	return err == nil && len(ops) == 0
+}
+
+// anyOpsConfigured tells if any tenant has ops to dispatch requests to
+func anyOpsConfigured() bool {
+	for _, cfg := range tenant.All() {
+		if !NoOpsConfigured(cfg) {
+			return true
+		}
+	}
+	return false
+}
+
+// opsLocale returns the language of the emails sent to the op: the locale of the op if set in the ops of
+// any tenant, otherwise opsLocale. Ops emails do not follow the language of the applicant
+func opsLocale(email string) string {
+	for _, cfg := range tenant.All() {
+		ops, err := ParseTenantOps(cfg)
+		if err != nil {
+			continue
+		}
+		for _, op := range ops {
+			if op.Email == email && op.Locale != "" {
+				return op.Locale
+			}
+		}
+	}
+	if locale := mailer.NormalizeLocale(viper.GetString("opsLocale")); locale != "" {
+		return locale
+	}
+	return mailer.DefaultLocale
+}
+
+// IsAvailable tells if the op handles applications at the given time
+func (op Op) IsAvailable(t time.Time) bool {
+	if len(op.Availability) == 0 {
+		return true
+	}
+	t = t.In(defaultLocation())
+	timeOfDay := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, window := range op.Availability {
+		if window.Start <= window.End {
+			if timeOfDay >= window.Start && timeOfDay < window.End {
+				return true
+			}
+		} else if timeOfDay >= window.Start || timeOfDay < window.End {
+			return true
+		}
+	}
+	return false
+}
+
+// availableOps returns the emails of ops available at the given time.
+// Fall back to all ops if no one is available so requests are never sent to nobody
+func availableOps(ops []Op, t time.Time) []string {
+	available := []string{}
+	for _, op := range ops {
+		if op.IsAvailable(t) {
+			available = append(available, op.Email)
+		}
+	}
+	if len(available) == 0 {
+		return opEmails(ops)
+	}
+	return available
+}
+
+func opEmails(ops []Op) []string {
+	emails := make([]string, 0, len(ops))
+	for _, op := range ops {
+		emails = append(emails, op.Email)
+	}
+	return emails
+}
+
+func parseWindow(fields map[string]interface{}) (AvailabilityWindow, error) {
+	start, err := parseTimeOfDay(fields["start"])
+	if err != nil {
+		return AvailabilityWindow{}, err
+	}
+	end, err := parseTimeOfDay(fields["end"])
+	if err != nil {
+		return AvailabilityWindow{}, err
+	}
+	return AvailabilityWindow{Start: start, End: end}, nil
+}
+
+// parse "HH:MM" into the duration since midnight. "24:00" is accepted as the end of the day
+func parseTimeOfDay(value interface{}) (time.Duration, error) {
+	s, _ := value.(string)
+	s = strings.TrimSpace(s)
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// defaultLocation is the timezone times of day are in unless configured otherwise, the timezone config. UTC if
+// it is invalid, which is reported on startup
+func defaultLocation() *time.Location {
+	location, err := schedule.Location()
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// yaml decodes nested objects with interface{} keys
+func stringKeys(value interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			result[fmt.Sprintf("%v", k)] = v
+		}
+	}
+	return result
+}
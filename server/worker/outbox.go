@@ -0,0 +1,157 @@
+package worker
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// Interval between two polls of the outbox if outboxPollSeconds is not configured
+	defaultOutboxPollInterval = time.Second
+	// Time a relay instance has to publish a claimed entry if outboxLeaseSeconds is not configured.
+	// Must be longer than the publish confirm timeout
+	defaultOutboxLease = 30 * time.Second
+)
+
+// outboxStore holds the tasks of request changes written by the API until the relay published them.
+// Implemented by *db.Service
+type outboxStore interface {
+	ClaimOutboxEntry(owner string, lease time.Duration, skip []primitive.ObjectID) (types.OutboxEntry, error)
+	HasUnsentOutboxEntryBefore(entry types.OutboxEntry) (bool, error)
+	MarkOutboxEntrySent(id primitive.ObjectID, owner string, sentAt time.Time) error
+	ReleaseOutboxEntry(id primitive.ObjectID, owner string) error
+	OutboxBacklog() (int64, time.Time, error)
+}
+
+func outboxPollInterval() time.Duration {
+	if seconds := viper.GetInt("outboxPollSeconds"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultOutboxPollInterval
+}
+
+func outboxLease() time.Duration {
+	if seconds := viper.GetInt("outboxLeaseSeconds"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultOutboxLease
+}
+
+// Periodically publish the tasks the API wrote to the outbox. The relay keeps running with directPublish
+// so the entries written before rolling back are still published
+func (worker *Worker) outboxRelayLoop() {
+	for range schedule.Tick(schedule.Every(outboxPollInterval())) {
+		// The publisher is replaced while reconnecting
+		if atomic.LoadInt32(&worker.reconnecting) == 1 {
+			continue
+		}
+		_, err := worker.relayOutbox()
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to relay outbox")
+		}
+		worker.updateOutboxLag(time.Now())
+	}
+}
+
+// relayOutbox publishes the unsent outbox entries until there is none left to claim and returns the number
+// of entries published. Relay instances claim entries with a lease so each entry is published by one of them
+// at a time. An entry is only published once the earlier entries of its request are, otherwise the request is
+// skipped until the next poll. An entry may be published twice if its lease expires before it is marked sent,
+// which the worker tolerates as tasks are idempotent and stale tasks are skipped by sequence
+func (worker *Worker) relayOutbox() (int, error) {
+	skip := []primitive.ObjectID{}
+	published := 0
+	for {
+		entry, err := worker.outbox.ClaimOutboxEntry(worker.relayID, outboxLease(), skip)
+		if err == mongo.ErrNoDocuments {
+			return published, nil
+		} else if err != nil {
+			return published, err
+		}
+		earlier, err := worker.outbox.HasUnsentOutboxEntryBefore(entry)
+		if err != nil || earlier {
+			// The earlier entry is claimed by another relay instance or is published on the next poll
+			worker.releaseOutboxEntry(entry)
+			if err != nil {
+				return published, err
+			}
+			skip = append(skip, entry.RequestID)
+			continue
+		}
+		err = worker.publishOutboxEntry(entry)
+		if err != nil {
+			// Published again on the next poll
+			worker.releaseOutboxEntry(entry)
+			return published, err
+		}
+		metrics.OutboxPublishDelay.Observe(time.Since(entry.CreatedAt).Seconds())
+		published++
+		err = worker.outbox.MarkOutboxEntrySent(entry.ID, worker.relayID, time.Now())
+		if err == mongo.ErrNoDocuments {
+			worker.logger.WithFields(logrus.Fields{
+				"ID":        entry.ID.Hex(),
+				"requestID": entry.RequestID.Hex(),
+			}).Warning("Lease of outbox entry expired before it was marked sent. It may be published again")
+		} else if err != nil {
+			// Published again once the lease expires
+			return published, err
+		}
+	}
+}
+
+// publishOutboxEntry publishes the task of the entry and waits for the confirmation of the message queue.
+// Tasks age from the time the change was stored
+func (worker *Worker) publishOutboxEntry(entry types.OutboxEntry) error {
+	headers := amqp.Table{types.PublishedAtHeader: entry.CreatedAt.Unix()}
+	if task, _, err := types.DecodeRequestMessage(entry.Body); err == nil && types.HighPriority(task.Status) {
+		headers[types.PriorityHeader] = types.PriorityHigh
+	}
+	return worker.publisher.publish(
+		"",                                   // exchange
+		worker.topology.TaskQueueOf(headers), // routing key
+		amqp.Publishing{
+			Headers:      headers,
+			DeliveryMode: amqp.Persistent,
+			ContentType:  "application/json",
+			Body:         entry.Body,
+		})
+}
+
+func (worker *Worker) releaseOutboxEntry(entry types.OutboxEntry) {
+	err := worker.outbox.ReleaseOutboxEntry(entry.ID, worker.relayID)
+	if err != nil {
+		// Claimed again once the lease expires
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  entry.ID.Hex(),
+			"err": err.Error(),
+		}).Error("Unable to release outbox entry")
+	}
+}
+
+// updateOutboxLag exposes the number of unsent outbox entries and the age of the oldest one
+func (worker *Worker) updateOutboxLag(now time.Time) {
+	pending, oldest, err := worker.outbox.OutboxBacklog()
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to read outbox backlog")
+		return
+	}
+	metrics.OutboxPending.Set(float64(pending))
+	lag := 0.0
+	if !oldest.IsZero() {
+		lag = now.Sub(oldest).Seconds()
+	}
+	metrics.OutboxLag.Set(lag)
+}
@@ -0,0 +1,192 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// Time to wait for the message queue to confirm a publication if publishConfirmTimeoutSeconds is not configured
+const defaultPublishConfirmTimeout = 5 * time.Second
+
+var errChannelClosed = errors.New("Channel closed before the publication was confirmed")
+
+// publishChannel is the part of the channel used to publish. Implemented by *amqp.Channel
+type publishChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// publisher publishes mandatory messages on a channel in confirm mode and waits for their confirmation,
+// so a message is never reported as published if the message queue lost or could not route it.
+// Confirms are matched by delivery tag, counted by the publisher, so the channel must be dedicated to it:
+// a publication it did not make would shift the tags of all the following ones
+type publisher struct {
+	channel publishChannel
+	timeout time.Duration
+
+	mu sync.Mutex
+	// Delivery tag of the last publication. The message queue numbers publications from 1
+	deliveryTag uint64
+	pending     map[uint64]*pendingPublication
+	// Delivery tags of pending publications by message ID, to match returned messages
+	messageTags map[string]uint64
+	closed      bool
+}
+
+type pendingPublication struct {
+	done     chan error
+	returned *amqp.Return
+}
+
+// newPublisher matches the confirmations and returned messages of the channel with the publications.
+// The confirmations channel is closed by the client library when the channel is closed
+func newPublisher(channel publishChannel, confirms <-chan amqp.Confirmation, returns <-chan amqp.Return, timeout time.Duration) *publisher {
+	p := &publisher{
+		channel:     channel,
+		timeout:     timeout,
+		pending:     make(map[uint64]*pendingPublication),
+		messageTags: make(map[string]uint64),
+	}
+	go p.dispatch(confirms, returns)
+	return p
+}
+
+func publishConfirmTimeout() time.Duration {
+	if seconds := viper.GetInt("publishConfirmTimeoutSeconds"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultPublishConfirmTimeout
+}
+
+// publish publishes the message and waits until the message queue confirms it. Returns an error
+// if the message was returned as unroutable, nacked, or not confirmed within the timeout
+func (p *publisher) publish(exchange, key string, msg amqp.Publishing) error {
+	if msg.Headers == nil {
+		msg.Headers = make(amqp.Table)
+	}
+	// Messages delayed in the retry queue are signed as of the time they come back
+	dueAt := time.Now()
+	if ms, err := strconv.ParseInt(msg.Expiration, 10, 64); err == nil {
+		dueAt = dueAt.Add(time.Duration(ms) * time.Millisecond)
+	}
+	err := types.SignMessage(msg.Headers, msg.Body, dueAt, utils.PassphraseSecrets().Primary)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errChannelClosed
+	}
+	tag := p.deliveryTag + 1
+	msg.MessageId = strconv.FormatUint(tag, 10) + "-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	err = p.channel.Publish(exchange, key, true, false, msg)
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	p.deliveryTag = tag
+	publication := &pendingPublication{done: make(chan error, 1)}
+	p.pending[tag] = publication
+	p.messageTags[msg.MessageId] = tag
+	p.mu.Unlock()
+
+	select {
+	case err = <-publication.done:
+		return err
+	case <-time.After(p.timeout):
+		p.mu.Lock()
+		delete(p.pending, tag)
+		delete(p.messageTags, msg.MessageId)
+		p.mu.Unlock()
+		return fmt.Errorf("Publication was not confirmed within %s", p.timeout)
+	}
+}
+
+func (p *publisher) dispatch(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			p.recordReturn(r)
+		case c, ok := <-confirms:
+			if !ok {
+				p.close()
+				return
+			}
+			// The message queue sends the return of a message before its confirmation
+			p.drainReturns(returns)
+			p.confirm(c)
+		}
+	}
+}
+
+func (p *publisher) drainReturns(returns <-chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				return
+			}
+			p.recordReturn(r)
+		default:
+			return
+		}
+	}
+}
+
+func (p *publisher) recordReturn(r amqp.Return) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if publication, ok := p.pending[p.messageTags[r.MessageId]]; ok {
+		publication.returned = &r
+	}
+}
+
+func (p *publisher) confirm(c amqp.Confirmation) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	publication, ok := p.pending[c.DeliveryTag]
+	if !ok {
+		// Timed out in the meantime
+		return
+	}
+	delete(p.pending, c.DeliveryTag)
+	for id, tag := range p.messageTags {
+		if tag == c.DeliveryTag {
+			delete(p.messageTags, id)
+			break
+		}
+	}
+	switch {
+	case publication.returned != nil:
+		publication.done <- fmt.Errorf("Message returned as unroutable by exchange %q with routing key %q: %s",
+			publication.returned.Exchange, publication.returned.RoutingKey, publication.returned.ReplyText)
+	case !c.Ack:
+		publication.done <- errors.New("Publication nacked by the message queue")
+	default:
+		publication.done <- nil
+	}
+}
+
+// close fails all pending publications once the channel is closed
+func (p *publisher) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for tag, publication := range p.pending {
+		publication.done <- errChannelClosed
+		delete(p.pending, tag)
+	}
+	p.messageTags = make(map[string]uint64)
+}
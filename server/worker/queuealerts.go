@@ -0,0 +1,205 @@
+package worker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
+	"github.com/tywin1104/mc-gatekeeper/topology"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/webhook"
+)
+
+// Conditions of queue alerts
+const (
+	alertTaskQueueDepth  = "task_queue_depth"
+	alertRetryQueueDepth = "retry_queue_depth"
+	alertMessageAge      = "message_age"
+)
+
+const (
+	defaultQueueMonitorInterval = time.Minute
+	defaultQueueAlertCooldown   = time.Hour
+)
+
+// queueMonitor tracks the oldest task delivered since the last check of the queues and when each alert
+// condition was last reported, so every condition is alerted at most once per cooldown
+type queueMonitor struct {
+	mu          sync.Mutex
+	oldest      time.Time
+	lastAlerted map[string]time.Time
+}
+
+func newQueueMonitor() *queueMonitor {
+	return &queueMonitor{lastAlerted: make(map[string]time.Time)}
+}
+
+func queueMonitorInterval() time.Duration {
+	if seconds := viper.GetInt("queueMonitorIntervalSeconds"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultQueueMonitorInterval
+}
+
+func queueAlertCooldown() time.Duration {
+	if minutes := viper.GetInt("queueAlertCooldownMinutes"); minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return defaultQueueAlertCooldown
+}
+
+// queueAlertEmail is the address queue alerts are sent to. Defaults to ownerEmail
+func queueAlertEmail() string {
+	if email := viper.GetString("queueAlertEmail"); email != "" {
+		return email
+	}
+	return viper.GetString("ownerEmail")
+}
+
+// observe records the first publication of a delivered task. Tasks published without the header are ignored
+func (m *queueMonitor) observe(headers amqp.Table) {
+	if m == nil {
+		return
+	}
+	publishedAt := headerInt(headers, types.PublishedAtHeader)
+	if publishedAt <= 0 {
+		return
+	}
+	t := time.Unix(int64(publishedAt), 0)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.oldest.IsZero() || t.Before(m.oldest) {
+		m.oldest = t
+	}
+}
+
+// oldestAge returns the age of the oldest task delivered since the previous call, 0 if none was delivered
+func (m *queueMonitor) oldestAge(now time.Time) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.oldest.IsZero() {
+		return 0
+	}
+	age := now.Sub(m.oldest)
+	m.oldest = time.Time{}
+	return age
+}
+
+// allow reports whether the condition may be alerted, i.e it was not alerted within the cooldown
+func (m *queueMonitor) allow(condition string, now time.Time, cooldown time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if last, ok := m.lastAlerted[condition]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+	m.lastAlerted[condition] = now
+	return true
+}
+
+// queueAlerts returns the alert conditions exceeded by the queue depths and the age of the oldest delivered
+// task. queueDepthAlertThreshold applies to the task and the retry queue. A threshold of 0 disables its alerts
+func queueAlerts(names topology.Names, depths map[string]int, oldestAge time.Duration, now time.Time) []webhook.QueueAlert {
+	alerts := []webhook.QueueAlert{}
+	if threshold := viper.GetInt("queueDepthAlertThreshold"); threshold > 0 {
+		for condition, queue := range map[string]string{alertTaskQueueDepth: names.TaskQueue, alertRetryQueueDepth: names.RetryQueue} {
+			if depth, ok := depths[queue]; ok && depth > threshold {
+				alerts = append(alerts, webhook.QueueAlert{
+					Condition: condition,
+					Queue:     queue,
+					Value:     int64(depth),
+					Threshold: int64(threshold),
+					Timestamp: now,
+				})
+			}
+		}
+	}
+	if limit := time.Duration(viper.GetInt("messageAgeAlertMinutes")) * time.Minute; limit > 0 && oldestAge > limit {
+		alerts = append(alerts, webhook.QueueAlert{
+			Condition: alertMessageAge,
+			Queue:     names.TaskQueue,
+			Value:     int64(oldestAge.Seconds()),
+			Threshold: int64(limit.Seconds()),
+			Timestamp: now,
+		})
+	}
+	return alerts
+}
+
+// describeQueueAlert is the text of the alert email
+func describeQueueAlert(alert webhook.QueueAlert) string {
+	if alert.Condition == alertMailFailureRate {
+		return fmt.Sprintf("%d%% of the emails sent lately failed, at least the threshold of %d%%. Action emails to ops are paused "+
+			"until emails are sent again. The SMTP credentials may have expired", alert.Value, alert.Threshold)
+	}
+	if alert.Condition == alertMessageAge {
+		return fmt.Sprintf("A task has been in the queues for %d minutes, longer than the limit of %d minutes",
+			alert.Value/60, alert.Threshold/60)
+	}
+	return fmt.Sprintf("%s holds %d messages, more than the threshold of %d", alert.Queue, alert.Value, alert.Threshold)
+}
+
+// Periodically check the depth of the queues and the age of delivered tasks, alerting the owner if they
+// exceed their thresholds
+func (worker *Worker) queueMonitorLoop() {
+	for range schedule.Tick(schedule.Every(queueMonitorInterval())) {
+		// The queues are shared, only the leader alerts about them
+		if worker.leading() {
+			worker.checkQueues(time.Now())
+		}
+	}
+}
+
+func (worker *Worker) checkQueues(now time.Time) {
+	depths, err := worker.inspectQueues(worker.topology.Queues())
+	if err != nil {
+		// Alert on the queues inspected so far and the age of delivered tasks
+		worker.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to inspect queue depth")
+	}
+	oldestAge := worker.queueMonitor.oldestAge(now)
+	metrics.OldestMessageAge.Set(oldestAge.Seconds())
+	for _, alert := range queueAlerts(worker.topology, depths, oldestAge, now) {
+		if worker.queueMonitor.allow(alert.Condition, now, queueAlertCooldown()) {
+			worker.sendQueueAlert(alert)
+		}
+	}
+}
+
+// sendQueueAlert emails the alert to the owner and sends it to the webhook endpoints. Best effort only
+func (worker *Worker) sendQueueAlert(alert webhook.QueueAlert) {
+	metrics.QueueAlerts.WithLabelValues(alert.Condition).Inc()
+	worker.logger.WithFields(logrus.Fields{
+		"condition": alert.Condition,
+		"queue":     alert.Queue,
+		"value":     alert.Value,
+		"threshold": alert.Threshold,
+	}).Error("Message queue alert")
+	if worker.webhooks != nil {
+		worker.webhooks.Enqueue(webhook.Event{
+			Event:     webhook.QueueAlertEvent,
+			Timestamp: alert.Timestamp,
+			Data:      alert,
+		})
+	}
+	recipent := queueAlertEmail()
+	if recipent == "" {
+		return
+	}
+	err := worker.sendMail("./mailer/templates/queue_alert.html", map[string]string{
+		"alert":      describeQueueAlert(alert),
+		"detectedAt": formatExpiry(alert.Timestamp),
+	}, "[Alert] Message queue needs attention", recipent)
+	if err != nil {
+		// Likely if the alert is about emails failing in the first place. The webhook and the metrics still tell
+		worker.logger.WithFields(logrus.Fields{
+			"recipent": recipent,
+			"err":      err,
+		}).Error("Failed to send queue alert email")
+	}
+}
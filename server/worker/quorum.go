@@ -0,0 +1,62 @@
+package worker
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// ValidateQuorum checks that every tenant has enough ops to reach minRequiredReceiver. Otherwise every new
+// request fails the quorum, so the worker refuses to start instead
+func ValidateQuorum() error {
+	return validateQuorum(ParseTenantOps)
+}
+
+// validateQuorum checks the quorum against the ops of the tenants returned by opsOf
+func validateQuorum(opsOf func(tenant.Config) ([]Op, error)) error {
+	required := viper.GetInt("minRequiredReceiver")
+	for _, cfg := range tenant.All() {
+		name := "default tenant"
+		if cfg.ID != "" {
+			name = "tenant " + cfg.ID
+		}
+		ops, err := opsOf(cfg)
+		if err != nil {
+			return fmt.Errorf("Invalid ops of the %s. %s", name, err.Error())
+		}
+		if len(ops) == 0 {
+			return fmt.Errorf("No ops configured for the %s. Every new request would fail the quorum of minRequiredReceiver", name)
+		}
+		if required > len(ops) {
+			return fmt.Errorf("minRequiredReceiver %d is higher than the %d ops configured for the %s. Every new request would fail the quorum",
+				required, len(ops), name)
+		}
+	}
+	return nil
+}
+
+// emailFallbackApprover sends the action email of a request whose quorum of ops can not be reached to
+// fallbackApprover. One email sent to it satisfies the quorum. Returns the fallback approver if it was notified
+func (worker *Worker) emailFallbackApprover(request types.WhitelistRequest) []string {
+	fallback := requestTenant(request).GetString("fallbackApprover")
+	if fallback == "" {
+		return nil
+	}
+	notified, _, err := worker.emailToOps(request, []string{fallback})
+	if err != nil || len(notified) == 0 {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":       request.ID.Hex(),
+			"recipent": fallback,
+		}).Error("Unable to send the action email to the fallback approver")
+		return nil
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"ID":       request.ID.Hex(),
+		"username": request.Username,
+		"recipent": fallback,
+	}).Error("Quorum of ops not reached. The fallback approver was sent the action email instead. Check the ops configuration and the SMTP server")
+	return notified
+}
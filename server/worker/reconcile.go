@@ -0,0 +1,207 @@
+package worker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+const (
+	// Actor of the audit entries of whitelist fixes made by the reconciliation
+	reconcileActor = "reconcile"
+	// Discrepancies between the whitelist of the game server and the approved requests
+	discrepancyNotApproved = "notApproved"
+	discrepancyMissing     = "missing"
+)
+
+// e.g "There are 2 whitelisted players: Steve, Alex" or "There are 2 (out of 3 seen) whitelisted players:\nSteve, Alex"
+var whitelistCountPattern = regexp.MustCompile(`There are (\d+|no) .*whitelisted players`)
+
+// ReconcileReport lists the discrepancies between the whitelist of the game server and the approved
+// requests, and the usernames fixed or failed to be fixed unless it was a dry run
+type ReconcileReport struct {
+	DryRun bool `json:"dryRun"`
+	// Whitelisted on the game server without an approved request
+	NotApproved []string `json:"notApproved"`
+	// Approved but not whitelisted on the game server
+	Missing []string `json:"missing"`
+	Fixed   []string `json:"fixed"`
+	Failed  []string `json:"failed"`
+}
+
+// Periodically reconcile the whitelist of the game server with the approved requests
+func (worker *Worker) reconcileLoop() {
+	var lastRun time.Time
+	for range schedule.Tick(schedule.Every(60 * time.Second)) {
+		interval := time.Duration(viper.GetInt("reconcileIntervalMinutes")) * time.Minute
+		if interval <= 0 || time.Since(lastRun) < interval || !worker.leading() {
+			continue
+		}
+		// The whitelist cannot be listed while the game server restarts. Reconciled on the next tick after the window
+		if _, ok := worker.inMaintenance(tenant.Default, time.Now()); ok {
+			continue
+		}
+		lastRun = time.Now()
+		_, err := worker.Reconcile(ReconcileDryRun())
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to reconcile the whitelist")
+		}
+	}
+}
+
+// ReconcileDryRun tells if the reconciliation only reports discrepancies. It is the default
+// so the discrepancies can be reviewed before they are fixed for the first time
+func ReconcileDryRun() bool {
+	return !viper.IsSet("reconcileDryRun") || viper.GetBool("reconcileDryRun")
+}
+
+// Reconcile compares the whitelist of the game server with the approved requests. Unless it is a dry run,
+// players without approved request are removed from the whitelist and approved players are added to it
+func (worker *Worker) Reconcile(dryRun bool) (ReconcileReport, error) {
+	// Only the game server of the default tenant is reconciled
+	approved, err := worker.store.QueryRequests(db.RequestFilter{
+		Statuses: []string{types.StatusApproved},
+		Tenants:  []string{""},
+	})
+	if err != nil {
+		return ReconcileReport{}, err
+	}
+	return worker.reconcile(approved, dryRun, worker.audit.CreateAuditEntry)
+}
+
+func (worker *Worker) reconcile(approved []types.WhitelistRequest, dryRun bool, audit func(types.AuditEntry) error) (ReconcileReport, error) {
+	log := worker.logger
+	response, err := worker.issueRCON("whitelist list")
+	if err != nil {
+		return ReconcileReport{}, err
+	}
+	whitelisted, err := parseWhitelist(response)
+	if err != nil {
+		return ReconcileReport{}, err
+	}
+	report := whitelistDiscrepancies(whitelisted, approved, viper.GetStringSlice("reconcileIgnore"))
+	report.DryRun = dryRun
+	log.WithFields(logrus.Fields{
+		"notApproved": report.NotApproved,
+		"missing":     report.Missing,
+		"dryRun":      dryRun,
+	}).Info("Whitelist reconciled with approved requests")
+	if dryRun {
+		return report, nil
+	}
+	fix := func(username, discrepancy, command string) {
+		response, cmdErr := worker.issueRCON(command)
+		if cmdErr != nil {
+			log.WithFields(logrus.Fields{
+				"username": username,
+				"err":      cmdErr.Error(),
+			}).Error("Unable to fix whitelist discrepancy on the game server")
+			report.Failed = append(report.Failed, username)
+		} else {
+			report.Fixed = append(report.Fixed, username)
+		}
+		err := audit(reconcileAuditEntry(username, discrepancy, command, response, cmdErr))
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"username": username,
+				"err":      err.Error(),
+			}).Error("Unable to record whitelist fix in the audit log")
+		}
+	}
+	for _, username := range report.NotApproved {
+		fix(username, discrepancyNotApproved, "whitelist remove "+username)
+	}
+	for _, username := range report.Missing {
+		fix(username, discrepancyMissing, "whitelist add "+username)
+	}
+	return report, nil
+}
+
+func reconcileAuditEntry(username, discrepancy, command, response string, cmdErr error) types.AuditEntry {
+	details := map[string]interface{}{
+		"username":    username,
+		"discrepancy": discrepancy,
+		"command":     command,
+		"response":    response,
+	}
+	if cmdErr != nil {
+		details["error"] = cmdErr.Error()
+	}
+	return types.AuditEntry{
+		Action:    "whitelist.reconcile",
+		Actor:     reconcileActor,
+		Details:   details,
+		Timestamp: time.Now(),
+	}
+}
+
+// parseWhitelist parses the response of the whitelist list command into usernames. An error is returned
+// if the response is not recognized or lists fewer players than it counts, e.g if it got truncated
+func parseWhitelist(response string) ([]string, error) {
+	match := whitelistCountPattern.FindStringSubmatch(response)
+	if match == nil {
+		return nil, fmt.Errorf("Unrecognized whitelist response %q", response)
+	}
+	if match[1] == "no" {
+		return []string{}, nil
+	}
+	count, _ := strconv.Atoi(match[1])
+	usernames := []string{}
+	if i := strings.Index(response, ":"); i >= 0 {
+		list := strings.Replace(response[i+1:], " and ", ",", -1)
+		for _, username := range strings.Split(list, ",") {
+			if username = strings.TrimSpace(username); username != "" {
+				usernames = append(usernames, username)
+			}
+		}
+	}
+	if len(usernames) != count {
+		return nil, fmt.Errorf("Whitelist response lists %d out of %d players", len(usernames), count)
+	}
+	return usernames, nil
+}
+
+// whitelistDiscrepancies compares the whitelisted usernames with the approved requests. Usernames are
+// case insensitive and ignored usernames, e.g of the owner, are never reported
+func whitelistDiscrepancies(whitelisted []string, approved []types.WhitelistRequest, ignored []string) ReconcileReport {
+	skip := make(map[string]bool)
+	for _, username := range ignored {
+		skip[strings.ToLower(username)] = true
+	}
+	onServer := make(map[string]bool)
+	for _, username := range whitelisted {
+		onServer[strings.ToLower(username)] = true
+	}
+	expected := make(map[string]bool)
+	report := ReconcileReport{NotApproved: []string{}, Missing: []string{}, Fixed: []string{}, Failed: []string{}}
+	for _, request := range approved {
+		username := strings.ToLower(request.Username)
+		if expected[username] {
+			continue
+		}
+		expected[username] = true
+		if !onServer[username] && !skip[username] {
+			report.Missing = append(report.Missing, request.Username)
+		}
+	}
+	for _, username := range whitelisted {
+		if !expected[strings.ToLower(username)] && !skip[strings.ToLower(username)] {
+			report.NotApproved = append(report.NotApproved, username)
+		}
+	}
+	sort.Strings(report.NotApproved)
+	sort.Strings(report.Missing)
+	return report
+}
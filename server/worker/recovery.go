@@ -0,0 +1,124 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultRecoveryInterval = 30 * time.Minute
+	defaultRecoveryGrace    = 10 * time.Minute
+	defaultRecoveryLookback = 72 * time.Hour
+)
+
+// onserverStore records the state of players on the game server and finds the requests whose state was never
+// recorded. Implemented by db.Store
+type onserverStore interface {
+	SetOnserverStatus(id primitive.ObjectID, status string, sequence int64, onserverStatus string) error
+	StuckRequests(since, before time.Time) ([]types.WhitelistRequest, error)
+}
+
+func recoveryInterval() time.Duration {
+	if !viper.IsSet("recoveryIntervalMinutes") {
+		return defaultRecoveryInterval
+	}
+	return time.Duration(viper.GetInt("recoveryIntervalMinutes")) * time.Minute
+}
+
+// recoveryGrace is how long a request waits for its task before it is considered stuck, so tasks still in the
+// queue or being retried are not republished
+func recoveryGrace() time.Duration {
+	grace := time.Duration(viper.GetInt("recoveryGraceMinutes")) * time.Minute
+	if grace <= 0 {
+		return defaultRecoveryGrace
+	}
+	return grace
+}
+
+// recoveryLookback is how far back stuck requests are looked for. Older requests, e.g approved before the
+// state of players was recorded, are left to the reconciliation of the whitelist
+func recoveryLookback() time.Duration {
+	lookback := time.Duration(viper.GetInt("recoveryLookbackHours")) * time.Hour
+	if lookback <= 0 {
+		return defaultRecoveryLookback
+	}
+	return lookback
+}
+
+// recordOnserverStatus records the state of the player on the game server once the task of the request has
+// been carried out there. The recovery pass republishes the task if it is never recorded
+func (worker *Worker) recordOnserverStatus(request types.WhitelistRequest, onserverStatus string) error {
+	if worker.onserver == nil {
+		return nil
+	}
+	err := worker.onserver.SetOnserverStatus(request.ID, request.Status, request.Sequence, onserverStatus)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":             request.ID.Hex(),
+			"onserverStatus": onserverStatus,
+			"err":            err.Error(),
+		}).Warning("Unable to record the state of the player on the game server")
+	}
+	return err
+}
+
+// Recover stuck requests on startup, then every recoveryIntervalMinutes. 0 only recovers them on startup
+func (worker *Worker) recoveryLoop() {
+	worker.runAsLeader("recover stuck requests", worker.recoverStuckRequests)
+	interval := recoveryInterval()
+	if interval <= 0 {
+		return
+	}
+	for range schedule.Tick(schedule.Every(interval)) {
+		worker.runAsLeader("recover stuck requests", worker.recoverStuckRequests)
+	}
+}
+
+// recoverStuckRequests republishes the tasks of the requests whose game server state does not match their
+// status, e.g because the worker stopped before recording it. The game server actions are idempotent, e.g
+// whitelisting a whitelisted player succeeds, so carrying them out again converges the state
+func (worker *Worker) recoverStuckRequests() error {
+	if worker.onserver == nil {
+		return nil
+	}
+	now := time.Now()
+	stuck, err := worker.onserver.StuckRequests(now.Add(-recoveryLookback()), now.Add(-recoveryGrace()))
+	if err != nil {
+		return err
+	}
+	recovered := 0
+	for _, request := range stuck {
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		// Tasks of game servers in maintenance are deferred until the end of the window, not stuck
+		if _, ok := worker.inMaintenance(requestTenant(request), now); ok {
+			continue
+		}
+		// The applicant was told about the decision by the first attempt
+		err = worker.publishRequest(request, stepsHeaders(types.StepNotifyApplicant))
+		if err != nil {
+			return err
+		}
+		recovered++
+		metrics.RecoveredRequests.WithLabelValues(request.Status).Inc()
+		worker.logger.WithFields(logrus.Fields{
+			"ID":             request.ID.Hex(),
+			"username":       request.Username,
+			"status":         request.Status,
+			"onserverStatus": request.OnserverStatus,
+		}).Warning("Request stuck in a transitional state. Task republished")
+	}
+	if recovered > 0 {
+		worker.logger.WithFields(logrus.Fields{
+			"recovered": recovered,
+		}).Warning("Recovered requests stuck in a transitional state")
+	}
+	return nil
+}
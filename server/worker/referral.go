@@ -0,0 +1,140 @@
+package worker
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Decision reason of new requests denied because no member in good standing vouched for the applicant
+const referrerDenialReason = "no valid referrer"
+
+// ReferralRequired tells if applicants of the tenant must be vouched for by a member in good standing. Requests
+// without one are denied instead of being flagged to ops
+func ReferralRequired(cfg tenant.Config) bool {
+	return cfg.GetBool("referralRequired")
+}
+
+// ValidateReferrer checks the referrer of a new request names another player and is given if referrals are required
+func ValidateReferrer(request types.WhitelistRequest) error {
+	if request.ReferrerUsername == "" {
+		if ReferralRequired(requestTenant(request)) {
+			return errors.New("A current member must vouch for you. Please enter their username")
+		}
+		return nil
+	}
+	if !utils.ValidPlayerName(request.ReferrerUsername) {
+		return errors.New("The username of the member vouching for you is not a valid Minecraft username")
+	}
+	if types.SameReferrer(request.ReferrerUsername, request.Username) {
+		return errors.New("You can not vouch for yourself")
+	}
+	return nil
+}
+
+// referralStore reads the requests of referrers, records the referral found on a request and denies requests
+// without a valid one. Implemented by db.Store
+type referralStore interface {
+	QueryRequests(filter db.RequestFilter) ([]types.WhitelistRequest, error)
+	SetReferral(id primitive.ObjectID, referral types.Referral) error
+	TransitionStatus(id primitive.ObjectID, change db.StatusChange) (types.WhitelistRequest, error)
+}
+
+// checkReferral records the standing of the referrer of the request on it and returns it. Requests whose referrer
+// is not a member in good standing are tagged TagUnverifiedReferrer. Nil if the request has no referrer or the
+// referrer can not be read. Best effort only, ops may accept the request either way
+func (worker *Worker) checkReferral(request types.WhitelistRequest) *types.Referral {
+	if worker.referrals == nil || request.ReferrerUsername == "" || request.Canary || request.Bench != "" {
+		return nil
+	}
+	log := worker.logger.WithFields(logrus.Fields{
+		"ID":       request.ID.Hex(),
+		"referrer": request.ReferrerUsername,
+	})
+	referrerRequests, err := worker.referrals.QueryRequests(db.RequestFilter{
+		Tenants:  []string{request.ServerID},
+		Username: request.ReferrerUsername,
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to read the requests of the referrer")
+		return nil
+	}
+	referral := types.ReferralOf(referrerRequests)
+	// A request can not vouch for itself
+	if types.SameReferrer(request.ReferrerUsername, request.Username) {
+		referral = types.Referral{Standing: types.ReferrerUnknown}
+	}
+	err = worker.referrals.SetReferral(request.ID, referral)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to record the referral of the request")
+	}
+	return &referral
+}
+
+// rejectUnverifiedReferral denies a new request without a member in good standing vouching for it if the tenant
+// requires referrals, and tells the applicant why. Returns false if the request is dispatched to ops as usual,
+// e.g because the referrer could not be checked
+func (worker *Worker) rejectUnverifiedReferral(request types.WhitelistRequest) bool {
+	if worker.referrals == nil || request.Canary || request.Bench != "" || !ReferralRequired(requestTenant(request)) {
+		return false
+	}
+	if request.ReferrerUsername != "" {
+		referral := worker.checkReferral(request)
+		if referral == nil || referral.Verified() {
+			return false
+		}
+	}
+	deniedRequest, err := worker.referrals.TransitionStatus(request.ID, db.StatusChange{
+		From:   types.StatusPending,
+		To:     types.StatusDenied,
+		At:     time.Now(),
+		Admin:  workerActor,
+		Reason: referrerDenialReason,
+	})
+	if err == db.ErrConflict {
+		// The request has been decided or removed in the meantime
+		return true
+	} else if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Error("Unable to deny request without a valid referrer")
+		return false
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"ID":       request.ID.Hex(),
+		"username": request.Username,
+		"referrer": request.ReferrerUsername,
+	}).Warning("Request without a valid referrer denied. Skip dispatching to ops")
+	// Counted and told as submitted and then denied
+	worker.updateCache(request)
+	worker.updateCache(deniedRequest)
+	worker.emailReferrerRejection(deniedRequest)
+	worker.notifyStatusChange(request)
+	deniedRequest.PreviousStatus = types.StatusPending
+	worker.notifyStatusChange(deniedRequest)
+	return true
+}
+
+// referralTemplateData is the referral of the request shown to ops in the action email
+func referralTemplateData(request types.WhitelistRequest) string {
+	if request.Referral == nil || request.ReferrerUsername == "" {
+		return ""
+	}
+	summary := request.Referral.Summary(request.ReferrerUsername)
+	if !request.Referral.Verified() {
+		summary += " [" + strings.ToUpper(types.TagUnverifiedReferrer) + "]"
+	}
+	return summary
+}
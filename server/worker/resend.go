@@ -0,0 +1,73 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+func resendTaskKey(task types.ResendTask) string {
+	return "resend:" + task.ID.Hex()
+}
+
+// processResendTask sends an email of a request again on behalf of an admin, with newly signed links.
+// Retry if the email failed, only to the ops whose action email failed
+func (worker *Worker) processResendTask(ctx context.Context, d amqp.Delivery) {
+	log := worker.taskLogger(ctx)
+	var task types.ResendTask
+	err := json.Unmarshal(d.Body, &task)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"messageBody": d.Body,
+			"err":         err,
+		}).Error("Unable to decode message into resendTask")
+		d.Nack(false, false)
+		return
+	}
+	request := task.Request
+	log.WithFields(logrus.Fields{
+		"username": request.Username,
+		"ID":       request.ID,
+		"email":    task.Email,
+		"actor":    task.Actor,
+		"Type":     "Resend Task",
+	}).Info("Received new task")
+	if worker.taskProcessed(d, resendTaskKey(task)) {
+		d.Ack(false)
+		return
+	}
+
+	switch task.Email {
+	case types.EmailConfirmation:
+		err = worker.emailConfirmation(request, true)
+	case types.EmailDecision:
+		err = worker.emailDecision(request, true)
+	case types.EmailOpsAction:
+		ops := task.Ops
+		if failedOps := headerStrings(d.Headers, failedOpsHeader); failedOps != nil {
+			ops = failedOps
+		}
+		var failedOps []string
+		_, failedOps, err = worker.emailToOps(request, ops)
+		if err == nil && len(failedOps) > 0 {
+			worker.retryMsgWithDelay(d, "Resend action email of "+request.Username+" to ops", errOpsNotEmailed(failedOps), amqp.Table{
+				failedOpsHeader: toTableArray(failedOps),
+			})
+			return
+		}
+	default:
+		log.WithFields(logrus.Fields{
+			"email": task.Email,
+		}).Error("Unknown email to resend")
+		d.Nack(false, false)
+		return
+	}
+	if err != nil {
+		worker.retryMsgWithDelay(d, "Resend "+task.Email+" email of "+request.Username, err, nil)
+		return
+	}
+	worker.completeTask(d, resendTaskKey(task))
+}
@@ -0,0 +1,120 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// retryStore records the messages parked in the retry queue, so admins can see them and retry or abandon them
+type retryStore interface {
+	RecordRetry(retry types.Retry) error
+	ConsumeRetry(id primitive.ObjectID, now time.Time) (string, error)
+}
+
+// errOpsNotEmailed is the cause of the retry of action emails which failed to send to some ops
+func errOpsNotEmailed(failedOps []string) error {
+	return fmt.Errorf("Unable to email ops %s", strings.Join(failedOps, ", "))
+}
+
+// retryRequestID returns the hex ID of the request the task is about, or of the console task
+func retryRequestID(d amqp.Delivery) string {
+	var task struct {
+		ID      primitive.ObjectID `json:"_id"`
+		Request struct {
+			ID primitive.ObjectID `json:"_id"`
+		} `json:"request"`
+	}
+	if json.Unmarshal(d.Body, &task) != nil {
+		return ""
+	}
+	switch taskType, _ := d.Headers[types.TaskTypeHeader].(string); taskType {
+	case types.ResendTaskType, types.CommentTaskType:
+		return task.Request.ID.Hex()
+	case "":
+		request, _, err := types.DecodeRequestMessage(d.Body)
+		if err != nil {
+			return ""
+		}
+		return request.ID.Hex()
+	}
+	return task.ID.Hex()
+}
+
+// recordRetry records the message republished to the retry queue with the headers. Best effort only, the retry
+// is carried out even if it is not recorded
+func (worker *Worker) recordRetry(d amqp.Delivery, id primitive.ObjectID, action string, cause error, headers amqp.Table, delay time.Duration) {
+	if worker.retries == nil {
+		return
+	}
+	now := time.Now()
+	taskType, _ := d.Headers[types.TaskTypeHeader].(string)
+	retry := types.Retry{
+		ID:            id,
+		TaskType:      taskType,
+		RequestID:     retryRequestID(d),
+		Action:        action,
+		Attempt:       headerInt(headers, retryCountHeader),
+		NextAttemptAt: now.Add(delay),
+		Status:        types.RetryParked,
+		Timestamp:     now,
+		Body:          d.Body,
+		Headers:       headers,
+	}
+	if cause != nil {
+		retry.LastError = cause.Error()
+	}
+	err := worker.retries.RecordRetry(retry)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"action": action,
+			"err":    err.Error(),
+		}).Warning("Unable to record retry")
+	}
+}
+
+// consumeRetry reconciles the retry recorded for a message coming back from the retry queue, so it is no longer
+// listed as parked. Returns false if the message has been acked and is not to be processed: an admin abandoned
+// it, or it is the original of a retry an admin forced which has been processed already
+func (worker *Worker) consumeRetry(d amqp.Delivery) bool {
+	hexID, _ := d.Headers[types.RetryIDHeader].(string)
+	if hexID == "" || worker.retries == nil {
+		return true
+	}
+	id, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		return true
+	}
+	status, err := worker.retries.ConsumeRetry(id, time.Now())
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			// Processed anyway, a task processed twice is skipped by the ledger of completed tasks
+			worker.logger.WithFields(logrus.Fields{
+				"retryId": hexID,
+				"err":     err.Error(),
+			}).Warning("Unable to consume retry")
+		}
+		return true
+	}
+	switch status {
+	case types.RetryAbandoned:
+		worker.logger.WithFields(logrus.Fields{
+			"retryId": hexID,
+		}).Warning("Retry abandoned by an admin. Dropping message")
+	case types.RetryConsumed:
+		worker.logger.WithFields(logrus.Fields{
+			"retryId": hexID,
+		}).Info("Retry forced by an admin has been processed already. Dropping message")
+	default:
+		return true
+	}
+	d.Ack(false)
+	return false
+}
@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+var errNoOpNotified = errors.New("No op received the review reminder")
+
+// Periodically ask ops to review provisional approvals that reached their review date
+func (worker *Worker) reviewReminderLoop() {
+	for range schedule.Tick(schedule.Every(60 * time.Second)) {
+		if !worker.anyOps() {
+			continue
+		}
+		worker.runAsLeader("remind ops of provisional approvals to review", worker.remindProvisionalReviews)
+	}
+}
+
+// remindProvisionalReviews emails the review action link of provisional approvals past their review date.
+// The op can confirm the approval, extend the trial period or deactivate the player
+func (worker *Worker) remindProvisionalReviews() error {
+	dueRequests, err := worker.store.QueryRequests(db.RequestFilter{
+		Statuses:          []string{types.StatusApproved},
+		ReviewDueBefore:   time.Now(),
+		NotReviewReminded: true,
+	})
+	if err != nil {
+		return err
+	}
+	for _, request := range dueRequests {
+		// Tasks of unknown tenants are parked, so are their reminders
+		if !tenant.Known(request.ServerID) {
+			continue
+		}
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		// Claim the reminder atomically so concurrent workers do not remind twice
+		err := worker.store.SetReviewReminded(request.ID, true)
+		if err == db.ErrConflict {
+			continue
+		} else if err != nil {
+			return err
+		}
+		targets, err := worker.reviewTargets(request)
+		if err != nil {
+			return err
+		}
+		subject := "[Review Required] Provisional membership of " + request.Username
+		notifiedOps, _, err := worker.emailActionLinks(request, targets, types.OpEventReview, "./mailer/templates/review.html", subject, map[string]interface{}{
+			"username":   request.Username,
+			"approvedAt": formatExpiry(request.ProcessedTimestamp),
+		})
+		if err == nil && len(notifiedOps) == 0 {
+			err = errNoOpNotified
+		}
+		if err != nil {
+			// Release the claim so the reminder is sent on the next run
+			revertErr := worker.store.SetReviewReminded(request.ID, false)
+			if revertErr != nil {
+				worker.logger.WithFields(logrus.Fields{
+					"ID":  request.ID.Hex(),
+					"err": revertErr.Error(),
+				}).Error("Unable to release review reminder of request")
+			}
+			return err
+		}
+		// The review link is only valid for assignees of the request
+		worker.addAssignees(request, notifiedOps)
+		worker.logger.WithFields(logrus.Fields{
+			"ID":          request.ID.Hex(),
+			"username":    request.Username,
+			"notifiedOps": notifiedOps,
+		}).Info("Ops reminded to review provisional approval")
+	}
+	return nil
+}
+
+// reviewTargets are the op who approved the request if still configured, otherwise all ops of the tenant.
+// All ops are targeted if provisionalReviewAllOps is set
+func (worker *Worker) reviewTargets(request types.WhitelistRequest) ([]string, error) {
+	configuredOps, err := worker.opsOf(requestTenant(request))
+	if err != nil {
+		return nil, err
+	}
+	emails := opEmails(configuredOps)
+	if viper.GetBool("provisionalReviewAllOps") {
+		return emails, nil
+	}
+	for _, op := range emails {
+		if op == request.Admin {
+			return []string{op}, nil
+		}
+	}
+	return emails, nil
+}
@@ -0,0 +1,69 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Actor of the audit entries of stale tasks skipped by the worker
+const workerActor = "worker"
+
+// sequenceLedger records the sequence of the last task applied to each request, so a task published
+// before another one of the same request is not applied after it, e.g once it is retried
+type sequenceLedger interface {
+	ClaimSequence(id primitive.ObjectID, sequence int64) (bool, int64, error)
+	CreateAuditEntry(entry types.AuditEntry) error
+}
+
+// claimSequence checks whether the task is the latest of its request and records it as applied.
+// Stale tasks are acked and noted in the audit log. Returns false if the task must not be processed
+func (worker *Worker) claimSequence(d amqp.Delivery, request types.WhitelistRequest) bool {
+	claimed, applied, err := worker.appliedSequences.ClaimSequence(request.ID, request.Sequence)
+	if err != nil {
+		// Processing it anyway could apply it after a later task
+		worker.logger.WithFields(logrus.Fields{
+			"ID":       request.ID.Hex(),
+			"sequence": request.Sequence,
+			"err":      err.Error(),
+		}).Error("Unable to check whether task is the latest of the request")
+		worker.retryMsgWithDelay(d, "Check sequence of "+request.Username+"'s task", err, nil)
+		return false
+	}
+	if claimed {
+		return true
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"ID":              request.ID.Hex(),
+		"status":          request.Status,
+		"sequence":        request.Sequence,
+		"appliedSequence": applied,
+	}).Warning("A later task of the request has already been applied. Skipping")
+	err = worker.appliedSequences.CreateAuditEntry(staleTaskAuditEntry(request, applied))
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Error("Unable to record stale task in the audit log")
+	}
+	worker.completeTask(d, requestTaskKey(request))
+	return false
+}
+
+func staleTaskAuditEntry(request types.WhitelistRequest, applied int64) types.AuditEntry {
+	return types.AuditEntry{
+		Action: "request.stale",
+		Actor:  workerActor,
+		Details: map[string]interface{}{
+			"requestID":       request.ID.Hex(),
+			"username":        request.Username,
+			"status":          request.Status,
+			"sequence":        request.Sequence,
+			"appliedSequence": applied,
+		},
+		Timestamp: time.Now(),
+	}
+}
@@ -0,0 +1,79 @@
+package worker
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// networkStore reads the requests submitted from a network and records the signals found on the request.
+// Implemented by db.Store
+type networkStore interface {
+	GetRequest(id primitive.ObjectID) (types.WhitelistRequest, error)
+	QueryRequests(filter db.RequestFilter) ([]types.WhitelistRequest, error)
+	SetNetworkSignals(id primitive.ObjectID, signals types.NetworkSignals) error
+}
+
+// collectNetworkSignals records the prior requests of the same server submitted from the network of the request
+// on it and returns them. Nil if there are none or they can not be read. Best effort only, the request is
+// dispatched to ops either way
+func (worker *Worker) collectNetworkSignals(request types.WhitelistRequest) *types.NetworkSignals {
+	if worker.networks == nil || request.Canary || request.Bench != "" {
+		return nil
+	}
+	log := worker.logger.WithFields(logrus.Fields{
+		"ID": request.ID.Hex(),
+	})
+	// The network is never part of the task
+	stored, err := worker.networks.GetRequest(request.ID)
+	if err == db.ErrNotFound {
+		return nil
+	} else if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to read the network of the request")
+		return nil
+	}
+	if stored.SubmissionIPPrefix == "" {
+		return nil
+	}
+	prior, err := worker.networks.QueryRequests(db.RequestFilter{
+		Tenants:            []string{request.ServerID},
+		SubmissionIPPrefix: stored.SubmissionIPPrefix,
+		ExcludeID:          request.ID,
+		NotBench:           true,
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to read the prior requests of the network")
+		return nil
+	}
+	signals := networkSignals(prior)
+	if signals.PriorRequests == 0 {
+		return nil
+	}
+	err = worker.networks.SetNetworkSignals(request.ID, signals)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to record the network signals of the request")
+	}
+	return &signals
+}
+
+// networkSignals summarizes the prior requests of a network, most recent first
+func networkSignals(prior []types.WhitelistRequest) types.NetworkSignals {
+	signals := types.NetworkSignals{PriorRequests: len(prior)}
+	for _, request := range prior {
+		if request.Status != types.StatusBanned {
+			continue
+		}
+		signals.PriorBanned++
+		if len(signals.BannedUsernames) < types.MaxSignalUsernames {
+			signals.BannedUsernames = append(signals.BannedUsernames, request.Username)
+		}
+	}
+	return signals
+}
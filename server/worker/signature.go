@@ -0,0 +1,88 @@
+package worker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// Messages signed longer ago are rejected if messageMaxAgeMinutes is not configured. Messages delayed in the
+// retry queue are signed as of the time they come back, see types.SignMessage
+const defaultMessageMaxAge = 24 * time.Hour
+
+var (
+	errMessageExpired  = errors.New("Message signed too long ago")
+	errMessageReplayed = errors.New("Message ID already seen")
+)
+
+// messageLedger records the IDs of the messages seen, so a message published again is rejected
+type messageLedger interface {
+	ClaimMessageID(id string, ttl time.Duration) (bool, error)
+}
+
+func messageMaxAge() time.Duration {
+	if minutes := viper.GetInt("messageMaxAgeMinutes"); minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return defaultMessageMaxAge
+}
+
+// verifyMessage checks the delivery is signed, not older than messageMaxAgeMinutes and not seen before, so a
+// message crafted or replayed by anyone with access to the message queue, e.g approving their own request, is
+// not processed. Rejected messages are parked in the dead-letter queue. Unsigned messages are accepted while
+// acceptUnsignedMessages is set, to roll out signing. Returns true if the message may be processed
+func (worker *Worker) verifyMessage(d amqp.Delivery) bool {
+	id, signedAt, err := types.VerifyMessage(d.Headers, d.Body, utils.PassphraseSecrets())
+	if err == types.ErrUnsignedMessage && viper.GetBool("acceptUnsignedMessages") {
+		return true
+	}
+	if err == nil && time.Since(signedAt) > messageMaxAge() {
+		err = errMessageExpired
+	}
+	// Deliveries not acked before a reconnect or requeued come back with the same ID
+	if err == nil && !d.Redelivered && !worker.claimMessageID(id, time.Until(signedAt.Add(messageMaxAge()))) {
+		err = errMessageReplayed
+	}
+	if err == nil {
+		return true
+	}
+	reason := map[error]string{
+		types.ErrUnsignedMessage:  "unsigned",
+		types.ErrMessageSignature: "signature",
+		errMessageExpired:         "expired",
+		errMessageReplayed:        "replayed",
+	}[err]
+	worker.logger.WithFields(logrus.Fields{
+		"messageID": id,
+		"signedAt":  signedAt,
+		"taskType":  d.Headers[types.TaskTypeHeader],
+		"err":       err.Error(),
+	}).Error("Message rejected. Parked in the dead-letter queue")
+	metrics.RejectedMessages.WithLabelValues(reason).Inc()
+	d.Nack(false, false)
+	metrics.DeadLettered.Inc()
+	return false
+}
+
+// claimMessageID records the message ID as seen until the message expires. Returns false if it was seen before.
+// If the ledger is unavailable the message is accepted, its signature and age are still checked
+func (worker *Worker) claimMessageID(id string, ttl time.Duration) bool {
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	claimed, err := worker.seenMessages.ClaimMessageID(id, ttl)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"messageID": id,
+			"err":       err.Error(),
+		}).Warning("Unable to check whether the message has been seen before. Processing it anyway")
+		return true
+	}
+	return claimed
+}
@@ -0,0 +1,131 @@
+package worker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/config"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/mailer"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+const (
+	slaCheckInterval = time.Hour
+	// A request is listed in the SLA digest at most once per interval
+	slaRenotifyInterval = 24 * time.Hour
+)
+
+// Periodically tell ops about requests pending longer than slaHours
+func (worker *Worker) slaLoop() {
+	for range schedule.Tick(schedule.Every(slaCheckInterval)) {
+		if config.GetInt("slaHours") <= 0 {
+			continue
+		}
+		worker.runAsLeader("notify ops about requests breaching the SLA", func() error {
+			return worker.notifySLABreaches(time.Now())
+		})
+	}
+}
+
+// slaBreachFilter matches the pending requests submitted before the cutoff that ops have not been told
+// about since notifiedBefore
+func slaBreachFilter(cutoff, notifiedBefore time.Time) db.RequestFilter {
+	return db.RequestFilter{
+		Statuses:          []string{types.StatusPending},
+		SubmittedBefore:   cutoff,
+		SLANotifiedBefore: notifiedBefore,
+	}
+}
+
+// notifySLABreaches emails the ops of each tenant a digest of the requests of the tenant pending longer than
+// the SLA. Each request is listed at most once a day
+func (worker *Worker) notifySLABreaches(now time.Time) error {
+	for _, cfg := range tenant.All() {
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		err := worker.notifyTenantSLABreaches(cfg, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (worker *Worker) notifyTenantSLABreaches(cfg tenant.Config, now time.Time) error {
+	sla := time.Duration(config.GetInt("slaHours")) * time.Hour
+	filter := slaBreachFilter(now.Add(-sla), now.Add(-slaRenotifyInterval))
+	filter.Tenants = []string{cfg.ID}
+	breaches, err := worker.store.QueryRequests(filter)
+	if err != nil {
+		return err
+	}
+	claimed := make([]types.WhitelistRequest, 0, len(breaches))
+	for _, request := range breaches {
+		// Claim the notification atomically so concurrent workers do not list the request twice
+		err := worker.store.ClaimSLANotification(request.ID, now.Add(-slaRenotifyInterval), now)
+		if err == db.ErrConflict {
+			continue
+		} else if err != nil {
+			return err
+		}
+		claimed = append(claimed, request)
+	}
+	if len(claimed) == 0 {
+		return nil
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"serverId": cfg.ID,
+		"requests": len(claimed),
+	}).Warning("Requests are pending longer than the SLA. Notifying ops")
+	return worker.emailSLADigest(cfg, claimed, now)
+}
+
+// emailSLADigest sends the digest of the requests breaching the SLA to every op of the tenant. Best effort per op
+func (worker *Worker) emailSLADigest(cfg tenant.Config, requests []types.WhitelistRequest, now time.Time) error {
+	configuredOps, err := worker.opsOf(cfg)
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("[SLA] %d request(s) pending longer than %d hours", len(requests), config.GetInt("slaHours"))
+	templateData := map[string]interface{}{
+		"requests": slaDigest(requests, now),
+		"sla":      strconv.Itoa(config.GetInt("slaHours")),
+	}
+	profiles := worker.profilesByOp()
+	for _, op := range opEmails(configuredOps) {
+		_, err = worker.notifyOp(profiles, types.OpEventSLA, op, func() error {
+			return worker.sendMail(mailer.ResolveTemplate(tenantTemplate(cfg, "./mailer/templates/sla_digest.html"), opsLocale(op)), templateData, subject, op)
+		}, func() string {
+			return subject + "\n" + strings.Join(slaDigest(requests, now), "\n")
+		})
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"recipent": op,
+				"err":      err,
+			}).Error("Failed to send SLA digest email to op")
+		}
+	}
+	return nil
+}
+
+// slaDigest lists the requests with how long they have been pending, longest first
+func slaDigest(requests []types.WhitelistRequest, now time.Time) []string {
+	sorted := append([]types.WhitelistRequest(nil), requests...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+	})
+	entries := make([]string, 0, len(sorted))
+	for _, request := range sorted {
+		entries = append(entries, fmt.Sprintf("%s, pending for %d hours since %s",
+			request.Username, int(now.Sub(request.Timestamp).Hours()), formatExpiry(request.Timestamp)))
+	}
+	return entries
+}
@@ -0,0 +1,103 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// gameServerTask is a decision carried out on the game server in steps, see types.CompletedStepsHeader
+type gameServerTask struct {
+	// action describes the game server action in logs and retries, e.g "Whitelist Steve on the game server"
+	action string
+	// run runs the command of the decision on the game server
+	run func() error
+	// onserverStatus is the state of the player on the game server once run succeeded
+	onserverStatus string
+	// persisted is called once the state of the player is recorded, e.g to update the banned usernames
+	persisted func()
+	// notify tells the applicant about the decision. The task is retried from this step if it fails, so
+	// notifications that are best effort only never fail. Addresses rejected for good are not retried
+	notify func() error
+}
+
+// completedSteps returns the steps of the task completed by earlier attempts. Messages published before the
+// steps were tracked carry the phase left to carry out instead
+func completedSteps(d amqp.Delivery) int {
+	steps := headerInt(d.Headers, types.CompletedStepsHeader)
+	phase, _ := d.Headers[types.PhaseHeader].(string)
+	switch phase {
+	case types.PhaseEmail:
+		steps |= types.StepServerAction | types.StepPersistOnserverStatus
+	case types.PhaseServer:
+		steps |= types.StepNotifyApplicant
+	}
+	return steps
+}
+
+// stepsHeaders returns the headers of the retry of a task which completed the steps
+func stepsHeaders(steps int) amqp.Table {
+	return amqp.Table{types.CompletedStepsHeader: int32(steps)}
+}
+
+// serverPhase tells if only the game server action of the task and recording its result is left, e.g for tasks
+// republished by the recovery pass
+func serverPhase(d amqp.Delivery) bool {
+	steps := completedSteps(d)
+	return steps&types.StepNotifyApplicant != 0 && steps&types.StepServerAction == 0
+}
+
+// runSteps runs the steps of the task not completed by earlier attempts. A failed step is retried with the steps
+// completed so far, so neither the game server action nor the applicant's email are repeated. While the game
+// server is in maintenance the applicant is told right away and the rest is deferred until the end of the window
+func (worker *Worker) runSteps(d amqp.Delivery, request types.WhitelistRequest, task gameServerTask) {
+	completed := completedSteps(d)
+	if completed&types.StepServerAction == 0 {
+		if until, ok := worker.inMaintenance(requestTenant(request), time.Now()); ok {
+			if completed&types.StepNotifyApplicant == 0 {
+				err := task.notify()
+				if err != nil && !worker.flagUndeliverable(request, err) {
+					worker.retryDecisionEmail(d, request, err, stepsHeaders(completed))
+					return
+				}
+				completed |= types.StepNotifyApplicant
+			}
+			worker.deferGameServerTask(d, until, task.action, stepsHeaders(completed))
+			return
+		}
+		err := task.run()
+		if err != nil {
+			worker.logGameServerError(logrus.Fields{
+				"username": request.Username,
+				"action":   task.action,
+			}, err, "Unable to carry out the action on the game server")
+			worker.retryGameServerTask(d, err, task.action, stepsHeaders(completed))
+			return
+		}
+		completed |= types.StepServerAction
+	}
+	if completed&types.StepPersistOnserverStatus == 0 {
+		err := worker.recordOnserverStatus(request, task.onserverStatus)
+		// Once retries are exhausted the applicant is still told, the recovery pass records the state later
+		if err != nil && !worker.retriesExhausted(d) {
+			worker.retryMsgWithDelay(d, "Record the state of "+request.Username+" on the game server", err, stepsHeaders(completed))
+			return
+		}
+		if task.persisted != nil {
+			task.persisted()
+		}
+		// Integrations learn about the change once it is in effect on the game server
+		worker.notifyStatusChange(request)
+		completed |= types.StepPersistOnserverStatus
+	}
+	if completed&types.StepNotifyApplicant == 0 {
+		err := task.notify()
+		if err != nil && !worker.flagUndeliverable(request, err) {
+			worker.retryDecisionEmail(d, request, err, stepsHeaders(completed))
+			return
+		}
+	}
+	worker.completeTask(d, requestTaskKey(request))
+}
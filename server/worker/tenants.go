@@ -0,0 +1,99 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/mailer"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// requestTenant returns the config of the community the request was submitted to. Requests of unknown
+// tenants are parked before they are processed, see parkUnknownTenant
+func requestTenant(request types.WhitelistRequest) tenant.Config {
+	return tenant.Config{ID: request.ServerID}
+}
+
+// parkUnknownTenant puts tasks of requests submitted to a tenant that is not configured, e.g after it was
+// removed from the config, to the dead-letter queue where they can be investigated and requeued
+func (worker *Worker) parkUnknownTenant(d amqp.Delivery, request types.WhitelistRequest) bool {
+	if tenant.Known(request.ServerID) {
+		return false
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"ID":       request.ID.Hex(),
+		"serverId": request.ServerID,
+	}).Error("Task of a request of an unknown tenant. Parked in the dead-letter queue")
+	d.Nack(false, false)
+	metrics.DeadLettered.Inc()
+	return true
+}
+
+// executorFor returns the executor running commands on the game server of the tenant. Game servers of
+// tenants are connected to on their first command and the connection is reused afterwards. Tenants without
+// their own RCONServer share the game server of the default tenant
+func (worker *Worker) executorFor(cfg tenant.Config) (RCONExecutor, error) {
+	if cfg.ID == "" || !cfg.Overrides("RCONServer") {
+		return worker.executor, nil
+	}
+	worker.tenantExecutorsMu.Lock()
+	defer worker.tenantExecutorsMu.Unlock()
+	if executor, ok := worker.tenantExecutors[cfg.ID]; ok {
+		return executor, nil
+	}
+	// Dialed again on the next command if the game server is down, like a failed command is retried
+	executor, err := newTenantExecutor(cfg, worker.logger.WithField("serverId", cfg.ID))
+	if err != nil {
+		return nil, err
+	}
+	if worker.tenantExecutors == nil {
+		worker.tenantExecutors = make(map[string]RCONExecutor)
+	}
+	worker.tenantExecutors[cfg.ID] = executor
+	return executor, nil
+}
+
+// rconLockFor returns the lock serializing the commands sent to the game server of the tenant, so a game server
+// stalling on a command does not hold up the commands of the other tenants
+func (worker *Worker) rconLockFor(cfg tenant.Config) *sync.Mutex {
+	server := ""
+	if cfg.ID != "" && cfg.Overrides("RCONServer") {
+		server = cfg.ID
+	}
+	worker.rconLocksMu.Lock()
+	defer worker.rconLocksMu.Unlock()
+	if worker.rconLocks == nil {
+		worker.rconLocks = make(map[string]*sync.Mutex)
+	}
+	lock, ok := worker.rconLocks[server]
+	if !ok {
+		lock = &sync.Mutex{}
+		worker.rconLocks[server] = lock
+	}
+	return lock
+}
+
+// TemplatePath returns the path of the email template with the file name the worker sends to the tenant in the
+// locale, so previews render the template emails are sent with
+func TemplatePath(cfg tenant.Config, name, locale string) string {
+	return mailer.ResolveTemplate(tenantTemplate(cfg, filepath.Join(mailer.TemplatesDir, name)), locale)
+}
+
+// tenantTemplate returns the template of the tenant's templateDir if it has its own version of it,
+// otherwise the shared template. Translations are resolved next to the returned template
+func tenantTemplate(cfg tenant.Config, template string) string {
+	dir := cfg.GetString("templateDir")
+	if dir == "" {
+		return template
+	}
+	own := filepath.Join(dir, filepath.Base(template))
+	if _, err := os.Stat(own); err != nil {
+		return template
+	}
+	return own
+}
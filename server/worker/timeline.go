@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// timelineStore records the milestones of the processing of requests
+type timelineStore interface {
+	RecordMilestone(id primitive.ObjectID, milestone types.Milestone) error
+}
+
+// recordMilestone adds the milestone to the timeline of the request. Callers refresh the cached request
+// afterwards. Best effort only
+func (worker *Worker) recordMilestone(request types.WhitelistRequest, milestone types.Milestone) {
+	if worker.timeline == nil || request.Canary {
+		return
+	}
+	err := worker.timeline.RecordMilestone(request.ID, milestone)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":        request.ID.Hex(),
+			"milestone": milestone.Name,
+			"err":       err.Error(),
+		}).Warning("Unable to record milestone of request")
+	}
+}
+
+// recordSubmitted records when the request was submitted
+func (worker *Worker) recordSubmitted(request types.WhitelistRequest) {
+	at := request.Timestamp
+	if request.SubmittedAt != nil {
+		at = *request.SubmittedAt
+	}
+	worker.recordMilestone(request, types.Milestone{Name: types.MilestoneSubmitted, At: at})
+}
+
+// recordOpsNotified records when the first ops were sent the request
+func (worker *Worker) recordOpsNotified(request types.WhitelistRequest, ops []string) {
+	if len(ops) == 0 {
+		return
+	}
+	worker.recordMilestone(request, types.Milestone{Name: types.MilestoneOpsNotified, At: time.Now(), Ops: ops})
+	worker.refreshCachedRequests(request.ID)
+}
+
+// recordDecided records the decision on the request and how many ops made it
+func (worker *Worker) recordDecided(request types.WhitelistRequest) {
+	if milestone, ok := request.DecisionMilestone(); ok {
+		worker.recordMilestone(request, milestone)
+	}
+}
+
+// recordWhitelisted records when the player was whitelisted on the game server
+func (worker *Worker) recordWhitelisted(request types.WhitelistRequest) {
+	worker.recordMilestone(request, types.Milestone{Name: types.MilestoneWhitelisted, At: time.Now()})
+	worker.refreshCachedRequests(request.ID)
+}
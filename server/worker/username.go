@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// Decision reason of requests denied because their username is not a valid Minecraft username
+const invalidUsernameDenialReason = "invalid username"
+
+// BedrockEnabled tells if Bedrock players join the game server of the tenant through Geyser, so they may apply
+func BedrockEnabled(cfg tenant.Config) bool {
+	return cfg.GetBool("bedrockEnabled")
+}
+
+// BedrockPrefix is the prefix Floodgate adds to the usernames of Bedrock players on the game server of the tenant
+func BedrockPrefix(cfg tenant.Config) string {
+	if !cfg.IsSet("bedrockUsernamePrefix") {
+		return utils.DefaultBedrockPrefix
+	}
+	return cfg.GetString("bedrockUsernamePrefix")
+}
+
+// ValidateBedrockPrefixes checks the Bedrock username prefix of every tenant can be used in RCON commands
+func ValidateBedrockPrefixes() error {
+	for _, cfg := range tenant.All() {
+		if prefix := BedrockPrefix(cfg); !utils.ValidBedrockPrefix(prefix) {
+			return fmt.Errorf("bedrockUsernamePrefix %q must be up to 2 of the characters .*!~+-#", prefix)
+		}
+	}
+	return nil
+}
+
+// NormalizeRequestUsername returns the username of the request as the game server knows the player. Bedrock
+// gamertags get the prefix of the tenant
+func NormalizeRequestUsername(request types.WhitelistRequest) string {
+	if request.Platform == utils.PlatformBedrock {
+		return utils.NormalizeBedrockUsername(request.Username, BedrockPrefix(requestTenant(request)))
+	}
+	return utils.NormalizeUsername(request.Username)
+}
+
+// ValidateRequestUsername checks the username of the request is valid for the platform of the player
+func ValidateRequestUsername(request types.WhitelistRequest) error {
+	if request.Platform == utils.PlatformBedrock {
+		return utils.ValidateBedrockUsername(request.Username, BedrockPrefix(requestTenant(request)))
+	}
+	return utils.ValidateUsername(request.Username)
+}
+
+// rejectInvalidUsername denies a new or approved request whose username is not a valid Minecraft username,
+// e.g submitted before usernames were validated, instead of retrying commands which can never succeed.
+// Returns false if the username is valid or the request could not be denied
+func (worker *Worker) rejectInvalidUsername(request types.WhitelistRequest) bool {
+	if ValidateRequestUsername(request) == nil {
+		return false
+	}
+	deniedRequest, err := worker.store.TransitionStatus(request.ID, db.StatusChange{
+		From:   request.Status,
+		To:     types.StatusDenied,
+		At:     time.Now(),
+		Admin:  workerActor,
+		Reason: invalidUsernameDenialReason,
+	})
+	if err == db.ErrConflict {
+		// The request has been decided or removed in the meantime
+		return true
+	} else if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Error("Unable to deny request with invalid username")
+		return false
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"ID":       request.ID.Hex(),
+		"username": request.Username,
+		"status":   request.Status,
+	}).Warning("Request with invalid username denied. No command issued on the game server")
+	if request.Status == types.StatusPending {
+		// Counted and told as submitted and then denied
+		worker.updateCache(request)
+		worker.notifyStatusChange(request)
+	}
+	worker.updateCache(deniedRequest)
+	worker.emailDecision(deniedRequest, false)
+	deniedRequest.PreviousStatus = request.Status
+	worker.notifyStatusChange(deniedRequest)
+	return true
+}
+
+// retryGameServerTask retries a task which failed on the game server. Commands of invalid usernames never
+// succeed, their task is put to the dead-letter queue right away
+func (worker *Worker) retryGameServerTask(d amqp.Delivery, err error, action string, headers amqp.Table) {
+	if utils.IsInvalidUsername(err) {
+		d.Nack(false, false)
+		metrics.DeadLettered.Inc()
+		return
+	}
+	worker.retryMsgWithDelay(d, action, err, headers)
+}
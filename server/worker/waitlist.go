@@ -0,0 +1,250 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MaxWhitelisted is the number of players the game server of the tenant has room for, maxWhitelisted. Requests
+// approved beyond it are waitlisted until players are deactivated or banned. 0 does not limit the players
+func MaxWhitelisted(cfg tenant.Config) int {
+	if max := cfg.GetInt("maxWhitelisted"); max > 0 {
+		return max
+	}
+	return 0
+}
+
+// WaitlistedBefore selects the waitlisted requests of the tenant of the request submitted at or before it. They
+// are promoted in that order, so their number is the position of the request on the waitlist
+func WaitlistedBefore(request types.WhitelistRequest) db.RequestFilter {
+	return db.RequestFilter{
+		Statuses:        []string{types.StatusWaitlisted},
+		Tenants:         []string{request.ServerID},
+		SubmittedBefore: request.Timestamp,
+	}
+}
+
+// whitelistedCount returns the number of approved requests of the tenant other than the one with the ID,
+// including approvals not carried out on the game server yet
+func (worker *Worker) whitelistedCount(serverID string, except primitive.ObjectID) (int, error) {
+	approved, err := worker.store.QueryRequests(db.RequestFilter{
+		Statuses: []string{types.StatusApproved},
+		Tenants:  []string{serverID},
+	})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, request := range approved {
+		if request.ID != except {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// waitlistIfFull moves the approved request to the waitlist if the game server of its tenant has no room left
+// for the player, and tells the applicant. The task is complete then, the request is approved again once
+// promoted. Returns false if the player is to be whitelisted
+func (worker *Worker) waitlistIfFull(d amqp.Delivery, request types.WhitelistRequest) bool {
+	max := MaxWhitelisted(requestTenant(request))
+	if max == 0 || request.Canary {
+		return false
+	}
+	count, err := worker.whitelistedCount(request.ServerID, request.ID)
+	if err != nil {
+		// Best effort only. The player is whitelisted as usual
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Warning("Unable to count whitelisted players")
+		return false
+	}
+	if count < max {
+		return false
+	}
+	waitlisted, err := worker.store.TransitionStatus(request.ID, db.StatusChange{
+		From: types.StatusApproved,
+		To:   types.StatusWaitlisted,
+		At:   time.Now(),
+	})
+	if err == db.ErrConflict {
+		// The request has changed since, its own task carries out the change
+		worker.completeTask(d, requestTaskKey(request))
+		return true
+	} else if err != nil {
+		worker.retryMsgWithDelay(d, "Waitlist "+request.Username, err, nil)
+		return true
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"ID":             request.ID.Hex(),
+		"username":       request.Username,
+		"maxWhitelisted": max,
+	}).Warning("Game server is full. Request waitlisted")
+	waitlisted.PreviousStatus = types.StatusApproved
+	worker.recordDecided(request)
+	worker.updateCache(waitlisted)
+	worker.notifyStatusChange(waitlisted)
+	// Best effort only. The status page shows the position on the waitlist
+	worker.emailWaitlisted(waitlisted)
+	worker.completeTask(d, requestTaskKey(request))
+	return true
+}
+
+// Periodically promote waitlisted requests while the game servers have room, e.g after maxWhitelisted was raised
+// or slots were freed while another instance led
+func (worker *Worker) waitlistLoop() {
+	for range schedule.Tick(schedule.Every(60 * time.Second)) {
+		worker.runAsLeader("promote waitlisted requests", worker.promoteAllWaitlisted)
+	}
+}
+
+// promoteAllWaitlisted promotes the waitlisted requests of every tenant with waitlisted requests
+func (worker *Worker) promoteAllWaitlisted() error {
+	waitlisted, err := worker.store.QueryRequests(db.RequestFilter{Statuses: []string{types.StatusWaitlisted}})
+	if err != nil {
+		return err
+	}
+	promoted := make(map[string]bool)
+	for _, request := range waitlisted {
+		if promoted[request.ServerID] {
+			continue
+		}
+		promoted[request.ServerID] = true
+		if err := worker.promoteWaitlisted(request.ServerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promoteAfterSlotFreed promotes the oldest waitlisted requests of the tenant of the request once its player
+// has been removed from the game server. Only the leading instance promotes requests, the others leave it to
+// the waitlist loop of the leader
+func (worker *Worker) promoteAfterSlotFreed(request types.WhitelistRequest) {
+	if request.Canary || MaxWhitelisted(requestTenant(request)) == 0 {
+		return
+	}
+	worker.runAsLeader("promote waitlisted requests", func() error {
+		return worker.promoteWaitlisted(request.ServerID)
+	})
+}
+
+// promoteWaitlisted approves the oldest waitlisted requests of the tenant while its game server has room for
+// their players, and publishes them so the approval task whitelists them
+func (worker *Worker) promoteWaitlisted(serverID string) error {
+	// The loop and processed tasks promote concurrently, only one at a time counts the free slots
+	worker.waitlistMu.Lock()
+	defer worker.waitlistMu.Unlock()
+	waitlisted, err := worker.store.QueryRequests(db.RequestFilter{
+		Statuses: []string{types.StatusWaitlisted},
+		Tenants:  []string{serverID},
+	})
+	if err != nil || len(waitlisted) == 0 {
+		return err
+	}
+	free := len(waitlisted)
+	if max := MaxWhitelisted(tenant.Config{ID: serverID}); max > 0 {
+		count, err := worker.whitelistedCount(serverID, primitive.NilObjectID)
+		if err != nil {
+			return err
+		}
+		free = max - count
+	}
+	// Oldest first, the requests are sorted most recent first
+	for i := len(waitlisted) - 1; i >= 0 && free > 0; i-- {
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		promoted, err := worker.promoteRequest(waitlisted[i])
+		if err != nil {
+			return err
+		}
+		if promoted {
+			free--
+		}
+	}
+	return nil
+}
+
+// promoteRequest approves the waitlisted request again and publishes it. The promotion is recorded as the
+// decision, as the player is whitelisted from then on. Returns false if the request is no longer waitlisted,
+// e.g an admin deactivated it
+func (worker *Worker) promoteRequest(request types.WhitelistRequest) (bool, error) {
+	approved, err := worker.store.TransitionStatus(request.ID, db.StatusChange{
+		From:  types.StatusWaitlisted,
+		To:    types.StatusApproved,
+		At:    time.Now(),
+		Admin: request.Admin,
+	})
+	if err == db.ErrConflict {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	approved.PreviousStatus = types.StatusWaitlisted
+	err = worker.publishRequest(approved, nil)
+	if err != nil {
+		// Back to the waitlist so the request is promoted again
+		_, revertErr := worker.store.TransitionStatus(request.ID, db.StatusChange{
+			From: types.StatusApproved,
+			To:   types.StatusWaitlisted,
+			At:   time.Now(),
+		})
+		if revertErr != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"ID":  request.ID.Hex(),
+				"err": revertErr.Error(),
+			}).Error("Unable to revert status of request")
+		}
+		return false, err
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"ID":       request.ID.Hex(),
+		"username": request.Username,
+	}).Info("Waitlisted request promoted. Approval task published")
+	return true, nil
+}
+
+// emailWaitlisted tells the applicant their request was approved but the game server is full, with a link to
+// the status page showing their position on the waitlist
+func (worker *Worker) emailWaitlisted(whitelistRequest types.WhitelistRequest) error {
+	log := worker.logger
+	subject := requestTenant(whitelistRequest).GetString("waitlistedEmailTitle")
+	if subject == "" {
+		subject = requestTenant(whitelistRequest).GetString("approvedEmailTitle")
+	}
+	requestIDToken, err := utils.SignToken(whitelistRequest.ID.Hex(), utils.PurposeStatus, statusLinkTTL())
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to encode requestID Token")
+		return err
+	}
+	builder, err := worker.linksOf(requestTenant(whitelistRequest))
+	if err != nil {
+		return err
+	}
+	templateData := map[string]string{"link": builder.StatusLink(requestIDToken)}
+	err = worker.sendApplicantMail(whitelistRequest, "./mailer/templates/waitlisted.html", templateData, subject, false)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+			"err":      err,
+			"ID":       whitelistRequest.ID.Hex(),
+		}).Error("Failed to send waitlisted email")
+	} else {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+		}).Info("Waitlisted email sent")
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/webhook"
+)
+
+const (
+	defaultWebhookMaxAttempts = 5
+	defaultWebhookRetryDelay  = 10 * time.Second
+)
+
+func newWebhookDispatcher(worker *Worker) *webhook.Dispatcher {
+	maxAttempts := defaultWebhookMaxAttempts
+	if viper.IsSet("webhookMaxAttempts") {
+		maxAttempts = viper.GetInt("webhookMaxAttempts")
+	}
+	retryDelay := time.Duration(viper.GetInt("webhookRetrySeconds")) * time.Second
+	if retryDelay <= 0 {
+		retryDelay = defaultWebhookRetryDelay
+	}
+	return webhook.NewDispatcher(webhook.NewSender(nil), maxAttempts, retryDelay, worker.logger.WithField("origin", "webhook"))
+}
+
+// notifyStatusChange queues a webhook telling the endpoints the request has changed its status. Deliveries
+// are sent in the background so they never hold up the task. Synthetic requests are not told
+func (worker *Worker) notifyStatusChange(request types.WhitelistRequest) {
+	if worker.webhooks == nil || request.Canary || request.Bench != "" || request.PreviousStatus == request.Status {
+		return
+	}
+	change := webhook.StatusChange{
+		RequestID:      request.ID.Hex(),
+		Username:       request.Username,
+		PreviousStatus: request.PreviousStatus,
+		Status:         request.Status,
+		Timestamp:      time.Now(),
+	}
+	// Changes of a bulk decision are told at once
+	if request.BulkID != "" && worker.bulkNotices != nil {
+		worker.bulkNotices.add(request.BulkID, change)
+		return
+	}
+	worker.webhooks.Enqueue(webhook.Event{
+		Event:     webhook.StatusChangeEvent,
+		Timestamp: time.Now(),
+		Data:      change,
+	})
+}
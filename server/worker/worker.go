@@ -1,68 +1,235 @@
 package worker
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"math/rand"
-	"os"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/streadway/amqp"
 	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/config"
 	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/health"
+	"github.com/tywin1104/mc-gatekeeper/links"
 	"github.com/tywin1104/mc-gatekeeper/mailer"
+	"github.com/tywin1104/mc-gatekeeper/metrics"
 	"github.com/tywin1104/mc-gatekeeper/rcon"
+	"github.com/tywin1104/mc-gatekeeper/schedule"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/topology"
 	"github.com/tywin1104/mc-gatekeeper/types"
 	"github.com/tywin1104/mc-gatekeeper/utils"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/tywin1104/mc-gatekeeper/webhook"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	try "gopkg.in/matryer/try.v1"
 )
 
+const (
+	// Number of times a message has been republished to the retry queue
+	retryCountHeader = "x-retry-count"
+	// Ops whose action email failed to send in the previous attempt
+	failedOpsHeader = "x-failed-ops"
+	// Number of ops who received the action email in previous attempts
+	notifiedCountHeader = "x-notified-count"
+	defaultMaxRetries   = 5
+	defaultRetryDelay   = 60 * time.Second
+	// Interval between two sweeps for expired pending requests if not configured
+	defaultExpirationSweepInterval = 10 * time.Minute
+	// Connecting to the message queue is attempted this many times, doubling the delay in between
+	maxConnectAttempts = 5
+	connectRetryDelay  = 2 * time.Second
+	// Dependency checks are cached for this long if healthCacheSeconds is not configured
+	defaultHealthCacheDuration = 5 * time.Second
+	healthCheckTimeout         = 2 * time.Second
+)
+
 // Worker defines message queue worker
 type Worker struct {
-	dbService        *db.Service
-	cache            *cache.Service
+	// Requests read and written through typed methods, see db.Store
+	store            db.Store
+	cache            sharedState
 	logger           *logrus.Entry
-	rconClient       *rcon.Client
 	conn             *amqp.Connection
 	channel          *amqp.Channel
 	rabbitCloseError chan *amqp.Error
-	delivery         <-chan amqp.Delivery
+	// Notified when the channel is closed, e.g by a channel level error, while the connection stays open
+	channelCloseError chan *amqp.Error
+	// Channel in confirm mode the publisher owns, so publications on the consumer channel never shift its
+	// delivery tags
+	publishChannel           *amqp.Channel
+	publishChannelCloseError chan *amqp.Error
+	delivery                 <-chan amqp.Delivery
+	// Deliveries of the high priority task queue, dispatched before the ones of delivery
+	highPriorityDelivery <-chan amqp.Delivery
+	sendMail             func(templateName string, templateData interface{}, subject string, recipent string) error
+	// Runs commands on the game server
+	executor RCONExecutor
+	// Links to the frontend of each tenant by server ID
+	linkBuilders map[string]*links.Builder
+	// Cached requests, stats and banned usernames updated by processed tasks
+	requestCache requestCache
+	// Refreshes of cached requests shared by concurrent tasks, and their stats changes applied in batches
+	refresher *requestRefresher
+	stats     *statsBatcher
+	// Records when decisions have been carried out
+	processedRequests processedRecorder
+	// Milestones of the processing of requests, shown on the status page
+	timeline timelineStore
+	// State of players on the game server, so requests whose task did not complete are recovered
+	onserver onserverStore
+	// Prior requests of the network of new requests, shown to ops
+	networks networkStore
+	// Finds the standing of the referrers of new requests
+	referrals referralStore
+	// Set while reconnect() is re-establishing the connection with the message queue
+	reconnecting int32
+	// Deliveries are processed concurrently in lanes ordered by player
+	lanes *lanes
+	// The RCON connection of each game server is shared by all lanes, see rconLockFor
+	rconLocks   map[string]*sync.Mutex
+	rconLocksMu sync.Mutex
+	// Executors of the game servers of tenants by server ID, connected on their first command
+	tenantExecutors   map[string]RCONExecutor
+	tenantExecutorsMu sync.Mutex
+	// Circuit breakers of the game servers by server ID, see breakerFor
+	breakers   map[string]*circuitBreaker
+	breakersMu sync.Mutex
+	// Held while promoting waitlisted requests, so the free slots are not counted twice
+	waitlistMu sync.Mutex
+	// Completed tasks, so redelivered messages are not processed twice
+	processedTasks taskLedger
+	// Emails sent to applicants, so they are not sent twice
+	sentEmails emailLedger
+	// Nonces of the action links sent to ops
+	actionNonces nonceStore
+	// IDs of the messages seen, so a captured message published again is rejected
+	seenMessages messageLedger
+	// Sequences of the last tasks applied, so tasks of a request are applied in the order they were published
+	appliedSequences sequenceLedger
+	// Publishes on the channel and waits for the confirmation of the message queue
+	publisher *publisher
+	// Tasks written by the API to publish, and the ID the relay of this worker claims them with
+	outbox  outboxStore
+	relayID string
+	// Decision emails given up after max retries
+	failedNotifications failedNotificationStore
+	// Messages parked in the retry queue
+	retries retryStore
+	// Only the leading instance runs the periodic background jobs
+	leader leaderElection
+	// Ops away are not dispatched requests
+	availability opAvailabilityStore
+	// Ops and how they are notified, managed by admins. The ops config is used until there are profiles
+	opProfiles opProfileStore
+	// Chats of ops with the Telegram bot by chat ID, nil if no bot is configured
+	opChats func(chatID string) alerter
+	// Sends applicant emails and returns their Message-ID, so their bounces are traced back to the request.
+	// Applicant emails are sent with sendMail without it
+	sendTrackedMail metrics.TrackedSendFunc
+	// Outcome of the emails sent lately, pausing ops dispatch while most of them fail
+	mailFailures *mailer.FailureRate
+	// Addresses emails bounced from and Message-IDs of applicant emails
+	bounces bounceStore
+	// Event batches ended once their end time has passed
+	batches batchStore
+	// Console tasks completed with the response of the game server
+	consoleTasks consoleTaskStore
+	// Records console commands and reconciliations in the audit log
+	audit auditStore
+	// Response times of the ops listed in digests
+	opResponses cache.OpResponseCounter
+	// Exchanges and queues declared on setup
+	topology topology.Names
+	// Tells webhook endpoints about status changes of requests
+	webhooks *webhook.Dispatcher
+	// Summarizes the status changes of bulk decisions for the webhook endpoints if bulkDecisionWebhookSummary is set
+	bulkNotices *bulkNotifier
+	// Confirms bans on the game server to the ops right away if telegramBanAlerts is set
+	banAlerts alerter
+	// Age of delivered tasks and the last alerts about the queues
+	queueMonitor *queueMonitor
 }
 
-// NewWorker creates a worker to constantly listen and handle messages in the queue
-func NewWorker(db *db.Service, cache *cache.Service, logger *logrus.Entry, rabbitCloseError chan *amqp.Error) (*Worker, error) {
-	// Initialize rcon client to interact with game server
-	var rconClient *rcon.Client
-	if viper.GetString("environment") == "test" {
-		// For testing environment do not connect to a running game server
-		rconClient = nil
-	} else {
-		var err error
-		rconClient, err = rcon.NewClient(viper.GetString("RCONServer"), viper.GetInt("RCONPort"), viper.GetString("RCONPassword"))
-		if err != nil {
-			return nil, err
-		}
+// NewWorker creates a worker to constantly listen and handle messages in the queue. Commands are run on the
+// game server through the executor, see NewRCONExecutor
+func NewWorker(dbService *db.Service, cache *cache.Service, logger *logrus.Entry, rabbitCloseError chan *amqp.Error, executor RCONExecutor) (*Worker, error) {
+	linkBuilders, err := links.ForTenants()
+	if err != nil {
+		return nil, err
+	}
+	store := db.NewMongoStore(dbService)
+	worker := &Worker{
+		linkBuilders:        linkBuilders,
+		store:               store,
+		cache:               cache,
+		logger:              logger,
+		rabbitCloseError:    rabbitCloseError,
+		sendMail:            Mailer(),
+		executor:            executor,
+		tenantExecutors:     make(map[string]RCONExecutor),
+		requestCache:        cache,
+		processedRequests:   dbService,
+		timeline:            dbService,
+		onserver:            store,
+		networks:            store,
+		referrals:           store,
+		processedTasks:      cache,
+		sentEmails:          cache,
+		actionNonces:        cache,
+		seenMessages:        cache,
+		appliedSequences:    dbService,
+		outbox:              dbService,
+		relayID:             primitive.NewObjectID().Hex(),
+		failedNotifications: dbService,
+		retries:             dbService,
+		leader:              cache,
+		availability:        dbService,
+		opProfiles:          dbService,
+		opChats:             newOpChats(),
+		sendTrackedMail:     metrics.InstrumentTrackedSend(mailer.SendTracked),
+		mailFailures:        mailer.Failures,
+		bounces:             dbService,
+		batches:             dbService,
+		consoleTasks:        dbService,
+		audit:               dbService,
+		opResponses:         dbService,
+		queueMonitor:        newQueueMonitor(),
+	}
+	if DryRun() {
+		// No email is sent. Emails written to files have no Message-ID
+		worker.sendTrackedMail = nil
+		logger.WithFields(logrus.Fields{
+			"mailDir": dryRunMailDir(),
+		}).Warning("Dry run. Commands are only logged and emails are written to files")
 	}
-	return &Worker{
-		dbService:        db,
-		cache:            cache,
-		logger:           logger,
-		rconClient:       rconClient,
-		rabbitCloseError: rabbitCloseError,
-	}, nil
+	worker.refresher = newRequestRefresher(cache.RefreshRequests)
+	worker.stats = newStatsBatcher(cache.ApplyStatsDelta, logger)
+	worker.webhooks = newWebhookDispatcher(worker)
+	worker.banAlerts = newBanAlerter()
+	if viper.GetBool("bulkDecisionWebhookSummary") {
+		worker.bulkNotices = newBulkNotifier(worker.webhooks.Enqueue, bulkSummaryDelay)
+	}
+	return worker, nil
 }
 
-func (worker *Worker) failOnError(err error, msg string) {
-	if err != nil {
-		worker.logger.WithFields(logrus.Fields{
-			"err": err,
-		}).Fatal(msg)
-	}
+// SetMailer replaces the function emails are sent with, e.g to record emails instead of sending them
+func (worker *Worker) SetMailer(sendMail func(templateName string, templateData interface{}, subject string, recipent string) error) {
+	worker.sendMail = sendMail
+	worker.sendTrackedMail = nil
+}
+
+// SetExecutor replaces the executor commands are run on the game server with, e.g to record commands
+// instead of running them
+func (worker *Worker) SetExecutor(executor RCONExecutor) {
+	worker.executor = executor
 }
 
 func (w *Worker) GetConn() *amqp.Connection {
@@ -72,295 +239,1500 @@ func (w *Worker) GetChannel() *amqp.Channel {
 	return w.channel
 }
 
-// Close connection and channel associated with the worker
+// Close connection and channel associated with the worker. The deliveries being processed finish first and
+// their stats changes are applied
 func (worker *Worker) Close() {
+	if worker.lanes != nil {
+		worker.lanes.drain()
+	}
+	worker.stats.flush()
+	worker.bulkNotices.flushAll()
+	worker.publishChannel.Close()
 	worker.channel.Close()
 	worker.conn.Close()
 }
 
-// Start the worker to process the messages pushed into the queue
-func (worker *Worker) Start(wg *sync.WaitGroup) {
-	log := worker.logger
-
+// Start connects to the message queue and starts processing messages in the background.
+// Connecting is retried with backoff so the worker can start before the message queue is up.
+// An error is returned if the message queue is still unavailable after all attempts
+func (worker *Worker) Start() error {
 	// Start will only perform initial setup
-	// If in the future the initial connection got closed,
+	// If in the future the connection or channel got closed,
 	// reconnect callback function will be executed and conn/chan/chan *Error will be reset
-	conn, err := amqp.Dial(viper.GetString("rabbitMQConn"))
-	worker.failOnError(err, "Failed to connect to RabbitMQ")
-	worker.conn = conn
-	worker.conn.NotifyClose(worker.rabbitCloseError)
+	// Fail fast on a typo in the command templates instead of on the first approval
+	err := ValidateCommandTemplates()
+	if err != nil {
+		return err
+	}
+	err = validateDispatchingMode()
+	if err != nil {
+		return err
+	}
+	// Before the quorum is validated against the ops
+	worker.seedOpProfiles()
+	err = validateQuorum(worker.opsOf)
+	if err != nil {
+		return err
+	}
+	worker.channelCloseError = make(chan *amqp.Error, 1)
+	worker.publishChannelCloseError = make(chan *amqp.Error, 1)
+	err = worker.connect()
+	if err != nil {
+		return err
+	}
+	worker.lanes = newLanes(laneCount(), prefetchCount(), worker.process)
+	go worker.webhooks.Run()
+	go worker.stats.run(statsFlushInterval)
+	go worker.runLoop()
+	go worker.escalationLoop()
+	go worker.slaLoop()
+	go worker.digestLoop()
+	go worker.expirationLoop()
+	go worker.grantExpirationLoop()
+	go worker.waitlistLoop()
+	go worker.batchExpirationLoop()
+	go worker.queueMonitorLoop()
+	go worker.releaseParkedLoop()
+	go worker.reviewReminderLoop()
+	go worker.canaryLoop()
+	go worker.reconcileLoop()
+	go worker.joinTrackingLoop()
+	go worker.followUpLoop()
+	go worker.outboxRelayLoop()
+	go worker.recoveryLoop()
+	worker.logger.Info("Worker started. Listening for messages..")
+	return nil
+}
 
-	ch, err := conn.Channel()
-	worker.failOnError(err, "Failed to open a channel")
-	worker.channel = ch
-	args := make(amqp.Table)
-	// Dead letter exchange name
-	args["x-dead-letter-exchange"] = "dead.letter.ex"
-	// Default message ttl 24 hours
-	args["x-message-ttl"] = int32(8.64e+7)
-
-	_, err = ch.QueueDeclare(
-		viper.GetString("taskQueueName"), // name
-		true,                             // durable
-		false,                            // delete when unused
-		false,                            // exclusive
-		false,                            // no-wait
-		args,                             // arguments
-	)
-	worker.failOnError(err, "Failed to declare a queue")
+// connect establishes the connection with the message queue, retrying with an exponential backoff
+func (worker *Worker) connect() error {
+	return try.Do(func(attempt int) (bool, error) {
+		if attempt > 1 {
+			worker.logger.Infof("Trying to connect to RabbitMQ [%d/%d]\n", attempt, maxConnectAttempts)
+		}
+		err := worker.setup()
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warning("Unable to connect to RabbitMQ")
+			if attempt < maxConnectAttempts {
+				time.Sleep(connectRetryDelay * time.Duration(1<<uint(attempt-1)))
+			}
+		}
+		return attempt < maxConnectAttempts, err
+	})
+}
 
+// setup dials the message queue, declares the queues and registers the consumer on a new channel.
+// Retries are republished on a second channel in confirm mode owned by the publisher.
+// The connection and both channels notify the worker when they are closed, as channel level
+// errors such as publishing to a missing exchange close the channel and silently stop the consumer
+func (worker *Worker) setup() error {
+	conn, err := amqp.Dial(viper.GetString("rabbitMQConn"))
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	names := topology.FromConfig()
+	err = topology.Declare(ch, names)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	worker.logger.WithFields(logrus.Fields(names.Fields())).Info("Message queue topology declared")
 	err = ch.Qos(
-		1,     // prefetch count
-		0,     // prefetch size
-		false, // global
+		prefetchCount(), // prefetch count
+		0,               // prefetch size
+		false,           // global
 	)
-	worker.failOnError(err, "Failed to set QoS")
-
-	forever := make(chan bool)
-	// Set initial delivery channel from the initial connection
-	worker.updateDeliveryChannel()
-	go worker.runLoop()
-	log.Info("Worker started. Listening for messages..")
-	wg.Done()
-
-	<-forever
-}
-
-// Update the messages fetching origin to be from the channel of the new connection
-// Is called whenver a new connection is established and the old one is closed
-func (worker *Worker) updateDeliveryChannel() {
-	msgs, err := worker.channel.Consume(
-		viper.GetString("taskQueueName"), // queue
-		"",                               // consumer
-		false,                            // auto-ack
-		false,                            // exclusive
-		false,                            // no-local
-		false,                            // no-wait
-		nil,                              // args
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	msgs, err := ch.Consume(
+		names.TaskQueue, // queue
+		"",              // consumer
+		false,           // auto-ack
+		false,           // exclusive
+		false,           // no-local
+		false,           // no-wait
+		nil,             // args
+	)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	highPriorityMsgs, err := ch.Consume(
+		names.HighPriorityTaskQueue, // queue
+		"",                          // consumer
+		false,                       // auto-ack
+		false,                       // exclusive
+		false,                       // no-local
+		false,                       // no-wait
+		nil,                         // args
 	)
-	worker.failOnError(err, "Failed to register a consumer")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	// Retries are only acked once their republication is confirmed
+	pubCh, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	err = pubCh.Confirm(false)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	confirms := pubCh.NotifyPublish(make(chan amqp.Confirmation, prefetchCount()))
+	returns := pubCh.NotifyReturn(make(chan amqp.Return, prefetchCount()))
+	conn.NotifyClose(worker.rabbitCloseError)
+	ch.NotifyClose(worker.channelCloseError)
+	pubCh.NotifyClose(worker.publishChannelCloseError)
+	worker.conn = conn
+	worker.channel = ch
+	worker.publishChannel = pubCh
+	worker.publisher = newPublisher(pubCh, confirms, returns, publishConfirmTimeout())
+	worker.topology = names
+	// Update worker's delivery from newly created channel of new connection
 	worker.delivery = msgs
+	worker.highPriorityDelivery = highPriorityMsgs
+	return nil
 }
 
 func (worker *Worker) reconnect() {
+	atomic.StoreInt32(&worker.reconnecting, 1)
+	defer atomic.StoreInt32(&worker.reconnecting, 0)
 	worker.logger.Warning("Worker connection with message queue closed unexpectedly. About to reconnect")
-	worker.rabbitCloseError = make(chan *amqp.Error)
-	err := try.Do(func(attempt int) (bool, error) {
-		if attempt > 1 {
-			worker.logger.Infof("Trying to connect to RabbitMQ [%d/3]\n", attempt)
-		}
-		var e error
-		conn, e := amqp.Dial(viper.GetString("rabbitMQConn"))
-		if e != nil {
-			time.Sleep(5 * time.Second)
-		} else {
-			worker.conn = conn
-		}
-		return attempt < 3, e
-	})
+	// Let the deliveries being processed finish before their channel is replaced
+	worker.lanes.drain()
+	// Close notifications are buffered so the client library never blocks on a notification
+	// the worker no longer listens to, e.g the connection one once the channel is closed
+	worker.rabbitCloseError = make(chan *amqp.Error, 1)
+	worker.channelCloseError = make(chan *amqp.Error, 1)
+	worker.publishChannelCloseError = make(chan *amqp.Error, 1)
+	// The connection may still be open if only the channel was closed
+	if worker.conn != nil && !worker.conn.IsClosed() {
+		worker.conn.Close()
+	}
+	err := worker.connect()
 	if err != nil {
 		worker.logger.WithFields(logrus.Fields{
 			"err": err.Error(),
 		}).Fatal("Unable to reconnect to message queue")
 	}
-
-	ch, err := worker.conn.Channel()
-	worker.failOnError(err, "Failed to open a channel")
-	worker.channel = ch
-	// Update worker's delivery from newly created channel of new connection
-	worker.updateDeliveryChannel()
+	worker.lanes = newLanes(laneCount(), prefetchCount(), worker.process)
 	worker.logger.Info("Worker-message queue connection established. Continue to process messages")
-	worker.conn.NotifyClose(worker.rabbitCloseError)
+	metrics.Reconnects.WithLabelValues("worker").Inc()
+}
+
+// HealthService reports the state of the worker's dependencies. Liveness only fails if the connection with the
+// message queue is lost and not being re-established. Readiness also fails while reconnecting and if mongo,
+// redis or the game server are unavailable, or while the circuit of a game server is open. Dependency checks
+// are cached for healthCacheSeconds
+func (worker *Worker) HealthService() *health.Service {
+	ttl := time.Duration(viper.GetInt("healthCacheSeconds")) * time.Second
+	if ttl <= 0 {
+		ttl = defaultHealthCacheDuration
+	}
+	svc := health.NewService()
+	svc.AddLivenessCheck("amqp", func() error {
+		if atomic.LoadInt32(&worker.reconnecting) == 1 {
+			return nil
+		}
+		if worker.conn == nil || worker.conn.IsClosed() {
+			return errors.New("Connection with message queue is closed")
+		}
+		return nil
+	})
+	svc.AddReadinessCheck("reconnect", func() error {
+		if atomic.LoadInt32(&worker.reconnecting) == 1 {
+			return errors.New("Reconnecting to message queue")
+		}
+		return nil
+	})
+	svc.AddReadinessCheck("mongo", health.Cached(func() error {
+		return worker.store.Ping(healthCheckTimeout)
+	}, ttl))
+	svc.AddReadinessCheck("redis", health.Cached(func() error {
+		return worker.cache.Ping()
+	}, ttl))
+	// Only a connected game server is probed, not the executors of dry runs
+	if _, ok := worker.executor.(*rcon.Client); ok {
+		svc.AddReadinessCheck("rcon", health.Cached(func() error {
+			_, err := rcon.Probe("list", healthCheckTimeout)
+			return err
+		}, ttl))
+	}
+	svc.AddReadinessCheck("rcon_circuit", worker.openCircuits)
+	return svc
+}
+
+// QueueDepth returns the number of messages waiting in the queues the worker consumes from
+func (worker *Worker) QueueDepth() (int, error) {
+	depths, err := worker.inspectQueues(worker.topology.Queues())
+	total := 0
+	for _, depth := range depths {
+		total += depth
+	}
+	return total, err
+}
+
+// inspectQueues returns the number of messages ready in each queue. Stops at the first queue that can
+// not be inspected and returns the depths of the queues inspected before
+func (worker *Worker) inspectQueues(queues []string) (map[string]int, error) {
+	depths := make(map[string]int, len(queues))
+	for _, name := range queues {
+		// Inspecting a missing queue closes the channel so use a dedicated one
+		ch, err := worker.conn.Channel()
+		if err != nil {
+			return depths, err
+		}
+		queue, err := ch.QueueInspect(name)
+		ch.Close()
+		if err != nil {
+			return depths, err
+		}
+		metrics.QueueDepth.WithLabelValues(name).Set(float64(queue.Messages))
+		depths[name] = queue.Messages
+	}
+	return depths, nil
 }
 func (worker *Worker) runLoop() {
 	for {
+		// High priority deliveries are dispatched first, so e.g bans do not wait behind new applications.
+		// A closed channel falls through so the close notifications are still received
+		select {
+		case d, ok := <-worker.highPriorityDelivery:
+			if ok {
+				worker.dispatch(d)
+				continue
+			}
+		default:
+		}
 		select {
 		case rabbitErr := <-worker.rabbitCloseError:
 			if rabbitErr != nil {
 				worker.reconnect()
 			}
 			break
-		case d := <-worker.delivery:
-			log := worker.logger
-			if d.Body == nil {
-				break
+		case channelErr := <-worker.channelCloseError:
+			if channelErr != nil {
+				worker.logger.WithFields(logrus.Fields{
+					"err": channelErr.Error(),
+				}).Warning("Worker channel closed unexpectedly")
+				worker.reconnect()
 			}
-			whitelistRequest, err := deserialize(d.Body)
-			if err != nil {
-				log.WithFields(logrus.Fields{
-					"messageBody": d.Body,
-					"err":         err,
-				}).Error("Unable to decode message into whitelistRequest")
-				// Unable to decode this message, put to the dead-letter queue
-				d.Nack(false, false)
-			} else {
-				// Concrete actions to do when receiving task from message queue
-				// From the message body to determine which type of work to do
-				switch whitelistRequest.Status {
-				case "Approved":
-					worker.processApproval(d, whitelistRequest)
-				case "Denied":
-					worker.processDenial(d, whitelistRequest)
-				case "Pending":
-					worker.processNewRequest(d, whitelistRequest)
-				case "Deactivated":
-					worker.processDeactivate(d, whitelistRequest)
-				case "Banned":
-					worker.processBan(d, whitelistRequest)
-				}
+			break
+		case channelErr := <-worker.publishChannelCloseError:
+			if channelErr != nil {
+				worker.logger.WithFields(logrus.Fields{
+					"err": channelErr.Error(),
+				}).Warning("Worker publish channel closed unexpectedly")
+				worker.reconnect()
 			}
+			break
+		case d := <-worker.highPriorityDelivery:
+			worker.dispatch(d)
+		case d := <-worker.delivery:
+			worker.dispatch(d)
 		}
 	}
 }
 
+// dispatch queues the delivery on its lane. Closed delivery channels yield empty deliveries which are skipped, and
+// messages which fail verification are rejected before reaching a lane
+func (worker *Worker) dispatch(d amqp.Delivery) {
+	if d.Body == nil || !worker.verifyMessage(d) {
+		return
+	}
+	worker.lanes.dispatch(laneKey(d), d)
+}
+
+// processTask handles a single delivery, see process
+func (worker *Worker) processTask(ctx context.Context, d amqp.Delivery) {
+	log := worker.taskLogger(ctx)
+	worker.queueMonitor.observe(d.Headers)
+	// Messages back from the retry queue are no longer parked, unless an admin abandoned them
+	if !worker.consumeRetry(d) {
+		return
+	}
+	// System tasks carry their own message body
+	start := time.Now()
+	if taskType, _ := d.Headers[types.TaskTypeHeader].(string); taskType == types.ConsoleTaskType {
+		worker.processConsoleTask(ctx, d)
+		metrics.ObserveProcessing(types.ConsoleTaskType, start)
+		return
+	}
+	if taskType, _ := d.Headers[types.TaskTypeHeader].(string); taskType == types.ResendTaskType {
+		worker.processResendTask(ctx, d)
+		metrics.ObserveProcessing(types.ResendTaskType, start)
+		return
+	}
+	if taskType, _ := d.Headers[types.TaskTypeHeader].(string); taskType == types.CommentTaskType {
+		worker.processCommentTask(ctx, d)
+		metrics.ObserveProcessing(types.CommentTaskType, start)
+		return
+	}
+	whitelistRequest, version, err := deserialize(d.Body)
+	if err == types.ErrUnknownSchemaVersion {
+		// Published by a newer version, e.g before a rollback. Parked for it to process once it is deployed again
+		log.WithFields(logrus.Fields{
+			"schemaVersion": version,
+			"supported":     types.RequestSchemaVersion,
+		}).Error("Message of an unknown schema version. Parked in the dead-letter queue")
+		d.Nack(false, false)
+		metrics.DeadLettered.Inc()
+		return
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"messageBody": d.Body,
+			"err":         err,
+		}).Error("Unable to decode message into whitelistRequest")
+		// Unable to decode this message, put to the dead-letter queue
+		d.Nack(false, false)
+		metrics.DeadLettered.Inc()
+		return
+	}
+	// Requests submitted before usernames were normalized may still have whitespace around them
+	whitelistRequest.Username = utils.NormalizeUsername(whitelistRequest.Username)
+	if worker.parkUnknownTenant(d, whitelistRequest) {
+		return
+	}
+	// Messages delivered but not acked before a reconnect are redelivered. Recovered tasks were completed
+	// before, their game server action is carried out again
+	if !serverPhase(d) && worker.taskProcessed(d, requestTaskKey(whitelistRequest)) {
+		d.Ack(false)
+		return
+	}
+	// Last writer wins: a task published before the last applied one of the request is skipped
+	if !worker.claimSequence(d, whitelistRequest) {
+		return
+	}
+	// Concrete actions to do when receiving task from message queue
+	// From the message body to determine which type of work to do
+	switch whitelistRequest.Status {
+	case types.StatusApproved:
+		worker.processApproval(ctx, d, whitelistRequest)
+	case types.StatusDenied:
+		worker.processDenial(ctx, d, whitelistRequest)
+	case types.StatusPending:
+		worker.processNewRequest(ctx, d, whitelistRequest)
+	case types.StatusDeactivated:
+		worker.processDeactivate(ctx, d, whitelistRequest)
+	case types.StatusBanned:
+		worker.processBan(ctx, d, whitelistRequest)
+	case types.StatusUnbanned:
+		worker.processUnban(ctx, d, whitelistRequest)
+	case types.StatusDisputed:
+		worker.processDispute(ctx, d, whitelistRequest)
+	case types.StatusCancelled:
+		worker.processCancel(ctx, d, whitelistRequest)
+	}
+	metrics.ObserveProcessing(whitelistRequest.Status, start)
+}
+
+// Number of lanes processing deliveries concurrently. 1 processes deliveries one at a time
+func laneCount() int {
+	if n := viper.GetInt("workerLanes"); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// Number of unacknowledged deliveries the message queue sends to the worker.
+// Defaults to the number of lanes so every lane can be busy
+func prefetchCount() int {
+	if n := viper.GetInt("prefetchCount"); n > 0 {
+		return n
+	}
+	return laneCount()
+}
+
+// sharedState is the state in the cache the workers check new requests against and dispatch them with
+type sharedState interface {
+	GetAttempts(key string) (int64, time.Duration, error)
+	IsUsernameBanned(serverID, username string) (bool, error)
+	IncrDispatchCursor(serverID string, n int) (int64, error)
+	Ping() error
+}
+
+// requestCache keeps the cached requests, stats and banned usernames in line with processed tasks
+type requestCache interface {
+	RefreshRequests(ids ...primitive.ObjectID) error
+	ApplyStatsDelta(serverID string, delta cache.StatsDelta) error
+	RecordDecisionLatency(request types.WhitelistRequest) error
+	AddBannedUsername(serverID, username string) error
+	RemoveBannedUsername(serverID, username string) error
+}
+
 func (worker *Worker) updateCache(request types.WhitelistRequest) {
-	// Update the cache for all requests. Best effort only
-	err := worker.cache.UpdateAllRequests()
+	worker.refreshCachedRequests(request.ID)
+
+	// Update Stats value in cache. Batched while the worker runs, see statsBatcher
+	if worker.stats != nil {
+		worker.stats.add(request.ServerID, cache.StatsDeltaOf(request))
+	} else if err := worker.requestCache.ApplyStatsDelta(request.ServerID, cache.StatsDeltaOf(request)); err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to update stats in cache")
+	}
+	if request.Status != types.StatusApproved && request.Status != types.StatusDenied {
+		return
+	}
+	err := worker.requestCache.RecordDecisionLatency(request)
 	if err != nil {
 		worker.logger.WithFields(logrus.Fields{
 			"err": err.Error(),
-		}).Warning("Unable to refresh all requests in cache")
+		}).Warning("Unable to record decision in stats")
 	}
+}
+
+// processedRecorder records when the worker carried out the decision on a request
+type processedRecorder interface {
+	MarkRequestProcessed(id primitive.ObjectID, processedAt time.Time) error
+}
 
-	// Update Stats value in cache
-	err = worker.cache.UpdateRealTimeStats(request)
+// recordProcessed records that the decision on the request has been carried out, for the time to whitelist
+// stats. Best effort only
+func (worker *Worker) recordProcessed(request types.WhitelistRequest) {
+	err := worker.processedRequests.MarkRequestProcessed(request.ID, time.Now())
 	if err != nil {
 		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
 			"err": err.Error(),
-		}).Warning("Unable to update stats in cache")
+		}).Warning("Unable to record request as processed")
 	}
 }
 
-// Nack if decision email is not sent. Ack if sent.
-func (worker *Worker) processApproval(d amqp.Delivery, request types.WhitelistRequest) {
-	worker.logger.WithFields(logrus.Fields{
+// Update the cached entries of the requests. Best effort only
+func (worker *Worker) refreshCachedRequests(ids ...primitive.ObjectID) {
+	refresh := worker.requestCache.RefreshRequests
+	if worker.refresher != nil {
+		refresh = worker.refresher.refreshRequests
+	}
+	err := refresh(ids...)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Warning("Unable to refresh all requests in cache")
+	}
+}
+
+// Whitelist the player on the game server and email them about the approval. Retries resume from the step
+// that failed, so a failed email is sent again without whitelisting the player again
+func (worker *Worker) processApproval(ctx context.Context, d amqp.Delivery, request types.WhitelistRequest) {
+	worker.taskLogger(ctx).WithFields(logrus.Fields{
 		"username": request.Username,
 		"ID":       request.ID,
 		"Type":     "Approval Task",
 	}).Info("Received new task")
 
-	worker.updateCache(request)
-	// Concrete whitelist action on the game server
-	err := worker.issueRCON("whitelist add " + request.Username)
-	if err != nil {
-		worker.logger.WithFields(logrus.Fields{
-			"username": request.Username,
-			"err":      err.Error(),
-		}).Error("Unable to issue whitelist cmd on the game server")
-		d.Nack(false, false)
-		return
+	if completedSteps(d)&types.StepServerAction == 0 {
+		if worker.rejectInvalidUsername(request) {
+			worker.completeTask(d, requestTaskKey(request))
+			return
+		}
+		// Only checked before anything was carried out, e.g not once the approval email was sent during maintenance
+		if completedSteps(d) == 0 && worker.waitlistIfFull(d, request) {
+			return
+		}
+		worker.recordDecided(request)
+		worker.updateCache(request)
 	}
-	worker.emailDecision(request)
-	d.Ack(false)
+	worker.runSteps(d, request, gameServerTask{
+		action: "Whitelist " + request.Username + " on the game server",
+		run: func() error {
+			return worker.backendFor(requestTenant(request)).Whitelist(request)
+		},
+		onserverStatus: types.OnserverWhitelisted,
+		persisted: func() {
+			worker.recordProcessed(request)
+			worker.recordWhitelisted(request)
+			if request.Canary {
+				worker.completeCanary(request)
+			}
+		},
+		notify: func() error {
+			return worker.emailDecision(request, false)
+		},
+	})
 }
 
-// Nack if decision email is not sent. Ack if sent.
-func (worker *Worker) processDenial(d amqp.Delivery, request types.WhitelistRequest) {
-	// Need to send update status back to the user
-	// Put message to dead letter queue for later investigation if unable to send decision email
-	worker.logger.WithFields(logrus.Fields{
+// Retry if the decision email failed. Once retries are exhausted the failure is recorded for admins to resend
+func (worker *Worker) processDenial(ctx context.Context, d amqp.Delivery, request types.WhitelistRequest) {
+	worker.taskLogger(ctx).WithFields(logrus.Fields{
 		"username": request.Username,
 		"ID":       request.ID,
 		"Type":     "Denial Task",
 	}).Info("Received new task")
 
-	worker.updateCache(request)
-	worker.emailDecision(request)
-	d.Ack(false)
+	if !emailPhase(d) {
+		worker.recordDecided(request)
+		worker.updateCache(request)
+		worker.recordProcessed(request)
+		worker.notifyStatusChange(request)
+	}
+	err := worker.emailDecision(request, false)
+	if err != nil && !worker.flagUndeliverable(request, err) {
+		worker.retryDecisionEmail(d, request, err, amqp.Table{types.PhaseHeader: types.PhaseEmail})
+		return
+	}
+	worker.completeTask(d, requestTaskKey(request))
+}
+
+// emailPhase tells if only the decision email of the task is left to send
+func emailPhase(d amqp.Delivery) bool {
+	phase, _ := d.Headers[types.PhaseHeader].(string)
+	return phase == types.PhaseEmail
+}
+
+// failedNotificationStore records decision emails the worker gave up sending
+type failedNotificationStore interface {
+	RecordFailedNotification(notification types.FailedNotification) error
+}
+
+// retryDecisionEmail retries sending the decision email without carrying out the decision again, the headers
+// tell the retry what is left. Once retries are exhausted the task is put to the dead letter queue and the
+// failure recorded, so an admin can resend it
+func (worker *Worker) retryDecisionEmail(d amqp.Delivery, request types.WhitelistRequest, emailErr error, headers amqp.Table) {
+	if worker.retriesExhausted(d) {
+		err := worker.failedNotifications.RecordFailedNotification(types.FailedNotification{
+			RequestID: request.ID,
+			ServerID:  request.ServerID,
+			Username:  request.Username,
+			Email:     request.Email,
+			Status:    request.Status,
+			Error:     emailErr.Error(),
+			Timestamp: time.Now(),
+		})
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"ID":  request.ID.Hex(),
+				"err": err.Error(),
+			}).Error("Unable to record failed decision email")
+		}
+	}
+	worker.retryMsgWithDelay(d, "Email decision to "+request.Username, emailErr, headers)
 }
 
 // Ban will permanately ban a user from the server and woll prevent
 // applications coming from that user
-func (worker *Worker) processBan(d amqp.Delivery, request types.WhitelistRequest) {
-	worker.logger.WithFields(logrus.Fields{
+func (worker *Worker) processBan(ctx context.Context, d amqp.Delivery, request types.WhitelistRequest) {
+	worker.taskLogger(ctx).WithFields(logrus.Fields{
 		"username": request.Username,
 		"ID":       request.ID,
 		"Type":     "Ban Task",
 	}).Info("Received new task")
 	worker.updateCache(request)
-	err := worker.issueRCON("ban " + request.Username)
-	if err != nil {
-		worker.logger.WithFields(logrus.Fields{
-			"username": request.Username,
-			"err":      err.Error(),
-		}).Error("Unable to ban user on the game server")
-		d.Nack(false, false)
-		return
-	}
-	d.Ack(false)
+	// Applications of the player are rejected right away, even while the ban waits for a maintenance window
+	worker.updateBannedUsernames(request)
+	worker.runSteps(d, request, gameServerTask{
+		action: "Ban " + request.Username + " on the game server",
+		run: func() error {
+			err := worker.backendFor(requestTenant(request)).Ban(request)
+			// The ops want to know the ban landed, or that it will not without them
+			if err == nil || worker.retriesExhausted(d) || utils.IsInvalidUsername(err) {
+				worker.alertBan(request, err)
+			}
+			return err
+		},
+		onserverStatus: types.OnserverBanned,
+		// The slot of the player goes to the oldest waitlisted request
+		persisted: func() {
+			worker.promoteAfterSlotFreed(request)
+		},
+		// Let the player know why they were banned. Best effort only
+		notify: func() error {
+			worker.emailDecision(request, false)
+			return nil
+		},
+	})
 }
 
-// Deactivate a user will un-whitelist that username. But allow further applications
-// from the same user
-func (worker *Worker) processDeactivate(d amqp.Delivery, request types.WhitelistRequest) {
-	worker.logger.WithFields(logrus.Fields{
+// Unban pardons a banned user on the game server. The user is not whitelisted again
+// but may apply again
+func (worker *Worker) processUnban(ctx context.Context, d amqp.Delivery, request types.WhitelistRequest) {
+	worker.taskLogger(ctx).WithFields(logrus.Fields{
 		"username": request.Username,
 		"ID":       request.ID,
-		"Type":     "Deactivate Task",
+		"Type":     "Unban Task",
 	}).Info("Received new task")
 	worker.updateCache(request)
-	err := worker.issueRCON("whitelist remove " + request.Username)
-	if err != nil {
-		worker.logger.WithFields(logrus.Fields{
-			"username": request.Username,
-			"err":      err.Error(),
-		}).Error("Unable to deactivate user on the game server")
-		d.Nack(false, false)
-		return
-	}
-	d.Ack(false)
-
+	worker.updateBannedUsernames(request)
+	worker.runSteps(d, request, gameServerTask{
+		action: "Unban " + request.Username + " on the game server",
+		run: func() error {
+			return worker.backendFor(requestTenant(request)).Pardon(request)
+		},
+		onserverStatus: types.OnserverRemoved,
+		// Let the player know they may apply again. Best effort only
+		notify: func() error {
+			worker.emailUnbanned(request)
+			return nil
+		},
+	})
 }
 
-//Nack: successful ops emails less than threshold; confirmation email does not count
-func (worker *Worker) processNewRequest(d amqp.Delivery, request types.WhitelistRequest) {
-	worker.logger.WithFields(logrus.Fields{
+// Deactivate a user will un-whitelist that username. But allow further applications
+// from the same user
+func (worker *Worker) processDeactivate(ctx context.Context, d amqp.Delivery, request types.WhitelistRequest) {
+	worker.taskLogger(ctx).WithFields(logrus.Fields{
 		"username": request.Username,
 		"ID":       request.ID,
-		"Type":     "New Reqeust Task",
+		"Type":     "Deactivate Task",
 	}).Info("Received new task")
-
 	worker.updateCache(request)
-	// Need to handle new request
-	// Send application confirmation email to user
-	worker.emailConfirmation(request)
+	worker.runSteps(d, request, gameServerTask{
+		action: "Deactivate " + request.Username + " on the game server",
+		run: func() error {
+			return worker.backendFor(requestTenant(request)).Unwhitelist(request)
+		},
+		onserverStatus: types.OnserverRemoved,
+		// The slot of the player goes to the oldest waitlisted request
+		persisted: func() {
+			worker.promoteAfterSlotFreed(request)
+		},
+		// Let the player know their temporary grant has ended. Best effort only
+		notify: func() error {
+			if grantExpired(request) {
+				worker.emailGrantExpired(request)
+			}
+			return nil
+		},
+	})
+}
 
-	// Send approval request emails to op(s)
-	successCount, err := worker.emailToOps(request, viper.GetInt("minRequiredReceiver"))
-	if err != nil {
-		// If success count for sending ops emails less than minimum quoram, put to dead letter queue
-		worker.logger.WithFields(logrus.Fields{
-			"message":      request,
-			"successCount": successCount,
-		}).Error("Failed to dispatch action emails to required number of ops")
-		d.Nack(false, false)
-		return
+// grantExpired tells if the request was deactivated because its temporary grant expired, not by an op
+// before the expiry
+func grantExpired(request types.WhitelistRequest) bool {
+	return request.ExpiresAt != nil && !request.ExpiresAt.After(request.LastUpdatedTimestamp)
+}
+
+// Periodically deactivate players whose temporary grant has passed its expiry
+func (worker *Worker) grantExpirationLoop() {
+	for range schedule.Tick(schedule.Every(60 * time.Second)) {
+		worker.runAsLeader("deactivate expired grants", worker.deactivateExpiredGrants)
 	}
-	d.Ack(false)
 }
 
-func (worker *Worker) emailDecision(whitelistRequest types.WhitelistRequest) error {
-	log := worker.logger
-	requestIDToken, err := utils.EncodeAndEncrypt(whitelistRequest.ID.Hex(), viper.GetString("passphrase"))
+// deactivateExpiredGrants marks approved requests past their ExpiresAt as deactivated and
+// hands them to the deactivate task, which un-whitelists the players
+func (worker *Worker) deactivateExpiredGrants() error {
+	now := time.Now()
+	expiredGrants, err := worker.store.QueryRequests(db.RequestFilter{
+		Statuses:      []string{types.StatusApproved},
+		ExpiresBefore: now,
+	})
 	if err != nil {
-		log.WithFields(logrus.Fields{
-			"err": err,
-		}).Error("Failed to encode requestID Token")
 		return err
 	}
-	var subject string
-	var template string
-	if whitelistRequest.Status == "Approved" {
-		subject = viper.GetString("approvedEmailTitle")
-		template = "./mailer/templates/approve.html"
-	} else {
-		subject = viper.GetString("deniedEmailTitle")
-		template = "./mailer/templates/deny.html"
+	for _, request := range expiredGrants {
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		claimed, err := worker.deactivateRequest(request)
+		if err != nil {
+			return err
+		}
+		if claimed {
+			worker.logger.WithFields(logrus.Fields{
+				"ID":       request.ID.Hex(),
+				"username": request.Username,
+			}).Info("Temporary grant expired. Request deactivated")
+		}
 	}
-	err = mailer.Send(template, map[string]string{"link": requestIDToken}, subject, whitelistRequest.Email)
-	if err != nil {
-		log.WithFields(logrus.Fields{
-			"recipent": whitelistRequest.Email,
+	return nil
+}
+
+// deactivateRequest marks an approved request as deactivated and hands its task to the worker like the API
+// does: written to the outbox with the change, or published right after it with directPublish. Returns false
+// if the request is no longer approved, e.g it has been deactivated by another worker concurrently
+func (worker *Worker) deactivateRequest(request types.WhitelistRequest) (bool, error) {
+	change := db.StatusChange{
+		From: types.StatusApproved,
+		To:   types.StatusDeactivated,
+		At:   time.Now(),
+	}
+	if !viper.GetBool("directPublish") {
+		_, err := worker.store.TransitionStatusWithTask(request.ID, change)
+		if err == db.ErrConflict {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	deactivatedRequest, err := worker.store.TransitionStatus(request.ID, change)
+	if err == db.ErrConflict {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	deactivatedRequest.PreviousStatus = types.StatusApproved
+	err = worker.publishRequest(deactivatedRequest, nil)
+	if err != nil {
+		// Release the claim so the request can be picked up again
+		_, revertErr := worker.store.TransitionStatus(request.ID, db.StatusChange{
+			From: types.StatusDeactivated,
+			To:   types.StatusApproved,
+			At:   time.Now(),
+		})
+		if revertErr != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"ID":  request.ID.Hex(),
+				"err": revertErr.Error(),
+			}).Error("Unable to revert status of request")
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// batchStore reads and ends event batches. Implemented by *db.Service
+type batchStore interface {
+	GetExpiredBatches(now time.Time) ([]types.Batch, error)
+	EndBatch(id primitive.ObjectID, now time.Time) (types.Batch, bool, error)
+}
+
+// Periodically end event batches whose end time has passed
+func (worker *Worker) batchExpirationLoop() {
+	for range schedule.Tick(schedule.Every(60 * time.Second)) {
+		worker.runAsLeader("end expired batches", worker.endExpiredBatches)
+	}
+}
+
+// endExpiredBatches publishes deactivation tasks for all members of the batches that have ended
+// and sends the owner a summary for each batch
+func (worker *Worker) endExpiredBatches() error {
+	now := time.Now()
+	expiredBatches, err := worker.batches.GetExpiredBatches(now)
+	if err != nil {
+		return err
+	}
+	for _, batch := range expiredBatches {
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		// Claim the batch atomically so concurrent workers do not end it twice
+		endedBatch, claimed, err := worker.batches.EndBatch(batch.ID, now)
+		if err != nil {
+			return err
+		} else if !claimed {
+			continue
+		}
+		// Members detached before the batch ended are no longer part of it
+		members, err := worker.store.QueryRequests(db.RequestFilter{
+			Statuses: []string{types.StatusApproved},
+			BatchID:  endedBatch.ID.Hex(),
+		})
+		if err != nil {
+			return err
+		}
+		deactivated := make([]string, 0)
+		failed := make([]string, 0)
+		for _, member := range members {
+			claimed, err := worker.deactivateRequest(member)
+			if err != nil {
+				worker.logger.WithFields(logrus.Fields{
+					"ID":      member.ID.Hex(),
+					"batchId": endedBatch.ID.Hex(),
+					"err":     err.Error(),
+				}).Error("Unable to deactivate batch member")
+				failed = append(failed, member.Username)
+			} else if claimed {
+				deactivated = append(deactivated, member.Username)
+			}
+		}
+		worker.logger.WithFields(logrus.Fields{
+			"batchId":     endedBatch.ID.Hex(),
+			"name":        endedBatch.Name,
+			"deactivated": len(deactivated),
+			"failed":      len(failed),
+		}).Info("Batch ended")
+		worker.emailBatchSummary(endedBatch, deactivated, failed)
+	}
+	return nil
+}
+
+// publishRequest publishes a whitelist request task to the task queue, the high priority one for bans and deactivations
+func (worker *Worker) publishRequest(request types.WhitelistRequest, headers amqp.Table) error {
+	body, err := types.EncodeRequestMessage(request)
+	if err != nil {
+		return err
+	}
+	if headers == nil {
+		headers = make(amqp.Table)
+	}
+	if _, ok := headers[types.PublishedAtHeader]; !ok {
+		headers[types.PublishedAtHeader] = time.Now().Unix()
+	}
+	if types.HighPriority(request.Status) {
+		headers[types.PriorityHeader] = types.PriorityHigh
+	}
+	return worker.publisher.publish(
+		"",                                   // exchange
+		worker.topology.TaskQueueOf(headers), // routing key
+		amqp.Publishing{
+			Headers:      headers,
+			DeliveryMode: amqp.Persistent,
+			ContentType:  "application/json",
+			Body:         body,
+		})
+}
+
+// Periodically re-dispatch requests assigned to away ops and escalate requests that no op has responded to
+func (worker *Worker) escalationLoop() {
+	for range schedule.Tick(schedule.Every(60 * time.Second)) {
+		worker.runAsLeader("re-dispatch requests of away ops", worker.redispatchFromAwayOps)
+		if viper.GetInt("escalationAfterMinutes") <= 0 {
+			continue
+		}
+		worker.runAsLeader("escalate stale requests", worker.escalateStaleRequests)
+	}
+}
+
+// escalateStaleRequests re-dispatch action emails for requests still pending after the configured
+// duration to the escalation address if configured, otherwise to the full ops list
+func (worker *Worker) escalateStaleRequests() error {
+	cutoff := time.Now().Add(-time.Duration(viper.GetInt("escalationAfterMinutes")) * time.Minute)
+	filter := db.RequestFilter{
+		Statuses:        []string{types.StatusPending},
+		SubmittedBefore: cutoff,
+		NotEscalated:    true,
+		// Parked requests have not been dispatched to anyone yet
+		ExcludeAwaitingOps: true,
+	}
+	if digestMode() {
+		// Ops only know about requests once they were in a digest
+		filter.DigestedBefore = cutoff
+	}
+	staleRequests, err := worker.store.QueryRequests(filter)
+	if err != nil {
+		return err
+	}
+	for _, request := range staleRequests {
+		// Tasks of unknown tenants are parked, so are their escalations
+		if !tenant.Known(request.ServerID) {
+			continue
+		}
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		// Claim the escalation atomically so concurrent workers do not escalate twice
+		err := worker.store.ClaimEscalation(request.ID, time.Now())
+		if err == db.ErrConflict {
+			continue
+		} else if err != nil {
+			return err
+		}
+		cfg := requestTenant(request)
+		targets := []string{cfg.GetString("escalationEmail")}
+		if targets[0] == "" {
+			ops, err := worker.opsOf(cfg)
+			if err != nil {
+				return err
+			}
+			targets = opEmails(ops)
+		}
+		worker.logger.WithFields(logrus.Fields{
+			"ID":      request.ID.Hex(),
+			"targets": targets,
+		}).Warning("Request is still pending. Escalating")
+		notifiedOps, _, err := worker.emailToOps(request, targets)
+		if err != nil {
+			return err
+		}
+		worker.addAssignees(request, notifiedOps)
+	}
+	return nil
+}
+
+// Periodically expire requests that stayed pending longer than pendingTTLHours
+func (worker *Worker) expirationLoop() {
+	interval := time.Duration(viper.GetInt("expirationSweepIntervalMinutes")) * time.Minute
+	if interval <= 0 {
+		interval = defaultExpirationSweepInterval
+	}
+	for range schedule.Tick(schedule.Every(interval)) {
+		if viper.GetInt("pendingTTLHours") <= 0 {
+			continue
+		}
+		worker.runAsLeader("expire stale requests", func() error {
+			return worker.expireStaleRequests(time.Now())
+		})
+	}
+}
+
+// expireStaleRequests transitions requests pending for longer than pendingTTLHours to Expired
+// and lets the applicants know they are welcome to reapply
+func (worker *Worker) expireStaleRequests(now time.Time) error {
+	cutoff := now.Add(-time.Duration(viper.GetInt("pendingTTLHours")) * time.Hour)
+	staleRequests, err := worker.store.QueryRequests(db.RequestFilter{
+		Statuses:           []string{types.StatusPending},
+		SubmittedBefore:    cutoff,
+		ExcludeAwaitingOps: true,
+	})
+	if err != nil {
+		return err
+	}
+	for _, request := range staleRequests {
+		if !worker.leading() {
+			return errLeadershipLost
+		}
+		// Only the worker whose update matches the pending request expires it
+		// so concurrent workers do not email the applicant twice
+		expiredRequest, err := worker.store.TransitionStatus(request.ID, db.StatusChange{
+			From: types.StatusPending,
+			To:   types.StatusExpired,
+			At:   now,
+		})
+		if err == db.ErrConflict {
+			continue
+		} else if err != nil {
+			return err
+		}
+		worker.logger.WithFields(logrus.Fields{
+			"ID": expiredRequest.ID.Hex(),
+		}).Info("Request expired")
+		worker.updateCache(expiredRequest)
+		// Best effort only. The request has expired regardless
+		worker.emailExpiration(expiredRequest)
+		expiredRequest.PreviousStatus = types.StatusPending
+		worker.notifyStatusChange(expiredRequest)
+	}
+	return nil
+}
+
+// Retry if successful ops emails less than threshold; confirmation email does not count
+// Retries only target the ops whose action email failed in the previous attempt
+func (worker *Worker) processNewRequest(ctx context.Context, d amqp.Delivery, request types.WhitelistRequest) {
+	worker.taskLogger(ctx).WithFields(logrus.Fields{
+		"username": request.Username,
+		"ID":       request.ID,
+		"Type":     "New Reqeust Task",
+	}).Info("Received new task")
+
+	// Requests submitted while applications were closed wait for the next window
+	if worker.holdOutsideApplicationWindow(d, request) {
+		return
+	}
+
+	// Only check for duplicates on the first attempt. Retries are already known to be unique
+	skip, _ := d.Headers[types.SkipConfirmationHeader].(bool)
+	if !skip && (worker.rejectInvalidUsername(request) || worker.submissionLimited(request) || worker.rejectBanned(request) ||
+		worker.rejectDuplicate(request) || worker.rejectInCooldown(request) || worker.rejectUnverifiedReferral(request)) {
+		worker.completeTask(d, requestTaskKey(request))
+		return
+	}
+
+	// Need to handle new request
+	// Count the request in stats and send application confirmation email to user only on the first attempt
+	if !skip {
+		worker.recordSubmitted(request)
+		worker.updateCache(request)
+		worker.emailConfirmation(request, false)
+		worker.notifyStatusChange(request)
+	}
+	// Collected again by retries, the task does not carry them
+	request.NetworkSignals = worker.collectNetworkSignals(request)
+	request.Referral = worker.checkReferral(request)
+	// Canary requests are dispatched to the canary mailbox only
+	if worker.noOpsFor(requestTenant(request)) && !request.Canary {
+		worker.parkRequest(d, request)
+		return
+	}
+	// Ops get the request with the next digest
+	if digestMode() && !request.Canary {
+		worker.completeTask(d, requestTaskKey(request))
+		return
+	}
+
+	// Ops are not emailed while most emails fail, e.g because the SMTP credentials expired
+	if rate, failing := worker.mailFailing(); failing {
+		worker.pauseOpsDispatch(d, request, rate)
+		return
+	}
+	// Send approval request emails to op(s)
+	targetOps := worker.targetOpsForAttempt(requestTenant(request), d.Headers)
+	if request.Canary {
+		targetOps = []string{canaryOp}
+	}
+	notifiedOps, failedOps, err := worker.emailToOps(request, targetOps)
+	if err != nil {
+		d.Nack(false, false)
+		return
+	}
+	worker.addAssignees(request, notifiedOps)
+	worker.recordOpsNotified(request, notifiedOps)
+
+	notifiedCount := headerInt(d.Headers, notifiedCountHeader) + len(notifiedOps)
+	if notifiedCount < viper.GetInt("minRequiredReceiver") {
+		worker.taskLogger(ctx).WithFields(logrus.Fields{
+			"message":       request,
+			"notifiedCount": notifiedCount,
+			"failedOps":     failedOps,
+		}).Error("Failed to dispatch action emails to required number of ops")
+		if (len(failedOps) == 0 || worker.retriesExhausted(d)) && !request.Canary {
+			// The quorum can not be reached anymore. One email sent to the fallback approver satisfies it
+			if fallback := worker.emailFallbackApprover(request); len(fallback) > 0 {
+				worker.addAssignees(request, fallback)
+				worker.recordOpsNotified(request, fallback)
+				worker.completeTask(d, requestTaskKey(request))
+				return
+			}
+		}
+		if len(failedOps) == 0 {
+			// Nothing left to retry. The quorum can not be reached with the current ops configuration
+			worker.completeTask(d, requestTaskKey(request))
+			return
+		}
+		worker.retryMsgWithDelay(d, "Dispatch action emails to ops for "+request.Username, errOpsNotEmailed(failedOps), amqp.Table{
+			types.SkipConfirmationHeader: true,
+			failedOpsHeader:              toTableArray(failedOps),
+			notifiedCountHeader:          int32(notifiedCount),
+		})
+		return
+	}
+	worker.completeTask(d, requestTaskKey(request))
+}
+
+// parkRequest flags a new request as awaiting ops configuration instead of dispatching it to nobody
+// and dead-lettering it. Parked requests are released by releaseParkedLoop once ops are configured
+func (worker *Worker) parkRequest(d amqp.Delivery, request types.WhitelistRequest) {
+	_, err := worker.store.SetAwaitingOps(request.ID, true)
+	if err == db.ErrConflict {
+		// The request has been decided or removed in the meantime
+		d.Ack(false)
+		return
+	} else if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Error("Unable to park request")
+		worker.retryMsgWithDelay(d, "Park request of "+request.Username, err, amqp.Table{types.SkipConfirmationHeader: true})
+		return
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"ID":       request.ID.Hex(),
+		"username": request.Username,
+	}).Warning("No ops configured. Request is awaiting ops configuration and will be dispatched once ops are configured")
+	worker.refreshCachedRequests(request.ID)
+	d.Ack(false)
+}
+
+// Periodically release parked requests once ops are configured, e.g after the config file is reloaded
+func (worker *Worker) releaseParkedLoop() {
+	for range schedule.Tick(schedule.Every(60 * time.Second)) {
+		if !worker.anyOps() {
+			continue
+		}
+		worker.runAsLeader("release parked requests", func() error {
+			_, err := worker.ReleaseParkedRequests()
+			return err
+		})
+	}
+}
+
+// ReleaseParkedRequests republish requests awaiting ops configuration so they go through the
+// normal dispatching to ops. Requests of tenants still without ops stay parked. The applicants are not sent
+// another confirmation email. Returns the number of requests released
+func (worker *Worker) ReleaseParkedRequests() (int, error) {
+	parkedRequests, err := worker.store.QueryRequests(db.RequestFilter{
+		Statuses:        []string{types.StatusPending},
+		OnlyAwaitingOps: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	released := make([]primitive.ObjectID, 0)
+	// Released requests are refreshed in the cache even if releasing the others fails
+	defer func() {
+		worker.refreshCachedRequests(released...)
+	}()
+	for _, request := range parkedRequests {
+		if !tenant.Known(request.ServerID) || worker.noOpsFor(requestTenant(request)) {
+			continue
+		}
+		// Claim the request atomically so concurrent workers do not release it twice
+		releasedRequest, err := worker.store.SetAwaitingOps(request.ID, false)
+		if err == db.ErrConflict {
+			continue
+		} else if err != nil {
+			return len(released), err
+		}
+		// Already told to webhook endpoints when submitted
+		releasedRequest.PreviousStatus = releasedRequest.Status
+		err = worker.publishRequest(releasedRequest, amqp.Table{types.SkipConfirmationHeader: true})
+		if err != nil {
+			// Park the request again so it is released by the next sweep
+			_, parkErr := worker.store.SetAwaitingOps(request.ID, true)
+			// Not parked again if it has been decided in the meantime
+			if parkErr != nil && parkErr != db.ErrConflict {
+				worker.logger.WithFields(logrus.Fields{
+					"ID":  request.ID.Hex(),
+					"err": parkErr.Error(),
+				}).Error("Unable to park request again after failing to release it")
+			}
+			return len(released), err
+		}
+		worker.logger.WithFields(logrus.Fields{
+			"ID": request.ID.Hex(),
+		}).Info("Released request awaiting ops configuration")
+		released = append(released, request.ID)
+	}
+	return len(released), nil
+}
+
+// submissionLimited checks whether applications of the request's email have been rejected by the submission
+// limit within its window. Requests published before the limit kicked in are skipped without side effects
+func (worker *Worker) submissionLimited(request types.WhitelistRequest) bool {
+	rejected, _, err := worker.cache.GetAttempts(cache.SubmissionLimitedKey(request.Email))
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Warning("Unable to check submission limit")
+		return false
+	}
+	if rejected == 0 {
+		return false
+	}
+	worker.logger.WithFields(logrus.Fields{
+		"ID":       request.ID.Hex(),
+		"username": request.Username,
+	}).Warning("Email exceeded the submission limit. Skipping request")
+	metrics.SubmissionsSkipped.Inc()
+	return true
+}
+
+// rejectDuplicate checks for an earlier open, approved or banned request with the same username or email.
+// If found, the new request is not dispatched to ops and the applicant is told why. Duplicates of open
+// or approved requests are discarded, requests of banned players are denied
+func (worker *Worker) rejectDuplicate(request types.WhitelistRequest) bool {
+	log := worker.logger
+	// Only requests submitted before this one count so two concurrent duplicates do not reject each other
+	duplicates, err := worker.store.QueryRequests(db.RequestFilter{
+		Statuses: []string{types.StatusPending, types.StatusDisputed, types.StatusApproved, types.StatusWaitlisted, types.StatusBanned},
+		Tenants:  []string{request.ServerID},
+		Username: request.Username,
+		Email:    request.Email,
+		BeforeID: request.ID,
+	})
+	if err != nil {
+		// Best effort only. Process the request as usual
+		log.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Warning("Unable to check for duplicate requests")
+		return false
+	}
+	if len(duplicates) == 0 {
+		return false
+	}
+	existing := duplicates[0]
+	for _, duplicate := range duplicates {
+		if duplicate.Status == types.StatusBanned {
+			// The request is kept as denied so ops can see the player tried again
+			return worker.denyBanned(request)
+		}
+	}
+	log.WithFields(logrus.Fields{
+		"ID":         request.ID.Hex(),
+		"existingID": existing.ID.Hex(),
+		"status":     existing.Status,
+	}).Warning("Duplicate request. Skip dispatching to ops")
+	err = worker.store.DeleteRequest(request.ID)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"ID":  request.ID.Hex(),
+			"err": err.Error(),
+		}).Error("Unable to delete duplicate request")
+	} else {
+		worker.refreshCachedRequests(request.ID)
+	}
+	worker.emailDuplicate(request, existing)
+	return true
+}
+
+// retryMsgWithDelay republishes the message to the retry queue where it waits for an
+// exponentially increasing delay before it is routed back to the task queue. The retry is recorded with the
+// error which caused it, see recordRetry. The original delivery is put to the dead letter queue once max retries is reached
+func (worker *Worker) retryMsgWithDelay(d amqp.Delivery, action string, cause error, headers amqp.Table) {
+	log := worker.logger
+	retryCount := headerInt(d.Headers, retryCountHeader)
+	if worker.retriesExhausted(d) {
+		log.WithFields(logrus.Fields{
+			"action":     action,
+			"retryCount": retryCount,
+		}).Error("Max retries reached. Put message to the dead letter queue")
+		d.Nack(false, false)
+		metrics.DeadLettered.Inc()
+		return
+	}
+
+	newHeaders := make(amqp.Table)
+	for k, v := range d.Headers {
+		newHeaders[k] = v
+	}
+	for k, v := range headers {
+		newHeaders[k] = v
+	}
+	newHeaders[retryCountHeader] = int32(retryCount + 1)
+	retryID := primitive.NewObjectID()
+	newHeaders[types.RetryIDHeader] = retryID.Hex()
+	delay := retryDelay(retryCount)
+	// The original delivery is only acked once the republication is confirmed, otherwise the action would be lost
+	err := worker.publishRetry(d, newHeaders, delay)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"action": action,
+			"err":    err.Error(),
+		}).Error("Unable to publish message to the retry queue. Requeue the message")
+		d.Nack(false, true)
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"action":  action,
+		"attempt": retryCount + 1,
+		"delay":   delay.String(),
+	}).Warning("Action failed. Message scheduled for retry")
+	metrics.Retries.Inc()
+	worker.recordRetry(d, retryID, action, cause, newHeaders, delay)
+	d.Ack(false)
+}
+
+// publishRetry republishes the message with the headers to the retry queue, from where it is routed back to the
+// task queue after the delay. Request tasks are stamped with the current schema version
+func (worker *Worker) publishRetry(d amqp.Delivery, headers amqp.Table, delay time.Duration) error {
+	body := d.Body
+	if taskType, _ := headers[types.TaskTypeHeader].(string); taskType == "" {
+		if request, _, err := deserialize(d.Body); err == nil {
+			if encoded, err := types.EncodeRequestMessage(request); err == nil {
+				body = encoded
+			}
+		}
+	}
+	// Retries keep the priority header, so they wait in and come back to the queues of their priority
+	exchange, key := worker.topology.RetryRouteOf(headers)
+	return worker.publisher.publish(
+		exchange, // exchange
+		key,      // routing key
+		amqp.Publishing{
+			Headers:      headers,
+			DeliveryMode: amqp.Persistent,
+			ContentType:  "application/json",
+			Body:         body,
+			// Per-message ttl in milliseconds
+			Expiration: strconv.FormatInt(int64(delay/time.Millisecond), 10),
+		})
+}
+
+// retriesExhausted tells if the message already reached max number of retries
+func (worker *Worker) retriesExhausted(d amqp.Delivery) bool {
+	maxRetries := config.GetInt("maxRetries")
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+	return headerInt(d.Headers, retryCountHeader) >= maxRetries
+}
+
+// Delay doubles for each retry starting from the configured retry delay
+func retryDelay(retryCount int) time.Duration {
+	delay := time.Duration(config.GetInt("retryDelaySeconds")) * time.Second
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	return delay * time.Duration(1<<uint(retryCount))
+}
+
+// headerInt reads an integer header value set by this worker. Missing header counts as 0
+func headerInt(headers amqp.Table, key string) int {
+	switch v := headers[key].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// headerStrings reads a string array header value. Returns nil if the header is missing
+func headerStrings(headers amqp.Table, key string) []string {
+	values, ok := headers[key].([]interface{})
+	if !ok {
+		return nil
+	}
+	result := []string{}
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func toTableArray(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, v := range values {
+		result[i] = v
+	}
+	return result
+}
+
+// Run an owner issued console command on the game server. The server response is recorded
+// on the task and in the audit log. Retry if the game server is unavailable
+func (worker *Worker) processConsoleTask(ctx context.Context, d amqp.Delivery) {
+	log := worker.taskLogger(ctx)
+	var task types.ConsoleTask
+	err := json.Unmarshal(d.Body, &task)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"messageBody": d.Body,
+			"err":         err,
+		}).Error("Unable to decode message into consoleTask")
+		d.Nack(false, false)
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"command": task.Command,
+		"actor":   task.Actor,
+		"ID":      task.ID,
+		"Type":    "Console Task",
+	}).Info("Received new task")
+	if worker.taskProcessed(d, consoleTaskKey(task)) {
+		d.Ack(false)
+		return
+	}
+
+	// Console commands run on the game server of the default tenant
+	if until, ok := worker.inMaintenance(tenant.Default, time.Now()); ok {
+		worker.deferGameServerTask(d, until, "Run console command "+task.Command, nil)
+		return
+	}
+	response, err := worker.issueRCON(task.Command)
+	if err != nil {
+		worker.logGameServerError(logrus.Fields{
+			"command": task.Command,
+		}, err, "Unable to issue console command on the game server")
+		if !worker.retriesExhausted(d) {
+			worker.retryMsgWithDelay(d, "Run console command "+task.Command, err, nil)
+			return
+		}
+	}
+	worker.completeConsoleTask(ctx, task, response, err)
+	if err != nil {
+		d.Nack(false, false)
+		return
+	}
+	worker.completeTask(d, consoleTaskKey(task))
+}
+
+// consoleTaskStore records the outcome of console tasks. Implemented by *db.Service
+type consoleTaskStore interface {
+	CompleteConsoleTask(ctx context.Context, id primitive.ObjectID, response, failure string, at time.Time) error
+}
+
+// auditStore appends entries to the audit log. Implemented by *db.Service
+type auditStore interface {
+	CreateAuditEntry(entry types.AuditEntry) error
+}
+
+// Record the outcome of the console task on the task itself and in the audit log
+func (worker *Worker) completeConsoleTask(ctx context.Context, task types.ConsoleTask, response string, cmdErr error) {
+	failure := ""
+	if cmdErr != nil {
+		failure = cmdErr.Error()
+	}
+	err := worker.consoleTasks.CompleteConsoleTask(ctx, task.ID, response, failure, time.Now())
+	if err != nil {
+		worker.taskLogger(ctx).WithFields(logrus.Fields{
+			"err": err.Error(),
+			"ID":  task.ID.Hex(),
+		}).Error("Unable to update console task status")
+	}
+	err = worker.audit.CreateAuditEntry(consoleAuditEntry(task, response, cmdErr))
+	if err != nil {
+		worker.taskLogger(ctx).WithFields(logrus.Fields{
+			"err": err.Error(),
+			"ID":  task.ID.Hex(),
+		}).Error("Unable to record console task in the audit log")
+	}
+}
+
+func consoleAuditEntry(task types.ConsoleTask, response string, cmdErr error) types.AuditEntry {
+	details := map[string]interface{}{
+		"taskID":   task.ID.Hex(),
+		"command":  task.Command,
+		"response": response,
+	}
+	if cmdErr != nil {
+		details["error"] = cmdErr.Error()
+	}
+	entry := types.AuditEntry{
+		Action:    "console.command",
+		Actor:     task.Actor,
+		Details:   details,
+		Timestamp: time.Now().Truncate(time.Millisecond),
+	}
+	// Signed, so the record of who ran which command on the game server can not be edited unnoticed
+	content, err := entry.SignedContent()
+	if err == nil {
+		entry.Signature = utils.SignAudit(content, utils.PassphraseSecrets().Primary)
+	}
+	return entry
+}
+
+// decisionEmail returns the subject and template of the email telling the applicant about the decision
+func decisionEmail(cfg tenant.Config, status string) (string, string) {
+	switch status {
+	case types.StatusApproved:
+		return cfg.GetString("approvedEmailTitle"), "./mailer/templates/approve.html"
+	case types.StatusBanned:
+		subject := cfg.GetString("bannedEmailTitle")
+		if subject == "" {
+			subject = cfg.GetString("deniedEmailTitle")
+		}
+		return subject, "./mailer/templates/ban.html"
+	default:
+		return cfg.GetString("deniedEmailTitle"), "./mailer/templates/deny.html"
+	}
+}
+
+// emailDecision tells the applicant about the decision. force sends it again even if it has been sent already
+func (worker *Worker) emailDecision(whitelistRequest types.WhitelistRequest, force bool) error {
+	log := worker.logger
+	requestIDToken, err := utils.SignToken(whitelistRequest.ID.Hex(), utils.PurposeStatus, statusLinkTTL())
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to encode requestID Token")
+		return err
+	}
+	subject, template := decisionEmail(requestTenant(whitelistRequest), whitelistRequest.Status)
+	templateData := map[string]string{"link": requestIDToken}
+	if whitelistRequest.ExpiresAt != nil {
+		templateData["expiresAt"] = formatExpiry(*whitelistRequest.ExpiresAt)
+	}
+	// Sets expectations before the applicant tries again
+	if reapplyAfter, ok := ReapplyAfter(whitelistRequest); ok {
+		templateData["reapplyAfter"] = formatExpiry(reapplyAfter)
+	}
+	// The reason is written by the op and rendered in an email sent to the applicant
+	if reason := mailer.SanitizeReason(whitelistRequest.DecisionReason); reason != "" {
+		templateData["reason"] = reason
+	}
+	err = worker.sendApplicantMail(whitelistRequest, template, templateData, subject, force)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
 			"err":      err,
 			"ID":       whitelistRequest.ID.Hex(),
 		}).Error("Failed to send decision email")
@@ -372,18 +1744,24 @@ func (worker *Worker) emailDecision(whitelistRequest types.WhitelistRequest) err
 	return err
 }
 
-func (worker *Worker) emailConfirmation(whitelistRequest types.WhitelistRequest) error {
+// emailConfirmation confirms the application to the applicant. force sends it again even if it has been sent
+// already
+func (worker *Worker) emailConfirmation(whitelistRequest types.WhitelistRequest, force bool) error {
 	log := worker.logger
-	subject := viper.GetString("confirmationEmailTitle")
-	requestIDToken, err := utils.EncodeAndEncrypt(whitelistRequest.ID.Hex(), viper.GetString("passphrase"))
+	subject := requestTenant(whitelistRequest).GetString("confirmationEmailTitle")
+	requestIDToken, err := utils.SignToken(whitelistRequest.ID.Hex(), utils.PurposeStatus, statusLinkTTL())
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err": err,
 		}).Error("Failed to encode requestID Token")
 		return err
 	}
-	confirmationLink := os.Getenv("FRONTEND_DEPLOYED_URL") + "status/" + requestIDToken
-	err = mailer.Send("./mailer/templates/confirmation.html", map[string]string{"link": confirmationLink}, subject, whitelistRequest.Email)
+	builder, err := worker.linksOf(requestTenant(whitelistRequest))
+	if err != nil {
+		return err
+	}
+	confirmationLink := builder.StatusLink(requestIDToken)
+	err = worker.sendApplicantMail(whitelistRequest, "./mailer/templates/confirmation.html", map[string]string{"link": confirmationLink}, subject, force)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"recipent": whitelistRequest.Email,
@@ -398,97 +1776,521 @@ func (worker *Worker) emailConfirmation(whitelistRequest types.WhitelistRequest)
 	return err
 }
 
-func (worker *Worker) emailToOps(whitelistRequest types.WhitelistRequest, quoram int) (int, error) {
+func (worker *Worker) emailDuplicate(whitelistRequest, existingRequest types.WhitelistRequest) error {
+	log := worker.logger
+	subject := requestTenant(whitelistRequest).GetString("duplicateEmailTitle")
+	requestIDToken, err := utils.SignToken(existingRequest.ID.Hex(), utils.PurposeStatus, statusLinkTTL())
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to encode requestID Token")
+		return err
+	}
+	builder, err := worker.linksOf(requestTenant(whitelistRequest))
+	if err != nil {
+		return err
+	}
+	statusLink := builder.StatusLink(requestIDToken)
+	err = worker.sendApplicantMail(whitelistRequest, "./mailer/templates/duplicate.html", map[string]string{"link": statusLink}, subject, false)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+			"err":      err,
+			"ID":       whitelistRequest.ID.Hex(),
+		}).Error("Failed to send duplicate request email")
+	} else {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+		}).Info("Duplicate request email sent")
+	}
+	return err
+}
+
+func (worker *Worker) emailBannedRejection(whitelistRequest types.WhitelistRequest) error {
+	log := worker.logger
+	subject := requestTenant(whitelistRequest).GetString("deniedEmailTitle")
+	err := worker.sendApplicantMail(whitelistRequest, "./mailer/templates/banned.html", map[string]string{}, subject, false)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+			"err":      err,
+			"ID":       whitelistRequest.ID.Hex(),
+		}).Error("Failed to send banned rejection email")
+	} else {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+		}).Info("Banned rejection email sent")
+	}
+	return err
+}
+
+func (worker *Worker) emailReferrerRejection(whitelistRequest types.WhitelistRequest) error {
+	log := worker.logger
+	subject := requestTenant(whitelistRequest).GetString("deniedEmailTitle")
+	err := worker.sendApplicantMail(whitelistRequest, "./mailer/templates/referrer.html", map[string]string{}, subject, false)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+			"err":      err,
+			"ID":       whitelistRequest.ID.Hex(),
+		}).Error("Failed to send referrer rejection email")
+	} else {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+		}).Info("Referrer rejection email sent")
+	}
+	return err
+}
+
+func (worker *Worker) emailExpiration(whitelistRequest types.WhitelistRequest) error {
+	log := worker.logger
+	subject := requestTenant(whitelistRequest).GetString("expiredEmailTitle")
+	err := worker.sendApplicantMail(whitelistRequest, "./mailer/templates/expired.html", map[string]string{}, subject, false)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+			"err":      err,
+			"ID":       whitelistRequest.ID.Hex(),
+		}).Error("Failed to send expiration email")
+	} else {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+		}).Info("Expiration email sent")
+	}
+	return err
+}
+
+func (worker *Worker) emailGrantExpired(whitelistRequest types.WhitelistRequest) error {
+	log := worker.logger
+	subject := requestTenant(whitelistRequest).GetString("grantExpiredEmailTitle")
+	err := worker.sendApplicantMail(whitelistRequest, "./mailer/templates/grant_expired.html", map[string]string{
+		"expiresAt": formatExpiry(*whitelistRequest.ExpiresAt),
+	}, subject, false)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+			"err":      err,
+			"ID":       whitelistRequest.ID.Hex(),
+		}).Error("Failed to send grant expired email")
+	} else {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+		}).Info("Grant expired email sent")
+	}
+	return err
+}
+
+// emailUnbanned lets the player know they may apply again, unless unbannedEmailTitle is empty
+func (worker *Worker) emailUnbanned(whitelistRequest types.WhitelistRequest) error {
+	log := worker.logger
+	subject := requestTenant(whitelistRequest).GetString("unbannedEmailTitle")
+	if subject == "" {
+		return nil
+	}
+	err := worker.sendApplicantMail(whitelistRequest, "./mailer/templates/unban.html", map[string]string{
+		"username": whitelistRequest.Username,
+	}, subject, false)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+			"err":      err,
+			"ID":       whitelistRequest.ID.Hex(),
+		}).Error("Failed to send unbanned email")
+	} else {
+		log.WithFields(logrus.Fields{
+			"recipent": whitelistRequest.Email,
+		}).Info("Unbanned email sent")
+	}
+	return err
+}
+
+// emailBatchSummary lets the owner know which members were deactivated when a batch ended
+func (worker *Worker) emailBatchSummary(batch types.Batch, deactivated, failed []string) error {
 	log := worker.logger
+	recipent := viper.GetString("ownerEmail")
+	if recipent == "" {
+		return nil
+	}
+	subject := "[Batch Ended] " + batch.Name
+	err := worker.sendMail("./mailer/templates/batch_summary.html", batchSummary(batch, deactivated, failed), subject, recipent)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"recipent": recipent,
+			"err":      err,
+			"batchId":  batch.ID.Hex(),
+		}).Error("Failed to send batch summary email")
+	} else {
+		log.WithFields(logrus.Fields{
+			"recipent": recipent,
+		}).Info("Batch summary email sent")
+	}
+	return err
+}
+
+func batchSummary(batch types.Batch, deactivated, failed []string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        batch.Name,
+		"endTime":     formatExpiry(batch.EndTime),
+		"deactivated": deactivated,
+		"failed":      failed,
+	}
+}
+
+// formatExpiry formats the expiry of a temporary grant for emails
+func formatExpiry(expiresAt time.Time) string {
+	return expiresAt.UTC().Format("January 2, 2006 15:04 MST")
+}
+
+// sendApplicantMail sends an email to the applicant in the language the request was submitted in. Nothing is
+// sent to addresses emails bounced from. Each email is sent once per status of the request unless forced, see
+// claimEmail
+func (worker *Worker) sendApplicantMail(whitelistRequest types.WhitelistRequest, template string, templateData map[string]string, subject string, force bool) error {
+	// Imported and erased requests have no email of the player to send to
+	if types.PlaceholderEmail(whitelistRequest.Email) {
+		worker.logger.WithFields(logrus.Fields{
+			"username": whitelistRequest.Username,
+		}).Info("Skipped email to the player of an imported or erased request")
+		return nil
+	}
+	// Emails resent by admins are sent again on purpose
+	if !force && !worker.claimEmail(whitelistRequest, template) {
+		worker.logger.WithFields(logrus.Fields{
+			"username": whitelistRequest.Username,
+			"template": template,
+		}).Info("Email has already been sent. Skipping")
+		return nil
+	}
+	err := worker.deliverApplicantMail(whitelistRequest, template, templateData, subject)
+	if err != nil && !force {
+		worker.releaseEmail(whitelistRequest, template)
+	}
+	return err
+}
+
+func (worker *Worker) deliverApplicantMail(whitelistRequest types.WhitelistRequest, template string, templateData map[string]string, subject string) error {
+	template = requestTemplate(whitelistRequest, template, whitelistRequest.Locale)
+	if !whitelistRequest.Canary && worker.emailSuppressed(whitelistRequest) {
+		worker.logger.WithFields(logrus.Fields{
+			"username": whitelistRequest.Username,
+			"template": template,
+		}).Warning("Skipped email to an address emails bounced from")
+		return nil
+	}
+	// Emails about canary requests go to the canary mailbox
+	if whitelistRequest.Canary || worker.sendTrackedMail == nil {
+		return worker.sendRequestMail(whitelistRequest, template, templateData, subject, whitelistRequest.Email)
+	}
+	messageID, err := worker.sendTrackedMail(template, templateData, subject, whitelistRequest.Email)
+	if err != nil {
+		return err
+	}
+	worker.recordMessageID(whitelistRequest, messageID)
+	return nil
+}
+
+// emailToOps sends action emails to the given ops and returns the ops who received the
+// email successfully and the ops whose email failed to send
+func (worker *Worker) emailToOps(whitelistRequest types.WhitelistRequest, ops []string) ([]string, []string, error) {
 	subject := "[Action Required] Whitelist request from " + whitelistRequest.Username
-	successCount := 0
-	requestIDToken, err := utils.EncodeAndEncrypt(whitelistRequest.ID.Hex(), viper.GetString("passphrase"))
+	templateData := map[string]interface{}{"answers": answersTemplateData(whitelistRequest)}
+	// Context for reviewing the request, e.g if it comes from the network of a banned player
+	if whitelistRequest.NetworkSignals != nil {
+		templateData["networkSignals"] = whitelistRequest.NetworkSignals.Summary()
+	}
+	if referral := referralTemplateData(whitelistRequest); referral != "" {
+		templateData["referral"] = referral
+	}
+	if links := worker.attachmentsTemplateData(whitelistRequest); len(links) > 0 {
+		templateData["attachments"] = links
+	}
+	if whitelistRequest.SubmissionCountry != "" {
+		templateData["country"] = whitelistRequest.SubmissionCountry
+	}
+	if whitelistRequest.PreviousRequestID != "" {
+		subject = "[Action Required] Resubmitted whitelist request from " + whitelistRequest.Username
+		for key, value := range resubmissionTemplateData(whitelistRequest, worker.previousRequest(whitelistRequest)) {
+			templateData[key] = value
+		}
+	}
+	return worker.emailActionLinks(whitelistRequest, ops, types.OpEventRequest, "./mailer/templates/ops.html", subject, templateData)
+}
+
+// previousRequest returns the denied request the request resubmits, or nil if it can not be read. Best effort only
+func (worker *Worker) previousRequest(request types.WhitelistRequest) *types.WhitelistRequest {
+	id, err := primitive.ObjectIDFromHex(request.PreviousRequestID)
+	if err != nil {
+		return nil
+	}
+	previousRequest, err := worker.store.GetRequest(id)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":         request.ID.Hex(),
+			"previousID": request.PreviousRequestID,
+		}).Warning("Unable to read previous request of resubmission")
+		return nil
+	}
+	return &previousRequest
+}
+
+// resubmissionTemplateData tells ops in the action email how often the request was submitted and why it was
+// denied before, so they have its history
+func resubmissionTemplateData(request types.WhitelistRequest, previousRequest *types.WhitelistRequest) map[string]string {
+	data := map[string]string{"attempt": strconv.Itoa(request.Attempt)}
+	if previousRequest != nil {
+		data["previousUsername"] = previousRequest.Username
+		data["previousReason"] = mailer.SanitizeReason(previousRequest.DecisionReason)
+	}
+	return data
+}
+
+// answersTemplateData lists the answers to the custom fields of the application form as label and value, for the
+// emails to ops
+func answersTemplateData(request types.WhitelistRequest) []map[string]string {
+	answers := make([]map[string]string, 0, len(request.Answers))
+	for _, answer := range request.Answers {
+		answers = append(answers, map[string]string{"label": answer.Label, "value": answer.Value})
+	}
+	return answers
+}
+
+// emailActionLinks sends each op the template with a link to the action page of the request
+// only valid for that op, and returns the ops who received the email and the ops whose email failed to send.
+// Ops are notified about the event through the channels of their profile, ops who muted it are neither
+func (worker *Worker) emailActionLinks(whitelistRequest types.WhitelistRequest, ops []string, event, template, subject string, templateData map[string]interface{}) ([]string, []string, error) {
+	log := worker.logger
+	requestIDToken, err := utils.SignToken(whitelistRequest.ID.Hex(), utils.PurposeAction, ActionLinkTTL())
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err": err,
 		}).Error("Failed to encode requestID Token")
-		return 0, err
+		return nil, nil, err
+	}
+	builder, err := worker.linksOf(requestTenant(whitelistRequest))
+	if err != nil {
+		return nil, nil, err
 	}
-	// ops who received the action emails successfully will be added to the assignees
-	// and attach as the metadata for the request db object
-	assignees := []string{}
-	// Get target ops to send action emails according to the configured dispatching strategy
-	ops := worker.getTargetOps()
+	profiles := worker.profilesByOp()
+	notifiedOps := []string{}
+	failedOps := []string{}
 	for _, op := range ops {
-		opEmailToken, err := utils.EncodeAndEncrypt(op, viper.GetString("passphrase"))
+		opToken, err := worker.actionToken(whitelistRequest, op)
 		if err != nil {
+			// Retried like a failed email
 			log.WithFields(logrus.Fields{
-				"err": err,
-			}).Error("Failed to encode opEmail Token")
-			return 0, err
+				"recipent": op,
+				"err":      err,
+				"ID":       whitelistRequest.ID.Hex(),
+			}).Error("Failed to issue action token of op")
+			failedOps = append(failedOps, op)
+			continue
 		}
-		opLink := os.Getenv("FRONTEND_DEPLOYED_URL") + "action/" + requestIDToken + "?adm=" + opEmailToken
-		err = mailer.Send("./mailer/templates/ops.html", map[string]string{"link": opLink}, subject, op)
-		if err != nil {
+		link := builder.ActionLink(requestIDToken, opToken)
+		data := map[string]interface{}{"link": link}
+		for key, value := range templateData {
+			data[key] = value
+		}
+		notified, err := worker.notifyOp(profiles, event, op, func() error {
+			return worker.sendRequestMail(whitelistRequest, requestTemplate(whitelistRequest, template, opsLocale(op)), data, subject, op)
+		}, func() string {
+			return subject + "\n" + link
+		})
+		if !notified {
+			continue
+		} else if err != nil {
 			log.WithFields(logrus.Fields{
 				"recipent": op,
 				"err":      err,
 				"ID":       whitelistRequest.ID.Hex(),
 			}).Error("Failed to send email to op")
+			failedOps = append(failedOps, op)
 		} else {
 			log.WithFields(logrus.Fields{
 				"recipent": op,
 				"ID":       whitelistRequest.ID.Hex(),
 			}).Info("Action email sent to op")
-			assignees = append(assignees, op)
-			successCount++
+			notifiedOps = append(notifiedOps, op)
 		}
 	}
-	// Attach assignee info to the db request object to keep track of each request
-	if len(assignees) > 0 {
-		requestedChange := make(bson.M)
-		requestedChange["assignees"] = assignees
-		_, err := worker.dbService.UpdateRequest(bson.D{{"_id", whitelistRequest.ID}}, bson.M{
-			"$set": requestedChange,
-		})
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"err":       err,
-				"assignees": assignees,
-				"ID":        whitelistRequest.ID.Hex(),
-			}).Error("Unable to update request db object with assignees metadata")
-		}
+	return notifiedOps, failedOps, nil
+}
+
+// linksOf returns the builder of the links to the frontend of the tenant. Builders are made on startup, so an
+// invalid frontendURL stops the worker before any email is sent
+func (worker *Worker) linksOf(cfg tenant.Config) (*links.Builder, error) {
+	if b, ok := worker.linkBuilders[cfg.ID]; ok {
+		return b, nil
+	}
+	return links.ForTenant(cfg)
+}
+
+// requestTemplate resolves the template of an email about the request for the tenant and the locale
+func requestTemplate(request types.WhitelistRequest, template, locale string) string {
+	return mailer.ResolveTemplate(tenantTemplate(requestTenant(request), template), locale)
+}
+
+// ops who received the action emails successfully will be added to the assignees
+// and attach as the metadata for the request db object
+func (worker *Worker) addAssignees(whitelistRequest types.WhitelistRequest, assignees []string) {
+	if len(assignees) == 0 {
+		return
 	}
-	if successCount >= quoram {
-		return successCount, nil
+	// Record when each op was sent the request, so the response time of the op can be told once decided.
+	// Assignees from previous attempts are kept. Requests removed in the meantime, e.g a timed out canary
+	// request, are not found
+	err := worker.store.AddAssignees(whitelistRequest.ID, assignees, time.Now())
+	if err != nil && err != db.ErrNotFound {
+		worker.logger.WithFields(logrus.Fields{
+			"err":       err,
+			"assignees": assignees,
+			"ID":        whitelistRequest.ID.Hex(),
+		}).Error("Unable to update request db object with assignees metadata")
+	}
+}
+
+// On retries only the ops who failed to receive the action email are targeted
+func (worker *Worker) targetOpsForAttempt(cfg tenant.Config, headers amqp.Table) []string {
+	if failedOps := headerStrings(headers, failedOpsHeader); failedOps != nil {
+		return failedOps
 	}
-	return successCount, errors.New("Success count does not reach minimum requirement")
+	return worker.getTargetOps(cfg)
 }
 
-func (worker *Worker) getTargetOps() []string {
-	// Strategy: Broadcast / Random with threshold
-	ops := viper.GetStringSlice("ops")
-	if viper.GetString("dispatchingStrategy") == "Broadcast" {
+func (worker *Worker) getTargetOps(cfg tenant.Config) []string {
+	// Strategy: Broadcast / Random / RoundRobin / LeastAssigned with threshold
+	// applied to the ops of the tenant available at the moment and not away
+	profiles := worker.profilesByOp()
+	configuredOps, err := profileOps(profiles, cfg)
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Invalid ops configuration")
+		return []string{}
+	}
+	now := time.Now()
+	ops := presentOps(availableOps(configuredOps, now), worker.awayOps(now))
+	// Ops who opted into the digest get new requests with it
+	if !digestMode() {
+		ops = withoutDigestOps(ops, profiles)
+	}
+	strategy := cfg.GetString("dispatchingStrategy")
+	if strategy == "Broadcast" || len(ops) == 0 {
 		return ops
 	}
-	n := viper.GetInt("randomDispatchingThreshold")
+	n := cfg.GetInt("randomDispatchingThreshold")
+	// Clamp the threshold to the number of available ops
+	if n > len(ops) || n <= 0 {
+		n = len(ops)
+	}
+	switch strategy {
+	case "RoundRobin":
+		cursor, err := worker.cache.IncrDispatchCursor(cfg.ID, n)
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warning("Unable to get round robin cursor. Fall back to random dispatching")
+			break
+		}
+		return roundRobinOps(ops, cursor-int64(n), n)
+	case "LeastAssigned":
+		assignments, err := worker.store.CountAssignments(db.RequestFilter{
+			Statuses: []string{types.StatusPending},
+			Tenants:  []string{cfg.ID},
+		})
+		if err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warning("Unable to count pending assignments. Fall back to random dispatching")
+			break
+		}
+		return leastAssignedOps(ops, assignments, n)
+	}
 	// Choose random n out of all ops as the target request handlers
 	rand.Seed(time.Now().UnixNano())
 	rand.Shuffle(len(ops), func(i, j int) { ops[i], ops[j] = ops[j], ops[i] })
 	return ops[:n]
 }
 
-// issue  command againest a user on the game server with retries
-func (worker *Worker) issueRCON(command string) error {
-	_, err := worker.rconClient.SendCommand(command)
+// roundRobinOps picks n ops starting from the cursor position, wrapping around the ops list
+func roundRobinOps(ops []string, cursor int64, n int) []string {
+	targets := make([]string, 0, n)
+	start := int(cursor % int64(len(ops)))
+	if start < 0 {
+		start += len(ops)
+	}
+	for i := 0; i < n; i++ {
+		targets = append(targets, ops[(start+i)%len(ops)])
+	}
+	return targets
+}
 
+// leastAssignedOps picks n ops with the fewest pending assignments.
+// Ties are broken by the order of ops in the configuration
+func leastAssignedOps(ops []string, assignments map[string]int, n int) []string {
+	sort.SliceStable(ops, func(i, j int) bool {
+		return assignments[ops[i]] < assignments[ops[j]]
+	})
+	return ops[:n]
+}
+
+// issue  command againest the game server with retries and return the server response
+func (worker *Worker) issueRCON(command string) (string, error) {
+	return worker.issueTenantRCON(tenant.Default, command)
+}
+
+// issueTenantRCON issues the command against the game server of the tenant. Commands give up after
+// rconTimeoutSeconds and fail with errCircuitOpen without being issued while the circuit of the game server is open
+func (worker *Worker) issueTenantRCON(cfg tenant.Config, command string) (string, error) {
+	executor, err := worker.executorFor(cfg)
 	if err != nil {
-		return err
+		metrics.RCONFailed(command)
+		return "", err
+	}
+	breaker := worker.breakerFor(cfg)
+	probe, err := breaker.allow()
+	if err != nil {
+		return "", err
+	}
+	lock := worker.rconLockFor(cfg)
+	lock.Lock()
+	defer lock.Unlock()
+	if probe {
+		_, err = sendCommand(executor, probeCommand, rconTimeout())
+		if err != nil {
+			breaker.failed()
+			worker.logger.WithFields(logrus.Fields{
+				"server": breaker.server,
+				"err":    err.Error(),
+			}).Debug("Game server still unavailable. Circuit stays open")
+			return "", errCircuitOpen
+		}
+		if breaker.succeeded() {
+			worker.logger.WithField("server", breaker.server).Info("Game server recovered. Circuit closed")
+		}
 	}
+	response, err := sendCommand(executor, command, rconTimeout())
+
+	if err != nil {
+		metrics.RCONFailed(command)
+		// Game servers only managed through the proxy plugin are not unavailable
+		if err != errNoRCON && breaker.failed() {
+			worker.logger.WithFields(logrus.Fields{
+				"server":   breaker.server,
+				"err":      err.Error(),
+				"cooldown": rconBreakerCooldown().String(),
+			}).Error("Circuit open. Game server failed repeatedly, commands are retried later without being issued")
+		}
+		return "", err
+	}
+	breaker.succeeded()
 	worker.logger.WithFields(logrus.Fields{
-		"command": command,
+		"command":  command,
+		"response": response,
 	}).Info("Command has been issued successfully on the game server")
-	return nil
+	return response, nil
 }
-func deserialize(b []byte) (types.WhitelistRequest, error) {
-	var msg types.WhitelistRequest
-	buf := bytes.NewBuffer(b)
-	decoder := json.NewDecoder(buf)
-	err := decoder.Decode(&msg)
-	return msg, err
+
+// deserialize decodes the request task of a message of any known schema version and returns the version it was
+// published in, see types.DecodeRequestMessage
+func deserialize(b []byte) (types.WhitelistRequest, int, error) {
+	return types.DecodeRequestMessage(b)
 }
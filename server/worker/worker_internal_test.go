@@ -0,0 +1,4518 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/mailer"
+	"github.com/tywin1104/mc-gatekeeper/proxy"
+	"github.com/tywin1104/mc-gatekeeper/telegram"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/topology"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"github.com/tywin1104/mc-gatekeeper/webhook"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Emails of ops and applicants link to the frontend
+func init() {
+	viper.SetDefault("frontendURL", "https://whitelist.example.com")
+}
+
+func TestRetryOnlyEmailsFailedOps(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	viper.Set("ops", []interface{}{"op1@gmail.com", "op2@gmail.com", "op3@gmail.com"})
+	viper.Set("minRequiredReceiver", 3)
+	viper.Set("dispatchingStrategy", "Broadcast")
+	defer viper.Set("ops", nil)
+	defer viper.Set("minRequiredReceiver", nil)
+	defer viper.Set("dispatchingStrategy", nil)
+	failing := map[string]bool{"op2@gmail.com": true, "op3@gmail.com": true}
+	var sent []string
+	store := db.NewMemoryStore()
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	ledger := &fakeLedger{processed: make(map[string]bool)}
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			sent = append(sent, recipent)
+			if failing[recipent] {
+				return errors.New("smtp unavailable")
+			}
+			return nil
+		},
+		store:          store,
+		cache:          &fakeSharedState{},
+		requestCache:   &fakeRequestCache{banned: make(map[string]bool)},
+		processedTasks: ledger,
+		sentEmails:     make(fakeEmailLedger),
+		publisher:      newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:       topology.FromConfig(),
+	}
+	id, err := store.CreateRequest(types.WhitelistRequest{Username: "Steve", Email: "steve@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _ := store.GetRequest(id)
+	body, _ := json.Marshal(request)
+
+	// First attempt with quorum 3: the applicant is told and two out of three ops fail
+	acknowledger := &recordingAcknowledger{}
+	w.processNewRequest(context.Background(), amqp.Delivery{Acknowledger: acknowledger, Body: body}, request)
+	if strings.Join(sent, ";") != "steve@gmail.com;op1@gmail.com;op2@gmail.com;op3@gmail.com" {
+		t.Fatalf("Expected the confirmation and the action emails, got %v", sent)
+	}
+	// The retry publication carries the failed ops in its headers
+	if acknowledger.acks != 1 || len(channel.headers) != 1 || ledger.processed[requestTaskKey(request)] {
+		t.Fatalf("Expected the task to be retried, got %d acks and %v", acknowledger.acks, channel.headers)
+	}
+	retry := channel.headers[0]
+	if failedOps := headerStrings(retry, failedOpsHeader); strings.Join(failedOps, ";") != "op2@gmail.com;op3@gmail.com" ||
+		headerInt(retry, notifiedCountHeader) != 1 {
+		t.Errorf("Expected the retry to carry the failed ops, got %v", retry)
+	}
+
+	// The retry only emails the failed ops, and not the applicant again
+	sent = nil
+	failing = map[string]bool{}
+	acknowledger = &recordingAcknowledger{}
+	w.processNewRequest(context.Background(), amqp.Delivery{Acknowledger: acknowledger, Body: []byte(channel.published[0]), Headers: retry}, request)
+	if strings.Join(sent, ";") != "op2@gmail.com;op3@gmail.com" {
+		t.Errorf("retry should only email the failed ops, got %v", sent)
+	}
+	// The quorum of 3 is reached after the retry
+	if acknowledger.acks != 1 || len(channel.headers) != 1 || !ledger.processed[requestTaskKey(request)] {
+		t.Errorf("Expected the task to be completed, got %d acks and %d retries", acknowledger.acks, len(channel.headers))
+	}
+	if request, _ = store.GetRequest(id); len(request.Assignees) != 3 {
+		t.Errorf("Expected the three ops to be assigned, got %v", request.Assignees)
+	}
+}
+
+func TestConsoleAuditEntry(t *testing.T) {
+	task := types.ConsoleTask{
+		ID:      primitive.NewObjectID(),
+		Command: "whitelist reload",
+		Actor:   "owner",
+	}
+	entry := consoleAuditEntry(task, "Reloaded the whitelist", nil)
+	if entry.Action != "console.command" || entry.Actor != "owner" {
+		t.Errorf("Unexpected audit entry %+v", entry)
+	}
+	if entry.Details["command"] != "whitelist reload" ||
+		entry.Details["response"] != "Reloaded the whitelist" ||
+		entry.Details["taskID"] != task.ID.Hex() {
+		t.Errorf("Unexpected audit entry details %v", entry.Details)
+	}
+	if _, ok := entry.Details["error"]; ok {
+		t.Error("Successful command should not record an error")
+	}
+	content, _ := entry.SignedContent()
+	if !utils.VerifyAudit(content, entry.Signature, utils.PassphraseSecrets()) {
+		t.Error("Expected the audit entry to be signed")
+	}
+	entry.Details["command"] = "op Steve"
+	content, _ = entry.SignedContent()
+	if utils.VerifyAudit(content, entry.Signature, utils.PassphraseSecrets()) {
+		t.Error("Expected the signature not to verify for an edited command")
+	}
+
+	entry = consoleAuditEntry(task, "", errors.New("Game server is down"))
+	if entry.Details["error"] != "Game server is down" {
+		t.Errorf("Failed command should record the error, got %v", entry.Details)
+	}
+}
+
+func TestRoundRobinOps(t *testing.T) {
+	ops := []string{"op1", "op2", "op3"}
+	// Successive requests with threshold 2 rotate through the list and wrap around
+	first := roundRobinOps(ops, 0, 2)
+	second := roundRobinOps(ops, 2, 2)
+	third := roundRobinOps(ops, 4, 2)
+	if first[0] != "op1" || first[1] != "op2" {
+		t.Errorf("unexpected first targets %v", first)
+	}
+	if second[0] != "op3" || second[1] != "op1" {
+		t.Errorf("unexpected second targets %v", second)
+	}
+	if third[0] != "op2" || third[1] != "op3" {
+		t.Errorf("unexpected third targets %v", third)
+	}
+}
+
+func TestLeastAssignedOps(t *testing.T) {
+	ops := []string{"op1", "op2", "op3"}
+	targets := leastAssignedOps(ops, map[string]int{"op1": 2, "op2": 1, "op3": 1}, 2)
+	// op2 and op3 both have one pending assignment, op1 has two
+	if len(targets) != 2 || targets[0] != "op2" || targets[1] != "op3" {
+		t.Errorf("unexpected targets %v", targets)
+	}
+}
+
+func TestParseOpsWithAvailability(t *testing.T) {
+	viper.Set("ops", []interface{}{
+		"op1@gmail.com",
+		map[interface{}]interface{}{
+			"email": "alice@gmail.com",
+			"availability": []interface{}{
+				map[interface{}]interface{}{"start": "00:00", "end": "12:00"},
+			},
+		},
+		map[interface{}]interface{}{
+			"email": "bob@gmail.com",
+			"availability": []interface{}{
+				map[interface{}]interface{}{"start": "12:00", "end": "24:00"},
+			},
+		},
+	})
+	defer viper.Set("ops", nil)
+	ops, err := ParseOps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 3 || ops[1].Email != "alice@gmail.com" || len(ops[1].Availability) != 1 {
+		t.Fatalf("unexpected ops %+v", ops)
+	}
+	morning := time.Date(2019, 11, 1, 8, 30, 0, 0, time.UTC)
+	evening := time.Date(2019, 11, 1, 20, 0, 0, 0, time.UTC)
+	if got := availableOps(ops, morning); len(got) != 2 || got[1] != "alice@gmail.com" {
+		t.Errorf("expect op1 and alice in the morning, got %v", got)
+	}
+	if got := availableOps(ops, evening); len(got) != 2 || got[1] != "bob@gmail.com" {
+		t.Errorf("expect op1 and bob in the evening, got %v", got)
+	}
+}
+
+func TestAvailabilityWindowWrapsMidnight(t *testing.T) {
+	op := Op{Email: "night@gmail.com", Availability: []AvailabilityWindow{{Start: 22 * time.Hour, End: 6 * time.Hour}}}
+	if !op.IsAvailable(time.Date(2019, 11, 1, 23, 0, 0, 0, time.UTC)) || !op.IsAvailable(time.Date(2019, 11, 1, 5, 59, 0, 0, time.UTC)) {
+		t.Error("expect op to be available during the night")
+	}
+	if op.IsAvailable(time.Date(2019, 11, 1, 6, 0, 0, 0, time.UTC)) {
+		t.Error("window end should be exclusive")
+	}
+}
+
+func TestNoAvailableOpFallsBackToBroadcast(t *testing.T) {
+	ops := []Op{
+		{Email: "alice@gmail.com", Availability: []AvailabilityWindow{{Start: 0, End: time.Hour}}},
+		{Email: "bob@gmail.com", Availability: []AvailabilityWindow{{Start: time.Hour, End: 2 * time.Hour}}},
+	}
+	got := availableOps(ops, time.Date(2019, 11, 1, 12, 0, 0, 0, time.UTC))
+	if len(got) != 2 {
+		t.Errorf("expect all ops when no one is available, got %v", got)
+	}
+}
+
+func TestParseOpsInvalidWindow(t *testing.T) {
+	viper.Set("ops", []interface{}{
+		map[interface{}]interface{}{
+			"email":        "alice@gmail.com",
+			"availability": []interface{}{map[interface{}]interface{}{"start": "9am", "end": "12:00"}},
+		},
+	})
+	defer viper.Set("ops", nil)
+	if _, err := ParseOps(); err == nil {
+		t.Error("expect invalid time to be rejected")
+	}
+}
+
+func TestBatchSummaryTemplate(t *testing.T) {
+	batch := types.Batch{Name: "build competition", EndTime: time.Date(2019, 11, 10, 0, 0, 0, 0, time.UTC)}
+	tmpl, err := template.ParseFiles("../mailer/templates/batch_summary.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, batchSummary(batch, []string{"guest1", "guest2"}, []string{"guest3"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := buf.String()
+	for _, expected := range []string{"build competition", "November 10, 2019 00:00 UTC", "2 member(s)", "guest1", "guest2", "removed manually", "guest3"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected batch summary to contain %q", expected)
+		}
+	}
+
+	buf.Reset()
+	err = tmpl.Execute(&buf, batchSummary(batch, []string{"guest1"}, []string{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "removed manually") {
+		t.Error("Expected no failed members section when all members are deactivated")
+	}
+}
+
+func TestResubmissionHistoryInOpsEmail(t *testing.T) {
+	tmpl, err := template.ParseFiles("../mailer/templates/ops.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "usre1", Status: types.StatusDenied, DecisionReason: "<i>Username</i> does not exist"}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "user1", PreviousRequestID: previous.ID.Hex(), Attempt: 2}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, resubmissionTemplateData(request, &previous))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"attempt 2", "usre1", "Username does not exist"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected the ops email to contain %q", expected)
+		}
+	}
+
+	// The attempt is still shown if the previous request can not be read
+	buf.Reset()
+	err = tmpl.Execute(&buf, resubmissionTemplateData(request, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "attempt 2") || strings.Contains(buf.String(), "denied with the reason") {
+		t.Error("Expected only the attempt without previous request")
+	}
+	buf.Reset()
+	err = tmpl.Execute(&buf, map[string]string{"link": "http://localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "resubmitted") {
+		t.Error("Expected no history for first submissions")
+	}
+}
+
+func TestNoOpsConfigured(t *testing.T) {
+	defer viper.Set("ops", nil)
+	viper.Set("ops", []interface{}{})
+	if !NoOpsConfigured(tenant.Default) {
+		t.Error("Expected empty ops list to be detected")
+	}
+	viper.Set("ops", nil)
+	if !NoOpsConfigured(tenant.Default) {
+		t.Error("Expected missing ops list to be detected")
+	}
+	viper.Set("ops", []interface{}{"op1@gmail.com"})
+	if NoOpsConfigured(tenant.Default) {
+		t.Error("Expected configured ops to be detected")
+	}
+	// Invalid ops are reported by the config validation instead
+	viper.Set("ops", []interface{}{42})
+	if NoOpsConfigured(tenant.Default) {
+		t.Error("Expected invalid ops not to be treated as empty")
+	}
+}
+
+func TestValidateQuorum(t *testing.T) {
+	defer viper.Set("ops", nil)
+	defer viper.Set("minRequiredReceiver", nil)
+	viper.Set("minRequiredReceiver", 1)
+	viper.Set("ops", []interface{}{})
+	if err := ValidateQuorum(); err == nil {
+		t.Error("Expected the worker to refuse to start without ops")
+	}
+	viper.Set("ops", []interface{}{"op1@gmail.com", "op2@gmail.com"})
+	if err := ValidateQuorum(); err != nil {
+		t.Errorf("Expected the quorum to be reachable, got %v", err)
+	}
+	viper.Set("minRequiredReceiver", 3)
+	if err := ValidateQuorum(); err == nil {
+		t.Error("Expected the worker to refuse to start with minRequiredReceiver higher than the number of ops")
+	}
+}
+
+func TestFallbackApprover(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	viper.Set("ops", []interface{}{"op1@gmail.com", "op2@gmail.com"})
+	viper.Set("minRequiredReceiver", 2)
+	viper.Set("maxRetries", 1)
+	defer viper.Set("ops", nil)
+	defer viper.Set("minRequiredReceiver", nil)
+	defer viper.Set("maxRetries", nil)
+	defer viper.Set("fallbackApprover", nil)
+	fallbackDown := false
+	var sent []string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			sent = append(sent, recipent)
+			if recipent == "fallback@gmail.com" && !fallbackDown {
+				return nil
+			}
+			return errors.New("smtp unavailable")
+		},
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Status: types.StatusPending}
+
+	// Without a fallback approver the last attempt is put to the dead letter queue
+	body, _ := json.Marshal(request)
+	headers := amqp.Table{
+		types.SkipConfirmationHeader: true,
+		retryCountHeader:             int32(1),
+		failedOpsHeader:              toTableArray([]string{"op1@gmail.com", "op2@gmail.com"}),
+	}
+	acknowledger := &recordingAcknowledger{}
+	w.processNewRequest(context.Background(), amqp.Delivery{Acknowledger: acknowledger, Body: body, Headers: headers}, request)
+	if acknowledger.nacks != 1 || len(sent) != 2 {
+		t.Fatalf("Expected the task to be dead lettered after emailing the ops, got %d nacks and emails to %v", acknowledger.nacks, sent)
+	}
+
+	// Once configured, one email sent to the fallback approver satisfies the quorum
+	viper.Set("fallbackApprover", "fallback@gmail.com")
+	if fallback := w.emailFallbackApprover(request); len(fallback) != 1 || fallback[0] != "fallback@gmail.com" {
+		t.Errorf("Expected the fallback approver to be notified, got %v", fallback)
+	}
+
+	// The task is dead lettered if the fallback approver can not be emailed either
+	fallbackDown = true
+	sent = nil
+	acknowledger = &recordingAcknowledger{}
+	w.processNewRequest(context.Background(), amqp.Delivery{Acknowledger: acknowledger, Body: body, Headers: headers}, request)
+	if acknowledger.nacks != 1 || len(sent) != 3 || sent[2] != "fallback@gmail.com" {
+		t.Errorf("Expected the fallback approver to be tried before dead lettering the task, got %d nacks and emails to %v", acknowledger.nacks, sent)
+	}
+}
+
+func TestLivenessWhileReconnecting(t *testing.T) {
+	w := &Worker{logger: logrus.New().WithField("origin", "worker")}
+	svc := w.HealthService()
+	if result := svc.Live(); result.Status == "ok" {
+		t.Errorf("Expected liveness to fail without a message queue connection, got %+v", result)
+	}
+	// The worker is re-establishing the connection by itself so it is still alive
+	w.reconnecting = 1
+	if result := svc.Live(); result.Status != "ok" {
+		t.Errorf("Expected liveness to pass while reconnecting, got %+v", result)
+	}
+}
+
+// countingAcknowledger counts acknowledged deliveries
+type countingAcknowledger struct {
+	acks int32
+}
+
+func (a *countingAcknowledger) Ack(tag uint64, multiple bool) error {
+	atomic.AddInt32(&a.acks, 1)
+	return nil
+}
+
+func (a *countingAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error { return nil }
+
+func (a *countingAcknowledger) Reject(tag uint64, requeue bool) error { return nil }
+
+func TestLanesKeepPerUsernameOrder(t *testing.T) {
+	const users, messages = 20, 500
+	type message struct {
+		Username string `json:"username"`
+		Sequence int    `json:"sequence"`
+	}
+	acknowledger := &countingAcknowledger{}
+	var mu sync.Mutex
+	lastSequence := make(map[string]int)
+	processed := 0
+	var inFlight, maxInFlight int32
+	process := func(d amqp.Delivery) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+		var m message
+		if err := json.Unmarshal(d.Body, &m); err != nil {
+			t.Error(err)
+			return
+		}
+		time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+		mu.Lock()
+		player := strings.ToLower(m.Username)
+		if last, ok := lastSequence[player]; ok && m.Sequence <= last {
+			t.Errorf("%s: message %d processed after %d", m.Username, m.Sequence, last)
+		}
+		lastSequence[player] = m.Sequence
+		processed++
+		mu.Unlock()
+		d.Ack(false)
+	}
+
+	// Not a power of two, the lane of a key hashed modulo a power of two does not depend on its case
+	l := newLanes(7, messages, process)
+	for i := 0; i < messages; i++ {
+		// Mixed case usernames of the same player share a lane. Every other message of a player is lower case
+		username := fmt.Sprintf("User%d", i%users)
+		if (i/users)%2 == 0 {
+			username = strings.ToLower(username)
+		}
+		body, _ := json.Marshal(message{Username: username, Sequence: i})
+		d := amqp.Delivery{Acknowledger: acknowledger, Body: body}
+		l.dispatch(laneKey(d), d)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&acknowledger.acks) < messages && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	l.drain()
+
+	if acks := atomic.LoadInt32(&acknowledger.acks); acks != messages {
+		t.Fatalf("expected %d acks, got %d", messages, acks)
+	}
+	if processed != messages {
+		t.Fatalf("expected %d processed messages, got %d", messages, processed)
+	}
+	if maxInFlight < 2 {
+		t.Fatalf("expected messages to be processed concurrently, at most %d were in flight", maxInFlight)
+	}
+	if len(lastSequence) != users {
+		t.Fatalf("expected the messages of %d players, got %d", users, len(lastSequence))
+	}
+}
+
+// fakeLedger is an in-memory taskLedger. Every call fails with err if set, e.g redis being down
+type fakeLedger struct {
+	processed map[string]bool
+	err       error
+}
+
+func (l *fakeLedger) IsTaskProcessed(key string) (bool, error) {
+	return l.processed[key], l.err
+}
+
+func (l *fakeLedger) MarkTaskProcessed(key string, ttl time.Duration) error {
+	if l.err != nil {
+		return l.err
+	}
+	l.processed[key] = true
+	return nil
+}
+
+// fakeEmailLedger records the emails claimed as sent
+type fakeEmailLedger map[string]bool
+
+func (l fakeEmailLedger) ClaimEmail(key string, ttl time.Duration) (bool, error) {
+	if l[key] {
+		return false, nil
+	}
+	l[key] = true
+	return true, nil
+}
+
+func (l fakeEmailLedger) ReleaseEmail(key string) error {
+	delete(l, key)
+	return nil
+}
+
+// fakeMessageLedger records the message IDs seen
+type fakeMessageLedger map[string]bool
+
+func (l fakeMessageLedger) ClaimMessageID(id string, ttl time.Duration) (bool, error) {
+	if l[id] {
+		return false, nil
+	}
+	l[id] = true
+	return true, nil
+}
+
+func TestRedeliveredTaskDoesNotEmailTwice(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	executor := &fakeRCON{}
+	ledger := &fakeLedger{processed: make(map[string]bool)}
+	smtpDown := false
+	var sent []string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			if smtpDown {
+				return errors.New("smtp unavailable")
+			}
+			sent = append(sent, filepath.Base(templateName))
+			return nil
+		},
+		executor:          executor,
+		requestCache:      &fakeRequestCache{banned: make(map[string]bool)},
+		processedRequests: make(fakeProcessed),
+		processedTasks:    ledger,
+		sentEmails:        make(fakeEmailLedger),
+		appliedSequences:  &fakeSequences{},
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Email: "steve@gmail.com", Status: types.StatusApproved}
+	body, _ := json.Marshal(request)
+	w.process(amqp.Delivery{Acknowledger: &recordingAcknowledger{}, Body: body})
+	// The worker stopped before recording the task as completed. RabbitMQ redelivers it without our headers
+	delete(ledger.processed, requestTaskKey(request))
+	w.process(amqp.Delivery{Acknowledger: &recordingAcknowledger{}, Body: body, Redelivered: true})
+	if len(executor.commands) != 2 {
+		t.Errorf("Expected the idempotent whitelisting to be repeated, got %v", executor.commands)
+	}
+	if strings.Join(sent, ";") != "approve.html" {
+		t.Errorf("Expected the decision email to be sent once, got %v", sent)
+	}
+
+	// A decision email which failed to send is sent by the retry
+	sent = nil
+	denial := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Alex", Email: "alex@gmail.com", Status: types.StatusDenied}
+	smtpDown = true
+	if err := w.emailDecision(denial, false); err == nil {
+		t.Fatal("Expected the email to fail")
+	}
+	smtpDown = false
+	w.emailDecision(denial, false)
+	w.emailDecision(denial, false)
+	if strings.Join(sent, ";") != "deny.html" {
+		t.Errorf("Expected the failed decision email to be sent once by the retry, got %v", sent)
+	}
+
+	// Admins resend emails on purpose
+	sent = nil
+	for _, email := range []string{types.EmailConfirmation, types.EmailDecision} {
+		w.emailConfirmation(request, false)
+		resend, _ := json.Marshal(types.ResendTask{ID: primitive.NewObjectID(), Request: request, Email: email, Actor: "admin"})
+		w.processResendTask(context.Background(), amqp.Delivery{Acknowledger: &recordingAcknowledger{}, Body: resend})
+	}
+	if strings.Join(sent, ";") != "confirmation.html;confirmation.html;approve.html" {
+		t.Errorf("Expected the resent emails to be sent again, got %v", sent)
+	}
+}
+
+func TestRedeliveredProcessedTaskIsSkipped(t *testing.T) {
+	sent := 0
+	ledger := &fakeLedger{processed: make(map[string]bool)}
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			sent++
+			return nil
+		},
+		processedTasks: ledger,
+	}
+	request := types.WhitelistRequest{
+		ID:                   primitive.NewObjectID(),
+		Username:             "user1",
+		Status:               types.StatusDenied,
+		LastUpdatedTimestamp: time.Now(),
+	}
+	body, _ := json.Marshal(request)
+	// The first delivery completed but its ack got lost with the connection
+	acknowledger := &countingAcknowledger{}
+	w.completeTask(amqp.Delivery{Acknowledger: acknowledger}, requestTaskKey(request))
+	if !ledger.processed[requestTaskKey(request)] {
+		t.Fatal("expected completed task to be recorded")
+	}
+
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body, Redelivered: true})
+	if sent != 0 {
+		t.Fatalf("expected no decision email for redelivered task, got %d", sent)
+	}
+	if acknowledger.acks != 2 {
+		t.Fatalf("expected redelivered task to be acked, got %d acks", acknowledger.acks)
+	}
+
+	// Setting the same status again later is a new task
+	request.LastUpdatedTimestamp = request.LastUpdatedTimestamp.Add(time.Minute)
+	if w.taskProcessed(amqp.Delivery{}, requestTaskKey(request)) {
+		t.Fatal("expected task of a later update not to be processed")
+	}
+}
+
+func TestTaskLedgerUnavailable(t *testing.T) {
+	ledger := &fakeLedger{processed: make(map[string]bool), err: errors.New("connection refused")}
+	w := &Worker{
+		logger:         logrus.New().WithField("origin", "worker"),
+		processedTasks: ledger,
+	}
+	key := consoleTaskKey(types.ConsoleTask{ID: primitive.NewObjectID()})
+	ledger.processed[key] = true
+	// Best effort: the task is processed rather than refused
+	if w.taskProcessed(amqp.Delivery{Redelivered: true}, key) {
+		t.Fatal("expected task to be processed while the ledger is unavailable")
+	}
+	acknowledger := &countingAcknowledger{}
+	w.completeTask(amqp.Delivery{Acknowledger: acknowledger}, key)
+	if acknowledger.acks != 1 {
+		t.Fatalf("expected task to be acked while the ledger is unavailable, got %d acks", acknowledger.acks)
+	}
+}
+
+func TestReviewTargets(t *testing.T) {
+	defer viper.Set("ops", nil)
+	defer viper.Set("provisionalReviewAllOps", nil)
+	viper.Set("ops", []interface{}{"op1@gmail.com", "op2@gmail.com"})
+	w := &Worker{logger: logrus.NewEntry(logrus.New())}
+
+	targets, err := w.reviewTargets(types.WhitelistRequest{Admin: "op2@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0] != "op2@gmail.com" {
+		t.Fatalf("expected the approving op to review, got %v", targets)
+	}
+	// The approving op is no longer an op
+	targets, _ = w.reviewTargets(types.WhitelistRequest{Admin: "op3@gmail.com"})
+	if len(targets) != 2 {
+		t.Fatalf("expected all ops to review, got %v", targets)
+	}
+	viper.Set("provisionalReviewAllOps", true)
+	targets, _ = w.reviewTargets(types.WhitelistRequest{Admin: "op2@gmail.com"})
+	if len(targets) != 2 {
+		t.Fatalf("expected all ops to review, got %v", targets)
+	}
+}
+
+// fakeCanaryPipeline keeps the canary request in memory. The worker stages are simulated
+// unless the pipeline is broken
+type fakeCanaryPipeline struct {
+	mu      sync.Mutex
+	request types.WhitelistRequest
+	broken  bool
+	removed bool
+}
+
+func (p *fakeCanaryPipeline) submit(request types.WhitelistRequest) (primitive.ObjectID, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	request.ID = primitive.NewObjectID()
+	request.Status = types.StatusPending
+	if !p.broken {
+		request.Assignees = []string{canaryOp}
+	}
+	p.request = request
+	return request.ID, nil
+}
+
+func (p *fakeCanaryPipeline) approve(request types.WhitelistRequest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.request.Status = types.StatusApproved
+	completed := time.Now()
+	p.request.CanaryCompletedTimestamp = &completed
+	return nil
+}
+
+func (p *fakeCanaryPipeline) get(id primitive.ObjectID) (types.WhitelistRequest, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.request, nil
+}
+
+func (p *fakeCanaryPipeline) remove(id primitive.ObjectID) error {
+	p.removed = true
+	return nil
+}
+
+func TestCanary(t *testing.T) {
+	defer viper.Set("ownerEmail", nil)
+	viper.Set("ownerEmail", "owner@gmail.com")
+	var alerts []string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			alerts = append(alerts, recipent)
+			return nil
+		},
+	}
+
+	pipeline := &fakeCanaryPipeline{}
+	if err := w.checkCanary(pipeline, time.Second, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if !pipeline.request.Canary || !pipeline.removed || len(alerts) != 0 {
+		t.Fatalf("expected the canary request to complete and be removed without alert, got %+v", pipeline)
+	}
+
+	// Nobody picks up the canary request
+	pipeline = &fakeCanaryPipeline{broken: true}
+	err := w.checkCanary(pipeline, 20*time.Millisecond, time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "not dispatched") {
+		t.Fatalf("expected the canary request not to be dispatched, got %v", err)
+	}
+	if len(alerts) != 1 || alerts[0] != "owner@gmail.com" {
+		t.Fatalf("expected the owner to be alerted, got %v", alerts)
+	}
+	if !pipeline.removed {
+		t.Fatal("expected the failed canary request to be removed")
+	}
+}
+
+func TestCanarySideEffects(t *testing.T) {
+	defer viper.Set("canaryEmail", nil)
+	var recipents []string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			recipents = append(recipents, recipent)
+			return nil
+		},
+	}
+	canary := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "canary_1", Email: "canary_1@canary.invalid", Canary: true}
+	if gameCommand(canary, "whitelist add canary_1") != canaryCommand {
+		t.Error("expected canary requests to run a harmless command")
+	}
+	// Without a canary mailbox emails are not sent
+	w.emailConfirmation(canary, false)
+	if len(recipents) != 0 {
+		t.Fatalf("expected no email without canary mailbox, got %v", recipents)
+	}
+	viper.Set("canaryEmail", "canary@gmail.com")
+	w.emailToOps(canary, []string{canaryOp})
+	if len(recipents) != 1 || recipents[0] != "canary@gmail.com" {
+		t.Fatalf("expected emails to go to the canary mailbox, got %v", recipents)
+	}
+}
+
+// fakePublishChannel records publications. The test plays the message queue on the confirms and returns channels
+type fakePublishChannel struct {
+	published []amqp.Publishing
+	mandatory bool
+}
+
+func (c *fakePublishChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.published = append(c.published, msg)
+	c.mandatory = mandatory
+	return nil
+}
+
+// requeueAcknowledger records how the delivery was settled
+type requeueAcknowledger struct {
+	acked    bool
+	requeued bool
+}
+
+func (a *requeueAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *requeueAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.requeued = requeue
+	return nil
+}
+
+func (a *requeueAcknowledger) Reject(tag uint64, requeue bool) error { return nil }
+
+func TestPublisherConfirms(t *testing.T) {
+	channel := &fakePublishChannel{}
+	confirms := make(chan amqp.Confirmation, 1)
+	returns := make(chan amqp.Return, 1)
+	p := newPublisher(channel, confirms, returns, time.Second)
+
+	done := make(chan error)
+	go func() { done <- p.publish("retry.ex", "", amqp.Publishing{Body: []byte("1")}) }()
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	if err := <-done; err != nil {
+		t.Fatalf("expected confirmed publication, got %s", err)
+	}
+	if !channel.mandatory {
+		t.Error("expected publications to be mandatory")
+	}
+
+	go func() { done <- p.publish("retry.ex", "", amqp.Publishing{Body: []byte("2")}) }()
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	if err := <-done; err == nil {
+		t.Fatal("expected nacked publication to fail")
+	}
+
+	// An unroutable message is returned before it is confirmed
+	go func() { done <- p.publish("retry.ex", "", amqp.Publishing{Body: []byte("3")}) }()
+	for {
+		p.mu.Lock()
+		published := len(p.pending)
+		p.mu.Unlock()
+		if published == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	returns <- amqp.Return{MessageId: channel.published[2].MessageId, Exchange: "retry.ex", ReplyText: "NO_ROUTE"}
+	confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: true}
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "NO_ROUTE") {
+		t.Fatalf("expected returned publication to fail, got %v", err)
+	}
+
+	// Pending publications fail once the channel is closed
+	go func() { done <- p.publish("retry.ex", "", amqp.Publishing{Body: []byte("4")}) }()
+	close(confirms)
+	if err := <-done; err != errChannelClosed {
+		t.Fatalf("expected publication to fail with the channel, got %v", err)
+	}
+}
+
+func TestRetryRequeuedIfNotConfirmed(t *testing.T) {
+	// The message queue never confirms the republication
+	w := &Worker{
+		logger:    logrus.New().WithField("origin", "worker"),
+		publisher: newPublisher(&fakePublishChannel{}, make(chan amqp.Confirmation), make(chan amqp.Return), 20*time.Millisecond),
+	}
+	acknowledger := &requeueAcknowledger{}
+	w.retryMsgWithDelay(amqp.Delivery{Acknowledger: acknowledger, Body: []byte("{}")}, "Whitelist user1 on the game server", errors.New("connection refused"), nil)
+	if acknowledger.acked || !acknowledger.requeued {
+		t.Fatalf("expected the original delivery to be requeued instead of acked, got %+v", acknowledger)
+	}
+}
+
+func TestDecisionEmailReason(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	var templates []string
+	var data []map[string]string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			templates = append(templates, templateName)
+			data = append(data, templateData.(map[string]string))
+			return nil
+		},
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "user1", Email: "user1@gmail.com"}
+
+	request.Status = types.StatusDenied
+	request.DecisionReason = "<b>Griefed</b> at spawn"
+	request.Note = "Caught by op2"
+	w.emailDecision(request, false)
+	request.Status = types.StatusBanned
+	w.emailDecision(request, false)
+	request.Status = types.StatusApproved
+	request.DecisionReason = ""
+	w.emailDecision(request, false)
+
+	expected := []string{"deny.html", "ban.html", "approve.html"}
+	for i, name := range templates {
+		if filepath.Base(name) != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], name)
+		}
+	}
+	if data[0]["reason"] != "Griefed at spawn" || data[1]["reason"] != "Griefed at spawn" {
+		t.Errorf("Expected the sanitized reason to be passed to the template, got %v", data)
+	}
+	if _, ok := data[2]["reason"]; ok {
+		t.Errorf("Expected no reason without decision reason, got %v", data[2])
+	}
+	for _, d := range data {
+		if _, ok := d["note"]; ok {
+			t.Errorf("The note of the op must not be passed to applicant emails, got %v", d)
+		}
+	}
+}
+
+func TestApprovalEmailExpiry(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	var data []map[string]string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			data = append(data, templateData.(map[string]string))
+			return nil
+		},
+	}
+	expiresAt := time.Date(2019, 11, 10, 18, 30, 0, 0, time.UTC)
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "user1", Email: "user1@gmail.com", Status: types.StatusApproved}
+	w.emailDecision(request, false)
+	request.ExpiresAt = &expiresAt
+	w.emailDecision(request, false)
+	if len(data) != 2 {
+		t.Fatalf("Expected 2 approval emails, got %d", len(data))
+	}
+	if _, ok := data[0]["expiresAt"]; ok {
+		t.Errorf("Expected no expiry for permanent grants, got %v", data[0])
+	}
+	if data[1]["expiresAt"] != formatExpiry(expiresAt) {
+		t.Errorf("Expected the expiry of the temporary grant, got %v", data[1])
+	}
+
+	tmpl, err := template.ParseFiles("../mailer/templates/approve.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, temporary := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data[i]); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), "temporary membership") != temporary ||
+			strings.Contains(buf.String(), formatExpiry(expiresAt)) != temporary {
+			t.Errorf("Expected the approval email to tell about the expiry only for temporary grants: %v", temporary)
+		}
+	}
+}
+
+func TestDeactivateExpiredGrants(t *testing.T) {
+	store := db.NewMemoryStore()
+	w := &Worker{logger: logrus.New().WithField("origin", "worker"), store: store}
+	approve := func(username string, expiresAt *time.Time) primitive.ObjectID {
+		id, err := store.CreateRequest(types.WhitelistRequest{Username: username, ExpiresAt: expiresAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.TransitionStatus(id, db.StatusChange{From: types.StatusPending, To: types.StatusApproved, At: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	expired := time.Now().Add(-time.Minute)
+	later := time.Now().Add(time.Hour)
+	steve := approve("Steve", &expired)
+	alex := approve("Alex", &later)
+	notch := approve("Notch", nil)
+
+	// Run twice, the second run finds nothing left to deactivate
+	for i := 0; i < 2; i++ {
+		if err := w.deactivateExpiredGrants(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, status := range map[primitive.ObjectID]string{steve: types.StatusDeactivated, alex: types.StatusApproved, notch: types.StatusApproved} {
+		request, _ := store.GetRequest(id)
+		if request.Status != status {
+			t.Errorf("Expected %s to be %s, got %s", request.Username, status, request.Status)
+		}
+	}
+	// The task is handed over through the outbox like the changes of the API
+	outbox := store.Outbox()
+	if len(outbox) != 1 || outbox[0].RequestID != steve {
+		t.Fatalf("Expected one outbox entry for the expired grant, got %+v", outbox)
+	}
+	task, _, err := types.DecodeRequestMessage(outbox[0].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Status != types.StatusDeactivated || task.PreviousStatus != types.StatusApproved || !grantExpired(task) {
+		t.Errorf("Expected the deactivation task of the expired grant, got %+v", task)
+	}
+}
+
+func TestExpireStaleRequests(t *testing.T) {
+	viper.Set("pendingTTLHours", 24)
+	defer viper.Set("pendingTTLHours", nil)
+	store := db.NewMemoryStore()
+	requestCache := &countingCache{}
+	var sent []string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		store:  store,
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			sent = append(sent, filepath.Base(templateName)+" "+recipent)
+			return nil
+		},
+		requestCache: requestCache,
+		sentEmails:   make(fakeEmailLedger),
+	}
+	create := func(username string) primitive.ObjectID {
+		id, err := store.CreateRequest(types.WhitelistRequest{Username: username, Email: strings.ToLower(username) + "@gmail.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	steve := create("Steve")
+	alex := create("Alex")
+	notch := create("Notch")
+	if _, err := store.SetAwaitingOps(alex, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.TransitionStatus(notch, db.StatusChange{From: types.StatusPending, To: types.StatusApproved, At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not pending for long enough yet
+	if err := w.expireStaleRequests(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if request, _ := store.GetRequest(steve); request.Status != types.StatusPending {
+		t.Errorf("Expected the fresh request to stay pending, got %s", request.Status)
+	}
+
+	// Run twice, the second run finds nothing left to expire
+	later := time.Now().Add(25 * time.Hour)
+	for i := 0; i < 2; i++ {
+		if err := w.expireStaleRequests(later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, status := range map[primitive.ObjectID]string{steve: types.StatusExpired, alex: types.StatusPending, notch: types.StatusApproved} {
+		request, _ := store.GetRequest(id)
+		if request.Status != status {
+			t.Errorf("Expected %s to be %s, got %s", request.Username, status, request.Status)
+		}
+	}
+	if strings.Join(sent, ";") != "expired.html steve@gmail.com" {
+		t.Errorf("Expected the applicant to be told once, got %v", sent)
+	}
+	if requestCache.statsUpdates != 1 || requestCache.stats.Expired != 1 || requestCache.stats.Pending != -1 {
+		t.Errorf("Expected the expiration to be counted once, got %d updates of %+v", requestCache.statsUpdates, requestCache.stats)
+	}
+}
+
+func TestOpsLocaleIndependentOfApplicantLocale(t *testing.T) {
+	// Template paths are relative to the server directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	viper.Set("passphrase", "passphrase")
+	defer viper.Set("opsLocale", nil)
+	defer viper.Set("ops", nil)
+
+	bodies := make(map[string]string)
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			tmpl, err := template.ParseFiles(templateName)
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			err = tmpl.Execute(&buf, templateData)
+			bodies[recipent] = buf.String()
+			return err
+		},
+	}
+	opsEmail := "There is a new whitelist application that waits for processing"
+	opsEmailZh := "有一份新的白名单申请等待您的处理"
+	confirmation := "We've received your application to join our server"
+	confirmationZh := "我们已经收到您加入服务器的申请"
+
+	viper.Set("opsLocale", "zh-CN")
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "user1", Email: "user1@gmail.com", Locale: "en-US"}
+	_, _, err = w.emailToOps(request, []string{"op1@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.emailConfirmation(request, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bodies["op1@gmail.com"], opsEmailZh) {
+		t.Errorf("Expected the ops email in zh-CN, got %s", bodies["op1@gmail.com"])
+	}
+	if !strings.Contains(bodies["user1@gmail.com"], confirmation) {
+		t.Errorf("Expected the applicant email in en-US, got %s", bodies["user1@gmail.com"])
+	}
+
+	// The locale of an op overrides opsLocale
+	viper.Set("ops", []interface{}{
+		map[interface{}]interface{}{"email": "op1@gmail.com", "locale": "en-US"},
+	})
+	request.Locale = "zh-CN"
+	_, _, err = w.emailToOps(request, []string{"op1@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.emailConfirmation(request, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bodies["op1@gmail.com"], opsEmail) {
+		t.Errorf("Expected the ops email in en-US, got %s", bodies["op1@gmail.com"])
+	}
+	if !strings.Contains(bodies["user1@gmail.com"], confirmationZh) {
+		t.Errorf("Expected the applicant email in zh-CN, got %s", bodies["user1@gmail.com"])
+	}
+}
+
+func TestParseOpsInvalidLocale(t *testing.T) {
+	viper.Set("ops", []interface{}{
+		map[interface{}]interface{}{"email": "alice@gmail.com", "locale": "xx"},
+	})
+	defer viper.Set("ops", nil)
+	if _, err := ParseOps(); err == nil {
+		t.Error("expect unsupported locale to be rejected")
+	}
+}
+
+func TestParseWhitelist(t *testing.T) {
+	tests := []struct {
+		response string
+		expected string
+	}{
+		{"There are 3 whitelisted players: Steve, Alex, Notch", "[Steve Alex Notch]"},
+		{"There are 2 (out of 5 seen) whitelisted players:\nSteve, Alex", "[Steve Alex]"},
+		{"There are 2 whitelisted players: Steve and Alex", "[Steve Alex]"},
+		{"There are no whitelisted players", "[]"},
+	}
+	for _, test := range tests {
+		usernames, err := parseWhitelist(test.response)
+		if err != nil || fmt.Sprint(usernames) != test.expected {
+			t.Errorf("Expected %s for %q, got %v %v", test.expected, test.response, usernames, err)
+		}
+	}
+	// A truncated response must not be mistaken for players missing from the whitelist
+	for _, response := range []string{"There are 3 whitelisted players: Steve, Alex", "Unknown command"} {
+		if _, err := parseWhitelist(response); err == nil {
+			t.Errorf("Expected error for %q", response)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	viper.Set("reconcileIgnore", []string{"owner"})
+	defer viper.Set("reconcileIgnore", nil)
+	var commands []string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		executor: CommandFunc(func(command string) (string, error) {
+			commands = append(commands, command)
+			if command == "whitelist add alex" {
+				return "", errors.New("connection refused")
+			}
+			return "There are 3 whitelisted players: Owner, steve, Griefer", nil
+		}),
+	}
+	var entries []types.AuditEntry
+	audit := func(entry types.AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}
+	approved := []types.WhitelistRequest{{Username: "Steve"}, {Username: "alex"}}
+
+	report, err := w.reconcile(approved, true, audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(report.NotApproved) != "[Griefer]" || fmt.Sprint(report.Missing) != "[alex]" {
+		t.Errorf("Unexpected discrepancies %+v", report)
+	}
+	if len(commands) != 1 || len(entries) != 0 {
+		t.Errorf("Expected a dry run to change nothing, got commands %v and audit entries %v", commands, entries)
+	}
+
+	commands = nil
+	report, err = w.reconcile(approved, false, audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(commands) != "[whitelist list whitelist remove Griefer whitelist add alex]" {
+		t.Errorf("Unexpected commands %v", commands)
+	}
+	if fmt.Sprint(report.Fixed) != "[Griefer]" || fmt.Sprint(report.Failed) != "[alex]" {
+		t.Errorf("Unexpected fixes %+v", report)
+	}
+	if len(entries) != 2 || entries[0].Action != "whitelist.reconcile" || entries[0].Details["discrepancy"] != discrepancyNotApproved ||
+		entries[1].Details["error"] != "connection refused" {
+		t.Errorf("Expected every fix to be audited, got %+v", entries)
+	}
+}
+
+func TestParseOnlinePlayers(t *testing.T) {
+	tests := []struct {
+		response string
+		expected string
+	}{
+		{"There are 2 of a max of 20 players online: Steve, Alex", "[Steve Alex]"},
+		{"There are 2/20 players online:\nSteve, Alex", "[Steve Alex]"},
+		{"There are 0 of a max of 20 players online:", "[]"},
+	}
+	for _, test := range tests {
+		usernames, err := parseOnlinePlayers(test.response)
+		if err != nil || fmt.Sprint(usernames) != test.expected {
+			t.Errorf("Expected %s for %q, got %v %v", test.expected, test.response, usernames, err)
+		}
+	}
+	for _, response := range []string{"There are 3 of a max of 20 players online: Steve, Alex", "Unknown command"} {
+		if _, err := parseOnlinePlayers(response); err == nil {
+			t.Errorf("Expected error for %q", response)
+		}
+	}
+}
+
+func TestFollowUpOf(t *testing.T) {
+	now := time.Now()
+	joinedAt := now.Add(-time.Hour)
+	tests := []struct {
+		bounced, joined, tracked bool
+		reasons, actions         string
+	}{
+		{bounced: false, joined: true, tracked: true},
+		{bounced: false, joined: false, tracked: false},
+		{bounced: true, joined: true, tracked: true, reasons: "[emailBounced]", actions: "[resendEmail]"},
+		{bounced: true, joined: false, tracked: false, reasons: "[emailBounced]", actions: "[resendEmail]"},
+		{bounced: false, joined: false, tracked: true, reasons: "[neverJoined]", actions: "[reachOut deactivate]"},
+		{bounced: true, joined: false, tracked: true, reasons: "[emailBounced neverJoined]", actions: "[resendEmail reachOut deactivate]"},
+	}
+	for _, test := range tests {
+		request := types.WhitelistRequest{Status: types.StatusApproved, EmailUndeliverable: test.bounced}
+		if test.joined {
+			request.FirstJoinedAt = &joinedAt
+		}
+		followUp := followUpOf(request, test.tracked, now)
+		if test.reasons == "" {
+			if followUp != nil {
+				t.Errorf("Expected no follow-up for %+v, got %+v", test, followUp)
+			}
+			continue
+		}
+		if followUp == nil || fmt.Sprint(followUp.Reasons) != test.reasons || fmt.Sprint(followUp.SuggestedActions) != test.actions ||
+			!followUp.FlaggedAt.Equal(now) {
+			t.Errorf("Expected follow-up %s %s for %+v, got %+v", test.reasons, test.actions, test, followUp)
+		}
+	}
+	// Flagged again for another reason, the player stays flagged since the first time
+	flaggedAt := now.Add(-24 * time.Hour)
+	request := types.WhitelistRequest{EmailUndeliverable: true, FollowUp: &types.FollowUp{Reasons: []string{types.FollowUpNeverJoined}, FlaggedAt: flaggedAt}}
+	if followUp := followUpOf(request, true, now); !followUp.FlaggedAt.Equal(flaggedAt) || sameFollowUp(request.FollowUp, followUp) {
+		t.Errorf("Expected the follow-up to be updated since the first flag, got %+v", followUp)
+	}
+}
+
+func TestFlagFollowUps(t *testing.T) {
+	viper.Set("followUpAfterDays", 7)
+	viper.Set("joinTrackingIntervalMinutes", 5)
+	viper.Set("ops", []string{"op1@gmail.com"})
+	defer viper.Set("followUpAfterDays", nil)
+	defer viper.Set("joinTrackingIntervalMinutes", nil)
+	defer viper.Set("ops", nil)
+	now := time.Now()
+	store := db.NewMemoryStore()
+	reports := make(map[string][]string)
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		store:  store,
+		executor: CommandFunc(func(command string) (string, error) {
+			return "There are 2 of a max of 20 players online: steve, Herobrine", nil
+		}),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			if filepath.Base(templateName) != "followup.html" {
+				t.Errorf("Unexpected follow-up email %s %q", templateName, subject)
+			}
+			reports[recipent] = templateData.(map[string]interface{})["requests"].([]string)
+			return nil
+		},
+	}
+	approve := func(username string, bounced bool, approvedAt time.Time) primitive.ObjectID {
+		request := types.WhitelistRequest{Username: username, EmailUndeliverable: bounced}
+		if bounced {
+			request.EmailBounceReason = "mailbox does not exist"
+		}
+		id, err := store.CreateRequest(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.TransitionStatus(id, db.StatusChange{From: types.StatusPending, To: types.StatusApproved, At: approvedAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	longAgo := now.AddDate(0, 0, -10)
+	steve := approve("Steve", false, longAgo)
+	alex := approve("Alex", false, longAgo)
+	notch := approve("Notch", true, longAgo)
+	jeb := approve("Jeb", true, now.AddDate(0, 0, -1))
+	if err := w.trackJoins(now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run twice, the second run changes nothing
+	for i := 0; i < 2; i++ {
+		if err := w.flagFollowUps(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[primitive.ObjectID]string{steve: "", alex: "[neverJoined]", notch: "[emailBounced neverJoined]", jeb: ""}
+	for id, reasons := range expected {
+		request, _ := store.GetRequest(id)
+		if reasons == "" && request.FollowUp != nil || reasons != "" && (request.FollowUp == nil || fmt.Sprint(request.FollowUp.Reasons) != reasons) {
+			t.Errorf("Expected follow-up %q of %s, got %+v", reasons, request.Username, request.FollowUp)
+		}
+	}
+
+	if err := w.sendFollowUpReports(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports["op1@gmail.com"]) != 2 || !strings.Contains(strings.Join(reports["op1@gmail.com"], "\n"),
+		"Notch, approved "+formatExpiry(longAgo)+": email bounced (mailbox does not exist), never joined. Suggested: resendEmail, reachOut, deactivate") {
+		t.Errorf("Expected the report of the flagged players, got %v", reports["op1@gmail.com"])
+	}
+
+	// Flags are cleared once players join, and dismissed ones are kept
+	alexRequest, _ := store.GetRequest(alex)
+	dismissed := *alexRequest.FollowUp
+	dismissed.DismissedAt = &now
+	if err := store.SetFollowUp(alex, &dismissed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RecordFirstJoins("", []string{"Alex", "Notch"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.flagFollowUps(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if request, _ := store.GetRequest(alex); request.FollowUp == nil || request.FollowUp.DismissedAt == nil {
+		t.Errorf("Expected the dismissed follow-up to be kept, got %+v", request.FollowUp)
+	}
+	if request, _ := store.GetRequest(notch); request.FollowUp == nil || fmt.Sprint(request.FollowUp.Reasons) != "[emailBounced]" ||
+		!request.FollowUp.FlaggedAt.Equal(now) {
+		t.Errorf("Expected only the bounce left since the first flag, got %+v", request.FollowUp)
+	}
+}
+
+func TestRunActionCommandTemplates(t *testing.T) {
+	viper.Set("approveCommand", []interface{}{"ewl add {{.Username}}", "lp user {{.UUID}} parent add member"})
+	viper.Set("banCommand", "ban {{.Username}} Banned by the ops")
+	defer viper.Set("approveCommand", nil)
+	defer viper.Set("banCommand", nil)
+	var commands []string
+	failing := ""
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		executor: CommandFunc(func(command string) (string, error) {
+			commands = append(commands, command)
+			if command == failing {
+				return "", errors.New("connection refused")
+			}
+			return "", nil
+		}),
+	}
+	request := types.WhitelistRequest{Username: "Steve", UUID: "8667ba71b85a4004af54457a9734eed7"}
+
+	if err := w.runAction(approveCommandKey, request); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(commands) != "[ewl add Steve lp user 8667ba71b85a4004af54457a9734eed7 parent add member]" {
+		t.Errorf("Expected the commands to be run in order, got %v", commands)
+	}
+	commands = nil
+	w.runAction(banCommandKey, request)
+	w.runAction(deactivateCommandKey, request)
+	w.runAction(unbanCommandKey, request)
+	if fmt.Sprint(commands) != "[ban Steve Banned by the ops whitelist remove Steve pardon Steve]" {
+		t.Errorf("Expected a single template and the vanilla defaults, got %v", commands)
+	}
+
+	// The action stops at the first failing command so it is retried as a whole
+	commands = nil
+	failing = "ewl add Steve"
+	if err := w.runAction(approveCommandKey, request); err == nil {
+		t.Error("Expected the action to fail")
+	}
+	if len(commands) != 1 {
+		t.Errorf("Expected the remaining commands to be skipped, got %v", commands)
+	}
+
+	// Canary requests run the harmless command for every command of the action
+	commands = nil
+	failing = ""
+	w.runAction(approveCommandKey, types.WhitelistRequest{Username: "canary_1", Canary: true})
+	if fmt.Sprint(commands) != "[list list]" {
+		t.Errorf("Expected canary requests to only run %q, got %v", canaryCommand, commands)
+	}
+}
+
+func TestRunActionBedrockCommands(t *testing.T) {
+	viper.Set("banCommand", "ban {{.Username}} Banned by the ops")
+	defer viper.Set("banCommand", nil)
+	var commands []string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		executor: CommandFunc(func(command string) (string, error) {
+			commands = append(commands, command)
+			return "", nil
+		}),
+	}
+	bedrock := types.WhitelistRequest{Username: ".Steve_Jobs", Platform: utils.PlatformBedrock}
+
+	// Floodgate's whitelist by default, bans fall back to the commands of Java players
+	for _, key := range []string{approveCommandKey, deactivateCommandKey, banCommandKey, unbanCommandKey} {
+		if err := w.runAction(key, bedrock); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+	}
+	expected := "[fwhitelist add Steve_Jobs fwhitelist remove Steve_Jobs ban .Steve_Jobs Banned by the ops pardon .Steve_Jobs]"
+	if fmt.Sprint(commands) != expected {
+		t.Errorf("Expected %v, got %v", expected, commands)
+	}
+
+	// Commands configured for Bedrock players with the prefix of the tenant. Java players keep theirs
+	viper.Set("bedrockUsernamePrefix", "*")
+	viper.Set("bedrockApproveCommand", "wl add {{.Gamertag}} {{.Platform}}")
+	defer viper.Set("bedrockUsernamePrefix", nil)
+	defer viper.Set("bedrockApproveCommand", nil)
+	commands = nil
+	w.runAction(approveCommandKey, types.WhitelistRequest{Username: "*Steve", Platform: utils.PlatformBedrock})
+	w.runAction(approveCommandKey, types.WhitelistRequest{Username: "Steve", Platform: utils.PlatformJava})
+	if fmt.Sprint(commands) != "[wl add Steve bedrock whitelist add Steve]" {
+		t.Errorf("Expected the Bedrock commands for Bedrock players only, got %v", commands)
+	}
+
+	// Usernames without the prefix of the tenant are never run
+	commands = nil
+	if err := w.runAction(approveCommandKey, bedrock); err != utils.ErrInvalidBedrockUsername || len(commands) != 0 {
+		t.Errorf("Expected invalid Bedrock username, got %v and %v", err, commands)
+	}
+}
+
+func TestValidateCommandTemplates(t *testing.T) {
+	if err := ValidateCommandTemplates(); err != nil {
+		t.Errorf("Expected the defaults to be valid, got %v", err)
+	}
+	defer viper.Set("deactivateCommand", nil)
+	for template, expected := range map[string]string{
+		"whitelist remove {{.Usernme}}": "deactivateCommand[0]",
+		"whitelist remove {{.Username}": "deactivateCommand[0]",
+		"{{if false}}x{{end}}":          "deactivateCommand[0] renders an empty command",
+	} {
+		viper.Set("deactivateCommand", template)
+		err := ValidateCommandTemplates()
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected an error about %s, got %v", template, expected, err)
+		}
+	}
+	viper.Set("deactivateCommand", nil)
+
+	// Bedrock commands are only validated for tenants accepting Bedrock players
+	viper.Set("bedrockDeactivateCommand", "fwhitelist remove {{.Gamertg}}")
+	defer viper.Set("bedrockDeactivateCommand", nil)
+	if err := ValidateCommandTemplates(); err != nil {
+		t.Errorf("Expected Bedrock commands to be ignored while Bedrock is disabled, got %v", err)
+	}
+	viper.Set("bedrockEnabled", true)
+	defer viper.Set("bedrockEnabled", nil)
+	if err := ValidateCommandTemplates(); err == nil || !strings.Contains(err.Error(), "bedrockDeactivateCommand[0]") {
+		t.Errorf("Expected an error about bedrockDeactivateCommand, got %v", err)
+	}
+}
+
+// fakeSequences is an in-memory sequenceLedger of a single request
+type fakeSequences struct {
+	applied int64
+	audited []types.AuditEntry
+}
+
+func (s *fakeSequences) ClaimSequence(id primitive.ObjectID, sequence int64) (bool, int64, error) {
+	if sequence < s.applied {
+		return false, s.applied, nil
+	}
+	s.applied = sequence
+	return true, sequence, nil
+}
+
+func (s *fakeSequences) CreateAuditEntry(entry types.AuditEntry) error {
+	s.audited = append(s.audited, entry)
+	return nil
+}
+
+func TestOutOfOrderTasksLastWriterWins(t *testing.T) {
+	id := primitive.NewObjectID()
+	now := time.Now()
+	task := func(status string, sequence int64) types.WhitelistRequest {
+		return types.WhitelistRequest{
+			ID:                   id,
+			Username:             "user1",
+			Status:               status,
+			Sequence:             sequence,
+			LastUpdatedTimestamp: now.Add(time.Duration(sequence) * time.Second),
+		}
+	}
+	// The op denies, changes their mind and approves, the approval is retried and the player is deactivated later
+	tasks := []types.WhitelistRequest{
+		task(types.StatusDenied, 1),
+		task(types.StatusApproved, 2),
+		task(types.StatusApproved, 2),
+		task(types.StatusDeactivated, 3),
+	}
+	for i := 0; i < 100; i++ {
+		sequences := &fakeSequences{}
+		w := &Worker{
+			logger:           logrus.New().WithField("origin", "worker"),
+			processedTasks:   &fakeLedger{processed: make(map[string]bool)},
+			appliedSequences: sequences,
+		}
+		acknowledger := &countingAcknowledger{}
+		finalStatus := ""
+		var lastApplied int64
+		skipped := 0
+		for _, j := range rand.Perm(len(tasks)) {
+			if w.claimSequence(amqp.Delivery{Acknowledger: acknowledger}, tasks[j]) {
+				if tasks[j].Sequence < lastApplied {
+					t.Fatalf("task %d applied after task %d", tasks[j].Sequence, lastApplied)
+				}
+				lastApplied = tasks[j].Sequence
+				finalStatus = tasks[j].Status
+			} else {
+				skipped++
+			}
+		}
+		if finalStatus != types.StatusDeactivated {
+			t.Fatalf("expected the task with the highest sequence to win, got %s", finalStatus)
+		}
+		if int(acknowledger.acks) != skipped || len(sequences.audited) != skipped {
+			t.Fatalf("expected %d stale tasks to be acked and audited, got %d acks and %d audit entries",
+				skipped, acknowledger.acks, len(sequences.audited))
+		}
+	}
+}
+
+func TestStaleTaskIsSkipped(t *testing.T) {
+	var commands []string
+	sequences := &fakeSequences{applied: 2}
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		executor: CommandFunc(func(command string) (string, error) {
+			commands = append(commands, command)
+			return "", nil
+		}),
+		processedTasks:   &fakeLedger{processed: make(map[string]bool)},
+		appliedSequences: sequences,
+	}
+	// The approval was queued before the deactivation that has already been applied
+	body, _ := json.Marshal(types.WhitelistRequest{
+		ID:       primitive.NewObjectID(),
+		Username: "user1",
+		Status:   types.StatusApproved,
+		Sequence: 1,
+	})
+	acknowledger := &countingAcknowledger{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body})
+	if len(commands) != 0 {
+		t.Fatalf("expected stale task not to run commands, got %v", commands)
+	}
+	if acknowledger.acks != 1 {
+		t.Fatalf("expected stale task to be acked, got %d acks", acknowledger.acks)
+	}
+	if len(sequences.audited) != 1 || sequences.audited[0].Action != "request.stale" ||
+		sequences.audited[0].Details["appliedSequence"] != int64(2) {
+		t.Fatalf("expected stale task to be noted in the audit log, got %+v", sequences.audited)
+	}
+}
+
+func TestBannedDenial(t *testing.T) {
+	store := db.NewMemoryStore()
+	id, _ := store.CreateRequest(types.WhitelistRequest{Username: "Steve", Email: "steve@gmail.com"})
+	now := time.Now()
+	denied, err := store.TransitionStatus(id, bannedDenial(now))
+	if err != nil || denied.Status != types.StatusDenied || denied.DecisionReason != bannedDenialReason || denied.Admin != workerActor {
+		t.Fatalf("expected request to be denied as previously banned, got %+v %v", denied, err)
+	}
+	if !denied.ProcessedTimestamp.Equal(now) || !denied.LastUpdatedTimestamp.Equal(now) {
+		t.Fatalf("expected request to be processed now, got %+v", denied)
+	}
+}
+
+func TestReapplyCooldown(t *testing.T) {
+	now := time.Now()
+	denial := types.WhitelistRequest{ID: primitive.NewObjectID(), Status: types.StatusDenied, Admin: "op1@gmail.com",
+		ProcessedTimestamp: now.Add(-2 * time.Hour)}
+	earlier := denial
+	earlier.ID = primitive.NewObjectID()
+	earlier.ProcessedTimestamp = now.Add(-10 * time.Hour)
+	// Denied by the worker, e.g with an invalid username or as previously banned
+	automatic := denial
+	automatic.Admin = workerActor
+	automatic.ProcessedTimestamp = now
+	expired := denial
+	expired.Status = types.StatusExpired
+	expired.ProcessedTimestamp = now
+	requests := []types.WhitelistRequest{earlier, automatic, expired, denial}
+
+	if _, _, ok := CooldownDenial(requests, now); ok {
+		t.Error("Expected no cooldown unless reapplyCooldownHours is set")
+	}
+	viper.Set("reapplyCooldownHours", 72)
+	defer viper.Set("reapplyCooldownHours", nil)
+	found, reapplyAfter, ok := CooldownDenial(requests, now)
+	if !ok || found.ID != denial.ID || !reapplyAfter.Equal(denial.ProcessedTimestamp.Add(72*time.Hour)) {
+		t.Errorf("Expected the cooldown of the latest denial of an op, got %v %v %v", found.ID, reapplyAfter, ok)
+	}
+	if _, _, ok := CooldownDenial(requests, now.Add(71*time.Hour)); ok {
+		t.Error("Expected the player to be allowed to apply once the cooldown ended")
+	}
+
+	// The denial email tells when the applicant may reapply
+	var sent map[string]string
+	w := &Worker{
+		logger: logrus.NewEntry(logrus.New()),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			sent = templateData.(map[string]string)
+			return nil
+		},
+	}
+	denial.Email = "steve@gmail.com"
+	w.emailDecision(denial, false)
+	if sent["reapplyAfter"] != formatExpiry(reapplyAfter) {
+		t.Errorf("Expected the denial email to tell when the applicant may reapply, got %v", sent)
+	}
+	w.emailDecision(automatic, false)
+	if _, ok := sent["reapplyAfter"]; ok {
+		t.Errorf("Expected no cooldown in the email of an automatic denial, got %v", sent)
+	}
+
+	// New requests of the player are discarded until then, resubmissions are limited by resubmissionLimit instead
+	store := db.NewMemoryStore()
+	w.store = store
+	w.requestCache = &fakeRequestCache{}
+	deniedID, _ := store.CreateRequest(types.WhitelistRequest{Username: "Steve", Email: "steve@gmail.com"})
+	store.TransitionStatus(deniedID, db.StatusChange{From: types.StatusPending, To: types.StatusDenied, At: now.Add(-time.Hour), Admin: "op1@gmail.com"})
+	newID, _ := store.CreateRequest(types.WhitelistRequest{Username: "steve", Email: "other@gmail.com"})
+	newRequest, _ := store.GetRequest(newID)
+	resubmission := newRequest
+	resubmission.PreviousRequestID = deniedID.Hex()
+	if w.rejectInCooldown(resubmission) {
+		t.Error("Expected resubmissions not to be rejected within the cooldown")
+	}
+	sent = nil
+	if !w.rejectInCooldown(newRequest) {
+		t.Fatal("Expected the request to be rejected within the cooldown")
+	}
+	if _, err := store.GetRequest(newID); err != db.ErrNotFound {
+		t.Errorf("Expected the rejected request to be discarded, got %v", err)
+	}
+	if sent["reapplyAfter"] != formatExpiry(now.Add(71*time.Hour)) || sent["link"] == "" {
+		t.Errorf("Expected the applicant to be told when they may reapply, got %v", sent)
+	}
+	viper.Set("reapplyCooldownHours", 1)
+	if w.rejectInCooldown(newRequest) {
+		t.Error("Expected the request to be accepted once the cooldown ended")
+	}
+}
+
+func TestWaitlist(t *testing.T) {
+	viper.Set("maxWhitelisted", 1)
+	defer viper.Set("maxWhitelisted", nil)
+	store := db.NewMemoryStore()
+	approve := func(username string) types.WhitelistRequest {
+		id, _ := store.CreateRequest(types.WhitelistRequest{Username: username, Email: username + "@gmail.com"})
+		approved, err := store.TransitionStatus(id, db.StatusChange{From: types.StatusPending, To: types.StatusApproved, At: time.Now(), Admin: "op1@gmail.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		return approved
+	}
+	alex, steve, notch := approve("Alex"), approve("Steve"), approve("Notch")
+	var sent []string
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	w := &Worker{
+		logger: logrus.NewEntry(logrus.New()),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			sent = append(sent, templateName)
+			return nil
+		},
+		store:          store,
+		requestCache:   &fakeRequestCache{},
+		processedTasks: &fakeLedger{processed: make(map[string]bool)},
+		publisher:      newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:       topology.FromConfig(),
+	}
+
+	// Approvals beyond the room on the game server are waitlisted without retrying
+	acknowledger := &recordingAcknowledger{}
+	d := amqp.Delivery{Acknowledger: acknowledger}
+	if !w.waitlistIfFull(d, steve) || !w.waitlistIfFull(d, notch) {
+		t.Fatal("Expected the approvals beyond maxWhitelisted to be waitlisted")
+	}
+	if steve, _ = store.GetRequest(steve.ID); steve.Status != types.StatusWaitlisted || acknowledger.acks != 2 {
+		t.Errorf("Expected the request to be waitlisted and its task completed, got %s and %d acks", steve.Status, acknowledger.acks)
+	}
+	if len(sent) != 2 || !strings.HasSuffix(sent[0], "waitlisted.html") {
+		t.Errorf("Expected the applicants to be told they are waitlisted, got %v", sent)
+	}
+	if w.waitlistIfFull(d, alex) {
+		t.Error("Expected the approval within maxWhitelisted to be carried out")
+	}
+	waitlisted, _ := store.QueryRequests(WaitlistedBefore(steve))
+	if len(waitlisted) != 1 {
+		t.Errorf("Expected the oldest waitlisted request to be first on the waitlist, got %d", len(waitlisted))
+	}
+
+	// Once a player is removed the oldest waitlisted request is approved again, only by the leader
+	if _, err := store.TransitionStatus(alex.ID, db.StatusChange{From: types.StatusApproved, To: types.StatusDeactivated, At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	lock := &fakeLeaderLock{holder: "other"}
+	w.leader = fakeLeader{lock: lock, instance: "worker"}
+	w.promoteAfterSlotFreed(alex)
+	if len(channel.published) != 0 {
+		t.Fatalf("Expected only the leader to promote waitlisted requests, got %v", channel.published)
+	}
+	lock.holder = "worker"
+	w.promoteAfterSlotFreed(alex)
+	if len(channel.published) != 1 || !strings.Contains(channel.published[0], steve.ID.Hex()) {
+		t.Fatalf("Expected the approval of the oldest waitlisted request to be published, got %v", channel.published)
+	}
+	steve, _ = store.GetRequest(steve.ID)
+	notch, _ = store.GetRequest(notch.ID)
+	if steve.Status != types.StatusApproved || steve.Admin != "op1@gmail.com" || notch.Status != types.StatusWaitlisted {
+		t.Errorf("Expected only the oldest waitlisted request to be promoted, got %s and %s", steve.Status, notch.Status)
+	}
+	if w.waitlistIfFull(d, steve) {
+		t.Error("Expected the promoted request to be whitelisted")
+	}
+	w.promoteAllWaitlisted()
+	if len(channel.published) != 1 {
+		t.Errorf("Expected no promotion while the game server is full, got %v", channel.published)
+	}
+}
+
+type fakeNonces map[string]time.Duration
+
+func (f fakeNonces) StoreActionNonce(nonce string, ttl time.Duration) error {
+	f[nonce] = ttl
+	return nil
+}
+
+func TestActionLinksAreSignedPerOp(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	viper.Set("actionLinkTTLHours", 48)
+	defer viper.Set("actionLinkTTLHours", nil)
+	links := make(map[string]string)
+	nonces := fakeNonces{}
+	w := &Worker{
+		logger:       logrus.New().WithField("origin", "worker"),
+		actionNonces: nonces,
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			links[recipent] = templateData.(map[string]interface{})["link"].(string)
+			return nil
+		},
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "user1"}
+	notifiedOps, _, err := w.emailToOps(request, []string{"op1@gmail.com", "op2@gmail.com"})
+	if err != nil || len(notifiedOps) != 2 {
+		t.Fatalf("Expected both ops to be notified, got %v %v", notifiedOps, err)
+	}
+	if len(nonces) != 2 {
+		t.Fatalf("Expected a nonce per op, got %v", nonces)
+	}
+	for op, link := range links {
+		token, err := utils.ParseActionToken(strings.SplitN(link, "?adm=", 2)[1], "passphrase", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Op != op || token.RequestID != request.ID.Hex() || nonces[token.Nonce] != 48*time.Hour {
+			t.Errorf("Unexpected token %+v of %s", token, op)
+		}
+		if _, err := utils.ParseActionToken(strings.SplitN(link, "?adm=", 2)[1], "passphrase", time.Now().Add(49*time.Hour)); err != utils.ErrTokenExpired {
+			t.Errorf("Expected the link to expire after 48 hours, got %v", err)
+		}
+	}
+}
+
+func TestResendTask(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	executor := &fakeRCON{}
+	ledger := &fakeLedger{processed: make(map[string]bool)}
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	failing := map[string]bool{"op2@gmail.com": true}
+	var sent []string
+	w := &Worker{
+		logger:       logrus.New().WithField("origin", "worker"),
+		actionNonces: fakeNonces{},
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			sent = append(sent, recipent+":"+filepath.Base(templateName))
+			if failing[recipent] {
+				return errors.New("smtp unavailable")
+			}
+			return nil
+		},
+		executor:       executor,
+		processedTasks: ledger,
+		publisher:      newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:       topology.FromConfig(),
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Email: "steve@gmail.com", Status: types.StatusDenied}
+	task := types.ResendTask{ID: primitive.NewObjectID(), Request: request, Email: types.EmailDecision, Actor: "admin"}
+	body, _ := json.Marshal(task)
+	acknowledger := &recordingAcknowledger{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body, Headers: amqp.Table{types.TaskTypeHeader: types.ResendTaskType}})
+	if strings.Join(sent, ",") != "steve@gmail.com:deny.html" || len(executor.commands) != 0 {
+		t.Errorf("Expected only the decision email to be sent again, got %v and commands %v", sent, executor.commands)
+	}
+	if acknowledger.acks != 1 || !ledger.processed[resendTaskKey(task)] {
+		t.Errorf("Expected the resend task to be completed")
+	}
+
+	// The action email is only retried for the op whose email failed
+	sent = nil
+	request.Status = types.StatusPending
+	task = types.ResendTask{ID: primitive.NewObjectID(), Request: request, Email: types.EmailOpsAction, Ops: []string{"op1@gmail.com", "op2@gmail.com"}}
+	body, _ = json.Marshal(task)
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body, Headers: amqp.Table{types.TaskTypeHeader: types.ResendTaskType}})
+	if len(sent) != 2 || len(channel.headers) != 1 || ledger.processed[resendTaskKey(task)] {
+		t.Fatalf("Expected the resend to be retried, got %v", sent)
+	}
+	sent = nil
+	failing = map[string]bool{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: []byte(channel.published[0]), Headers: channel.headers[0]})
+	if strings.Join(sent, ",") != "op2@gmail.com:ops.html" || !ledger.processed[resendTaskKey(task)] {
+		t.Errorf("Expected the action email to be resent to the failed op only, got %v", sent)
+	}
+}
+
+func TestCommentEmailedToOtherAssignees(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	defer viper.Set("commentNotification", nil)
+	viper.Set("commentNotification", "email")
+	executor := &fakeRCON{}
+	ledger := &fakeLedger{processed: make(map[string]bool)}
+	sent := make(map[string]map[string]interface{})
+	w := &Worker{
+		logger:       logrus.New().WithField("origin", "worker"),
+		actionNonces: fakeNonces{},
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			if filepath.Base(templateName) == "comment.html" {
+				sent[recipent] = templateData.(map[string]interface{})
+			}
+			return nil
+		},
+		executor:       executor,
+		processedTasks: ledger,
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Status: types.StatusPending,
+		Assignees: []string{"op1@gmail.com", "op2@gmail.com"}}
+	task := types.CommentTask{
+		Request: request,
+		Comment: types.Comment{ID: primitive.NewObjectID(), Author: "op1@gmail.com", Text: "My cousin, I vouch"},
+		Ops:     []string{"op2@gmail.com"},
+	}
+	body, _ := json.Marshal(task)
+	acknowledger := &recordingAcknowledger{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body, Headers: amqp.Table{types.TaskTypeHeader: types.CommentTaskType}})
+	data, ok := sent["op2@gmail.com"]
+	if len(sent) != 1 || !ok || data["comment"] != "My cousin, I vouch" || data["author"] != "op1@gmail.com" || data["link"] == nil {
+		t.Errorf("Expected only the other assignee to be emailed the comment with an action link, got %v", sent)
+	}
+	if len(executor.commands) != 0 || acknowledger.acks != 1 || !ledger.processed[commentTaskKey(task)] {
+		t.Errorf("Expected the comment task to be completed without running commands, got %v", executor.commands)
+	}
+}
+
+func TestCancellationEmailedToAssignees(t *testing.T) {
+	recipents := make(map[string]string)
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			recipents[recipent] = filepath.Base(templateName)
+			return nil
+		},
+	}
+	request := types.WhitelistRequest{
+		ID:        primitive.NewObjectID(),
+		Username:  "user1",
+		Email:     "user1@gmail.com",
+		Status:    types.StatusCancelled,
+		Assignees: []string{"op1@gmail.com", "op2@gmail.com"},
+	}
+	w.emailCancellation(request)
+	if len(recipents) != 2 || recipents["op1@gmail.com"] != "cancelled.html" || recipents["op2@gmail.com"] != "cancelled.html" {
+		t.Errorf("Expected the assigned ops to be told of the cancellation, got %v", recipents)
+	}
+	defer viper.Set("notifyOpsOnCancel", nil)
+	viper.Set("notifyOpsOnCancel", false)
+	if notifyOpsOnCancel() {
+		t.Error("Expected notifications on cancellation to be disabled")
+	}
+}
+
+func TestQueueAlertConditions(t *testing.T) {
+	defer viper.Set("queueDepthAlertThreshold", nil)
+	defer viper.Set("messageAgeAlertMinutes", nil)
+	names := topology.Names{TaskQueue: "task.queue", RetryQueue: "retry.queue", DeadLetterQueue: "dead.letter.queue"}
+	depths := map[string]int{"task.queue": 10, "retry.queue": 250, "dead.letter.queue": 500}
+	now := time.Now()
+	if alerts := queueAlerts(names, depths, 2*time.Hour, now); len(alerts) != 0 {
+		t.Errorf("Expected no alerts without thresholds, got %v", alerts)
+	}
+
+	viper.Set("queueDepthAlertThreshold", 100)
+	viper.Set("messageAgeAlertMinutes", 60)
+	alerts := queueAlerts(names, depths, 2*time.Hour, now)
+	if len(alerts) != 2 {
+		t.Fatalf("Expected the retry queue depth and the message age to be alerted, got %v", alerts)
+	}
+	for _, alert := range alerts {
+		switch alert.Condition {
+		case alertRetryQueueDepth:
+			if alert.Queue != "retry.queue" || alert.Value != 250 || alert.Threshold != 100 {
+				t.Errorf("Unexpected depth alert %+v", alert)
+			}
+		case alertMessageAge:
+			if alert.Value != 7200 || alert.Threshold != 3600 {
+				t.Errorf("Unexpected age alert %+v", alert)
+			}
+		default:
+			t.Errorf("Unexpected alert %+v", alert)
+		}
+	}
+}
+
+func TestQueueMonitor(t *testing.T) {
+	monitor := newQueueMonitor()
+	now := time.Now()
+	monitor.observe(amqp.Table{types.PublishedAtHeader: now.Add(-time.Hour).Unix()})
+	monitor.observe(amqp.Table{types.PublishedAtHeader: now.Add(-24 * time.Hour).Unix()})
+	// Tasks published before the header was set
+	monitor.observe(amqp.Table{})
+	if age := monitor.oldestAge(now); age < 24*time.Hour || age > 24*time.Hour+time.Second {
+		t.Errorf("Expected the oldest task to be a day old, got %v", age)
+	}
+	if age := monitor.oldestAge(now); age != 0 {
+		t.Errorf("Expected a new window after the check, got %v", age)
+	}
+
+	// One alert per condition per cooldown
+	if !monitor.allow(alertMessageAge, now, time.Hour) || !monitor.allow(alertRetryQueueDepth, now, time.Hour) {
+		t.Error("Expected the first alert of each condition to be sent")
+	}
+	if monitor.allow(alertMessageAge, now.Add(59*time.Minute), time.Hour) {
+		t.Error("Expected the alert to be deduplicated within the cooldown")
+	}
+	if !monitor.allow(alertMessageAge, now.Add(time.Hour), time.Hour) {
+		t.Error("Expected the alert to be sent again after the cooldown")
+	}
+}
+
+func TestQueueAlertEmail(t *testing.T) {
+	defer viper.Set("ownerEmail", nil)
+	viper.Set("ownerEmail", "owner@gmail.com")
+	var recipents []string
+	var data map[string]string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			recipents = append(recipents, recipent)
+			data = templateData.(map[string]string)
+			return nil
+		},
+	}
+	w.sendQueueAlert(webhook.QueueAlert{Condition: alertRetryQueueDepth, Queue: "retry.queue", Value: 250, Threshold: 100, Timestamp: time.Now()})
+	if len(recipents) != 1 || recipents[0] != "owner@gmail.com" {
+		t.Fatalf("Expected the alert to be sent to the owner, got %v", recipents)
+	}
+	if data["alert"] != "retry.queue holds 250 messages, more than the threshold of 100" {
+		t.Errorf("Unexpected alert %q", data["alert"])
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	defer viper.Set("dryRun", nil)
+	defer viper.Set("environment", nil)
+	viper.Set("environment", "production")
+	if DryRun() {
+		t.Error("Expected no dry run by default")
+	}
+	viper.Set("dryRun", true)
+	if !DryRun() {
+		t.Error("Expected dry run if configured")
+	}
+	viper.Set("dryRun", false)
+	viper.Set("environment", "test")
+	if !DryRun() {
+		t.Error("Expected dry run in the test environment")
+	}
+	executor, err := NewRCONExecutor(logrus.New().WithField("origin", "worker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Worker{logger: logrus.New().WithField("origin", "worker"), executor: executor}
+	if _, err := w.issueRCON("whitelist add steve"); err != nil {
+		t.Errorf("Expected simulated command to succeed, got %v", err)
+	}
+}
+
+// fakeRCON records the commands run on the game server. Commands in failing fail
+type fakeRCON struct {
+	commands []string
+	failing  map[string]bool
+}
+
+func (r *fakeRCON) SendCommand(command string) (string, error) {
+	r.commands = append(r.commands, command)
+	if r.failing[command] {
+		return "", errors.New("connection refused")
+	}
+	return "", nil
+}
+
+// fakeSharedState has no submission limits reached nor banned usernames
+type fakeSharedState struct {
+	cursor int64
+}
+
+func (c *fakeSharedState) GetAttempts(key string) (int64, time.Duration, error) { return 0, 0, nil }
+
+func (c *fakeSharedState) IsUsernameBanned(serverID, username string) (bool, error) {
+	return false, nil
+}
+
+func (c *fakeSharedState) IncrDispatchCursor(serverID string, n int) (int64, error) {
+	c.cursor += int64(n)
+	return c.cursor, nil
+}
+
+func (c *fakeSharedState) Ping() error { return nil }
+
+// fakeRequestCache records the refreshed requests and the banned usernames
+type fakeRequestCache struct {
+	refreshed []primitive.ObjectID
+	banned    map[string]bool
+}
+
+func (c *fakeRequestCache) RefreshRequests(ids ...primitive.ObjectID) error {
+	c.refreshed = append(c.refreshed, ids...)
+	return nil
+}
+
+func (c *fakeRequestCache) ApplyStatsDelta(serverID string, delta cache.StatsDelta) error { return nil }
+
+func (c *fakeRequestCache) RecordDecisionLatency(request types.WhitelistRequest) error { return nil }
+
+func (c *fakeRequestCache) AddBannedUsername(serverID, username string) error {
+	c.banned[username] = true
+	return nil
+}
+
+func (c *fakeRequestCache) RemoveBannedUsername(serverID, username string) error {
+	delete(c.banned, username)
+	return nil
+}
+
+// fakeProcessed records the requests whose decision has been carried out
+type fakeProcessed map[primitive.ObjectID]time.Time
+
+func (f fakeProcessed) MarkRequestProcessed(id primitive.ObjectID, processedAt time.Time) error {
+	f[id] = processedAt
+	return nil
+}
+
+// fakeTimeline records the milestones of requests like the db, keeping the first of each name
+type fakeTimeline map[primitive.ObjectID][]types.Milestone
+
+func (f fakeTimeline) RecordMilestone(id primitive.ObjectID, milestone types.Milestone) error {
+	for _, recorded := range f[id] {
+		if recorded.Name == milestone.Name {
+			return nil
+		}
+	}
+	f[id] = append(f[id], milestone)
+	return nil
+}
+
+func (f fakeTimeline) names(id primitive.ObjectID) []string {
+	var names []string
+	for _, milestone := range f[id] {
+		names = append(names, milestone.Name)
+	}
+	return names
+}
+
+// recordingAcknowledger records how the delivery was settled
+type recordingAcknowledger struct {
+	acks, nacks int
+}
+
+func (a *recordingAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks++
+	return nil
+}
+
+func (a *recordingAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacks++
+	return nil
+}
+
+func (a *recordingAcknowledger) Reject(tag uint64, requeue bool) error { return nil }
+
+func TestProcessTasks(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	viper.Set("ops", []string{"op1@gmail.com", "op2@gmail.com"})
+	viper.Set("unbannedEmailTitle", "You have been unbanned")
+	defer viper.Set("ops", nil)
+	defer viper.Set("unbannedEmailTitle", nil)
+	expiresAt := time.Now().Add(-time.Minute)
+	deactivatedAt := time.Now()
+	expiresLater := deactivatedAt.Add(time.Hour)
+	tests := []struct {
+		status    string
+		request   types.WhitelistRequest
+		commands  []string
+		templates map[string]string
+		banned    bool
+	}{
+		{types.StatusApproved, types.WhitelistRequest{}, []string{"whitelist add Steve"},
+			map[string]string{"steve@gmail.com": "approve.html"}, false},
+		{types.StatusDenied, types.WhitelistRequest{}, nil,
+			map[string]string{"steve@gmail.com": "deny.html"}, false},
+		{types.StatusBanned, types.WhitelistRequest{}, []string{"ban Steve"},
+			map[string]string{"steve@gmail.com": "ban.html"}, true},
+		{types.StatusUnbanned, types.WhitelistRequest{}, []string{"pardon Steve"},
+			map[string]string{"steve@gmail.com": "unban.html"}, false},
+		{types.StatusDeactivated, types.WhitelistRequest{}, []string{"whitelist remove Steve"},
+			map[string]string{}, false},
+		{types.StatusDeactivated, types.WhitelistRequest{ExpiresAt: &expiresAt, LastUpdatedTimestamp: deactivatedAt},
+			[]string{"whitelist remove Steve"}, map[string]string{"steve@gmail.com": "grant_expired.html"}, false},
+		// Deactivated by an op before the grant expired
+		{types.StatusDeactivated, types.WhitelistRequest{ExpiresAt: &expiresLater, LastUpdatedTimestamp: deactivatedAt},
+			[]string{"whitelist remove Steve"}, map[string]string{}, false},
+		{types.StatusDisputed, types.WhitelistRequest{}, nil,
+			map[string]string{"op1@gmail.com": "disputed.html", "op2@gmail.com": "disputed.html"}, false},
+		{types.StatusCancelled, types.WhitelistRequest{Assignees: []string{"op2@gmail.com"}}, nil,
+			map[string]string{"op2@gmail.com": "cancelled.html"}, false},
+	}
+	for _, test := range tests {
+		executor := &fakeRCON{}
+		requestCache := &fakeRequestCache{banned: map[string]bool{"Steve": true}}
+		ledger := &fakeLedger{processed: make(map[string]bool)}
+		processed := make(fakeProcessed)
+		timeline := make(fakeTimeline)
+		templates := make(map[string]string)
+		w := &Worker{
+			logger: logrus.New().WithField("origin", "worker"),
+			sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+				templates[recipent] = filepath.Base(templateName)
+				return nil
+			},
+			executor:          executor,
+			requestCache:      requestCache,
+			processedRequests: processed,
+			timeline:          timeline,
+			processedTasks:    ledger,
+			appliedSequences:  &fakeSequences{},
+		}
+		request := test.request
+		request.ID = primitive.NewObjectID()
+		request.Username = "Steve"
+		request.Email = "steve@gmail.com"
+		request.Status = test.status
+		body, _ := json.Marshal(request)
+		acknowledger := &recordingAcknowledger{}
+		w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body})
+
+		if strings.Join(executor.commands, ";") != strings.Join(test.commands, ";") {
+			t.Errorf("%s: expected commands %v, got %v", test.status, test.commands, executor.commands)
+		}
+		if fmt.Sprint(templates) != fmt.Sprint(test.templates) {
+			t.Errorf("%s: expected emails %v, got %v", test.status, test.templates, templates)
+		}
+		// Usernames are banned in the cache from the start, only bans and unbans change them
+		if requestCache.banned["Steve"] != (test.banned || test.status != types.StatusUnbanned) {
+			t.Errorf("%s: expected banned usernames to be updated, got %v", test.status, requestCache.banned)
+		}
+		// Only carrying out decisions counts for the time to whitelist
+		decision := test.status == types.StatusApproved || test.status == types.StatusDenied
+		if _, ok := processed[request.ID]; ok != decision {
+			t.Errorf("%s: expected request to be recorded as processed: %v", test.status, decision)
+		}
+		// Only decisions and carrying them out are milestones of the timeline
+		var milestones []string
+		switch test.status {
+		case types.StatusApproved:
+			milestones = []string{types.MilestoneApproved, types.MilestoneWhitelisted}
+		case types.StatusDenied:
+			milestones = []string{types.MilestoneDenied}
+		}
+		if names := timeline.names(request.ID); !reflect.DeepEqual(names, milestones) {
+			t.Errorf("%s: expected milestones %v, got %v", test.status, milestones, names)
+		}
+		if len(requestCache.refreshed) == 0 || requestCache.refreshed[0] != request.ID {
+			t.Errorf("%s: expected cached request to be refreshed", test.status)
+		}
+		if acknowledger.acks != 1 || acknowledger.nacks != 0 || !ledger.processed[requestTaskKey(request)] {
+			t.Errorf("%s: expected task to be completed, got %d acks and %d nacks", test.status, acknowledger.acks, acknowledger.nacks)
+		}
+	}
+}
+
+// fakeOnserver lists the stuck requests and records the state of players on the game server
+type fakeOnserver struct {
+	stuck    []types.WhitelistRequest
+	recorded map[primitive.ObjectID]string
+	// Returned instead of recording the state, e.g while db is unreachable
+	err   error
+	calls int
+}
+
+func (f *fakeOnserver) SetOnserverStatus(id primitive.ObjectID, status string, sequence int64, onserverStatus string) error {
+	f.calls++
+	if f.err != nil {
+		return f.err
+	}
+	f.recorded[id] = onserverStatus
+	return nil
+}
+
+func (f *fakeOnserver) StuckRequests(since, before time.Time) ([]types.WhitelistRequest, error) {
+	return f.stuck, nil
+}
+
+// fakeNetworks holds the stored request and the prior requests of its network
+type fakeNetworks struct {
+	stored  types.WhitelistRequest
+	prior   []types.WhitelistRequest
+	updates []types.NetworkSignals
+}
+
+func (f *fakeNetworks) GetRequest(id primitive.ObjectID) (types.WhitelistRequest, error) {
+	if id != f.stored.ID {
+		return types.WhitelistRequest{}, db.ErrNotFound
+	}
+	return f.stored, nil
+}
+
+func (f *fakeNetworks) QueryRequests(filter db.RequestFilter) ([]types.WhitelistRequest, error) {
+	return f.prior, nil
+}
+
+func (f *fakeNetworks) SetNetworkSignals(id primitive.ObjectID, signals types.NetworkSignals) error {
+	f.updates = append(f.updates, signals)
+	return nil
+}
+
+func TestNetworkSignalsShownToOps(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Status: types.StatusPending, SubmissionCountry: "GB"}
+	stored := request
+	stored.SubmissionIPPrefix = "hashed prefix"
+	networks := &fakeNetworks{stored: stored, prior: []types.WhitelistRequest{
+		{Username: "Alex", Status: types.StatusBanned},
+		{Username: "Notch", Status: types.StatusApproved},
+	}}
+	var data map[string]interface{}
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			data = templateData.(map[string]interface{})
+			return nil
+		},
+		networks: networks,
+	}
+	request.NetworkSignals = w.collectNetworkSignals(request)
+	expected := types.NetworkSignals{PriorRequests: 2, PriorBanned: 1, BannedUsernames: []string{"Alex"}}
+	if request.NetworkSignals == nil || !reflect.DeepEqual(*request.NetworkSignals, expected) || len(networks.updates) != 1 {
+		t.Fatalf("Expected the signals to be recorded, got %+v and %d updates", request.NetworkSignals, len(networks.updates))
+	}
+	if _, _, err := w.emailToOps(request, []string{"op1@gmail.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if data["networkSignals"] != "2 prior requests from this network, 1 banned (Alex)" || data["country"] != "GB" {
+		t.Errorf("Expected the signals in the ops email, got %v", data)
+	}
+
+	// Nothing is recorded for requests of unknown networks or without prior requests
+	networks.stored.SubmissionIPPrefix = ""
+	if signals := w.collectNetworkSignals(request); signals != nil {
+		t.Errorf("Expected no signals without the network of the request, got %+v", signals)
+	}
+	networks.stored.SubmissionIPPrefix = "hashed prefix"
+	networks.prior = nil
+	if signals := w.collectNetworkSignals(request); signals != nil || len(networks.updates) != 1 {
+		t.Errorf("Expected no signals without prior requests, got %+v", signals)
+	}
+}
+
+func TestStepsResumeAfterFailure(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	tests := []struct {
+		status  string
+		command string
+		// Step failing on the first attempt
+		failing int
+		// Emails sent by the task, best effort only for all but approvals
+		emails int
+	}{
+		{types.StatusApproved, "whitelist add Steve", types.StepServerAction, 1},
+		{types.StatusApproved, "whitelist add Steve", types.StepPersistOnserverStatus, 1},
+		{types.StatusApproved, "whitelist add Steve", types.StepNotifyApplicant, 1},
+		{types.StatusBanned, "ban Steve", types.StepServerAction, 1},
+		{types.StatusBanned, "ban Steve", types.StepPersistOnserverStatus, 1},
+		{types.StatusDeactivated, "whitelist remove Steve", types.StepServerAction, 0},
+		{types.StatusDeactivated, "whitelist remove Steve", types.StepPersistOnserverStatus, 0},
+	}
+	for _, test := range tests {
+		executor := &fakeRCON{failing: map[string]bool{}}
+		onserver := &fakeOnserver{recorded: make(map[primitive.ObjectID]string)}
+		smtpDown := false
+		sent := 0
+		switch test.failing {
+		case types.StepServerAction:
+			executor.failing[test.command] = true
+		case types.StepPersistOnserverStatus:
+			onserver.err = errors.New("db unavailable")
+		case types.StepNotifyApplicant:
+			smtpDown = true
+		}
+		ledger := &fakeLedger{processed: make(map[string]bool)}
+		channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+		w := &Worker{
+			logger: logrus.New().WithField("origin", "worker"),
+			sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+				if smtpDown {
+					return errors.New("smtp unavailable")
+				}
+				sent++
+				return nil
+			},
+			executor:            executor,
+			requestCache:        &fakeRequestCache{banned: make(map[string]bool)},
+			processedRequests:   make(fakeProcessed),
+			processedTasks:      ledger,
+			appliedSequences:    &fakeSequences{},
+			publisher:           newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+			topology:            topology.FromConfig(),
+			onserver:            onserver,
+			failedNotifications: &fakeFailedNotifications{},
+		}
+		request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Email: "steve@gmail.com", Status: test.status}
+		body, _ := json.Marshal(request)
+		acknowledger := &recordingAcknowledger{}
+		w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body})
+		if len(channel.headers) != 1 || ledger.processed[requestTaskKey(request)] {
+			t.Fatalf("%s: expected step %d to be retried, got %v", test.status, test.failing, channel.headers)
+		}
+		// Every step before the failing one is completed
+		if completed := headerInt(channel.headers[0], types.CompletedStepsHeader); completed != test.failing-1 {
+			t.Errorf("%s: expected steps %b to be completed, got %b", test.status, test.failing-1, completed)
+		}
+
+		executor.failing = nil
+		onserver.err = nil
+		smtpDown = false
+		commands, calls := len(executor.commands), onserver.calls
+		w.process(amqp.Delivery{Acknowledger: acknowledger, Body: []byte(channel.published[0]), Headers: channel.headers[0]})
+		if !ledger.processed[requestTaskKey(request)] || acknowledger.acks != 2 {
+			t.Fatalf("%s: expected the retry of step %d to complete the task, got %d acks", test.status, test.failing, acknowledger.acks)
+		}
+		// The retry only runs the failing step and the ones after it
+		if reran := len(executor.commands) > commands; reran != (test.failing == types.StepServerAction) {
+			t.Errorf("%s: expected the game server action to be run again only if it failed, got %v", test.status, executor.commands)
+		}
+		if rerecorded := onserver.calls > calls; rerecorded != (test.failing <= types.StepPersistOnserverStatus) {
+			t.Errorf("%s: expected the state to be recorded again only if it was not recorded, got %d calls", test.status, onserver.calls)
+		}
+		if onserver.recorded[request.ID] == "" || sent != test.emails {
+			t.Errorf("%s: expected the state to be recorded and %d emails, got %v and %d emails", test.status, test.emails, onserver.recorded, sent)
+		}
+	}
+}
+
+func TestStuckRequestsRecovered(t *testing.T) {
+	approved := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Email: "steve@gmail.com", Status: types.StatusApproved}
+	banned := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Alex", Email: "alex@gmail.com", Status: types.StatusBanned}
+	executor := &fakeRCON{}
+	// The approval was completed, but the worker stopped before recording that the player is whitelisted
+	ledger := &fakeLedger{processed: map[string]bool{requestTaskKey(approved): true}}
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	onserver := &fakeOnserver{stuck: []types.WhitelistRequest{approved, banned}, recorded: make(map[primitive.ObjectID]string)}
+	var sent []string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			sent = append(sent, recipent)
+			return nil
+		},
+		executor:          executor,
+		requestCache:      &fakeRequestCache{banned: make(map[string]bool)},
+		processedRequests: make(fakeProcessed),
+		processedTasks:    ledger,
+		appliedSequences:  &fakeSequences{},
+		publisher:         newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:          topology.FromConfig(),
+		onserver:          onserver,
+	}
+	if err := w.recoverStuckRequests(); err != nil {
+		t.Fatal(err)
+	}
+	if len(channel.headers) != 2 || completedSteps(amqp.Delivery{Headers: channel.headers[0]}) != types.StepNotifyApplicant ||
+		completedSteps(amqp.Delivery{Headers: channel.headers[1]}) != types.StepNotifyApplicant {
+		t.Fatalf("Expected the tasks of the stuck requests to be republished, got %v", channel.headers)
+	}
+	acknowledger := &recordingAcknowledger{}
+	for i := range channel.published {
+		w.process(amqp.Delivery{Acknowledger: acknowledger, Body: []byte(channel.published[i]), Headers: channel.headers[i]})
+	}
+	if strings.Join(executor.commands, ";") != "whitelist add Steve;ban Alex" {
+		t.Errorf("Expected the game server actions to be carried out again, got %v", executor.commands)
+	}
+	if len(sent) != 0 {
+		t.Errorf("Expected the emails not to be sent again, got %v", sent)
+	}
+	if onserver.recorded[approved.ID] != types.OnserverWhitelisted || onserver.recorded[banned.ID] != types.OnserverBanned {
+		t.Errorf("Expected the state of the players to be recorded, got %v", onserver.recorded)
+	}
+	if acknowledger.acks != 2 || !ledger.processed[requestTaskKey(banned)] {
+		t.Errorf("Expected the recovered tasks to be completed, got %d acks", acknowledger.acks)
+	}
+}
+
+func TestUnbanTask(t *testing.T) {
+	viper.Set("unbannedEmailTitle", "You may apply again")
+	defer viper.Set("unbannedEmailTitle", nil)
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Alex", Email: "alex@gmail.com", Status: types.StatusUnbanned}
+	executor := &fakeRCON{}
+	ledger := &fakeLedger{processed: make(map[string]bool)}
+	requestCache := &fakeRequestCache{banned: map[string]bool{"Alex": true}}
+	onserver := &fakeOnserver{recorded: make(map[primitive.ObjectID]string)}
+	var sent []string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			sent = append(sent, filepath.Base(templateName)+" "+recipent)
+			return nil
+		},
+		executor:          executor,
+		requestCache:      requestCache,
+		processedRequests: make(fakeProcessed),
+		processedTasks:    ledger,
+		sentEmails:        make(fakeEmailLedger),
+		appliedSequences:  &fakeSequences{},
+		onserver:          onserver,
+	}
+	body, _ := json.Marshal(request)
+	acknowledger := &recordingAcknowledger{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body})
+	if strings.Join(executor.commands, ";") != "pardon Alex" {
+		t.Errorf("Expected the player to be pardoned on the game server, got %v", executor.commands)
+	}
+	if onserver.recorded[request.ID] != types.OnserverRemoved {
+		t.Errorf("Expected the player to be recorded as removed from the game server, got %v", onserver.recorded)
+	}
+	if requestCache.banned["Alex"] {
+		t.Error("Expected the player to be removed from the banned usernames")
+	}
+	if strings.Join(sent, ";") != "unban.html alex@gmail.com" {
+		t.Errorf("Expected the player to be told they may apply again, got %v", sent)
+	}
+	if acknowledger.acks != 1 || !ledger.processed[requestTaskKey(request)] {
+		t.Errorf("Expected the unban task to be completed, got %d acks", acknowledger.acks)
+	}
+}
+
+func TestMaintenanceWindowEnd(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nightly := MaintenanceWindow{Hour: 4, Duration: 15 * time.Minute, Location: berlin}
+	overnight := MaintenanceWindow{Hour: 23, Minute: 30, Duration: 2 * time.Hour, Location: berlin}
+	sundayNight := MaintenanceWindow{Hour: 23, Minute: 30, Duration: 2 * time.Hour, Location: berlin, Days: []time.Weekday{time.Sunday}}
+	longOvernight := MaintenanceWindow{Hour: 23, Duration: 6 * time.Hour, Location: berlin}
+	utc := func(value string) time.Time {
+		t, _ := time.Parse(time.RFC3339, value)
+		return t
+	}
+	cases := []struct {
+		window MaintenanceWindow
+		at     time.Time
+		end    time.Time
+	}{
+		// 04:00 in Berlin is 02:00 UTC in summer
+		{nightly, utc("2026-07-01T01:59:59Z"), time.Time{}},
+		{nightly, utc("2026-07-01T02:00:00Z"), utc("2026-07-01T02:15:00Z")},
+		{nightly, utc("2026-07-01T02:15:00Z"), time.Time{}},
+		// Windows crossing midnight are still in progress the next day
+		{overnight, utc("2026-07-01T21:45:00Z"), utc("2026-07-01T23:30:00Z")},
+		{overnight, utc("2026-07-01T22:30:00Z"), utc("2026-07-01T23:30:00Z")},
+		{overnight, utc("2026-07-01T23:30:00Z"), time.Time{}},
+		// Only the occurrence starting on Sunday 2026-07-05 is in progress after midnight
+		{sundayNight, utc("2026-07-05T22:30:00Z"), utc("2026-07-05T23:30:00Z")},
+		{sundayNight, utc("2026-07-04T22:30:00Z"), time.Time{}},
+		// Clocks go forward at 02:00 on 2026-03-29, the window starts at 04:00 summer time
+		{nightly, utc("2026-03-28T03:05:00Z"), utc("2026-03-28T03:15:00Z")},
+		{nightly, utc("2026-03-29T02:05:00Z"), utc("2026-03-29T02:15:00Z")},
+		{nightly, utc("2026-03-29T03:05:00Z"), time.Time{}},
+		// Clocks go back at 03:00 on 2026-10-25, the window starts at 04:00 winter time
+		{nightly, utc("2026-10-24T02:05:00Z"), utc("2026-10-24T02:15:00Z")},
+		{nightly, utc("2026-10-25T02:05:00Z"), time.Time{}},
+		{nightly, utc("2026-10-25T03:05:00Z"), utc("2026-10-25T03:15:00Z")},
+		// Starting at 23:00 summer time on 2026-10-24, 6 hours later is 04:00 winter time
+		{longOvernight, utc("2026-10-25T02:30:00Z"), utc("2026-10-25T03:00:00Z")},
+		{longOvernight, utc("2026-10-25T03:00:00Z"), time.Time{}},
+	}
+	for _, c := range cases {
+		end := c.window.endAt(c.at)
+		if !end.Equal(c.end) {
+			t.Errorf("Expected the window starting at %02d:%02d to end at %v at %v, got %v", c.window.Hour, c.window.Minute, c.end, c.at, end)
+		}
+	}
+
+	// Windows following each other without a gap count as one
+	windows := []MaintenanceWindow{nightly, {Hour: 4, Minute: 15, Duration: 30 * time.Minute, Location: berlin}}
+	end, ok := maintenanceEnd(windows, utc("2026-07-01T02:10:00Z"))
+	if !ok || !end.Equal(utc("2026-07-01T02:45:00Z")) {
+		t.Errorf("Expected consecutive windows to end at 02:45 UTC, got %v", end)
+	}
+	if _, ok := maintenanceEnd(windows, utc("2026-07-01T02:45:00Z")); ok {
+		t.Error("Expected no maintenance after the windows")
+	}
+	// Windows covering the whole day defer tasks for at most maxMaintenance
+	end, ok = maintenanceEnd([]MaintenanceWindow{{Duration: 24 * time.Hour, Location: time.UTC}}, utc("2026-07-01T02:10:00Z"))
+	if !ok || end.Sub(utc("2026-07-01T02:10:00Z")) < maxMaintenance || end.Sub(utc("2026-07-01T02:10:00Z")) > maxMaintenance+24*time.Hour {
+		t.Errorf("Expected a permanent maintenance to be capped, got %v", end)
+	}
+}
+
+func TestParseMaintenanceWindows(t *testing.T) {
+	defer viper.Set("maintenanceWindows", nil)
+	cases := []struct {
+		window map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"start": "04:00", "duration": "15m", "timezone": "Europe/Berlin", "days": []interface{}{"Sun", "monday"}}, ""},
+		{map[string]interface{}{"start": "4am", "duration": "15m"}, `maintenanceWindows[0]: invalid time "4am", expected HH:MM`},
+		{map[string]interface{}{"start": "24:00", "duration": "15m"}, `maintenanceWindows[0]: invalid start "24:00", expected HH:MM before 24:00`},
+		{map[string]interface{}{"start": "04:00"}, `maintenanceWindows[0]: invalid duration "", expected e.g 30m, at most 24h`},
+		{map[string]interface{}{"start": "04:00", "duration": "25h"}, `maintenanceWindows[0]: invalid duration "25h", expected e.g 30m, at most 24h`},
+		{map[string]interface{}{"start": "04:00", "duration": "15m", "timezone": "Mars/Olympus"}, `maintenanceWindows[0]: unknown timezone "Mars/Olympus"`},
+		{map[string]interface{}{"start": "04:00", "duration": "15m", "days": []interface{}{"Funday"}}, `maintenanceWindows[0]: unknown day "Funday", expected e.g Mon`},
+	}
+	for _, c := range cases {
+		viper.Set("maintenanceWindows", []interface{}{c.window})
+		windows, err := ParseMaintenanceWindows(tenant.Default)
+		if c.err == "" && (err != nil || len(windows) != 1 || windows[0].Location.String() != "Europe/Berlin" || len(windows[0].Days) != 2) {
+			t.Errorf("Expected %v to be parsed, got %v, %v", c.window, windows, err)
+		} else if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("Expected error %q for %v, got %v", c.err, c.window, err)
+		}
+	}
+}
+
+func TestApprovalDeferredDuringMaintenance(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	viper.Set("maintenanceWindows", []interface{}{map[string]interface{}{
+		"start":    time.Now().UTC().Add(-time.Hour).Format("15:04"),
+		"duration": "2h",
+	}})
+	defer viper.Set("maintenanceWindows", nil)
+	executor := &fakeRCON{}
+	ledger := &fakeLedger{processed: make(map[string]bool)}
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	sent := 0
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			sent++
+			return nil
+		},
+		executor:          executor,
+		requestCache:      &fakeRequestCache{banned: make(map[string]bool)},
+		processedRequests: make(fakeProcessed),
+		processedTasks:    ledger,
+		appliedSequences:  &fakeSequences{},
+		publisher:         newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:          topology.FromConfig(),
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Email: "steve@gmail.com", Status: types.StatusApproved}
+	body, _ := json.Marshal(request)
+	acknowledger := &recordingAcknowledger{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body, Headers: amqp.Table{retryCountHeader: int32(2)}})
+	if len(executor.commands) != 0 || sent != 1 || acknowledger.acks != 1 || ledger.processed[requestTaskKey(request)] {
+		t.Fatalf("Expected the decision email to be sent and the whitelisting to be deferred, got %v and %d emails", executor.commands, sent)
+	}
+	if len(channel.headers) != 1 || headerInt(channel.headers[0], types.CompletedStepsHeader) != types.StepNotifyApplicant || headerInt(channel.headers[0], retryCountHeader) != 2 {
+		t.Fatalf("Expected the game server action to be deferred without using up a retry, got %v", channel.headers)
+	}
+
+	// The deferred task comes back once the window is over
+	viper.Set("maintenanceWindows", nil)
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: []byte(channel.published[0]), Headers: channel.headers[0]})
+	if strings.Join(executor.commands, ";") != "whitelist add Steve" || sent != 1 {
+		t.Errorf("Expected the player to be whitelisted without emailing them again, got %v and %d emails", executor.commands, sent)
+	}
+	if acknowledger.acks != 2 || !ledger.processed[requestTaskKey(request)] {
+		t.Errorf("Expected the deferred task to be completed, got %d acks", acknowledger.acks)
+	}
+}
+
+func TestApplicationWindowState(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(value string) time.Time {
+		t, _ := time.Parse(time.RFC3339, value)
+		return t
+	}
+	monthly := ApplicationWindow{Day: 1, Duration: 7 * 24 * time.Hour, Location: berlin}
+	holidays := ApplicationWindow{Opens: utc("2026-12-20T00:00:00Z"), Closes: utc("2027-01-03T00:00:00Z")}
+	cases := []struct {
+		windows     []ApplicationWindow
+		at          time.Time
+		open        bool
+		closesAt    time.Time
+		nextOpening time.Time
+	}{
+		{nil, utc("2026-07-15T00:00:00Z"), true, time.Time{}, time.Time{}},
+		// Midnight of the 1st in Berlin is 22:00 UTC the day before in summer
+		{[]ApplicationWindow{monthly}, utc("2026-06-30T21:59:59Z"), false, time.Time{}, utc("2026-06-30T22:00:00Z")},
+		{[]ApplicationWindow{monthly}, utc("2026-07-03T12:00:00Z"), true, utc("2026-07-07T22:00:00Z"), time.Time{}},
+		{[]ApplicationWindow{monthly}, utc("2026-07-15T00:00:00Z"), false, time.Time{}, utc("2026-07-31T22:00:00Z")},
+		// The window of December runs into the holidays
+		{[]ApplicationWindow{monthly, holidays}, utc("2026-12-22T00:00:00Z"), true, utc("2027-01-07T23:00:00Z"), time.Time{}},
+		{[]ApplicationWindow{holidays}, utc("2027-01-04T00:00:00Z"), false, time.Time{}, time.Time{}},
+	}
+	for i, c := range cases {
+		state := applicationWindowState(c.windows, c.at)
+		if state.Open != c.open {
+			t.Errorf("case %d: expected open %v, got %+v", i, c.open, state)
+		}
+		if (state.ClosesAt == nil) != c.closesAt.IsZero() || (state.ClosesAt != nil && !state.ClosesAt.Equal(c.closesAt)) {
+			t.Errorf("case %d: expected the window to close at %v, got %v", i, c.closesAt, state.ClosesAt)
+		}
+		if (state.NextOpening == nil) != c.nextOpening.IsZero() || (state.NextOpening != nil && !state.NextOpening.Equal(c.nextOpening)) {
+			t.Errorf("case %d: expected the next window to open at %v, got %v", i, c.nextOpening, state.NextOpening)
+		}
+	}
+}
+
+func TestParseApplicationWindows(t *testing.T) {
+	defer viper.Set("applicationWindows", nil)
+	viper.Set("applicationWindows", []interface{}{
+		map[interface{}]interface{}{"day": 1, "start": "00:00", "duration": "168h", "timezone": "Europe/Berlin"},
+		map[interface{}]interface{}{"opens": "2026-12-20T00:00:00Z", "closes": "2027-01-03T00:00:00Z"},
+	})
+	windows, err := ParseApplicationWindows(tenant.Default)
+	if err != nil || len(windows) != 2 || windows[0].Duration != 7*24*time.Hour || windows[1].Opens.IsZero() {
+		t.Errorf("Expected a recurring and an explicit window, got %+v %v", windows, err)
+	}
+	for _, invalid := range []map[string]interface{}{
+		{"day": 29, "start": "00:00", "duration": "168h"},
+		{"day": 1, "start": "00:00", "duration": "700h"},
+		{"opens": "2027-01-03T00:00:00Z", "closes": "2026-12-20T00:00:00Z"},
+		{"opens": "tomorrow", "closes": "2027-01-03T00:00:00Z"},
+	} {
+		viper.Set("applicationWindows", []interface{}{invalid})
+		if err := ValidateApplicationWindows(); err == nil {
+			t.Errorf("Expected %v to be rejected", invalid)
+		}
+	}
+}
+
+func TestRequestHeldOutsideApplicationWindow(t *testing.T) {
+	opens := time.Now().Add(time.Hour).UTC()
+	viper.Set("applicationWindows", []interface{}{map[string]interface{}{
+		"opens":  opens.Format(time.RFC3339),
+		"closes": opens.Add(24 * time.Hour).Format(time.RFC3339),
+	}})
+	defer viper.Set("applicationWindows", nil)
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	sent := 0
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			sent++
+			return nil
+		},
+		publisher: newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:  topology.FromConfig(),
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Status: types.StatusPending, Timestamp: time.Now()}
+	body, _ := json.Marshal(request)
+	acknowledger := &recordingAcknowledger{}
+	w.processNewRequest(context.Background(), amqp.Delivery{Acknowledger: acknowledger, Body: body, Headers: amqp.Table{retryCountHeader: int32(2)}}, request)
+	if sent != 0 || acknowledger.acks != 1 || len(channel.headers) != 1 {
+		t.Fatalf("Expected the request to be held without emails, got %d emails and %d acks", sent, acknowledger.acks)
+	}
+	if held, _ := channel.headers[0][applicationHoldHeader].(bool); !held || headerInt(channel.headers[0], retryCountHeader) != 2 {
+		t.Errorf("Expected the request to be held without using up a retry, got %v", channel.headers[0])
+	}
+	if w.holdOutsideApplicationWindow(amqp.Delivery{Acknowledger: acknowledger, Headers: channel.headers[0]}, request) {
+		t.Error("Expected the held request to be processed once back")
+	}
+
+	// Requests submitted before the window closed are processed normally
+	request.Timestamp = opens.Add(time.Hour)
+	if w.holdOutsideApplicationWindow(amqp.Delivery{Acknowledger: acknowledger}, request) {
+		t.Error("Expected the request submitted while the window was open not to be held")
+	}
+}
+
+func TestMessageSchemaVersions(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	executor := &fakeRCON{failing: map[string]bool{"whitelist add Steve": true}}
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	w := &Worker{
+		logger:            logrus.New().WithField("origin", "worker"),
+		sendMail:          func(templateName string, templateData interface{}, subject string, recipent string) error { return nil },
+		executor:          executor,
+		requestCache:      &fakeRequestCache{banned: make(map[string]bool)},
+		processedRequests: make(fakeProcessed),
+		processedTasks:    &fakeLedger{processed: make(map[string]bool)},
+		appliedSequences:  &fakeSequences{},
+		publisher:         newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:          topology.FromConfig(),
+	}
+	// Published before the envelope and still in the retry queue
+	id := primitive.NewObjectID()
+	v1 := `{"_id": "` + id.Hex() + `", "username": "Steve", "email": "steve@gmail.com", "status": "Approved"}`
+	acknowledger := &recordingAcknowledger{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: []byte(v1)})
+	if len(executor.commands) != 1 || len(channel.published) != 1 {
+		t.Fatalf("Expected the version 1 task to be processed and retried, got %v", executor.commands)
+	}
+	request, version, err := deserialize([]byte(channel.published[0]))
+	if err != nil || version != types.RequestSchemaVersion || request.ID != id || request.Username != "Steve" {
+		t.Fatalf("Expected the retry to be stamped with the current schema version, got %v %d %v", request, version, err)
+	}
+	executor.failing = nil
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: []byte(channel.published[0]), Headers: channel.headers[0]})
+	if len(executor.commands) != 2 || acknowledger.acks != 2 {
+		t.Errorf("Expected the retried task to be processed, got %v", executor.commands)
+	}
+
+	// Published by a newer version, e.g before a rollback
+	acknowledger = &recordingAcknowledger{}
+	future := `{"schemaVersion": 99, "request": {"_id": "` + id.Hex() + `", "username": "Steve", "status": "Banned"}}`
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: []byte(future)})
+	if acknowledger.nacks != 1 || acknowledger.acks != 0 || len(executor.commands) != 2 {
+		t.Errorf("Expected the task of the unknown version to be parked, got %d acks and %v", acknowledger.acks, executor.commands)
+	}
+}
+
+// fakeFailedNotifications records the decision emails given up
+type fakeFailedNotifications []types.FailedNotification
+
+func (f *fakeFailedNotifications) RecordFailedNotification(notification types.FailedNotification) error {
+	*f = append(*f, notification)
+	return nil
+}
+
+func TestDecisionEmailRetriedWithoutRepeatingTheDecision(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	viper.Set("maxRetries", 1)
+	defer viper.Set("maxRetries", nil)
+	executor := &fakeRCON{}
+	ledger := &fakeLedger{processed: make(map[string]bool)}
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	failed := &fakeFailedNotifications{}
+	smtpDown := true
+	sent := 0
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			if smtpDown {
+				return errors.New("smtp unavailable")
+			}
+			sent++
+			return nil
+		},
+		executor:            executor,
+		requestCache:        &fakeRequestCache{banned: make(map[string]bool)},
+		processedRequests:   make(fakeProcessed),
+		processedTasks:      ledger,
+		appliedSequences:    &fakeSequences{},
+		publisher:           newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:            topology.FromConfig(),
+		failedNotifications: failed,
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Email: "steve@gmail.com", Status: types.StatusApproved}
+	body, _ := json.Marshal(request)
+	acknowledger := &recordingAcknowledger{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body})
+	if len(executor.commands) != 1 || acknowledger.acks != 1 || ledger.processed[requestTaskKey(request)] {
+		t.Fatalf("expected the player to be whitelisted and the email to be retried, got %v", executor.commands)
+	}
+	if len(channel.headers) != 1 || headerInt(channel.headers[0], types.CompletedStepsHeader) != types.StepServerAction|types.StepPersistOnserverStatus {
+		t.Fatalf("expected the retry to only send the email, got %v", channel.headers)
+	}
+
+	// The retry is routed back to the task queue once the SMTP server is reachable again
+	smtpDown = false
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: []byte(channel.published[0]), Headers: channel.headers[0]})
+	if len(executor.commands) != 1 {
+		t.Errorf("expected the player not to be whitelisted again, got %v", executor.commands)
+	}
+	if sent != 1 || acknowledger.acks != 2 || !ledger.processed[requestTaskKey(request)] {
+		t.Errorf("expected the email to be sent and the task to be completed, got %d emails", sent)
+	}
+	if len(*failed) != 0 {
+		t.Errorf("expected no failed notification, got %v", *failed)
+	}
+
+	// The denial email keeps failing until retries are exhausted
+	smtpDown = true
+	denial := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Alex", Email: "alex@gmail.com", Status: types.StatusDenied}
+	body, _ = json.Marshal(denial)
+	acknowledger = &recordingAcknowledger{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body, Headers: amqp.Table{retryCountHeader: int32(1), types.PhaseHeader: types.PhaseEmail}})
+	if acknowledger.nacks != 1 || ledger.processed[requestTaskKey(denial)] {
+		t.Errorf("expected the task to be put to the dead letter queue, got %d acks and %d nacks", acknowledger.acks, acknowledger.nacks)
+	}
+	if len(*failed) != 1 || (*failed)[0].RequestID != denial.ID || (*failed)[0].Status != types.StatusDenied || (*failed)[0].Error != "smtp unavailable" {
+		t.Errorf("expected the failed denial email to be recorded, got %v", *failed)
+	}
+}
+
+func TestFailedCommandIsNotCompleted(t *testing.T) {
+	viper.Set("maxRetries", 1)
+	defer viper.Set("maxRetries", nil)
+	for status, command := range map[string]string{
+		types.StatusApproved:    "whitelist add Steve",
+		types.StatusBanned:      "ban Steve",
+		types.StatusUnbanned:    "pardon Steve",
+		types.StatusDeactivated: "whitelist remove Steve",
+	} {
+		sent := 0
+		ledger := &fakeLedger{processed: make(map[string]bool)}
+		w := &Worker{
+			logger: logrus.New().WithField("origin", "worker"),
+			sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+				sent++
+				return nil
+			},
+			executor:         &fakeRCON{failing: map[string]bool{command: true}},
+			requestCache:     &fakeRequestCache{banned: make(map[string]bool)},
+			processedTasks:   ledger,
+			appliedSequences: &fakeSequences{},
+		}
+		request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Status: status}
+		body, _ := json.Marshal(request)
+		acknowledger := &recordingAcknowledger{}
+		// The last retry failed, so the task is put to the dead letter queue
+		w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body, Headers: amqp.Table{retryCountHeader: int32(1)}})
+
+		if acknowledger.acks != 0 || acknowledger.nacks != 1 {
+			t.Errorf("%s: expected task to be nacked, got %d acks and %d nacks", status, acknowledger.acks, acknowledger.nacks)
+		}
+		if sent != 0 || ledger.processed[requestTaskKey(request)] {
+			t.Errorf("%s: expected no email and the task not to be completed", status)
+		}
+	}
+}
+
+func TestSLADigest(t *testing.T) {
+	viper.Set("ops", []string{"op1@gmail.com", "op2@gmail.com"})
+	viper.Set("slaHours", 24)
+	defer viper.Set("ops", nil)
+	defer viper.Set("slaHours", nil)
+	now := time.Date(2019, 11, 20, 12, 0, 0, 0, time.UTC)
+	requests := []types.WhitelistRequest{
+		{Username: "alex", Timestamp: now.Add(-30 * time.Hour)},
+		{Username: "steve", Timestamp: now.Add(-72 * time.Hour)},
+	}
+	digests := make(map[string][]string)
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			if filepath.Base(templateName) != "sla_digest.html" || subject != "[SLA] 2 request(s) pending longer than 24 hours" {
+				t.Errorf("Unexpected SLA digest email %s %q", templateName, subject)
+			}
+			digests[recipent] = templateData.(map[string]interface{})["requests"].([]string)
+			return nil
+		},
+	}
+	if err := w.emailSLADigest(tenant.Default, requests, now); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"steve, pending for 72 hours since November 17, 2019 12:00 UTC",
+		"alex, pending for 30 hours since November 19, 2019 06:00 UTC",
+	}
+	for _, op := range []string{"op1@gmail.com", "op2@gmail.com"} {
+		if strings.Join(digests[op], "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Expected %s to get the longest pending request first, got %v", op, digests[op])
+		}
+	}
+	filter := slaBreachFilter(now.Add(-24*time.Hour), now.Add(-slaRenotifyInterval))
+	if len(filter.Statuses) != 1 || filter.Statuses[0] != types.StatusPending || !filter.SLANotifiedBefore.Equal(now.Add(-slaRenotifyInterval)) {
+		t.Errorf("Expected pending requests not notified within a day, got %v", filter)
+	}
+}
+
+func TestDigestSchedule(t *testing.T) {
+	defer viper.Set("dispatchingMode", nil)
+	defer viper.Set("digestTime", nil)
+	defer viper.Set("digestTimezone", nil)
+	viper.Set("dispatchingMode", "digest")
+	viper.Set("digestTime", "08:30")
+	viper.Set("digestTimezone", "America/Toronto")
+	if err := validateDispatchingMode(); err != nil {
+		t.Fatal(err)
+	}
+	digests, _ := digestSchedule()
+	tests := []struct {
+		since, now, scheduled time.Time
+	}{
+		// 08:30 in Toronto is 13:30 UTC in winter
+		{time.Date(2019, 11, 20, 13, 29, 0, 0, time.UTC), time.Date(2019, 11, 20, 13, 30, 0, 0, time.UTC), time.Date(2019, 11, 20, 13, 30, 0, 0, time.UTC)},
+		{time.Date(2019, 11, 20, 13, 28, 0, 0, time.UTC), time.Date(2019, 11, 20, 13, 29, 0, 0, time.UTC), time.Time{}},
+		{time.Date(2019, 11, 20, 13, 30, 0, 0, time.UTC), time.Date(2019, 11, 20, 13, 31, 0, 0, time.UTC), time.Time{}},
+		// Digests missed are sent once
+		{time.Date(2019, 11, 18, 2, 0, 0, 0, time.UTC), time.Date(2019, 11, 21, 2, 0, 0, 0, time.UTC), time.Date(2019, 11, 20, 13, 30, 0, 0, time.UTC)},
+		// and 12:30 UTC in summer
+		{time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC), time.Date(2019, 7, 1, 12, 45, 0, 0, time.UTC), time.Date(2019, 7, 1, 12, 30, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if scheduled := dueDigestTime(digests, test.since, test.now); !scheduled.Equal(test.scheduled) {
+			t.Errorf("%v: expected digest due at %v, got %v", test.now, test.scheduled, scheduled.UTC())
+		}
+	}
+	// Schedule expressions and the global timezone are accepted too
+	defer viper.Set("timezone", nil)
+	viper.Set("digestTime", "weekdays at 08:30")
+	viper.Set("digestTimezone", nil)
+	viper.Set("timezone", "Europe/Berlin")
+	digests, err := digestSchedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Friday Nov 22, then Monday Nov 25 at 07:30 UTC
+	if next := digests.Next(time.Date(2019, 11, 22, 8, 0, 0, 0, time.UTC)); !next.Equal(time.Date(2019, 11, 25, 7, 30, 0, 0, time.UTC)) {
+		t.Errorf("Expected the next weekday digest in the timezone, got %v", next.UTC())
+	}
+	viper.Set("timezone", nil)
+	viper.Set("digestTime", nil)
+	for key, value := range map[string]string{"digestTime": "9am", "digestTimezone": "Mars/Olympus", "timezone": "Mars/Olympus"} {
+		viper.Set(key, value)
+		if err := validateDispatchingMode(); err == nil {
+			t.Errorf("Expected invalid %s %s to be rejected", key, value)
+		}
+		viper.Set(key, nil)
+	}
+	viper.Set("dispatchingMode", "weekly")
+	if err := validateDispatchingMode(); err == nil {
+		t.Error("Expected unknown dispatching mode to be rejected")
+	}
+}
+
+func TestDigestEntriesHaveActionLinksPerOp(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	nonces := fakeNonces{}
+	w := &Worker{logger: logrus.New().WithField("origin", "worker"), actionNonces: nonces}
+	requests := []types.WhitelistRequest{
+		{ID: primitive.NewObjectID(), Username: "steve", Age: 16, Gender: "male"},
+		{ID: primitive.NewObjectID(), Username: "alex", Age: 20, Gender: "female"},
+	}
+	for _, op := range []string{"op1@gmail.com", "op2@gmail.com"} {
+		entries, err := w.digestEntries(requests, op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0]["username"] != "steve" || entries[1]["age"] != "20" {
+			t.Fatalf("Expected an entry per request, got %v", entries)
+		}
+		for i, entry := range entries {
+			token, err := utils.ParseActionToken(strings.SplitN(entry["link"].(string), "?adm=", 2)[1], "passphrase", time.Now())
+			if err != nil || token.Op != op || token.RequestID != requests[i].ID.Hex() {
+				t.Errorf("Expected action link of %s for %s, got %+v %v", op, requests[i].Username, token, err)
+			}
+		}
+	}
+	if len(nonces) != 4 {
+		t.Errorf("Expected a single use link per op and request, got %d nonces", len(nonces))
+	}
+}
+
+func TestDigestResponseTimes(t *testing.T) {
+	rows := digestResponseTimes([]types.OpResponseStats{
+		{Op: "op1@gmail.com", Assigned: 3, Decided: 2, MedianResponseTimeInMinutes: 150.4, EscalatedPast: 1},
+		{Op: "op2@gmail.com", Assigned: 1, Decided: 1, MedianResponseTimeInMinutes: 0.2},
+		// Only decided by other ops so far
+		{Op: "op3@gmail.com", Assigned: 2},
+	})
+	medians := []string{"2h30m", "<1m", "-"}
+	for i, row := range rows {
+		if row["median"] != medians[i] {
+			t.Errorf("Expected median response time %s for %s, got %v", medians[i], row["op"], row["median"])
+		}
+	}
+	if rows[0]["escalatedPast"] != int64(1) || rows[2]["assigned"] != int64(2) {
+		t.Errorf("Expected the counts of each op, got %v", rows)
+	}
+}
+
+func TestTenantTasks(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	viper.Set("approvedEmailTitle", "Welcome")
+	viper.Set("dispatchingStrategy", "Broadcast")
+	viper.Set("ops", []string{"op1@gmail.com"})
+	viper.Set("tenants", map[string]interface{}{
+		"creative": map[string]interface{}{
+			"RCONServer":         "creative.example.com",
+			"approvedEmailTitle": "Welcome to Creative",
+			"ops":                []string{"builder@gmail.com"},
+			"frontendURL":        "https://creative.example.com",
+		},
+	})
+	defer func() {
+		for _, key := range []string{"approvedEmailTitle", "dispatchingStrategy", "ops", "tenants"} {
+			viper.Set(key, nil)
+		}
+	}()
+	defaultServer := &fakeRCON{}
+	creativeServer := &fakeRCON{}
+	subjects := make(map[string]string)
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			subjects[recipent] = subject
+			return nil
+		},
+		executor:          defaultServer,
+		tenantExecutors:   map[string]RCONExecutor{"creative": creativeServer},
+		requestCache:      &fakeRequestCache{banned: make(map[string]bool)},
+		processedRequests: make(fakeProcessed),
+		processedTasks:    &fakeLedger{processed: make(map[string]bool)},
+		appliedSequences:  &fakeSequences{},
+	}
+	process := func(serverID, username string) *recordingAcknowledger {
+		request := types.WhitelistRequest{ID: primitive.NewObjectID(), ServerID: serverID, Username: username,
+			Email: username + "@gmail.com", Status: types.StatusApproved}
+		body, _ := json.Marshal(request)
+		acknowledger := &recordingAcknowledger{}
+		w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body})
+		return acknowledger
+	}
+	process("creative", "alex")
+	process("", "steve")
+	if strings.Join(creativeServer.commands, ";") != "whitelist add alex" || strings.Join(defaultServer.commands, ";") != "whitelist add steve" {
+		t.Errorf("Expected each player to be whitelisted on the game server of their tenant, got %v and %v",
+			creativeServer.commands, defaultServer.commands)
+	}
+	if subjects["alex@gmail.com"] != "Welcome to Creative" || subjects["steve@gmail.com"] != "Welcome" {
+		t.Errorf("Expected the decision emails to have the subject of their tenant, got %v", subjects)
+	}
+
+	// Tasks of unknown tenants are parked without side effects
+	acknowledger := process("skyblock", "notch")
+	if acknowledger.acks != 0 || acknowledger.nacks != 1 {
+		t.Errorf("Expected the task of an unknown tenant to be dead-lettered, got %d acks and %d nacks", acknowledger.acks, acknowledger.nacks)
+	}
+	if len(creativeServer.commands)+len(defaultServer.commands) != 2 || subjects["notch@gmail.com"] != "" {
+		t.Error("Expected no command nor email for the task of an unknown tenant")
+	}
+
+	creative := tenant.Config{ID: "creative"}
+	if ops := w.getTargetOps(creative); strings.Join(ops, ",") != "builder@gmail.com" {
+		t.Errorf("Expected requests to be dispatched to the ops of the tenant, got %v", ops)
+	}
+	if builder, _ := w.linksOf(creative); builder.ActionLink("request", "op") != "https://creative.example.com/action/request?adm=op" {
+		t.Errorf("Expected the action link to point to the frontend of the tenant, got %q", builder.ActionLink("request", "op"))
+	}
+}
+
+func TestTenantRCONLocks(t *testing.T) {
+	viper.Set("tenants", map[string]interface{}{
+		"creative": map[string]interface{}{"RCONServer": "creative.example.com"},
+	})
+	defer viper.Set("tenants", nil)
+	release := make(chan struct{})
+	started := make(chan string, 2)
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		executor: CommandFunc(func(command string) (string, error) {
+			started <- command
+			if command == "save-all" {
+				<-release
+			}
+			return "", nil
+		}),
+		tenantExecutors: map[string]RCONExecutor{"creative": &fakeRCON{}},
+	}
+	done := make(chan error, 3)
+	issue := func(cfg tenant.Config, command string) {
+		go func() {
+			_, err := w.issueTenantRCON(cfg, command)
+			done <- err
+		}()
+	}
+	issue(tenant.Config{}, "save-all")
+	<-started
+	issue(tenant.Config{}, "whitelist add steve")
+	issue(tenant.Config{ID: "creative"}, "whitelist add alex")
+	// The game server of another tenant is not held up
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatal("Expected the command of a tenant not to wait for the game server of another tenant")
+	}
+	// Commands to the same game server wait for the one it stalls on
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case command := <-started:
+		t.Errorf("Expected %q to wait for the command the game server stalls on", command)
+	default:
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fakeOutbox keeps outbox entries in memory. Entries of held requests are claimed by another relay
+type fakeOutbox struct {
+	entries []*types.OutboxEntry
+	held    map[primitive.ObjectID]bool
+}
+
+func (o *fakeOutbox) append(requestID primitive.ObjectID, sequence int64, body string) {
+	o.entries = append(o.entries, &types.OutboxEntry{
+		ID:        primitive.NewObjectID(),
+		RequestID: requestID,
+		Sequence:  sequence,
+		Body:      []byte(body),
+		CreatedAt: time.Now().Add(-time.Duration(100-len(o.entries)) * time.Second),
+	})
+}
+
+func (o *fakeOutbox) ClaimOutboxEntry(owner string, lease time.Duration, skip []primitive.ObjectID) (types.OutboxEntry, error) {
+	skipped := map[primitive.ObjectID]bool{}
+	for _, id := range skip {
+		skipped[id] = true
+	}
+	for _, entry := range o.entries {
+		if entry.SentAt != nil || entry.LeaseOwner != "" || skipped[entry.RequestID] || o.held[entry.ID] {
+			continue
+		}
+		entry.LeaseOwner = owner
+		entry.Attempts++
+		return *entry, nil
+	}
+	return types.OutboxEntry{}, mongo.ErrNoDocuments
+}
+
+func (o *fakeOutbox) HasUnsentOutboxEntryBefore(entry types.OutboxEntry) (bool, error) {
+	for _, other := range o.entries {
+		if other.RequestID == entry.RequestID && other.SentAt == nil && other.Sequence < entry.Sequence {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (o *fakeOutbox) MarkOutboxEntrySent(id primitive.ObjectID, owner string, sentAt time.Time) error {
+	for _, entry := range o.entries {
+		if entry.ID == id && entry.LeaseOwner == owner {
+			entry.SentAt = &sentAt
+			entry.LeaseOwner = ""
+			return nil
+		}
+	}
+	return mongo.ErrNoDocuments
+}
+
+func (o *fakeOutbox) ReleaseOutboxEntry(id primitive.ObjectID, owner string) error {
+	for _, entry := range o.entries {
+		if entry.ID == id && entry.LeaseOwner == owner {
+			entry.LeaseOwner = ""
+		}
+	}
+	return nil
+}
+
+func (o *fakeOutbox) OutboxBacklog() (int64, time.Time, error) {
+	var pending int64
+	var oldest time.Time
+	for _, entry := range o.entries {
+		if entry.SentAt == nil {
+			if pending == 0 {
+				oldest = entry.CreatedAt
+			}
+			pending++
+		}
+	}
+	return pending, oldest, nil
+}
+
+// confirmingChannel records publications and confirms them right away, or nacks them if failing
+type confirmingChannel struct {
+	published []string
+	headers   []amqp.Table
+	confirms  chan amqp.Confirmation
+	failing   bool
+}
+
+func (c *confirmingChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.published = append(c.published, string(msg.Body))
+	c.headers = append(c.headers, msg.Headers)
+	c.confirms <- amqp.Confirmation{DeliveryTag: uint64(len(c.published)), Ack: !c.failing}
+	return nil
+}
+
+func TestRelayOutboxKeepsRequestsInOrder(t *testing.T) {
+	first, second := primitive.NewObjectID(), primitive.NewObjectID()
+	outbox := &fakeOutbox{held: map[primitive.ObjectID]bool{}}
+	outbox.append(first, 1, "first-1")
+	outbox.append(second, 1, "second-1")
+	outbox.append(first, 2, "first-2")
+	outbox.append(second, 2, "second-2")
+	// The first task of the second request is being published by another relay
+	outbox.held[outbox.entries[1].ID] = true
+
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	w := &Worker{
+		logger:    logrus.New().WithField("origin", "worker"),
+		publisher: newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:  topology.FromConfig(),
+		outbox:    outbox,
+		relayID:   "relay1",
+	}
+	published, err := w.relayOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published != 2 || strings.Join(channel.published, ",") != "first-1,first-2" {
+		t.Fatalf("expected the tasks of the second request to wait for the other relay, got %v", channel.published)
+	}
+	if outbox.entries[3].LeaseOwner != "" {
+		t.Error("expected the skipped entry to be released")
+	}
+	pending, oldest, _ := outbox.OutboxBacklog()
+	if pending != 2 || oldest != outbox.entries[1].CreatedAt {
+		t.Errorf("expected the tasks of the second request to be pending, got %d since %s", pending, oldest)
+	}
+
+	// The other relay went away before publishing, its lease expired
+	delete(outbox.held, outbox.entries[1].ID)
+	channel.failing = true
+	if _, err := w.relayOutbox(); err == nil {
+		t.Fatal("expected nacked publication to fail")
+	}
+	if outbox.entries[1].SentAt != nil || outbox.entries[1].LeaseOwner != "" {
+		t.Error("expected the entry to be released for the next poll")
+	}
+	channel.failing = false
+	channel.published = nil
+	channel.confirms = make(chan amqp.Confirmation, 10)
+	w.publisher = newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second)
+	if _, err := w.relayOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(channel.published, ",") != "second-1,second-2" {
+		t.Errorf("expected the tasks of the second request in order, got %v", channel.published)
+	}
+	if pending, _, _ := outbox.OutboxBacklog(); pending != 0 {
+		t.Errorf("expected every entry to be sent, got %d pending", pending)
+	}
+}
+
+func TestProxyBackend(t *testing.T) {
+	var actions []proxy.Action
+	failing := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token1" || failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var action proxy.Action
+		json.NewDecoder(r.Body).Decode(&action)
+		actions = append(actions, action)
+	}))
+	defer ts.Close()
+	viper.Set("tenants", map[string]interface{}{
+		"network": map[string]interface{}{
+			"serverBackend":      "http",
+			"serverBackendURL":   ts.URL,
+			"serverBackendToken": "token1",
+		},
+	})
+	defer viper.Set("tenants", nil)
+	if err := ValidateServerBackends(); err != nil {
+		t.Fatal(err)
+	}
+	gameServer := &fakeRCON{}
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	w := &Worker{
+		logger:            logrus.New().WithField("origin", "worker"),
+		sendMail:          func(string, interface{}, string, string) error { return nil },
+		executor:          gameServer,
+		publisher:         newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:          topology.FromConfig(),
+		requestCache:      &fakeRequestCache{banned: make(map[string]bool)},
+		processedRequests: make(fakeProcessed),
+		processedTasks:    &fakeLedger{processed: make(map[string]bool)},
+		appliedSequences:  &fakeSequences{},
+	}
+	process := func(serverID, status string) *recordingAcknowledger {
+		request := types.WhitelistRequest{ID: primitive.NewObjectID(), ServerID: serverID, Username: "steve",
+			Email: "steve@gmail.com", Status: status}
+		body, _ := json.Marshal(request)
+		acknowledger := &recordingAcknowledger{}
+		w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body})
+		return acknowledger
+	}
+	process("network", types.StatusApproved)
+	process("network", types.StatusBanned)
+	if len(actions) != 2 || actions[0].Action != proxy.ActionWhitelist || actions[1].Action != proxy.ActionBan || actions[0].Username != "steve" {
+		t.Errorf("Expected the decisions to be sent to the proxy, got %+v", actions)
+	}
+	if len(gameServer.commands) != 0 {
+		t.Errorf("Expected no RCON command for the tenant behind the proxy, got %v", gameServer.commands)
+	}
+	process("", types.StatusApproved)
+	if strings.Join(gameServer.commands, ";") != "whitelist add steve" {
+		t.Errorf("Expected the default tenant to keep using RCON, got %v", gameServer.commands)
+	}
+
+	// Failed actions are retried like failed commands
+	failing = true
+	process("network", types.StatusDeactivated)
+	if len(channel.published) != 1 || len(actions) != 2 {
+		t.Errorf("Expected the task to be republished for a retry, got %d publications", len(channel.published))
+	}
+
+	viper.Set("tenants.network.serverBackendToken", "")
+	if err := ValidateServerBackends(); err == nil || !strings.Contains(err.Error(), "network") {
+		t.Errorf("Expected the http backend of the tenant to require a token, got %v", err)
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gameserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set("tenants", map[string]interface{}{
+		"creative": map[string]interface{}{
+			"serverBackend":    "file",
+			"serverBackendDir": dir,
+		},
+	})
+	defer viper.Set("tenants", nil)
+	if err := ValidateServerBackends(); err != nil {
+		t.Fatal(err)
+	}
+	gameServer := &fakeRCON{}
+	w := &Worker{
+		logger:            logrus.New().WithField("origin", "worker"),
+		sendMail:          func(string, interface{}, string, string) error { return nil },
+		executor:          gameServer,
+		requestCache:      &fakeRequestCache{banned: make(map[string]bool)},
+		processedRequests: make(fakeProcessed),
+		processedTasks:    &fakeLedger{processed: make(map[string]bool)},
+		appliedSequences:  &fakeSequences{},
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), ServerID: "creative", Username: "steve",
+		UUID: "8667ba71b85a4004af54457a9734eed7", Email: "steve@gmail.com", Status: types.StatusApproved}
+	body, _ := json.Marshal(request)
+	acknowledger := &recordingAcknowledger{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body})
+	whitelist, _ := ioutil.ReadFile(filepath.Join(dir, "whitelist.json"))
+	if acknowledger.acks != 1 || !strings.Contains(string(whitelist), `"8667ba71-b85a-4004-af54-457a9734eed7"`) {
+		t.Errorf("Expected the player to be added to the whitelist file, got %s", whitelist)
+	}
+	if len(gameServer.commands) != 0 {
+		t.Errorf("Expected no RCON command for the tenant managed through its files, got %v", gameServer.commands)
+	}
+
+	viper.Set("tenants.creative.serverBackendDir", filepath.Join(dir, "missing"))
+	if err := ValidateServerBackends(); err == nil || !strings.Contains(err.Error(), "creative") {
+		t.Errorf("Expected the file backend of the tenant to require the game server directory, got %v", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	viper.Set("rconBreakerThreshold", 2)
+	defer viper.Set("rconBreakerThreshold", nil)
+	var commands []string
+	down := true
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		executor: CommandFunc(func(command string) (string, error) {
+			commands = append(commands, command)
+			if down {
+				return "", errors.New("connection refused")
+			}
+			return "done", nil
+		}),
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := w.issueRCON("whitelist add steve"); err == nil || err == errCircuitOpen {
+			t.Fatalf("Expected the command to fail on the game server, got %v", err)
+		}
+	}
+	_, err := w.issueRCON("whitelist add steve")
+	if err != errCircuitOpen || len(commands) != 2 {
+		t.Fatalf("Expected commands not to be issued once the circuit is open, got %v after %v", err, commands)
+	}
+	if w.openCircuits() == nil {
+		t.Error("Expected the open circuit to fail the readiness check")
+	}
+
+	// Probe fails after the cooldown, the circuit opens again
+	breaker := w.breakerFor(tenant.Default)
+	later := time.Now().Add(defaultRCONBreakerCooldown)
+	breaker.now = func() time.Time { return later }
+	_, err = w.issueRCON("whitelist add steve")
+	if err != errCircuitOpen || fmt.Sprint(commands[2:]) != "[list]" {
+		t.Fatalf("Expected the game server to be probed, got %v after %v", err, commands)
+	}
+	if _, err = w.issueRCON("whitelist add steve"); err != errCircuitOpen {
+		t.Fatalf("Expected the circuit to open again, got %v", err)
+	}
+
+	down = false
+	later = later.Add(defaultRCONBreakerCooldown)
+	response, err := w.issueRCON("whitelist add steve")
+	if err != nil || response != "done" || fmt.Sprint(commands[3:]) != "[list whitelist add steve]" {
+		t.Fatalf("Expected the command to be issued once the probe succeeded, got %q, %v after %v", response, err, commands)
+	}
+	if w.openCircuits() != nil {
+		t.Error("Expected the circuit to be closed")
+	}
+}
+
+func TestRCONTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	hanging := CommandFunc(func(command string) (string, error) {
+		<-release
+		return "", nil
+	})
+	_, err := sendCommand(hanging, "whitelist add steve", 10*time.Millisecond)
+	if err != errRCONTimeout {
+		t.Errorf("Expected the command to time out, got %v", err)
+	}
+}
+
+func TestRunActionRejectsInvalidUsername(t *testing.T) {
+	var commands []string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		executor: CommandFunc(func(command string) (string, error) {
+			commands = append(commands, command)
+			return "", nil
+		}),
+	}
+	for _, username := range []string{"Steve\nop Griefer", "Steve op", "St", "Stеve"} {
+		err := w.runAction(approveCommandKey, types.WhitelistRequest{Username: username})
+		if err != utils.ErrInvalidUsername {
+			t.Errorf("Expected %q to be rejected, got %v", username, err)
+		}
+	}
+	if len(commands) != 0 {
+		t.Errorf("Expected no command to be issued for invalid usernames, got %v", commands)
+	}
+
+	store := db.NewMemoryStore()
+	id, err := store.CreateRequest(types.WhitelistRequest{Username: "Steve op", Email: "steve@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _ := store.GetRequest(id)
+	w.store = store
+	w.requestCache = &fakeRequestCache{banned: make(map[string]bool)}
+	w.sendMail = func(templateName string, templateData interface{}, subject string, recipent string) error {
+		return nil
+	}
+	if !w.rejectInvalidUsername(request) {
+		t.Fatal("Expected the request with an invalid username to be denied")
+	}
+	denied, _ := store.GetRequest(id)
+	if denied.Status != types.StatusDenied || denied.DecisionReason != invalidUsernameDenialReason || denied.Admin != workerActor {
+		t.Errorf("Expected request to be denied for its invalid username, got %+v", denied)
+	}
+}
+
+type fakeRetryStore struct {
+	recorded []types.Retry
+	statuses map[primitive.ObjectID]string
+}
+
+func (s *fakeRetryStore) RecordRetry(retry types.Retry) error {
+	s.recorded = append(s.recorded, retry)
+	return nil
+}
+
+func (s *fakeRetryStore) ConsumeRetry(id primitive.ObjectID, now time.Time) (string, error) {
+	status, ok := s.statuses[id]
+	if !ok {
+		return "", mongo.ErrNoDocuments
+	}
+	if status == types.RetryParked || status == types.RetryForced {
+		s.statuses[id] = types.RetryConsumed
+	}
+	return status, nil
+}
+
+func TestRetryRecorded(t *testing.T) {
+	channel := &fakePublishChannel{}
+	confirms := make(chan amqp.Confirmation, 1)
+	store := &fakeRetryStore{}
+	w := &Worker{
+		logger:    logrus.New().WithField("origin", "worker"),
+		publisher: newPublisher(channel, confirms, make(chan amqp.Return), time.Second),
+		retries:   store,
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "user1"}
+	body, _ := json.Marshal(request)
+	acknowledger := &requeueAcknowledger{}
+	done := make(chan struct{})
+	go func() {
+		w.retryMsgWithDelay(amqp.Delivery{Acknowledger: acknowledger, Body: body}, "Whitelist user1 on the game server", errors.New("connection refused"), nil)
+		close(done)
+	}()
+	for {
+		w.publisher.mu.Lock()
+		published := len(w.publisher.pending)
+		w.publisher.mu.Unlock()
+		if published == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	<-done
+	if !acknowledger.acked || len(store.recorded) != 1 {
+		t.Fatalf("Expected the retry to be recorded, got %+v", store.recorded)
+	}
+	retry := store.recorded[0]
+	if retry.RequestID != request.ID.Hex() || retry.Attempt != 1 || retry.LastError != "connection refused" || retry.Status != types.RetryParked {
+		t.Errorf("Unexpected retry %+v", retry)
+	}
+	if channel.published[0].Headers[types.RetryIDHeader] != retry.ID.Hex() || retry.Headers[types.RetryIDHeader] != retry.ID.Hex() {
+		t.Errorf("Expected the retried message to carry the ID of the retry, got %v", channel.published[0].Headers)
+	}
+}
+
+func TestConsumeRetry(t *testing.T) {
+	parked, forced, abandoned := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	store := &fakeRetryStore{statuses: map[primitive.ObjectID]string{
+		parked:    types.RetryParked,
+		forced:    types.RetryForced,
+		abandoned: types.RetryAbandoned,
+	}}
+	w := &Worker{logger: logrus.New().WithField("origin", "worker"), retries: store}
+	for _, c := range []struct {
+		retryID string
+		process bool
+	}{
+		{"", true},
+		{parked.Hex(), true},
+		// Unknown, e.g not recorded
+		{primitive.NewObjectID().Hex(), true},
+		{abandoned.Hex(), false},
+		// The forced copy is processed, the original is dropped once it comes back
+		{forced.Hex(), true},
+		{forced.Hex(), false},
+	} {
+		acknowledger := &requeueAcknowledger{}
+		d := amqp.Delivery{Acknowledger: acknowledger, Headers: amqp.Table{types.RetryIDHeader: c.retryID}}
+		if process := w.consumeRetry(d); process != c.process || acknowledger.acked == c.process {
+			t.Errorf("Expected message of retry %q to be processed: %v, got %v", c.retryID, c.process, process)
+		}
+	}
+	if store.statuses[parked] != types.RetryConsumed {
+		t.Errorf("Expected the parked retry to be consumed, got %s", store.statuses[parked])
+	}
+}
+
+// fakeLeaderLock is the leader lock shared by the instances, taken if no instance holds it
+type fakeLeaderLock struct {
+	holder string
+}
+
+type fakeLeader struct {
+	lock     *fakeLeaderLock
+	instance string
+}
+
+func (l fakeLeader) IsLeader() bool {
+	if l.lock.holder == "" {
+		l.lock.holder = l.instance
+	}
+	return l.lock.holder == l.instance
+}
+
+func TestOnlyLeaderRunsSweeps(t *testing.T) {
+	lock := &fakeLeaderLock{}
+	logger := logrus.New().WithField("origin", "worker")
+	first := &Worker{logger: logger, leader: fakeLeader{lock, "first"}}
+	second := &Worker{logger: logger, leader: fakeLeader{lock, "second"}}
+	sweeps := make(map[*Worker]int)
+	sweep := func(w *Worker) func() error {
+		return func() error {
+			sweeps[w]++
+			return nil
+		}
+	}
+	for i := 0; i < 3; i++ {
+		first.runAsLeader("expire stale requests", sweep(first))
+		second.runAsLeader("expire stale requests", sweep(second))
+	}
+	if sweeps[first] != 3 || sweeps[second] != 0 {
+		t.Errorf("Expected only the leader to run the sweep, got %d and %d runs", sweeps[first], sweeps[second])
+	}
+
+	// The leader stops midway once another instance takes over
+	expired := 0
+	ran := first.runAsLeader("expire stale requests", func() error {
+		for i := 0; i < 3; i++ {
+			if !first.leading() {
+				return errLeadershipLost
+			}
+			expired++
+			lock.holder = "second"
+		}
+		return nil
+	})
+	if !ran || expired != 1 {
+		t.Errorf("Expected the sweep to stop once leadership is lost, expired %d", expired)
+	}
+	first.runAsLeader("expire stale requests", sweep(first))
+	second.runAsLeader("expire stale requests", sweep(second))
+	if sweeps[first] != 3 || sweeps[second] != 1 {
+		t.Errorf("Expected the new leader to run the sweep, got %d and %d runs", sweeps[first], sweeps[second])
+	}
+
+	// Instances without leader election always lead
+	if !(&Worker{}).leading() {
+		t.Error("Expected an instance without leader election to lead")
+	}
+}
+
+// fakeAvailability keeps the away ops in memory
+type fakeAvailability struct {
+	away []types.OpAway
+	err  error
+}
+
+func (a *fakeAvailability) GetAwayOps(now time.Time) ([]types.OpAway, error) {
+	away := make([]types.OpAway, 0)
+	for _, record := range a.away {
+		if record.AwayUntil.After(now) {
+			away = append(away, record)
+		}
+	}
+	return away, a.err
+}
+
+func TestAwayOpsLeftOutOfDispatch(t *testing.T) {
+	viper.Set("ops", []string{"Op1@gmail.com", "op2@gmail.com"})
+	viper.Set("dispatchingStrategy", "Broadcast")
+	defer viper.Set("ops", nil)
+	defer viper.Set("dispatchingStrategy", nil)
+	availability := &fakeAvailability{}
+	w := &Worker{logger: logrus.New().WithField("origin", "worker"), availability: availability}
+
+	availability.away = []types.OpAway{{Op: "op1@gmail.com", AwayUntil: time.Now().Add(time.Hour)}}
+	if ops := w.getTargetOps(tenant.Default); strings.Join(ops, ",") != "op2@gmail.com" {
+		t.Errorf("Expected away ops to be left out, got %v", ops)
+	}
+	availability.away = append(availability.away, types.OpAway{Op: "op2@gmail.com", AwayUntil: time.Now().Add(time.Hour)})
+	if ops := w.getTargetOps(tenant.Default); len(ops) != 2 {
+		t.Errorf("Expected every op to be dispatched to if all of them are away, got %v", ops)
+	}
+	// Ops marked back or no longer away are dispatched to again without a restart
+	availability.away = []types.OpAway{{Op: "op1@gmail.com", AwayUntil: time.Now().Add(-time.Minute)}}
+	if ops := w.getTargetOps(tenant.Default); len(ops) != 2 {
+		t.Errorf("Expected ops back to be dispatched to, got %v", ops)
+	}
+	availability.err = errors.New("unreachable")
+	if ops := w.getTargetOps(tenant.Default); len(ops) != 2 {
+		t.Errorf("Expected every op to be dispatched to if away ops can not be told, got %v", ops)
+	}
+
+	remaining, removed := withoutAwayOps([]string{"OP1@gmail.com", "op2@gmail.com"}, map[string]bool{"op1@gmail.com": true})
+	if strings.Join(remaining, ",") != "op2@gmail.com" || strings.Join(removed, ",") != "OP1@gmail.com" {
+		t.Errorf("Expected the away op to be removed from the assignees, got %v and %v", remaining, removed)
+	}
+	if ops := excludingOps([]string{"op1@gmail.com", "op3@gmail.com"}, []string{"Op1@gmail.com"}); strings.Join(ops, ",") != "op3@gmail.com" {
+		t.Errorf("Expected assigned ops to be excluded, got %v", ops)
+	}
+}
+
+func TestBansProcessedBeforeNewRequests(t *testing.T) {
+	delivery := make(chan amqp.Delivery, 3)
+	highPriorityDelivery := make(chan amqp.Delivery, 2)
+	task := func(username, status string) amqp.Delivery {
+		body, _ := json.Marshal(types.WhitelistRequest{Username: username, Status: status})
+		headers := amqp.Table{}
+		types.SignMessage(headers, body, time.Now(), utils.PassphraseSecrets().Primary)
+		return amqp.Delivery{Body: body, Headers: headers}
+	}
+	for _, username := range []string{"steve", "alex", "notch"} {
+		delivery <- task(username, types.StatusPending)
+	}
+	highPriorityDelivery <- task("griefer", types.StatusBanned)
+	highPriorityDelivery <- task("vandal", types.StatusDeactivated)
+
+	processed := make(chan string, 5)
+	w := &Worker{
+		logger:               logrus.New().WithField("origin", "worker"),
+		delivery:             delivery,
+		highPriorityDelivery: highPriorityDelivery,
+		seenMessages:         fakeMessageLedger{},
+		lanes: newLanes(1, 5, func(d amqp.Delivery) {
+			request, _, _ := deserialize(d.Body)
+			processed <- request.Status
+		}),
+	}
+	go w.runLoop()
+	order := make([]string, 0, 5)
+	for len(order) < 5 {
+		select {
+		case status := <-processed:
+			order = append(order, status)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected every task to be processed, got %v", order)
+		}
+	}
+	if strings.Join(order, ",") != "Banned,Deactivated,Pending,Pending,Pending" {
+		t.Errorf("Expected bans and deactivations to be processed first, got %v", order)
+	}
+}
+
+// fakeBounces keeps the suppressed addresses, recorded Message-IDs and undeliverable requests in memory
+type fakeBounces struct {
+	suppressed    map[string]bool
+	messageIDs    map[primitive.ObjectID][]string
+	undeliverable map[primitive.ObjectID]string
+}
+
+func (b *fakeBounces) EmailSuppressed(email string) (bool, error) {
+	return b.suppressed[strings.ToLower(email)], nil
+}
+
+func (b *fakeBounces) RecordMessageID(id primitive.ObjectID, messageID string) error {
+	b.messageIDs[id] = append(b.messageIDs[id], messageID)
+	return nil
+}
+
+func (b *fakeBounces) MarkRequestEmailUndeliverable(id primitive.ObjectID, reason string) error {
+	b.undeliverable[id] = reason
+	return nil
+}
+
+func TestRejectedAddressNotRetried(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	bounces := &fakeBounces{messageIDs: make(map[primitive.ObjectID][]string), undeliverable: make(map[primitive.ObjectID]string)}
+	ledger := &fakeLedger{processed: make(map[string]bool)}
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	var sendErr error
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendTrackedMail: func(templateName string, templateData interface{}, subject string, recipent string) (string, error) {
+			return "", sendErr
+		},
+		requestCache:        &fakeRequestCache{banned: make(map[string]bool)},
+		processedRequests:   make(fakeProcessed),
+		processedTasks:      ledger,
+		appliedSequences:    &fakeSequences{},
+		publisher:           newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:            topology.FromConfig(),
+		failedNotifications: &fakeFailedNotifications{},
+		bounces:             bounces,
+	}
+
+	// Transient failures are retried
+	sendErr = &mailer.ErrTransient{Code: 421, Err: errors.New("421 try again later")}
+	denial := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Alex", Email: "alex@gmail.com", Status: types.StatusDenied}
+	body, _ := json.Marshal(denial)
+	acknowledger := &recordingAcknowledger{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body})
+	if len(channel.headers) != 1 || ledger.processed[requestTaskKey(denial)] || len(bounces.undeliverable) != 0 {
+		t.Fatalf("Expected the denial email to be retried, got %d retries", len(channel.headers))
+	}
+
+	// Addresses rejected for good flag the request and are not retried
+	sendErr = &mailer.ErrPermanent{Code: 550, Recipient: true, Err: errors.New("550 no such user")}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: []byte(channel.published[0]), Headers: channel.headers[0]})
+	if len(channel.headers) != 1 || !ledger.processed[requestTaskKey(denial)] {
+		t.Errorf("Expected the task to be completed without retrying the email, got %d retries", len(channel.headers))
+	}
+	if bounces.undeliverable[denial.ID] != "550 no such user" {
+		t.Errorf("Expected the request to be flagged undeliverable, got %v", bounces.undeliverable)
+	}
+}
+
+func TestOpsDispatchPausedWhileMailFails(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	viper.Set("ops", []interface{}{"op1@gmail.com", "op2@gmail.com"})
+	viper.Set("ownerEmail", "owner@gmail.com")
+	defer viper.Set("ops", nil)
+	defer viper.Set("ownerEmail", nil)
+	failures := mailer.NewFailureRate(time.Hour)
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	var sent []string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			sent = append(sent, recipent)
+			return errors.New("535 authentication failed")
+		},
+		publisher:    newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:     topology.FromConfig(),
+		mailFailures: failures,
+		queueMonitor: newQueueMonitor(),
+	}
+	for i := 0; i < minMailFailureSamples; i++ {
+		failures.Record(&mailer.ErrPermanent{Code: 535, Err: errors.New("535 authentication failed")})
+	}
+	// Rejected addresses do not lower the failure rate of the setup
+	failures.Record(&mailer.ErrPermanent{Code: 550, Recipient: true, Err: errors.New("550 no such user")})
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Status: types.StatusPending}
+	body, _ := json.Marshal(request)
+	headers := amqp.Table{types.SkipConfirmationHeader: true, retryCountHeader: int32(1)}
+	for i := 0; i < 2; i++ {
+		acknowledger := &recordingAcknowledger{}
+		w.processNewRequest(context.Background(), amqp.Delivery{Acknowledger: acknowledger, Body: body, Headers: headers}, request)
+		if acknowledger.acks != 1 || len(channel.headers) != i+1 || headerInt(channel.headers[i], retryCountHeader) != 1 {
+			t.Fatalf("Expected the task to be deferred without using up a retry, got %v", channel.headers)
+		}
+	}
+	// Only the owner is alerted, once
+	if strings.Join(sent, ",") != "owner@gmail.com" {
+		t.Errorf("Expected no op to be emailed and the owner to be alerted once, got %v", sent)
+	}
+
+	viper.Set("mailFailureRateThreshold", 0)
+	defer viper.Set("mailFailureRateThreshold", nil)
+	if _, failing := w.mailFailing(); failing {
+		t.Error("Expected the pause to be disabled")
+	}
+}
+
+func TestBouncedAddressNotEmailed(t *testing.T) {
+	bounces := &fakeBounces{suppressed: map[string]bool{"alex@gmail.com": true}, messageIDs: make(map[primitive.ObjectID][]string)}
+	sent := make([]string, 0)
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendTrackedMail: func(templateName string, templateData interface{}, subject string, recipent string) (string, error) {
+			sent = append(sent, recipent)
+			return fmt.Sprintf("%d@example.com", len(sent)), nil
+		},
+		bounces: bounces,
+	}
+	steve := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "steve", Email: "steve@gmail.com", Status: types.StatusApproved}
+	alex := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "alex", Email: "Alex@gmail.com", Status: types.StatusApproved}
+	for _, request := range []types.WhitelistRequest{steve, alex} {
+		if err := w.emailConfirmation(request, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.emailDecision(request, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(sent, ",") != "steve@gmail.com,steve@gmail.com" {
+		t.Errorf("Expected no email to the address emails bounced from, got %v", sent)
+	}
+	if ids := bounces.messageIDs[steve.ID]; strings.Join(ids, ",") != "1@example.com,2@example.com" {
+		t.Errorf("Expected the Message-IDs to be recorded on the request, got %v", ids)
+	}
+
+	// Requests flagged undeliverable are not emailed even if the address is not suppressed
+	steve.EmailUndeliverable = true
+	w.emailDecision(steve, false)
+	if len(sent) != 2 {
+		t.Errorf("Expected no email to a request flagged undeliverable, got %v", sent)
+	}
+}
+
+func TestMessageVerification(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	channel := &fakePublishChannel{}
+	confirms := make(chan amqp.Confirmation, 1)
+	p := newPublisher(channel, confirms, make(chan amqp.Return), time.Second)
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	body, _ := types.EncodeRequestMessage(types.WhitelistRequest{Username: "Steve", Status: types.StatusApproved})
+	// Retries are signed as of the time they come back from the retry queue
+	err := p.publish("retry.ex", "", amqp.Publishing{Headers: amqp.Table{}, Body: body, Expiration: "60000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := channel.published[0]
+	if signedAt, _ := published.Headers[types.SignedAtHeader].(int64); signedAt < time.Now().Add(59*time.Second).Unix() {
+		t.Errorf("Expected the retry to be signed as of the end of its delay, got %d", signedAt)
+	}
+
+	w := &Worker{
+		logger:       logrus.New().WithField("origin", "worker"),
+		seenMessages: fakeMessageLedger{},
+	}
+	verify := func(headers amqp.Table, body []byte, redelivered bool) bool {
+		ack := &recordingAcknowledger{}
+		ok := w.verifyMessage(amqp.Delivery{Acknowledger: ack, Headers: headers, Body: body, Redelivered: redelivered})
+		if ok == (ack.nacks == 1) {
+			t.Errorf("Expected rejected messages and only them to be dead-lettered")
+		}
+		return ok
+	}
+	if !verify(published.Headers, body, false) {
+		t.Error("Expected a message signed by the worker to be accepted")
+	}
+	if verify(published.Headers, body, false) {
+		t.Error("Expected a replayed message to be rejected")
+	}
+	if !verify(published.Headers, body, true) {
+		t.Error("Expected a redelivered message to be accepted")
+	}
+	crafted, _ := types.EncodeRequestMessage(types.WhitelistRequest{Username: "Griefer", Status: types.StatusApproved})
+	if verify(published.Headers, crafted, false) {
+		t.Error("Expected a message with another body to be rejected")
+	}
+	if verify(amqp.Table{}, crafted, false) {
+		t.Error("Expected an unsigned message to be rejected")
+	}
+	viper.Set("acceptUnsignedMessages", true)
+	if !verify(amqp.Table{}, crafted, false) {
+		t.Error("Expected an unsigned message to be accepted while rolling out signing")
+	}
+	viper.Set("acceptUnsignedMessages", nil)
+
+	viper.Set("messageMaxAgeMinutes", 60)
+	defer viper.Set("messageMaxAgeMinutes", nil)
+	old := amqp.Table{}
+	types.SignMessage(old, body, time.Now().Add(-2*time.Hour), "passphrase")
+	if verify(old, body, false) {
+		t.Error("Expected a message signed longer ago than messageMaxAgeMinutes to be rejected")
+	}
+}
+
+// countingCache counts the db queries refreshing cached requests and the stats updates, which take a while
+type countingCache struct {
+	fakeRequestCache
+	mu           sync.Mutex
+	queries      int
+	statsUpdates int
+	stats        cache.StatsDelta
+	latency      time.Duration
+}
+
+func (c *countingCache) RefreshRequests(ids ...primitive.ObjectID) error {
+	time.Sleep(c.latency)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queries++
+	c.refreshed = append(c.refreshed, ids...)
+	return nil
+}
+
+func (c *countingCache) ApplyStatsDelta(serverID string, delta cache.StatsDelta) error {
+	time.Sleep(c.latency)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statsUpdates++
+	c.stats.Add(delta)
+	return nil
+}
+
+// burst processes the cache updates of a burst of approvals concurrently, like the lanes of the worker
+func burst(w *Worker, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.updateCache(types.WhitelistRequest{ID: primitive.NewObjectID(), Status: types.StatusApproved, Gender: "female"})
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCacheUpdatesCoalesced(t *testing.T) {
+	requestCache := &countingCache{latency: 5 * time.Millisecond}
+	w := &Worker{
+		logger:       logrus.New().WithField("origin", "worker"),
+		requestCache: requestCache,
+		refresher:    newRequestRefresher(requestCache.RefreshRequests),
+	}
+	w.stats = newStatsBatcher(requestCache.ApplyStatsDelta, w.logger)
+	burst(w, 100)
+	if len(requestCache.refreshed) != 100 {
+		t.Errorf("Expected every request to be refreshed, got %d", len(requestCache.refreshed))
+	}
+	if requestCache.queries >= 100 {
+		t.Errorf("Expected concurrent refreshes to share db queries, got %d queries", requestCache.queries)
+	}
+	w.stats.flush()
+	if requestCache.stats.Approved != 100 || requestCache.stats.Pending != -100 || requestCache.stats.FemaleCount != 100 {
+		t.Errorf("Expected the stats changes of every approval to be applied, got %+v", requestCache.stats)
+	}
+	if requestCache.statsUpdates != 1 {
+		t.Errorf("Expected the stats changes to be applied at once, got %d updates", requestCache.statsUpdates)
+	}
+	// Stats are applied once a batch is full without waiting for the interval
+	go w.stats.run(time.Hour)
+	for i := 0; i < statsBatchSize; i++ {
+		w.stats.add("", cache.StatsDeltaOf(types.WhitelistRequest{Status: types.StatusPending}))
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		requestCache.mu.Lock()
+		pending := requestCache.stats.Pending
+		requestCache.mu.Unlock()
+		if pending == statsBatchSize-100 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a full batch to be applied right away, got %d pending", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BenchmarkCacheUpdateBurst compares the db queries refreshing cached requests and the stats updates made by a
+// burst of 100 approvals, with every task updating the cache on its own and with shared refreshes and batched stats
+func BenchmarkCacheUpdateBurst(b *testing.B) {
+	for _, coalesced := range []bool{false, true} {
+		name := "direct"
+		if coalesced {
+			name = "coalesced"
+		}
+		b.Run(name, func(b *testing.B) {
+			requestCache := &countingCache{latency: time.Millisecond}
+			w := &Worker{
+				logger:       logrus.New().WithField("origin", "worker"),
+				requestCache: requestCache,
+			}
+			if coalesced {
+				w.refresher = newRequestRefresher(requestCache.RefreshRequests)
+				w.stats = newStatsBatcher(requestCache.ApplyStatsDelta, w.logger)
+			}
+			for i := 0; i < b.N; i++ {
+				burst(w, 100)
+				if w.stats != nil {
+					w.stats.flush()
+				}
+			}
+			b.Logf("%d bursts: %d db queries, %d stats updates", b.N, requestCache.queries, requestCache.statsUpdates)
+		})
+	}
+}
+
+func TestBulkNoticesCoalesced(t *testing.T) {
+	sent := make(chan webhook.Event, 4)
+	notifier := newBulkNotifier(func(event webhook.Event) { sent <- event }, 50*time.Millisecond)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		notifier.add("bulk1", webhook.StatusChange{Username: username, Status: types.StatusApproved})
+	}
+	notifier.add("bulk2", webhook.StatusChange{Username: "dave", Status: types.StatusDenied})
+	notifier.flushAll()
+	summaries := make(map[string]webhook.BulkDecision)
+	for i := 0; i < 2; i++ {
+		event := <-sent
+		if event.Event != webhook.BulkDecisionEvent {
+			t.Fatalf("expected a %s event, got %s", webhook.BulkDecisionEvent, event.Event)
+		}
+		decision := event.Data.(webhook.BulkDecision)
+		summaries[decision.BulkID] = decision
+	}
+	if len(summaries["bulk1"].Changes) != 3 || summaries["bulk1"].Status != types.StatusApproved {
+		t.Errorf("expected the 3 approvals in one summary, got %+v", summaries["bulk1"])
+	}
+	if len(summaries["bulk2"].Changes) != 1 || summaries["bulk2"].Status != types.StatusDenied {
+		t.Errorf("expected the denial in its own summary, got %+v", summaries["bulk2"])
+	}
+
+	// Without flushing, the summary is sent once the delay passed
+	notifier.add("bulk3", webhook.StatusChange{Username: "erin", Status: types.StatusApproved})
+	select {
+	case event := <-sent:
+		if decision := event.Data.(webhook.BulkDecision); decision.BulkID != "bulk3" {
+			t.Errorf("expected the summary of bulk3, got %+v", decision)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the summary after the delay")
+	}
+	select {
+	case event := <-sent:
+		t.Errorf("expected a single summary per bulk decision, got %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBanAlerts(t *testing.T) {
+	viper.Set("maxRetries", 3)
+	defer viper.Set("maxRetries", nil)
+	messages := make(chan telegram.Message, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message telegram.Message
+		json.NewDecoder(r.Body).Decode(&message)
+		messages <- message
+		// The Bot API is down, which must not affect the task
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	}))
+	defer ts.Close()
+	executor := &fakeRCON{failing: map[string]bool{"ban Alex": true}}
+	ledger := &fakeLedger{processed: make(map[string]bool)}
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			return nil
+		},
+		executor:          executor,
+		requestCache:      &fakeRequestCache{banned: make(map[string]bool)},
+		processedRequests: make(fakeProcessed),
+		processedTasks:    ledger,
+		appliedSequences:  &fakeSequences{},
+		banAlerts:         telegram.NewClient(ts.URL, "123:abc", "-1001", nil),
+	}
+
+	steve := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Email: "steve@gmail.com",
+		Status: types.StatusBanned, Admin: "op1@gmail.com"}
+	body, _ := json.Marshal(steve)
+	acknowledger := &recordingAcknowledger{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body})
+	if acknowledger.acks != 1 || acknowledger.nacks != 0 || !ledger.processed[requestTaskKey(steve)] {
+		t.Fatalf("expected the ban to be completed despite the failing alert, got %d acks and %d nacks", acknowledger.acks, acknowledger.nacks)
+	}
+	select {
+	case message := <-messages:
+		expected := "Steve is banned on the game server. Request " + steve.ID.Hex() + ", banned by op1@gmail.com"
+		if message.ChatID != "-1001" || message.Text != expected {
+			t.Errorf("expected the ban to be confirmed, got %+v", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the ban to be confirmed")
+	}
+
+	// Failed bans are only told once their retries are exhausted
+	alex := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Alex", Status: types.StatusBanned}
+	body, _ = json.Marshal(alex)
+	acknowledger = &recordingAcknowledger{}
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body, Headers: amqp.Table{retryCountHeader: int32(3)}})
+	if acknowledger.acks != 0 || acknowledger.nacks != 1 {
+		t.Fatalf("expected the ban to be dead lettered, got %d acks and %d nacks", acknowledger.acks, acknowledger.nacks)
+	}
+	select {
+	case message := <-messages:
+		if !strings.HasPrefix(message.Text, "Ban of Alex FAILED on the game server: ") {
+			t.Errorf("expected the failed ban to be told, got %+v", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the failed ban to be told")
+	}
+	select {
+	case message := <-messages:
+		t.Errorf("expected a single alert per outcome, got %+v", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// blockingRCON hangs every command until released
+type blockingRCON struct {
+	release chan struct{}
+}
+
+func (r *blockingRCON) SendCommand(command string) (string, error) {
+	<-r.release
+	return "", nil
+}
+
+func TestTaskDeadline(t *testing.T) {
+	viper.Set("taskTimeoutSeconds", 1)
+	defer viper.Set("taskTimeoutSeconds", nil)
+	executor := &blockingRCON{release: make(chan struct{})}
+	channel := &confirmingChannel{confirms: make(chan amqp.Confirmation, 10)}
+	mailed := make(chan bool, 1)
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			mailed <- true
+			return nil
+		},
+		executor:          executor,
+		requestCache:      &fakeRequestCache{banned: make(map[string]bool)},
+		processedRequests: make(fakeProcessed),
+		processedTasks:    &fakeLedger{processed: make(map[string]bool)},
+		appliedSequences:  &fakeSequences{},
+		publisher:         newPublisher(channel, channel.confirms, make(chan amqp.Return), time.Second),
+		topology:          topology.FromConfig(),
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Email: "steve@gmail.com", Status: types.StatusApproved}
+	body, _ := json.Marshal(request)
+	acknowledger := &recordingAcknowledger{}
+	start := time.Now()
+	w.process(amqp.Delivery{Acknowledger: acknowledger, Body: body})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the task to be given up after its deadline, took %s", elapsed)
+	}
+	if len(channel.published) != 1 || headerInt(channel.headers[0], retryCountHeader) != 1 || acknowledger.acks != 1 {
+		t.Fatalf("expected the hung task to be retried, got %d retries and %d acks", len(channel.published), acknowledger.acks)
+	}
+
+	// The hung task finishing later must not settle the delivery again
+	close(executor.release)
+	select {
+	case <-mailed:
+	case <-time.After(time.Second):
+		t.Fatal("expected the hung task to finish once released")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if acknowledger.acks != 1 || acknowledger.nacks != 0 {
+		t.Errorf("expected the delivery to be settled once, got %d acks and %d nacks", acknowledger.acks, acknowledger.nacks)
+	}
+}
+
+func TestTaskLogger(t *testing.T) {
+	w := &Worker{logger: logrus.New().WithField("origin", "worker")}
+	if _, ok := w.taskLogger(context.Background()).Data["taskID"]; ok {
+		t.Error("expected no task ID outside of tasks")
+	}
+	first, second := withTaskID(context.Background()), withTaskID(context.Background())
+	id := w.taskLogger(first).Data["taskID"]
+	if id == nil || id != taskIDOf(first) || id == taskIDOf(second) {
+		t.Errorf("expected a task ID per task in the logs, got %v", id)
+	}
+}
+
+// fakeReferrals holds the requests of referrers and records the referrals and denials
+type fakeReferrals struct {
+	requests map[string][]types.WhitelistRequest
+	updates  []types.Referral
+	denied   []db.StatusChange
+}
+
+func (f *fakeReferrals) QueryRequests(filter db.RequestFilter) ([]types.WhitelistRequest, error) {
+	return f.requests[strings.ToLower(filter.Username)], nil
+}
+
+func (f *fakeReferrals) SetReferral(id primitive.ObjectID, referral types.Referral) error {
+	f.updates = append(f.updates, referral)
+	return nil
+}
+
+func (f *fakeReferrals) TransitionStatus(id primitive.ObjectID, change db.StatusChange) (types.WhitelistRequest, error) {
+	f.denied = append(f.denied, change)
+	return types.WhitelistRequest{ID: id, Status: change.To, DecisionReason: change.Reason}, nil
+}
+
+func TestReferralShownToOps(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	member := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Alex", Status: types.StatusApproved}
+	referrals := &fakeReferrals{requests: map[string][]types.WhitelistRequest{
+		"alex":  {member},
+		"notch": {{Username: "Notch", Status: types.StatusApproved}, {Username: "Notch", Status: types.StatusBanned}},
+	}}
+	var data map[string]interface{}
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			data = templateData.(map[string]interface{})
+			return nil
+		},
+		referrals: referrals,
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Status: types.StatusPending, ReferrerUsername: "alex"}
+	request.Referral = w.checkReferral(request)
+	if request.Referral == nil || *request.Referral != (types.Referral{Standing: types.ReferrerMember, ReferrerRequestID: member.ID.Hex()}) {
+		t.Fatalf("expected the referrer to be a member, got %+v", request.Referral)
+	}
+	if len(referrals.updates) != 1 || referrals.updates[0] != *request.Referral {
+		t.Errorf("expected the referral to be recorded, got %v", referrals.updates)
+	}
+	if _, _, err := w.emailToOps(request, []string{"op1@gmail.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if data["referral"] != "Vouched for by alex, a member in good standing" {
+		t.Errorf("expected the referral in the ops email, got %v", data["referral"])
+	}
+
+	// Banned and unknown referrers flag the request, ops may still accept it
+	for referrer, standing := range map[string]string{"Notch": types.ReferrerBanned, "Herobrine": types.ReferrerUnknown, "steve": types.ReferrerUnknown} {
+		referrals.updates = nil
+		request.ReferrerUsername = referrer
+		request.Referral = w.checkReferral(request)
+		if request.Referral == nil || request.Referral.Standing != standing {
+			t.Errorf("expected %s to be %s, got %+v", referrer, standing, request.Referral)
+		}
+		if len(referrals.updates) != 1 || referrals.updates[0].Verified() {
+			t.Errorf("expected the request vouched for by %s to be recorded as unverified, got %v", referrer, referrals.updates)
+		}
+		if w.rejectUnverifiedReferral(request) {
+			t.Errorf("expected the request vouched for by %s not to be denied while referrals are optional", referrer)
+		}
+	}
+
+	// Without a referrer nothing is recorded
+	referrals.updates = nil
+	request.ReferrerUsername = ""
+	if referral := w.checkReferral(request); referral != nil || len(referrals.updates) != 0 {
+		t.Errorf("expected no referral without a referrer, got %+v", referral)
+	}
+}
+
+func TestReferralRequired(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	viper.Set("referralRequired", true)
+	defer viper.Set("referralRequired", nil)
+	referrals := &fakeReferrals{requests: map[string][]types.WhitelistRequest{
+		"alex":  {{Username: "Alex", Status: types.StatusApproved}},
+		"notch": {{Username: "Notch", Status: types.StatusBanned}},
+	}}
+	var templates []string
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			templates = append(templates, filepath.Base(templateName))
+			return nil
+		},
+		requestCache: &fakeRequestCache{banned: make(map[string]bool)},
+		referrals:    referrals,
+	}
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Email: "steve@gmail.com", Status: types.StatusPending}
+	for referrer, denied := range map[string]bool{"Alex": false, "Notch": true, "": true} {
+		referrals.denied, templates = nil, nil
+		request.ReferrerUsername = referrer
+		if w.rejectUnverifiedReferral(request) != denied {
+			t.Errorf("expected the request vouched for by %q to be denied: %v", referrer, denied)
+		}
+		if !denied {
+			continue
+		}
+		if len(referrals.denied) != 1 || referrals.denied[0].From != types.StatusPending || referrals.denied[0].Reason != referrerDenialReason {
+			t.Errorf("expected the request vouched for by %q to be denied with a reason, got %v", referrer, referrals.denied)
+		}
+		if !reflect.DeepEqual(templates, []string{"referrer.html"}) {
+			t.Errorf("expected the applicant to be told, got %v", templates)
+		}
+	}
+
+	if err := ValidateReferrer(types.WhitelistRequest{Username: "Steve"}); err == nil {
+		t.Error("expected a referrer to be required")
+	}
+	if err := ValidateReferrer(types.WhitelistRequest{Username: "Steve", ReferrerUsername: "STEVE"}); err == nil {
+		t.Error("expected applicants not to vouch for themselves")
+	}
+	if err := ValidateReferrer(types.WhitelistRequest{Username: "Steve", ReferrerUsername: "not a player"}); err == nil {
+		t.Error("expected an invalid referrer to be rejected")
+	}
+	if err := ValidateReferrer(types.WhitelistRequest{Username: "Steve", ReferrerUsername: "Alex"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAttachmentsShownToOps(t *testing.T) {
+	viper.Set("passphrase", "passphrase")
+	defer viper.Set("apiURL", nil)
+	var data map[string]interface{}
+	w := &Worker{
+		logger: logrus.New().WithField("origin", "worker"),
+		sendMail: func(templateName string, templateData interface{}, subject string, recipent string) error {
+			data = templateData.(map[string]interface{})
+			return nil
+		},
+	}
+	key := "0123456789abcdef0123456789abcdef.png"
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "Steve", Status: types.StatusPending, Attachments: []string{key}}
+	// Sent without the links if they can not be signed
+	if _, _, err := w.emailToOps(request, []string{"op1@gmail.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data["attachments"]; ok {
+		t.Errorf("expected no links without apiURL, got %v", data["attachments"])
+	}
+	viper.Set("apiURL", "https://api.example.com")
+	if _, _, err := w.emailToOps(request, []string{"op1@gmail.com"}); err != nil {
+		t.Fatal(err)
+	}
+	links, _ := data["attachments"].([]string)
+	if len(links) != 1 || !strings.HasPrefix(links[0], "https://api.example.com/api/v1/attachments/") {
+		t.Fatalf("expected the signed link of the attachment in the ops email, got %v", data["attachments"])
+	}
+	token := strings.TrimPrefix(links[0], "https://api.example.com/api/v1/attachments/")
+	if signed, err := utils.VerifyAttachmentToken(token); err != nil || signed != key {
+		t.Errorf("expected the link to be signed for the attachment, got %q %v", signed, err)
+	}
+}
+
+type fakeOpProfiles struct {
+	profiles []types.OpProfile
+}
+
+func (f *fakeOpProfiles) GetOpProfiles() ([]types.OpProfile, error) {
+	return f.profiles, nil
+}
+
+func (f *fakeOpProfiles) SeedOpProfiles(profiles []types.OpProfile) (bool, error) {
+	if len(f.profiles) > 0 {
+		return false, nil
+	}
+	f.profiles = profiles
+	return len(profiles) > 0, nil
+}
+
+type fakeChat struct {
+	sent []string
+}
+
+func (f *fakeChat) Send(text string) error {
+	f.sent = append(f.sent, text)
+	return nil
+}
+
+func TestOpProfiles(t *testing.T) {
+	defer viper.Set("ops", nil)
+	viper.Set("ops", []interface{}{"op1@gmail.com", "Op2@gmail.com"})
+	store := &fakeOpProfiles{}
+	chat := &fakeChat{}
+	w := &Worker{
+		logger:     logrus.New().WithField("origin", "worker"),
+		opProfiles: store,
+		opChats:    func(chatID string) alerter { return chat },
+	}
+
+	// The ops config is used until there are profiles
+	ops, err := w.opsOf(tenant.Default)
+	if err != nil || len(ops) != 2 {
+		t.Fatalf("expected the configured ops, got %v %v", ops, err)
+	}
+	w.seedOpProfiles()
+	if len(store.profiles) != 2 || store.profiles[1].Email != "op2@gmail.com" || !store.profiles[1].HandlesTenant("") {
+		t.Fatalf("expected the ops config to be seeded, got %v", store.profiles)
+	}
+	store.profiles = []types.OpProfile{
+		{Email: "op3@gmail.com", Tenants: []string{""}, TelegramChatID: "42",
+			Notifications: map[string][]string{types.OpEventRequest: {types.OpChannelTelegram}, types.OpEventComment: {}}},
+		{Email: "op1@gmail.com", Tenants: []string{""}, Digest: true},
+		{Email: "op2@gmail.com", Tenants: []string{"other"}},
+	}
+	// Once there are profiles they replace the ops config
+	w.seedOpProfiles()
+	if len(store.profiles) != 3 {
+		t.Fatalf("expected the profiles to be kept, got %v", store.profiles)
+	}
+	ops, _ = w.opsOf(tenant.Default)
+	if len(ops) != 2 || ops[0].Email != "op1@gmail.com" || ops[1].Email != "op3@gmail.com" {
+		t.Fatalf("expected the ops of the profiles handling the tenant, got %v", ops)
+	}
+	profiles := w.profilesByOp()
+	if kept := withoutDigestOps([]string{"op1@gmail.com", "op3@gmail.com"}, profiles); len(kept) != 1 || kept[0] != "op3@gmail.com" {
+		t.Errorf("expected the digest op to be left out, got %v", kept)
+	}
+	if kept := withoutDigestOps([]string{"op1@gmail.com"}, profiles); len(kept) != 1 {
+		t.Errorf("expected every op to be kept if all opted into the digest, got %v", kept)
+	}
+
+	emailed := 0
+	email := func() error { emailed++; return nil }
+	text := func() string { return "New request" }
+	if notified, _ := w.notifyOp(profiles, types.OpEventRequest, "op3@gmail.com", email, text); !notified || emailed != 0 ||
+		len(chat.sent) != 1 {
+		t.Errorf("expected the op to be notified through Telegram only, got %d emails %v", emailed, chat.sent)
+	}
+	if notified, _ := w.notifyOp(profiles, types.OpEventComment, "op3@gmail.com", email, text); notified || emailed != 0 {
+		t.Error("expected the muted event not to be sent")
+	}
+	if notified, _ := w.notifyOp(profiles, types.OpEventReview, "OP3@gmail.com", email, text); !notified || emailed != 1 {
+		t.Error("expected the op to be emailed by default")
+	}
+	// Emailed instead without a bot
+	w.opChats = nil
+	if notified, _ := w.notifyOp(profiles, types.OpEventRequest, "op3@gmail.com", email, text); !notified || emailed != 2 ||
+		len(chat.sent) != 1 {
+		t.Errorf("expected the op to be emailed without a bot, got %d emails", emailed)
+	}
+}
@@ -2,7 +2,7 @@ package worker_test
 
 import (
 	"context"
-	"sync"
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -12,7 +12,11 @@ import (
 	"github.com/tywin1104/mc-gatekeeper/cache"
 	"github.com/tywin1104/mc-gatekeeper/db"
 	"github.com/tywin1104/mc-gatekeeper/server/sse"
+	"github.com/tywin1104/mc-gatekeeper/tenant"
+	"github.com/tywin1104/mc-gatekeeper/topology"
+	"github.com/tywin1104/mc-gatekeeper/types"
 	"github.com/tywin1104/mc-gatekeeper/worker"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -20,6 +24,7 @@ import (
 var log = logrus.New()
 var rabbitCloseError chan *amqp.Error
 var testWorker *worker.Worker
+var dbSvc *db.Service
 
 func TestMain(m *testing.M) {
 	// Mock the main application using the test configuration file
@@ -39,20 +44,25 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		log.Fatal("Unable to connect to mongodb: " + err.Error())
 	}
-	dbSvc := db.NewService(client)
+	dbSvc = db.NewService(client)
 	serverLogger := log.WithField("origin", "server")
 	sseServer := sse.NewServer(serverLogger)
 	cache := cache.NewService(dbSvc, sseServer)
 	workerLogger := log.WithField("origin", "worker")
 	rabbitCloseError = make(chan *amqp.Error)
-	testWorker, err = worker.NewWorker(dbSvc, cache, workerLogger, rabbitCloseError)
+	// The test environment runs dry, no game server is needed
+	executor, err := worker.NewRCONExecutor(workerLogger)
+	if err != nil {
+		log.Fatal("Unable to start worker: " + err.Error())
+	}
+	testWorker, err = worker.NewWorker(dbSvc, cache, workerLogger, rabbitCloseError, executor)
+	if err != nil {
+		log.Fatal("Unable to start worker: " + err.Error())
+	}
+	err = testWorker.Start()
 	if err != nil {
 		log.Fatal("Unable to start worker: " + err.Error())
 	}
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go testWorker.Start(&wg)
-	wg.Wait()
 	defer testWorker.Close()
 	m.Run()
 }
@@ -73,3 +83,89 @@ func TestWorkerReconnect(t *testing.T) {
 		t.Error("RabbitMQ connection and channel do not change after reconnect")
 	}
 }
+
+func getRequest(t *testing.T, request types.WhitelistRequest) types.WhitelistRequest {
+	requests, err := dbSvc.GetRequests(1, bson.M{"_id": request.ID})
+	if err != nil || len(requests) == 0 {
+		t.Fatalf("Unable to get request %s: %v", request.ID.Hex(), err)
+	}
+	return requests[0]
+}
+
+func TestParkAndReleaseWithoutOps(t *testing.T) {
+	ops := viper.Get("ops")
+	defer viper.Set("ops", ops)
+	viper.Set("ops", []interface{}{})
+
+	request := types.WhitelistRequest{
+		Username:  "parkeduser",
+		Email:     "parkeduser@gmail.com",
+		Status:    types.StatusPending,
+		Timestamp: time.Now(),
+	}
+	var err error
+	request.ID, err = dbSvc.CreateRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbSvc.DeleteRequest(request.ID)
+	body, _ := json.Marshal(request)
+	headers := amqp.Table{}
+	types.SignMessage(headers, body, time.Now(), viper.GetString("passphrase"))
+	// Published like the broker does, on a channel of its own
+	ch, err := testWorker.GetConn().Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	err = ch.Publish("", topology.FromConfig().TaskQueue, false, false, amqp.Publishing{
+		Headers:     headers,
+		ContentType: "application/json",
+		Body:        body,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	// Without ops the request is parked instead of being dead-lettered
+	if parked := getRequest(t, request); !parked.AwaitingOps || parked.Status != types.StatusPending {
+		t.Fatalf("Expected request to await ops configuration, got %+v", parked)
+	}
+	// Nothing is released while ops are still missing from the config
+	if !worker.NoOpsConfigured(tenant.Default) {
+		t.Fatal("Expected no ops to be configured")
+	}
+
+	// Ops are configured through a config reload
+	viper.Set("ops", []interface{}{"op1@gmail.com"})
+	released, err := testWorker.ReleaseParkedRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released != 1 {
+		t.Errorf("Expected 1 released request, got %d", released)
+	}
+	time.Sleep(2 * time.Second)
+	if releasedRequest := getRequest(t, request); releasedRequest.AwaitingOps {
+		t.Errorf("Expected request to be released, got %+v", releasedRequest)
+	}
+	// A second sweep has nothing left to release
+	released, err = testWorker.ReleaseParkedRequests()
+	if err != nil || released != 0 {
+		t.Errorf("Expected nothing left to release, got %d %v", released, err)
+	}
+}
+
+func TestWorkerReconnectOnChannelError(t *testing.T) {
+	oldChannel := testWorker.GetChannel()
+	// Publishing to a missing exchange closes the channel while the connection stays open
+	err := oldChannel.Publish("missing.exchange", "", false, false, amqp.Publishing{Body: []byte("{}")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Short wait for the reconnection to be established
+	time.Sleep(3 * time.Second)
+	if testWorker.GetChannel() == oldChannel {
+		t.Error("RabbitMQ channel does not change after a channel level error")
+	}
+}